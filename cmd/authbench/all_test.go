@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/httpapi"
+)
+
+func init() {
+	hashers["test"] = &auth.BcryptHasher{Cost: 4}
+}
+
+// runRows runs a command line, and returns the rows of the table by operation.
+func runRows(t *testing.T, args ...string) (map[string][]string, string) {
+	var out bytes.Buffer
+	err := run(args, &out)
+	assert.Equal(t, nil, err, "should success")
+	rows := map[string][]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 8 {
+			rows[fields[0]] = fields
+		}
+	}
+	return rows, out.String()
+}
+
+func TestMix(t *testing.T) {
+	{
+		m, err := parseMix("check=3, invalidate=1")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, mix{0, 3, 1}, m, "should leave out operations with a weight of 0")
+		assert.Equal(t, opCheck, m.pick(0), "should pick by weight")
+		assert.Equal(t, opCheck, m.pick(2), "should pick by weight")
+		assert.Equal(t, opInvalidate, m.pick(3), "should pick by weight")
+	}
+	for _, s := range []string{"", "check", "check=-1", "check=0", "login=1"} {
+		_, err := parseMix(s)
+		assert.Equal(t, errUsage, err, "should reject "+s)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	assert.Equal(t, time.Duration(0), h.quantile(0.5), "should be 0 when empty")
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Microsecond)
+	}
+	var other histogram
+	other.add(time.Second)
+	h.merge(&other)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want := q * 1001 * float64(time.Microsecond)
+		got := float64(h.quantile(q))
+		assert.Equal(t, true, got > 0.97*want && got < 1.03*want, "should be within 3%")
+	}
+	assert.Equal(t, time.Second, h.quantile(1), "should not exceed the max")
+	assert.Equal(t, time.Second, h.max(), "should keep the max")
+	assert.Equal(t, 1919, histIndex(^uint64(0)), "should fit any duration")
+	assert.Equal(t, 1230*time.Microsecond, round(1234567*time.Nanosecond), "should round to 3 digits")
+}
+
+func TestRun(t *testing.T) {
+	flags := []string{"-users", "5", "-concurrency", "2", "-duration", "200ms"}
+	{
+		rows, out := runRows(t, append(flags, "-hasher", "test")...)
+		for _, op := range []string{"authenticate", "check", "invalidate"} {
+			assert.NotEqual(t, "0", rows[op][1], "should run "+op)
+			assert.Equal(t, "0", rows[op][2], "should not fail")
+		}
+		assert.Equal(t, true, strings.Contains(out, "heap:"), "should measure the heap")
+	}
+
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	admin, _ := svr.CreateUser("admin", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.GrantPermissionToRole(rid, "auth:admin")
+	svr.AddRoleToUser(admin, rid)
+	token, _ := svr.Authenticate("admin", "passw0rd")
+	ts := httptest.NewServer(httpapi.NewHandler(svr, &httpapi.Options{AdminPermission: "auth:admin"}))
+	defer ts.Close()
+	for i := 0; i < 2; i++ {
+		// Again on the users of the first run
+		rows, out := runRows(t, append(flags, "-url", ts.URL, "-token", string(token), "-mix", "authenticate=1,check=1")...)
+		assert.NotEqual(t, "0", rows["check"][1], "should run remotely")
+		assert.Equal(t, "0", rows["check"][2], "should not fail")
+		assert.Equal(t, "0", rows["invalidate"][1], "should follow the mix")
+		assert.Equal(t, false, strings.Contains(out, "heap:"), "should not measure the heap remotely")
+	}
+	{
+		assert.Equal(t, errUsage, run([]string{"-hasher", "md5"}, &bytes.Buffer{}), "should check the hasher")
+		assert.Equal(t, errUsage, run([]string{"-users", "0"}, &bytes.Buffer{}), "should check the users")
+		err := run(append(flags, "-url", ts.URL), &bytes.Buffer{})
+		assert.Equal(t, "setup: missing bearer token", err.Error(), "should report the errors of the setup")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// errDenied counts checks that fail, as the users of the setup hold the role.
+var errDenied = errors.New("role not held")
+
+// load is what runLoad runs.
+type load struct {
+	users       int
+	role        auth.RoleID
+	mix         mix
+	concurrency int
+	duration    time.Duration
+}
+
+// result is the outcome of runLoad.
+type result struct {
+	elapsed time.Duration
+	ops     [numOps]opStats
+	mem     *memStats // in-process only
+}
+
+type opStats struct {
+	count, errors uint64
+	latency       histogram
+}
+
+// runLoad runs the workers until the duration is over, and merges their stats.
+func runLoad(t target, l *load) *result {
+	stats := make([]result, l.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(l.duration)
+	for i := range stats {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(deadline)
+		}(&worker{target: t, load: l, stats: &stats[i], rand: rand.New(rand.NewSource(start.UnixNano() + int64(i)))})
+	}
+	wg.Wait()
+
+	res := &result{elapsed: time.Since(start)}
+	for i := range stats {
+		for o := range res.ops {
+			res.ops[o].count += stats[i].ops[o].count
+			res.ops[o].errors += stats[i].ops[o].errors
+			res.ops[o].latency.merge(&stats[i].ops[o].latency)
+		}
+	}
+	return res
+}
+
+// worker draws operations from the mix, on a session of its own.
+type worker struct {
+	target
+	*load
+	stats *result
+	rand  *rand.Rand
+	token auth.TokenValue // empty once invalidated
+}
+
+func (w *worker) run(deadline time.Time) {
+	// The first login is not measured, as every worker logs in at once
+	w.token, _ = w.Authenticate(userName(w.rand.Intn(w.users)), password)
+	total := w.mix.total()
+	for time.Now().Before(deadline) {
+		o := w.mix.pick(w.rand.Intn(total))
+		if o != opAuthenticate && w.token == "" {
+			o = opAuthenticate
+		}
+		start := time.Now()
+		var err error
+		switch o {
+		case opAuthenticate:
+			var token auth.TokenValue
+			if token, err = w.Authenticate(userName(w.rand.Intn(w.users)), password); err == nil {
+				// The previous session is left to expire
+				w.token = token
+			}
+		case opCheck:
+			var ok bool
+			if ok, err = w.CheckRole(w.token, w.role); err == nil && !ok {
+				err = errDenied
+			}
+		case opInvalidate:
+			err = w.Invalidate(w.token)
+			w.token = ""
+		}
+		s := &w.stats.ops[o]
+		s.latency.add(time.Since(start))
+		s.count++
+		if err != nil {
+			s.errors++
+		}
+	}
+}
+
+// print writes the stats of each operation, and of all of them, as a table, and the growth of the
+// heap.
+func (r *result) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OP\tCOUNT\tERRORS\tRATE/S\tP50\tP90\tP99\tMAX")
+	var all opStats
+	row := func(name string, s *opStats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\n", name, s.count, s.errors,
+			float64(s.count)/r.elapsed.Seconds(), s.latency.quantile(0.5), s.latency.quantile(0.9),
+			s.latency.quantile(0.99), s.latency.max())
+	}
+	for o := range r.ops {
+		s := &r.ops[o]
+		row(opNames[o], s)
+		all.count += s.count
+		all.errors += s.errors
+		all.latency.merge(&s.latency)
+	}
+	row("total", &all)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if m := r.mem; m != nil {
+		growth := int64(m.after) - int64(m.before)
+		fmt.Fprintf(w, "\nheap: %s before, %s after (%+.1f MiB), %s peak", mib(m.before), mib(m.after),
+			float64(growth)/(1<<20), mib(m.peak))
+		if n := r.ops[opAuthenticate].count; n > 0 {
+			fmt.Fprintf(w, ", %d B per authenticate", growth/int64(n))
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+	return nil
+}
+
+func mib(b uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(b)/(1<<20))
+}
+
+// *-* Histogram *-*
+
+// histogram counts latencies in log-linear buckets: exact under 64ns, and then 32 per power of 2,
+// within 3%. It takes 15 KiB whatever the count, so the workers do not keep every sample.
+type histogram struct {
+	counts [histBuckets]uint64
+	n      uint64
+	top    time.Duration
+}
+
+const histBuckets = 32*58 + 64
+
+func histIndex(v uint64) int {
+	if v < 64 {
+		return int(v)
+	}
+	e := bits.Len64(v) - 6 // v>>e is in [32, 64)
+	return 32*e + int(v>>e)
+}
+
+// histValue is the middle of a bucket.
+func histValue(i int) time.Duration {
+	if i < 64 {
+		return time.Duration(i)
+	}
+	e := uint(i/32 - 1)
+	return time.Duration(uint64(i%32+32)<<e + uint64(1)<<e/2)
+}
+
+func (h *histogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histIndex(uint64(d))]++
+	h.n++
+	if d > h.top {
+		h.top = d
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	if o.top > h.top {
+		h.top = o.top
+	}
+}
+
+// quantile gives the latency under which a fraction q of the operations completed, to 3 significant
+// digits, or 0 without any.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank >= h.n {
+		return round(h.top)
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			if v := histValue(i); v < h.top {
+				return round(v)
+			}
+			break
+		}
+	}
+	return round(h.top)
+}
+
+func (h *histogram) max() time.Duration {
+	return round(h.top)
+}
+
+// round rounds a latency to 3 significant digits.
+func round(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d >= 1000*unit {
+		unit *= 10
+	}
+	return d.Round(unit)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// local is a server of its own, on a MemoryStorage.
+type local struct {
+	svr *auth.Server
+}
+
+func newLocal(hasher auth.PasswordHasher) (*local, error) {
+	svr, err := auth.New(auth.WithHasher(hasher))
+	if err != nil {
+		return nil, err
+	}
+	return &local{svr: svr}, nil
+}
+
+func (l *local) Setup(users int, password string) (auth.RoleID, error) {
+	f := auth.Fixture{Roles: []auth.RoleSpec{{Name: roleName}}, Users: make([]auth.FixtureUser, users)}
+	for i := range f.Users {
+		f.Users[i] = auth.FixtureUser{Name: userName(i), Password: password, Roles: []string{roleName}}
+	}
+	if _, err := l.svr.Seed(&f); err != nil {
+		return 0, err
+	}
+	r := l.svr.GetRoleByName(roleName)
+	if r == nil {
+		return 0, auth.ErrRoleNotExist
+	}
+	return r.ID, nil
+}
+
+func (l *local) Authenticate(name, password string) (auth.TokenValue, error) {
+	return l.svr.Authenticate(name, password)
+}
+
+func (l *local) CheckRole(token auth.TokenValue, role auth.RoleID) (bool, error) {
+	return l.svr.CheckRole(token, role)
+}
+
+func (l *local) Invalidate(token auth.TokenValue) error {
+	l.svr.Invalidate(token)
+	return nil
+}
+
+func (l *local) Close() error {
+	return l.svr.Close(context.Background())
+}
+
+// roleName is the role of the users of the setup, named by userName.
+const roleName = "authbench"
+
+func userName(i int) string {
+	return fmt.Sprintf("authbench-%d", i)
+}
@@ -0,0 +1,250 @@
+// Command authbench load-tests an auth server with a mix of logins, role checks and logouts, for
+// capacity planning:
+//
+//	authbench -duration 30s -concurrency 16 -mix authenticate=1,check=20,invalidate=1
+//	authbench -url https://auth.example.com -token $ADMIN_TOKEN -users 1000
+//
+// Without -url, the server runs in-process on a MemoryStorage, with the password hasher of -hasher
+// at its default cost. With -url, it is reached over the JSON API of lib/httpapi, and -token (or
+// the AUTHBENCH_TOKEN environment variable) must grant its AdminPermission for the setup.
+//
+// The setup creates -users users named authbench-<n>, holding the role authbench, unless they
+// exist. Each worker then logs in as a random user, and draws operations from the mix until
+// -duration is over:
+//
+//	authenticate  logs in as a random user, keeping the token, so sessions pile up as in production
+//	check         checks that the user of the token holds the role
+//	invalidate    logs out, after which the next check logs in first, as an authenticate
+//
+// authbench prints the throughput, errors and latency percentiles of each operation (within 3%), and
+// in-process, the growth of the heap, sampled every second.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// target is the server under test, in-process or remote.
+type target interface {
+	Authenticate(name, password string) (auth.TokenValue, error)
+	CheckRole(token auth.TokenValue, role auth.RoleID) (bool, error)
+	Invalidate(token auth.TokenValue) error
+	// Setup creates the users, as many as told, holding a role, and returns it.
+	Setup(users int, password string) (auth.RoleID, error)
+	Close() error
+}
+
+// password is that of the users of the setup.
+const password = "authbench-passw0rd"
+
+var errUsage = errors.New("usage")
+
+const usage = `usage: authbench [-url URL [-token TOKEN]] [flags]
+
+flags:
+  -url URL           base URL of the HTTP API; in-process if not set
+  -token TOKEN       bearer token for the HTTP API, to create the users
+  -hasher NAME       in-process password hasher: argon2id, bcrypt or scrypt (default argon2id)
+  -users N           users to log in as (default 100)
+  -concurrency N     workers (default 8)
+  -duration D        how long to run (default 10s)
+  -mix MIX           weights of the operations (default authenticate=1,check=8,invalidate=1)
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "authbench:", err)
+		os.Exit(1)
+	}
+}
+
+// run carries out the command line args.
+//
+// Errors: errUsage, or any error of the setup
+func run(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("authbench", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	url := fs.String("url", "", "base URL of the HTTP API")
+	token := fs.String("token", os.Getenv("AUTHBENCH_TOKEN"), "bearer token for the HTTP API")
+	hasher := fs.String("hasher", "argon2id", "in-process password hasher")
+	users := fs.Int("users", 100, "users to log in as")
+	concurrency := fs.Int("concurrency", 8, "workers")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run")
+	mixFlag := fs.String("mix", "authenticate=1,check=8,invalidate=1", "weights of the operations")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	m, err := parseMix(*mixFlag)
+	if err != nil || *users < 1 || *concurrency < 1 || *duration <= 0 {
+		return errUsage
+	}
+
+	var t target
+	if *url != "" {
+		t = newRemote(*url, *token, *concurrency)
+	} else {
+		h, ok := hashers[*hasher]
+		if !ok {
+			return errUsage
+		}
+		if t, err = newLocal(h); err != nil {
+			return err
+		}
+	}
+	defer t.Close()
+	role, err := t.Setup(*users, password)
+	if err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+
+	var mem *memSampler
+	if _, ok := t.(*local); ok {
+		mem = startMemSampler(time.Second)
+	}
+	res := runLoad(t, &load{users: *users, role: role, mix: m, concurrency: *concurrency, duration: *duration})
+	if mem != nil {
+		res.mem = mem.stop()
+	}
+	return res.print(stdout)
+}
+
+var hashers = map[string]auth.PasswordHasher{
+	"argon2id": &auth.Argon2idHasher{},
+	"bcrypt":   &auth.BcryptHasher{},
+	"scrypt":   &auth.ScryptHasher{},
+}
+
+// *-* Mix *-*
+
+type op int
+
+const (
+	opAuthenticate op = iota
+	opCheck
+	opInvalidate
+	numOps
+)
+
+var opNames = [numOps]string{"authenticate", "check", "invalidate"}
+
+// mix holds the weights of the operations.
+type mix [numOps]int
+
+// parseMix parses weights such as "authenticate=1,check=8,invalidate=1". Operations left out have
+// a weight of 0, and at least one must have more.
+//
+// Errors: errUsage
+func parseMix(s string) (mix, error) {
+	var m mix
+	total := 0
+	for _, item := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(item, "=")
+		w, err := strconv.Atoi(weight)
+		if !ok || err != nil || w < 0 {
+			return m, errUsage
+		}
+		found := false
+		for i, n := range opNames {
+			if n == strings.TrimSpace(name) {
+				m[i], found = w, true
+			}
+		}
+		if !found {
+			return m, errUsage
+		}
+		total += w
+	}
+	if total == 0 {
+		return m, errUsage
+	}
+	return m, nil
+}
+
+// pick draws an operation, n being uniform in [0, sum of the weights).
+func (m *mix) pick(n int) op {
+	for i, w := range m {
+		if n < w {
+			return op(i)
+		}
+		n -= w
+	}
+	return numOps - 1
+}
+
+func (m *mix) total() int {
+	total := 0
+	for _, w := range m {
+		total += w
+	}
+	return total
+}
+
+// *-* Memory *-*
+
+// memSampler samples the heap of this process, for the in-process server.
+type memSampler struct {
+	before uint64
+	peak   uint64
+	done   chan struct{}
+	result chan memStats
+}
+
+type memStats struct {
+	before, after, peak uint64 // live heap, in bytes
+}
+
+func heapAlloc(gc bool) uint64 {
+	if gc {
+		runtime.GC()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+func startMemSampler(interval time.Duration) *memSampler {
+	s := &memSampler{done: make(chan struct{}), result: make(chan memStats, 1)}
+	s.before = heapAlloc(true)
+	s.peak = s.before
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if h := heapAlloc(false); h > s.peak {
+					s.peak = h
+				}
+			case <-s.done:
+				after := heapAlloc(true)
+				if after > s.peak {
+					s.peak = after
+				}
+				s.result <- memStats{before: s.before, after: after, peak: s.peak}
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// stop ends the sampling, and measures the heap after a GC, which leaves what the server keeps.
+func (s *memSampler) stop() *memStats {
+	close(s.done)
+	m := <-s.result
+	return &m
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// remote is a server reached over the HTTP API of lib/httpapi.
+type remote struct {
+	base   string
+	token  string // for the setup
+	client *http.Client
+}
+
+func newRemote(base, token string, concurrency int) *remote {
+	// A connection per worker, rather than the 2 idle ones kept by default
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = concurrency
+	return &remote{
+		base:   strings.TrimRight(base, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// call sends a request with a body (JSON unless it is a []byte, if not nil) and a bearer token (if
+// not empty), and decodes the JSON response into out (if not nil).
+//
+// Errors: the error reported by the API, or any error from the client
+func (c *remote) call(method, path, token string, in, out interface{}) error {
+	var body io.Reader
+	if b, ok := in.([]byte); ok {
+		body = bytes.NewReader(b)
+	} else if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		// Drained, so that the connection is reused
+		_, err := io.Copy(io.Discard, res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Setup imports the users, which hashes their passwords in parallel, then assigns them the role with
+// an apply, which also creates it.
+func (c *remote) Setup(users int, password string) (auth.RoleID, error) {
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	spec := auth.Spec{Roles: []auth.RoleSpec{{Name: roleName}}, Users: make([]auth.UserSpec, users)}
+	for i := range spec.Users {
+		enc.Encode(auth.UserRecord{Name: userName(i), Password: password})
+		spec.Users[i] = auth.UserSpec{Name: userName(i), Roles: []string{roleName}}
+	}
+	var imported struct {
+		Failed []struct {
+			Error string `json:"error"`
+		} `json:"failed"`
+	}
+	if err := c.call(http.MethodPost, "/users/import", c.token, lines.Bytes(), &imported); err != nil {
+		return 0, err
+	}
+	for _, f := range imported.Failed {
+		// Created by an earlier run
+		if f.Error != auth.ErrUserExists.Error() {
+			return 0, errors.New(f.Error)
+		}
+	}
+	if err := c.call(http.MethodPost, "/apply", c.token, &spec, nil); err != nil {
+		return 0, err
+	}
+
+	var roles struct {
+		Roles []struct {
+			ID   auth.RoleID `json:"id"`
+			Name string      `json:"name"`
+		} `json:"roles"`
+	}
+	if err := c.call(http.MethodGet, "/roles?sort=name&prefix="+roleName, c.token, nil, &roles); err != nil {
+		return 0, err
+	}
+	for _, r := range roles.Roles {
+		if r.Name == roleName {
+			return r.ID, nil
+		}
+	}
+	return 0, auth.ErrRoleNotExist
+}
+
+func (c *remote) Authenticate(name, password string) (auth.TokenValue, error) {
+	var res struct {
+		Token auth.TokenValue `json:"token"`
+	}
+	in := map[string]string{"username": name, "password": password}
+	if err := c.call(http.MethodPost, "/auth/login", "", in, &res); err != nil {
+		return "", err
+	}
+	if res.Token == "" {
+		// e.g. {"mfa_required"}
+		return "", auth.ErrUnsupported
+	}
+	return res.Token, nil
+}
+
+func (c *remote) CheckRole(token auth.TokenValue, role auth.RoleID) (bool, error) {
+	var res struct {
+		Allowed bool `json:"allowed"`
+	}
+	in := map[string]auth.RoleID{"role_id": role}
+	if err := c.call(http.MethodPost, "/auth/check", string(token), in, &res); err != nil {
+		return false, err
+	}
+	return res.Allowed, nil
+}
+
+func (c *remote) Invalidate(token auth.TokenValue) error {
+	return c.call(http.MethodPost, "/auth/logout", string(token), nil, nil)
+}
+
+func (c *remote) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/walstore"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/httpapi"
+)
+
+var testConfig = &auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}
+
+// runOut runs a command line with the given stdin, and returns its output.
+func runOut(stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+// testCommands runs the commands shared by both backends. login issues a token for a user, and
+// gives its ID.
+func testCommands(t *testing.T, flags []string, login func(name, password string) string) {
+	cmd := func(stdin string, args ...string) (string, error) {
+		return runOut(stdin, append(append([]string{}, flags...), args...)...)
+	}
+	{
+		out, err := cmd("passw0rd\n", "user", "create", "anna")
+		assert.Equal(t, nil, err, "should success")
+		assert.NotEqual(t, "", strings.TrimSpace(out), "should print the ID")
+		_, err = cmd("passw0rd", "user", "create", "belle")
+		assert.Equal(t, nil, err, "should read a password without a newline")
+		_, err = cmd("short\n", "user", "create", "cara")
+		assert.Equal(t, auth.ErrWeakPassword.Error(), err.Error(), "should report the error")
+		out, _ = cmd("", "user", "list")
+		assert.Equal(t, true, strings.HasPrefix(out, "ID"), "should list the users under a header")
+		assert.Equal(t, true, strings.Contains(out, "anna") && strings.Contains(out, "belle"), "should list the users")
+		assert.Equal(t, false, strings.Contains(out, "cara"), "should not create users with a weak password")
+		out, _ = cmd("", "user", "list", "an")
+		assert.Equal(t, false, strings.Contains(out, "belle"), "should filter by prefix")
+	}
+	{
+		_, err := cmd("", "role", "create", "clerk")
+		assert.Equal(t, nil, err, "should success")
+		_, err = cmd("", "role", "grant", "clerk", "orders:*")
+		assert.Equal(t, nil, err, "should success")
+		_, err = cmd("", "role", "revoke", "clerk", "orders:*")
+		assert.Equal(t, nil, err, "should success")
+		_, err = cmd("", "role", "grant", "auditor", "orders:read")
+		assert.Equal(t, auth.ErrRoleNotExist.Error(), err.Error(), "should check the role")
+	}
+	{
+		id := login("anna", "passw0rd")
+		out, err := cmd("", "token", "list", "anna")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, strings.Contains(out, id), "should list the tokens")
+		_, err = cmd("", "token", "revoke", "anna", id)
+		assert.Equal(t, nil, err, "should success")
+		out, _ = cmd("", "token", "list", "anna")
+		assert.Equal(t, false, strings.Contains(out, id), "should revoke the token")
+	}
+	{
+		_, err := cmd("", "user", "delete", "belle")
+		assert.Equal(t, nil, err, "should success")
+		_, err = cmd("", "user", "delete", "belle")
+		assert.Equal(t, auth.ErrUserNotExist.Error(), err.Error(), "should not find deleted users")
+	}
+	{
+		_, err := cmd("", "user", "rename", "anna")
+		assert.Equal(t, errUsage, err, "should reject unknown commands")
+		_, err = cmd("", "role", "grant", "clerk")
+		assert.Equal(t, errUsage, err, "should check the arguments")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	testCommands(t, []string{"-dir", dir}, func(name, password string) string {
+		svr, store, _ := walstore.NewWALServer(testConfig, dir, nil)
+		defer store.Close()
+		svr.Authenticate(name, password)
+		tokens, _ := svr.ListTokens(svr.GetUserByName(name).ID)
+		return tokens[0].ID
+	})
+
+	snap := filepath.Join(t.TempDir(), "snap.json")
+	_, err := runOut("", "-dir", dir, "snapshot", "save", snap)
+	assert.Equal(t, nil, err, "should success")
+	runOut("", "-dir", dir, "user", "delete", "anna")
+	_, err = runOut("", "-dir", dir, "snapshot", "load", snap)
+	assert.Equal(t, nil, err, "should success")
+	out, _ := runOut("", "-dir", dir, "user", "list", "anna")
+	assert.Equal(t, true, strings.Contains(out, "active"), "should restore the snapshot")
+}
+
+func TestRemote(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(testConfig)
+	admin, _ := svr.CreateUser("admin", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.GrantPermissionToRole(rid, "auth:admin")
+	svr.AddRoleToUser(admin, rid)
+	token, _ := svr.Authenticate("admin", "passw0rd")
+	ts := httptest.NewServer(httpapi.NewHandler(svr, &httpapi.Options{AdminPermission: "auth:admin"}))
+	defer ts.Close()
+
+	testCommands(t, []string{"-url", ts.URL, "-token", string(token)}, func(name, password string) string {
+		svr.Authenticate(name, password)
+		tokens, _ := svr.ListTokens(svr.GetUserByName(name).ID)
+		return tokens[0].ID
+	})
+	{
+		_, err := runOut("", "-url", ts.URL, "user", "list")
+		assert.Equal(t, "missing bearer token", err.Error(), "should report the error of the API")
+		_, err = runOut("", "-url", ts.URL, "-token", string(token), "snapshot", "save", filepath.Join(t.TempDir(), "snap.json"))
+		assert.Equal(t, errNoRemote, err, "should not support snapshots")
+		_, err = runOut("", "user", "list")
+		assert.Equal(t, errUsage, err, "should require a backend")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/walstore"
+)
+
+// local runs commands on a server of its own, over a walstore directory.
+type local struct {
+	svr   *auth.Server
+	store *walstore.Store
+}
+
+func openLocal(dir string) (*local, error) {
+	// Tokens are only listed and revoked, so their lifetime does not matter
+	svr, store, err := walstore.NewWALServer(&auth.ServerConfig{TokenExpireSec: 3600}, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &local{svr: svr, store: store}, nil
+}
+
+func (l *local) user(name string) (*auth.User, error) {
+	u := l.svr.GetUserByName(name)
+	if u == nil {
+		return nil, auth.ErrUserNotExist
+	}
+	return u, nil
+}
+
+func (l *local) role(name string) (*auth.Role, error) {
+	r := l.svr.GetRoleByName(name)
+	if r == nil {
+		return nil, auth.ErrRoleNotExist
+	}
+	return r, nil
+}
+
+func (l *local) CreateUser(name, password string) (auth.UserID, error) {
+	return l.svr.CreateUser(name, password)
+}
+
+func (l *local) DeleteUser(name string) error {
+	u, err := l.user(name)
+	if err != nil {
+		return err
+	}
+	return l.svr.DeleteUser(u.ID)
+}
+
+func (l *local) ListUsers(prefix string) ([]userEntry, error) {
+	var list []userEntry
+	opts := auth.ListOptions{Prefix: prefix, Limit: auth.MaxListLimit}
+	for {
+		users, next, err := l.svr.ListUsers(&opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			e := userEntry{ID: u.ID, Name: u.Name, Status: "active"}
+			if u.Deleted != nil {
+				e.Status = "deleted"
+			} else if u.Status == auth.UserSuspended {
+				e.Status = "suspended"
+			}
+			list = append(list, e)
+		}
+		if next == "" {
+			return list, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+func (l *local) CreateRole(name string) (auth.RoleID, error) {
+	return l.svr.CreateRole(name)
+}
+
+func (l *local) GrantPermission(role, perm string) error {
+	r, err := l.role(role)
+	if err != nil {
+		return err
+	}
+	return l.svr.GrantPermissionToRole(r.ID, perm)
+}
+
+func (l *local) RevokePermission(role, perm string) error {
+	r, err := l.role(role)
+	if err != nil {
+		return err
+	}
+	return l.svr.RevokePermissionFromRole(r.ID, perm)
+}
+
+func (l *local) ListTokens(user string) ([]auth.TokenInfo, error) {
+	u, err := l.user(user)
+	if err != nil {
+		return nil, err
+	}
+	return l.svr.ListTokens(u.ID)
+}
+
+func (l *local) RevokeToken(user, id string) error {
+	u, err := l.user(user)
+	if err != nil {
+		return err
+	}
+	return l.svr.InvalidateToken(u.ID, id)
+}
+
+func (l *local) SaveSnapshot(w io.Writer) error {
+	return l.store.Save(w, false)
+}
+
+func (l *local) LoadSnapshot(r io.Reader) error {
+	return l.store.Load(r)
+}
+
+func (l *local) Close() error {
+	return l.store.Close()
+}
@@ -0,0 +1,206 @@
+// Command authctl administers an auth server from the command line, for operators who do not want
+// to write Go.
+//
+//	authctl -url https://auth.example.com -token $ADMIN_TOKEN user list
+//	authctl -dir /var/lib/auth role grant clerk orders:read
+//
+// With -url, it talks to the JSON API of lib/httpapi, with a bearer token (-token, or the
+// AUTHCTL_TOKEN environment variable) granting its AdminPermission. With -dir, it opens the
+// write-ahead log directory of a lib/auth/walstore in-process, which only works while the server
+// is not running, as only one process may open it.
+//
+// Commands:
+//
+//	user create NAME             password read from the first line of stdin
+//	user delete NAME
+//	user list [PREFIX]
+//	role create NAME
+//	role grant ROLE PERMISSION
+//	role revoke ROLE PERMISSION
+//	token list USER
+//	token revoke USER TOKEN_ID
+//	snapshot save FILE           with -dir only, tokens left out
+//	snapshot load FILE           with -dir only, replaces everything
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// backend is where commands are carried out: in-process, or over the HTTP API.
+type backend interface {
+	CreateUser(name, password string) (auth.UserID, error)
+	DeleteUser(name string) error
+	ListUsers(prefix string) ([]userEntry, error)
+	CreateRole(name string) (auth.RoleID, error)
+	GrantPermission(role, perm string) error
+	RevokePermission(role, perm string) error
+	ListTokens(user string) ([]auth.TokenInfo, error)
+	RevokeToken(user, id string) error
+	SaveSnapshot(w io.Writer) error
+	LoadSnapshot(r io.Reader) error
+	Close() error
+}
+
+type userEntry struct {
+	ID     auth.UserID
+	Name   string
+	Status string // "active", "suspended" or "deleted"
+}
+
+var (
+	errUsage    = errors.New("usage")
+	errNoRemote = errors.New("snapshots need -dir, the HTTP API does not expose them")
+)
+
+const usage = `usage: authctl (-url URL [-token TOKEN] | -dir DIR) COMMAND ARGS...
+
+commands:
+  user create NAME             password read from the first line of stdin
+  user delete NAME
+  user list [PREFIX]
+  role create NAME
+  role grant ROLE PERMISSION
+  role revoke ROLE PERMISSION
+  token list USER
+  token revoke USER TOKEN_ID
+  snapshot save FILE           with -dir only
+  snapshot load FILE           with -dir only
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "authctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run carries out the command line args.
+//
+// Errors: errUsage, or any error of the command
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("authctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	url := fs.String("url", "", "base URL of the HTTP API")
+	token := fs.String("token", os.Getenv("AUTHCTL_TOKEN"), "bearer token for the HTTP API")
+	dir := fs.String("dir", "", "walstore directory, opened in-process")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	args = fs.Args()
+	if len(args) < 2 || (*url == "") == (*dir == "") {
+		return errUsage
+	}
+
+	var b backend
+	if *url != "" {
+		b = newRemote(*url, *token)
+	} else {
+		var err error
+		if b, err = openLocal(*dir); err != nil {
+			return err
+		}
+	}
+	err := runCommand(b, args, stdin, stdout)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runCommand(b backend, args []string, stdin io.Reader, stdout io.Writer) error {
+	cmd, args := args[0]+" "+args[1], args[2:]
+	want := map[string]int{
+		"user create": 1, "user delete": 1, "user list": -1,
+		"role create": 1, "role grant": 2, "role revoke": 2,
+		"token list": 1, "token revoke": 2,
+		"snapshot save": 1, "snapshot load": 1,
+	}
+	n, ok := want[cmd]
+	if !ok || (n >= 0 && len(args) != n) || (n < 0 && len(args) > 1) {
+		return errUsage
+	}
+
+	switch cmd {
+	case "user create":
+		password, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		id, err := b.CreateUser(args[0], strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, id)
+	case "user delete":
+		return b.DeleteUser(args[0])
+	case "user list":
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		users, err := b.ListUsers(prefix)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSTATUS")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", u.ID, u.Name, u.Status)
+		}
+		return tw.Flush()
+	case "role create":
+		id, err := b.CreateRole(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, id)
+	case "role grant":
+		return b.GrantPermission(args[0], args[1])
+	case "role revoke":
+		return b.RevokePermission(args[0], args[1])
+	case "token list":
+		tokens, err := b.ListTokens(args[0])
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tISSUED\tEXPIRES\tIP")
+		for _, t := range tokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.Issued.Format(time.RFC3339), t.Expires.Format(time.RFC3339), t.Client.IP)
+		}
+		return tw.Flush()
+	case "token revoke":
+		return b.RevokeToken(args[0], args[1])
+	case "snapshot save":
+		// Buffered, so that a failed save leaves no partial file
+		var buf bytes.Buffer
+		if err := b.SaveSnapshot(&buf); err != nil {
+			return err
+		}
+		return os.WriteFile(args[0], buf.Bytes(), 0o600)
+	case "snapshot load":
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return b.LoadSnapshot(f)
+	}
+	return nil
+}
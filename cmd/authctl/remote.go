@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// remote runs commands over the HTTP API of lib/httpapi.
+type remote struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newRemote(base, token string) *remote {
+	return &remote{base: strings.TrimRight(base, "/"), token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// call sends a request with a JSON body (if in is not nil), and decodes the JSON response into out
+// (if not nil).
+//
+// Errors: the error reported by the API, or any error from the client
+func (c *remote) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&e) != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type userItem struct {
+	ID        auth.UserID `json:"id"`
+	Name      string      `json:"name"`
+	Suspended bool        `json:"suspended"`
+	Deleted   *time.Time  `json:"deleted"`
+}
+
+// listUsers gets every user whose name starts with prefix.
+func (c *remote) listUsers(prefix string) ([]userItem, error) {
+	var all []userItem
+	q := url.Values{"prefix": {prefix}, "limit": {fmt.Sprint(auth.MaxListLimit)}}
+	for {
+		var page struct {
+			Users []userItem `json:"users"`
+			Next  string     `json:"next"`
+		}
+		if err := c.call("GET", "/users?"+q.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Users...)
+		if page.Next == "" {
+			return all, nil
+		}
+		q.Set("cursor", page.Next)
+	}
+}
+
+// userID looks up a user by name, as the API refers to users by ID. Deleted users are left out.
+func (c *remote) userID(name string) (auth.UserID, error) {
+	users, err := c.listUsers(name)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		if u.Name == name && u.Deleted == nil {
+			return u.ID, nil
+		}
+	}
+	return 0, auth.ErrUserNotExist
+}
+
+// roleID looks up a role by name.
+func (c *remote) roleID(name string) (auth.RoleID, error) {
+	q := url.Values{"prefix": {name}, "limit": {fmt.Sprint(auth.MaxListLimit)}}
+	for {
+		var page struct {
+			Roles []struct {
+				ID   auth.RoleID `json:"id"`
+				Name string      `json:"name"`
+			} `json:"roles"`
+			Next string `json:"next"`
+		}
+		if err := c.call("GET", "/roles?"+q.Encode(), nil, &page); err != nil {
+			return 0, err
+		}
+		for _, r := range page.Roles {
+			if r.Name == name {
+				return r.ID, nil
+			}
+		}
+		if page.Next == "" {
+			return 0, auth.ErrRoleNotExist
+		}
+		q.Set("cursor", page.Next)
+	}
+}
+
+func (c *remote) CreateUser(name, password string) (auth.UserID, error) {
+	var res struct {
+		ID auth.UserID `json:"id"`
+	}
+	err := c.call("POST", "/users", map[string]string{"name": name, "password": password}, &res)
+	return res.ID, err
+}
+
+func (c *remote) DeleteUser(name string) error {
+	id, err := c.userID(name)
+	if err != nil {
+		return err
+	}
+	return c.call("DELETE", fmt.Sprintf("/users/%d", id), nil, nil)
+}
+
+func (c *remote) ListUsers(prefix string) ([]userEntry, error) {
+	users, err := c.listUsers(prefix)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]userEntry, len(users))
+	for i, u := range users {
+		list[i] = userEntry{ID: u.ID, Name: u.Name, Status: "active"}
+		if u.Deleted != nil {
+			list[i].Status = "deleted"
+		} else if u.Suspended {
+			list[i].Status = "suspended"
+		}
+	}
+	return list, nil
+}
+
+func (c *remote) CreateRole(name string) (auth.RoleID, error) {
+	var res struct {
+		ID auth.RoleID `json:"id"`
+	}
+	err := c.call("POST", "/roles", map[string]string{"name": name}, &res)
+	return res.ID, err
+}
+
+func (c *remote) GrantPermission(role, perm string) error {
+	id, err := c.roleID(role)
+	if err != nil {
+		return err
+	}
+	return c.call("POST", fmt.Sprintf("/roles/%d/permissions", id), map[string]string{"permission": perm}, nil)
+}
+
+func (c *remote) RevokePermission(role, perm string) error {
+	id, err := c.roleID(role)
+	if err != nil {
+		return err
+	}
+	return c.call("DELETE", fmt.Sprintf("/roles/%d/permissions/%s", id, url.PathEscape(perm)), nil, nil)
+}
+
+func (c *remote) ListTokens(user string) ([]auth.TokenInfo, error) {
+	id, err := c.userID(user)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Tokens []struct {
+			ID      string    `json:"id"`
+			Issued  time.Time `json:"issued"`
+			Expires time.Time `json:"expires"`
+			IP      string    `json:"ip"`
+		} `json:"tokens"`
+	}
+	if err := c.call("GET", fmt.Sprintf("/users/%d/tokens", id), nil, &res); err != nil {
+		return nil, err
+	}
+	list := make([]auth.TokenInfo, len(res.Tokens))
+	for i, t := range res.Tokens {
+		list[i] = auth.TokenInfo{ID: t.ID, Issued: t.Issued, Expires: t.Expires, Client: auth.ClientInfo{IP: t.IP}}
+	}
+	return list, nil
+}
+
+func (c *remote) RevokeToken(user, tokenID string) error {
+	id, err := c.userID(user)
+	if err != nil {
+		return err
+	}
+	return c.call("DELETE", fmt.Sprintf("/users/%d/tokens/%s", id, url.PathEscape(tokenID)), nil, nil)
+}
+
+func (c *remote) SaveSnapshot(io.Writer) error {
+	return errNoRemote
+}
+
+func (c *remote) LoadSnapshot(io.Reader) error {
+	return errNoRemote
+}
+
+func (c *remote) Close() error {
+	return nil
+}
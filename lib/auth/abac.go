@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var ErrInvalidAttribute = newError("invalid_attribute", http.StatusBadRequest, "invalid attribute")
+
+// Attributes are typed values by name, for attribute-based access control: those of a user (e.g.
+// "department", "clearance", "region", see SetUserAttribute) and those of a request (see
+// WithAttributes). Values are strings, bools, int64s, float64s or []strings, and keep their type
+// through the storage.
+type Attributes map[string]interface{}
+
+// normalizeAttribute converts a value to one of the types of Attributes.
+func normalizeAttribute(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string, bool, int64, float64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case float32:
+		return float64(v), true
+	case []string:
+		return append([]string(nil), v...), true
+	}
+	return nil, false
+}
+
+// String returns the named string attribute, or "" if it is not a string.
+func (a Attributes) String(key string) string {
+	v, _ := a[key].(string)
+	return v
+}
+
+// Bool returns the named bool attribute, or false if it is not a bool.
+func (a Attributes) Bool(key string) bool {
+	v, _ := a[key].(bool)
+	return v
+}
+
+// Int returns the named int64 attribute, or 0 if it is not an int64.
+func (a Attributes) Int(key string) int64 {
+	v, _ := a[key].(int64)
+	return v
+}
+
+// Float returns the named number attribute as a float64, or 0 if it is not a number.
+func (a Attributes) Float(key string) float64 {
+	switch v := a[key].(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+// Strings returns the named []string attribute, or nil if it is not a []string.
+func (a Attributes) Strings(key string) []string {
+	v, _ := a[key].([]string)
+	return v
+}
+
+func (a Attributes) clone() Attributes {
+	if a == nil {
+		return nil
+	}
+	c := make(Attributes, len(a))
+	for k, v := range a {
+		c[k], _ = normalizeAttribute(v)
+	}
+	return c
+}
+
+// UnmarshalJSON decodes numbers without a fraction as int64 and lists as []string, so that the
+// values keep the types they were set with.
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*a = nil
+		return nil
+	}
+	res := make(Attributes, len(raw))
+	for k, msg := range raw {
+		msg = bytes.TrimSpace(msg)
+		if len(msg) > 0 && msg[0] == '[' {
+			var list []string
+			if err := json.Unmarshal(msg, &list); err != nil {
+				return err
+			}
+			res[k] = list
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if v, err = n.Float64(); err != nil {
+				return err
+			}
+		}
+		res[k] = v
+	}
+	*a = res
+	return nil
+}
+
+// SetUserAttribute sets an attribute of a user. value is a string, bool, integer, float or
+// []string; integers are stored as int64 and floats as float64.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrInvalidAttribute if the key is empty or the type unsupported
+func (s *Server) SetUserAttribute(user UserID, key string, value interface{}) (err error) {
+	s, sp := s.trace("auth.SetUserAttribute")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	value, ok := normalizeAttribute(value)
+	if key == "" || !ok {
+		return ErrInvalidAttribute
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	userObj = userObj.clone()
+	if userObj.Attributes == nil {
+		userObj.Attributes = make(Attributes)
+	}
+	userObj.Attributes[key] = value
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// RemoveUserAttribute removes an attribute of a user. It is a no-op if the user does not have it.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) RemoveUserAttribute(user UserID, key string) (err error) {
+	s, sp := s.trace("auth.RemoveUserAttribute")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, ok := userObj.Attributes[key]; !ok {
+		return nil
+	}
+	userObj = userObj.clone()
+	delete(userObj.Attributes, key)
+	if len(userObj.Attributes) == 0 {
+		userObj.Attributes = nil
+	}
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// *-* Policies *-*
+
+// Subject is the user a policy is evaluated for.
+type Subject struct {
+	User UserID
+	Name string
+	// Roles are the roles of the user, including those of its groups, within the scope of the
+	// token, in ascending order.
+	Roles      []RoleID
+	RoleNames  []string   // of the Roles, in ascending order
+	Attributes Attributes // of the user, read-only
+}
+
+// HasRole tells if the subject has a role.
+func (sub *Subject) HasRole(role RoleID) bool {
+	i := sort.Search(len(sub.Roles), func(i int) bool { return sub.Roles[i] >= role })
+	return i < len(sub.Roles) && sub.Roles[i] == role
+}
+
+// Environment is the context of the request a policy is evaluated for.
+type Environment struct {
+	Time       time.Time
+	Attributes Attributes // of the request, see WithAttributes; read-only
+}
+
+// Policy decides on access from the attributes of the subject and of the request, see Evaluate.
+type Policy interface {
+	Allow(sub *Subject, env *Environment) (bool, error)
+}
+
+// PolicyFunc is a Policy written as a function, e.g.
+//
+//	auth.PolicyFunc(func(sub *auth.Subject, env *auth.Environment) (bool, error) {
+//		return sub.Attributes.Int("clearance") >= 3 && sub.Attributes.String("region") == env.Attributes.String("region"), nil
+//	})
+type PolicyFunc func(sub *Subject, env *Environment) (bool, error)
+
+func (f PolicyFunc) Allow(sub *Subject, env *Environment) (bool, error) {
+	return f(sub, env)
+}
+
+type attributesKey struct{}
+
+// WithAttributes returns a context carrying the attributes of a request (e.g. the resource, the
+// action or the region of the client), for the policies evaluated by a server bound to it with
+// Server.WithContext.
+func WithAttributes(ctx context.Context, attrs Attributes) context.Context {
+	return context.WithValue(ctx, attributesKey{}, attrs)
+}
+
+// Evaluate evaluates a policy for the user identified by the token, with the attributes of the
+// request in the context of the server, if any (see WithAttributes). The user attributes are looked
+// up at the time of the evaluation, in JWT mode too. The policy is called without any lock held, so
+// it may call the server.
+//
+// Returns: the decision of the policy
+// Errors: ErrInvalidToken, or any error of the policy
+func (s *Server) Evaluate(token TokenValue, policy Policy) (ok bool, err error) {
+	s, sp := s.trace("auth.Evaluate")
+	defer func() { sp.check(ok, err) }()
+	sub, err := s.subject(token)
+	if err != nil {
+		return false, err
+	}
+	attrs, _ := s.ctx.Value(attributesKey{}).(Attributes)
+	return policy.Allow(sub, &Environment{Time: s.now(), Attributes: attrs})
+}
+
+// subject describes the user identified by a token, for Evaluate.
+func (s *Server) subject(token TokenValue) (*Subject, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, scope, err := s.verifyScoped(token)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := s.scopedRoles(userObj, scope)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		roleObj, err := s.store.GetRole(s.ctx, role)
+		if err == ErrRoleNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, roleObj.Name)
+	}
+	sort.Strings(names)
+	return &Subject{User: userObj.ID, Name: userObj.Name, Roles: roles, RoleNames: names, Attributes: userObj.Attributes.clone()}, nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttributes(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	{
+		assert.Equal(t, ErrInvalidAttribute, svr.SetUserAttribute(uid, "", "x"), "should reject empty keys")
+		assert.Equal(t, ErrInvalidAttribute, svr.SetUserAttribute(uid, "manager", uid), "should reject unsupported types")
+		assert.Equal(t, ErrUserNotExist, svr.SetUserAttribute(uid+10, "region", "eu"), "should check the user")
+		assert.Equal(t, nil, svr.SetUserAttribute(uid, "region", "eu"), "should success")
+		assert.Equal(t, nil, svr.SetUserAttribute(uid, "clearance", 3), "should success")
+		svr.SetUserAttribute(uid, "contractor", false)
+		svr.SetUserAttribute(uid, "score", 0.5)
+		svr.SetUserAttribute(uid, "teams", []string{"payments"})
+		attrs := svr.GetUser(uid).Attributes
+		assert.Equal(t, int64(3), attrs["clearance"], "should store integers as int64")
+		assert.Equal(t, "eu", attrs.String("region"), "should get strings")
+		assert.Equal(t, int64(3), attrs.Int("clearance"), "should get integers")
+		assert.Equal(t, 3.0, attrs.Float("clearance"), "should get integers as floats")
+		assert.Equal(t, []string{"payments"}, attrs.Strings("teams"), "should get lists")
+		assert.Equal(t, "", attrs.String("clearance"), "should ignore other types")
+
+		data, _ := json.Marshal(attrs)
+		var decoded Attributes
+		assert.Equal(t, nil, json.Unmarshal(data, &decoded), "should success")
+		assert.Equal(t, attrs, decoded, "should keep the types through JSON")
+
+		assert.Equal(t, nil, svr.RemoveUserAttribute(uid, "score"), "should success")
+		assert.Equal(t, nil, svr.RemoveUserAttribute(uid, "score"), "should be a no-op the second time")
+		_, ok := svr.GetUser(uid).Attributes["score"]
+		assert.Equal(t, false, ok, "should remove the attribute")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("analyst")
+	svr.AddRoleToUser(uid, rid)
+	svr.SetUserAttribute(uid, "region", "eu")
+	svr.SetUserAttribute(uid, "clearance", 3)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	sameRegion := PolicyFunc(func(sub *Subject, env *Environment) (bool, error) {
+		return sub.HasRole(rid) && sub.Attributes.Int("clearance") >= 2 &&
+			sub.Attributes.String("region") == env.Attributes.String("region"), nil
+	})
+	{
+		ctx := WithAttributes(context.Background(), Attributes{"region": "eu"})
+		ok, err := svr.WithContext(ctx).Evaluate(token, sameRegion)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should allow matching attributes")
+		ctx = WithAttributes(context.Background(), Attributes{"region": "us"})
+		ok, _ = svr.WithContext(ctx).Evaluate(token, sameRegion)
+		assert.Equal(t, false, ok, "should deny other attributes")
+		ok, _ = svr.Evaluate(token, sameRegion)
+		assert.Equal(t, false, ok, "should evaluate without request attributes")
+	}
+	{
+		svr.RemoveRoleFromUser(uid, rid)
+		ctx := WithAttributes(context.Background(), Attributes{"region": "eu"})
+		ok, _ := svr.WithContext(ctx).Evaluate(token, sameRegion)
+		assert.Equal(t, false, ok, "should look up the roles at the time of the evaluation")
+		_, err := svr.Evaluate("invalid", sameRegion)
+		assert.Equal(t, ErrInvalidToken, err, "should check the token")
+		failing := errors.New("unavailable")
+		_, err = svr.Evaluate(token, PolicyFunc(func(*Subject, *Environment) (bool, error) { return true, failing }))
+		assert.Equal(t, failing, err, "should return the error of the policy")
+	}
+}
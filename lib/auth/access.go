@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+)
+
+var (
+	ErrPolicyNotExist = newError("policy_not_exist", http.StatusNotFound, "policy does not exist")
+	ErrInvalidPolicy  = newError("invalid_policy", http.StatusBadRequest, "invalid policy")
+)
+
+// PolicyCompiler compiles the source of the policies of CheckAccess, see ServerConfig.Policies.
+// CompileExpression is the default; lib/authcel compiles CEL.
+type PolicyCompiler interface {
+	// Compile compiles a policy. Errors should match ErrInvalidPolicy with errors.Is.
+	Compile(src string) (Policy, error)
+}
+
+// AccessInput is what CheckAccess decides on.
+type AccessInput struct {
+	Policy string // name of the policy
+	// Attributes are those of the request, e.g. the action and the resource. If nil, those of the
+	// context of the server are taken, see WithAttributes.
+	Attributes Attributes
+}
+
+// namedPolicy is a compiled policy, with its source.
+type namedPolicy struct {
+	src    string
+	policy Policy
+}
+
+// compilePolicies compiles the policies of a config with compiler.
+func compilePolicies(compiler PolicyCompiler, sources map[string]string) (map[string]namedPolicy, error) {
+	policies := make(map[string]namedPolicy, len(sources))
+	for name, src := range sources {
+		if name == "" {
+			return nil, ErrInvalidConfig
+		}
+		policy, err := compiler.Compile(src)
+		if err != nil {
+			return nil, err
+		}
+		policies[name] = namedPolicy{src: src, policy: policy}
+	}
+	return policies, nil
+}
+
+// SetPolicy compiles a policy and saves it under a name for CheckAccess, replacing any policy of
+// the same name. Policies are kept by the server, not the storage: those that must survive a
+// restart belong in ServerConfig.Policies.
+//
+// Returns: none
+// Errors: ErrInvalidPolicy if the name is empty, or any error of the PolicyCompiler (a *PolicyError
+// for expressions)
+func (s *Server) SetPolicy(name, src string) (err error) {
+	s, sp := s.trace("auth.SetPolicy")
+	defer func() { sp.end(err) }()
+	if name == "" {
+		return ErrInvalidPolicy
+	}
+	policy, err := s.cfg.PolicyCompiler.Compile(src)
+	if err != nil {
+		return err
+	}
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.policies[name] = namedPolicy{src: src, policy: policy}
+	return nil
+}
+
+// RemovePolicy removes a policy saved by SetPolicy or given in ServerConfig.Policies.
+//
+// Returns: none
+// Errors: ErrPolicyNotExist
+func (s *Server) RemovePolicy(name string) (err error) {
+	s, sp := s.trace("auth.RemovePolicy")
+	defer func() { sp.end(err) }()
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if _, ok := s.policies[name]; !ok {
+		return ErrPolicyNotExist
+	}
+	delete(s.policies, name)
+	return nil
+}
+
+// Policies lists the names of the policies of the server.
+//
+// Returns: the names in ascending order
+func (s *Server) Policies() []string {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	names := make([]string, 0, len(s.policies))
+	for name := range s.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PolicySource returns the source of a policy.
+//
+// Returns: the source, or "" and false if there is no such policy
+func (s *Server) PolicySource(name string) (string, bool) {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	p, ok := s.policies[name]
+	return p.src, ok
+}
+
+// CheckAccess evaluates the named policy for the user identified by the token, as Evaluate does,
+// with the attributes of the input. Policies are compiled once, by SetPolicy or NewServer, so
+// checks only evaluate them.
+//
+// Returns: the decision of the policy
+// Errors: ErrPolicyNotExist, ErrInvalidToken, or any error of the policy (a *PolicyError for
+// expressions on values of the wrong type)
+func (s *Server) CheckAccess(token TokenValue, input *AccessInput) (ok bool, err error) {
+	s, sp := s.trace("auth.CheckAccess")
+	defer func() { sp.check(ok, err) }()
+	s.policyMu.RLock()
+	p, found := s.policies[input.Policy]
+	s.policyMu.RUnlock()
+	if !found {
+		return false, ErrPolicyNotExist
+	}
+
+	sub, err := s.subject(token)
+	if err != nil {
+		return false, err
+	}
+	attrs := input.Attributes
+	if attrs == nil {
+		attrs, _ = s.ctx.Value(attributesKey{}).(Attributes)
+	}
+	return p.policy.Allow(sub, &Environment{Time: s.now(), Attributes: attrs})
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressions(t *testing.T) {
+	sub := &Subject{User: 7, Name: "anna", Roles: []RoleID{1, 2}, RoleNames: []string{"analyst", "staff"},
+		Attributes: Attributes{"region": "eu", "clearance": int64(3), "score": 0.5, "teams": []string{"payments"}}}
+	env := &Environment{Time: time.Date(2023, 3, 6, 14, 0, 0, 0, time.UTC), Attributes: Attributes{"region": "eu", "amount": int64(250)}}
+	eval := func(src string) (bool, error) {
+		policy, err := CompileExpression(src)
+		if err != nil {
+			return false, err
+		}
+		return policy.Allow(sub, env)
+	}
+	{
+		for _, src := range []string{
+			`true`,
+			`"analyst" in subject.roles && 2 in subject.role_ids`,
+			`subject.attributes.clearance >= 3 && subject.attributes.region == request.region`,
+			`subject.attributes.score < 1 && subject.attributes.clearance == 3.0`,
+			`!(subject.name != 'anna') && subject.id == 7`,
+			`"payments" in subject.attributes.teams && size(subject.attributes.teams) == 1`,
+			`!has(subject.attributes.manager) && has(request.amount)`,
+			`env.hour >= 9 && env.hour < 17 && env.weekday == 1 && env.time > 0`,
+			`startsWith(subject.name, "an") && request.amount in [100, 250]`,
+			`false || subject.attributes.missing == null`,
+		} {
+			ok, err := eval(src)
+			assert.Equal(t, nil, err, "should evaluate "+src)
+			assert.Equal(t, true, ok, "should allow "+src)
+		}
+		for _, src := range []string{
+			`subject.attributes.missing > 1`,
+			`"admin" in subject.roles`,
+			`false && subject.attributes.region`,
+			`subject.attributes.region != "eu" || request.amount > 1000`,
+		} {
+			ok, err := eval(src)
+			assert.Equal(t, nil, err, "should evaluate "+src)
+			assert.Equal(t, false, ok, "should deny "+src)
+		}
+	}
+	{
+		for _, src := range []string{``, `subject.password == "x"`, `user.id == 1`, `true &&`, `(true`, `len(subject.name) > 1`,
+			`has("x")`, `"unterminated`, `subject.id = 1`, `true false`} {
+			_, err := CompileExpression(src)
+			assert.Equal(t, true, errors.Is(err, ErrInvalidPolicy), "should not compile "+src)
+		}
+		_, err := CompileExpression(`true && subject.nme == "anna"`)
+		assert.Equal(t, &PolicyError{Pos: 8, Msg: `unknown variable "subject.nme"`}, err, "should locate the error")
+		for _, src := range []string{`subject.name`, `subject.name > 1`, `!subject.id`, `subject.id in subject.name`, `false || size(1) > 0`} {
+			_, err := eval(src)
+			assert.Equal(t, true, errors.Is(err, ErrInvalidPolicy), "should fail to evaluate "+src)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	_, err := New(WithConfig(&ServerConfig{TokenExpireSec: 60, Policies: map[string]string{"bad": "true &&"}}))
+	assert.Equal(t, true, errors.Is(err, ErrInvalidPolicy), "should compile the policies of the config")
+
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, Hasher: fastHasher, Policies: map[string]string{
+		"refund": `"support" in subject.roles && request.amount <= subject.attributes.refund_limit`,
+	}}))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("support")
+	svr.AddRoleToUser(uid, rid)
+	svr.SetUserAttribute(uid, "refund_limit", 500)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		ok, err := svr.CheckAccess(token, &AccessInput{Policy: "refund", Attributes: Attributes{"amount": int64(120)}})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should allow by the policy")
+		ok, _ = svr.CheckAccess(token, &AccessInput{Policy: "refund", Attributes: Attributes{"amount": int64(900)}})
+		assert.Equal(t, false, ok, "should deny by the policy")
+		_, err = svr.CheckAccess(token, &AccessInput{Policy: "delete"})
+		assert.Equal(t, ErrPolicyNotExist, err, "should check the policy")
+		_, err = svr.CheckAccess("invalid", &AccessInput{Policy: "refund"})
+		assert.Equal(t, ErrInvalidToken, err, "should check the token")
+	}
+	{
+		assert.Equal(t, true, errors.Is(svr.SetPolicy("refund", "request.amount <"), ErrInvalidPolicy), "should compile the policy")
+		src, _ := svr.PolicySource("refund")
+		assert.Equal(t, `"support" in subject.roles && request.amount <= subject.attributes.refund_limit`, src, "should keep the policy on errors")
+		assert.Equal(t, ErrInvalidPolicy, svr.SetPolicy("", "true"), "should reject empty names")
+		assert.Equal(t, nil, svr.SetPolicy("refund", "request.amount < 100"), "should success")
+		assert.Equal(t, nil, svr.SetPolicy("read", "true"), "should success")
+		ok, _ := svr.CheckAccess(token, &AccessInput{Policy: "refund", Attributes: Attributes{"amount": int64(120)}})
+		assert.Equal(t, false, ok, "should replace the policy")
+		assert.Equal(t, []string{"read", "refund"}, svr.Policies(), "should list the policies")
+		assert.Equal(t, nil, svr.RemovePolicy("read"), "should success")
+		assert.Equal(t, ErrPolicyNotExist, svr.RemovePolicy("read"), "should check the policy")
+	}
+}
@@ -1,253 +1,886 @@
-package auth
-
-import (
-	"testing"
-	"time"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestNewInMemoryServer(t *testing.T) {
-	var nilServer *InMemoryServer
-	{
-		svr, err := NewInMemoryServer(nil)
-		assert.Equal(t, nilServer, svr, "should return nil if config is nil")
-		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if config is nil")
-	}
-	{
-		svr, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 59})
-		assert.Equal(t, nilServer, svr, "should return nil if TokenExpireSec is too short")
-		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if TokenExpireSec is too short")
-	}
-	{
-		cfg := &InMemoryServerConfig{
-			TokenExpireSec: 7200,
-		}
-		svr, err := NewInMemoryServer(cfg)
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, UserID(1), svr.nextUser, "IDs should start from 1")
-		assert.Equal(t, RoleID(1), svr.nextRole, "IDs should start from 1")
-
-		cfg.TokenExpireSec = 3600
-		assert.Equal(t, int32(7200), svr.cfg.TokenExpireSec, "once initialized, config should not be externally changed")
-	}
-}
-
-func TestCreateUser(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	{
-		_, err := svr.CreateUser("dummy", "")
-		assert.Equal(t, ErrWeakPassword, err, "should disallow empty password")
-	}
-	{
-		id, err := svr.CreateUser("anna", "passw0rd")
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, &User{
-			ID:     id,
-			Name:   "anna",
-			Secret: getPasswordHash("passw0rd"),
-			Roles:  map[RoleID]*Role{},
-		}, svr.GetUserByName("anna"), "should create the user anna")
-	}
-	{
-		_, err := svr.CreateUser("anna", "passw1rd")
-		assert.Equal(t, ErrUserExists, err, "should not create another user with the same name")
-	}
-	{
-		id, err := svr.CreateUser("belle", "passw2rd")
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, UserID(2), id, "user ID should increment")
-	}
-}
-
-func TestDeleteUser(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	id, _ := svr.CreateUser("phoebe", "weakpswd")
-	{
-		err := svr.DeleteUser(101)
-		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist if attempted to delete a nonexistent user")
-	}
-	{
-		err := svr.DeleteUser(id)
-		assert.Equal(t, nil, err, "should success")
-	}
-	{
-		err := svr.DeleteUser(id)
-		assert.Equal(t, ErrUserNotExist, err, "should not be able to repeatedly delete a user")
-	}
-}
-
-func TestCreateRole(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	{
-		id, err := svr.CreateRole("fuseblk")
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, &Role{
-			ID:   id,
-			Name: "fuseblk",
-		}, svr.GetRoleByName("fuseblk"), "should create the role fuseblk")
-	}
-	{
-		_, err := svr.CreateRole("fuseblk")
-		assert.Equal(t, ErrRoleExists, err, "should not create another role with the same name")
-	}
-	{
-		id, err := svr.CreateRole("plugdev")
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, RoleID(2), id, "role ID should increment")
-	}
-}
-
-func TestDeleteRole(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	id, _ := svr.CreateRole("scanner")
-	{
-		err := svr.DeleteRole(101)
-		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist if attempted to delete a nonexistent group")
-	}
-	{
-		err := svr.DeleteRole(id)
-		assert.Equal(t, nil, err, "should success")
-	}
-	{
-		err := svr.DeleteRole(id)
-		assert.Equal(t, ErrRoleNotExist, err, "should not be able to repeatedly delete a role")
-	}
-}
-
-func TestAddRoleToUser(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("phoebe", "weakpswd")
-	rid, _ := svr.CreateRole("scanner")
-	{
-		err := svr.AddRoleToUser(uid, 101)
-		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist")
-		err = svr.AddRoleToUser(101, rid)
-		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
-	}
-	{
-		err := svr.AddRoleToUser(uid, rid)
-		assert.Equal(t, nil, err, "should success")
-		user := svr.GetUser(uid)
-		assert.Equal(t, map[RoleID]*Role{
-			1: {ID: 1, Name: "scanner"},
-		}, user.Roles, "should have the scanner role")
-	}
-}
-
-func TestAuthenticate(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("fred", "addtssnbzq")
-	{
-		_, err := svr.Authenticate("cara", "")
-		assert.Equal(t, ErrInvalidAuth, err, "should fail if user not found")
-	}
-	{
-		_, err := svr.Authenticate("fred", "whhhrqddjs")
-		assert.Equal(t, ErrInvalidAuth, err, "should fail if password is wrong")
-	}
-	{
-		token, err := svr.Authenticate("fred", "addtssnbzq")
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, 12, len(token), "should be a 64-bit base64 token")
-		assert.Equal(t, uid, svr.tokens[token].User, "the token should map to user fred")
-
-		assert.Equal(t, 1, len(svr.tokenQ), "should have 1 epoch")
-		assert.Equal(t, int32(1), svr.tokenQ[0].ServerEpoch, "the server should be at epoch 1")
-		assert.Equal(t, svr.tokens[token], svr.tokenQ[0].Tokens[0], "the token in the queue should match that in the map")
-	}
-}
-
-func TestInvalidate(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("fred", "addtssnbzq")
-	token, _ := svr.Authenticate("fred", "addtssnbzq")
-	var nilToken *Token
-	{
-		assert.Equal(t, uid, svr.tokens[token].User, "the token should map to user fred")
-		svr.Invalidate(token)
-		assert.Equal(t, nilToken, svr.tokens[token], "the token should be invalidated")
-	}
-}
-
-func TestCheckRole(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("elton", "123456")
-	rid, _ := svr.CreateRole("scanner")
-	rid2, _ := svr.CreateRole("plugdev")
-	svr.AddRoleToUser(uid, rid)
-	token, _ := svr.Authenticate("elton", "123456")
-	{
-		_, err := svr.CheckRole("invalid", rid)
-		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
-	}
-	{
-		_, err := svr.CheckRole(token, 101)
-		assert.Equal(t, ErrRoleNotExist, err, "should error on invalid role")
-	}
-	{
-		ret, err := svr.CheckRole(token, rid)
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, true, ret, "should have the role scanner")
-	}
-	{
-		ret, err := svr.CheckRole(token, rid2)
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, false, ret, "should not have the role plugdev")
-	}
-}
-
-func TestAllRoles(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("elton", "123456")
-	rid, _ := svr.CreateRole("scanner")
-	rid2, _ := svr.CreateRole("plugdev")
-	svr.AddRoleToUser(uid, rid)
-	svr.AddRoleToUser(uid, rid2)
-	token, _ := svr.Authenticate("elton", "123456")
-	{
-		_, err := svr.AllRoles("invalid")
-		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
-	}
-	{
-		ret, err := svr.AllRoles(token)
-		assert.Equal(t, nil, err, "should success")
-		assert.Equal(t, 2, len(ret), "should have 2 roles")
-	}
-}
-
-// TestVerifyToken includes cases not covered by TestCheckRole and TestAllRoles, such as removing expired tokens.
-func TestVerifyToken(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
-	uid, _ := svr.CreateUser("elton", "123456")
-	{
-		token, _ := svr.Authenticate("elton", "123456")
-		assert.Equal(t, 1, len(svr.tokens), "the server should have one token")
-		svr.tokens[token].Expires = time.Now().Add(-30 * time.Second) // Manually modify token expiration time to the past
-		_, err := svr.verifyToken(token)
-		assert.Equal(t, ErrInvalidToken, err, "token should expire")
-	}
-	{
-		token, _ := svr.Authenticate("elton", "123456")
-		assert.Equal(t, 1, len(svr.tokens), "the server should have one token")
-		svr.DeleteUser(uid)
-		_, err := svr.verifyToken(token)
-		assert.Equal(t, ErrInvalidToken, err, "token should be invalidated after user removal")
-		assert.Equal(t, 0, len(svr.tokens), "the server should remove the token")
-	}
-}
-
-func TestPruneTokens(t *testing.T) {
-	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 1800})
-	svr.CreateUser("elton", "123456")
-	{
-		svr.Authenticate("elton", "123456")
-		svr.Authenticate("elton", "123456")
-		svr.Authenticate("elton", "123456")
-		assert.Equal(t, 3, len(svr.tokens), "the server should create one token per authentication")
-
-		svr.startedOn = time.Now().Add(-121 * time.Minute) // Two hours passed magically
-		svr.Authenticate("elton", "123456")
-		assert.Equal(t, 1, len(svr.tokens), "the server should remove stale tokens")
-	}
-}
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fastHasher is for tests that hash many passwords. Do not use such parameters in production.
+var fastHasher = &Argon2idHasher{Time: 1, Memory: 64}
+
+// memStore gives access to the internals of the default storage backend.
+func memStore(svr *Server) *MemoryStorage {
+	return svr.baseStore().(*MemoryStorage)
+}
+
+// memTokens gathers the tokens of the shards of the default storage backend.
+func memTokens(svr *Server) map[TokenValue]*Token {
+	tokens := make(map[TokenValue]*Token)
+	for i := range memStore(svr).shards {
+		sh := &memStore(svr).shards[i]
+		sh.mu.RLock()
+		for v, t := range sh.tokens {
+			tokens[v] = t
+		}
+		sh.mu.RUnlock()
+	}
+	return tokens
+}
+
+func TestNewInMemoryServer(t *testing.T) {
+	var nilServer *InMemoryServer
+	{
+		svr, err := NewInMemoryServer(nil)
+		assert.Equal(t, nilServer, svr, "should return nil if config is nil")
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if config is nil")
+	}
+	{
+		svr, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 59})
+		assert.Equal(t, nilServer, svr, "should return nil if TokenExpireSec is too short")
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if TokenExpireSec is too short")
+	}
+	{
+		cfg := &InMemoryServerConfig{
+			TokenExpireSec: 7200,
+		}
+		svr, err := NewInMemoryServer(cfg)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, UserID(1), memStore(svr).nextUser, "IDs should start from 1")
+		assert.Equal(t, RoleID(1), memStore(svr).nextRole, "IDs should start from 1")
+
+		cfg.TokenExpireSec = 3600
+		assert.Equal(t, int32(7200), svr.cfg.TokenExpireSec, "once initialized, config should not be externally changed")
+	}
+	{
+		svr, err := NewServer(&ServerConfig{TokenExpireSec: 60}, nil)
+		assert.Equal(t, nilServer, svr, "should return nil if storage is nil")
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if storage is nil")
+	}
+	{
+		svr, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, PruneIntervalSec: -1})
+		assert.Equal(t, nilServer, svr, "should return nil if PruneIntervalSec is negative")
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if PruneIntervalSec is negative")
+		svr, _ = NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+		assert.Equal(t, int32(3600), svr.cfg.PruneIntervalSec, "epochs should default to 1 hour")
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	{
+		_, err := svr.CreateUser("dummy", "")
+		assert.Equal(t, ErrWeakPassword, err, "should disallow empty password")
+	}
+	{
+		id, err := svr.CreateUser("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should success")
+		user := svr.GetUserByName("anna")
+		ok, _ := (&Argon2idHasher{}).Verify("passw0rd", user.Secret)
+		assert.Equal(t, true, ok, "should hash the password with argon2id")
+		user.Secret = nil
+		assert.Equal(t, &User{
+			ID:    id,
+			Name:  "anna",
+			Roles: map[RoleID]*Role{},
+		}, user, "should create the user anna")
+	}
+	{
+		_, err := svr.CreateUser("anna", "passw1rd")
+		assert.Equal(t, ErrUserExists, err, "should not create another user with the same name")
+	}
+	{
+		id, err := svr.CreateUser("belle", "passw2rd")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, UserID(2), id, "user ID should increment")
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher, PasswordPolicy: &PasswordPolicy{RejectUsername: true}})
+	id, _ := svr.CreateUser("anna", "passw0rd")
+	{
+		err := svr.SetPassword(id, "n3wpass")
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrInvalidAuth, err, "should replace the old password")
+		_, err = svr.Authenticate("anna", "n3wpass")
+		assert.Equal(t, nil, err, "should accept the new password")
+	}
+	{
+		err := svr.SetPassword(id, "anna123")
+		assert.Equal(t, ErrWeakPassword, err, "should enforce the policy with the username")
+		err = svr.SetPassword(101, "n3wpass")
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist for nonexistent users")
+		memStore(svr).InsertUser(context.Background(), &User{Name: "fred", Source: "corp", Roles: map[RoleID]*Role{}})
+		err = svr.SetPassword(svr.GetUserByName("fred").ID, "n3wpass")
+		assert.Equal(t, ErrUnsupported, err, "should not set the password of external users")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	id, _ := svr.CreateUser("phoebe", "weakpswd")
+	{
+		err := svr.DeleteUser(101)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist if attempted to delete a nonexistent user")
+	}
+	{
+		err := svr.DeleteUser(id)
+		assert.Equal(t, nil, err, "should success")
+	}
+	{
+		err := svr.DeleteUser(id)
+		assert.Equal(t, ErrUserNotExist, err, "should not be able to repeatedly delete a user")
+	}
+}
+
+func TestCreateRole(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	{
+		id, err := svr.CreateRole("fuseblk")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, &Role{
+			ID:   id,
+			Name: "fuseblk",
+		}, svr.GetRoleByName("fuseblk"), "should create the role fuseblk")
+	}
+	{
+		_, err := svr.CreateRole("fuseblk")
+		assert.Equal(t, ErrRoleExists, err, "should not create another role with the same name")
+	}
+	{
+		id, err := svr.CreateRole("plugdev")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, RoleID(2), id, "role ID should increment")
+	}
+}
+
+func TestDeleteRole(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	id, _ := svr.CreateRole("scanner")
+	{
+		err := svr.DeleteRole(101)
+		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist if attempted to delete a nonexistent group")
+	}
+	{
+		err := svr.DeleteRole(id)
+		assert.Equal(t, nil, err, "should success")
+	}
+	{
+		err := svr.DeleteRole(id)
+		assert.Equal(t, ErrRoleNotExist, err, "should not be able to repeatedly delete a role")
+	}
+}
+
+func TestAddRoleToUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("phoebe", "weakpswd")
+	rid, _ := svr.CreateRole("scanner")
+	{
+		err := svr.AddRoleToUser(uid, 101)
+		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist")
+		err = svr.AddRoleToUser(101, rid)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
+	}
+	{
+		err := svr.AddRoleToUser(uid, rid)
+		assert.Equal(t, nil, err, "should success")
+		user := svr.GetUser(uid)
+		assert.Equal(t, map[RoleID]*Role{
+			1: {ID: 1, Name: "scanner"},
+		}, user.Roles, "should have the scanner role")
+	}
+}
+
+func TestRemoveRoleFromUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("phoebe", "weakpswd")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.AddRoleToUser(uid, rid)
+	svr.AddRoleToUser(uid, rid2)
+	{
+		err := svr.RemoveRoleFromUser(uid, 101)
+		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist")
+		err = svr.RemoveRoleFromUser(101, rid)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
+	}
+	{
+		err := svr.RemoveRoleFromUser(uid, rid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, map[RoleID]*Role{
+			2: {ID: 2, Name: "plugdev"},
+		}, svr.GetUser(uid).Roles, "should only have the plugdev role")
+		err = svr.RemoveRoleFromUser(uid, rid)
+		assert.Equal(t, nil, err, "should be a no-op if the user does not have the role")
+	}
+}
+
+func TestListUsersWithRole(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("phoebe", "weakpswd")
+	uid2, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid2, rid)
+	svr.AddRoleToUser(uid, rid)
+	{
+		_, err := svr.ListUsersWithRole(101)
+		assert.Equal(t, ErrRoleNotExist, err, "should give ErrRoleNotExist")
+	}
+	{
+		list, err := svr.ListUsersWithRole(rid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []UserID{uid, uid2}, list, "should list both users in order")
+	}
+	{
+		svr.RemoveRoleFromUser(uid, rid)
+		svr.DeleteUser(uid2)
+		list, _ := svr.ListUsersWithRole(rid)
+		assert.Equal(t, []UserID{}, list, "should keep the index up to date")
+		assert.Equal(t, 0, len(memStore(svr).holders), "should not leak empty index entries")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("fred", "addtssnbzq")
+	{
+		_, err := svr.Authenticate("cara", "")
+		assert.Equal(t, ErrInvalidAuth, err, "should fail if user not found")
+	}
+	{
+		_, err := svr.Authenticate("fred", "whhhrqddjs")
+		assert.Equal(t, ErrInvalidAuth, err, "should fail if password is wrong")
+	}
+	{
+		token, err := svr.Authenticate("fred", "addtssnbzq")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 43, len(token), "should be a 256-bit base64url token")
+		assert.Equal(t, uid, memTokens(svr)[token].User, "the token should map to user fred")
+
+		assert.Equal(t, 1, len(svr.tokenQ), "should queue the token for pruning")
+		assert.Equal(t, memTokens(svr)[token], svr.tokenQ[0], "the token in the queue should match that in the map")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("fred", "addtssnbzq")
+	token, _ := svr.Authenticate("fred", "addtssnbzq")
+	var nilToken *Token
+	{
+		assert.Equal(t, uid, memTokens(svr)[token].User, "the token should map to user fred")
+		svr.Invalidate(token)
+		assert.Equal(t, nilToken, memTokens(svr)[token], "the token should be invalidated")
+	}
+}
+
+func TestCheckRole(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		_, err := svr.CheckRole("invalid", rid)
+		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
+	}
+	{
+		_, err := svr.CheckRole(token, 101)
+		assert.Equal(t, ErrRoleNotExist, err, "should error on invalid role")
+	}
+	{
+		ret, err := svr.CheckRole(token, rid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ret, "should have the role scanner")
+	}
+	{
+		ret, err := svr.CheckRole(token, rid2)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, false, ret, "should not have the role plugdev")
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		_, err := svr.TokenUser("invalid")
+		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
+	}
+	{
+		id, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, uid, id, "should map to user elton")
+	}
+}
+
+func TestIssueToken(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	e, _ := svr.EnrollTOTP(uid)
+	svr.VerifyTOTP(uid, currentCode(e))
+	{
+		token, err := svr.IssueToken(uid, ClientInfo{IP: "192.0.2.1"})
+		assert.Equal(t, nil, err, "should success")
+		id, _ := svr.TokenUser(token)
+		assert.Equal(t, uid, id, "should issue a session token without MFA")
+		list, _ := svr.ListTokens(uid)
+		assert.Equal(t, "192.0.2.1", list[0].Client.IP, "should record the client")
+	}
+	{
+		_, err := svr.IssueToken(101, ClientInfo{})
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
+		svr.SuspendUser(uid)
+		_, err = svr.IssueToken(uid, ClientInfo{})
+		assert.Equal(t, ErrUserSuspended, err, "should reject suspended users")
+	}
+}
+
+func TestScopedTokens(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	reader, _ := svr.CreateRole("reader")
+	writer, _ := svr.CreateRole("writer")
+	svr.GrantPermissionToRole(reader, "docs:read")
+	svr.GrantPermissionToRole(writer, "docs:write")
+	svr.GrantPermissionToRole(writer, "docs:read")
+	svr.AddRoleToUser(uid, reader)
+	svr.AddRoleToUser(uid, writer)
+	{
+		token, err := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{reader, reader}})
+		assert.Equal(t, nil, err, "should success")
+		ok, _ := svr.CheckRole(token, reader)
+		assert.Equal(t, true, ok, "should keep the roles in the scope")
+		ok, _ = svr.CheckRole(token, writer)
+		assert.Equal(t, false, ok, "should drop the roles outside the scope")
+		roles, _ := svr.AllRoles(token)
+		assert.Equal(t, []RoleID{reader}, roles, "should only list the roles in the scope")
+		ok, _ = svr.CheckPermission(token, "docs:write")
+		assert.Equal(t, false, ok, "should not grant the permissions of other roles")
+		list, _ := svr.ListTokens(uid)
+		assert.Equal(t, &TokenScope{Roles: []RoleID{reader}}, list[0].Scope, "should show the scope without duplicates")
+		svr.RemoveRoleFromUser(uid, reader)
+		ok, _ = svr.CheckRole(token, reader)
+		assert.Equal(t, false, ok, "should not outlast the roles of the user")
+		svr.AddRoleToUser(uid, reader)
+	}
+	{
+		token, err := svr.IssueScopedToken(uid, ClientInfo{}, &TokenScope{Permissions: []string{"docs:read"}})
+		assert.Equal(t, nil, err, "should success")
+		ok, _ := svr.CheckPermission(token, "docs:read")
+		assert.Equal(t, true, ok, "should grant the permissions in the scope")
+		ok, _ = svr.CheckPermission(token, "docs:write")
+		assert.Equal(t, false, ok, "should not grant the permissions outside the scope")
+		ok, _ = svr.CheckRole(token, writer)
+		assert.Equal(t, false, ok, "should hold no roles with permissions only")
+		token, _ = svr.IssueScopedToken(uid, ClientInfo{}, &TokenScope{Roles: []RoleID{writer}, Permissions: []string{"docs:*"}})
+		ok, _ = svr.CheckPermission(token, "docs:write")
+		assert.Equal(t, true, ok, "should take both roles and permissions")
+	}
+	{
+		_, err := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{101}})
+		assert.Equal(t, ErrInvalidScope, err, "should reject roles the user does not hold")
+		_, err = svr.IssueScopedToken(uid, ClientInfo{}, &TokenScope{})
+		assert.Equal(t, ErrInvalidScope, err, "should reject empty scopes")
+		_, err = svr.IssueScopedToken(uid, ClientInfo{}, &TokenScope{Permissions: []string{"docs::read"}})
+		assert.Equal(t, ErrInvalidPermission, err, "should check the permissions")
+		_, err = svr.AuthenticateScoped("anna", "wrong", ClientInfo{}, &TokenScope{Roles: []RoleID{101}})
+		assert.Equal(t, ErrInvalidAuth, err, "should check the password first")
+	}
+	{
+		e, _ := svr.EnrollTOTP(uid)
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		// Confirm with the previous step, so that the current code is still unused
+		svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod-1))
+		challenge, err := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{reader}})
+		assert.Equal(t, ErrMFARequired, err, "should require MFA")
+		token, err := svr.CompleteMFA(challenge, currentCode(e))
+		assert.Equal(t, nil, err, "should success")
+		ok, _ := svr.CheckRole(token, reader)
+		assert.Equal(t, true, ok, "should give a working token")
+		ok, _ = svr.CheckRole(token, writer)
+		assert.Equal(t, false, ok, "should keep the scope through MFA")
+	}
+	{
+		jsvr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+		uid, _ := jsvr.CreateUser("anna", "passw0rd")
+		rid, _ := jsvr.CreateRole("reader")
+		jsvr.AddRoleToUser(uid, rid)
+		token, _ := jsvr.IssueScopedToken(uid, ClientInfo{}, &TokenScope{Permissions: []string{"docs:read"}})
+		ok, _ := jsvr.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should carry the scope in JWTs")
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Clock: clock})
+	uid, _ := svr.CreateUser("elton", "123456")
+	uid2, _ := svr.CreateUser("fred", "123456")
+	phone, _ := svr.AuthenticateClient("elton", "123456", ClientInfo{IP: "192.0.2.1", UserAgent: "phone"})
+	clock.Advance(30 * time.Second)
+	laptop, _ := svr.AuthenticateClient("elton", "123456", ClientInfo{IP: "192.0.2.2", UserAgent: "laptop"})
+	other, _ := svr.Authenticate("fred", "123456")
+	{
+		list, err := svr.ListTokens(uid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 2, len(list), "should list the tokens of the user only")
+		assert.Equal(t, ClientInfo{IP: "192.0.2.1", UserAgent: "phone"}, list[0].Client, "should list the oldest first")
+		assert.Equal(t, memTokens(svr)[phone].ID(), list[0].ID, "should identify the token")
+		assert.NotEqual(t, string(phone), list[0].ID, "should not reveal the token")
+		assert.Equal(t, memTokens(svr)[phone].Expires, list[0].Expires, "should report the expiry")
+
+		clock.Advance(31 * time.Second) // The phone token has expired
+		list, _ = svr.ListTokens(uid)
+		assert.Equal(t, 1, len(list), "should skip expired tokens")
+		assert.Equal(t, memTokens(svr)[laptop].ID(), list[0].ID, "should keep valid tokens")
+		_, err = svr.ListTokens(101)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
+	}
+	{
+		id := memTokens(svr)[other].ID()
+		assert.Equal(t, ErrInvalidToken, svr.InvalidateToken(uid, id), "should not invalidate tokens of other users")
+		assert.Equal(t, nil, svr.InvalidateToken(uid2, id), "should success")
+		_, err := svr.TokenUser(other)
+		assert.Equal(t, ErrInvalidToken, err, "the token should be invalidated")
+	}
+}
+
+func TestAllRoles(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.AddRoleToUser(uid, rid)
+	svr.AddRoleToUser(uid, rid2)
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		_, err := svr.AllRoles("invalid")
+		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
+	}
+	{
+		ret, err := svr.AllRoles(token)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 2, len(ret), "should have 2 roles")
+	}
+	{
+		rid3, _ := svr.CreateRole("video")
+		gid, _ := svr.CreateGroup("staff")
+		gid2, _ := svr.CreateGroup("admins")
+		svr.AddRoleToGroup(gid, rid)
+		svr.AddRoleToGroup(gid, rid3)
+		svr.AddRoleToGroup(gid2, rid3)
+		svr.AddUserToGroup(uid, gid)
+		svr.AddUserToGroup(uid, gid2)
+		ret, _ := svr.AllRoles(token)
+		assert.ElementsMatch(t, []RoleID{rid, rid2, rid3}, ret, "should list the roles granted twice once")
+	}
+}
+
+func TestMatchPermission(t *testing.T) {
+	cases := []struct {
+		granted, requested string
+		match              bool
+	}{
+		{"orders:read", "orders:read", true},
+		{"orders:read", "orders:write", false},
+		{"orders:read", "orders:read:own", false},
+		{"orders:*", "orders:read", true},
+		{"orders:*", "orders:read:own", true},
+		{"orders:*", "orders", false},
+		{"orders:*:own", "orders:read:own", true},
+		{"orders:*:own", "orders:read:all", false},
+		{"orders:*:own", "orders:read", false},
+		{"*", "invoices:delete", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchPermission(c.granted, c.requested), c.granted+" vs "+c.requested)
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("clerk")
+	rid2, _ := svr.CreateRole("auditor")
+	svr.AddRoleToUser(uid, rid)
+	svr.AddRoleToUser(uid, rid2)
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		assert.Equal(t, ErrRoleNotExist, svr.GrantPermissionToRole(101, "orders:read"), "should give ErrRoleNotExist")
+		assert.Equal(t, ErrInvalidPermission, svr.GrantPermissionToRole(rid, "orders::read"), "should reject empty segments")
+		_, err := svr.CheckPermission("invalid", "orders:read")
+		assert.Equal(t, ErrInvalidToken, err, "should verify the token")
+	}
+	{
+		assert.Equal(t, nil, svr.GrantPermissionToRole(rid, "orders:*"), "should success")
+		assert.Equal(t, nil, svr.GrantPermissionToRole(rid2, "invoices:read"), "should success")
+		assert.Equal(t, nil, svr.GrantPermissionToRole(rid2, "invoices:read"), "should be a no-op if already granted")
+		assert.Equal(t, []string{"invoices:read"}, svr.GetRole(rid2).Permissions, "should not duplicate permissions")
+		assert.Equal(t, []string{"invoices:read"}, svr.GetUser(uid).Roles[rid2].Permissions, "users should see the updated role")
+
+		ok, err := svr.CheckPermission(token, "orders:write")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should be granted by the wildcard")
+		ok, _ = svr.CheckPermission(token, "invoices:read")
+		assert.Equal(t, true, ok, "should be granted by the second role")
+		ok, _ = svr.CheckPermission(token, "invoices:write")
+		assert.Equal(t, false, ok, "should not be granted")
+	}
+	{
+		assert.Equal(t, nil, svr.RevokePermissionFromRole(rid, "orders:*"), "should success")
+		ok, _ := svr.CheckPermission(token, "orders:write")
+		assert.Equal(t, false, ok, "should apply to existing tokens")
+		assert.Equal(t, nil, svr.DeleteRole(rid2), "should success")
+		ok, _ = svr.CheckPermission(token, "invoices:read")
+		assert.Equal(t, false, ok, "should ignore deleted roles")
+	}
+}
+
+// TestVerifyToken includes cases not covered by TestCheckRole and TestAllRoles, such as removing expired tokens.
+func TestVerifyToken(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Clock: clock})
+	uid, _ := svr.CreateUser("elton", "123456")
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		assert.Equal(t, 1, len(memTokens(svr)), "the server should have one token")
+		clock.Advance(90 * time.Second)
+		_, err := svr.verifyToken(token)
+		assert.Equal(t, ErrInvalidToken, err, "token should expire")
+	}
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		assert.Equal(t, 1, len(memTokens(svr)), "the server should have one token")
+		svr.DeleteUser(uid)
+		_, err := svr.verifyToken(token)
+		assert.Equal(t, ErrInvalidToken, err, "token should be invalidated after user removal")
+		assert.Equal(t, 0, len(memTokens(svr)), "the server should remove the token")
+	}
+}
+
+func TestPruneTokens(t *testing.T) {
+	start := time.Now()
+	clock := NewManualClock(start)
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 1800, Clock: clock})
+	svr.CreateUser("elton", "123456")
+	{
+		svr.Authenticate("elton", "123456")
+		svr.Authenticate("elton", "123456")
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, 3, len(memTokens(svr)), "the server should create one token per authentication")
+
+		clock.Set(start.Add(121 * time.Minute)) // Two hours passed magically
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, 1, len(memTokens(svr)), "the server should remove stale tokens")
+	}
+	clock.Set(start)
+	svr, _ = NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Clock: clock})
+	svr.CreateUser("elton", "123456")
+	{
+		svr.Authenticate("elton", "123456")
+		clock.Set(start.Add(60 * time.Second))
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, 2, len(memTokens(svr)), "the server should keep tokens until they expire")
+
+		clock.Set(start.Add(61 * time.Second)) // Within the first hour
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, 2, len(memTokens(svr)), "the server should prune tokens as soon as they expire")
+		assert.Equal(t, 2, len(svr.tokenQ), "the server should dequeue the pruned tokens")
+		assert.Equal(t, start.Add(120*time.Second), svr.tokenQ.peek().Expires, "the token expiring first should be next")
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	{
+		_, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, TokenMaxLifetimeSec: 30})
+		assert.Equal(t, ErrInvalidConfig, err, "should reject a lifetime below the idle timeout")
+		_, err = NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, TokenMaxLifetimeSec: 3600, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+		assert.Equal(t, ErrInvalidConfig, err, "should not slide JWTs")
+	}
+	start := time.Now()
+	clock := NewManualClock(start)
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, TokenMaxLifetimeSec: 3600, Clock: clock})
+	svr.CreateUser("elton", "123456")
+	expires := func(token TokenValue) time.Time {
+		tokenObj, err := svr.store.GetToken(context.Background(), token)
+		if err != nil {
+			return time.Time{}
+		}
+		return tokenObj.Expires
+	}
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		clock.Advance(50 * time.Second)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should success")
+		assert.Eventually(t, func() bool { return expires(token).Equal(clock.Now().Add(time.Minute)) }, time.Second, time.Millisecond,
+			"should extend the token by the idle timeout")
+	}
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		issued := clock.Now()
+		// Used every 50 seconds, until its lifetime is almost over
+		for i := 0; i < 71; i++ {
+			clock.Advance(50 * time.Second)
+			svr.TokenUser(token)
+			want := clock.Now().Add(time.Minute)
+			if i == 70 {
+				want = issued.Add(time.Hour)
+			}
+			if !assert.Eventually(t, func() bool { return expires(token).Equal(want) }, time.Second, time.Millisecond,
+				"should not extend the token beyond its lifetime") {
+				break
+			}
+		}
+		clock.Set(issued.Add(time.Hour + time.Second))
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should expire the token at its lifetime")
+	}
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		before := expires(token)
+		svr.TokenUser(token)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, before, expires(token), "should not save each use")
+	}
+	{
+		clock.Set(start)
+		svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, TokenMaxLifetimeSec: 3600, Clock: clock})
+		svr.CreateUser("elton", "123456")
+		used, _ := svr.Authenticate("elton", "123456")
+		svr.Authenticate("elton", "123456")
+		clock.Advance(50 * time.Second)
+		svr.TokenUser(used)
+		assert.Eventually(t, func() bool {
+			tokenObj, err := svr.store.GetToken(context.Background(), used)
+			return err == nil && tokenObj.Expires.Equal(clock.Now().Add(time.Minute))
+		}, time.Second, time.Millisecond, "should extend the token")
+		clock.Advance(30 * time.Second) // The other token is past the idle timeout
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, 2, len(memTokens(svr)), "should prune idle tokens, and keep those extended")
+		assert.Equal(t, 2, len(svr.tokenQ), "should queue extended tokens again")
+		_, err := svr.TokenUser(used)
+		assert.Equal(t, nil, err, "should keep extended tokens valid")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	{
+		_, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, MaxSessions: -1})
+		assert.Equal(t, ErrInvalidConfig, err, "should reject a negative limit")
+		_, err = NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, MaxSessions: 2, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+		assert.Equal(t, ErrInvalidConfig, err, "should not limit JWTs")
+	}
+	{
+		svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, MaxSessions: 2})
+		uid, _ := svr.CreateUser("elton", "123456")
+		other, _ := svr.CreateUser("david", "123456")
+		svr.Authenticate("david", "123456")
+		first, _ := svr.Authenticate("elton", "123456")
+		second, _ := svr.Authenticate("elton", "123456")
+		svr.CreateAPIKey(uid, "ci", nil, time.Time{})
+		third, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.TokenUser(first)
+		assert.Equal(t, ErrInvalidToken, err, "should evict the oldest session")
+		fourth, _ := svr.IssueToken(uid, ClientInfo{})
+		_, err = svr.TokenUser(second)
+		assert.Equal(t, ErrInvalidToken, err, "should evict in the order of issuance")
+		for _, token := range []TokenValue{third, fourth} {
+			_, err = svr.TokenUser(token)
+			assert.Equal(t, nil, err, "should keep the newest sessions")
+		}
+		list, _ := svr.ListTokens(other)
+		assert.Equal(t, 1, len(list), "should not evict the sessions of other users")
+	}
+	{
+		svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, MaxSessions: 1, OnMaxSessions: RejectNew})
+		uid, _ := svr.CreateUser("elton", "123456")
+		first, _ := svr.Authenticate("elton", "123456")
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrTooManySessions, err, "should reject new sessions")
+		_, err = svr.TokenUser(first)
+		assert.Equal(t, nil, err, "should keep the existing session")
+		svr.Invalidate(first)
+		_, err = svr.IssueToken(uid, ClientInfo{})
+		assert.Equal(t, nil, err, "should accept sessions again after logging out")
+	}
+}
+
+// TestConcurrentAccess interleaves reads and writes from many goroutines.
+// It is most useful when run with the race detector, i.e. `go test -race ./...`.
+func TestConcurrentAccess(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	rid, _ := svr.CreateRole("scanner")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i)
+			for j := 0; j < 50; j++ {
+				uid, err := svr.CreateUser(name, "123456")
+				assert.Equal(t, nil, err, "should success")
+				assert.Equal(t, nil, svr.AddRoleToUser(uid, rid), "should success")
+				token, err := svr.Authenticate(name, "123456")
+				assert.Equal(t, nil, err, "should success")
+				ok, err := svr.CheckRole(token, rid)
+				assert.Equal(t, nil, err, "should success")
+				assert.Equal(t, true, ok, "should have the role scanner")
+				_, _ = svr.AllRoles(token)
+				_ = svr.GetUserByName(name)
+				assert.Equal(t, nil, svr.DeleteUser(uid), "should success")
+				_, err = svr.CheckRole(token, rid)
+				assert.Equal(t, ErrInvalidToken, err, "token should be invalidated after user removal")
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 0, len(memStore(svr).users), "all users should be removed")
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	{
+		u := &User{Name: "anna", Roles: map[RoleID]*Role{}}
+		assert.Equal(t, nil, m.InsertUser(ctx, u), "should success")
+		assert.Equal(t, UserID(1), u.ID, "should assign an ID")
+		assert.Equal(t, ErrUserExists, m.InsertUser(ctx, &User{Name: "anna"}), "should reject duplicate names")
+		assert.Equal(t, nil, m.InsertUser(ctx, &User{ID: 10, Name: "belle"}), "should accept a preset ID")
+		assert.Equal(t, UserID(11), m.nextUser, "should not reuse IDs below a preset one")
+	}
+	{
+		r := &Role{Name: "scanner"}
+		assert.Equal(t, nil, m.InsertRole(ctx, r), "should success")
+		u, _ := m.GetUser(ctx, 1)
+		u = u.clone()
+		u.Name = "cara"
+		u.Roles[r.ID] = &Role{ID: r.ID}
+		assert.Equal(t, nil, m.UpdateUser(ctx, u), "should success")
+		_, err := m.GetUserByName(ctx, "anna")
+		assert.Equal(t, ErrUserNotExist, err, "old name should be released")
+		u, _ = m.GetUserByName(ctx, "cara")
+		assert.Equal(t, r, u.Roles[r.ID], "role assignments should point to the stored role")
+		assert.Equal(t, ErrUserExists, m.UpdateUser(ctx, &User{ID: 1, Name: "belle"}), "should reject renaming to a taken name")
+		assert.Equal(t, ErrUserNotExist, m.UpdateUser(ctx, &User{ID: 101, Name: "dora"}), "should reject unknown users")
+	}
+	{
+		_, err := m.GetToken(ctx, "invalid")
+		assert.Equal(t, ErrInvalidToken, err, "should give ErrInvalidToken if the token is unknown")
+		for i := 0; i < 64; i++ {
+			m.InsertToken(ctx, &Token{Value: TokenValue(fmt.Sprintf("token%d", i)), User: UserID(1 + i%2)})
+		}
+		used := 0
+		for i := range m.shards {
+			if len(m.shards[i].tokens) > 0 {
+				used++
+			}
+		}
+		assert.Equal(t, DefaultTokenShards, used, "should spread the tokens over the shards")
+		tokens, _ := m.UserTokens(ctx, 1)
+		assert.Equal(t, 32, len(tokens), "should find the tokens of a user in all shards")
+		m.DeleteToken(ctx, "token0")
+		counts, _ := m.Count(ctx)
+		assert.Equal(t, int64(63), counts.Tokens, "should count the tokens of all shards")
+	}
+	{
+		before := m.view.Load().(*memView)
+		r, _ := m.GetRoleByName(ctx, "scanner")
+		r = &Role{ID: r.ID, Name: "sweeper"}
+		assert.Equal(t, nil, m.UpdateRole(ctx, r), "should success")
+		u, _ := m.GetUser(ctx, 1)
+		assert.Equal(t, r, u.Roles[r.ID], "holders should point to the new role in the view")
+		assert.Equal(t, "scanner", before.roles[r.ID].Name, "should not change a published view")
+		m.DeleteUser(ctx, 10)
+		m.DeleteRole(ctx, r.ID)
+		_, err := m.GetUser(ctx, 10)
+		assert.Equal(t, ErrUserNotExist, err, "should drop deleted users from the view")
+		_, err = m.GetRole(ctx, r.ID)
+		assert.Equal(t, ErrRoleNotExist, err, "should drop deleted roles from the view")
+		assert.NotEqual(t, nil, before.users[viewBucket(10)][10], "should not change a published view")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 1800, Clock: clock})
+	svr.CreateUser("elton", "123456")
+	svr.CreateRole("scanner")
+	svr.Authenticate("elton", "123456")
+	svr.Authenticate("elton", "123456")
+	svr.Authenticate("elton", "654321")
+	svr.Authenticate("fred", "123456")
+	{
+		m, err := svr.Metrics()
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, [3]int64{1, 1, 2}, [3]int64{m.Users, m.Roles, m.Tokens}, "should count the entities")
+		assert.Equal(t, uint64(2), m.Authentications, "should count authentications")
+		assert.Equal(t, uint64(2), m.FailedLogins, "should count failed logins")
+		assert.Equal(t, uint64(0), m.Prunes, "should not have pruned yet")
+	}
+	{
+		clock.Advance(121 * time.Minute)
+		svr.Authenticate("elton", "123456")
+		m, _ := svr.Metrics()
+		assert.Equal(t, 121*time.Minute, m.Uptime, "should tell the uptime")
+		assert.Equal(t, uint64(1), m.Prunes, "should count prunes")
+		assert.Equal(t, uint64(2), m.PrunedTokens, "should count pruned tokens")
+		assert.Equal(t, int64(1), m.Tokens, "should count the remaining tokens")
+		assert.Equal(t, m.PruneDuration, m.LastPruneDuration, "should measure the prune")
+	}
+	{
+		var b strings.Builder
+		m := &Metrics{Users: 3, Roles: -1, Authentications: 5}
+		assert.Equal(t, nil, m.WritePrometheus(&b), "should success")
+		assert.Contains(t, b.String(), "# HELP auth_users Number of users.\n# TYPE auth_users gauge\nauth_users 3\n", "should write gauges")
+		assert.Contains(t, b.String(), "# TYPE auth_authentications_total counter\nauth_authentications_total 5\n", "should write counters")
+		assert.NotContains(t, b.String(), "auth_roles", "should leave out unknown counts")
+	}
+}
+
+// ctxStore records the context of the last GetUser call.
+type ctxStore struct {
+	*MemoryStorage
+	last context.Context
+}
+
+func (c *ctxStore) GetUser(ctx context.Context, id UserID) (*User, error) {
+	c.last = ctx
+	return c.MemoryStorage.GetUser(ctx, id)
+}
+
+func TestWithContext(t *testing.T) {
+	store := &ctxStore{MemoryStorage: NewMemoryStorage()}
+	svr, _ := NewServer(&ServerConfig{TokenExpireSec: 60}, store)
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "request"))
+	view := svr.WithContext(ctx)
+	{
+		assert.Equal(t, context.Background(), svr.Context(), "should default to the background context")
+		assert.Equal(t, ctx, view.Context(), "should bind the context")
+		uid, _ := view.CreateUser("elton", "123456")
+		assert.Equal(t, "elton", svr.GetUser(uid).Name, "should share the state with the original")
+		view.GetUser(uid)
+		assert.Equal(t, "request", store.last.Value(key{}), "should pass the context to the storage")
+	}
+	{
+		cancel()
+		_, err := view.CreateUser("fred", "123456")
+		assert.Equal(t, context.Canceled, err, "should not create users for canceled requests")
+		_, err = view.Authenticate("elton", "123456")
+		assert.Equal(t, context.Canceled, err, "should not authenticate for canceled requests")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should not affect the original")
+	}
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Anomaly names a pattern of events suggesting an attack, see DetectAnomalies.
+type Anomaly string
+
+const (
+	// AnomalySpraying is failed logins from one IP for many names, as when trying a few common
+	// passwords on every account.
+	AnomalySpraying Anomaly = "password_spraying"
+	// AnomalyTravel is two successful logins of a user from places too far apart for the time
+	// between them, as when its password is used by someone else.
+	AnomalyTravel Anomaly = "impossible_travel"
+	// AnomalyTokenReuse is a revoked session token presented again, as by whoever stole it.
+	AnomalyTokenReuse Anomaly = "token_reuse"
+)
+
+// AnomalyConfig configures DetectAnomalies. The zero value detects password spraying and token
+// reuse with the defaults.
+type AnomalyConfig struct {
+	// SprayNames is how many names failing to log in from one IP within SprayWindowSec make
+	// password spraying. They default to 10 names in 10 minutes.
+	SprayNames     int
+	SprayWindowSec int32
+	// Locate, if set, tells where an IP is, e.g. from a GeoIP database, to detect impossible travel:
+	// successive logins of a user faster than MaxSpeedKmh apart, which defaults to 1000 (about an
+	// airliner). Places less than 100 km apart are taken as the same, as IPs are not located more
+	// precisely. IPs it cannot locate are skipped.
+	Locate      func(ip string) (lat, lon float64, ok bool)
+	MaxSpeedKmh float64
+	// ReuseWindowSec is how long revoked session tokens are remembered to detect their reuse.
+	// Defaults to a day. Only tokens revoked with a token.revoked event are, and not JWTs.
+	ReuseWindowSec int32
+}
+
+const (
+	defaultSprayNames  = 10
+	defaultSprayWindow = 10 * time.Minute
+	defaultMaxSpeedKmh = 1000
+	defaultReuseWindow = 24 * time.Hour
+	// minTravelKm is the distance below which two logins are taken as from the same place
+	minTravelKm = 100
+	earthKm     = 6371
+)
+
+// detector follows the events of a server for DetectAnomalies.
+type detector struct {
+	svr         *Server
+	sprayNames  int
+	sprayWindow time.Duration
+	locate      func(ip string) (lat, lon float64, ok bool)
+	maxSpeed    float64
+	reuseWindow time.Duration
+
+	mu sync.Mutex
+	// The names that failed to log in from each IP, with the time of their last failure, and the
+	// IPs reported for spraying until their window is over
+	failures map[string]map[string]time.Time
+	spraying map[string]time.Time
+	sweepAt  int
+	// The last located login of each user
+	places map[UserID]place
+	// The IDs of the revoked tokens, with their user, and in the order they were revoked
+	revoked  map[string]UserID
+	revokedQ []revokedToken
+}
+
+type place struct {
+	lat, lon float64
+	at       time.Time
+}
+
+type revokedToken struct {
+	id string
+	at time.Time
+}
+
+// DetectAnomalies watches the events of the server for password spraying, impossible travel and
+// the reuse of revoked tokens, see Anomaly and AnomalyConfig. Each one found is raised as a
+// security.anomaly event telling the Anomaly, with the User, Name, IP and TokenID that apply, so
+// that webhooks and other subscribers can alert on them. Token reuse is reported when a revoked
+// token fails to verify; the other anomalies rely on the IPs given to AuthenticateClient.
+// Detection is done in memory, for the events of this server only, until cancel is called.
+//
+// Returns: a function that stops the detection
+func (s *Server) DetectAnomalies(cfg *AnomalyConfig) (cancel func()) {
+	if cfg == nil {
+		cfg = &AnomalyConfig{}
+	}
+	d := &detector{
+		svr:         s,
+		sprayNames:  cfg.SprayNames,
+		sprayWindow: time.Duration(cfg.SprayWindowSec) * time.Second,
+		locate:      cfg.Locate,
+		maxSpeed:    cfg.MaxSpeedKmh,
+		reuseWindow: time.Duration(cfg.ReuseWindowSec) * time.Second,
+		failures:    make(map[string]map[string]time.Time),
+		spraying:    make(map[string]time.Time),
+		sweepAt:     minSweep,
+		places:      make(map[UserID]place),
+		revoked:     make(map[string]UserID),
+	}
+	if d.sprayNames <= 0 {
+		d.sprayNames = defaultSprayNames
+	}
+	if d.sprayWindow <= 0 {
+		d.sprayWindow = defaultSprayWindow
+	}
+	if d.maxSpeed <= 0 {
+		d.maxSpeed = defaultMaxSpeedKmh
+	}
+	if d.reuseWindow <= 0 {
+		d.reuseWindow = defaultReuseWindow
+	}
+
+	unsubscribe := s.Subscribe(d.observe, EventLoginFailed, EventLoginSucceeded, EventTokenRevoked)
+	s.events.mu.Lock()
+	s.events.detectors[d] = struct{}{}
+	s.events.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			delete(s.events.detectors, d)
+			s.events.mu.Unlock()
+			unsubscribe()
+		})
+	}
+}
+
+// observe is the subscriber of a detector.
+func (d *detector) observe(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e.Type {
+	case EventLoginFailed:
+		d.failedLogin(e)
+	case EventLoginSucceeded:
+		d.login(e)
+	case EventTokenRevoked:
+		d.expire(e.Time)
+		if e.TokenID != "" {
+			d.revoked[e.TokenID] = e.User
+			d.revokedQ = append(d.revokedQ, revokedToken{id: e.TokenID, at: e.Time})
+		}
+	}
+}
+
+// failedLogin looks for password spraying. The caller must hold d.mu.
+func (d *detector) failedLogin(e Event) {
+	if e.IP == "" {
+		return
+	}
+	names := d.failures[e.IP]
+	if names == nil {
+		if len(d.failures) >= d.sweepAt {
+			d.sweep(e.Time)
+		}
+		names = make(map[string]time.Time)
+		d.failures[e.IP] = names
+	}
+	names[e.Name] = e.Time
+	for name, at := range names {
+		if e.Time.Sub(at) >= d.sprayWindow {
+			delete(names, name)
+		}
+	}
+	if len(names) < d.sprayNames || e.Time.Before(d.spraying[e.IP]) {
+		return
+	}
+	// Reported once per window, for as long as it goes on
+	d.spraying[e.IP] = e.Time.Add(d.sprayWindow)
+	d.svr.emit(Event{Type: EventAnomaly, Anomaly: AnomalySpraying, Name: e.Name, IP: e.IP, UserAgent: e.UserAgent})
+}
+
+// sweep forgets the IPs without recent failures, like TokenBucket. The caller must hold d.mu.
+func (d *detector) sweep(now time.Time) {
+	for ip, names := range d.failures {
+		for name, at := range names {
+			if now.Sub(at) >= d.sprayWindow {
+				delete(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(d.failures, ip)
+		}
+	}
+	for ip, until := range d.spraying {
+		if !now.Before(until) {
+			delete(d.spraying, ip)
+		}
+	}
+	if d.sweepAt = 2 * len(d.failures); d.sweepAt < minSweep {
+		d.sweepAt = minSweep
+	}
+}
+
+// login looks for impossible travel. The caller must hold d.mu.
+func (d *detector) login(e Event) {
+	if d.locate == nil || e.IP == "" {
+		return
+	}
+	lat, lon, ok := d.locate(e.IP)
+	if !ok {
+		return
+	}
+	last, seen := d.places[e.User]
+	d.places[e.User] = place{lat: lat, lon: lon, at: e.Time}
+	if !seen {
+		return
+	}
+	km := distanceKm(last.lat, last.lon, lat, lon)
+	if km < minTravelKm {
+		return
+	}
+	if hours := e.Time.Sub(last.at).Hours(); hours <= 0 || km/hours > d.maxSpeed {
+		d.svr.emit(Event{Type: EventAnomaly, Anomaly: AnomalyTravel, User: e.User, Name: e.Name, IP: e.IP,
+			UserAgent: e.UserAgent})
+	}
+}
+
+// expire forgets the tokens revoked before the reuse window. The caller must hold d.mu.
+func (d *detector) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.revokedQ) && now.Sub(d.revokedQ[i].at) >= d.reuseWindow; i++ {
+		delete(d.revoked, d.revokedQ[i].id)
+	}
+	if i > 0 {
+		d.revokedQ = append([]revokedToken(nil), d.revokedQ[i:]...)
+	}
+}
+
+// unknownToken reports a token that was presented but not found, which is token reuse if it was
+// revoked. It is reported once.
+func (d *detector) unknownToken(id string, client ClientInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(d.svr.now())
+	user, ok := d.revoked[id]
+	if !ok {
+		return
+	}
+	delete(d.revoked, id)
+	d.svr.emit(Event{Type: EventAnomaly, Anomaly: AnomalyTokenReuse, User: user, TokenID: id, IP: client.IP,
+		UserAgent: client.UserAgent})
+}
+
+// forget drops what is known about a user, for EraseUser.
+func (d *detector) forget(user UserID, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.places, user)
+	for ip, names := range d.failures {
+		if delete(names, name); len(names) == 0 {
+			delete(d.failures, ip)
+		}
+	}
+	for id, u := range d.revoked {
+		if u == user {
+			delete(d.revoked, id)
+		}
+	}
+}
+
+// distanceKm is the great-circle distance between two places, in kilometers.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat, dlon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthKm * math.Asin(math.Sqrt(a))
+}
+
+// reportUnknownToken hands a token that was not found to the detectors of the server, if any.
+func (s *Server) reportUnknownToken(v TokenValue) {
+	s.events.mu.Lock()
+	if len(s.events.detectors) == 0 {
+		s.events.mu.Unlock()
+		return
+	}
+	detectors := make([]*detector, 0, len(s.events.detectors))
+	for d := range s.events.detectors {
+		detectors = append(detectors, d)
+	}
+	s.events.mu.Unlock()
+
+	id := tokenID(v)
+	client, _ := s.requestClient()
+	for _, d := range detectors {
+		d.unknownToken(id, client)
+	}
+}
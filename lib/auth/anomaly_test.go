@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// learned waits for the detectors of a server to know n revoked tokens, as they learn them from
+// events.
+func learned(svr *Server, n int) {
+	for i := 0; i < 100; i++ {
+		known := true
+		svr.events.mu.Lock()
+		for d := range svr.events.detectors {
+			d.mu.Lock()
+			known = known && len(d.revoked) >= n
+			d.mu.Unlock()
+		}
+		svr.events.mu.Unlock()
+		if known {
+			return
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestDetectSpraying(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithClock(clock), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	stop := svr.DetectAnomalies(&AnomalyConfig{SprayNames: 3, SprayWindowSec: 600})
+	defer stop()
+	next, cancel := collect(svr, EventAnomaly)
+	defer cancel()
+	attacker := ClientInfo{IP: "203.0.113.9"}
+	{
+		svr.AuthenticateClient("anna", "123456", attacker)
+		svr.AuthenticateClient("elton", "123456", attacker)
+		svr.AuthenticateClient("anna", "123456", ClientInfo{IP: "198.51.100.1"})
+		assert.Equal(t, 0, len(next(1)), "should not count the names twice, nor other IPs")
+		svr.AuthenticateClient("dora", "123456", attacker)
+		svr.AuthenticateClient("bob", "123456", attacker)
+		events := next(2)
+		assert.Equal(t, 1, len(events), "should report spraying once per window")
+		assert.Equal(t, AnomalySpraying, events[0].Anomaly, "should tell the anomaly")
+		assert.Equal(t, "203.0.113.9", events[0].IP, "should tell the IP")
+	}
+	{
+		clock.Advance(11 * time.Minute)
+		svr.AuthenticateClient("carl", "123456", attacker)
+		assert.Equal(t, 0, len(next(1)), "should forget old failures")
+		svr.AuthenticateClient("eve", "123456", attacker)
+		svr.AuthenticateClient("fred", "123456", attacker)
+		assert.Equal(t, 1, len(next(1)), "should report spraying again in the next window")
+	}
+}
+
+func TestDetectTravel(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithClock(clock), WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	places := map[string][2]float64{
+		"192.0.2.1": {48.86, 2.35},   // Paris
+		"192.0.2.2": {48.80, 2.13},   // Versailles
+		"192.0.2.3": {40.71, -74.01}, // New York
+	}
+	stop := svr.DetectAnomalies(&AnomalyConfig{Locate: func(ip string) (float64, float64, bool) {
+		p, ok := places[ip]
+		return p[0], p[1], ok
+	}})
+	defer stop()
+	next, cancel := collect(svr, EventAnomaly)
+	defer cancel()
+	login := func(ip string) {
+		svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: ip})
+	}
+	{
+		login("192.0.2.1")
+		clock.Advance(time.Minute)
+		login("192.0.2.2")
+		login("198.51.100.1")
+		assert.Equal(t, 0, len(next(1)), "should take nearby places as the same, and skip unknown ones")
+	}
+	{
+		clock.Advance(time.Hour)
+		login("192.0.2.3")
+		events := next(1)
+		assert.Equal(t, 1, len(events), "should report impossible travel")
+		assert.Equal(t, AnomalyTravel, events[0].Anomaly, "should tell the anomaly")
+		assert.Equal(t, [2]interface{}{anna, "192.0.2.3"}, [2]interface{}{events[0].User, events[0].IP}, "should tell the user and IP")
+		clock.Advance(12 * time.Hour)
+		login("192.0.2.1")
+		assert.Equal(t, 0, len(next(1)), "should allow a flight")
+	}
+}
+
+func TestDetectTokenReuse(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	stop := svr.DetectAnomalies(nil)
+	next, cancel := collect(svr, EventAnomaly)
+	defer cancel()
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		svr.Invalidate(token)
+		learned(svr, 1)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the token")
+		events := next(1)
+		assert.Equal(t, 1, len(events), "should report the reuse")
+		assert.Equal(t, AnomalyTokenReuse, events[0].Anomaly, "should tell the anomaly")
+		assert.Equal(t, anna, events[0].User, "should tell the user")
+		assert.Equal(t, (&Token{Value: token}).ID(), events[0].TokenID, "should tell the token")
+		svr.TokenUser(token)
+		svr.TokenUser("unknown")
+		assert.Equal(t, 0, len(next(1)), "should report each token once, and revoked ones only")
+	}
+	{
+		stop()
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Invalidate(token)
+		svr.TokenUser(token)
+		assert.Equal(t, 0, len(next(1)), "should stop")
+	}
+}
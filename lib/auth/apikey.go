@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API keys are long-lived credentials for automation, such as scripts and CI jobs, which would
+// otherwise store a password and call Authenticate. They are accepted wherever a token is, but are
+// created and revoked explicitly. Keys are saved on their user as a SHA-256 hash: they are random,
+// so a slow password hash adds nothing. The key also encodes the IDs of the user and of the key, so
+// that verifying it takes one lookup.
+
+// APIKeyPrefix starts all API keys, so that they can be told from tokens, e.g. by secret scanners.
+const APIKeyPrefix = "ak_"
+
+// apiKeyTouchInterval limits how often the last use of a key is saved.
+const apiKeyTouchInterval = time.Minute
+
+// APIKey is an API key, as saved on its user.
+type APIKey struct {
+	Name     string
+	Hash     []byte   // SHA-256 of the key
+	Scopes   []string `json:",omitempty"` // see CreateAPIKey
+	Created  time.Time
+	Expires  time.Time // zero if the key does not expire
+	LastUsed time.Time // saved at most once per minute
+}
+
+// APIKeyInfo describes an API key without revealing it.
+type APIKeyInfo struct {
+	ID       string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+var ErrAPIKeyNotExist = newError("api_key_not_exist", http.StatusNotFound, "API key does not exist")
+
+func (k *APIKey) clone() *APIKey {
+	if k == nil {
+		return nil
+	}
+	c := *k
+	c.Hash = append([]byte(nil), k.Hash...)
+	c.Scopes = append([]string(nil), k.Scopes...)
+	return &c
+}
+
+// CreateAPIKey creates an API key for a user. Scopes are permissions (patterns allowed) that limit
+// the key: CheckPermission only passes for permissions they match (and the roles of the user grant),
+// and CheckRole and AllRoles see no roles, which could grant more. Without scopes, the key can do
+// everything the user can. A zero expires makes a key that is valid until revoked.
+// The key is only returned here, keep it safe.
+//
+// Returns: the key, to be used as a token
+// Errors: ErrUserNotExist, ErrInvalidPermission, ErrInternal
+func (s *Server) CreateAPIKey(user UserID, name string, scopes []string, expires time.Time) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.CreateAPIKey")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	for _, perm := range scopes {
+		if err := validatePermission(perm); err != nil {
+			return "", err
+		}
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	userObj = userObj.clone()
+	key, err := s.addAPIKey(userObj, name, scopes, expires)
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// addAPIKey generates an API key, and adds it to a user that is not saved yet (e.g. a clone).
+//
+// Errors: ErrInternal
+func (s *Server) addAPIKey(userObj *User, name string, scopes []string, expires time.Time) (TokenValue, error) {
+	raw := make([]byte, 40) // user ID, key ID and 24 random bytes
+	binary.BigEndian.PutUint64(raw, uint64(userObj.ID))
+	if err := s.random(raw[8:]); err != nil {
+		return "", ErrInternal
+	}
+	key := TokenValue(APIKeyPrefix + base64.RawURLEncoding.EncodeToString(raw))
+	sum := sha256.Sum256([]byte(key))
+	if userObj.APIKeys == nil {
+		userObj.APIKeys = make(map[string]*APIKey)
+	}
+	userObj.APIKeys[base64.RawURLEncoding.EncodeToString(raw[8:16])] = &APIKey{
+		Name:    name,
+		Hash:    sum[:],
+		Scopes:  append([]string(nil), scopes...),
+		Created: s.now(),
+		Expires: expires,
+	}
+	return key, nil
+}
+
+// ListAPIKeys lists the API keys of a user, oldest first. Expired keys are included.
+//
+// Returns: the keys
+// Errors: ErrUserNotExist
+func (s *Server) ListAPIKeys(user UserID) (_ []APIKeyInfo, err error) {
+	s, sp := s.trace("auth.ListAPIKeys")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]APIKeyInfo, 0, len(userObj.APIKeys))
+	for id, k := range userObj.APIKeys {
+		list = append(list, APIKeyInfo{
+			ID:       id,
+			Name:     k.Name,
+			Scopes:   append([]string(nil), k.Scopes...),
+			Created:  k.Created,
+			Expires:  k.Expires,
+			LastUsed: k.LastUsed,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// RevokeAPIKey deletes an API key of a user by its ID (see APIKeyInfo). Invalidate does not revoke
+// API keys, so that logging out with one does not break the automation using it.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrAPIKeyNotExist
+func (s *Server) RevokeAPIKey(user UserID, id string) (err error) {
+	s, sp := s.trace("auth.RevokeAPIKey")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, ok := userObj.APIKeys[id]; !ok {
+		return ErrAPIKeyNotExist
+	}
+	userObj = userObj.clone()
+	delete(userObj.APIKeys, id)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventAPIKeyRevoked, User: user, Name: userObj.Name, TokenID: id})
+	return nil
+}
+
+// parseAPIKey extracts the IDs of the user and of the key from an API key.
+func parseAPIKey(t TokenValue) (UserID, string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(t), APIKeyPrefix))
+	if err != nil || len(raw) != 40 {
+		return 0, "", false
+	}
+	return UserID(binary.BigEndian.Uint64(raw)), base64.RawURLEncoding.EncodeToString(raw[8:16]), true
+}
+
+// verifyAPIKey is verifyToken for API keys. The caller must hold s.mu (at least for reading).
+func (s *Server) verifyAPIKey(t TokenValue) (*User, *APIKey, error) {
+	user, id, ok := parseAPIKey(t)
+	if !ok {
+		return nil, nil, ErrInvalidToken
+	}
+	userObj, err := s.getUser(s.ctx, user)
+	if err == ErrUserNotExist {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	key := userObj.APIKeys[id]
+	if key == nil {
+		return nil, nil, ErrInvalidToken
+	}
+	sum := sha256.Sum256([]byte(t))
+	if subtle.ConstantTimeCompare(sum[:], key.Hash) != 1 {
+		return nil, nil, ErrInvalidToken
+	}
+	now := s.now()
+	if (!key.Expires.IsZero() && now.After(key.Expires)) || userObj.Status == UserSuspended {
+		return nil, nil, ErrInvalidToken
+	}
+	if now.Sub(key.LastUsed) >= apiKeyTouchInterval {
+		s.touchAPIKey(user, id, now)
+	}
+	return userObj, key, nil
+}
+
+// scope gives the scope of a key, which holds no roles, or nil if it is not limited.
+func (k *APIKey) scope() *TokenScope {
+	if len(k.Scopes) == 0 {
+		return nil
+	}
+	return &TokenScope{Permissions: k.Scopes}
+}
+
+// touchAPIKey saves the last use of a key in the background, as the callers of verifyAPIKey only
+// hold s.mu for reading. A key is only saved by one goroutine at a time.
+func (s *Server) touchAPIKey(user UserID, id string, now time.Time) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.touching[id] {
+		return
+	}
+	s.touching[id] = true
+
+	started := s.goBackground(func() {
+		defer func() {
+			s.tokenMu.Lock()
+			delete(s.touching, id)
+			s.tokenMu.Unlock()
+		}()
+		ctx := context.Background() // Not canceled with the request using the key
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		userObj, err := s.getUser(ctx, user)
+		if err != nil {
+			return
+		}
+		// The key may have been revoked in the meantime
+		if key := userObj.APIKeys[id]; key == nil || !key.LastUsed.Before(now) {
+			return
+		}
+		userObj = userObj.clone()
+		userObj.APIKeys[id].LastUsed = now
+		_ = s.store.UpdateUser(ctx, userObj)
+	})
+	if !started {
+		delete(s.touching, id)
+	}
+}
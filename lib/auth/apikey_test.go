@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	uid, _ := svr.CreateUser("ci", "passw0rd")
+	rid, _ := svr.CreateRole("deployer")
+	svr.GrantPermissionToRole(rid, "deploy:*")
+	svr.AddRoleToUser(uid, rid)
+	{
+		key, err := svr.CreateAPIKey(uid, "pipeline", nil, time.Time{})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, strings.HasPrefix(string(key), APIKeyPrefix), "should have the prefix")
+		ok, err := svr.CheckRole(key, rid)
+		assert.Equal(t, true, ok, "should work as a token")
+		user, _ := svr.TokenUser(key)
+		assert.Equal(t, uid, user, "should identify the user")
+		altered := []byte(key)
+		if altered[30] == 'A' {
+			altered[30] = 'B'
+		} else {
+			altered[30] = 'A'
+		}
+		_, err = svr.TokenUser(TokenValue(altered))
+		assert.Equal(t, ErrInvalidToken, err, "should reject altered keys")
+		for _, k := range svr.GetUser(uid).APIKeys {
+			assert.Equal(t, false, strings.Contains(string(k.Hash), string(key)), "should not store the key")
+		}
+		svr.Invalidate(key)
+		_, err = svr.TokenUser(key)
+		assert.Equal(t, nil, err, "should not be revoked by Invalidate")
+	}
+	{
+		key, _ := svr.CreateAPIKey(uid, "staging", []string{"deploy:staging"}, time.Time{})
+		ok, _ := svr.CheckPermission(key, "deploy:staging")
+		assert.Equal(t, true, ok, "should grant the scopes")
+		ok, _ = svr.CheckPermission(key, "deploy:prod")
+		assert.Equal(t, false, ok, "should be limited to the scopes")
+		ok, _ = svr.CheckRole(key, rid)
+		assert.Equal(t, false, ok, "should not pass role checks with scopes")
+		roles, _ := svr.AllRoles(key)
+		assert.Equal(t, []RoleID{}, roles, "should not list roles with scopes")
+		_, err := svr.CreateAPIKey(uid, "bad", []string{"deploy::x"}, time.Time{})
+		assert.Equal(t, ErrInvalidPermission, err, "should check the scopes")
+	}
+	{
+		key, _ := svr.CreateAPIKey(uid, "old", nil, time.Now().Add(-time.Second))
+		_, err := svr.TokenUser(key)
+		assert.Equal(t, ErrInvalidToken, err, "should expire")
+		_, err = svr.TokenUser(APIKeyPrefix + "AAAA")
+		assert.Equal(t, ErrInvalidToken, err, "should reject malformed keys")
+		_, err = svr.CreateAPIKey(101, "x", nil, time.Time{})
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist for nonexistent users")
+	}
+	{
+		list, err := svr.ListAPIKeys(uid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 3, len(list), "should list all keys")
+		assert.Equal(t, "pipeline", list[0].Name, "should list the oldest first")
+		assert.Eventually(t, func() bool {
+			list, _ := svr.ListAPIKeys(uid)
+			return !list[0].LastUsed.IsZero()
+		}, time.Second, time.Millisecond, "should record the last use")
+		assert.Equal(t, []string{"deploy:staging"}, list[1].Scopes, "should list the scopes")
+
+		key, _ := svr.CreateAPIKey(uid, "temp", nil, time.Time{})
+		list, _ = svr.ListAPIKeys(uid)
+		err = svr.RevokeAPIKey(uid, list[3].ID)
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.TokenUser(key)
+		assert.Equal(t, ErrInvalidToken, err, "should revoke the key")
+		err = svr.RevokeAPIKey(uid, list[3].ID)
+		assert.Equal(t, ErrAPIKeyNotExist, err, "should give ErrAPIKeyNotExist")
+	}
+	{
+		key, _ := svr.CreateAPIKey(uid, "pipeline2", nil, time.Time{})
+		svr.SuspendUser(uid)
+		_, err := svr.TokenUser(key)
+		assert.Equal(t, ErrInvalidToken, err, "should reject keys of suspended users")
+	}
+}
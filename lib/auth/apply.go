@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+// Spec is the desired state of roles, their permissions and their assignments to users, for Apply.
+// It is meant to be kept in version control, and applied on change.
+type Spec struct {
+	Roles []RoleSpec `json:"roles"`
+	// Users sets the direct roles of users, by name. Users left out keep theirs, and roles held
+	// through groups are not affected.
+	Users []UserSpec `json:"users"`
+}
+
+// RoleSpec is a role with exactly the given permissions.
+type RoleSpec struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserSpec is a user holding exactly the given roles, by name.
+type UserSpec struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// ApplyOptions customizes Apply.
+type ApplyOptions struct {
+	// Prune deletes the roles that are not in the spec, but protected ones (see
+	// Server.SetRoleProtected). Otherwise they are kept as they are.
+	Prune bool
+	// DryRun only computes the changes, without making them.
+	DryRun bool
+}
+
+// ChangeOp is the kind of a Change.
+type ChangeOp string
+
+const (
+	OpCreateRole       ChangeOp = "create_role"
+	OpDeleteRole       ChangeOp = "delete_role"
+	OpGrantPermission  ChangeOp = "grant_permission"
+	OpRevokePermission ChangeOp = "revoke_permission"
+	OpAddRole          ChangeOp = "add_role" // to a user
+	OpRemoveRole       ChangeOp = "remove_role"
+)
+
+// Change is a step that takes the server to the state of a spec.
+type Change struct {
+	Op         ChangeOp `json:"op"`
+	Role       string   `json:"role"`
+	Permission string   `json:"permission,omitempty"`
+	User       string   `json:"user,omitempty"`
+}
+
+var (
+	ErrInvalidSpec = newError("invalid_spec", http.StatusBadRequest, "invalid spec")
+)
+
+// Apply takes roles and assignments to the state described by spec: it computes the difference
+// with the current state, and creates, updates or deletes what is needed, in that order. Applying
+// the same spec again changes nothing. The spec is checked as a whole before any change, and the
+// changes are made under the write lock, so others never see a half-applied spec. A storage
+// error midway leaves the changes made so far, and applying again completes them.
+//
+// Returns: the changes, made or (with DryRun) to make
+// Errors: ErrInvalidSpec (e.g. a role or user twice), ErrInvalidPermission, ErrUserNotExist,
+// ErrRoleNotExist (for roles of users that are not in the spec, unless existing and, with Prune,
+// protected), ErrTooManyRoles before any change.
+// With a storage error, the changes made are returned as well.
+func (s *Server) Apply(spec *Spec, opts *ApplyOptions) (_ []Change, err error) {
+	s, sp := s.trace("auth.Apply")
+	defer func() { sp.end(err) }()
+	if spec == nil {
+		return nil, ErrInvalidSpec
+	}
+	var o ApplyOptions
+	if opts != nil {
+		o = *opts
+	}
+	wanted, err := spec.roles()
+	if err != nil {
+		return nil, err
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.allRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+
+	// Roles and permissions
+	for _, rs := range spec.Roles {
+		r := existing[rs.Name]
+		if r == nil {
+			changes = append(changes, Change{Op: OpCreateRole, Role: rs.Name})
+			r = &Role{Name: rs.Name}
+		}
+		for _, p := range wanted[rs.Name] {
+			if !r.hasPermission(p) {
+				changes = append(changes, Change{Op: OpGrantPermission, Role: rs.Name, Permission: p})
+			}
+		}
+		for _, p := range r.Permissions {
+			if !contains(wanted[rs.Name], p) {
+				changes = append(changes, Change{Op: OpRevokePermission, Role: rs.Name, Permission: p})
+			}
+		}
+	}
+
+	// Assignments, checked before any change is made
+	users := make([]*User, len(spec.Users))
+	seen := make(map[string]bool, len(spec.Users))
+	for i, us := range spec.Users {
+		if us.Name == "" || seen[us.Name] {
+			return nil, ErrInvalidSpec
+		}
+		seen[us.Name] = true
+		if users[i], err = s.getUserByName(ctx, us.Name); err != nil {
+			return nil, err
+		}
+		current := liveRoles(users[i], existing)
+		held := make(map[string]bool, len(us.Roles))
+		for _, name := range us.Roles {
+			if _, ok := wanted[name]; !ok && (existing[name] == nil || (o.Prune && !existing[name].Protected)) {
+				return nil, ErrRoleNotExist
+			}
+			if held[name] {
+				continue
+			}
+			held[name] = true
+			if !contains(current, name) {
+				changes = append(changes, Change{Op: OpAddRole, Role: name, User: us.Name})
+			}
+		}
+		for _, name := range current {
+			if !held[name] {
+				changes = append(changes, Change{Op: OpRemoveRole, Role: name, User: us.Name})
+			}
+		}
+	}
+
+	if o.Prune {
+		var names []string
+		for name, r := range existing {
+			if _, ok := wanted[name]; !ok && !r.Protected {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			changes = append(changes, Change{Op: OpDeleteRole, Role: name})
+		}
+	}
+	if o.DryRun {
+		return changes, nil
+	}
+	creates := 0
+	for _, c := range changes {
+		if c.Op == OpCreateRole {
+			creates++
+		}
+	}
+	if err := s.checkRoleLimit(ctx, creates); err != nil {
+		return nil, err
+	}
+	for i, c := range changes {
+		if err := s.applyChange(ctx, c, existing); err != nil {
+			return changes[:i], err
+		}
+	}
+	return changes, nil
+}
+
+// roles checks the roles of a spec, and gives their sorted permissions by name.
+func (spec *Spec) roles() (map[string][]string, error) {
+	wanted := make(map[string][]string, len(spec.Roles))
+	for _, rs := range spec.Roles {
+		if _, dup := wanted[rs.Name]; dup || rs.Name == "" {
+			return nil, ErrInvalidSpec
+		}
+		perms := make([]string, 0, len(rs.Permissions))
+		for _, p := range rs.Permissions {
+			if err := validatePermission(p); err != nil {
+				return nil, err
+			}
+			if !contains(perms, p) {
+				perms = append(perms, p)
+			}
+		}
+		sort.Strings(perms)
+		wanted[rs.Name] = perms
+	}
+	return wanted, nil
+}
+
+// allRoles gets every role by name. The caller must hold s.mu.
+func (s *Server) allRoles(ctx context.Context) (map[string]*Role, error) {
+	roles := make(map[string]*Role)
+	q := ListQuery{Limit: MaxListLimit}
+	for {
+		page, err := s.store.ListRoles(ctx, &q)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			roles[r.Name] = r
+		}
+		if len(page) < q.Limit {
+			return roles, nil
+		}
+		q.After = &ListKey{ID: int64(page[len(page)-1].ID), Name: page[len(page)-1].Name}
+	}
+}
+
+// applyChange makes a change of Apply, keeping roles (by name) up to date. The caller must hold
+// s.mu.
+func (s *Server) applyChange(ctx context.Context, c Change, roles map[string]*Role) error {
+	switch c.Op {
+	case OpCreateRole:
+		r := &Role{Name: c.Role}
+		if err := s.store.InsertRole(ctx, r); err != nil {
+			return err
+		}
+		roles[c.Role] = r
+		s.emit(Event{Type: EventRoleCreated, Role: r.ID, Name: r.Name})
+
+	case OpDeleteRole:
+		if err := s.deleteRole(ctx, roles[c.Role]); err != nil {
+			return err
+		}
+		delete(roles, c.Role)
+
+	case OpGrantPermission, OpRevokePermission:
+		r := roles[c.Role].clone()
+		if c.Op == OpGrantPermission {
+			r.Permissions = append(r.Permissions, c.Permission)
+			sort.Strings(r.Permissions)
+		} else {
+			var perms []string
+			for _, p := range r.Permissions {
+				if p != c.Permission {
+					perms = append(perms, p)
+				}
+			}
+			r.Permissions = perms
+		}
+		if err := s.store.UpdateRole(ctx, r); err != nil {
+			return err
+		}
+		roles[c.Role] = r
+
+	case OpAddRole, OpRemoveRole:
+		userObj, err := s.getUserByName(ctx, c.User)
+		if err != nil {
+			return err
+		}
+		r := roles[c.Role]
+		userObj = userObj.clone()
+		event := EventRoleGranted
+		if c.Op == OpAddRole {
+			userObj.Roles[r.ID] = r
+		} else {
+			delete(userObj.Roles, r.ID)
+			event = EventRoleRevoked
+		}
+		delete(userObj.RoleExpiry, r.ID)
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return err
+		}
+		s.emit(Event{Type: event, User: userObj.ID, Name: userObj.Name, Role: r.ID})
+	}
+	return nil
+}
+
+// liveRoles gives the sorted names of the direct roles of a user, leaving out deleted roles, which
+// users keep referring to.
+func liveRoles(u *User, roles map[string]*Role) []string {
+	var names []string
+	for id, r := range u.Roles {
+		if live := roles[r.Name]; live != nil && live.ID == id {
+			names = append(names, r.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	belle, _ := svr.CreateUser("belle", "passw0rd")
+	legacy, _ := svr.CreateRole("legacy")
+	svr.AddRoleToUser(anna, legacy)
+	svr.AddRoleToUser(belle, legacy)
+	gone, _ := svr.CreateRole("gone")
+	svr.AddRoleToUser(anna, gone)
+	svr.DeleteRole(gone) // Taken away from anna too
+	spec := &Spec{
+		Roles: []RoleSpec{
+			{Name: "admin", Permissions: []string{"*"}},
+			{Name: "reader", Permissions: []string{"orders:read", "invoices:read", "orders:read"}},
+		},
+		Users: []UserSpec{{Name: "anna", Roles: []string{"admin", "reader"}}},
+	}
+	{
+		for _, bad := range []*Spec{
+			nil,
+			{Roles: []RoleSpec{{Name: "admin"}, {Name: "admin"}}},
+			{Users: []UserSpec{{Name: "anna"}, {Name: "anna"}}},
+		} {
+			_, err := svr.Apply(bad, nil)
+			assert.Equal(t, ErrInvalidSpec, err, "should check the spec")
+		}
+		_, err := svr.Apply(&Spec{Roles: []RoleSpec{{Name: "admin", Permissions: []string{"a::b"}}}}, nil)
+		assert.Equal(t, ErrInvalidPermission, err, "should check permissions")
+		_, err = svr.Apply(&Spec{Users: []UserSpec{{Name: "cara"}}}, nil)
+		assert.Equal(t, ErrUserNotExist, err, "should check users")
+		_, err = svr.Apply(&Spec{Users: []UserSpec{{Name: "anna", Roles: []string{"legacy"}}}}, &ApplyOptions{Prune: true})
+		assert.Equal(t, ErrRoleNotExist, err, "should not assign pruned roles")
+		assert.Equal(t, (*Role)(nil), svr.GetRoleByName("admin"), "should not change anything on errors")
+	}
+	{
+		changes, err := svr.Apply(spec, &ApplyOptions{Prune: true, DryRun: true})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []Change{
+			{Op: OpCreateRole, Role: "admin"},
+			{Op: OpGrantPermission, Role: "admin", Permission: "*"},
+			{Op: OpCreateRole, Role: "reader"},
+			{Op: OpGrantPermission, Role: "reader", Permission: "invoices:read"},
+			{Op: OpGrantPermission, Role: "reader", Permission: "orders:read"},
+			{Op: OpAddRole, Role: "admin", User: "anna"},
+			{Op: OpAddRole, Role: "reader", User: "anna"},
+			{Op: OpRemoveRole, Role: "legacy", User: "anna"},
+			{Op: OpDeleteRole, Role: "legacy"},
+		}, changes, "should compute the changes")
+		assert.Equal(t, (*Role)(nil), svr.GetRoleByName("admin"), "should not make changes in a dry run")
+	}
+	{
+		changes, _ := svr.Apply(spec, nil)
+		assert.Equal(t, 8, len(changes), "should keep other roles without Prune")
+		reader := svr.GetRoleByName("reader")
+		assert.Equal(t, []string{"invoices:read", "orders:read"}, reader.Permissions, "should grant the permissions")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		ok, _ := svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should assign the roles")
+		ok, _ = svr.CheckRole(token, legacy)
+		assert.Equal(t, false, ok, "should remove the roles left out")
+		ok, _ = svr.CheckRole(token, reader.ID)
+		assert.Equal(t, true, ok, "should add the roles of the spec")
+
+		changes, _ = svr.Apply(spec, nil)
+		assert.Equal(t, 0, len(changes), "should change nothing the second time")
+	}
+	{
+		spec.Roles[1].Permissions = []string{"orders:*"}
+		changes, err := svr.Apply(spec, &ApplyOptions{Prune: true})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []Change{
+			{Op: OpGrantPermission, Role: "reader", Permission: "orders:*"},
+			{Op: OpRevokePermission, Role: "reader", Permission: "invoices:read"},
+			{Op: OpRevokePermission, Role: "reader", Permission: "orders:read"},
+			{Op: OpDeleteRole, Role: "legacy"},
+		}, changes, "should update permissions and prune roles")
+		assert.Equal(t, []string{"orders:*"}, svr.GetRoleByName("reader").Permissions, "should set the permissions")
+		assert.Equal(t, (*Role)(nil), svr.GetRoleByName("legacy"), "should delete pruned roles")
+		svr.CreateRole("legacy")
+		changes, _ = svr.Apply(spec, nil)
+		assert.Equal(t, 0, len(changes), "should ignore deleted roles held by users")
+	}
+	{
+		system, _ := svr.CreateRole("system")
+		svr.SetRoleProtected(system, true)
+		svr.AddRoleToUser(belle, system)
+		spec.Users = append(spec.Users, UserSpec{Name: "belle", Roles: []string{"system"}})
+		changes, err := svr.Apply(spec, &ApplyOptions{Prune: true})
+		assert.Equal(t, nil, err, "should let users keep protected roles")
+		assert.Equal(t, []Change{{Op: OpDeleteRole, Role: "legacy"}}, changes, "should not prune protected roles")
+		assert.Equal(t, system, svr.GetRoleByName("system").ID, "should keep protected roles")
+	}
+}
@@ -1,336 +1,1585 @@
-package auth
-
-import (
-	"bytes"
-	"crypto/rand"
-	"encoding/base64"
-	"errors"
-	"time"
-)
-
-type InMemoryServerConfig struct {
-	TokenExpireSec int32
-}
-
-// InMemoryServer is an auth server that stores all its data in memory (without persistence).
-// It uses maps to provide quick access with both IDs and names as key.
-// TODO: use a mutex to protect internal data structures when operating multi-threaded.
-type InMemoryServer struct {
-	cfg InMemoryServerConfig
-
-	users  map[UserID]*User
-	uname  map[string]*User
-	roles  map[RoleID]*Role
-	rname  map[string]*Role
-	tokens map[TokenValue]*Token
-
-	// Auto-increment numerical IDs
-	nextUser UserID
-	nextRole RoleID
-
-	// For removing expired tokens
-	tokenQ []TokenQueue
-
-	// For calculating server epoch
-	startedOn time.Time
-}
-
-var (
-	ErrInvalidConfig = errors.New("wrong config")
-	ErrInternal      = errors.New("internal server error")
-)
-
-// NewInMemoryServer creates an InMemoryServer for authentication and authorization.
-// We assume that tokens must be valid for at least 1 minute to be useful. Setting TokenExpireSec
-// to anything below that will result in an error.
-//
-// Returns: pointer to the new server instance
-// Errors: ErrInvalidConfig
-// TODO: allow setting nextUser and nextRole in config.
-func NewInMemoryServer(config *InMemoryServerConfig) (*InMemoryServer, error) {
-	if config == nil || config.TokenExpireSec < 60 {
-		return nil, ErrInvalidConfig
-	}
-
-	svr := InMemoryServer{
-		cfg:      *config,
-		users:    make(map[UserID]*User),
-		uname:    make(map[string]*User),
-		roles:    make(map[RoleID]*Role),
-		rname:    make(map[string]*Role),
-		tokens:   make(map[TokenValue]*Token),
-		nextUser: 1,
-		nextRole: 1,
-
-		startedOn: time.Now(),
-	}
-	return &svr, nil
-}
-
-// *-* Public API *-*
-
-// CreateUser adds a new user with given credentials.
-//
-// Returns: the ID of the new user
-// Errors: ErrWeakPassword, ErrUserExists
-func (s *InMemoryServer) CreateUser(name, password string) (UserID, error) {
-	if _, exists := s.uname[name]; exists {
-		return 0, ErrUserExists
-	}
-	if len(password) < 6 {
-		return 0, ErrWeakPassword
-	}
-
-	newUser := User{
-		ID:     s.nextUser,
-		Name:   name,
-		Secret: getPasswordHash(password),
-		Roles:  make(map[RoleID]*Role),
-	}
-	s.users[s.nextUser] = &newUser
-	s.uname[name] = &newUser
-	s.nextUser++
-	return newUser.ID, nil
-}
-
-// DeleteUser removes a user with given ID.
-//
-// Returns: none
-// Errors: ErrUserNotExist
-func (s *InMemoryServer) DeleteUser(user UserID) error {
-	userObj, ok := s.users[user]
-	if !ok {
-		return ErrUserNotExist
-	}
-
-	delete(s.users, user)
-	delete(s.uname, userObj.Name)
-	return nil
-}
-
-// CreateRole adds a new role with given name.
-//
-// Returns: the ID of the new group
-// Errors: ErrRoleExists
-func (s *InMemoryServer) CreateRole(name string) (RoleID, error) {
-	if _, exists := s.rname[name]; exists {
-		return 0, ErrRoleExists
-	}
-
-	newRole := Role{
-		ID:   s.nextRole,
-		Name: name,
-	}
-	s.roles[s.nextRole] = &newRole
-	s.rname[name] = &newRole
-	s.nextRole++
-	return newRole.ID, nil
-}
-
-// DeleteRole removes a role with given ID.
-//
-// Returns: none
-// Errors: ErrRoleNotExist
-func (s *InMemoryServer) DeleteRole(role RoleID) error {
-	roleObj, ok := s.roles[role]
-	if !ok {
-		return ErrRoleNotExist
-	}
-
-	delete(s.roles, role)
-	delete(s.rname, roleObj.Name)
-	return nil
-}
-
-// AddRoleToUser assigns a role to a user.
-// It is a no-op if the user already has the role.
-//
-// Returns: none
-// Errors: ErrUserNotExist, ErrRoleNotExist
-func (s *InMemoryServer) AddRoleToUser(user UserID, role RoleID) error {
-	userObj, ok := s.users[user]
-	if !ok {
-		return ErrUserNotExist
-	}
-	roleObj, ok := s.roles[role]
-	if !ok {
-		return ErrRoleNotExist
-	}
-
-	userObj.Roles[roleObj.ID] = roleObj
-	return nil
-}
-
-// Authenticate checks a username/password pair, and creates a token for the user if it passes.
-// Note that the password is clear text, like that in HTTP Basic auth.
-// For security, the function does not distinguish "wrong username" from "wrong password".
-// ErrInternal is returned only in rare cases where the system cannot provide enough randomness.
-//
-// Returns: the token string
-// Errors: ErrInvalidAuth, ErrInternal
-// TODO: use old token instead of username/password to renew authentication
-func (s *InMemoryServer) Authenticate(username, password string) (TokenValue, error) {
-	userObj, ok := s.uname[username]
-	if !ok {
-		return "", ErrInvalidAuth
-	}
-	secret := getPasswordHash(password)
-	if !bytes.Equal(secret, userObj.Secret) {
-		return "", ErrInvalidAuth
-	}
-
-	token, err := s.newToken(userObj)
-	if err != nil {
-		return "", ErrInternal
-	}
-	s.tokens[token.Value] = token
-	return token.Value, nil
-}
-
-// Invalidate invalidates a token immediately.
-//
-// Returns: none
-func (s *InMemoryServer) Invalidate(token TokenValue) {
-	delete(s.tokens, token)
-}
-
-// CheckRole checks if the user identified by the token has the given role.
-//
-// Returns: true or false
-// Errors: ErrRoleNotExist, ErrInvalidToken
-func (s *InMemoryServer) CheckRole(token TokenValue, role RoleID) (bool, error) {
-	userObj, err := s.verifyToken(token)
-	if err != nil {
-		return false, err
-	}
-
-	if _, ok := s.roles[role]; !ok {
-		return false, ErrRoleNotExist
-	}
-
-	_, belongs := userObj.Roles[role]
-	return belongs, nil
-}
-
-// AllRoles return all role IDs associated with the user identified by the token.
-//
-// Returns: a list of RoleIDs (32-bit integers)
-// Errors: ErrInvalidToken
-func (s *InMemoryServer) AllRoles(token TokenValue) ([]RoleID, error) {
-	userObj, err := s.verifyToken(token)
-	if err != nil {
-		return nil, err
-	}
-	roleList := make([]RoleID, len(userObj.Roles))
-	var i int
-	for role := range userObj.Roles {
-		roleList[i] = role
-		i++
-	}
-	return roleList, nil
-}
-
-// *-* Query operations *-*
-// These functions provide mapping between IDs and names.
-// nil is returned if the query has no result.
-// The function names are self-explanatory.
-
-func (s *InMemoryServer) GetUser(id UserID) *User {
-	return s.users[id]
-}
-
-func (s *InMemoryServer) GetUserByName(name string) *User {
-	return s.uname[name]
-}
-
-func (s *InMemoryServer) GetRole(id RoleID) *Role {
-	return s.roles[id]
-}
-
-func (s *InMemoryServer) GetRoleByName(name string) *Role {
-	return s.rname[name]
-}
-
-// *-* Internal *-*
-// Bookkeeping, including token maintenance.
-
-// newToken creates a new token for a user.
-// It optionally triggers garbage collection for expired tokens.
-func (s *InMemoryServer) newToken(u *User) (*Token, error) {
-	b := make([]byte, 8)
-	_, err := rand.Read(b)
-	if err != nil {
-		return nil, err
-	}
-	now := time.Now()
-	t := Token{
-		Value:   TokenValue(base64.StdEncoding.EncodeToString(b)),
-		User:    u.ID,
-		Expires: now.Add(time.Duration(s.cfg.TokenExpireSec) * time.Second),
-	}
-	s.addToTokenQueue(&t)
-	return &t, nil
-}
-
-// verifyToken ensures the token, as well as its associated user, is valid and not expired/deleted.
-func (s *InMemoryServer) verifyToken(t TokenValue) (*User, error) {
-	tokenObj, ok := s.tokens[t]
-	if !ok {
-		return nil, ErrInvalidToken
-	}
-	now := time.Now()
-	if now.After(tokenObj.Expires) {
-		// Lazily remove expired tokens
-		delete(s.tokens, t)
-		return nil, ErrInvalidToken
-	}
-	userObj, ok := s.users[tokenObj.User]
-	if !ok {
-		// Lazily invalidate tokens after the user is deleted
-		delete(s.tokens, t)
-		return nil, ErrInvalidToken
-	}
-	return userObj, nil
-}
-
-// pruneTokens remove expired tokens from memory.
-// It is triggered roughly once per hour. TODO: support configuring this interval
-func (s *InMemoryServer) pruneTokens() {
-	var (
-		i      int
-		ep     = s.currentEpochInHour()
-		expire = s.cfg.TokenExpireSec/3600 + 1
-	)
-	for i = 0; i < len(s.tokenQ); i++ {
-		if ep-s.tokenQ[i].ServerEpoch <= expire {
-			break
-		}
-		for _, token := range s.tokenQ[i].Tokens {
-			delete(s.tokens, token.Value)
-		}
-	}
-	// Avoid slice leak
-	tmpTokenQueue := make([]TokenQueue, len(s.tokenQ)-i)
-	copy(tmpTokenQueue, s.tokenQ[i:])
-	s.tokenQ = tmpTokenQueue
-}
-
-// addToTokenQueue saves a reference to a token for later pruning.
-func (s *InMemoryServer) addToTokenQueue(t *Token) {
-	ep := s.currentEpochInHour()
-	if l := len(s.tokenQ); l == 0 || s.tokenQ[l-1].ServerEpoch < ep {
-		s.tokenQ = append(s.tokenQ, TokenQueue{
-			ServerEpoch: ep,
-		})
-		s.pruneTokens()
-	}
-	l := len(s.tokenQ)
-	s.tokenQ[l-1].Tokens = append(s.tokenQ[l-1].Tokens, t)
-}
-
-// currentEpochInHour gets the number of hours, starting from 1, since the server started.
-func (s *InMemoryServer) currentEpochInHour() int32 {
-	now := time.Now()
-	elapsed := now.Sub(s.startedOn)
-	return int32(elapsed.Seconds())/3600 + 1
-}
+package auth
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ServerConfig struct {
+	TokenExpireSec int32
+	// TokenMaxLifetimeSec, if positive, makes session tokens expire after TokenExpireSec of
+	// inactivity instead: each use extends a token, until that long after it was issued. It must not
+	// be less than TokenExpireSec, and is not supported in JWT mode.
+	TokenMaxLifetimeSec int32
+	// PruneIntervalSec is the length of a server epoch, i.e. how often soft-deleted users are purged
+	// and expired temporary roles removed, in the background. Defaults to 3600. Expired tokens do not
+	// wait for it: they are removed as soon as a new token is issued after their expiry.
+	PruneIntervalSec int32
+	// TokenBytes is the randomness of opaque tokens (sessions, MFA challenges and one-time tokens),
+	// in bytes. Defaults to 32, and must be at least 16. TokenEncoding tells how they are written,
+	// and TokenPrefix, if set, starts them, e.g. "hsb_", so that secret scanners can spot them. The
+	// prefix is made of letters, digits, "_" and "-", and must not be that of API keys. Tokens
+	// issued before a change still verify.
+	TokenBytes    int
+	TokenEncoding TokenEncoding
+	TokenPrefix   string
+	// If JWT is set, Authenticate issues signed JWTs instead of opaque tokens. They carry the user ID
+	// and roles, so checking them costs a single read of the user, which rejects deleted and
+	// suspended users, and no read of the token.
+	JWT *JWTConfig
+	// JWTRotationSec, if positive, replaces the JWT signing key with a new one of the same
+	// algorithm that often, see RotateJWTKey. Retired keys keep verifying, and stay in JWKSet, for
+	// JWTGraceSec, which defaults to TokenExpireSec so that the tokens they signed live out their
+	// lifetime. Only supported in JWT mode, and for a single server, as the new keys are not shared.
+	JWTRotationSec int32
+	JWTGraceSec    int32
+	// Revocations, if set, shares the JWTs revoked by Invalidate with the other servers of a
+	// cluster, and applies theirs. Only supported in JWT mode.
+	Revocations RevocationBroadcaster
+	// Hasher hashes new passwords. Defaults to Argon2idHasher with OWASP-recommended parameters.
+	// Hashes made by other built-in hashers still verify, so the algorithm can be changed anytime.
+	Hasher PasswordHasher
+	// LegacySHA256 accepts the unsalted SHA-256 hashes of early versions of this package on login.
+	// Only enable it for data created by those versions.
+	LegacySHA256 bool
+	// RehashOnLogin replaces the hash of a user on login if the Hasher would make another one, e.g.
+	// a legacy SHA-256 or bcrypt hash after switching to Argon2id, or one with lower cost
+	// parameters, so that existing users migrate as they log in.
+	RehashOnLogin bool
+	// Peppers, if set, are secrets mixed into the password hashes (see Pepper). New hashes use the
+	// first one; the others still verify the hashes made with them. To rotate, put a new pepper
+	// first, and remove the old one once its users have logged in with RehashOnLogin, or have been
+	// given new passwords: their hashes no longer verify without it. Hashes made without a pepper
+	// verify as before.
+	Peppers []Pepper
+	// KeyProvider, if set, encrypts the secrets of users at rest, for persistent storages and
+	// snapshots: password hashes, TOTP secrets and recovery codes, and the hashes of API keys are
+	// saved in User.Sealed, with AES-256-GCM data keys wrapped by the master key of the provider.
+	// Users saved before keep their secrets in the clear until next updated. Servers sharing the
+	// storage need the same master key, as secrets they cannot decrypt fail with ErrDecrypt.
+	KeyProvider KeyProvider
+	// PasswordPolicy is enforced on new passwords. Defaults to DefaultPasswordPolicy.
+	PasswordPolicy *PasswordPolicy
+	// UsernamePolicy, if set, is enforced on the names of new local users, and may make names
+	// case-insensitive. Users of Authenticators keep the names of their directory, normalized.
+	UsernamePolicy *UsernamePolicy
+	// BreachChecker, if set, rejects new passwords found in data breaches with ErrBreachedPassword,
+	// after the PasswordPolicy. Its errors are returned as they are, so that an outage does not let
+	// breached passwords through.
+	BreachChecker BreachChecker
+	// Policies are the policies of CheckAccess by name, compiled by PolicyCompiler when the server is
+	// created. More can be added with SetPolicy.
+	Policies map[string]string
+	// PolicyCompiler compiles the policies. Defaults to the built-in expressions, see
+	// CompileExpression.
+	PolicyCompiler PolicyCompiler
+	// EmailVerificationSec is how long the tokens of RequestEmailVerification are valid. Defaults to
+	// an hour, and is capped at the lifetime of session tokens.
+	EmailVerificationSec int32
+	// PasswordResetSec is how long the tokens of RequestPasswordReset are valid. Defaults to 15
+	// minutes, and is capped at the lifetime of session tokens.
+	PasswordResetSec int32
+	// RequireVerifiedEmail makes Authenticate fail with ErrEmailNotVerified for users whose email
+	// address is missing or not verified, see VerifyEmail. It does not apply to the users of
+	// Authenticators, whose addresses are up to their directory.
+	RequireVerifiedEmail bool
+	// RateLimiter, if set, throttles Authenticate by user name and source IP (see
+	// AuthenticateClient and WithClientInfo) against brute-force attacks, e.g. &TokenBucket{}:
+	// attempts beyond the allowance of either fail with ErrRateLimited, before the password is
+	// checked, and a login.throttled event. A successful login restores the allowance of the name.
+	// The codes given to CompleteMFA take from the allowance of the user too, which the password
+	// does not restore then. Its errors are returned as they are.
+	RateLimiter RateLimiter
+	// TOTPIssuer names the service in authenticator apps. Defaults to "auth".
+	TOTPIssuer string
+	// SoftDeleteSec, if positive, makes DeleteUser keep deleted users for that long, during which
+	// they can be restored with RestoreUser. They are purged in the background afterwards.
+	SoftDeleteSec int32
+	// LazyCleanup skips the cleanup of DeleteUser and DeleteRole, for deployments where deletions
+	// must stay cheap: the tokens of a deleted user are then removed when next used or pruned, and
+	// the groups and resource grants of a deleted role keep its ID, which is ignored. DeleteRole
+	// still takes the role away from the users holding it directly.
+	LazyCleanup bool
+	// Authenticators verify the passwords of names without a local user, in order, and of the users
+	// they created. See Authenticator.
+	Authenticators []Authenticator
+	// DefaultRoles are the names of roles given to every user made by CreateUser, each with a
+	// role.granted event marked Default. Names without a role are skipped, so that the roles can be
+	// created after the server. Service accounts and imported users do not get them.
+	DefaultRoles []string
+	// DefaultRolesExternal also gives the DefaultRoles to the users created by Authenticators, on
+	// top of the roles of their Identity.
+	DefaultRolesExternal bool
+	// MaxSessions, if positive, limits the active session tokens of each user. OnMaxSessions tells
+	// what happens to a new one beyond that. API keys do not count. Not supported in JWT mode.
+	MaxSessions   int
+	OnMaxSessions SessionLimitAction
+	// BindTokens binds every session token to the IP and Fingerprint of the client it is issued to
+	// (see AuthenticateClient), as ClientInfo.Bind does for one token: it then only verifies for a
+	// server whose context carries the same client (see WithClientInfo), so that a stolen token
+	// cannot be replayed from elsewhere. Tokens issued without either are not bound. Not
+	// supported in JWT mode.
+	BindTokens bool
+	// SessionVersioning makes downgrades of a user take effect on its tokens at once, including
+	// JWTs, which otherwise keep their roles until they expire: setting or resetting its password,
+	// taking a role away from it (directly, through a group, or on expiry), removing it from a group
+	// and suspending it bump its SessionVersion, and the tokens issued before stop verifying. API
+	// keys are not affected.
+	SessionVersioning bool
+	// ImpersonatePermission, if set, is the permission allowing Impersonate, such as
+	// "users:impersonate". Impersonation is disabled without it, and in JWT mode.
+	ImpersonatePermission string
+	// StepUp demands fresh or MFA-verified logins for the permissions it lists, see StepUp. Cached
+	// decisions (see DecisionCacheSec) may outlive a MaxAgeSec by up to DecisionCacheSec.
+	StepUp []StepUp
+	// DecisionCacheSec, if positive, caches the results of CheckRole and CheckPermission by token
+	// and role or permission for that long, for gateways checking every request. The cache is
+	// emptied by every change to users, roles, groups or tokens made through the server, including
+	// the revocation of tokens, so it only misses the changes made by other servers sharing the
+	// storage (unless it is a ChangeNotifier) and the passing of time: a result may outlive the
+	// expiry of its token or of a temporary role by up to DecisionCacheSec. It must be less than
+	// TokenExpireSec. DecisionCacheSize limits the cached results, which are all dropped when it is
+	// reached. Defaults to 10000.
+	DecisionCacheSec  int32
+	DecisionCacheSize int
+	// StorageCacheSize, if positive, keeps up to that many users, roles, groups and tokens read from
+	// the storage in memory, evicting the least recently used, so that a persistent storage is read
+	// about as fast as a MemoryStorage. Writes go to the storage before they return, and drop what
+	// they change from the cache. Like the decision cache, it misses the changes made by other
+	// servers sharing the storage, unless it is a ChangeNotifier. It cannot be used with a
+	// MemoryStorage, which is in memory already.
+	StorageCacheSize int
+	// LoginHistorySize is how many logins are kept per user, see GetLoginHistory. Defaults to 10.
+	LoginHistorySize int
+	// MaxUsers, MaxRoles and MaxTokens, if positive, bound what the server holds, so that whoever
+	// can log in or create users cannot make it grow without end. Beyond them, new users (including
+	// those of Authenticators and imports) fail with ErrTooManyUsers, new roles with
+	// ErrTooManyRoles, and new tokens (sessions, MFA challenges and one-time tokens) with
+	// ErrTooManyTokens. Users, soft-deleted ones included, and roles are counted by the storage,
+	// which must then implement Counter. Tokens are counted as this server queues them for pruning
+	// (see Stats), so invalidated tokens count until they expire. MaxTokensPerUser bounds the live
+	// tokens of each user, of all kinds, read from Storage.UserTokens: those deleted (on logout, or
+	// replaced by a new password reset) make room at once, so that nobody can lock a user out by
+	// piling up tokens. MaxSessions only counts sessions. JWTs are not saved, so not counted.
+	MaxUsers         int64
+	MaxRoles         int64
+	MaxTokens        int
+	MaxTokensPerUser int
+	// Clock tells the time for token expiry, pruning and the other timestamps of the server.
+	// Defaults to SystemClock.
+	Clock Clock
+	// Rand is the entropy source of the values the server issues: token values (of sessions,
+	// password resets, email verifications and MFA challenges), API keys, JWT IDs, the keys it
+	// generates for JWT rotations (but RS256 ones, which crypto/rsa draws itself), TOTP secrets and
+	// recovery codes. Defaults to crypto/rand, and reads are serialized. Password salts come from
+	// the Hasher, and encryption keys and nonces always from crypto/rand, as repeating them would
+	// break the encryption. See DeterministicRand.
+	Rand io.Reader
+	// Interceptors run around the main operations of the server, the first one outermost. See
+	// Interceptor.
+	Interceptors []Interceptor
+	// ChangeLogSize, if set, keeps that many of the last changes to users, roles and groups in
+	// memory for Watch.
+	ChangeLogSize int
+	// UserIDs, if set, makes the IDs of new users, e.g. RandomIDs or a Snowflake. Otherwise the
+	// storage counts them from 1, see also MemoryStorage.StartIDs.
+	UserIDs IDGenerator
+	// Tracer, if set, traces the operations of the server and its storage calls, e.g. with
+	// lib/authotel. See Tracer.
+	Tracer Tracer
+	// SnapshotPath, if set, is the file to which Close saves a snapshot of the MemoryStorage of the
+	// server, with its tokens, for Load on the next start. Other storages are not supported.
+	SnapshotPath string
+}
+
+// Server is an auth server that implements authentication and authorization on top of a Storage.
+// All methods are safe for concurrent use.
+//
+// Methods pass the context of the server (see WithContext) to the storage, so that cancellation,
+// deadlines and request-scoped values reach persistent backends.
+type Server struct {
+	*serverCore
+	ctx context.Context
+}
+
+// serverCore is the state shared by a Server and its WithContext copies.
+type serverCore struct {
+	// cfg is the config given to NewServer, with the defaults applied, but for the fields of
+	// LiveConfig, which are read from liveCfg, see UpdateConfig
+	cfg     ServerConfig
+	liveCfg atomic.Value // *liveConfig
+	store   Storage
+	hasher  PasswordHasher
+
+	// mu serializes write operations, so that checks and updates spanning multiple store calls are
+	// atomic. Read operations hold it for reading. tokenMu guards tokenQ. sessionMu serializes new
+	// session tokens with MaxSessions.
+	// When several are needed, they are acquired in the order mu, sessionMu, tokenMu.
+	mu        sync.RWMutex
+	sessionMu sync.Mutex
+	tokenMu   sync.Mutex
+
+	// For removing expired tokens. tokenQ holds the tokens issued by this server on their expiry.
+	// queued counts them. pruneEpoch is the last epoch that started the background purges. All are
+	// guarded by tokenMu.
+	tokenQ     tokenHeap
+	queued     int
+	pruneEpoch int32
+
+	metrics *serverMetrics
+
+	// For JWT mode. revoked maps the IDs of invalidated JWTs to their expiry, and is guarded by tokenMu.
+	jwt          *jwtKeys
+	revoked      map[string]time.Time
+	revokedEpoch int32
+
+	// For calculating server epoch
+	startedOn time.Time
+
+	// 1 while PurgeDeletedUsers runs in the background
+	purging int32
+
+	// 1 while ExpireRoles runs in the background, and tempRoles 1 unless ExpireRoles found no
+	// temporary role assignments since
+	expiringRoles int32
+	tempRoles     int32
+
+	// Subscriptions, see Subscribe
+	events *eventBus
+
+	// Name of the realm, if the server is one of Realms
+	realm string
+
+	// Allowances of the MFA codes of each user without ServerConfig.RateLimiter, see mfaLimiter
+	mfaBucket *TokenBucket
+
+	// The storage encrypting secrets at rest, within store, or nil, see ServerConfig.KeyProvider
+	crypt *cryptStore
+
+	// Hash verified for the logins without one, so that they take as long, see dummyVerify
+	dummyOnce sync.Once
+	dummyHash []byte
+
+	// Compiled policies by name, see SetPolicy. policyMu guards them, and is never held with other
+	// locks.
+	policyMu sync.RWMutex
+	policies map[string]namedPolicy
+
+	// IDs of the API keys whose last use is being saved, and values of the tokens being extended,
+	// guarded by tokenMu
+	touching map[string]bool
+
+	// Results of checks, see ServerConfig.DecisionCacheSec. nil if disabled.
+	decisions *decisionCache
+	// Recent changes, see ServerConfig.ChangeLogSize. nil if disabled.
+	changes *changeLog
+
+	// For Close. closing stops new background work, guarded by closeMu, which is never held with
+	// other locks; background counts the work in progress; closed is 1 once the storage is closed.
+	closeMu    sync.Mutex
+	closing    bool
+	background sync.WaitGroup
+	closed     int32
+}
+
+// InMemoryServer is a Server backed by MemoryStorage.
+// The names are kept for compatibility with code written before Storage was introduced.
+type (
+	InMemoryServer       = Server
+	InMemoryServerConfig = ServerConfig
+)
+
+var (
+	ErrInvalidConfig = newError("invalid_config", http.StatusInternalServerError, "wrong config")
+	ErrInternal      = newError("internal", http.StatusInternalServerError, "internal server error")
+)
+
+// NewServer creates a Server for authentication and authorization, which saves its data to store.
+// We assume that tokens must be valid for at least 1 minute to be useful. Setting TokenExpireSec to
+// anything below that will result in an error. So does a negative PruneIntervalSec or
+// SoftDeleteSec, a TokenBytes below 16, an unknown TokenEncoding, an invalid TokenPrefix, a JWT key
+// not matching the algorithm, a TokenMaxLifetimeSec below TokenExpireSec or with JWT, a negative
+// MaxSessions or one with JWT, BindTokens with JWT, a negative LoginHistorySize, an invalid
+// ImpersonatePermission, an invalid permission, Level or MaxAgeSec in StepUp, Revocations without
+// JWT, a negative JWTRotationSec or JWTGraceSec, a JWTRotationSec without JWT, Peppers with an
+// empty or repeated ID, an ID containing "$", or a key under 16 bytes, Policies with an empty name,
+// an empty name in DefaultRoles, a negative EmailVerificationSec, PasswordResetSec,
+// DecisionCacheSec, DecisionCacheSize or StorageCacheSize, a DecisionCacheSec not below
+// TokenExpireSec, a negative MaxUsers, MaxRoles, MaxTokens or MaxTokensPerUser, a MaxUsers or
+// MaxRoles with a storage that does not implement Counter, a SnapshotPath with a storage other than
+// MemoryStorage, or a StorageCacheSize with a MemoryStorage.
+//
+// Returns: pointer to the new server instance
+// Errors: ErrInvalidConfig, any error from compiling Policies, or from subscribing to Revocations
+func NewServer(config *ServerConfig, store Storage) (*Server, error) {
+	if config == nil || config.TokenExpireSec < 60 || config.PruneIntervalSec < 0 || config.SoftDeleteSec < 0 || store == nil {
+		return nil, ErrInvalidConfig
+	}
+	if config.TokenMaxLifetimeSec != 0 && (config.TokenMaxLifetimeSec < config.TokenExpireSec || config.JWT != nil) {
+		return nil, ErrInvalidConfig
+	}
+	if !validTokenFormat(config) {
+		return nil, ErrInvalidConfig
+	}
+	if config.MaxSessions < 0 || (config.MaxSessions > 0 && config.JWT != nil) || (config.BindTokens && config.JWT != nil) || config.LoginHistorySize < 0 {
+		return nil, ErrInvalidConfig
+	}
+	if config.ImpersonatePermission != "" && validatePermission(config.ImpersonatePermission) != nil {
+		return nil, ErrInvalidConfig
+	}
+	if !validStepUp(config.StepUp) {
+		return nil, ErrInvalidConfig
+	}
+	if config.Revocations != nil && config.JWT == nil {
+		return nil, ErrInvalidConfig
+	}
+	if config.JWTRotationSec < 0 || config.JWTGraceSec < 0 || (config.JWTRotationSec > 0 && config.JWT == nil) {
+		return nil, ErrInvalidConfig
+	}
+	if !validPeppers(config.Peppers) {
+		return nil, ErrInvalidConfig
+	}
+	for _, name := range config.DefaultRoles {
+		if name == "" {
+			return nil, ErrInvalidConfig
+		}
+	}
+	if config.EmailVerificationSec < 0 || config.PasswordResetSec < 0 || config.DecisionCacheSec < 0 || config.DecisionCacheSec >= config.TokenExpireSec || config.DecisionCacheSize < 0 || config.StorageCacheSize < 0 {
+		return nil, ErrInvalidConfig
+	}
+	if !validLimits(config, store) {
+		return nil, ErrInvalidConfig
+	}
+	_, inMemory := store.(*MemoryStorage)
+	if config.SnapshotPath != "" && !inMemory || config.StorageCacheSize > 0 && inMemory {
+		return nil, ErrInvalidConfig
+	}
+
+	svr := serverCore{
+		cfg:    *config,
+		store:  store,
+		hasher: config.Hasher,
+
+		metrics:  &serverMetrics{},
+		touching: make(map[string]bool),
+		events:   &eventBus{subs: make(map[*subscription]struct{}), detectors: make(map[*detector]struct{})},
+
+		// Temporary role assignments may remain from a previous run
+		tempRoles: 1,
+	}
+	if svr.cfg.Clock == nil {
+		svr.cfg.Clock = SystemClock
+	}
+	svr.startedOn = svr.cfg.Clock.Now()
+	svr.mfaBucket = &TokenBucket{Clock: svr.cfg.Clock}
+	if config.KeyProvider != nil {
+		svr.crypt = newCryptStore(store, config.KeyProvider)
+		svr.store = svr.crypt
+	}
+	if svr.cfg.StorageCacheSize > 0 {
+		cache := newStorageCache(svr.cfg.StorageCacheSize)
+		svr.store = &cachedStore{Storage: svr.store, cache: cache, metrics: svr.metrics}
+		if n, ok := store.(ChangeNotifier); ok {
+			n.NotifyChanges(cache.invalidate)
+		}
+	}
+	if svr.cfg.Tracer != nil {
+		svr.store = &tracedStore{Storage: svr.store, svr: &svr}
+	}
+	if svr.cfg.DecisionCacheSec > 0 {
+		if svr.cfg.DecisionCacheSize == 0 {
+			svr.cfg.DecisionCacheSize = defaultDecisionCacheSize
+		}
+		svr.decisions = newDecisionCache(time.Duration(svr.cfg.DecisionCacheSec)*time.Second, svr.cfg.DecisionCacheSize)
+		svr.store = &decisionStore{Storage: svr.store, cache: svr.decisions}
+		if n, ok := store.(ChangeNotifier); ok {
+			n.NotifyChanges(svr.decisions.invalidate)
+		}
+	}
+	if svr.cfg.ChangeLogSize > 0 {
+		svr.changes = newChangeLog(svr.cfg.ChangeLogSize, svr.cfg.Clock, svr.startedOn)
+		svr.store = &changeStore{Storage: svr.store, log: svr.changes}
+	}
+	svr.store = &closableStore{Storage: svr.store, svr: &svr}
+	svr.cfg.Rand = entropy(svr.cfg.Rand)
+	if svr.cfg.PruneIntervalSec == 0 {
+		svr.cfg.PruneIntervalSec = 3600
+	}
+	if svr.cfg.TokenBytes == 0 {
+		svr.cfg.TokenBytes = defaultTokenBytes
+	}
+	if svr.cfg.LoginHistorySize == 0 {
+		svr.cfg.LoginHistorySize = defaultLoginHistorySize
+	}
+	if svr.hasher == nil {
+		svr.hasher = &Argon2idHasher{}
+	}
+	live := &liveConfig{
+		LiveConfig: LiveConfig{
+			TokenExpireSec:   svr.cfg.TokenExpireSec,
+			PruneIntervalSec: svr.cfg.PruneIntervalSec,
+			PasswordPolicy:   DefaultPasswordPolicy,
+			RateLimiter:      svr.cfg.RateLimiter,
+		},
+		epochFrom: svr.startedOn,
+		epochBase: 1,
+	}
+	if config.PasswordPolicy != nil {
+		live.PasswordPolicy = *config.PasswordPolicy
+		live.PasswordPolicy.BannedWords = append([]string(nil), config.PasswordPolicy.BannedWords...)
+		svr.cfg.PasswordPolicy = &live.PasswordPolicy
+	}
+	svr.liveCfg.Store(live)
+	if config.UsernamePolicy != nil {
+		p := *config.UsernamePolicy
+		p.Reserved = append([]string(nil), config.UsernamePolicy.Reserved...)
+		svr.cfg.UsernamePolicy = &p
+	}
+	svr.cfg.StepUp = append([]StepUp(nil), config.StepUp...)
+	// Copied, as a pepper changed by the caller would lock users out
+	if len(config.Peppers) > 0 {
+		svr.cfg.Peppers = make([]Pepper, len(config.Peppers))
+		for i, p := range config.Peppers {
+			svr.cfg.Peppers[i] = Pepper{ID: p.ID, Key: append([]byte(nil), p.Key...)}
+		}
+	}
+	svr.cfg.DefaultRoles = append([]string(nil), config.DefaultRoles...)
+	if svr.cfg.PolicyCompiler == nil {
+		svr.cfg.PolicyCompiler = expressionCompiler{}
+	}
+	policies, err := compilePolicies(svr.cfg.PolicyCompiler, config.Policies)
+	if err != nil {
+		return nil, err
+	}
+	svr.policies = policies
+	svr.cfg.Policies = nil
+	if config.JWT != nil {
+		keys, err := newJWTKeys(config.JWT, svr.cfg.Clock)
+		if err != nil {
+			return nil, err
+		}
+		svr.jwt = keys
+		svr.cfg.JWT = &keys.active.cfg
+		svr.revoked = make(map[string]time.Time)
+	}
+	s := &Server{serverCore: &svr, ctx: context.Background()}
+	if svr.cfg.Revocations != nil {
+		if err := svr.cfg.Revocations.Subscribe(func(r Revocation) { s.recordRevocation(r) }); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// NewInMemoryServer creates a Server backed by a new MemoryStorage. See NewServer for details.
+// It is kept for compatibility; New takes options instead, and also sets the first IDs.
+//
+// Returns: pointer to the new server instance
+// Errors: ErrInvalidConfig
+func NewInMemoryServer(config *InMemoryServerConfig) (*InMemoryServer, error) {
+	return NewServer(config, NewMemoryStorage())
+}
+
+// *-* Public API *-*
+
+// WithContext returns a copy of the server that uses ctx for its operations, e.g. the context of an
+// HTTP request. The copy shares all state with the original, and is as cheap as a pointer.
+// A nil ctx means context.Background().
+//
+// Returns: the server bound to ctx
+func (s *Server) WithContext(ctx context.Context) *Server {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Server{serverCore: s.serverCore, ctx: ctx}
+}
+
+// Context returns the context of the server, which is context.Background() unless set by
+// WithContext.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// CreateUser adds a new user with given credentials. The name must satisfy the UsernamePolicy, if
+// any, and the password the password policy. The user gets the roles of ServerConfig.DefaultRoles.
+// ErrInternal is returned only in rare cases where the system cannot provide enough randomness.
+//
+// Returns: the ID of the new user
+// Errors: ErrInvalidUsername, ErrWeakPassword, ErrBreachedPassword, ErrUserExists, ErrTooManyUsers, ErrInternal,
+// ctx.Err() of the server context, or any error from the BreachChecker
+func (s *Server) CreateUser(name, password string) (_ UserID, err error) {
+	s, sp := s.trace("auth.CreateUser")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.createUser(name, password)
+	}
+	op := &Operation{Method: "CreateUser", Name: name}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.User, err = s.createUser(op.Name, password)
+		return err
+	})
+	return op.User, err
+}
+
+// createUser is CreateUser without the interceptors.
+func (s *Server) createUser(name, password string) (_ UserID, err error) {
+	ctx := s.ctx
+	if err := s.checkUsername(name); err != nil {
+		return 0, err
+	}
+	if err := s.checkPassword(ctx, name, password); err != nil {
+		return 0, err
+	}
+	// Hashing is slow by design, so do it before taking the lock, and skip it if nobody waits
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	secret, err := s.hashPassword(password)
+	if err != nil {
+		return 0, ErrInternal
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.lookupUserByName(ctx, name); err == nil {
+		return 0, ErrUserExists
+	} else if err != ErrUserNotExist {
+		return 0, err
+	}
+
+	newUser := User{
+		Name:   s.cfg.UsernamePolicy.Normalize(name),
+		Secret: secret,
+		Roles:  make(map[RoleID]*Role),
+	}
+	defaults, err := s.grantDefaultRoles(ctx, &newUser)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.insertUser(ctx, &newUser); err != nil {
+		return 0, err
+	}
+	s.emit(Event{Type: EventUserCreated, User: newUser.ID, Name: newUser.Name})
+	s.emitDefaultRoles(&newUser, defaults)
+	return newUser.ID, nil
+}
+
+// SetPassword replaces the password of a user, as an administrator would, without asking for the
+// current one. The password must satisfy the password policy. Tokens of the user are kept, unless
+// ServerConfig.SessionVersioning is set.
+// Users created by an Authenticator have their password in the external source, and service
+// accounts have none, so setting it gives ErrUnsupported.
+//
+// Returns: none
+// Errors: ErrWeakPassword, ErrBreachedPassword, ErrUserNotExist, ErrUnsupported, ErrInternal, ctx.Err()
+// of the server context, or any error from the BreachChecker
+func (s *Server) SetPassword(user UserID, password string) (err error) {
+	s, sp := s.trace("auth.SetPassword")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	// The policy may reject the username, which is only known from the storage
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPassword(ctx, userObj.Name, password); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	secret, err := s.hashPassword(password)
+	if err != nil {
+		return ErrInternal
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Read it again, as it may have changed while hashing
+	userObj, err = s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if userObj.Source != "" || userObj.Kind == UserService {
+		return ErrUnsupported
+	}
+	userObj = userObj.clone()
+	userObj.Secret = secret
+	s.bumpSession(userObj)
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// UpdateUserName renames a user, keeping its ID, password, roles and groups, and emits a
+// user.renamed event. The name must satisfy the UsernamePolicy, if any, and be free, including
+// from soft-deleted users. Users of an Authenticator keep the name of their directory, as renaming
+// them would provision a new user on their next login. JWTs keep the old name in their claims
+// until they expire. Giving the current name is a no-op.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrInvalidUsername, ErrUserExists, ErrUnsupported
+func (s *Server) UpdateUserName(user UserID, name string) (err error) {
+	s, sp := s.trace("auth.UpdateUserName")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	if err := s.checkUsername(name); err != nil {
+		return err
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if userObj.Source != "" {
+		return ErrUnsupported
+	}
+	if userObj.Name == s.cfg.UsernamePolicy.Normalize(name) {
+		return nil
+	}
+	if other, err := s.lookupUserByName(ctx, name); err == nil && other.ID != user {
+		return ErrUserExists
+	} else if err != nil && err != ErrUserNotExist {
+		return err
+	}
+	oldName := userObj.Name
+	userObj = userObj.clone()
+	userObj.Name = s.cfg.UsernamePolicy.Normalize(name)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventUserRenamed, User: user, Name: userObj.Name, OldName: oldName})
+	return nil
+}
+
+// DeleteUser removes a user with given ID, and its tokens. With ServerConfig.SoftDeleteSec, the
+// user is kept for that long and can be restored with RestoreUser; deleting it again removes it for
+// good.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) DeleteUser(user UserID) (err error) {
+	s, sp := s.trace("auth.DeleteUser")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.deleteUser(user)
+	}
+	op := &Operation{Method: "DeleteUser", User: user}
+	return s.intercept(op, func(s *Server) error {
+		return s.deleteUser(op.User)
+	})
+}
+
+// deleteUser is DeleteUser without the interceptors.
+func (s *Server) deleteUser(user UserID) (err error) {
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.store.GetUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if s.cfg.SoftDeleteSec <= 0 || userObj.Deleted != nil {
+		err = s.hardDeleteUser(ctx, user)
+	} else {
+		err = s.softDeleteUser(userObj)
+	}
+	if err != nil {
+		return err
+	}
+	if userObj.Deleted == nil {
+		s.emit(Event{Type: EventUserDeleted, User: user, Name: userObj.Name})
+	}
+	return nil
+}
+
+// CreateRole adds a new role with given name.
+//
+// Returns: the ID of the new group
+// Errors: ErrRoleExists, ErrTooManyRoles
+func (s *Server) CreateRole(name string) (_ RoleID, err error) {
+	s, sp := s.trace("auth.CreateRole")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.createRole(name)
+	}
+	op := &Operation{Method: "CreateRole", Name: name}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.Role, err = s.createRole(op.Name)
+		return err
+	})
+	return op.Role, err
+}
+
+// createRole is CreateRole without the interceptors.
+func (s *Server) createRole(name string) (_ RoleID, err error) {
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.store.GetRoleByName(ctx, name); err == nil {
+		return 0, ErrRoleExists
+	} else if err != ErrRoleNotExist {
+		return 0, err
+	}
+
+	if err := s.checkRoleLimit(ctx, 1); err != nil {
+		return 0, err
+	}
+	newRole := Role{
+		Name: name,
+	}
+	if err := s.store.InsertRole(ctx, &newRole); err != nil {
+		return 0, err
+	}
+	s.emit(Event{Type: EventRoleCreated, Role: newRole.ID, Name: name})
+	return newRole.ID, nil
+}
+
+// UpdateRoleName renames a role, keeping its ID, permissions and holders, and emits a role.renamed
+// event. Giving the current name is a no-op.
+//
+// Returns: none
+// Errors: ErrRoleNotExist, ErrRoleExists
+func (s *Server) UpdateRoleName(role RoleID, name string) (err error) {
+	s, sp := s.trace("auth.UpdateRoleName")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil || roleObj.Name == name {
+		return err
+	}
+	if _, err := s.store.GetRoleByName(ctx, name); err == nil {
+		return ErrRoleExists
+	} else if err != ErrRoleNotExist {
+		return err
+	}
+	oldName := roleObj.Name
+	roleObj = roleObj.clone()
+	roleObj.Name = name
+	if err := s.store.UpdateRole(ctx, roleObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventRoleRenamed, Role: role, Name: name, OldName: oldName})
+	return nil
+}
+
+// DeleteRole removes a role with given ID, and takes it away from all the users holding it
+// directly, with a role.revoked event for each, before the role.deleted one. Readers see either
+// all the users with the role or without it. If the storage is a RoleFinder, the role is also taken
+// away from the groups having it, and from the users holding it on resources, with a role.revoked
+// event for each resource; otherwise, or with ServerConfig.LazyCleanup, they keep the ID, which is
+// ignored as IDs are not reused. If the storage fails midway, the role is kept, and deleting it
+// again finishes the job. Protected roles cannot be deleted, see SetRoleProtected;
+// DeleteRoleDryRun tells which users would lose the role.
+//
+// Returns: none
+// Errors: ErrRoleNotExist, ErrRoleProtected
+func (s *Server) DeleteRole(role RoleID) (err error) {
+	s, sp := s.trace("auth.DeleteRole")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	if roleObj.Protected {
+		return ErrRoleProtected
+	}
+	return s.deleteRole(ctx, roleObj)
+}
+
+// DeleteRoleDryRun checks that a role can be deleted, without deleting it.
+//
+// Returns: the users that would lose the role, in ascending order
+// Errors: ErrRoleNotExist, ErrRoleProtected
+func (s *Server) DeleteRoleDryRun(role RoleID) (_ []UserID, err error) {
+	s, sp := s.trace("auth.DeleteRoleDryRun")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	if roleObj.Protected {
+		return nil, ErrRoleProtected
+	}
+	return s.store.UsersWithRole(ctx, role)
+}
+
+// deleteRole removes a role from its holders, then deletes it. The caller must hold s.mu.
+func (s *Server) deleteRole(ctx context.Context, roleObj *Role) error {
+	holders, err := s.store.UsersWithRole(ctx, roleObj.ID)
+	if err != nil {
+		return err
+	}
+	for _, id := range holders {
+		// Soft-deleted users too, so that restoring them gives nothing back
+		userObj, err := s.store.GetUser(ctx, id)
+		if err == ErrUserNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, ok := userObj.Roles[roleObj.ID]; !ok {
+			continue
+		}
+		userObj = userObj.clone()
+		delete(userObj.Roles, roleObj.ID)
+		delete(userObj.RoleExpiry, roleObj.ID)
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventRoleRevoked, User: id, Name: userObj.Name, Role: roleObj.ID})
+	}
+	if !s.cfg.LazyCleanup {
+		if err := s.unlinkRole(ctx, roleObj.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.store.DeleteRole(ctx, roleObj.ID); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventRoleDeleted, Role: roleObj.ID, Name: roleObj.Name})
+	return nil
+}
+
+// SetRoleProtected protects a role from deletion, e.g. for the roles the system depends on, or
+// lifts the protection. Protected roles are not pruned by Apply either.
+//
+// Returns: none
+// Errors: ErrRoleNotExist
+func (s *Server) SetRoleProtected(role RoleID, protected bool) (err error) {
+	s, sp := s.trace("auth.SetRoleProtected")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil || roleObj.Protected == protected {
+		return err
+	}
+	roleObj = roleObj.clone()
+	roleObj.Protected = protected
+	return s.store.UpdateRole(ctx, roleObj)
+}
+
+// AddRoleToUser assigns a role to a user.
+// It is a no-op if the user already has the role, unless it was given until an expiry by
+// AddRoleToUserUntil: the assignment is then made permanent.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrRoleNotExist
+func (s *Server) AddRoleToUser(user UserID, role RoleID) (err error) {
+	s, sp := s.trace("auth.AddRoleToUser")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.addRoleToUser(user, role)
+	}
+	op := &Operation{Method: "AddRoleToUser", User: user, Role: role}
+	return s.intercept(op, func(s *Server) error {
+		return s.addRoleToUser(op.User, op.Role)
+	})
+}
+
+// addRoleToUser is AddRoleToUser without the interceptors.
+func (s *Server) addRoleToUser(user UserID, role RoleID) (err error) {
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	_, temporary := userObj.RoleExpiry[roleObj.ID]
+	if _, ok := userObj.Roles[roleObj.ID]; ok && !temporary {
+		return nil
+	}
+
+	userObj = userObj.clone()
+	userObj.Roles[roleObj.ID] = roleObj
+	delete(userObj.RoleExpiry, roleObj.ID)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventRoleGranted, User: user, Name: userObj.Name, Role: role})
+	return nil
+}
+
+// RemoveRoleFromUser takes a role away from a user.
+// It is a no-op if the user does not have the role.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrRoleNotExist
+func (s *Server) RemoveRoleFromUser(user UserID, role RoleID) (err error) {
+	s, sp := s.trace("auth.RemoveRoleFromUser")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.removeRoleFromUser(user, role)
+	}
+	op := &Operation{Method: "RemoveRoleFromUser", User: user, Role: role}
+	return s.intercept(op, func(s *Server) error {
+		return s.removeRoleFromUser(op.User, op.Role)
+	})
+}
+
+// removeRoleFromUser is RemoveRoleFromUser without the interceptors.
+func (s *Server) removeRoleFromUser(user UserID, role RoleID) (err error) {
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, ok := userObj.Roles[role]; !ok {
+		_, err := s.store.GetRole(ctx, role)
+		return err
+	}
+
+	userObj = userObj.clone()
+	delete(userObj.Roles, role)
+	delete(userObj.RoleExpiry, role)
+	s.bumpSession(userObj)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventRoleRevoked, User: user, Name: userObj.Name, Role: role})
+	return nil
+}
+
+// ListUsersWithRole lists the users holding a role directly, not through a group. Expired
+// temporary assignments (see AddRoleToUserUntil) are listed until ExpireRoles removes them.
+//
+// Returns: a list of UserIDs in ascending order
+// Errors: ErrRoleNotExist
+func (s *Server) ListUsersWithRole(role RoleID) (_ []UserID, err error) {
+	s, sp := s.trace("auth.ListUsersWithRole")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.store.GetRole(ctx, role); err != nil {
+		return nil, err
+	}
+	return s.store.UsersWithRole(ctx, role)
+}
+
+// Authenticate checks a username/password pair, and creates a token for the user if it passes.
+// Note that the password is clear text, like that in HTTP Basic auth.
+// If the user has enrolled in MFA, the token is a challenge to pass to CompleteMFA, and the error
+// is ErrMFARequired.
+// For security, the function does not distinguish "wrong username" from "wrong password".
+// ErrUserSuspended is only returned for the right password, and so is ErrEmailNotVerified, with
+// ServerConfig.RequireVerifiedEmail.
+// With ServerConfig.Authenticators, names without a local user are tried against them, and the
+// user is created on success (see Authenticator).
+// With ServerConfig.MaxSessions, older tokens of the user may be invalidated, or the login rejected
+// with ErrTooManySessions.
+// With ServerConfig.RateLimiter, attempts may be throttled with ErrRateLimited.
+// ErrInternal is returned only in rare cases where the system cannot provide enough randomness.
+//
+// Returns: the token string
+// Errors: ErrInvalidAuth, ErrUserSuspended, ErrEmailNotVerified, ErrMFARequired, ErrTooManySessions, ErrTooManyTokens, ErrInternal,
+// ErrRateLimited, ctx.Err() of the server context,
+// or any error from the authenticators or the rate limiter
+// With ServerConfig.Interceptors, the login may also be rejected or changed by them.
+// TODO: use old token instead of username/password to renew authentication
+func (s *Server) Authenticate(username, password string) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.Authenticate")
+	defer func() { sp.end(err) }()
+	return s.interceptAuthenticate("Authenticate", username, password, ClientInfo{}, nil)
+}
+
+// interceptAuthenticate runs authenticate for a method through the interceptors.
+func (s *Server) interceptAuthenticate(method, username, password string, client ClientInfo, scope *TokenScope) (_ TokenValue, err error) {
+	if s.cfg.Interceptors == nil {
+		return s.authenticate(username, password, client, scope)
+	}
+	op := &Operation{Method: method, Name: username, Client: client}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.Token, err = s.authenticate(op.Name, password, op.Client, scope)
+		return err
+	})
+	return op.Token, err
+}
+
+func (s *Server) authenticate(username, password string, client ClientInfo, scope *TokenScope) (TokenValue, error) {
+	// No lock is needed, as the stored user object is never modified. Not holding it also keeps
+	// the slow password hashing from blocking writers.
+	ctx := s.ctx
+	if err := s.checkRateLimit(username, client); err != nil {
+		return "", err
+	}
+	userObj, err := s.getUserByName(ctx, username)
+	switch err {
+	case ErrUserNotExist:
+		userObj, err = s.authenticateExternal(ctx, username, password)
+		if err == ErrInvalidAuth {
+			s.dummyVerify(password)
+		}
+	case nil:
+		err = s.checkUserPassword(ctx, userObj, password)
+	}
+	if userObj != nil {
+		s.traceUser(userObj.ID)
+	}
+	// record saves the outcome in the history of the user, see GetLoginHistory
+	record := func(success bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.recordLogin(userObj.ID, client, success)
+	}
+	if err == ErrInvalidAuth {
+		s.countLogin(false)
+		if userObj != nil {
+			record(false)
+		} else {
+			s.emit(Event{Type: EventLoginFailed, Name: username, IP: client.IP, UserAgent: client.UserAgent})
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if userObj.TOTP == nil || !userObj.TOTP.Confirmed {
+		// Otherwise restored by CompleteMFA, so that the codes stay limited
+		s.resetRateLimit(username)
+	}
+	// Only checked after the password, so that the status is not revealed to others
+	if userObj.Status == UserSuspended {
+		s.countLogin(false)
+		record(false)
+		return "", ErrUserSuspended
+	}
+	if s.cfg.RequireVerifiedEmail && userObj.Source == "" && !userObj.EmailVerified {
+		s.countLogin(false)
+		record(false)
+		return "", ErrEmailNotVerified
+	}
+	if scope, err = s.checkScope(userObj, scope); err != nil {
+		return "", err
+	}
+
+	if userObj.TOTP != nil && userObj.TOTP.Confirmed {
+		challenge, err := s.newChallenge(userObj, client)
+		if err != nil {
+			return "", err
+		}
+		challenge.Scope = scope
+		if err := s.store.InsertToken(ctx, challenge); err != nil {
+			return "", err
+		}
+		atomic.AddUint64(&s.metrics.mfaChallenges, 1)
+		return challenge.Value, ErrMFARequired
+	}
+	token, err := s.issueToken(userObj, client, scope, AuthPassword)
+	if err == nil {
+		record(true)
+	}
+	return token, err
+}
+
+// checkUserPassword verifies the password of an existing user, locally or with its Authenticator.
+//
+// Errors: ErrInvalidAuth, ErrInternal, ctx.Err(), or any error from the Authenticator
+func (s *Server) checkUserPassword(ctx context.Context, userObj *User, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if userObj.Kind == UserService {
+		s.dummyVerify(password)
+		return ErrInvalidAuth
+	}
+	if userObj.Source != "" {
+		a := s.authenticator(userObj.Source)
+		if a == nil {
+			// The authenticator was removed from the config
+			return ErrInvalidAuth
+		}
+		if _, err := a.Authenticate(ctx, userObj.Name, password); err == ErrUserNotExist {
+			return ErrInvalidAuth
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	ok, stale, err := s.verifyPassword(password, userObj.Secret)
+	if err == ErrHashFormat || (err == nil && !ok) {
+		return ErrInvalidAuth
+	} else if err != nil {
+		return ErrInternal
+	}
+	if stale && s.cfg.RehashOnLogin {
+		s.rehash(ctx, userObj, password)
+	}
+	return nil
+}
+
+// issueToken creates and saves a session token (or a JWT) for a user authenticated at a level. The
+// scope must have passed checkScope.
+func (s *Server) issueToken(userObj *User, client ClientInfo, scope *TokenScope, level AuthLevel) (TokenValue, error) {
+	if s.jwt != nil {
+		token, err := s.newJWT(userObj, scope, level)
+		if err != nil {
+			return "", ErrInternal
+		}
+		s.countLogin(true)
+		return token, nil
+	}
+	if s.cfg.MaxSessions > 0 {
+		// Held until the token is saved, so that concurrent logins do not overshoot
+		s.sessionMu.Lock()
+		defer s.sessionMu.Unlock()
+		if err := s.limitSessions(userObj.ID); err != nil {
+			return "", err
+		}
+	}
+	token, err := s.newToken(userObj)
+	if err != nil {
+		return "", err
+	}
+	token.Client = client
+	token.Scope = scope
+	token.Level = level
+	if err := s.store.InsertToken(s.ctx, token); err != nil {
+		return "", err
+	}
+	s.countLogin(true)
+	return token.Value, nil
+}
+
+// Invalidate invalidates a token immediately.
+// In JWT mode, that only works for this server, and those sharing ServerConfig.Revocations: other
+// services verifying the token by themselves keep accepting it until it expires.
+//
+// Returns: none
+func (s *Server) Invalidate(token TokenValue) {
+	s, sp := s.trace("auth.Invalidate")
+	defer sp.end(nil)
+	if s.cfg.Interceptors == nil {
+		s.invalidate(token)
+		return
+	}
+	op := &Operation{Method: "Invalidate", Token: token}
+	_ = s.intercept(op, func(s *Server) error {
+		s.invalidate(op.Token)
+		return nil
+	})
+}
+
+// invalidate is Invalidate without the interceptors.
+func (s *Server) invalidate(token TokenValue) {
+	if s.jwt != nil {
+		s.revokeJWT(token)
+		return
+	}
+	ctx := s.ctx
+	tokenObj, err := s.store.GetToken(ctx, token)
+	if err != nil {
+		return
+	}
+	if s.store.DeleteToken(ctx, token) == nil && tokenObj.Kind == TokenSession {
+		s.emit(Event{Type: EventTokenRevoked, User: tokenObj.User, Actor: tokenObj.Actor, TokenID: tokenObj.ID()})
+	}
+}
+
+// CheckRole checks if the user identified by the token has the given role, directly or through a
+// group. For tokens with a scope, the role must also be in the scope (see TokenScope): it is false
+// for API keys with scopes, see CreateAPIKey. Results may come from the decision cache, see
+// ServerConfig.DecisionCacheSec.
+//
+// Returns: true or false
+// Errors: ErrRoleNotExist, ErrInvalidToken
+func (s *Server) CheckRole(token TokenValue, role RoleID) (ok bool, err error) {
+	s, sp := s.trace("auth.CheckRole")
+	defer func() { sp.check(ok, err) }()
+	if s.cfg.Interceptors == nil {
+		return s.cachedCheck(decisionKey{token: token, role: role}, func() (bool, UserID, error) {
+			return s.checkRole(token, role)
+		})
+	}
+	op := &Operation{Method: "CheckRole", Token: token, Role: role}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.Allowed, err = s.cachedCheck(decisionKey{token: op.Token, role: op.Role}, func() (bool, UserID, error) {
+			return s.checkRole(op.Token, op.Role)
+		})
+		return err
+	})
+	return op.Allowed && err == nil, err
+}
+
+// checkRole is CheckRole without the cache. It also tells the user of the token.
+func (s *Server) checkRole(token TokenValue, role RoleID) (bool, UserID, error) {
+	ctx := s.ctx
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, scope, err := s.verifyScoped(token)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if _, err := s.store.GetRole(ctx, role); err != nil {
+		return false, 0, err
+	}
+	if scope != nil && !scope.hasRole(role) {
+		return false, userObj.ID, nil
+	}
+
+	if userObj.hasRole(role, s.now()) {
+		return true, userObj.ID, nil
+	}
+	belongs, err := s.groupsGrant(userObj, role)
+	if err != nil {
+		return false, 0, err
+	}
+	return belongs, userObj.ID, nil
+}
+
+// AllRoles return all role IDs associated with the user identified by the token, including those
+// of the groups of the user. In JWT mode, those are the roles at the time the token was issued.
+// For tokens with a scope, only the roles in the scope are returned, and none for API keys.
+//
+// Returns: a list of RoleIDs (32-bit integers)
+// Errors: ErrInvalidToken
+func (s *Server) AllRoles(token TokenValue) (_ []RoleID, err error) {
+	s, sp := s.trace("auth.AllRoles")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.tokenRoles(token)
+	}
+	op := &Operation{Method: "AllRoles", Token: token}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.Roles, err = s.tokenRoles(op.Token)
+		return err
+	})
+	return op.Roles, err
+}
+
+// tokenRoles is AllRoles without the interceptors.
+func (s *Server) tokenRoles(token TokenValue) (_ []RoleID, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, scope, err := s.verifyScoped(token)
+	if err != nil {
+		return nil, err
+	}
+	return s.scopedRoles(userObj, scope)
+}
+
+// scopedRoles gives the roles of a user, including those of its groups, within a scope.
+// The caller must hold s.mu (at least for reading).
+//
+// Unlike effectiveRoles, it builds the list without a map: the groups are fetched first to size it,
+// and a role granted again by a group is skipped if the user holds it directly or an earlier group
+// grants it, which Group.Roles being sorted makes cheap.
+func (s *Server) scopedRoles(userObj *User, scope *TokenScope) ([]RoleID, error) {
+	if scope != nil && len(scope.Roles) == 0 {
+		return []RoleID{}, nil
+	}
+	var buf [8]*Group
+	groups, n := buf[:0], len(userObj.Roles)
+	for _, group := range userObj.Groups {
+		g, err := s.store.GetGroup(s.ctx, group)
+		if err == ErrGroupNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		groups, n = append(groups, g), n+len(g.Roles)
+	}
+	now := s.now()
+	roleList := make([]RoleID, 0, n)
+	for role := range userObj.Roles {
+		if userObj.unexpired(role, now) {
+			roleList = append(roleList, role)
+		}
+	}
+	for i, g := range groups {
+		for _, role := range g.Roles {
+			if !userObj.hasRole(role, now) && !anyGrants(groups[:i], role) {
+				roleList = append(roleList, role)
+			}
+		}
+	}
+	if scope != nil && len(scope.Roles) > 0 {
+		kept := roleList[:0]
+		for _, role := range roleList {
+			if scope.hasRole(role) {
+				kept = append(kept, role)
+			}
+		}
+		roleList = kept
+	}
+	return roleList, nil
+}
+
+// anyGrants tells if any of the groups grants a role.
+func anyGrants(groups []*Group, role RoleID) bool {
+	for _, g := range groups {
+		if g.hasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenUser identifies the user behind a token.
+//
+// Returns: the ID of the user
+// Errors: ErrInvalidToken
+func (s *Server) TokenUser(token TokenValue) (_ UserID, err error) {
+	s, sp := s.trace("auth.TokenUser")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.tokenUser(token)
+	}
+	op := &Operation{Method: "TokenUser", Token: token}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.User, err = s.tokenUser(op.Token)
+		return err
+	})
+	return op.User, err
+}
+
+// tokenUser is TokenUser without the interceptors.
+func (s *Server) tokenUser(token TokenValue) (_ UserID, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, err := s.verifyToken(token)
+	if err != nil {
+		return 0, err
+	}
+	return userObj.ID, nil
+}
+
+// *-* Query operations *-*
+// These functions provide mapping between IDs and names.
+// nil is returned if the query has no result.
+// The function names are self-explanatory.
+// The returned objects are copies, so they can be read and modified freely.
+
+func (s *Server) GetUser(id UserID) *User {
+	u, _ := s.getUser(s.ctx, id)
+	return u.clone()
+}
+
+func (s *Server) GetUserByName(name string) *User {
+	u, _ := s.getUserByName(s.ctx, name)
+	return u.clone()
+}
+
+func (s *Server) GetRole(id RoleID) *Role {
+	r, _ := s.store.GetRole(s.ctx, id)
+	return r.clone()
+}
+
+func (s *Server) GetRoleByName(name string) *Role {
+	r, _ := s.store.GetRoleByName(s.ctx, name)
+	return r.clone()
+}
+
+func (s *Server) GetGroup(id GroupID) *Group {
+	g, _ := s.store.GetGroup(s.ctx, id)
+	return g.clone()
+}
+
+func (s *Server) GetGroupByName(name string) *Group {
+	g, _ := s.store.GetGroupByName(s.ctx, name)
+	return g.clone()
+}
+
+// *-* Internal *-*
+// Bookkeeping, including token maintenance.
+
+// newToken creates a new token for a user.
+// It optionally triggers garbage collection for expired tokens.
+//
+// Errors: ErrTooManyTokens, ErrInternal
+func (s *Server) newToken(u *User) (*Token, error) {
+	v, err := s.newTokenValue()
+	if err != nil {
+		return nil, ErrInternal
+	}
+	now := s.now()
+	t := Token{
+		Value:    v,
+		User:     u.ID,
+		Issued:   now,
+		Expires:  now.Add(time.Duration(s.live().TokenExpireSec) * time.Second),
+		AuthTime: now,
+		Version:  u.SessionVersion,
+	}
+	if err := s.addToTokenQueue(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// verifyToken ensures the token, as well as its associated user, is valid and not expired/deleted.
+// The caller must hold s.mu (at least for reading).
+func (s *Server) verifyToken(t TokenValue) (*User, error) {
+	userObj, _, err := s.verifyScoped(t)
+	return userObj, err
+}
+
+// verifyScoped verifies a token like verifyToken, and tells the scope it is limited to, or nil if it
+// is not limited.
+// The caller must hold s.mu (at least for reading).
+func (s *Server) verifyScoped(t TokenValue) (*User, *TokenScope, error) {
+	userObj, scope, _, err := s.verifyAuthn(t)
+	return userObj, scope, err
+}
+
+// verifyAuthn verifies a token like verifyScoped, and tells how its user authenticated.
+// The caller must hold s.mu (at least for reading).
+func (s *Server) verifyAuthn(t TokenValue) (*User, *TokenScope, authn, error) {
+	if strings.HasPrefix(string(t), APIKeyPrefix) {
+		userObj, key, err := s.verifyAPIKey(t)
+		if err != nil {
+			return nil, nil, authn{}, err
+		}
+		s.traceUser(userObj.ID)
+		return userObj, key.scope(), authn{}, nil
+	}
+	if s.jwt != nil {
+		userObj, scope, a, err := s.verifyJWT(t)
+		if err == nil {
+			s.traceUser(userObj.ID)
+		}
+		return userObj, scope, a, err
+	}
+	ctx := s.ctx
+	tokenObj, err := s.store.GetToken(ctx, t)
+	if err == ErrInvalidToken {
+		s.reportUnknownToken(t)
+		return nil, nil, authn{}, err
+	} else if err != nil {
+		return nil, nil, authn{}, err
+	}
+	if tokenObj.Kind != TokenSession {
+		return nil, nil, authn{}, ErrInvalidToken
+	}
+	now := s.now()
+	if now.After(tokenObj.Expires) {
+		// Lazily remove expired tokens
+		_ = s.store.DeleteToken(ctx, t)
+		return nil, nil, authn{}, ErrInvalidToken
+	}
+	if err := s.checkBinding(tokenObj); err != nil {
+		return nil, nil, authn{}, err
+	}
+	userObj, err := s.getUser(ctx, tokenObj.User)
+	if err == ErrUserNotExist {
+		// Lazily invalidate tokens after the user is deleted
+		_ = s.store.DeleteToken(ctx, t)
+		return nil, nil, authn{}, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, authn{}, err
+	}
+	if userObj.Status == UserSuspended || !s.currentSession(userObj, tokenObj.Version) {
+		return nil, nil, authn{}, ErrInvalidToken
+	}
+	if err := s.checkActor(tokenObj); err != nil {
+		return nil, nil, authn{}, err
+	}
+	if s.cfg.TokenMaxLifetimeSec > 0 {
+		s.slideToken(tokenObj, now)
+	}
+	s.traceUser(userObj.ID)
+	return userObj, tokenObj.Scope, tokenObj.authn(), nil
+}
+
+// pruneTokens removes the tokens that have expired from the store. The caller must hold s.tokenMu.
+// It is triggered by new tokens, and costs nothing until a token expires.
+//
+// Tokens extended by sliding expiry (see TokenMaxLifetimeSec) are saved anew, so those that seem
+// expired are looked up again, and go back in the queue if they were.
+func (s *Server) pruneTokens() {
+	now := s.now()
+	if t := s.tokenQ.peek(); t == nil || !now.After(t.Expires) {
+		return
+	}
+	// Not canceled with the request that triggers pruning
+	ctx, sp := s.startSpan(context.Background(), "auth.prune")
+	n, start := 0, time.Now()
+	for t := s.tokenQ.peek(); t != nil && now.After(t.Expires); t = s.tokenQ.peek() {
+		heap.Pop(&s.tokenQ)
+		if s.cfg.TokenMaxLifetimeSec > 0 && t.Kind == TokenSession {
+			if stored, err := s.store.GetToken(ctx, t.Value); err == nil && !now.After(stored.Expires) {
+				heap.Push(&s.tokenQ, stored)
+				continue
+			}
+		}
+		_ = s.store.DeleteToken(ctx, t.Value)
+		s.queued--
+		n++
+	}
+	s.countPrune(n, time.Since(start))
+	sp.set(AttrPrunedCount, int64(n))
+	sp.end(nil)
+}
+
+// addToTokenQueue saves a reference to a token for pruning once it expires, after pruning those that
+// have. Once per epoch, it also starts the background purges of soft-deleted users and expired
+// temporary roles.
+//
+// Errors: ErrTooManyTokens, or any error from the storage with MaxTokensPerUser
+func (s *Server) addToTokenQueue(t *Token) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	if ep := s.currentEpoch(); ep > s.pruneEpoch {
+		s.pruneEpoch = ep
+		s.startPurge()
+		s.startRoleExpiry()
+	}
+	s.pruneTokens()
+	if err := s.checkTokenLimit(t.User); err != nil {
+		return err
+	}
+	heap.Push(&s.tokenQ, t)
+	s.queued++
+	return nil
+}
+
+// currentEpoch gets the number of epochs (PruneIntervalSec long), starting from 1, since the server
+// started. See UpdateConfig for changes of PruneIntervalSec.
+func (s *Server) currentEpoch() int32 {
+	live := s.live()
+	elapsed := s.now().Sub(live.epochFrom)
+	return int32(elapsed.Seconds())/live.PruneIntervalSec + live.epochBase
+}
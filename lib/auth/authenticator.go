@@ -0,0 +1,98 @@
+package auth
+
+import "context"
+
+// With ServerConfig.Authenticators, passwords can be checked by external sources, such as an LDAP
+// directory, while roles are still managed by the server. On the first successful login, a local
+// user is created for the name, with User.Source set to the authenticator (JIT provisioning). The
+// password of such users is never stored, and only their source can verify it.
+
+// Authenticator verifies passwords against an external source.
+type Authenticator interface {
+	// Name identifies the authenticator in User.Source. It must not change once users are created.
+	Name() string
+	// Authenticate checks the password of a user. It must fail for empty passwords, which
+	// directories tend to accept as anonymous logins.
+	//
+	// Returns: what the source knows about the user
+	// Errors: ErrUserNotExist (so that the next authenticator is tried), ErrInvalidAuth, or any
+	// other error if the source cannot be reached
+	Authenticate(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// Identity is what an Authenticator knows about a user.
+type Identity struct {
+	// Roles are the names of the roles given to the user when it is created, such as those mapped
+	// from directory groups. Roles that do not exist are skipped. Later changes are not synced, so
+	// that roles can be managed here.
+	Roles []string
+}
+
+// authenticator finds the authenticator of a user created by one.
+func (s *Server) authenticator(name string) Authenticator {
+	for _, a := range s.cfg.Authenticators {
+		if a.Name() == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// authenticateExternal tries the authenticators in order for a name without a local user, and
+// creates the user when one of them accepts the password.
+//
+// Errors: ErrInvalidAuth, or any error from the authenticators or the storage
+func (s *Server) authenticateExternal(ctx context.Context, username, password string) (*User, error) {
+	for _, a := range s.cfg.Authenticators {
+		id, err := a.Authenticate(ctx, username, password)
+		if err == ErrUserNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return s.provisionUser(ctx, username, a.Name(), id)
+	}
+	return nil, ErrInvalidAuth
+}
+
+// provisionUser creates the local user of an external identity.
+func (s *Server) provisionUser(ctx context.Context, name, source string, id *Identity) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, err := s.lookupUserByName(ctx, name); err == nil {
+		// Created by a concurrent login, or the name is held by a tombstone
+		if u.Deleted != nil || u.Source != source {
+			return nil, ErrInvalidAuth
+		}
+		return u, nil
+	} else if err != ErrUserNotExist {
+		return nil, err
+	}
+
+	newUser := User{
+		Name:   s.cfg.UsernamePolicy.Normalize(name),
+		Source: source,
+		Roles:  make(map[RoleID]*Role),
+	}
+	for _, roleName := range id.Roles {
+		if r, err := s.store.GetRoleByName(ctx, roleName); err == nil {
+			newUser.Roles[r.ID] = r
+		} else if err != ErrRoleNotExist {
+			return nil, err
+		}
+	}
+	var defaults []RoleID
+	if s.cfg.DefaultRolesExternal {
+		var err error
+		if defaults, err = s.grantDefaultRoles(ctx, &newUser); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.insertUser(ctx, &newUser); err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: EventUserCreated, User: newUser.ID, Name: newUser.Name})
+	s.emitDefaultRoles(&newUser, defaults)
+	return &newUser, nil
+}
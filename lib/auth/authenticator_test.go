@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDirectory is an Authenticator backed by a map of passwords.
+type fakeDirectory struct {
+	name      string
+	passwords map[string]string
+	roles     []string
+	down      bool
+}
+
+var errDirectoryDown = errors.New("directory unreachable")
+
+func (d *fakeDirectory) Name() string { return d.name }
+
+func (d *fakeDirectory) Authenticate(_ context.Context, username, password string) (*Identity, error) {
+	if d.down {
+		return nil, errDirectoryDown
+	}
+	want, ok := d.passwords[username]
+	if !ok {
+		return nil, ErrUserNotExist
+	}
+	if password == "" || password != want {
+		return nil, ErrInvalidAuth
+	}
+	return &Identity{Roles: d.roles}, nil
+}
+
+func TestAuthenticators(t *testing.T) {
+	corp := &fakeDirectory{name: "corp", passwords: map[string]string{"anna": "c0rp", "elton": "c0rp"}, roles: []string{"staff", "missing"}}
+	lab := &fakeDirectory{name: "lab", passwords: map[string]string{"fred": "l4b", "anna": "l4b"}}
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher, Authenticators: []Authenticator{corp, lab}})
+	rid, _ := svr.CreateRole("staff")
+	svr.CreateUser("elton", "123456")
+	{
+		token, err := svr.Authenticate("anna", "c0rp")
+		assert.Equal(t, nil, err, "should accept the password of the directory")
+		u := svr.GetUserByName("anna")
+		assert.Equal(t, "corp", u.Source, "should create the user from the first directory that knows it")
+		assert.Equal(t, 0, len(u.Secret), "should not store the password")
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should give the mapped roles that exist")
+		_, err = svr.Authenticate("anna", "l4b")
+		assert.Equal(t, ErrInvalidAuth, err, "should only ask the source of the user")
+	}
+	{
+		_, err := svr.Authenticate("fred", "l4b")
+		assert.Equal(t, nil, err, "should try the directories in order")
+		_, err = svr.Authenticate("gina", "l4b")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject names unknown to all")
+		_, err = svr.Authenticate("elton", "c0rp")
+		assert.Equal(t, ErrInvalidAuth, err, "should check local users locally")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should check local users locally")
+	}
+	{
+		corp.down = true
+		_, err := svr.Authenticate("anna", "c0rp")
+		assert.Equal(t, errDirectoryDown, err, "should report directory failures")
+		svr2, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+		svr2.CreateRole("staff")
+		memStore(svr2).InsertUser(context.Background(), &User{Name: "anna", Source: "corp", Roles: map[RoleID]*Role{}})
+		_, err = svr2.Authenticate("anna", "c0rp")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject users of removed authenticators")
+	}
+}
@@ -0,0 +1,117 @@
+package authtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkService runs the same calls on the Fake and a real server, which should agree.
+func checkService(t *testing.T, svc auth.Service) {
+	uid, err := svc.CreateUser("elton", "passw0rd")
+	assert.Equal(t, nil, err, "should success")
+	_, err = svc.CreateUser("elton", "passw0rd")
+	assert.Equal(t, auth.ErrUserExists, err, "should reject duplicate names")
+	rid, _ := svc.CreateRole("clerk")
+	assert.Equal(t, auth.ErrInvalidPermission, svc.GrantPermissionToRole(rid, "orders::read"), "should check permissions")
+	assert.Equal(t, nil, svc.GrantPermissionToRole(rid, "orders:*"), "should success")
+	assert.Equal(t, auth.ErrRoleNotExist, svc.AddRoleToUser(uid, rid+1), "should check the role")
+	assert.Equal(t, nil, svc.AddRoleToUser(uid, rid), "should success")
+
+	_, err = svc.Authenticate("elton", "wrong")
+	assert.Equal(t, auth.ErrInvalidAuth, err, "should check the password")
+	token, err := svc.Authenticate("elton", "passw0rd")
+	assert.Equal(t, nil, err, "should success")
+	id, _ := svc.TokenUser(token)
+	assert.Equal(t, uid, id, "should identify the user")
+	ok, _ := svc.CheckRole(token, rid)
+	assert.Equal(t, true, ok, "should have the role")
+	ok, _ = svc.CheckPermission(token, "orders:read:own")
+	assert.Equal(t, true, ok, "should match wildcards")
+	ok, _ = svc.CheckPermission(token, "orders")
+	assert.Equal(t, false, ok, "should match wildcards")
+	roles, _ := svc.AllRoles(token)
+	assert.Equal(t, []auth.RoleID{rid}, roles, "should list the roles")
+	assert.Equal(t, []string{"orders:*"}, svc.GetUser(uid).Roles[rid].Permissions, "should tell the roles")
+	assert.Equal(t, uid, svc.GetUserByName("elton").ID, "should find users by name")
+	assert.Equal(t, (*auth.User)(nil), svc.GetUserByName("fred"), "should return nil for unknown users")
+
+	assert.Equal(t, nil, svc.RemoveRoleFromUser(uid, rid), "should success")
+	ok, _ = svc.CheckPermission(token, "orders:read")
+	assert.Equal(t, false, ok, "should apply changes to existing tokens")
+	svc.Invalidate(token)
+	_, err = svc.TokenUser(token)
+	assert.Equal(t, auth.ErrInvalidToken, err, "should revoke the token")
+	token, _ = svc.Authenticate("elton", "passw0rd")
+	assert.Equal(t, nil, svc.DeleteUser(uid), "should success")
+	_, err = svc.CheckRole(token, rid)
+	assert.Equal(t, auth.ErrInvalidToken, err, "should reject the tokens of deleted users")
+}
+
+func TestService(t *testing.T) {
+	t.Run("Server", func(t *testing.T) {
+		svr, _ := auth.New(auth.WithHasher(&auth.BcryptHasher{Cost: 4}))
+		checkService(t, svr)
+	})
+	t.Run("Fake", func(t *testing.T) {
+		checkService(t, New(nil))
+	})
+}
+
+func TestFake(t *testing.T) {
+	f := New(&Config{
+		Users: []User{{Name: "alice", Password: "passw0rd", Roles: []string{"clerk", "viewer"}}, {Name: "bob"}},
+		Roles: []Role{{Name: "clerk", Permissions: []string{"orders:write"}}},
+	})
+	{
+		assert.Equal(t, auth.RoleID(1), f.GetRoleByName("clerk").ID, "should create the roles first")
+		assert.Equal(t, auth.RoleID(2), f.GetRoleByName("viewer").ID, "should create the roles of the users")
+		assert.Equal(t, auth.UserID(2), f.GetUserByName("bob").ID, "should create the users in order")
+		assert.Panics(t, func() { New(&Config{Roles: []Role{{Name: "a", Permissions: []string{""}}}}) }, "should reject bad configs")
+	}
+	{
+		token := f.Login("alice")
+		assert.Equal(t, auth.TokenValue("token-1"), token, "should issue predictable tokens")
+		ok, _ := f.CheckPermission(token, "orders:write")
+		assert.Equal(t, true, ok, "should preload the permissions")
+		f.Authenticate("bob", "")
+		assert.Equal(t, []auth.TokenValue{"token-1", "token-2"}, f.Tokens(), "should capture the tokens")
+		assert.Equal(t, auth.TokenValue("token-2"), f.LastToken(), "should capture the tokens")
+		f.Invalidate("token-2")
+		assert.Equal(t, []auth.TokenValue{"token-2"}, f.Revoked(), "should capture the revocations")
+		assert.Panics(t, func() { f.Login("carol") }, "should only log existing users in")
+	}
+	{
+		token := f.Login("alice")
+		f.Clock.Advance(time.Hour - time.Second)
+		_, err := f.TokenUser(token)
+		assert.Equal(t, nil, err, "should freeze the time")
+		f.Clock.Advance(time.Second)
+		_, err = f.TokenUser(token)
+		assert.Equal(t, auth.ErrInvalidToken, err, "should expire tokens with the clock")
+	}
+	{
+		errDown := errors.New("down")
+		token := f.Login("alice")
+		f.FailNext("CheckPermission", auth.ErrStepUpRequired)
+		f.Fail("CheckPermission", errDown)
+		_, err := f.CheckPermission(token, "orders:write")
+		assert.Equal(t, auth.ErrStepUpRequired, err, "should fail the next call first")
+		_, err = f.CheckPermission(token, "orders:write")
+		assert.Equal(t, errDown, err, "should fail the calls")
+		_, err = f.CheckPermission(token, "orders:write")
+		assert.Equal(t, errDown, err, "should keep failing")
+		f.Fail("CheckPermission", nil)
+		ok, _ := f.CheckPermission(token, "orders:write")
+		assert.Equal(t, true, ok, "should stop failing")
+
+		f.Fail("CreateUser", errDown)
+		f.CreateUser("carol", "")
+		f.Fail("CreateUser", nil)
+		assert.Equal(t, (*auth.User)(nil), f.GetUserByName("carol"), "should change nothing on forced errors")
+		assert.Panics(t, func() { f.Fail("Invalidate", errDown) }, "should only fail methods with errors")
+	}
+}
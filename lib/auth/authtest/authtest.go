@@ -0,0 +1,537 @@
+// Package authtest is a fake of the auth server, for the unit tests of services that depend on an
+// auth.Service, so that they run without a real server or its storage:
+//
+//	f := authtest.New(&authtest.Config{
+//		Users: []authtest.User{{Name: "alice", Password: "passw0rd", Roles: []string{"clerk"}}},
+//		Roles: []authtest.Role{{Name: "clerk", Permissions: []string{"orders:*"}}},
+//	})
+//	svc := orders.NewService(f)
+//	token := f.Login("alice")
+//	...
+//	f.Fail("CheckPermission", auth.ErrInternal) // to test how the service handles outages
+//
+// The Fake follows the semantics of the server for what it implements, and returns the same
+// errors, but leaves out what a real instance is needed for: password policies, groups, scopes,
+// MFA and the like. Passwords are kept in clear, and tokens are predictable ("token-1",
+// "token-2"...), so tests can spell them out. Time only moves with the Clock.
+package authtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Config configures a Fake. The zero value is a Fake without users.
+type Config struct {
+	// Users are created after Roles, in order, with IDs from 1.
+	Users []User
+	// Roles are created before the users, in order, with IDs from 1. The roles of Users that are
+	// not listed are created too, without permissions.
+	Roles []Role
+	// Now is the time the Clock is frozen at. Defaults to 2024-01-01 UTC.
+	Now time.Time
+	// TokenTTL is how long tokens stay valid. Defaults to an hour, like auth.New.
+	TokenTTL time.Duration
+}
+
+// User is a user to preload in a Fake.
+type User struct {
+	Name     string
+	Password string
+	Roles    []string // by name
+}
+
+// Role is a role to preload in a Fake.
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+// Fake is an auth.Service in memory. All methods are safe for concurrent use.
+type Fake struct {
+	// Clock is the time of the Fake, frozen until moved with Clock.Advance or Clock.Set, e.g. to
+	// expire tokens.
+	Clock *auth.ManualClock
+
+	ttl time.Duration
+
+	mu        sync.Mutex
+	users     map[auth.UserID]*auth.User
+	passwords map[auth.UserID]string
+	roles     map[auth.RoleID]*auth.Role
+	tokens    map[auth.TokenValue]*token
+	issued    []auth.TokenValue // in order, see Tokens
+	revoked   []auth.TokenValue // in order, see Revoked
+	nextUser  auth.UserID
+	nextRole  auth.RoleID
+
+	// failures are the errors forced by Fail (always) and FailNext (once, first), by method
+	failures map[string]error
+	once     map[string][]error
+}
+
+type token struct {
+	user    auth.UserID
+	expires time.Time
+}
+
+var _ auth.Service = (*Fake)(nil)
+
+// methods are those of auth.Service that return errors, for Fail and FailNext.
+var methods = map[string]bool{
+	"CreateUser": true, "DeleteUser": true, "CreateRole": true, "AddRoleToUser": true,
+	"RemoveRoleFromUser": true, "GrantPermissionToRole": true, "Authenticate": true,
+	"TokenUser": true, "CheckRole": true, "CheckPermission": true, "AllRoles": true,
+}
+
+// New creates a Fake with the users and roles of cfg. cfg can be nil.
+//
+// Returns: pointer to the new Fake
+func New(cfg *Config) *Fake {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Now.IsZero() {
+		c.Now = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if c.TokenTTL == 0 {
+		c.TokenTTL = time.Hour
+	}
+	f := &Fake{
+		Clock:     auth.NewManualClock(c.Now),
+		ttl:       c.TokenTTL,
+		users:     make(map[auth.UserID]*auth.User),
+		passwords: make(map[auth.UserID]string),
+		roles:     make(map[auth.RoleID]*auth.Role),
+		tokens:    make(map[auth.TokenValue]*token),
+		failures:  make(map[string]error),
+		once:      make(map[string][]error),
+	}
+	for _, r := range c.Roles {
+		id := f.role(r.Name)
+		for _, p := range r.Permissions {
+			f.must(f.GrantPermissionToRole(id, p))
+		}
+	}
+	for _, u := range c.Users {
+		id, err := f.CreateUser(u.Name, u.Password)
+		f.must(err)
+		for _, r := range u.Roles {
+			f.must(f.AddRoleToUser(id, f.role(r)))
+		}
+	}
+	return f
+}
+
+// must panics on the errors of preloading, which are mistakes in the Config.
+func (f *Fake) must(err error) {
+	if err != nil {
+		panic(fmt.Sprintf("authtest: bad Config: %v", err))
+	}
+}
+
+// role returns the ID of a role, which is created if needed.
+func (f *Fake) role(name string) auth.RoleID {
+	if r := f.GetRoleByName(name); r != nil {
+		return r.ID
+	}
+	id, err := f.CreateRole(name)
+	f.must(err)
+	return id
+}
+
+// *-* Scripting *-*
+
+// Fail makes every later call of a method of auth.Service return err, until Fail is called again
+// for the method with a nil err. Calls failed that way change nothing.
+//
+// It panics if the method does not exist or returns no error.
+func (f *Fake) Fail(method string, err error) {
+	checkMethod(method)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.failures, method)
+	} else {
+		f.failures[method] = err
+	}
+}
+
+// FailNext makes the next call of a method of auth.Service return err, before those set by Fail.
+// Calling it several times for a method fails as many calls, in order.
+//
+// It panics if the method does not exist or returns no error.
+func (f *Fake) FailNext(method string, err error) {
+	checkMethod(method)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.once[method] = append(f.once[method], err)
+}
+
+func checkMethod(method string) {
+	if !methods[method] {
+		panic("authtest: no method " + method + " to fail")
+	}
+}
+
+// failure returns the error forced for a call of method, if any. The caller must hold f.mu.
+func (f *Fake) failure(method string) error {
+	if errs := f.once[method]; len(errs) > 0 {
+		f.once[method] = errs[1:]
+		return errs[0]
+	}
+	return f.failures[method]
+}
+
+// Login issues a token for a user without its password, for tests that start logged in. The token
+// is captured like those of Authenticate.
+//
+// It panics if the user does not exist.
+//
+// Returns: the token
+func (f *Fake) Login(name string) auth.TokenValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.userByName(name)
+	if u == nil {
+		panic("authtest: no user " + name + " to log in")
+	}
+	return f.issue(u.ID)
+}
+
+// Tokens returns the tokens issued so far, by Authenticate and Login, in order, including those
+// revoked or expired since.
+//
+// Returns: the tokens
+func (f *Fake) Tokens() []auth.TokenValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]auth.TokenValue(nil), f.issued...)
+}
+
+// LastToken returns the token issued last, by Authenticate or Login.
+//
+// Returns: the token, "" if none was issued
+func (f *Fake) LastToken() auth.TokenValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.issued) == 0 {
+		return ""
+	}
+	return f.issued[len(f.issued)-1]
+}
+
+// Revoked returns the tokens passed to Invalidate so far, in order, e.g. to check a logout.
+//
+// Returns: the tokens
+func (f *Fake) Revoked() []auth.TokenValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]auth.TokenValue(nil), f.revoked...)
+}
+
+// Password returns the password of a user, e.g. to check what a service signed a user up with.
+//
+// Returns: the password, "" if the user does not exist
+func (f *Fake) Password(user auth.UserID) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.passwords[user]
+}
+
+// *-* auth.Service *-*
+
+func (f *Fake) CreateUser(name, password string) (auth.UserID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("CreateUser"); err != nil {
+		return 0, err
+	}
+	if name == "" {
+		return 0, auth.ErrInvalidUsername
+	}
+	if f.userByName(name) != nil {
+		return 0, auth.ErrUserExists
+	}
+	f.nextUser++
+	id := f.nextUser
+	f.users[id] = &auth.User{ID: id, Name: name, Roles: make(map[auth.RoleID]*auth.Role)}
+	f.passwords[id] = password
+	return id, nil
+}
+
+func (f *Fake) DeleteUser(user auth.UserID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("DeleteUser"); err != nil {
+		return err
+	}
+	if f.users[user] == nil {
+		return auth.ErrUserNotExist
+	}
+	delete(f.users, user)
+	delete(f.passwords, user)
+	return nil
+}
+
+func (f *Fake) CreateRole(name string) (auth.RoleID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("CreateRole"); err != nil {
+		return 0, err
+	}
+	if f.roleByName(name) != nil {
+		return 0, auth.ErrRoleExists
+	}
+	f.nextRole++
+	id := f.nextRole
+	f.roles[id] = &auth.Role{ID: id, Name: name}
+	return id, nil
+}
+
+func (f *Fake) AddRoleToUser(user auth.UserID, role auth.RoleID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("AddRoleToUser"); err != nil {
+		return err
+	}
+	u, r := f.users[user], f.roles[role]
+	if u == nil {
+		return auth.ErrUserNotExist
+	}
+	if r == nil {
+		return auth.ErrRoleNotExist
+	}
+	u.Roles[role] = r
+	return nil
+}
+
+func (f *Fake) RemoveRoleFromUser(user auth.UserID, role auth.RoleID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("RemoveRoleFromUser"); err != nil {
+		return err
+	}
+	u := f.users[user]
+	if u == nil {
+		return auth.ErrUserNotExist
+	}
+	if f.roles[role] == nil {
+		return auth.ErrRoleNotExist
+	}
+	delete(u.Roles, role)
+	return nil
+}
+
+func (f *Fake) GrantPermissionToRole(role auth.RoleID, perm string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("GrantPermissionToRole"); err != nil {
+		return err
+	}
+	r := f.roles[role]
+	if r == nil {
+		return auth.ErrRoleNotExist
+	}
+	if !validPermission(perm) {
+		return auth.ErrInvalidPermission
+	}
+	i := sort.SearchStrings(r.Permissions, perm)
+	if i < len(r.Permissions) && r.Permissions[i] == perm {
+		return nil
+	}
+	r.Permissions = append(r.Permissions, "")
+	copy(r.Permissions[i+1:], r.Permissions[i:])
+	r.Permissions[i] = perm
+	return nil
+}
+
+func (f *Fake) Authenticate(username, password string) (auth.TokenValue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("Authenticate"); err != nil {
+		return "", err
+	}
+	u := f.userByName(username)
+	if u == nil || f.passwords[u.ID] != password {
+		return "", auth.ErrInvalidAuth
+	}
+	return f.issue(u.ID), nil
+}
+
+func (f *Fake) Invalidate(token auth.TokenValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, token)
+	delete(f.tokens, token)
+}
+
+func (f *Fake) TokenUser(token auth.TokenValue) (auth.UserID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("TokenUser"); err != nil {
+		return 0, err
+	}
+	u, err := f.verify(token)
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+func (f *Fake) CheckRole(token auth.TokenValue, role auth.RoleID) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("CheckRole"); err != nil {
+		return false, err
+	}
+	u, err := f.verify(token)
+	if err != nil {
+		return false, err
+	}
+	if f.roles[role] == nil {
+		return false, auth.ErrRoleNotExist
+	}
+	return u.Roles[role] != nil, nil
+}
+
+func (f *Fake) CheckPermission(token auth.TokenValue, perm string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("CheckPermission"); err != nil {
+		return false, err
+	}
+	if !validPermission(perm) {
+		return false, auth.ErrInvalidPermission
+	}
+	u, err := f.verify(token)
+	if err != nil {
+		return false, err
+	}
+	for id := range u.Roles {
+		for _, p := range f.roles[id].Permissions {
+			if auth.MatchPermission(p, perm) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (f *Fake) AllRoles(token auth.TokenValue) ([]auth.RoleID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("AllRoles"); err != nil {
+		return nil, err
+	}
+	u, err := f.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]auth.RoleID, 0, len(u.Roles))
+	for id := range u.Roles {
+		roles = append(roles, id)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	return roles, nil
+}
+
+// GetUser, GetUserByName, GetRole and GetRoleByName return copies, or nil, like those of the server.
+
+func (f *Fake) GetUser(id auth.UserID) *auth.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.copyUser(f.users[id])
+}
+
+func (f *Fake) GetUserByName(name string) *auth.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.copyUser(f.userByName(name))
+}
+
+func (f *Fake) GetRole(id auth.RoleID) *auth.Role {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copyRole(f.roles[id])
+}
+
+func (f *Fake) GetRoleByName(name string) *auth.Role {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copyRole(f.roleByName(name))
+}
+
+// *-* Internals *-*
+// The caller must hold f.mu.
+
+func (f *Fake) issue(user auth.UserID) auth.TokenValue {
+	v := auth.TokenValue(fmt.Sprintf("token-%d", len(f.issued)+1))
+	f.tokens[v] = &token{user: user, expires: f.Clock.Now().Add(f.ttl)}
+	f.issued = append(f.issued, v)
+	return v
+}
+
+// verify returns the user of a token.
+//
+// Errors: auth.ErrInvalidToken if the token is unknown, revoked, expired, or its user deleted
+func (f *Fake) verify(v auth.TokenValue) (*auth.User, error) {
+	t := f.tokens[v]
+	if t == nil || !f.Clock.Now().Before(t.expires) {
+		return nil, auth.ErrInvalidToken
+	}
+	u := f.users[t.user]
+	if u == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	return u, nil
+}
+
+// validPermission is the check of the permissions of the server: no empty segments.
+func validPermission(perm string) bool {
+	return perm != "" && !strings.Contains(":"+perm+":", "::")
+}
+
+func (f *Fake) userByName(name string) *auth.User {
+	for _, u := range f.users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (f *Fake) roleByName(name string) *auth.Role {
+	for _, r := range f.roles {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (f *Fake) copyUser(u *auth.User) *auth.User {
+	if u == nil {
+		return nil
+	}
+	c := &auth.User{ID: u.ID, Name: u.Name, Roles: make(map[auth.RoleID]*auth.Role, len(u.Roles))}
+	for id, r := range u.Roles {
+		c.Roles[id] = copyRole(r)
+	}
+	return c
+}
+
+func copyRole(r *auth.Role) *auth.Role {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Permissions = append([]string(nil), r.Permissions...)
+	return &c
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchServer gives a server with a user holding a direct role, and another through a group, among
+// a few more.
+func benchServer(b *testing.B) (*Server, TokenValue, RoleID, RoleID) {
+	svr, _ := New(WithHasher(fastHasher))
+	user, _ := svr.CreateUser("anna", "passw0rd")
+	var direct, grouped RoleID
+	for i := 0; i < 8; i++ {
+		role, _ := svr.CreateRole("role" + strconv.Itoa(i))
+		svr.AddRoleToUser(user, role)
+		direct = role
+	}
+	group, _ := svr.CreateGroup("staff")
+	for i := 0; i < 8; i++ {
+		role, _ := svr.CreateRole("staff" + strconv.Itoa(i))
+		svr.AddRoleToGroup(group, role)
+		grouped = role
+	}
+	svr.AddUserToGroup(user, group)
+	token, err := svr.Authenticate("anna", "passw0rd")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return svr, token, direct, grouped
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	svr, _, _, _ := benchServer(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := svr.Authenticate("anna", "passw0rd"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyToken(b *testing.B) {
+	svr, token, _, _ := benchServer(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := svr.TokenUser(token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCheckRole(b *testing.B) {
+	svr, token, direct, _ := benchServer(b)
+	for i := 0; i < b.N; i++ {
+		if ok, _ := svr.CheckRole(token, direct); !ok {
+			b.Fatal("should have the role")
+		}
+	}
+}
+
+func BenchmarkCheckRoleGroup(b *testing.B) {
+	svr, token, _, grouped := benchServer(b)
+	for i := 0; i < b.N; i++ {
+		if ok, _ := svr.CheckRole(token, grouped); !ok {
+			b.Fatal("should have the role")
+		}
+	}
+}
+
+func BenchmarkCheckRoleParallel(b *testing.B) {
+	svr, token, _, grouped := benchServer(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			svr.CheckRole(token, grouped)
+		}
+	})
+}
+
+func BenchmarkAllRoles(b *testing.B) {
+	svr, token, _, _ := benchServer(b)
+	for i := 0; i < b.N; i++ {
+		if roles, _ := svr.AllRoles(token); len(roles) != 16 {
+			b.Fatal("should have 16 roles")
+		}
+	}
+}
+
+func BenchmarkVerifyTokenParallel(b *testing.B) {
+	svr, token, _, _ := benchServer(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			svr.TokenUser(token)
+		}
+	})
+}
+
+// BenchmarkTokenShards checks tokens of the storage from many goroutines, one in ten operations
+// saving a new token and deleting it, with and without sharding. Run it with -cpu to see the shards
+// pay off on several cores.
+func BenchmarkTokenShards(b *testing.B) {
+	for _, shards := range []int{1, DefaultTokenShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ctx := context.Background()
+			m := NewShardedMemoryStorage(shards)
+			tokens := make([]TokenValue, 1024)
+			for i := range tokens {
+				tokens[i] = TokenValue("token" + strconv.Itoa(i))
+				m.InsertToken(ctx, &Token{Value: tokens[i], User: UserID(i%16 + 1)})
+			}
+			var next int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				g := atomic.AddInt64(&next, 1)
+				for i := 0; pb.Next(); i++ {
+					if i%10 == 0 {
+						v := TokenValue("new" + strconv.FormatInt(g, 10))
+						m.InsertToken(ctx, &Token{Value: v, User: UserID(g)})
+						m.DeleteToken(ctx, v)
+					} else {
+						m.GetToken(ctx, tokens[(i+int(g)*7)%len(tokens)])
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCheckRoleDuringWrites checks a role through a group from many goroutines, while another
+// keeps saving other users to the storage.
+func BenchmarkCheckRoleDuringWrites(b *testing.B) {
+	svr, token, _, grouped := benchServer(b)
+	ctx := context.Background()
+	other, _ := svr.CreateUser("elton", "123456")
+	u, _ := svr.store.GetUser(ctx, other)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c := u.clone()
+			c.Metadata = map[string]string{"n": strconv.Itoa(i)}
+			svr.store.UpdateUser(ctx, c)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			svr.CheckRole(token, grouped)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// BenchmarkRoleLookups makes the storage lookups of CheckRole: the user, the role and a group.
+func BenchmarkRoleLookups(b *testing.B) {
+	svr, _, _, grouped := benchServer(b)
+	ctx := context.Background()
+	u, _ := svr.store.GetUserByName(ctx, "anna")
+	for i := 0; i < b.N; i++ {
+		svr.store.GetUser(ctx, u.ID)
+		svr.store.GetRole(ctx, grouped)
+		svr.store.GetGroup(ctx, u.Groups[0])
+	}
+}
@@ -0,0 +1,36 @@
+package auth
+
+import "context"
+
+type clientKey struct{}
+
+// WithClientInfo returns a context carrying the client of a request, for the servers bound to it
+// with Server.WithContext to verify the tokens bound to a client, see ServerConfig.BindTokens.
+// Only its IP and Fingerprint are compared.
+func WithClientInfo(ctx context.Context, client ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// requestClient gives the client in the context of the server, if any (see WithClientInfo).
+func (s *Server) requestClient() (ClientInfo, bool) {
+	c, ok := s.ctx.Value(clientKey{}).(ClientInfo)
+	return c, ok
+}
+
+// checkBinding verifies that a session token bound to its client is used by that client: the IP
+// and Fingerprint recorded on the token, if set, must be those of the context.
+//
+// Errors: ErrInvalidToken
+func (s *Server) checkBinding(t *Token) error {
+	if !s.cfg.BindTokens && !t.Client.Bind {
+		return nil
+	}
+	if t.Client.IP == "" && t.Client.Fingerprint == "" {
+		return nil
+	}
+	c, ok := s.requestClient()
+	if !ok || (t.Client.IP != "" && c.IP != t.Client.IP) || (t.Client.Fingerprint != "" && c.Fingerprint != t.Client.Fingerprint) {
+		return ErrInvalidToken
+	}
+	return nil
+}
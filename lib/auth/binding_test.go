@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBinding(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, DecisionCacheSec: 60}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(uid, rid)
+	home := ClientInfo{IP: "10.0.0.1", Fingerprint: "sha256:abcd"}
+	ctx := context.Background()
+	{
+		token, _ := svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: home.IP, Fingerprint: home.Fingerprint, Bind: true})
+		ok, err := svr.WithContext(WithClientInfo(ctx, home)).CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should verify for the same client")
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.WithContext(WithClientInfo(ctx, ClientInfo{IP: "10.0.0.2", Fingerprint: home.Fingerprint})).CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should check the IP, even with a cached decision")
+		_, err = svr.WithContext(WithClientInfo(ctx, ClientInfo{IP: home.IP})).TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should check the fingerprint")
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should require the client")
+	}
+	{
+		token, _ := svr.AuthenticateClient("anna", "passw0rd", home)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should not bind tokens by default")
+	}
+	cfg.BindTokens = true
+	svr, _ = New(WithConfig(cfg), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	{
+		token, _ := svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: home.IP})
+		_, err := svr.WithContext(WithClientInfo(ctx, ClientInfo{IP: home.IP, UserAgent: "curl"})).TokenUser(token)
+		assert.Equal(t, nil, err, "should only compare the IP and fingerprint")
+		_, err = svr.WithContext(WithClientInfo(ctx, ClientInfo{IP: "10.0.0.2"})).TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should bind all tokens")
+		token, _ = svr.Authenticate("anna", "passw0rd")
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should not bind tokens without a client")
+	}
+	{
+		_, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, BindTokens: true, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+		assert.Equal(t, ErrInvalidConfig, err, "should not bind JWTs")
+	}
+}
@@ -0,0 +1,148 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/storagetest"
+)
+
+var testConfig = &auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}
+
+func TestBoltServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	svr, s, err := NewBoltServer(testConfig, path, nil)
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "123456")
+	gone, _ := svr.CreateUser("fred", "123456")
+	svr.DeleteUser(gone)
+	assert.Equal(t, nil, s.Close(), "should success")
+	assert.Equal(t, nil, s.Close(), "should be idempotent")
+
+	svr, s, _ = NewBoltServer(testConfig, path, nil)
+	defer s.Close()
+	ok, err := svr.CheckRole(token, rid)
+	assert.Equal(t, nil, err, "should persist the tokens")
+	assert.Equal(t, true, ok, "should persist the roles of users")
+	id, _ := svr.CreateUser("fred", "123456")
+	assert.Equal(t, gone+1, id, "should not reuse the IDs of deleted users")
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	s, _ := Open(filepath.Join(t.TempDir(), "auth.db"), nil)
+	defer s.Close()
+	{
+		assert.Equal(t, nil, s.InsertUser(ctx, &auth.User{ID: 10, Name: "anna"}), "should accept a preset ID")
+		u := &auth.User{Name: "belle"}
+		assert.Equal(t, nil, s.InsertUser(ctx, u), "should success")
+		assert.Equal(t, auth.UserID(11), u.ID, "should not reuse IDs below a preset one")
+		assert.Equal(t, auth.ErrUserExists, s.InsertUser(ctx, &auth.User{Name: "anna"}), "should reject taken names")
+		assert.Equal(t, auth.ErrUserExists, s.InsertUser(ctx, &auth.User{ID: 10, Name: "cara"}), "should reject taken IDs")
+		u.Name = "anna"
+		assert.Equal(t, auth.ErrUserExists, s.UpdateUser(ctx, u), "should reject renaming to a taken name")
+		assert.Equal(t, auth.ErrUserNotExist, s.UpdateUser(ctx, &auth.User{ID: 101, Name: "cara"}), "should reject unknown users")
+		u.Name = "bella"
+		assert.Equal(t, nil, s.UpdateUser(ctx, u), "should rename")
+		_, err := s.GetUserByName(ctx, "belle")
+		assert.Equal(t, auth.ErrUserNotExist, err, "should forget the old name")
+	}
+	{
+		_ = s.InsertRole(ctx, &auth.Role{Name: "scanner"})
+		_ = s.InsertUser(ctx, &auth.User{Name: "an_a", Roles: map[auth.RoleID]*auth.Role{1: nil}})
+		list, err := s.ListUsers(ctx, &auth.ListQuery{Prefix: "an", SortBy: auth.SortByName, Limit: 10})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 2, len(list), "should filter by prefix")
+		assert.Equal(t, "an_a", list[0].Name, "should sort by name")
+		assert.Equal(t, "scanner", list[0].Roles[1].Name, "should populate the roles")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Prefix: "an", SortBy: auth.SortByName, Desc: true, Limit: 10})
+		assert.Equal(t, "anna", list[0].Name, "should sort by name in descending order")
+		assert.Equal(t, 2, len(list), "should filter by prefix in descending order")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{SortBy: auth.SortByName, After: &auth.ListKey{Name: "anna"}, Limit: 10})
+		assert.Equal(t, "bella", list[0].Name, "should continue after the key")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Desc: true, After: &auth.ListKey{ID: 12}, Limit: 1})
+		assert.Equal(t, auth.UserID(11), list[0].ID, "should continue after the key in descending order")
+		assert.Equal(t, 1, len(list), "should apply the limit")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Prefix: "an", Limit: 10})
+		assert.Equal(t, []auth.UserID{10, 12}, []auth.UserID{list[0].ID, list[1].ID}, "should filter by prefix in ID order")
+		users, _ := s.UsersWithRole(ctx, 1)
+		assert.Equal(t, []auth.UserID{12}, users, "should index the roles")
+
+		assert.Equal(t, nil, s.DeleteRole(ctx, 1), "should success")
+		u, _ := s.GetUser(ctx, 12)
+		assert.Equal(t, 0, len(u.Roles), "should take deleted roles away from users")
+		users, _ = s.UsersWithRole(ctx, 1)
+		assert.Equal(t, []auth.UserID{}, users, "should update the index")
+		assert.Equal(t, auth.ErrRoleNotExist, s.DeleteRole(ctx, 1), "should reject unknown roles")
+	}
+	{
+		g := &auth.Group{Name: "staff"}
+		_ = s.InsertGroup(ctx, g)
+		u, _ := s.GetUser(ctx, 10)
+		u.Groups = []auth.GroupID{g.ID}
+		_ = s.UpdateUser(ctx, u)
+		members, _ := s.GroupMembers(ctx, g.ID)
+		assert.Equal(t, []auth.UserID{10}, members, "should index the members")
+		assert.Equal(t, nil, s.DeleteGroup(ctx, g.ID), "should success")
+		u, _ = s.GetUser(ctx, 10)
+		assert.Equal(t, 0, len(u.Groups), "should remove the members from deleted groups")
+
+		assert.Equal(t, nil, s.DeleteUser(ctx, 12), "should success")
+		assert.Equal(t, auth.ErrUserNotExist, s.DeleteUser(ctx, 12), "should reject unknown users")
+	}
+	{
+		_, err := s.GetToken(ctx, "invalid")
+		assert.Equal(t, auth.ErrInvalidToken, err, "should give ErrInvalidToken if the token is unknown")
+		now := time.Now()
+		_ = s.InsertToken(ctx, &auth.Token{Value: "old", User: 10, Expires: now.Add(-time.Minute)})
+		_ = s.InsertToken(ctx, &auth.Token{Value: "new", User: 10, Expires: now.Add(time.Minute)})
+		n, err := s.DeleteExpiredTokens(ctx, now)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, int64(1), n, "should remove the expired token only")
+		tok, _ := s.GetToken(ctx, "new")
+		assert.Equal(t, now.Add(time.Minute).UnixNano(), tok.Expires.UnixNano(), "should keep the expiry time")
+		_ = s.InsertToken(ctx, &auth.Token{Value: "other", User: 11, Expires: now.Add(time.Minute)})
+		counts, err := s.Count(ctx)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, auth.Counts{Users: 2, Roles: 0, Tokens: 2}, counts, "should count the entities")
+		list, err := s.UserTokens(ctx, 10)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 1, len(list), "should list the tokens of the user")
+		assert.Equal(t, auth.TokenValue("new"), list[0].Value, "should list the tokens of the user")
+		assert.Equal(t, nil, s.DeleteToken(ctx, "new"), "should success")
+		list, _ = s.UserTokens(ctx, 10)
+		assert.Equal(t, 0, len(list), "should update the index")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	s, _ := Open(filepath.Join(t.TempDir(), "auth.db"), &Options{SweepInterval: 10 * time.Millisecond})
+	defer s.Close()
+	_ = s.InsertToken(ctx, &auth.Token{Value: "old", User: 1, Expires: time.Now().Add(-time.Minute)})
+	_ = s.InsertToken(ctx, &auth.Token{Value: "new", User: 1, Expires: time.Now().Add(time.Minute)})
+	time.Sleep(50 * time.Millisecond)
+	_, err := s.GetToken(ctx, "old")
+	assert.Equal(t, auth.ErrInvalidToken, err, "should sweep expired tokens")
+	_, err = s.GetToken(ctx, "new")
+	assert.Equal(t, nil, err, "should keep valid tokens")
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) auth.Storage {
+		s, err := Open(filepath.Join(t.TempDir(), "auth.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
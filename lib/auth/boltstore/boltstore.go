@@ -0,0 +1,846 @@
+// Package boltstore implements auth.Storage on top of bbolt (go.etcd.io/bbolt), an embedded
+// key-value store in a single file. It is a middle ground between the in-memory backends and a
+// SQL database: writes are durable on return, and the data does not have to fit in memory.
+//
+// Each entity is saved as a JSON document in a bucket, keyed by its ID, next to buckets indexing
+// the names, role assignments, group memberships and tokens. Tokens are also indexed by expiry,
+// so that DeleteExpiredTokens (or Options.SweepInterval) removes them without a full scan.
+//
+// Only one process may open a file at a time.
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Buckets, created on Open
+var (
+	bucketUsers      = []byte("users")       // ID -> userRecord
+	bucketUserNames  = []byte("user_names")  // name -> ID
+	bucketUserRoles  = []byte("user_roles")  // role ID + user ID -> nothing
+	bucketUserGroups = []byte("user_groups") // group ID + user ID -> nothing
+	bucketRoles      = []byte("roles")       // ID -> auth.Role
+	bucketRoleNames  = []byte("role_names")
+	bucketGroups     = []byte("groups") // ID -> auth.Group
+	bucketGroupNames = []byte("group_names")
+	bucketTokens     = []byte("tokens")       // value -> auth.Token
+	bucketUserTokens = []byte("user_tokens")  // user ID + value -> nothing
+	bucketExpiry     = []byte("token_expiry") // expiry (Unix nanoseconds) + value -> nothing
+)
+
+// Options customizes a Store. The zero value is usable.
+type Options struct {
+	// SweepInterval, if positive, removes expired tokens in the background at this interval. The
+	// server only prunes the tokens it issued itself, so this cleans up after restarts.
+	SweepInterval time.Duration
+	// Timeout is how long Open waits for another process to release the file. 0 means forever.
+	Timeout time.Duration
+}
+
+// Store is an auth.Storage backed by a bbolt database.
+type Store struct {
+	db *bolt.DB
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+var (
+	ErrSchemaTooNew = errors.New("database is newer than this version of the package")
+)
+
+// schemaVersion is saved in the meta bucket, to detect files written by a newer version.
+const schemaVersion = 1
+
+// Open opens the database in path, creating it if needed.
+//
+// Returns: pointer to the store
+// Errors: ErrSchemaTooNew, or any error from bbolt or the file system
+func Open(path string, opts *Options) (*Store, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: o.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		if v := meta.Get([]byte("version")); v != nil && binary.BigEndian.Uint64(v) > schemaVersion {
+			return ErrSchemaTooNew
+		}
+		if err := meta.Put([]byte("version"), u64(schemaVersion)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketUsers, bucketUserNames, bucketUserRoles, bucketUserGroups, bucketRoles,
+			bucketRoleNames, bucketGroups, bucketGroupNames, bucketTokens, bucketUserTokens, bucketExpiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db, stop: make(chan struct{})}
+	if o.SweepInterval > 0 {
+		s.wg.Add(1)
+		go s.sweep(o.SweepInterval)
+	}
+	return s, nil
+}
+
+// NewBoltServer creates an auth.Server that persists its data in the bbolt database in path.
+// Close the returned store when done.
+//
+// Returns: pointer to the new server instance, and the store
+// Errors: auth.ErrInvalidConfig, plus those of Open
+func NewBoltServer(config *auth.ServerConfig, path string, opts *Options) (*auth.Server, *Store, error) {
+	s, err := Open(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	svr, err := auth.NewServer(config, s)
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	return svr, s, nil
+}
+
+// Close stops the sweeper and closes the database. The store cannot be used afterwards.
+//
+// Returns: none
+// Errors: any error from bbolt
+func (s *Store) Close() error {
+	select {
+	case <-s.stop:
+		return nil
+	default:
+	}
+	close(s.stop)
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+func (s *Store) sweep(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			_, _ = s.DeleteExpiredTokens(context.Background(), now)
+		}
+	}
+}
+
+// DeleteExpiredTokens removes all tokens that expired before the given time.
+//
+// Returns: number of removed tokens
+func (s *Store) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	var n int64
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketExpiry).Cursor()
+		limit := u64(uint64(before.UnixNano()))
+		var values [][]byte
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+			values = append(values, append([]byte(nil), k[8:]...))
+		}
+		// Not while iterating, as deleting moves the cursor
+		for _, v := range values {
+			if err := deleteToken(tx, v); err != nil {
+				return err
+			}
+		}
+		n = int64(len(values))
+		return nil
+	})
+	return n, err
+}
+
+// *-* Users *-*
+
+// userRecord is the JSON document of a user. Roles are saved by ID, and populated on reads.
+type userRecord struct {
+	*auth.User
+	Roles []auth.RoleID `json:",omitempty"`
+}
+
+func (s *Store) InsertUser(ctx context.Context, u *auth.User) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		names := tx.Bucket(bucketUserNames)
+		if names.Get([]byte(u.Name)) != nil {
+			return auth.ErrUserExists
+		}
+		users := tx.Bucket(bucketUsers)
+		id, err := nextID(users, int64(u.ID))
+		if err != nil {
+			return err
+		}
+		if users.Get(u64(uint64(id))) != nil {
+			return auth.ErrUserExists
+		}
+		saved := *u
+		saved.ID = auth.UserID(id)
+		if err := putUser(tx, &saved, nil); err != nil {
+			return err
+		}
+		u.ID = saved.ID
+		return nil
+	})
+}
+
+func (s *Store) UpdateUser(ctx context.Context, u *auth.User) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		old, err := getUser(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		if id := tx.Bucket(bucketUserNames).Get([]byte(u.Name)); id != nil && auth.UserID(binary.BigEndian.Uint64(id)) != u.ID {
+			return auth.ErrUserExists
+		}
+		return putUser(tx, u, old)
+	})
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id auth.UserID) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := unindexUser(tx, u); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketUserNames).Delete([]byte(u.Name)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketUsers).Delete(u64(uint64(id)))
+	})
+}
+
+func (s *Store) GetUser(ctx context.Context, id auth.UserID) (*auth.User, error) {
+	var u *auth.User
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		u, err = getUser(tx, id)
+		return err
+	})
+	return u, err
+}
+
+func (s *Store) GetUserByName(ctx context.Context, name string) (*auth.User, error) {
+	var u *auth.User
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		id := tx.Bucket(bucketUserNames).Get([]byte(name))
+		if id == nil {
+			return auth.ErrUserNotExist
+		}
+		u, err = getUser(tx, auth.UserID(binary.BigEndian.Uint64(id)))
+		return err
+	})
+	return u, err
+}
+
+func (s *Store) UsersWithRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, bucketUserRoles, u32(uint32(role)))
+}
+
+func (s *Store) ListUsers(ctx context.Context, q *auth.ListQuery) ([]*auth.User, error) {
+	var list []*auth.User
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return listPage(tx.Bucket(bucketUsers), tx.Bucket(bucketUserNames), q, 8, func(id []byte) (string, func(), error) {
+			u, err := getUser(tx, auth.UserID(binary.BigEndian.Uint64(id)))
+			if err != nil {
+				return "", nil, err
+			}
+			return u.Name, func() { list = append(list, u) }, nil
+		})
+	})
+	return list, err
+}
+
+// userIDs lists the users of an index of users by role or group, in key (and so ID) order.
+func (s *Store) userIDs(ctx context.Context, bucket, prefix []byte) ([]auth.UserID, error) {
+	list := []auth.UserID{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			list = append(list, auth.UserID(binary.BigEndian.Uint64(k[len(prefix):])))
+		}
+		return nil
+	})
+	return list, err
+}
+
+// getUser reads a user, with its Roles populated.
+func getUser(tx *bolt.Tx, id auth.UserID) (*auth.User, error) {
+	data := tx.Bucket(bucketUsers).Get(u64(uint64(id)))
+	if data == nil {
+		return nil, auth.ErrUserNotExist
+	}
+	var u auth.User
+	rec := userRecord{User: &u}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	u.Roles = make(map[auth.RoleID]*auth.Role, len(rec.Roles))
+	for _, role := range rec.Roles {
+		if r, err := getRole(tx, role); err == nil {
+			u.Roles[role] = r
+		} else if err != auth.ErrRoleNotExist {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+// putUser saves a user, and updates the indexes from those of old (nil for a new user).
+func putUser(tx *bolt.Tx, u, old *auth.User) error {
+	rec := userRecord{User: u, Roles: make([]auth.RoleID, 0, len(u.Roles))}
+	for role := range u.Roles {
+		if tx.Bucket(bucketRoles).Get(u32(uint32(role))) == nil {
+			// Deleted in the meantime, as the indexes cascade
+			continue
+		}
+		rec.Roles = append(rec.Roles, role)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err := unindexUser(tx, old); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketUserNames).Delete([]byte(old.Name)); err != nil {
+			return err
+		}
+	}
+	id := u64(uint64(u.ID))
+	if err := tx.Bucket(bucketUsers).Put(id, data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketUserNames).Put([]byte(u.Name), id); err != nil {
+		return err
+	}
+	for _, role := range rec.Roles {
+		if err := tx.Bucket(bucketUserRoles).Put(join(u32(uint32(role)), id), nil); err != nil {
+			return err
+		}
+	}
+	for _, group := range u.Groups {
+		if err := tx.Bucket(bucketUserGroups).Put(join(u32(uint32(group)), id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexUser removes a user from the indexes of roles and groups.
+func unindexUser(tx *bolt.Tx, u *auth.User) error {
+	id := u64(uint64(u.ID))
+	for role := range u.Roles {
+		if err := tx.Bucket(bucketUserRoles).Delete(join(u32(uint32(role)), id)); err != nil {
+			return err
+		}
+	}
+	for _, group := range u.Groups {
+		if err := tx.Bucket(bucketUserGroups).Delete(join(u32(uint32(group)), id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *-* Roles *-*
+
+func (s *Store) InsertRole(ctx context.Context, r *auth.Role) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketRoleNames).Get([]byte(r.Name)) != nil {
+			return auth.ErrRoleExists
+		}
+		roles := tx.Bucket(bucketRoles)
+		id, err := nextID(roles, int64(r.ID))
+		if err != nil {
+			return err
+		}
+		if roles.Get(u32(uint32(id))) != nil {
+			return auth.ErrRoleExists
+		}
+		saved := *r
+		saved.ID = auth.RoleID(id)
+		if err := putNamed(roles, tx.Bucket(bucketRoleNames), u32(uint32(id)), saved.Name, &saved); err != nil {
+			return err
+		}
+		r.ID = saved.ID
+		return nil
+	})
+}
+
+func (s *Store) UpdateRole(ctx context.Context, r *auth.Role) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		old, err := getRole(tx, r.ID)
+		if err != nil {
+			return err
+		}
+		names := tx.Bucket(bucketRoleNames)
+		if id := names.Get([]byte(r.Name)); id != nil && auth.RoleID(binary.BigEndian.Uint32(id)) != r.ID {
+			return auth.ErrRoleExists
+		}
+		if err := names.Delete([]byte(old.Name)); err != nil {
+			return err
+		}
+		return putNamed(tx.Bucket(bucketRoles), names, u32(uint32(r.ID)), r.Name, r)
+	})
+}
+
+// DeleteRole removes a role, and takes it away from its users.
+func (s *Store) DeleteRole(ctx context.Context, id auth.RoleID) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		r, err := getRole(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketRoles).Delete(u32(uint32(id))); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketRoleNames).Delete([]byte(r.Name)); err != nil {
+			return err
+		}
+		for _, user := range members(tx, bucketUserRoles, u32(uint32(id))) {
+			old, err := getUser(tx, user)
+			if err != nil {
+				return err
+			}
+			// getUser already leaves out the deleted role
+			if err := putUser(tx, old, old); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketUserRoles).Delete(join(u32(uint32(id)), u64(uint64(user)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetRole(ctx context.Context, id auth.RoleID) (*auth.Role, error) {
+	var r *auth.Role
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		r, err = getRole(tx, id)
+		return err
+	})
+	return r, err
+}
+
+func (s *Store) GetRoleByName(ctx context.Context, name string) (*auth.Role, error) {
+	var r *auth.Role
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		id := tx.Bucket(bucketRoleNames).Get([]byte(name))
+		if id == nil {
+			return auth.ErrRoleNotExist
+		}
+		r, err = getRole(tx, auth.RoleID(binary.BigEndian.Uint32(id)))
+		return err
+	})
+	return r, err
+}
+
+func (s *Store) ListRoles(ctx context.Context, q *auth.ListQuery) ([]*auth.Role, error) {
+	var list []*auth.Role
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return listPage(tx.Bucket(bucketRoles), tx.Bucket(bucketRoleNames), q, 4, func(id []byte) (string, func(), error) {
+			r, err := getRole(tx, auth.RoleID(binary.BigEndian.Uint32(id)))
+			if err != nil {
+				return "", nil, err
+			}
+			return r.Name, func() { list = append(list, r) }, nil
+		})
+	})
+	return list, err
+}
+
+func getRole(tx *bolt.Tx, id auth.RoleID) (*auth.Role, error) {
+	data := tx.Bucket(bucketRoles).Get(u32(uint32(id)))
+	if data == nil {
+		return nil, auth.ErrRoleNotExist
+	}
+	var r auth.Role
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// *-* Groups *-*
+
+func (s *Store) InsertGroup(ctx context.Context, g *auth.Group) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketGroupNames).Get([]byte(g.Name)) != nil {
+			return auth.ErrGroupExists
+		}
+		groups := tx.Bucket(bucketGroups)
+		id, err := nextID(groups, int64(g.ID))
+		if err != nil {
+			return err
+		}
+		if groups.Get(u32(uint32(id))) != nil {
+			return auth.ErrGroupExists
+		}
+		saved := *g
+		saved.ID = auth.GroupID(id)
+		if err := putNamed(groups, tx.Bucket(bucketGroupNames), u32(uint32(id)), saved.Name, &saved); err != nil {
+			return err
+		}
+		g.ID = saved.ID
+		return nil
+	})
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, g *auth.Group) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		old, err := getGroup(tx, g.ID)
+		if err != nil {
+			return err
+		}
+		names := tx.Bucket(bucketGroupNames)
+		if id := names.Get([]byte(g.Name)); id != nil && auth.GroupID(binary.BigEndian.Uint32(id)) != g.ID {
+			return auth.ErrGroupExists
+		}
+		if err := names.Delete([]byte(old.Name)); err != nil {
+			return err
+		}
+		return putNamed(tx.Bucket(bucketGroups), names, u32(uint32(g.ID)), g.Name, g)
+	})
+}
+
+// DeleteGroup removes a group, and its members from it.
+func (s *Store) DeleteGroup(ctx context.Context, id auth.GroupID) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		g, err := getGroup(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketGroups).Delete(u32(uint32(id))); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketGroupNames).Delete([]byte(g.Name)); err != nil {
+			return err
+		}
+		for _, user := range members(tx, bucketUserGroups, u32(uint32(id))) {
+			old, err := getUser(tx, user)
+			if err != nil {
+				return err
+			}
+			u := *old
+			u.Groups = nil
+			for _, group := range old.Groups {
+				if group != id {
+					u.Groups = append(u.Groups, group)
+				}
+			}
+			if err := putUser(tx, &u, old); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetGroup(ctx context.Context, id auth.GroupID) (*auth.Group, error) {
+	var g *auth.Group
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		g, err = getGroup(tx, id)
+		return err
+	})
+	return g, err
+}
+
+func (s *Store) GetGroupByName(ctx context.Context, name string) (*auth.Group, error) {
+	var g *auth.Group
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		id := tx.Bucket(bucketGroupNames).Get([]byte(name))
+		if id == nil {
+			return auth.ErrGroupNotExist
+		}
+		g, err = getGroup(tx, auth.GroupID(binary.BigEndian.Uint32(id)))
+		return err
+	})
+	return g, err
+}
+
+func (s *Store) GroupMembers(ctx context.Context, group auth.GroupID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, bucketUserGroups, u32(uint32(group)))
+}
+
+func getGroup(tx *bolt.Tx, id auth.GroupID) (*auth.Group, error) {
+	data := tx.Bucket(bucketGroups).Get(u32(uint32(id)))
+	if data == nil {
+		return nil, auth.ErrGroupNotExist
+	}
+	var g auth.Group
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Count implements auth.Counter.
+func (s *Store) Count(ctx context.Context) (auth.Counts, error) {
+	var c auth.Counts
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		c.Users = int64(tx.Bucket(bucketUsers).Stats().KeyN)
+		c.Roles = int64(tx.Bucket(bucketRoles).Stats().KeyN)
+		c.Tokens = int64(tx.Bucket(bucketTokens).Stats().KeyN)
+		return nil
+	})
+	return c, err
+}
+
+// *-* Tokens *-*
+
+func (s *Store) InsertToken(ctx context.Context, t *auth.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		v := []byte(t.Value)
+		// A token saved again replaces the old one, and its index entries
+		if err := deleteToken(tx, v); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketTokens).Put(v, data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketUserTokens).Put(join(u64(uint64(t.User)), v), nil); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpiry).Put(join(u64(uint64(t.Expires.UnixNano())), v), nil)
+	})
+}
+
+func (s *Store) GetToken(ctx context.Context, v auth.TokenValue) (*auth.Token, error) {
+	var t *auth.Token
+	err := s.view(ctx, func(tx *bolt.Tx) (err error) {
+		t, err = getToken(tx, []byte(v))
+		return err
+	})
+	return t, err
+}
+
+func (s *Store) DeleteToken(ctx context.Context, v auth.TokenValue) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return deleteToken(tx, []byte(v))
+	})
+}
+
+func (s *Store) UserTokens(ctx context.Context, user auth.UserID) ([]*auth.Token, error) {
+	var list []*auth.Token
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		prefix := u64(uint64(user))
+		c := tx.Bucket(bucketUserTokens).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			t, err := getToken(tx, k[len(prefix):])
+			if err != nil {
+				return err
+			}
+			list = append(list, t)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func getToken(tx *bolt.Tx, v []byte) (*auth.Token, error) {
+	data := tx.Bucket(bucketTokens).Get(v)
+	if data == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	var t auth.Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// deleteToken removes a token and its index entries. It is a no-op if the token does not exist.
+func deleteToken(tx *bolt.Tx, v []byte) error {
+	t, err := getToken(tx, v)
+	if err == auth.ErrInvalidToken {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketUserTokens).Delete(join(u64(uint64(t.User)), v)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketExpiry).Delete(join(u64(uint64(t.Expires.UnixNano())), v)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTokens).Delete(v)
+}
+
+// *-* Helpers *-*
+
+// view and update run a transaction, unless ctx is done. bbolt transactions cannot be canceled
+// once started, so ctx is only checked at the start.
+func (s *Store) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(fn)
+}
+
+func (s *Store) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+// nextID returns id, or a new ID from the sequence of the bucket if id is 0. The sequence is moved
+// past preset IDs, so that generated IDs do not collide with them, and never goes back, so the IDs
+// of deleted entities are not reused.
+func nextID(b *bolt.Bucket, id int64) (int64, error) {
+	if id == 0 {
+		seq, err := b.NextSequence()
+		return int64(seq), err
+	}
+	if uint64(id) > b.Sequence() {
+		return id, b.SetSequence(uint64(id))
+	}
+	return id, nil
+}
+
+// putNamed saves a role or group, and indexes its name. The old name, if any, must be removed
+// by the caller.
+func putNamed(b, names *bolt.Bucket, id []byte, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(id, data); err != nil {
+		return err
+	}
+	return names.Put([]byte(name), id)
+}
+
+// members lists the users in an index of users by role or group.
+func members(tx *bolt.Tx, bucket, prefix []byte) []auth.UserID {
+	var ids []auth.UserID
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, auth.UserID(binary.BigEndian.Uint64(k[len(prefix):])))
+	}
+	return ids
+}
+
+// listPage calls load with the IDs of the entities, in the order of the query, until it accepts
+// q.Limit of them. load gives the name of the entity, and a function adding it to the page. byID
+// is keyed by IDs of idLen bytes, and byName maps names to IDs.
+func listPage(byID, byName *bolt.Bucket, q *auth.ListQuery, idLen int, load func(id []byte) (string, func(), error)) error {
+	byNames := q.SortBy == auth.SortByName
+	c := byID.Cursor()
+	if byNames {
+		c = byName.Cursor()
+	}
+	var start []byte
+	switch {
+	case q.After != nil && byNames:
+		start = []byte(q.After.Name)
+	case q.After != nil && idLen == 8:
+		start = u64(uint64(q.After.ID))
+	case q.After != nil:
+		start = u32(uint32(q.After.ID))
+	case byNames && !q.Desc:
+		start = []byte(q.Prefix)
+	}
+	var k, v []byte
+	switch {
+	case !q.Desc && start != nil:
+		k, v = c.Seek(start)
+	case !q.Desc:
+		k, v = c.First()
+	case start != nil:
+		// The last key before start
+		if k, v = c.Seek(start); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	default:
+		k, v = c.Last()
+	}
+	next := c.Next
+	if q.Desc {
+		next = c.Prev
+	}
+
+	for n := 0; k != nil && n < q.Limit; k, v = next() {
+		id := k
+		if byNames {
+			id = v
+			if name := string(k); !strings.HasPrefix(name, q.Prefix) {
+				// Names with the prefix are contiguous: stop after them
+				if (name > q.Prefix) != q.Desc {
+					break
+				}
+				continue
+			}
+		}
+		name, add, err := load(id)
+		if err != nil {
+			return err
+		}
+		if q.Match(auth.ListKey{ID: int64(decodeID(id)), Name: name}) {
+			add()
+			n++
+		}
+	}
+	return nil
+}
+
+func decodeID(b []byte) uint64 {
+	if len(b) == 8 {
+		return binary.BigEndian.Uint64(b)
+	}
+	return uint64(binary.BigEndian.Uint32(b))
+}
+
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func u32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func join(a, b []byte) []byte {
+	return append(append(make([]byte, 0, len(a)+len(b)), a...), b...)
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// BreachChecker tells if a password appeared in known data breaches, e.g. lib/hibp for the Have I
+// Been Pwned database. See ServerConfig.BreachChecker.
+type BreachChecker interface {
+	// Breached reports whether the password is known from a breach.
+	Breached(ctx context.Context, password string) (bool, error)
+}
+
+var ErrBreachedPassword = newError("breached_password", http.StatusBadRequest, "password found in a data breach")
+
+// checkBreached runs the BreachChecker of the server, if any, on a new password.
+//
+// Errors: ErrBreachedPassword, or any error from the checker
+func (s *Server) checkBreached(ctx context.Context, password string) error {
+	if s.cfg.BreachChecker == nil {
+		return nil
+	}
+	breached, err := s.cfg.BreachChecker.Breached(ctx, password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		return ErrBreachedPassword
+	}
+	return nil
+}
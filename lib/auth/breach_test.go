@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type breachList map[string]bool
+
+func (l breachList) Breached(_ context.Context, password string) (bool, error) {
+	if password == "unreachable" {
+		return false, errors.New("unreachable")
+	}
+	return l[password], nil
+}
+
+func TestBreachChecker(t *testing.T) {
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, BreachChecker: breachList{"password1": true}}))
+	{
+		_, err := svr.CreateUser("anna", "password1")
+		assert.Equal(t, ErrBreachedPassword, err, "should reject breached passwords")
+		_, err = svr.CreateUser("anna", "pw")
+		assert.Equal(t, ErrWeakPassword, err, "should check the policy first")
+		_, err = svr.CreateUser("anna", "unreachable")
+		assert.Equal(t, "unreachable", err.Error(), "should report the errors of the checker")
+		id, err := svr.CreateUser("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should accept other passwords")
+
+		assert.Equal(t, ErrBreachedPassword, svr.SetPassword(id, "password1"), "should check changed passwords")
+	}
+	{
+		res, err := svr.ImportUsers(strings.NewReader(`{"name":"elton","password":"password1"}`), FormatJSON)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, ErrBreachedPassword, res.Failed[0].Err, "should check imported passwords")
+	}
+}
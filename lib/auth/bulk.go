@@ -0,0 +1,527 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserFormat is the encoding of ImportUsers and ExportUsers.
+type UserFormat int
+
+const (
+	// FormatJSON is JSON Lines: a UserRecord object per line.
+	FormatJSON UserFormat = iota
+	// FormatCSV starts with a header row naming the columns, among "name" (required), "password",
+	// "password_hash", "roles" and "suspended". Roles are separated by semicolons.
+	FormatCSV
+)
+
+// UserRecord is a user in an import or an export.
+type UserRecord struct {
+	Name string `json:"name"`
+	// Password is a clear-text password, which must satisfy the password policy. Only imported.
+	Password string `json:"password,omitempty"`
+	// PasswordHash is a hash in the format of a built-in PasswordHasher (or the configured one),
+	// e.g. "$argon2id$...", to import passwords without knowing them. Exactly one of Password and
+	// PasswordHash is given.
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Roles        []string `json:"roles,omitempty"` // names of existing roles
+	Suspended    bool     `json:"suspended,omitempty"`
+	// Metadata is that of the user, see SetUserMetadata. It has no CSV column.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ImportResult tells the outcome of ImportUsers.
+type ImportResult struct {
+	Created int
+	Failed  []ImportFailure
+}
+
+// ImportFailure is a record that was not imported.
+type ImportFailure struct {
+	Line int // of the record, from 1. In CSV, the header is line 1.
+	Name string
+	Err  error // ErrBadRecord, ErrUserExists, ErrRoleNotExist, ErrWeakPassword, ErrBreachedPassword, ErrHashFormat, ErrInvalidMetadata, ErrInvalidUsername or ErrTooManyUsers
+}
+
+var (
+	ErrBadImport = newError("bad_import", http.StatusBadRequest, "malformed import")
+	ErrBadRecord = newError("bad_record", http.StatusBadRequest, "malformed user record")
+)
+
+var csvColumns = map[string]bool{"name": true, "password": true, "password_hash": true, "roles": true, "suspended": true}
+
+// ImportUsers creates the users read from r, record by record, so that imports of any size run in
+// constant memory and do not block the server for long. A record that cannot be imported, e.g. as
+// its name is taken or a role does not exist, is reported in the result and skipped. The import
+// only stops on errors of the input as a whole, or of the storage.
+//
+// Clear-text passwords are hashed, which is slow by design; hashes are imported as is, and verify
+// on login like those of any built-in hasher. Imports create no events but user.created.
+//
+// Returns: the number of users created, and the failed records
+// Errors: ErrBadImport, ErrInternal, ctx.Err() of the server context, any error from r, the store
+// or the BreachChecker. The result is valid up to the error.
+func (s *Server) ImportUsers(r io.Reader, format UserFormat) (_ *ImportResult, err error) {
+	s, sp := s.trace("auth.ImportUsers")
+	defer func() { sp.end(err) }()
+	res := &ImportResult{}
+	next, err := newRecordReader(r, format)
+	if err != nil {
+		return res, err
+	}
+	for {
+		line, rec, err := next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err == ErrBadRecord {
+			res.Failed = append(res.Failed, ImportFailure{Line: line, Err: err})
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		if err := s.importUser(rec); err == nil {
+			res.Created++
+		} else if isRecordError(err) {
+			res.Failed = append(res.Failed, ImportFailure{Line: line, Name: rec.Name, Err: err})
+		} else {
+			return res, err
+		}
+	}
+}
+
+func isRecordError(err error) bool {
+	switch err {
+	case ErrBadRecord, ErrUserExists, ErrRoleNotExist, ErrWeakPassword, ErrBreachedPassword, ErrHashFormat,
+		ErrInvalidMetadata, ErrInvalidUsername:
+		return true
+	}
+	return false
+}
+
+// newRecordReader returns a function reading the next record and its line, or io.EOF at the end.
+func newRecordReader(r io.Reader, format UserFormat) (func() (int, *UserRecord, error), error) {
+	switch format {
+	case FormatJSON:
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, 1<<20)
+		line := 0
+		return func() (int, *UserRecord, error) {
+			for sc.Scan() {
+				line++
+				if len(strings.TrimSpace(sc.Text())) == 0 {
+					continue
+				}
+				var rec UserRecord
+				if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+					return line, nil, ErrBadRecord
+				}
+				return line, &rec, nil
+			}
+			if err := sc.Err(); err != nil {
+				return line, nil, err
+			}
+			return line, nil, io.EOF
+		}, nil
+
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1 // Checked per record, so that a bad row does not end the import
+		header, err := cr.Read()
+		if err == io.EOF {
+			return func() (int, *UserRecord, error) { return 0, nil, io.EOF }, nil
+		} else if err != nil {
+			return nil, ErrBadImport
+		}
+		col := make(map[string]int, len(header))
+		for i, name := range header {
+			name = strings.TrimSpace(name)
+			if _, dup := col[name]; dup || !csvColumns[name] {
+				return nil, ErrBadImport
+			}
+			col[name] = i
+		}
+		if _, ok := col["name"]; !ok {
+			return nil, ErrBadImport
+		}
+		return func() (int, *UserRecord, error) {
+			row, err := cr.Read()
+			if err == io.EOF {
+				return 0, nil, io.EOF
+			} else if pe, ok := err.(*csv.ParseError); ok {
+				return pe.StartLine, nil, ErrBadRecord
+			} else if err != nil {
+				return 0, nil, err
+			}
+			line, _ := cr.FieldPos(0)
+			if len(row) != len(header) {
+				return line, nil, ErrBadRecord
+			}
+			field := func(name string) string {
+				if i, ok := col[name]; ok {
+					return row[i]
+				}
+				return ""
+			}
+			rec := &UserRecord{Name: field("name"), Password: field("password"), PasswordHash: field("password_hash")}
+			if roles := field("roles"); roles != "" {
+				rec.Roles = strings.Split(roles, ";")
+			}
+			if suspended := field("suspended"); suspended != "" {
+				if rec.Suspended, err = strconv.ParseBool(suspended); err != nil {
+					return line, nil, ErrBadRecord
+				}
+			}
+			return line, rec, nil
+		}, nil
+	}
+	return nil, ErrBadImport
+}
+
+// importUser creates the user of a record.
+func (s *Server) importUser(rec *UserRecord) error {
+	ctx := s.ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rec.Name == "" || (rec.Password == "") == (rec.PasswordHash == "") {
+		return ErrBadRecord
+	}
+	if !validMetadata(rec.Metadata) {
+		return ErrInvalidMetadata
+	}
+	if err := s.checkUsername(rec.Name); err != nil {
+		return err
+	}
+	var secret []byte
+	if rec.Password != "" {
+		if err := s.checkPassword(ctx, rec.Name, rec.Password); err != nil {
+			return err
+		}
+		var err error
+		if secret, err = s.hashPassword(rec.Password); err != nil {
+			return ErrInternal
+		}
+	} else {
+		secret = []byte(rec.PasswordHash)
+		if !s.knownHashFormat(secret) {
+			return ErrHashFormat
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.lookupUserByName(ctx, rec.Name); err == nil {
+		return ErrUserExists
+	} else if err != ErrUserNotExist {
+		return err
+	}
+	newUser := User{
+		Name:     s.cfg.UsernamePolicy.Normalize(rec.Name),
+		Secret:   secret,
+		Roles:    make(map[RoleID]*Role, len(rec.Roles)),
+		Metadata: mergeMetadata(nil, rec.Metadata),
+	}
+	if rec.Suspended {
+		newUser.Status = UserSuspended
+	}
+	for _, roleName := range rec.Roles {
+		r, err := s.store.GetRoleByName(ctx, strings.TrimSpace(roleName))
+		if err != nil {
+			return err
+		}
+		newUser.Roles[r.ID] = r
+	}
+	if err := s.insertUser(ctx, &newUser); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventUserCreated, User: newUser.ID, Name: newUser.Name})
+	return nil
+}
+
+// knownHashFormat tells if a hash looks like one of a built-in hasher, or of the configured one.
+// Built-in formats are only parsed, as verifying a password would cost as much as a login.
+func (s *Server) knownHashFormat(hash []byte) bool {
+	if id, inner, peppered := splitPepper(hash); peppered {
+		return s.pepper(id) != nil && s.knownHashFormat(inner)
+	}
+	parts := strings.Split(string(hash), "$")
+	switch {
+	case len(parts) == 6 && parts[1] == "argon2id", len(parts) == 5 && parts[1] == "scrypt":
+		return true
+	case len(parts) == 4 && strings.HasPrefix(parts[1], "2"):
+		_, err := bcrypt.Cost(hash)
+		return err == nil
+	}
+	_, err := s.hasher.Verify("", hash)
+	return err != ErrHashFormat
+}
+
+// isLegacyHash tells if a hash is an unsalted SHA-256 hash, unlike the hashes of PasswordHashers,
+// which are text.
+func isLegacyHash(hash []byte) bool {
+	return len(hash) == sha256.Size && hash[0] != '$'
+}
+
+// ExportUsers writes the users with a local password, as imported by ImportUsers, in the order of
+// their IDs. Deleted users, service accounts and users of an Authenticator are left out, as their
+// credentials cannot be exported, and so are users with a legacy SHA-256 hash (see
+// ServerConfig.LegacySHA256); see MemoryStorage.Save for full backups. The users are read a
+// page at a time, so the export sees the changes made in the meantime.
+//
+// Returns: none
+// Errors: ErrBadImport for an unknown format, any error from w or the store
+func (s *Server) ExportUsers(w io.Writer, format UserFormat) (err error) {
+	s, sp := s.trace("auth.ExportUsers")
+	defer func() { sp.end(err) }()
+	var write func(rec *UserRecord) error
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		write = func(rec *UserRecord) error { return enc.Encode(rec) }
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		if err := cw.Write([]string{"name", "password_hash", "roles", "suspended"}); err != nil {
+			return err
+		}
+		write = func(rec *UserRecord) error {
+			return cw.Write([]string{rec.Name, rec.PasswordHash, strings.Join(rec.Roles, ";"), strconv.FormatBool(rec.Suspended)})
+		}
+	default:
+		return ErrBadImport
+	}
+
+	opts := ListOptions{Limit: MaxListLimit}
+	for {
+		users, next, err := s.ListUsers(&opts)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if u.Deleted != nil || u.Kind == UserService || u.Source != "" || len(u.Secret) == 0 || isLegacyHash(u.Secret) {
+				continue
+			}
+			rec := UserRecord{Name: u.Name, PasswordHash: string(u.Secret), Suspended: u.Status == UserSuspended, Metadata: u.Metadata}
+			for _, r := range u.Roles {
+				rec.Roles = append(rec.Roles, r.Name)
+			}
+			sort.Strings(rec.Roles)
+			if err := write(&rec); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// Credentials are the name and password of a user to create with CreateUsers.
+type Credentials struct {
+	Name     string
+	Password string
+}
+
+// RoleGrant is a role to assign to a user with AddRolesToUsers.
+type RoleGrant struct {
+	User UserID
+	Role RoleID
+}
+
+// CreateUsers creates many users like CreateUser, for provisioning. The passwords are checked and
+// hashed in parallel before taking the write lock, which is then taken once for all the users. A
+// user that cannot be created, e.g. as its name is taken (also by a user earlier in the list), is
+// reported and skipped.
+//
+// Returns: the IDs of the new users and the errors of the others, both in the order of users: an ID
+// is 0 where the error is not nil. Errors are ErrInvalidUsername, ErrWeakPassword,
+// ErrBreachedPassword, ErrUserExists or ErrTooManyUsers.
+// Errors: ErrInternal, ctx.Err() of the server context or any error from the BreachChecker, before
+// any user is created; any error from the store, with the users created so far
+func (s *Server) CreateUsers(users []Credentials) (_ []UserID, _ []error, err error) {
+	s, sp := s.trace("auth.CreateUsers")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	ids := make([]UserID, len(users))
+	errs := make([]error, len(users))
+	secrets, err := s.hashCredentials(users, errs)
+	if err != nil {
+		return ids, errs, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range users {
+		if errs[i] != nil {
+			continue
+		}
+		if _, err := s.lookupUserByName(ctx, c.Name); err == nil {
+			errs[i] = ErrUserExists
+			continue
+		} else if err != ErrUserNotExist {
+			return ids, errs, err
+		}
+		newUser := User{
+			Name:   s.cfg.UsernamePolicy.Normalize(c.Name),
+			Secret: secrets[i],
+			Roles:  make(map[RoleID]*Role),
+		}
+		defaults, err := s.grantDefaultRoles(ctx, &newUser)
+		if err != nil {
+			return ids, errs, err
+		}
+		if err := s.insertUser(ctx, &newUser); err == ErrUserExists || err == ErrTooManyUsers {
+			errs[i] = err
+			continue
+		} else if err != nil {
+			return ids, errs, err
+		}
+		ids[i] = newUser.ID
+		s.emit(Event{Type: EventUserCreated, User: newUser.ID, Name: newUser.Name})
+		s.emitDefaultRoles(&newUser, defaults)
+	}
+	return ids, errs, nil
+}
+
+// hashCredentials checks and hashes the passwords of users, on as many goroutines as there are
+// CPUs. The errors of the users are set in errs.
+//
+// Returns: the hashes, nil where errs is set
+// Errors: ErrInternal, ctx.Err() of the server context, or any error from the BreachChecker
+func (s *Server) hashCredentials(users []Credentials, errs []error) ([][]byte, error) {
+	ctx := s.ctx
+	secrets := make([][]byte, len(users))
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		fatal error
+		next  = make(chan int)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if fatal == nil {
+			fatal = err
+		}
+		mu.Unlock()
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(users) {
+		workers = len(users)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				c := users[i]
+				if err := s.checkUsername(c.Name); err != nil {
+					errs[i] = err
+					continue
+				}
+				if err := s.checkPassword(ctx, c.Name, c.Password); isRecordError(err) {
+					errs[i] = err
+					continue
+				} else if err != nil {
+					fail(err)
+					continue
+				}
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					continue
+				}
+				secret, err := s.hashPassword(c.Password)
+				if err != nil {
+					fail(ErrInternal)
+					continue
+				}
+				secrets[i] = secret
+			}
+		}()
+	}
+	for i := range users {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return secrets, fatal
+}
+
+// AddRolesToUsers assigns many roles like AddRoleToUser, under a single write lock, and saves each
+// user once for all its roles. A grant that cannot be made is reported and skipped.
+//
+// Returns: the errors of the grants, in their order, which are nil for those made or ErrUserNotExist
+// or ErrRoleNotExist
+// Errors: any error from the store. The users saved before it keep their roles.
+func (s *Server) AddRolesToUsers(grants []RoleGrant) (_ []error, err error) {
+	s, sp := s.trace("auth.AddRolesToUsers")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	errs := make([]error, len(grants))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The users to save, in the order of their first grant, with the roles given to them
+	var (
+		order   []UserID
+		pending = make(map[UserID]*User)
+		granted = make(map[UserID][]RoleID)
+	)
+	for i, g := range grants {
+		userObj, ok := pending[g.User]
+		if !ok {
+			u, err := s.getUser(ctx, g.User)
+			if err == ErrUserNotExist {
+				errs[i] = err
+				continue
+			} else if err != nil {
+				return errs, err
+			}
+			userObj = u
+		}
+		roleObj, err := s.store.GetRole(ctx, g.Role)
+		if err == ErrRoleNotExist {
+			errs[i] = err
+			continue
+		} else if err != nil {
+			return errs, err
+		}
+		_, temporary := userObj.RoleExpiry[roleObj.ID]
+		if _, has := userObj.Roles[roleObj.ID]; has && !temporary {
+			continue
+		}
+		if !ok {
+			userObj = userObj.clone()
+			pending[g.User] = userObj
+			order = append(order, g.User)
+		}
+		userObj.Roles[roleObj.ID] = roleObj
+		delete(userObj.RoleExpiry, roleObj.ID)
+		granted[g.User] = append(granted[g.User], roleObj.ID)
+	}
+	for _, user := range order {
+		userObj := pending[user]
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return errs, err
+		}
+		for _, role := range granted[user] {
+			s.emit(Event{Type: EventRoleGranted, User: user, Name: userObj.Name, Role: role})
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportExport(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	svr.CreateRole("admin")
+	svr.CreateRole("reader")
+	hash, _ := (&BcryptHasher{Cost: 4}).Hash("s3cr3t-hash")
+	{
+		input := `{"name": "anna", "password": "passw0rd", "roles": ["admin", "reader"]}
+{"name": "belle", "password_hash": "` + string(hash) + `", "suspended": true}
+
+{"name": "cara", "password": "passw0rd", "password_hash": "` + string(hash) + `"}
+{"name": "dora", "password": "x"}
+{"name": "anna", "password": "passw0rd"}
+{"name": "elke", "password": "passw0rd", "roles": ["writer"]}
+{"name": "fay", "password_hash": "$md5$abc"}
+not json
+`
+		res, err := svr.ImportUsers(strings.NewReader(input), FormatJSON)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 2, res.Created, "should create the valid users")
+		assert.Equal(t, []ImportFailure{
+			{Line: 4, Name: "cara", Err: ErrBadRecord},
+			{Line: 5, Name: "dora", Err: ErrWeakPassword},
+			{Line: 6, Name: "anna", Err: ErrUserExists},
+			{Line: 7, Name: "elke", Err: ErrRoleNotExist},
+			{Line: 8, Name: "fay", Err: ErrHashFormat},
+			{Line: 9, Err: ErrBadRecord},
+		}, res.Failed, "should report the failed records")
+
+		anna := svr.GetUserByName("anna")
+		assert.Equal(t, 2, len(anna.Roles), "should assign roles by name")
+		assert.Equal(t, UserSuspended, svr.GetUserByName("belle").Status, "should import the status")
+		svr.ReactivateUser(svr.GetUserByName("belle").ID)
+		_, err = svr.Authenticate("belle", "s3cr3t-hash")
+		assert.Equal(t, nil, err, "should import password hashes")
+	}
+	{
+		input := "name,password,roles\r\ngreta,passw0rd,reader;admin\r\nhana,passw0rd\r\n\"ida,passw0rd,\r\n"
+		res, err := svr.ImportUsers(strings.NewReader(input), FormatCSV)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 1, res.Created, "should import CSV")
+		assert.Equal(t, []ImportFailure{{Line: 3, Err: ErrBadRecord}, {Line: 4, Err: ErrBadRecord}}, res.Failed,
+			"should report malformed rows")
+		assert.Equal(t, 2, len(svr.GetUserByName("greta").Roles), "should split the roles")
+		_, err = svr.ImportUsers(strings.NewReader("name,email\r\n"), FormatCSV)
+		assert.Equal(t, ErrBadImport, err, "should reject unknown columns")
+		_, err = svr.ImportUsers(strings.NewReader("password\r\n"), FormatCSV)
+		assert.Equal(t, ErrBadImport, err, "should require names")
+	}
+	{
+		svr.CreateServiceAccount("ci")
+		svr.DeleteUser(svr.GetUserByName("greta").ID)
+		var b bytes.Buffer
+		assert.Equal(t, nil, svr.ExportUsers(&b, FormatCSV), "should success")
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		assert.Equal(t, 3, len(lines), "should export the users with a password")
+		assert.Equal(t, "name,password_hash,roles,suspended", strings.TrimSpace(lines[0]), "should write a header")
+		assert.Equal(t, true, strings.HasPrefix(lines[1], "anna,"), "should export in order of IDs")
+		assert.Equal(t, true, strings.HasSuffix(strings.TrimSpace(lines[1]), ",admin;reader,false"), "should export the roles")
+
+		other, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+		other.CreateRole("admin")
+		other.CreateRole("reader")
+		b.Reset()
+		svr.ExportUsers(&b, FormatJSON)
+		res, err := other.ImportUsers(&b, FormatJSON)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 2, res.Created, "should import its own export")
+		_, err = other.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should keep the passwords")
+	}
+}
+
+func TestBulk(t *testing.T) {
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxUsers: 4}), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	{
+		next, cancel := collect(svr, EventUserCreated)
+		ids, errs, err := svr.CreateUsers([]Credentials{
+			{"belle", "passw0rd"}, {"cara", "x"}, {"anna", "passw0rd"}, {"dora", "passw0rd"}, {"belle", "passw0rd"},
+			{"elke", "passw0rd"}, {"fay", "passw0rd"},
+		})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []error{nil, ErrWeakPassword, ErrUserExists, nil, ErrUserExists, nil, ErrTooManyUsers}, errs,
+			"should report the users not created")
+		assert.Equal(t, svr.GetUserByName("dora").ID, ids[3], "should return the IDs of the new users")
+		assert.Equal(t, UserID(0), ids[1], "should give no ID to failed users")
+		_, err = svr.Authenticate("elke", "passw0rd")
+		assert.Equal(t, nil, err, "should hash the passwords")
+		assert.Equal(t, 3, len(next(4)), "should emit events of the new users")
+		cancel()
+	}
+	{
+		admin, _ := svr.CreateRole("admin")
+		reader, _ := svr.CreateRole("reader")
+		anna, belle := svr.GetUserByName("anna").ID, svr.GetUserByName("belle").ID
+		svr.AddRoleToUser(belle, reader)
+		next, cancel := collect(svr, EventRoleGranted)
+		errs, err := svr.AddRolesToUsers([]RoleGrant{{anna, admin}, {101, admin}, {anna, 101}, {belle, reader}, {anna, reader}})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []error{nil, ErrUserNotExist, ErrRoleNotExist, nil, nil}, errs, "should report the grants not made")
+		assert.Equal(t, 2, len(svr.GetUser(anna).Roles), "should save all the roles of a user")
+		events := next(3)
+		assert.Equal(t, 2, len(events), "should emit events of the new grants only")
+		cancel()
+	}
+}
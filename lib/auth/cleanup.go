@@ -0,0 +1,77 @@
+package auth
+
+import "context"
+
+// hardDeleteUser removes a user for good, with its tokens unless ServerConfig.LazyCleanup is set.
+// The tokens go first, so that deleting the user again finishes the job if the storage fails
+// midway. The caller must hold s.mu.
+func (s *Server) hardDeleteUser(ctx context.Context, user UserID) error {
+	if !s.cfg.LazyCleanup {
+		tokens, err := s.store.UserTokens(ctx, user)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return s.store.DeleteUser(ctx, user)
+}
+
+// unlinkRole takes a role about to be deleted away from the groups having it, and from the users
+// holding it on resources, if the storage is a RoleFinder. The caller must hold s.mu.
+func (s *Server) unlinkRole(ctx context.Context, role RoleID) error {
+	f, ok := s.baseStore().(RoleFinder)
+	if !ok {
+		return nil
+	}
+	groups, err := f.GroupsWithRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	for _, id := range groups {
+		groupObj, err := s.store.GetGroup(ctx, id)
+		if err == ErrGroupNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !groupObj.hasRole(role) {
+			continue
+		}
+		groupObj = groupObj.clone()
+		groupObj.removeRole(role)
+		if err := s.store.UpdateGroup(ctx, groupObj); err != nil {
+			return err
+		}
+	}
+
+	grantees, err := f.UsersWithResourceRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	for _, id := range grantees {
+		// Soft-deleted users too, like the holders of the role
+		userObj, err := s.store.GetUser(ctx, id)
+		if err == ErrUserNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		resources, ok := userObj.ResourceRoles[role]
+		if !ok {
+			continue
+		}
+		userObj = userObj.clone()
+		delete(userObj.ResourceRoles, role)
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return err
+		}
+		for _, resource := range resources {
+			s.emit(Event{Type: EventRoleRevoked, User: id, Name: userObj.Name, Role: role, Resource: resource})
+		}
+	}
+	return nil
+}
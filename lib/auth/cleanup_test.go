@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteUserCleanup(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		store := NewMemoryStorage()
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, LazyCleanup: lazy}), WithStorage(store), WithHasher(fastHasher))
+		anna, _ := svr.CreateUser("anna", "passw0rd")
+		elton, _ := svr.CreateUser("elton", "123456")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Authenticate("anna", "passw0rd")
+		svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, svr.DeleteUser(anna), "should success")
+		tokens, _ := store.UserTokens(context.Background(), anna)
+		if lazy {
+			assert.Equal(t, 2, len(tokens), "should leave the tokens in lazy mode")
+		} else {
+			assert.Equal(t, 0, len(tokens), "should delete the tokens of the user")
+		}
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the tokens either way")
+		tokens, _ = store.UserTokens(context.Background(), elton)
+		assert.Equal(t, 1, len(tokens), "should keep the tokens of other users")
+	}
+}
+
+func TestDeleteRoleCleanup(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		for _, lazy := range []bool{false, true} {
+			var store Storage = NewMemoryStorage()
+			if !indexed {
+				store = listOnlyStorage{store}
+			}
+			svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, LazyCleanup: lazy}), WithStorage(store), WithHasher(fastHasher))
+			anna, _ := svr.CreateUser("anna", "passw0rd")
+			elton, _ := svr.CreateUser("elton", "123456")
+			rid, _ := svr.CreateRole("editor")
+			other, _ := svr.CreateRole("reader")
+			gid, _ := svr.CreateGroup("staff")
+			svr.AddRoleToGroup(gid, rid)
+			svr.AddRoleToGroup(gid, other)
+			svr.AddRoleToUser(anna, rid)
+			svr.AddRoleToUserOnResource(elton, rid, "docs:1")
+			svr.AddRoleToUserOnResource(elton, rid, "docs:2")
+			svr.AddRoleToUserOnResource(elton, other, "docs:3")
+			next, cancel := collect(svr, EventRoleRevoked)
+
+			assert.Equal(t, nil, svr.DeleteRole(rid), "should success")
+			_, held := svr.GetUser(anna).Roles[rid]
+			assert.Equal(t, false, held, "should take the role away from its holders")
+			u := svr.GetUser(elton)
+			_, granted := u.ResourceRoles[rid]
+			if indexed && !lazy {
+				assert.Equal(t, []RoleID{other}, svr.GetGroup(gid).Roles, "should take the role away from groups")
+				assert.Equal(t, false, granted, "should take the role away from resources")
+				var resources []string
+				for _, e := range next(3)[1:] {
+					resources = append(resources, e.Resource)
+				}
+				assert.Equal(t, []string{"docs:1", "docs:2"}, resources, "should emit role.revoked for each resource")
+			} else {
+				assert.Equal(t, []RoleID{rid, other}, svr.GetGroup(gid).Roles, "should leave the groups")
+				assert.Equal(t, true, granted, "should leave the resources")
+			}
+			assert.Equal(t, []string{"docs:3"}, u.ResourceRoles[other], "should keep the other roles")
+			cancel()
+		}
+	}
+}
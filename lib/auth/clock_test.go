@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	{
+		clock.Advance(time.Hour)
+		assert.Equal(t, start.Add(time.Hour), clock.Now(), "should advance")
+		clock.Set(start)
+		assert.Equal(t, start, clock.Now(), "should be set")
+	}
+	{
+		svr, _ := New(WithConfig(&ServerConfig{JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}}),
+			WithClock(clock), WithHasher(fastHasher), WithTokenTTL(time.Minute))
+		svr.CreateUser("anna", "passw0rd")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should accept JWTs issued at the time of the clock")
+		clock.Advance(time.Minute)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should expire JWTs by the clock")
+	}
+}
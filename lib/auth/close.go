@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServerClosed = newError("server_closed", http.StatusServiceUnavailable, "server closed")
+)
+
+// Close shuts the server down gracefully, in that order: it stops starting background work (token
+// extensions, purges and role expiry) and waits for that in progress, waits for the operations in
+// progress, rejects all the later ones with ErrServerClosed, saves a snapshot to
+// ServerConfig.SnapshotPath if set, and delivers the events queued for the subscribers (such as
+// webhooks and audit logs) before ending all subscriptions and watches.
+//
+// The storage is left open, to be closed by its owner after Close, and so is the RevocationBroadcaster.
+// If ctx ends before the background work or the subscribers are done, Close goes on without
+// waiting for them (the events left are dropped) and returns ctx.Err().
+//
+// Returns: none
+// Errors: ErrServerClosed if already closed, ctx.Err(), or any error from saving the snapshot
+func (s *Server) Close(ctx context.Context) (err error) {
+	s, sp := s.trace("auth.Close")
+	defer func() { sp.end(err) }()
+	s.closeMu.Lock()
+	if s.closing {
+		s.closeMu.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	s.closeMu.Unlock()
+
+	waitErr := wait(ctx, s.background.Wait)
+
+	s.mu.Lock()
+	atomic.StoreInt32(&s.closed, 1)
+	s.decisions.invalidate()
+	var saveErr error
+	if s.cfg.SnapshotPath != "" {
+		saveErr = writeSnapshot(s.baseStore().(*MemoryStorage), s.cfg.SnapshotPath, s.now())
+	}
+	s.mu.Unlock()
+
+	if s.changes != nil {
+		s.changes.close()
+	}
+	if err := s.events.close(ctx); err != nil && waitErr == nil {
+		waitErr = err
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	return waitErr
+}
+
+// goBackground runs fn on a goroutine that Close waits for, unless the server is closing.
+//
+// Returns: false if fn was not run
+func (s *Server) goBackground(fn func()) bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		fn()
+	}()
+	return true
+}
+
+// wait calls fn, which blocks, until it returns or ctx ends.
+//
+// Errors: ctx.Err()
+func wait(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeSnapshot saves a snapshot of m with its tokens to a file, which is replaced at once so that
+// a crash midway leaves the previous one. The file is only readable by its owner, as it holds
+// password hashes and tokens. The caller must keep writers of m out.
+func writeSnapshot(m *MemoryStorage, path string, now time.Time) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails once renamed
+	if err := m.save(f, true, now); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// *-* Storage *-*
+
+// closableStore fails all the calls to the storage of a server once it is closed, so that every
+// operation does.
+type closableStore struct {
+	Storage
+	svr *serverCore
+}
+
+func (c *closableStore) check() error {
+	if atomic.LoadInt32(&c.svr.closed) != 0 {
+		return ErrServerClosed
+	}
+	return nil
+}
+
+func (c *closableStore) InsertUser(ctx context.Context, u *User) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.InsertUser(ctx, u)
+}
+
+func (c *closableStore) UpdateUser(ctx context.Context, u *User) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.UpdateUser(ctx, u)
+}
+
+func (c *closableStore) DeleteUser(ctx context.Context, id UserID) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.DeleteUser(ctx, id)
+}
+
+func (c *closableStore) GetUser(ctx context.Context, id UserID) (*User, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetUser(ctx, id)
+}
+
+func (c *closableStore) GetUserByName(ctx context.Context, name string) (*User, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetUserByName(ctx, name)
+}
+
+func (c *closableStore) UsersWithRole(ctx context.Context, role RoleID) ([]UserID, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.UsersWithRole(ctx, role)
+}
+
+func (c *closableStore) ListUsers(ctx context.Context, q *ListQuery) ([]*User, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.ListUsers(ctx, q)
+}
+
+func (c *closableStore) InsertRole(ctx context.Context, r *Role) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.InsertRole(ctx, r)
+}
+
+func (c *closableStore) UpdateRole(ctx context.Context, r *Role) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.UpdateRole(ctx, r)
+}
+
+func (c *closableStore) DeleteRole(ctx context.Context, id RoleID) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.DeleteRole(ctx, id)
+}
+
+func (c *closableStore) GetRole(ctx context.Context, id RoleID) (*Role, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetRole(ctx, id)
+}
+
+func (c *closableStore) GetRoleByName(ctx context.Context, name string) (*Role, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetRoleByName(ctx, name)
+}
+
+func (c *closableStore) ListRoles(ctx context.Context, q *ListQuery) ([]*Role, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.ListRoles(ctx, q)
+}
+
+func (c *closableStore) InsertGroup(ctx context.Context, g *Group) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.InsertGroup(ctx, g)
+}
+
+func (c *closableStore) UpdateGroup(ctx context.Context, g *Group) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.UpdateGroup(ctx, g)
+}
+
+func (c *closableStore) DeleteGroup(ctx context.Context, id GroupID) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.DeleteGroup(ctx, id)
+}
+
+func (c *closableStore) GetGroup(ctx context.Context, id GroupID) (*Group, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetGroup(ctx, id)
+}
+
+func (c *closableStore) GetGroupByName(ctx context.Context, name string) (*Group, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetGroupByName(ctx, name)
+}
+
+func (c *closableStore) GroupMembers(ctx context.Context, group GroupID) ([]UserID, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GroupMembers(ctx, group)
+}
+
+func (c *closableStore) InsertToken(ctx context.Context, t *Token) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.InsertToken(ctx, t)
+}
+
+func (c *closableStore) GetToken(ctx context.Context, v TokenValue) (*Token, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetToken(ctx, v)
+}
+
+func (c *closableStore) DeleteToken(ctx context.Context, v TokenValue) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.Storage.DeleteToken(ctx, v)
+}
+
+func (c *closableStore) UserTokens(ctx context.Context, user UserID) ([]*Token, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.Storage.UserTokens(ctx, user)
+}
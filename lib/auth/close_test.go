@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	svr, _ := New(WithHasher(fastHasher), WithDecisionCache(time.Minute, 0), WithSnapshotPath(path))
+	uid, _ := svr.CreateUser("elton", "passw0rd")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "passw0rd")
+	svr.CheckRole(token, rid)
+	{
+		var delivered []EventType
+		svr.Subscribe(func(e Event) {
+			time.Sleep(10 * time.Millisecond)
+			delivered = append(delivered, e.Type)
+		})
+		svr.CreateRole("auditor")
+		svr.CreateRole("writer")
+		assert.Equal(t, nil, svr.Close(context.Background()), "should success")
+		assert.Equal(t, []EventType{EventRoleCreated, EventRoleCreated}, delivered, "should deliver the queued events")
+		assert.Equal(t, ErrServerClosed, svr.Close(context.Background()), "should close once")
+	}
+	{
+		_, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrServerClosed, err, "should reject checks, cached or not")
+		_, err = svr.Authenticate("elton", "passw0rd")
+		assert.Equal(t, ErrServerClosed, err, "should reject logins")
+		_, err = svr.CreateRole("reader")
+		assert.Equal(t, ErrServerClosed, err, "should reject writes")
+	}
+	{
+		f, err := os.Open(path)
+		assert.Equal(t, nil, err, "should save a snapshot")
+		defer f.Close()
+		next, _ := New(WithHasher(fastHasher))
+		assert.Equal(t, nil, next.Load(f), "should save a valid snapshot")
+		ok, _ := next.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should keep the tokens")
+	}
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		block := make(chan struct{})
+		defer close(block)
+		svr.Subscribe(func(e Event) { <-block })
+		svr.CreateRole("scanner")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, svr.Close(ctx), "should give up on stuck subscribers")
+		_, err := svr.CreateRole("auditor")
+		assert.Equal(t, ErrServerClosed, err, "should close anyway")
+	}
+	{
+		_, err := New(WithStorage(listOnlyStorage{NewMemoryStorage()}), WithSnapshotPath(path))
+		assert.Equal(t, ErrInvalidConfig, err, "should only save snapshots of a MemoryStorage")
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingHasher counts the passwords verified by a hasher.
+type countingHasher struct {
+	PasswordHasher
+	verified int32
+}
+
+func (h *countingHasher) Verify(password string, hash []byte) (bool, error) {
+	atomic.AddInt32(&h.verified, 1)
+	return h.PasswordHasher.Verify(password, hash)
+}
+
+func TestConstantTimeLogin(t *testing.T) {
+	h := &countingHasher{PasswordHasher: fastHasher}
+	svr, _ := New(WithHasher(h))
+	svr.CreateUser("anna", "passw0rd")
+	svr.CreateServiceAccount("ci")
+	deleted, _ := svr.CreateUser("elton", "123456")
+	svr.DeleteUser(deleted)
+	for _, name := range []string{"anna", "nobody", "ci", "elton"} {
+		atomic.StoreInt32(&h.verified, 0)
+		_, err := svr.Authenticate(name, "wrong")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject "+name)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&h.verified), "should verify one hash for "+name)
+	}
+}
+
+// TestLoginTiming guards that logins with unknown names take about as long as those with wrong
+// passwords. Medians of many attempts are compared, with a wide margin, to keep it stable.
+func TestLoginTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	svr, _ := New(WithHasher(&Argon2idHasher{Time: 1, Memory: 8 * 1024}))
+	svr.CreateUser("anna", "passw0rd")
+	median := func(name string) time.Duration {
+		const n = 15
+		times := make([]time.Duration, n)
+		for i := range times {
+			start := time.Now()
+			svr.Authenticate(name, "wrong")
+			times[i] = time.Since(start)
+		}
+		for i := range times {
+			for j := i + 1; j < len(times); j++ {
+				if times[j] < times[i] {
+					times[i], times[j] = times[j], times[i]
+				}
+			}
+		}
+		return times[n/2]
+	}
+	median("nobody") // hashes the dummy password
+	known, unknown := median("anna"), median("nobody")
+	assert.Equal(t, true, unknown > known/2 && unknown < known*2,
+		"should take as long for unknown names: "+unknown.String()+" vs "+known.String())
+}
+
+func BenchmarkAuthenticateWrongPassword(b *testing.B) {
+	svr, _ := New(WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svr.Authenticate("anna", "wrong")
+	}
+}
+
+func BenchmarkAuthenticateUnknownName(b *testing.B) {
+	svr, _ := New(WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	svr.Authenticate("nobody", "wrong")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svr.Authenticate("nobody", "wrong")
+	}
+}
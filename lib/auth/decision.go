@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDecisionCacheSize is the DecisionCacheSize if not set.
+const defaultDecisionCacheSize = 10000
+
+// decisionKey identifies a check: of a role, or of a permission if perm is set. client is that of
+// the context, for tokens bound to it.
+type decisionKey struct {
+	token  TokenValue
+	role   RoleID
+	perm   string
+	client ClientInfo
+}
+
+type decision struct {
+	ok      bool
+	user    UserID
+	expires time.Time
+}
+
+// decisionCache keeps the results of CheckRole and CheckPermission, see
+// ServerConfig.DecisionCacheSec. A nil cache keeps nothing.
+//
+// It is emptied by every write to the storage that may change a decision, and by JWT revocations.
+// gen counts the invalidations, so that a result computed before one is not cached after it, e.g.
+// by a check running while a revocation comes from another server.
+type decisionCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	gen     uint64
+	entries map[decisionKey]decision
+}
+
+func newDecisionCache(ttl time.Duration, size int) *decisionCache {
+	return &decisionCache{ttl: ttl, size: size, entries: make(map[decisionKey]decision)}
+}
+
+// get looks up a decision that has not expired at now.
+func (c *decisionCache) get(k decisionKey, now time.Time) (decision, bool) {
+	if c == nil {
+		return decision{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[k]
+	if ok && !now.Before(d.expires) {
+		delete(c.entries, k)
+		ok = false
+	}
+	return d, ok
+}
+
+// generation tells the number of invalidations, to pass to put.
+func (c *decisionCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches a decision made since generation gen. It is dropped if the cache was invalidated in
+// between. A full cache is emptied first, so that the tokens of a burst do not stay forever.
+func (c *decisionCache) put(k decisionKey, d decision, gen uint64, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if len(c.entries) >= c.size {
+		c.entries = make(map[decisionKey]decision)
+	}
+	d.expires = now.Add(c.ttl)
+	c.entries[k] = d
+}
+
+// invalidate forgets all the decisions.
+func (c *decisionCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if len(c.entries) > 0 {
+		c.entries = make(map[decisionKey]decision)
+	}
+}
+
+// cachedCheck answers a check from the cache, or by calling check and caching its result. The
+// caller records the result in its span; cachedCheck sets the user of cached ones.
+func (s *Server) cachedCheck(k decisionKey, check func() (bool, UserID, error)) (bool, error) {
+	c := s.decisions
+	if c == nil {
+		ok, _, err := check()
+		return ok, err
+	}
+	k.client, _ = s.requestClient()
+	if d, hit := c.get(k, s.now()); hit {
+		atomic.AddUint64(&s.metrics.decisionHits, 1)
+		s.traceUser(d.user)
+		return d.ok, nil
+	}
+	atomic.AddUint64(&s.metrics.decisionMisses, 1)
+	gen := c.generation()
+	ok, user, err := check()
+	if err == nil {
+		c.put(k, decision{ok: ok, user: user}, gen, s.now())
+	}
+	return ok, err
+}
+
+// *-* Storage *-*
+
+// decisionStore invalidates the decision cache of a server on the writes to its storage that may
+// change a decision. Inserts do not, as decisions are only cached for existing users, roles and
+// tokens.
+type decisionStore struct {
+	Storage
+	cache *decisionCache
+}
+
+func (d *decisionStore) UpdateUser(ctx context.Context, u *User) error {
+	defer d.cache.invalidate()
+	return d.Storage.UpdateUser(ctx, u)
+}
+
+func (d *decisionStore) DeleteUser(ctx context.Context, id UserID) error {
+	defer d.cache.invalidate()
+	return d.Storage.DeleteUser(ctx, id)
+}
+
+func (d *decisionStore) UpdateRole(ctx context.Context, r *Role) error {
+	defer d.cache.invalidate()
+	return d.Storage.UpdateRole(ctx, r)
+}
+
+func (d *decisionStore) DeleteRole(ctx context.Context, id RoleID) error {
+	defer d.cache.invalidate()
+	return d.Storage.DeleteRole(ctx, id)
+}
+
+func (d *decisionStore) UpdateGroup(ctx context.Context, g *Group) error {
+	defer d.cache.invalidate()
+	return d.Storage.UpdateGroup(ctx, g)
+}
+
+func (d *decisionStore) DeleteGroup(ctx context.Context, id GroupID) error {
+	defer d.cache.invalidate()
+	return d.Storage.DeleteGroup(ctx, id)
+}
+
+func (d *decisionStore) DeleteToken(ctx context.Context, v TokenValue) error {
+	defer d.cache.invalidate()
+	return d.Storage.DeleteToken(ctx, v)
+}
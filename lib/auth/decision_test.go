@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionCache(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, err := New(WithClock(clock), WithHasher(fastHasher), WithDecisionCache(5*time.Second, 0))
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	token, _ := svr.Authenticate("elton", "123456")
+	hits := func() uint64 {
+		m, _ := svr.Metrics()
+		return m.DecisionCacheHits
+	}
+	{
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should not have the role")
+		ok, _ = svr.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should still not have the role")
+		assert.Equal(t, uint64(1), hits(), "should answer the second check from the cache")
+		m, _ := svr.Metrics()
+		assert.Equal(t, uint64(1), m.DecisionCacheMisses, "should count the misses")
+		_, err := svr.CheckRole(token, rid+1)
+		assert.Equal(t, ErrRoleNotExist, err, "should not cache errors")
+		_, err = svr.CheckRole("wrong", rid)
+		assert.Equal(t, ErrInvalidToken, err, "should check the token")
+	}
+	{
+		svr.AddRoleToUser(uid, rid)
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should invalidate on new role assignments")
+		svr.GrantPermissionToRole(rid, "orders:*")
+		svr.CheckPermission(token, "orders:read")
+		ok, _ = svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should grant the permission")
+		assert.Equal(t, uint64(2), hits(), "should cache permissions")
+		svr.DenyPermissionToUser(uid, "orders:read")
+		ok, _ = svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, false, ok, "should invalidate on deny rules")
+	}
+	{
+		svr.CheckRole(token, rid)
+		clock.Advance(5 * time.Second)
+		before := hits()
+		svr.CheckRole(token, rid)
+		assert.Equal(t, before, hits(), "should expire cached results")
+		svr.Invalidate(token)
+		_, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate on revoked tokens")
+	}
+	{
+		c := newDecisionCache(time.Second, 1)
+		now := clock.Now()
+		k := decisionKey{token: "t", role: 1}
+		gen := c.generation()
+		c.invalidate()
+		c.put(k, decision{ok: true}, gen, now)
+		_, hit := c.get(k, now)
+		assert.Equal(t, false, hit, "should not cache results computed before an invalidation")
+		c.put(k, decision{ok: true}, c.generation(), now)
+		c.put(decisionKey{token: "u", role: 1}, decision{ok: true}, c.generation(), now)
+		_, hit = c.get(k, now)
+		assert.Equal(t, false, hit, "should drop the results when full")
+	}
+	{
+		_, err := New(WithDecisionCache(time.Hour, 0))
+		assert.Equal(t, ErrInvalidConfig, err, "should not outlive the tokens")
+		_, err = New(WithDecisionCache(time.Second, -1))
+		assert.Equal(t, ErrInvalidConfig, err, "should check the size")
+	}
+}
+
+func TestDecisionCacheRevocations(t *testing.T) {
+	store := NewMemoryStorage()
+	bus := NewMemoryBroadcaster()
+	cfg := &ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}, Revocations: bus,
+		DecisionCacheSec: 10, Hasher: fastHasher}
+	a, _ := NewServer(cfg, store)
+	b, _ := NewServer(cfg, store)
+	a.CreateUser("elton", "123456")
+	rid, _ := a.CreateRole("admin")
+	token, _ := a.Authenticate("elton", "123456")
+	{
+		ok, err := b.CheckRole(token, rid)
+		assert.Equal(t, false, ok || err != nil, "should success")
+		a.Invalidate(token)
+		_, err = b.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate on the revocations of other servers")
+	}
+}
+
+// notifyingStorage is a MemoryStorage shared by servers, telling them of the changes of each other.
+type notifyingStorage struct {
+	*MemoryStorage
+	subs []func()
+}
+
+func (n *notifyingStorage) NotifyChanges(fn func()) {
+	n.subs = append(n.subs, fn)
+}
+
+func (n *notifyingStorage) UpdateUser(ctx context.Context, u *User) error {
+	defer func() {
+		for _, fn := range n.subs {
+			fn()
+		}
+	}()
+	return n.MemoryStorage.UpdateUser(ctx, u)
+}
+
+func TestDecisionCacheNotifier(t *testing.T) {
+	store := &notifyingStorage{MemoryStorage: NewMemoryStorage()}
+	cfg := &ServerConfig{TokenExpireSec: 60, DecisionCacheSec: 10, Hasher: fastHasher}
+	a, _ := NewServer(cfg, store)
+	b, _ := NewServer(cfg, store)
+	uid, _ := a.CreateUser("elton", "123456")
+	rid, _ := a.CreateRole("admin")
+	token, _ := a.Authenticate("elton", "123456")
+	{
+		ok, _ := b.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should not have the role")
+		a.AddRoleToUser(uid, rid)
+		ok, _ = b.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should invalidate on the changes of other servers")
+	}
+}
@@ -0,0 +1,34 @@
+package auth
+
+import "context"
+
+// grantDefaultRoles gives a new user the roles of ServerConfig.DefaultRoles that exist, before it is
+// inserted. The caller must hold s.mu, and announce the grants with emitDefaultRoles once the user
+// is saved.
+//
+// Returns: the roles granted, leaving out those the user already had
+// Errors: any error from the store
+func (s *Server) grantDefaultRoles(ctx context.Context, u *User) ([]RoleID, error) {
+	var granted []RoleID
+	for _, name := range s.cfg.DefaultRoles {
+		r, err := s.store.GetRoleByName(ctx, name)
+		if err == ErrRoleNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := u.Roles[r.ID]; ok {
+			continue
+		}
+		u.Roles[r.ID] = r
+		granted = append(granted, r.ID)
+	}
+	return granted, nil
+}
+
+// emitDefaultRoles records the default roles given to a new user, after its user.created event.
+func (s *Server) emitDefaultRoles(u *User, roles []RoleID) {
+	for _, role := range roles {
+		s.emit(Event{Type: EventRoleGranted, User: u.ID, Name: u.Name, Role: role, Default: true})
+	}
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRoles(t *testing.T) {
+	_, err := New(WithConfig(&ServerConfig{TokenExpireSec: 60, DefaultRoles: []string{""}}))
+	assert.Equal(t, ErrInvalidConfig, err, "should reject empty role names")
+
+	corp := &fakeDirectory{name: "corp", passwords: map[string]string{"anna": "c0rp"}, roles: []string{"staff"}}
+	lab := &fakeDirectory{name: "lab", passwords: map[string]string{"fred": "l4b"}}
+	config := &ServerConfig{TokenExpireSec: 60, Hasher: fastHasher, DefaultRoles: []string{"reader", "missing"}, Authenticators: []Authenticator{corp}}
+	svr, _ := New(WithConfig(config))
+	reader, _ := svr.CreateRole("reader")
+	staff, _ := svr.CreateRole("staff")
+	config.DefaultRoles[0] = "staff"
+	next, cancel := collect(svr, EventUserCreated, EventRoleGranted)
+	defer cancel()
+	{
+		uid, _ := svr.CreateUser("elton", "123456")
+		assert.Equal(t, []RoleID{reader}, roleIDs(svr.GetUser(uid)), "should give the default roles that exist")
+		events := next(2)
+		assert.Equal(t, EventUserCreated, events[0].Type, "should create the user first")
+		assert.Equal(t, Event{Type: EventRoleGranted, Time: events[1].Time, User: uid, Name: "elton", Role: reader, Default: true}, events[1], "should record the default role")
+
+		sid, _, _ := svr.CreateServiceAccount("ci")
+		assert.Equal(t, []RoleID{}, roleIDs(svr.GetUser(sid)), "should not give the default roles to service accounts")
+		next(1)
+	}
+	{
+		svr.Authenticate("anna", "c0rp")
+		assert.Equal(t, []RoleID{staff}, roleIDs(svr.GetUserByName("anna")), "should not give the default roles to external users by default")
+		next(1)
+
+		config.Authenticators = []Authenticator{lab}
+		config.DefaultRoles = []string{"reader", "staff"}
+		config.DefaultRolesExternal = true
+		svr, _ = New(WithConfig(config))
+		svr.CreateRole("reader")
+		svr.CreateRole("staff")
+		svr.Authenticate("fred", "l4b")
+		assert.Equal(t, 2, len(svr.GetUserByName("fred").Roles), "should give the default roles to external users if enabled")
+	}
+}
+
+func roleIDs(u *User) []RoleID {
+	ids := make([]RoleID, 0, len(u.Roles))
+	for id := range u.Roles {
+		ids = append(ids, id)
+	}
+	return ids
+}
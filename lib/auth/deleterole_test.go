@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteRoleCascade(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithClock(clock), WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	elton, _ := svr.CreateUser("elton", "123456")
+	clerk, _ := svr.CreateRole("clerk")
+	admin, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(anna, clerk)
+	svr.AddRoleToUserUntil(elton, clerk, clock.Now().Add(time.Hour))
+	svr.AddRoleToUser(elton, admin)
+	next, cancel := collect(svr, EventRoleRevoked, EventRoleDeleted)
+	defer cancel()
+	{
+		assert.Equal(t, ErrRoleNotExist, svr.SetRoleProtected(admin+10, true), "should check the role")
+		assert.Equal(t, nil, svr.SetRoleProtected(admin, true), "should success")
+		assert.Equal(t, true, svr.GetRole(admin).Protected, "should protect the role")
+		assert.Equal(t, ErrRoleProtected, svr.DeleteRole(admin), "should not delete protected roles")
+		_, err := svr.DeleteRoleDryRun(admin)
+		assert.Equal(t, ErrRoleProtected, err, "should check the protection on dry runs")
+		assert.Equal(t, admin, svr.GetUser(elton).Roles[admin].ID, "should keep the role of its holders")
+	}
+	{
+		users, err := svr.DeleteRoleDryRun(clerk)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []UserID{anna, elton}, users, "should report the holders")
+		assert.Equal(t, clerk, svr.GetRole(clerk).ID, "should not delete on dry runs")
+
+		assert.Equal(t, nil, svr.DeleteRole(clerk), "should success")
+		events := next(3)
+		assert.Equal(t, []EventType{EventRoleRevoked, EventRoleRevoked, EventRoleDeleted}, []EventType{events[0].Type, events[1].Type, events[2].Type}, "should revoke the role first")
+		_, has := svr.GetUser(anna).Roles[clerk]
+		assert.Equal(t, false, has, "should take the role away from its holders")
+		assert.Equal(t, 0, len(svr.GetUser(elton).RoleExpiry), "should forget temporary assignments")
+		assert.Equal(t, 1, len(svr.GetUser(elton).Roles), "should keep the other roles")
+		assert.Equal(t, ErrRoleNotExist, svr.DeleteRole(clerk), "should check the role")
+	}
+	{
+		svr.SetRoleProtected(admin, false)
+		assert.Equal(t, nil, svr.DeleteRole(admin), "should delete roles no longer protected")
+	}
+}
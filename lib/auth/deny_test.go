@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenyRules(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	ops, _ := svr.CreateRole("ops")
+	auditor, _ := svr.CreateRole("auditor")
+	svr.GrantPermissionToRole(ops, "orders:*")
+	svr.GrantPermissionToRole(auditor, "reports:read")
+	svr.AddRoleToUser(uid, ops)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		assert.Equal(t, ErrRoleNotExist, svr.DenyPermissionToRole(ops+10, "orders:delete"), "should check the role")
+		assert.Equal(t, ErrUserNotExist, svr.DenyPermissionToUser(uid+10, "orders:delete"), "should check the user")
+		assert.Equal(t, ErrInvalidPermission, svr.DenyPermissionToRole(ops, "orders:"), "should validate the permission")
+
+		assert.Equal(t, nil, svr.DenyPermissionToRole(ops, "orders:delete"), "should success")
+		assert.Equal(t, nil, svr.DenyPermissionToRole(ops, "orders:delete"), "should be a no-op the second time")
+		assert.Equal(t, []string{"orders:delete"}, svr.GetRole(ops).Denied, "should store the deny rule")
+		ok, _ := svr.CheckPermission(token, "orders:delete")
+		assert.Equal(t, false, ok, "should override the grant of the same role")
+		ok, _ = svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should keep the other permissions")
+		assert.Equal(t, nil, svr.RemoveDenyFromRole(ops, "orders:delete"), "should success")
+		ok, _ = svr.CheckPermission(token, "orders:delete")
+		assert.Equal(t, true, ok, "should grant again once removed")
+	}
+	{
+		svr.AddRoleToUser(uid, auditor)
+		svr.DenyPermissionToRole(auditor, "orders:*")
+		ok, _ := svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, false, ok, "should override the grants of other roles, with patterns")
+		scoped, _ := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{ops}})
+		ok, _ = svr.CheckPermission(scoped, "orders:read")
+		assert.Equal(t, false, ok, "should apply the deny rules of roles out of the scope")
+		svr.RemoveDenyFromRole(auditor, "orders:*")
+	}
+	{
+		assert.Equal(t, nil, svr.DenyPermissionToUser(uid, "orders:refund"), "should success")
+		assert.Equal(t, []string{"orders:refund"}, svr.GetUser(uid).Denied, "should store the deny rule")
+		ok, _ := svr.CheckPermission(token, "orders:refund")
+		assert.Equal(t, false, ok, "should override the grants of the roles")
+		ok, _ = svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should keep the other permissions")
+		assert.Equal(t, nil, svr.RemoveDenyFromUser(uid, "orders:refund"), "should success")
+		assert.Equal(t, nil, svr.RemoveDenyFromUser(uid, "orders:refund"), "should be a no-op the second time")
+		assert.Equal(t, []string(nil), svr.GetUser(uid).Denied, "should remove the deny rule")
+	}
+	{
+		jsvr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+		jsvr.CreateUser("belle", "passw0rd")
+		rid, _ := jsvr.CreateRole("ops")
+		jsvr.GrantPermissionToRole(rid, "orders:*")
+		jsvr.AddRoleToUser(1, rid)
+		jwt, _ := jsvr.Authenticate("belle", "passw0rd")
+		jsvr.DenyPermissionToUser(1, "orders:refund")
+		ok, _ := jsvr.CheckPermission(jwt, "orders:refund")
+		assert.Equal(t, false, ok, "should apply the deny rules of the user to issued JWTs")
+		ok, _ = jsvr.CheckPermission(jwt, "orders:read")
+		assert.Equal(t, true, ok, "should keep the other permissions")
+	}
+}
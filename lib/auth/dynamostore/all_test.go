@@ -0,0 +1,297 @@
+package dynamostore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/storagetest"
+)
+
+// The tests run against a fake of the API in memory, or against DynamoDB, usually DynamoDB Local,
+// if its endpoint is given, such as
+//
+//	AUTH_TEST_DYNAMODB_ENDPOINT=http://localhost:8000
+//
+// Every test works in a table of its own, which is deleted afterwards.
+func testTable(t *testing.T) (API, string) {
+	endpoint := os.Getenv("AUTH_TEST_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		return newFakeAPI(), "authtest"
+	}
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		EndpointResolver: dynamodb.EndpointResolverFromURL(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+	table := fmt.Sprintf("authtest-%d", time.Now().UnixNano())
+	if err := CreateTable(context.Background(), client, table); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = client.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	})
+	return client, table
+}
+
+var testConfig = &auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) auth.Storage {
+		client, table := testTable(t)
+		s, err := New(context.Background(), client, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestDynamoServer(t *testing.T) {
+	ctx := context.Background()
+	client, table := testTable(t)
+	a, _, err := NewDynamoServer(ctx, testConfig, client, table)
+	assert.Equal(t, nil, err, "should success")
+	b, _, _ := NewDynamoServer(ctx, testConfig, client, table)
+	uid, _ := a.CreateUser("elton", "123456")
+	rid, _ := a.CreateRole("scanner")
+	a.AddRoleToUser(uid, rid)
+	token, _ := a.Authenticate("elton", "123456")
+	{
+		ok, err := b.CheckRole(token, rid)
+		assert.Equal(t, nil, err, "should share the tokens")
+		assert.Equal(t, true, ok, "should share the roles")
+		a.Invalidate(token)
+		_, err = b.CheckRole(token, rid)
+		assert.Equal(t, auth.ErrInvalidToken, err, "should share the revocations of tokens")
+	}
+	{
+		_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(table),
+			Key:                       itemKey(pkMeta, "SCHEMA"),
+			UpdateExpression:          aws.String("SET #v = :v"),
+			ExpressionAttributeNames:  map[string]string{"#v": "v"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":v": num(schemaVersion + 1)},
+		})
+		assert.Equal(t, nil, err, "should success")
+		_, err = New(ctx, client, table)
+		assert.Equal(t, ErrSchemaTooNew, err, "should reject newer tables")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	assert.Equal(t, int64(1700000000), ttl(time.Unix(1700000000, 0)), "should keep whole seconds")
+	assert.Equal(t, int64(1700000001), ttl(time.Unix(1700000000, 1)), "should not remove tokens before they expire")
+}
+
+// *-* Fake *-*
+
+// fakeAPI is a table in memory, which only understands the expressions that the store writes (and
+// fails on the others). It returns small pages and batches, and rejects what DynamoDB rejects, such
+// as a transaction writing an item twice, so that the store is tested as it runs in DynamoDB.
+type fakeAPI struct {
+	mu    sync.Mutex
+	items map[[2]string]map[string]types.AttributeValue // by pk and sk
+}
+
+const (
+	fakeBatchSize = 2
+	fakePageSize  = 3
+)
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{items: make(map[[2]string]map[string]types.AttributeValue)}
+}
+
+func fakeKey(item map[string]types.AttributeValue) [2]string {
+	return [2]string{getS(item, "pk"), getS(item, "sk")}
+}
+
+// copyItem copies the attributes of an item, whose values are never modified.
+func copyItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	c := make(map[string]types.AttributeValue, len(item))
+	for name, v := range item {
+		c[name] = v
+	}
+	return c
+}
+
+func (f *fakeAPI) GetItem(_ context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[fakeKey(in.Key)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(item)}, nil
+}
+
+// BatchGetItem only reads fakeBatchSize keys, and leaves the others unprocessed.
+func (f *fakeAPI) BatchGetItem(_ context.Context, in *dynamodb.BatchGetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]types.AttributeValue),
+		UnprocessedKeys: make(map[string]types.KeysAndAttributes),
+	}
+	for table, keys := range in.RequestItems {
+		seen := make(map[[2]string]bool)
+		for i, key := range keys.Keys {
+			if seen[fakeKey(key)] {
+				return nil, fmt.Errorf("ValidationException: duplicate key %v", fakeKey(key))
+			}
+			seen[fakeKey(key)] = true
+			if i >= fakeBatchSize {
+				left := out.UnprocessedKeys[table]
+				left.Keys = append(left.Keys, key)
+				out.UnprocessedKeys[table] = left
+			} else if item, ok := f.items[fakeKey(key)]; ok {
+				out.Responses[table] = append(out.Responses[table], copyItem(item))
+			}
+		}
+	}
+	return out, nil
+}
+
+// Query returns pages of fakePageSize items.
+func (f *fakeAPI) Query(_ context.Context, in *dynamodb.QueryInput, _ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pk, prefix := getS(in.ExpressionAttributeValues, ":pk"), ""
+	switch cond := aws.ToString(in.KeyConditionExpression); cond {
+	case "pk = :pk":
+	case "pk = :pk AND begins_with(sk, :prefix)":
+		prefix = getS(in.ExpressionAttributeValues, ":prefix")
+	default:
+		return nil, fmt.Errorf("fake: unknown key condition %q", cond)
+	}
+	asc := aws.ToBool(in.ScanIndexForward)
+	start, hasStart := getS(in.ExclusiveStartKey, "sk"), in.ExclusiveStartKey != nil
+	var sks []string
+	for key := range f.items {
+		if key[0] != pk || !strings.HasPrefix(key[1], prefix) {
+			continue
+		}
+		if !hasStart || (asc && key[1] > start) || (!asc && key[1] < start) {
+			sks = append(sks, key[1])
+		}
+	}
+	if asc {
+		sort.Strings(sks)
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(sks)))
+	}
+	out := &dynamodb.QueryOutput{}
+	if len(sks) > fakePageSize {
+		sks = sks[:fakePageSize]
+		out.LastEvaluatedKey = itemKey(pk, sks[fakePageSize-1])
+	}
+	for _, sk := range sks {
+		out.Items = append(out.Items, copyItem(f.items[[2]string{pk, sk}]))
+	}
+	return out, nil
+}
+
+// UpdateItem applies the schema version, sequence and counter updates.
+func (f *fakeAPI) UpdateItem(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(in.Key)
+	item, ok := f.items[key]
+	if ok {
+		item = copyItem(item)
+	} else {
+		item = copyItem(in.Key)
+	}
+	vals := in.ExpressionAttributeValues
+	switch expr := aws.ToString(in.UpdateExpression); expr {
+	case "SET #v = :v":
+		name := in.ExpressionAttributeNames["#v"]
+		if _, has := item[name]; has && in.ConditionExpression != nil && getN(item, name) > getN(vals, ":v") {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		item[name] = vals[":v"]
+	case "SET #n = :id":
+		name := in.ExpressionAttributeNames["#n"]
+		if _, has := item[name]; has && getN(item, name) >= getN(vals, ":id") {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		item[name] = vals[":id"]
+	case "ADD #n :one":
+		name := in.ExpressionAttributeNames["#n"]
+		item[name] = num(getN(item, name) + getN(vals, ":one"))
+	default:
+		return nil, fmt.Errorf("fake: unknown update %q", expr)
+	}
+	f.items[key] = item
+	return &dynamodb.UpdateItemOutput{Attributes: copyItem(item)}, nil
+}
+
+// TransactWriteItems checks all the conditions before writing anything, and reports those that
+// failed in the cancellation reasons, as DynamoDB does.
+func (f *fakeAPI) TransactWriteItems(_ context.Context, in *dynamodb.TransactWriteItemsInput, _ ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(in.TransactItems) == 0 || len(in.TransactItems) > 100 {
+		return nil, fmt.Errorf("ValidationException: %d items", len(in.TransactItems))
+	}
+	reasons := make([]types.CancellationReason, len(in.TransactItems))
+	seen := make(map[[2]string]bool)
+	canceled := false
+	for i, ti := range in.TransactItems {
+		var key [2]string
+		var cond *string
+		var vals map[string]types.AttributeValue
+		switch {
+		case ti.Put != nil:
+			key, cond, vals = fakeKey(ti.Put.Item), ti.Put.ConditionExpression, ti.Put.ExpressionAttributeValues
+		case ti.Delete != nil:
+			key, cond, vals = fakeKey(ti.Delete.Key), ti.Delete.ConditionExpression, ti.Delete.ExpressionAttributeValues
+		default:
+			return nil, fmt.Errorf("fake: unknown operation")
+		}
+		if key[0] == "" || key[1] == "" || seen[key] {
+			return nil, fmt.Errorf("ValidationException: invalid or duplicate key %v", key)
+		}
+		seen[key] = true
+		item, exists := f.items[key]
+		ok := true
+		switch c := aws.ToString(cond); c {
+		case "":
+		case "attribute_not_exists(pk)":
+			ok = !exists
+		case "rev = :rev":
+			ok = exists && getN(item, "rev") == getN(vals, ":rev")
+		default:
+			return nil, fmt.Errorf("fake: unknown condition %q", c)
+		}
+		reasons[i].Code = aws.String("None")
+		if !ok {
+			reasons[i].Code, canceled = aws.String("ConditionalCheckFailed"), true
+		}
+	}
+	if canceled {
+		return nil, &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	for _, ti := range in.TransactItems {
+		if ti.Put != nil {
+			f.items[fakeKey(ti.Put.Item)] = copyItem(ti.Put.Item)
+		} else {
+			delete(f.items, fakeKey(ti.Delete.Key))
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
@@ -0,0 +1,1069 @@
+// Package dynamostore implements auth.Storage on top of Amazon DynamoDB, for serverless deployments
+// where running a database server is overkill.
+//
+// All entities live in a single table with a string partition key pk and a string sort key sk
+// (see CreateTable). Each entity is saved as a JSON document in an item, next to items for the
+// unique names, role assignments, group memberships and tokens:
+//
+//	pk               sk          attributes
+//	USER             user ID     doc, name, rev
+//	USERNAME         name        id
+//	ROLE             role ID     doc, name, rev
+//	ROLENAME         name        id
+//	GROUP            group ID    doc, name, rev
+//	GROUPNAME        name        id
+//	ROLE#<role>      user ID     (the holders of a role)
+//	GROUP#<group>    user ID     (the members of a group)
+//	TOKEN#<value>    TOKEN       doc, user, ttl
+//	TOKENS#<user>    value       doc, ttl
+//	SEQUENCE         entities    n (the last ID)
+//
+// IDs are spelled in fixed-width hexadecimal, so that they sort like numbers. Users, roles and
+// groups are thus listed from a single partition each, with strongly consistent reads. Names are
+// kept unique by conditional writes, and every write is a transaction, guarded by the revision
+// (rev) of the item read before. A transaction holds at most 100 items, which bounds the roles and
+// groups that a single UpdateUser can change.
+//
+// Tokens hold their expiry in the TTL attribute of the table, so that DynamoDB removes them, usually
+// within a few days after they expire. The server checks the expiry meanwhile.
+//
+// The store does not implement auth.Counter, as counting tokens takes a scan of the table, so
+// ServerConfig.MaxUsers and MaxRoles are not available.
+package dynamostore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Partition keys
+const (
+	pkUsers      = "USER"
+	pkUserNames  = "USERNAME"
+	pkRoles      = "ROLE"
+	pkRoleNames  = "ROLENAME"
+	pkGroups     = "GROUP"
+	pkGroupNames = "GROUPNAME"
+	pkHolders    = "ROLE#"   // + role ID
+	pkMembers    = "GROUP#"  // + group ID
+	pkToken      = "TOKEN#"  // + value
+	pkUserTokens = "TOKENS#" // + user ID
+	pkSequences  = "SEQUENCE"
+	pkMeta       = "META"
+)
+
+// IDs are spelled in fixed-width hexadecimal, so that keys sort like IDs.
+const (
+	userIDFormat = "%016x"
+	roleIDFormat = "%08x"
+)
+
+// API is the part of *dynamodb.Client used by the store, so that it can be wrapped, e.g. to add
+// metrics.
+type API interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// Store is an auth.Storage backed by a DynamoDB table.
+type Store struct {
+	client API
+	table  string
+}
+
+var (
+	ErrSchemaTooNew = errors.New("table is newer than this version of the package")
+	// ErrTooLarge is returned for a write of more items than a DynamoDB transaction holds, such as a
+	// user given or taken about 100 roles and groups at once.
+	ErrTooLarge = errors.New("write exceeds the items of a DynamoDB transaction")
+	// ErrConflict is returned when a write kept conflicting with others, and was given up.
+	ErrConflict = errors.New("too many conflicting writes")
+)
+
+// schemaVersion is saved in the table, to detect tables written by a newer version.
+const schemaVersion = 1
+
+// maxTransactItems is the limit of DynamoDB on the items of a transaction.
+const maxTransactItems = 100
+
+// maxAttempts bounds the retries of a write, from reading the items again, when another write
+// changed them in between.
+const maxAttempts = 10
+
+// New creates a Store on an existing table, such as one made by CreateTable.
+//
+// Returns: pointer to the store
+// Errors: ErrSchemaTooNew, or any error from DynamoDB
+func New(ctx context.Context, client API, table string) (*Store, error) {
+	s := &Store{client: client, table: table}
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       itemKey(pkMeta, "SCHEMA"),
+		UpdateExpression:          aws.String("SET #v = :v"),
+		ConditionExpression:       aws.String("attribute_not_exists(#v) OR #v <= :v"),
+		ExpressionAttributeNames:  map[string]string{"#v": "v"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":v": num(schemaVersion)},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil, ErrSchemaTooNew
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewDynamoServer creates an auth.Server that persists its data in a DynamoDB table.
+//
+// Returns: pointer to the new server instance, and the store
+// Errors: auth.ErrInvalidConfig, plus those of New
+func NewDynamoServer(ctx context.Context, config *auth.ServerConfig, client API, table string) (*auth.Server, *Store, error) {
+	s, err := New(ctx, client, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	svr, err := auth.NewServer(config, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return svr, s, nil
+}
+
+// CreateTable creates a table for the store, billed on demand, and waits until it is ready. The TTL
+// of the table is set to the attribute ttl. It is meant for development and tests; production
+// tables are better declared along the rest of the infrastructure, with the same key schema.
+//
+// Returns: none
+// Errors: any error from DynamoDB
+func CreateTable(ctx context.Context, client *dynamodb.Client, table string) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("sk"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("sk"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return err
+	}
+	err = dynamodb.NewTableExistsWaiter(client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName:               aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{AttributeName: aws.String("ttl"), Enabled: aws.Bool(true)},
+	})
+	return err
+}
+
+// *-* Users *-*
+
+// userRecord is the JSON document of a user. Roles are saved by ID, and populated on reads.
+type userRecord struct {
+	*auth.User
+	Roles []auth.RoleID `json:",omitempty"`
+}
+
+// storedUser is a user as read, to write it back.
+type storedUser struct {
+	user  *auth.User // without its Roles
+	roles []auth.RoleID
+	rev   int64
+}
+
+func (s *Store) InsertUser(ctx context.Context, u *auth.User) error {
+	if taken, err := s.exists(ctx, pkUserNames, u.Name); err != nil {
+		return err
+	} else if taken {
+		// Checked first, not to spend an ID
+		return auth.ErrUserExists
+	}
+	roles, err := s.existingRoles(ctx, u.Roles)
+	if err != nil {
+		return err
+	}
+	id, err := s.nextID(ctx, pkUsers, int64(u.ID))
+	if err != nil {
+		return err
+	}
+	saved := *u
+	saved.ID = auth.UserID(id)
+	w, err := s.userWrites(&saved, roles, nil)
+	if err != nil {
+		return err
+	}
+	if failed, err := s.transact(ctx, w.items); err != nil {
+		if failed[w.user] || failed[w.name] {
+			return auth.ErrUserExists
+		}
+		return err
+	}
+	u.ID = saved.ID
+	return nil
+}
+
+func (s *Store) UpdateUser(ctx context.Context, u *auth.User) error {
+	return s.updateUser(ctx, u.ID, func(*auth.User) *auth.User { return u })
+}
+
+// updateUser replaces a user with what update makes of it, from scratch again if the user changed
+// in between.
+//
+// Errors: auth.ErrUserNotExist, auth.ErrUserExists, ErrTooLarge, ErrConflict
+func (s *Store) updateUser(ctx context.Context, id auth.UserID, update func(old *auth.User) *auth.User) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		old, err := s.loadUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		u := update(old.user)
+		roles, err := s.existingRoles(ctx, u.Roles)
+		if err != nil {
+			return err
+		}
+		w, err := s.userWrites(u, roles, old)
+		if err != nil {
+			return err
+		}
+		failed, err := s.transact(ctx, w.items)
+		switch {
+		case err == nil:
+			return nil
+		case failed[w.name]:
+			return auth.ErrUserExists
+		case !isConflict(err):
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id auth.UserID) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		old, err := s.loadUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		uid := fmt.Sprintf(userIDFormat, uint64(id))
+		items := []types.TransactWriteItem{
+			s.deleteItem(pkUsers, uid, old.rev),
+			s.deleteItem(pkUserNames, old.user.Name, 0),
+		}
+		for _, role := range old.roles {
+			items = append(items, s.deleteItem(holdersKey(role), uid, 0))
+		}
+		for _, group := range groupSet(old.user.Groups) {
+			items = append(items, s.deleteItem(membersKey(group), uid, 0))
+		}
+		if _, err = s.transact(ctx, items); !isConflict(err) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (s *Store) GetUser(ctx context.Context, id auth.UserID) (*auth.User, error) {
+	old, err := s.loadUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.populate(ctx, old)
+}
+
+func (s *Store) GetUserByName(ctx context.Context, name string) (*auth.User, error) {
+	id, err := s.nameID(ctx, pkUserNames, name, auth.ErrUserNotExist)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUser(ctx, auth.UserID(id))
+}
+
+func (s *Store) UsersWithRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, holdersKey(role))
+}
+
+func (s *Store) ListUsers(ctx context.Context, q *auth.ListQuery) ([]*auth.User, error) {
+	var list []*auth.User
+	err := s.listPage(ctx, q, pkUsers, pkUserNames, userIDFormat, func(id uint64) (string, func(), error) {
+		u, err := s.GetUser(ctx, auth.UserID(id))
+		if err != nil {
+			return "", nil, err
+		}
+		return u.Name, func() { list = append(list, u) }, nil
+	})
+	return list, err
+}
+
+// userIDs lists the users of a partition of role holders or group members, in ID order.
+func (s *Store) userIDs(ctx context.Context, pk string) ([]auth.UserID, error) {
+	list := []auth.UserID{}
+	err := s.query(ctx, pk, "", nil, false, func(item map[string]types.AttributeValue) (bool, error) {
+		id, err := strconv.ParseUint(getS(item, "sk"), 16, 64)
+		list = append(list, auth.UserID(id))
+		return true, err
+	})
+	return list, err
+}
+
+// loadUser reads a user, and the IDs of its roles.
+//
+// Errors: auth.ErrUserNotExist, or any error from DynamoDB
+func (s *Store) loadUser(ctx context.Context, id auth.UserID) (*storedUser, error) {
+	item, err := s.get(ctx, pkUsers, fmt.Sprintf(userIDFormat, uint64(id)))
+	if err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, auth.ErrUserNotExist
+	}
+	var u auth.User
+	rec := userRecord{User: &u}
+	if err := json.Unmarshal([]byte(getS(item, "doc")), &rec); err != nil {
+		return nil, err
+	}
+	return &storedUser{user: &u, roles: rec.Roles, rev: getN(item, "rev")}, nil
+}
+
+// populate gives the user read, with its Roles populated.
+func (s *Store) populate(ctx context.Context, old *storedUser) (*auth.User, error) {
+	u := old.user
+	u.Roles = make(map[auth.RoleID]*auth.Role, len(old.roles))
+	items, err := s.batchGet(ctx, pkRoles, roleSKs(old.roles))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var r auth.Role
+		if err := json.Unmarshal([]byte(getS(item, "doc")), &r); err != nil {
+			return nil, err
+		}
+		u.Roles[r.ID] = &r
+	}
+	return u, nil
+}
+
+// existingRoles lists the roles of a user that exist, in ID order. Those deleted in the meantime
+// are left out, like the other stores do.
+func (s *Store) existingRoles(ctx context.Context, roles map[auth.RoleID]*auth.Role) ([]auth.RoleID, error) {
+	ids := make([]auth.RoleID, 0, len(roles))
+	for id := range roles {
+		ids = append(ids, id)
+	}
+	items, err := s.batchGet(ctx, pkRoles, roleSKs(ids))
+	if err != nil {
+		return nil, err
+	}
+	found := make([]auth.RoleID, 0, len(items))
+	for _, item := range items {
+		id, err := strconv.ParseUint(getS(item, "sk"), 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, auth.RoleID(id))
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found, nil
+}
+
+// userWrite is the transaction saving a user, with the indexes of the items whose conditions tell
+// why it failed (-1 if absent).
+type userWrite struct {
+	items      []types.TransactWriteItem
+	user, name int
+}
+
+// userWrites makes the transaction saving a user holding roles, and updating the index items from
+// those of old (nil for a new user).
+//
+// Errors: ErrTooLarge
+func (s *Store) userWrites(u *auth.User, roles []auth.RoleID, old *storedUser) (*userWrite, error) {
+	data, err := json.Marshal(userRecord{User: u, Roles: roles})
+	if err != nil {
+		return nil, err
+	}
+	uid := fmt.Sprintf(userIDFormat, uint64(u.ID))
+	w := &userWrite{user: 0, name: -1}
+	var rev int64
+	var oldName string
+	var oldRoles []auth.RoleID
+	var oldGroups []auth.GroupID
+	if old != nil {
+		rev, oldName, oldRoles, oldGroups = old.rev, old.user.Name, old.roles, old.user.Groups
+	}
+	w.items = append(w.items, s.putItem(pkUsers, uid, rev, map[string]types.AttributeValue{
+		"doc": str(string(data)), "name": str(u.Name),
+	}))
+	if old == nil || oldName != u.Name {
+		w.name = len(w.items)
+		w.items = append(w.items, s.putItem(pkUserNames, u.Name, 0, map[string]types.AttributeValue{"id": str(uid)}))
+		if old != nil {
+			w.items = append(w.items, s.deleteItem(pkUserNames, oldName, 0))
+		}
+	}
+
+	had := make(map[auth.RoleID]bool, len(oldRoles))
+	for _, role := range oldRoles {
+		had[role] = true
+	}
+	for _, role := range roles {
+		if !had[role] {
+			w.items = append(w.items, s.putItem(holdersKey(role), uid, -1, nil))
+		}
+		delete(had, role)
+	}
+	for role := range had {
+		w.items = append(w.items, s.deleteItem(holdersKey(role), uid, 0))
+	}
+	inGroup := make(map[auth.GroupID]bool, len(oldGroups))
+	for _, group := range groupSet(oldGroups) {
+		inGroup[group] = true
+	}
+	for _, group := range groupSet(u.Groups) {
+		if !inGroup[group] {
+			w.items = append(w.items, s.putItem(membersKey(group), uid, -1, nil))
+		}
+		delete(inGroup, group)
+	}
+	for group := range inGroup {
+		w.items = append(w.items, s.deleteItem(membersKey(group), uid, 0))
+	}
+	if len(w.items) > maxTransactItems {
+		return nil, ErrTooLarge
+	}
+	return w, nil
+}
+
+// *-* Roles *-*
+
+func (s *Store) InsertRole(ctx context.Context, r *auth.Role) error {
+	id, err := s.insertNamed(ctx, pkRoles, pkRoleNames, int64(r.ID), r.Name, auth.ErrRoleExists, func(id int64) interface{} {
+		saved := *r
+		saved.ID = auth.RoleID(id)
+		return &saved
+	})
+	if err == nil {
+		r.ID = auth.RoleID(id)
+	}
+	return err
+}
+
+func (s *Store) UpdateRole(ctx context.Context, r *auth.Role) error {
+	return s.updateNamed(ctx, pkRoles, pkRoleNames, int64(r.ID), r.Name, r, auth.ErrRoleNotExist, auth.ErrRoleExists)
+}
+
+// DeleteRole removes a role, and then takes it away from its users, one at a time.
+func (s *Store) DeleteRole(ctx context.Context, id auth.RoleID) error {
+	if err := s.deleteNamed(ctx, pkRoles, pkRoleNames, int64(id), auth.ErrRoleNotExist); err != nil {
+		return err
+	}
+	users, err := s.UsersWithRole(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		// existingRoles leaves out the deleted role, and userWrites its index item
+		err := s.updateUser(ctx, user, func(old *auth.User) *auth.User { return old })
+		if err == auth.ErrUserNotExist {
+			err = s.deleteKeys(ctx, holdersKey(id), fmt.Sprintf(userIDFormat, uint64(user)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetRole(ctx context.Context, id auth.RoleID) (*auth.Role, error) {
+	var r auth.Role
+	if _, err := s.getDoc(ctx, pkRoles, fmt.Sprintf(roleIDFormat, uint32(id)), &r, auth.ErrRoleNotExist); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *Store) GetRoleByName(ctx context.Context, name string) (*auth.Role, error) {
+	id, err := s.nameID(ctx, pkRoleNames, name, auth.ErrRoleNotExist)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetRole(ctx, auth.RoleID(id))
+}
+
+func (s *Store) ListRoles(ctx context.Context, q *auth.ListQuery) ([]*auth.Role, error) {
+	var list []*auth.Role
+	err := s.listPage(ctx, q, pkRoles, pkRoleNames, roleIDFormat, func(id uint64) (string, func(), error) {
+		r, err := s.GetRole(ctx, auth.RoleID(id))
+		if err != nil {
+			return "", nil, err
+		}
+		return r.Name, func() { list = append(list, r) }, nil
+	})
+	return list, err
+}
+
+// *-* Groups *-*
+
+func (s *Store) InsertGroup(ctx context.Context, g *auth.Group) error {
+	id, err := s.insertNamed(ctx, pkGroups, pkGroupNames, int64(g.ID), g.Name, auth.ErrGroupExists, func(id int64) interface{} {
+		saved := *g
+		saved.ID = auth.GroupID(id)
+		return &saved
+	})
+	if err == nil {
+		g.ID = auth.GroupID(id)
+	}
+	return err
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, g *auth.Group) error {
+	return s.updateNamed(ctx, pkGroups, pkGroupNames, int64(g.ID), g.Name, g, auth.ErrGroupNotExist, auth.ErrGroupExists)
+}
+
+// DeleteGroup removes a group, and then its members from it, one at a time.
+func (s *Store) DeleteGroup(ctx context.Context, id auth.GroupID) error {
+	if err := s.deleteNamed(ctx, pkGroups, pkGroupNames, int64(id), auth.ErrGroupNotExist); err != nil {
+		return err
+	}
+	members, err := s.GroupMembers(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, user := range members {
+		err := s.updateUser(ctx, user, func(old *auth.User) *auth.User {
+			u := *old
+			u.Groups = nil
+			for _, group := range old.Groups {
+				if group != id {
+					u.Groups = append(u.Groups, group)
+				}
+			}
+			return &u
+		})
+		if err == auth.ErrUserNotExist {
+			err = s.deleteKeys(ctx, membersKey(id), fmt.Sprintf(userIDFormat, uint64(user)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetGroup(ctx context.Context, id auth.GroupID) (*auth.Group, error) {
+	var g auth.Group
+	if _, err := s.getDoc(ctx, pkGroups, fmt.Sprintf(roleIDFormat, uint32(id)), &g, auth.ErrGroupNotExist); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *Store) GetGroupByName(ctx context.Context, name string) (*auth.Group, error) {
+	id, err := s.nameID(ctx, pkGroupNames, name, auth.ErrGroupNotExist)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetGroup(ctx, auth.GroupID(id))
+}
+
+func (s *Store) GroupMembers(ctx context.Context, group auth.GroupID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, membersKey(group))
+}
+
+// *-* Tokens *-*
+
+// InsertToken saves a token, with its expiry as the TTL of its items.
+func (s *Store) InsertToken(ctx context.Context, t *auth.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	v := string(t.Value)
+	attrs := map[string]types.AttributeValue{
+		"doc": str(string(data)), "user": num(int64(t.User)), "ttl": num(ttl(t.Expires)),
+	}
+	items := []types.TransactWriteItem{
+		s.putItem(pkToken+v, "TOKEN", -1, attrs),
+		s.putItem(userTokensKey(t.User), v, -1, map[string]types.AttributeValue{"doc": attrs["doc"], "ttl": attrs["ttl"]}),
+	}
+	// A token saved again replaces the old one, and its index item
+	old, err := s.get(ctx, pkToken+v, "TOKEN")
+	if err != nil {
+		return err
+	}
+	if old != nil && auth.UserID(getN(old, "user")) != t.User {
+		items = append(items, s.deleteItem(userTokensKey(auth.UserID(getN(old, "user"))), v, 0))
+	}
+	_, err = s.transact(ctx, items)
+	return err
+}
+
+func (s *Store) GetToken(ctx context.Context, v auth.TokenValue) (*auth.Token, error) {
+	var t auth.Token
+	if _, err := s.getDoc(ctx, pkToken+string(v), "TOKEN", &t, auth.ErrInvalidToken); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *Store) DeleteToken(ctx context.Context, v auth.TokenValue) error {
+	old, err := s.get(ctx, pkToken+string(v), "TOKEN")
+	if err != nil || old == nil {
+		return err
+	}
+	_, err = s.transact(ctx, []types.TransactWriteItem{
+		s.deleteItem(pkToken+string(v), "TOKEN", 0),
+		s.deleteItem(userTokensKey(auth.UserID(getN(old, "user"))), string(v), 0),
+	})
+	return err
+}
+
+func (s *Store) UserTokens(ctx context.Context, user auth.UserID) ([]*auth.Token, error) {
+	var list []*auth.Token
+	err := s.query(ctx, userTokensKey(user), "", nil, false, func(item map[string]types.AttributeValue) (bool, error) {
+		var t auth.Token
+		if err := json.Unmarshal([]byte(getS(item, "doc")), &t); err != nil {
+			return false, err
+		}
+		list = append(list, &t)
+		return true, nil
+	})
+	return list, err
+}
+
+// ttl is the TTL attribute of a token expiring at t, in Unix seconds, rounded up.
+func ttl(t time.Time) int64 {
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	return sec
+}
+
+// *-* Named entities *-*
+
+// insertNamed saves a new role or group, given by saved with its ID, and its unique name.
+//
+// Returns: the ID
+func (s *Store) insertNamed(ctx context.Context, pk, pkNames string, id int64, name string, errExists error, saved func(id int64) interface{}) (int64, error) {
+	if taken, err := s.exists(ctx, pkNames, name); err != nil {
+		return 0, err
+	} else if taken {
+		return 0, errExists
+	}
+	id, err := s.nextID(ctx, pk, id)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(saved(id))
+	if err != nil {
+		return 0, err
+	}
+	sk := fmt.Sprintf(roleIDFormat, uint32(id))
+	failed, err := s.transact(ctx, []types.TransactWriteItem{
+		s.putItem(pk, sk, 0, map[string]types.AttributeValue{"doc": str(string(data)), "name": str(name)}),
+		s.putItem(pkNames, name, 0, map[string]types.AttributeValue{"id": str(sk)}),
+	})
+	if failed[0] || failed[1] {
+		// The ID or the name is taken
+		return 0, errExists
+	}
+	return id, err
+}
+
+// updateNamed replaces a role or group, and moves its unique name.
+func (s *Store) updateNamed(ctx context.Context, pk, pkNames string, id int64, name string, v interface{}, errNotExist, errExists error) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sk := fmt.Sprintf(roleIDFormat, uint32(id))
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		old, err := s.get(ctx, pk, sk)
+		if err != nil {
+			return err
+		} else if old == nil {
+			return errNotExist
+		}
+		items := []types.TransactWriteItem{
+			s.putItem(pk, sk, getN(old, "rev"), map[string]types.AttributeValue{"doc": str(string(data)), "name": str(name)}),
+		}
+		if oldName := getS(old, "name"); oldName != name {
+			items = append(items,
+				s.putItem(pkNames, name, 0, map[string]types.AttributeValue{"id": str(sk)}),
+				s.deleteItem(pkNames, oldName, 0))
+		}
+		failed, err := s.transact(ctx, items)
+		switch {
+		case err == nil:
+			return nil
+		case len(items) > 1 && failed[1]:
+			return errExists
+		case !isConflict(err):
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// deleteNamed removes a role or group, and its unique name.
+func (s *Store) deleteNamed(ctx context.Context, pk, pkNames string, id int64, errNotExist error) error {
+	sk := fmt.Sprintf(roleIDFormat, uint32(id))
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		old, err := s.get(ctx, pk, sk)
+		if err != nil {
+			return err
+		} else if old == nil {
+			return errNotExist
+		}
+		_, err = s.transact(ctx, []types.TransactWriteItem{
+			s.deleteItem(pk, sk, getN(old, "rev")),
+			s.deleteItem(pkNames, getS(old, "name"), 0),
+		})
+		if !isConflict(err) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// nameID looks up the ID of a user, role or group by name.
+func (s *Store) nameID(ctx context.Context, pkNames, name string, errNotExist error) (uint64, error) {
+	item, err := s.get(ctx, pkNames, name)
+	if err != nil {
+		return 0, err
+	} else if item == nil {
+		return 0, errNotExist
+	}
+	return strconv.ParseUint(getS(item, "id"), 16, 64)
+}
+
+// listPage calls load with the IDs of the entities, in the order of the query, until it accepts
+// q.Limit of them. load gives the name of the entity, and a function adding it to the page. The
+// entities are in the partition byID, under IDs spelled with idFormat, and byName maps their names
+// to IDs.
+func (s *Store) listPage(ctx context.Context, q *auth.ListQuery, byID, byName, idFormat string, load func(id uint64) (string, func(), error)) error {
+	byNames := q.SortBy == auth.SortByName
+	pk, prefix := byID, ""
+	if byNames {
+		// Names with the prefix are contiguous
+		pk, prefix = byName, q.Prefix
+	}
+	var after *string
+	if q.After != nil && byNames {
+		after = aws.String(q.After.Name)
+	} else if q.After != nil {
+		after = aws.String(fmt.Sprintf(idFormat, uint64(q.After.ID)))
+	}
+
+	n := 0
+	if q.Limit <= 0 {
+		return nil
+	}
+	return s.query(ctx, pk, prefix, after, q.Desc, func(item map[string]types.AttributeValue) (bool, error) {
+		id := getS(item, "sk")
+		if byNames {
+			id = getS(item, "id")
+		}
+		n64, err := strconv.ParseUint(id, 16, 64)
+		if err != nil {
+			return false, err
+		}
+		name, add, err := load(n64)
+		if err == auth.ErrUserNotExist || err == auth.ErrRoleNotExist {
+			// Deleted since the query
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if q.Match(auth.ListKey{ID: int64(n64), Name: name}) {
+			add()
+			n++
+		}
+		return n < q.Limit, nil
+	})
+}
+
+// *-* Helpers *-*
+
+// nextID returns id, or a new ID from the sequence of the entities if id is 0. The sequence is
+// moved past preset IDs, so that generated IDs do not collide with them, and never goes back, so
+// the IDs of deleted entities are not reused.
+func (s *Store) nextID(ctx context.Context, entities string, id int64) (int64, error) {
+	names := map[string]string{"#n": "n"}
+	if id != 0 {
+		_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(s.table),
+			Key:                       itemKey(pkSequences, entities),
+			UpdateExpression:          aws.String("SET #n = :id"),
+			ConditionExpression:       aws.String("attribute_not_exists(#n) OR #n < :id"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: map[string]types.AttributeValue{":id": num(id)},
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// Past it already
+			err = nil
+		}
+		return id, err
+	}
+	out, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       itemKey(pkSequences, entities),
+		UpdateExpression:          aws.String("ADD #n :one"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: map[string]types.AttributeValue{":one": num(1)},
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return getN(out.Attributes, "n"), nil
+}
+
+// get reads an item, with a strongly consistent read. It gives nil if the item does not exist.
+func (s *Store) get(ctx context.Context, pk, sk string) (map[string]types.AttributeValue, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            itemKey(pk, sk),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// getDoc reads the JSON document of an item into v.
+//
+// Returns: the item
+// Errors: errNotExist, or any error from DynamoDB
+func (s *Store) getDoc(ctx context.Context, pk, sk string, v interface{}, errNotExist error) (map[string]types.AttributeValue, error) {
+	item, err := s.get(ctx, pk, sk)
+	if err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, errNotExist
+	}
+	return item, json.Unmarshal([]byte(getS(item, "doc")), v)
+}
+
+func (s *Store) exists(ctx context.Context, pk, sk string) (bool, error) {
+	item, err := s.get(ctx, pk, sk)
+	return item != nil, err
+}
+
+// batchGet reads the items of a partition with the given sort keys, in any order, leaving out those
+// that do not exist.
+func (s *Store) batchGet(ctx context.Context, pk string, sks []string) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for len(sks) > 0 {
+		// BatchGetItem takes up to 100 keys
+		n := len(sks)
+		if n > 100 {
+			n = 100
+		}
+		keys := make([]map[string]types.AttributeValue, n)
+		for i, sk := range sks[:n] {
+			keys[i] = itemKey(pk, sk)
+		}
+		sks = sks[n:]
+		req := map[string]types.KeysAndAttributes{s.table: {Keys: keys, ConsistentRead: aws.Bool(true)}}
+		for len(req) > 0 {
+			out, err := s.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: req})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, out.Responses[s.table]...)
+			// Keys left out when throttled or over the size of a response
+			req = out.UnprocessedKeys
+		}
+	}
+	return items, nil
+}
+
+// query calls fn with the items of a partition, those whose sort keys start with prefix if not
+// empty, and come strictly after after if not nil, in sort key order (or the reverse), until it
+// returns false.
+func (s *Store) query(ctx context.Context, pk, prefix string, after *string, desc bool, fn func(item map[string]types.AttributeValue) (bool, error)) error {
+	in := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pk": str(pk)},
+		ScanIndexForward:          aws.Bool(!desc),
+		ConsistentRead:            aws.Bool(true),
+	}
+	if prefix != "" {
+		in.KeyConditionExpression = aws.String("pk = :pk AND begins_with(sk, :prefix)")
+		in.ExpressionAttributeValues[":prefix"] = str(prefix)
+	}
+	if after != nil {
+		in.ExclusiveStartKey = itemKey(pk, *after)
+	}
+	for {
+		out, err := s.client.Query(ctx, in)
+		if err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			if more, err := fn(item); err != nil || !more {
+				return err
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// transact runs a transaction.
+//
+// Returns: which items failed their condition, if the transaction was canceled
+func (s *Store) transact(ctx context.Context, items []types.TransactWriteItem) (map[int]bool, error) {
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return nil, err
+	}
+	failed := make(map[int]bool)
+	for i, r := range tce.CancellationReasons {
+		if aws.ToString(r.Code) == "ConditionalCheckFailed" {
+			failed[i] = true
+		}
+	}
+	return failed, tce
+}
+
+// isConflict tells if a transaction was canceled by another write, having changed the revision of
+// an item or run at the same time, so that it can be retried.
+func isConflict(err error) bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return false
+	}
+	for i, r := range tce.CancellationReasons {
+		switch aws.ToString(r.Code) {
+		case "TransactionConflict":
+			return true
+		case "ConditionalCheckFailed":
+			// Revisions are checked on the first item only
+			return i == 0
+		}
+	}
+	return false
+}
+
+// putItem writes an item. rev is the revision of the item read before, or 0 for a new item, which
+// must not exist; a rev of -1 writes the item regardless.
+func (s *Store) putItem(pk, sk string, rev int64, attrs map[string]types.AttributeValue) types.TransactWriteItem {
+	item := itemKey(pk, sk)
+	for k, v := range attrs {
+		item[k] = v
+	}
+	put := &types.Put{TableName: aws.String(s.table), Item: item}
+	switch {
+	case rev == 0:
+		item["rev"] = num(1)
+		put.ConditionExpression = aws.String("attribute_not_exists(pk)")
+	case rev > 0:
+		item["rev"] = num(rev + 1)
+		put.ConditionExpression = aws.String("rev = :rev")
+		put.ExpressionAttributeValues = map[string]types.AttributeValue{":rev": num(rev)}
+	}
+	return types.TransactWriteItem{Put: put}
+}
+
+// deleteItem removes an item. rev, if positive, is the revision of the item read before.
+func (s *Store) deleteItem(pk, sk string, rev int64) types.TransactWriteItem {
+	del := &types.Delete{TableName: aws.String(s.table), Key: itemKey(pk, sk)}
+	if rev > 0 {
+		del.ConditionExpression = aws.String("rev = :rev")
+		del.ExpressionAttributeValues = map[string]types.AttributeValue{":rev": num(rev)}
+	}
+	return types.TransactWriteItem{Delete: del}
+}
+
+// deleteKeys removes an index item on its own.
+func (s *Store) deleteKeys(ctx context.Context, pk, sk string) error {
+	_, err := s.transact(ctx, []types.TransactWriteItem{s.deleteItem(pk, sk, 0)})
+	return err
+}
+
+func itemKey(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"pk": str(pk), "sk": str(sk)}
+}
+
+func holdersKey(role auth.RoleID) string {
+	return pkHolders + fmt.Sprintf(roleIDFormat, uint32(role))
+}
+
+func membersKey(group auth.GroupID) string {
+	return pkMembers + fmt.Sprintf(roleIDFormat, uint32(group))
+}
+
+func userTokensKey(user auth.UserID) string {
+	return pkUserTokens + fmt.Sprintf(userIDFormat, uint64(user))
+}
+
+func roleSKs(roles []auth.RoleID) []string {
+	sks := make([]string, len(roles))
+	for i, role := range roles {
+		sks[i] = fmt.Sprintf(roleIDFormat, uint32(role))
+	}
+	return sks
+}
+
+// groupSet gives the groups listed, without duplicates, which would write an item twice.
+func groupSet(groups []auth.GroupID) []auth.GroupID {
+	seen := make(map[auth.GroupID]bool, len(groups))
+	var set []auth.GroupID
+	for _, group := range groups {
+		if !seen[group] {
+			seen[group] = true
+			set = append(set, group)
+		}
+	}
+	return set
+}
+
+func str(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+func num(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func getS(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func getN(item map[string]types.AttributeValue, name string) int64 {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+	return 0
+}
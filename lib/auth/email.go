@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// defaultEmailVerificationTTL is the EmailVerificationSec if not set.
+const defaultEmailVerificationTTL = time.Hour
+
+var (
+	ErrInvalidEmail     = newError("invalid_email", http.StatusBadRequest, "invalid email address")
+	ErrEmailExists      = newError("email_exists", http.StatusConflict, "email address already in use")
+	ErrEmailNotVerified = newError("email_not_verified", http.StatusForbidden, "email address not verified")
+)
+
+// SetUserEmail sets the email address of a user, or removes it if email is empty. Addresses are
+// unique among users, including soft-deleted ones, and compared regardless of case: they are saved
+// in lower case. A new address is not verified, see RequestEmailVerification. Setting the same
+// address again is a no-op.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrInvalidEmail if it is not a plain address (like "anna@example.com"),
+// ErrEmailExists
+func (s *Server) SetUserEmail(user UserID, email string) (err error) {
+	s, sp := s.trace("auth.SetUserEmail")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	if email != "" {
+		var ok bool
+		if email, ok = normalizeEmail(email); !ok {
+			return ErrInvalidEmail
+		}
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil || userObj.Email == email {
+		return err
+	}
+	if email != "" {
+		if _, err := s.userByEmail(ctx, email); err == nil {
+			return ErrEmailExists
+		} else if err != ErrUserNotExist {
+			return err
+		}
+	}
+	userObj = userObj.clone()
+	userObj.Email = email
+	userObj.EmailVerified = false
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// GetUserByEmail finds the user with an email address, regardless of case, like GetUserByName.
+func (s *Server) GetUserByEmail(email string) *User {
+	email, ok := normalizeEmail(email)
+	if !ok {
+		return nil
+	}
+	u, err := s.userByEmail(s.ctx, email)
+	if err != nil || u.Deleted != nil {
+		return nil
+	}
+	return u.clone()
+}
+
+// RequestEmailVerification issues a single-use token proving that its holder received it at the
+// email address of a user, for the caller to send, e.g. in a link. It expires after
+// ServerConfig.EmailVerificationSec, and whenever the address changes. Earlier tokens stay valid
+// until then.
+//
+// Returns: the token string
+// Errors: ErrUserNotExist, ErrInvalidEmail if the user has no address, ErrTooManyTokens, ErrInternal
+func (s *Server) RequestEmailVerification(user UserID) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.RequestEmailVerification")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if userObj.Email == "" {
+		return "", ErrInvalidEmail
+	}
+	t, err := s.newOneTimeToken(userObj, TokenEmailVerification, s.emailVerificationTTL())
+	if err != nil {
+		return "", err
+	}
+	t.Email = userObj.Email
+	if err := s.store.InsertToken(ctx, t); err != nil {
+		return "", err
+	}
+	return t.Value, nil
+}
+
+// VerifyEmail marks the email address of a user as verified, with a token of
+// RequestEmailVerification, and emits an email.verified event. The token can only be used once.
+//
+// Returns: the ID of the user
+// Errors: ErrInvalidToken if the token is unknown, expired, or for another address than that of
+// the user
+func (s *Server) VerifyEmail(token TokenValue) (_ UserID, err error) {
+	s, sp := s.trace("auth.VerifyEmail")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenObj, userObj, err := s.useOneTimeToken(ctx, token, TokenEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.store.DeleteToken(ctx, token); err != nil {
+		return 0, err
+	}
+	if tokenObj.Email != userObj.Email {
+		return 0, ErrInvalidToken
+	}
+	s.traceUser(userObj.ID)
+	if !userObj.EmailVerified {
+		userObj = userObj.clone()
+		userObj.EmailVerified = true
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return 0, err
+		}
+	}
+	s.emit(Event{Type: EventEmailVerified, User: userObj.ID, Name: userObj.Name})
+	return userObj.ID, nil
+}
+
+// normalizeEmail checks that email is a plain address, and lowers its case.
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", false
+	}
+	return strings.ToLower(email), true
+}
+
+// userByEmail looks up a normalized email with the EmailFinder of the store, or by listing the
+// users otherwise. The caller must hold s.mu when the result decides on a write.
+func (s *Server) userByEmail(ctx context.Context, email string) (*User, error) {
+	if f, ok := s.baseStore().(EmailFinder); ok {
+		u, err := f.GetUserByEmail(ctx, email)
+		return s.openUser(ctx, u, err)
+	}
+	q := &ListQuery{Limit: MaxListLimit}
+	for {
+		list, err := s.store.ListUsers(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range list {
+			if u.Email == email {
+				return u, nil
+			}
+		}
+		if len(list) < q.Limit {
+			return nil, ErrUserNotExist
+		}
+		last := list[len(list)-1]
+		q.After = &ListKey{ID: int64(last.ID), Name: last.Name}
+	}
+}
+
+// emailVerificationTTL is ServerConfig.EmailVerificationSec, or its default, within the lifetime of
+// session tokens, which keeps the tokens safe from pruning.
+func (s *Server) emailVerificationTTL() time.Duration {
+	ttl := defaultEmailVerificationTTL
+	if s.cfg.EmailVerificationSec > 0 {
+		ttl = time.Duration(s.cfg.EmailVerificationSec) * time.Second
+	}
+	if max := time.Duration(s.tokenLifetimeSec()) * time.Second; ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// newOneTimeToken creates a token of a kind that is used up by useOneTimeToken, queued for pruning.
+// Its value is URL-safe, to fit in links.
+func (s *Server) newOneTimeToken(u *User, kind TokenKind, ttl time.Duration) (*Token, error) {
+	v, err := s.newTokenValue()
+	if err != nil {
+		return nil, ErrInternal
+	}
+	now := s.now()
+	t := Token{
+		Value:   v,
+		Kind:    kind,
+		User:    u.ID,
+		Issued:  now,
+		Expires: now.Add(ttl),
+	}
+	if err := s.addToTokenQueue(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// useOneTimeToken checks a token of newOneTimeToken, and gives it with its user. Expired tokens,
+// and those of users gone, are deleted. The caller must hold s.mu, and delete the token once used.
+//
+// Errors: ErrInvalidToken
+func (s *Server) useOneTimeToken(ctx context.Context, token TokenValue, kind TokenKind) (*Token, *User, error) {
+	tokenObj, err := s.store.GetToken(ctx, token)
+	if err == ErrInvalidToken || (err == nil && tokenObj.Kind != kind) {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if s.now().After(tokenObj.Expires) {
+		_ = s.store.DeleteToken(ctx, token)
+		return nil, nil, ErrInvalidToken
+	}
+	userObj, err := s.getUser(ctx, tokenObj.User)
+	if err == ErrUserNotExist {
+		_ = s.store.DeleteToken(ctx, token)
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return tokenObj, userObj, nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listOnlyStorage hides the EmailFinder of a MemoryStorage.
+type listOnlyStorage struct{ Storage }
+
+func TestUserEmail(t *testing.T) {
+	for _, store := range []Storage{NewMemoryStorage(), listOnlyStorage{NewMemoryStorage()}} {
+		svr, _ := New(WithStorage(store), WithHasher(fastHasher))
+		anna, _ := svr.CreateUser("anna", "passw0rd")
+		elton, _ := svr.CreateUser("elton", "123456")
+		{
+			for _, bad := range []string{"anna", "Anna <anna@example.com>", "anna@"} {
+				assert.Equal(t, ErrInvalidEmail, svr.SetUserEmail(anna, bad), "should check the address")
+			}
+			assert.Equal(t, ErrUserNotExist, svr.SetUserEmail(elton+1, "x@example.com"), "should check the user")
+			assert.Equal(t, nil, svr.SetUserEmail(anna, " Anna@Example.com"), "should success")
+			assert.Equal(t, "anna@example.com", svr.GetUser(anna).Email, "should lower the case")
+			assert.Equal(t, ErrEmailExists, svr.SetUserEmail(elton, "ANNA@example.com"), "should keep addresses unique")
+			assert.Equal(t, anna, svr.GetUserByEmail("anna@EXAMPLE.com").ID, "should find users by email")
+			assert.Equal(t, (*User)(nil), svr.GetUserByEmail("elton@example.com"), "should give nil for unknown addresses")
+		}
+		{
+			assert.Equal(t, nil, svr.SetUserEmail(anna, ""), "should remove the address")
+			assert.Equal(t, nil, svr.SetUserEmail(elton, "anna@example.com"), "should free removed addresses")
+			assert.Equal(t, "", svr.GetUser(anna).Email, "should forget the address")
+		}
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, RequireVerifiedEmail: true}), WithClock(clock), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("elton", "123456")
+	next, cancel := collect(svr, EventEmailVerified)
+	defer cancel()
+	{
+		_, err := svr.RequestEmailVerification(uid)
+		assert.Equal(t, ErrInvalidEmail, err, "should need an address")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrEmailNotVerified, err, "should require a verified address")
+		_, err = svr.Authenticate("elton", "wrong")
+		assert.Equal(t, ErrInvalidAuth, err, "should check the password first")
+	}
+	{
+		svr.SetUserEmail(uid, "elton@example.com")
+		token, err := svr.RequestEmailVerification(uid)
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.CheckRole(token, 1)
+		assert.Equal(t, ErrInvalidToken, err, "should not be a session token")
+		_, err = svr.VerifyEmail("wrong")
+		assert.Equal(t, ErrInvalidToken, err, "should check the token")
+		id, err := svr.VerifyEmail(token)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, uid, id, "should tell the user")
+		assert.Equal(t, true, svr.GetUser(uid).EmailVerified, "should verify the address")
+		assert.Equal(t, uid, next(1)[0].User, "should emit email.verified")
+		_, err = svr.VerifyEmail(token)
+		assert.Equal(t, ErrInvalidToken, err, "should only be used once")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should accept verified addresses")
+	}
+	{
+		token, _ := svr.RequestEmailVerification(uid)
+		svr.SetUserEmail(uid, "elton@example.org")
+		assert.Equal(t, false, svr.GetUser(uid).EmailVerified, "should not verify new addresses")
+		_, err := svr.VerifyEmail(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not verify another address")
+
+		token, _ = svr.RequestEmailVerification(uid)
+		clock.Advance(time.Hour + time.Second)
+		_, err = svr.VerifyEmail(token)
+		assert.Equal(t, ErrInvalidToken, err, "should expire")
+	}
+}
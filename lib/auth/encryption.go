@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KeyProvider holds the master key of the envelope encryption of ServerConfig.KeyProvider: secrets
+// are encrypted with data keys, which are stored next to them wrapped (encrypted) by the master key,
+// so that the master key never leaves the provider, such as a KMS. See LocalKeyProvider, and
+// lib/awskms and lib/vault.
+type KeyProvider interface {
+	// GenerateDataKey makes a new 256-bit data key, in the clear and wrapped by the master key.
+	GenerateDataKey(ctx context.Context) (key, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key made by GenerateDataKey.
+	DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// SealedSecrets are the secrets of a user encrypted at rest, see ServerConfig.KeyProvider.
+type SealedSecrets struct {
+	Key  []byte // the data key, wrapped by the KeyProvider
+	Data []byte // the nonce, then the secrets sealed with AES-256-GCM
+}
+
+func (s *SealedSecrets) clone() *SealedSecrets {
+	if s == nil {
+		return nil
+	}
+	return &SealedSecrets{Key: append([]byte(nil), s.Key...), Data: append([]byte(nil), s.Data...)}
+}
+
+var ErrDecrypt = newError("decrypt", http.StatusInternalServerError, "cannot decrypt secrets")
+
+const (
+	dataKeyBytes = 32
+	// maxSeals is how many secrets a data key seals before a new one is made, well below the 2^32
+	// random nonces that AES-GCM allows per key
+	maxSeals = 1 << 24
+)
+
+// *-* Local keys *-*
+
+// LocalKeyProvider is a KeyProvider holding the master key in memory, e.g. read from a file by
+// LoadKeyFile, for deployments without a KMS. Data keys are wrapped with AES-256-GCM.
+type LocalKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyProvider creates a LocalKeyProvider with a 256-bit master key.
+//
+// Returns: pointer to the new provider
+// Errors: ErrInvalidConfig
+func NewLocalKeyProvider(key []byte) (*LocalKeyProvider, error) {
+	if len(key) != dataKeyBytes {
+		return nil, ErrInvalidConfig
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, ErrInvalidConfig
+	}
+	return &LocalKeyProvider{aead: aead}, nil
+}
+
+// LoadKeyFile creates a LocalKeyProvider with the master key in a file, written in base64, e.g. by
+// "openssl rand -base64 32". The file should only be readable by the server.
+//
+// Returns: pointer to the new provider
+// Errors: ErrInvalidConfig, any error from reading the file
+func LoadKeyFile(path string) (*LocalKeyProvider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, ErrInvalidConfig
+	}
+	return NewLocalKeyProvider(key)
+}
+
+func (p *LocalKeyProvider) GenerateDataKey(context.Context) ([]byte, []byte, error) {
+	key := make([]byte, dataKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(p.aead, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+func (p *LocalKeyProvider) DecryptDataKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	return open(p.aead, wrapped, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with a random nonce, which comes first in the result.
+func seal(aead cipher.AEAD, plain, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, data), nil
+}
+
+// open decrypts the result of seal.
+//
+// Errors: ErrDecrypt
+func open(aead cipher.AEAD, sealed, data []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, sealed[:n], sealed[n:], data)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// *-* Storage *-*
+
+// secrets are the fields of a user encrypted at rest.
+type secrets struct {
+	Password []byte            `json:"password,omitempty"`
+	TOTP     []byte            `json:"totp,omitempty"`
+	Recovery [][]byte          `json:"recovery,omitempty"`
+	APIKeys  map[string][]byte `json:"api_keys,omitempty"` // hashes by ID
+}
+
+// takeSecrets moves the secrets of a user to a secrets.
+func takeSecrets(u *User) *secrets {
+	sec := &secrets{Password: u.Secret}
+	u.Secret = nil
+	if u.TOTP != nil {
+		sec.TOTP, sec.Recovery = u.TOTP.Secret, u.TOTP.RecoveryCodes
+		u.TOTP.Secret, u.TOTP.RecoveryCodes = nil, nil
+	}
+	for id, k := range u.APIKeys {
+		if sec.APIKeys == nil {
+			sec.APIKeys = make(map[string][]byte, len(u.APIKeys))
+		}
+		sec.APIKeys[id] = k.Hash
+		k.Hash = nil
+	}
+	return sec
+}
+
+// restore puts the secrets back in their user.
+func (sec *secrets) restore(u *User) {
+	u.Secret = sec.Password
+	if u.TOTP != nil {
+		u.TOTP.Secret, u.TOTP.RecoveryCodes = sec.TOTP, sec.Recovery
+	}
+	for id, hash := range sec.APIKeys {
+		if k := u.APIKeys[id]; k != nil {
+			k.Hash = hash
+		}
+	}
+}
+
+func (sec *secrets) empty() bool {
+	return len(sec.Password) == 0 && len(sec.TOTP) == 0 && len(sec.Recovery) == 0 && len(sec.APIKeys) == 0
+}
+
+// cryptStore encrypts the secrets of users at rest for ServerConfig.KeyProvider: they are moved to
+// User.Sealed when written, and back when read. Users read without Sealed are given as they are.
+type cryptStore struct {
+	Storage
+	provider KeyProvider
+
+	mu sync.Mutex
+	// The data key sealing new secrets, made on first use, how many more it may seal, and the
+	// unwrapped data keys by wrapped key
+	current *dataKey
+	seals   int
+	keys    map[string]cipher.AEAD
+}
+
+type dataKey struct {
+	wrapped []byte
+	aead    cipher.AEAD
+}
+
+func newCryptStore(store Storage, provider KeyProvider) *cryptStore {
+	return &cryptStore{Storage: store, provider: provider, keys: make(map[string]cipher.AEAD)}
+}
+
+// userData binds sealed secrets to their user, so that they cannot be moved to another one. It is
+// the name, as the storage may only give an ID on insertion.
+func userData(u *User) []byte {
+	return []byte(u.Name)
+}
+
+// dataKey gives the data key to seal secrets with, making a new one if needed.
+func (c *cryptStore) dataKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil || c.seals == 0 {
+		key, wrapped, err := c.provider.GenerateDataKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		c.current, c.seals = &dataKey{wrapped: wrapped, aead: aead}, maxSeals
+		c.keys[string(wrapped)] = aead
+	}
+	c.seals--
+	return c.current, nil
+}
+
+// unwrap gives the AEAD of a wrapped data key, asking the provider the first time.
+func (c *cryptStore) unwrap(ctx context.Context, wrapped []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	aead, ok := c.keys[string(wrapped)]
+	c.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := c.provider.DecryptDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, ErrDecrypt
+	}
+	c.mu.Lock()
+	c.keys[string(wrapped)] = aead
+	c.mu.Unlock()
+	return aead, nil
+}
+
+// seal gives a copy of a user with its secrets sealed. Users that are sealed already are given as
+// they are.
+func (c *cryptStore) seal(ctx context.Context, u *User) (*User, error) {
+	if u.Sealed != nil {
+		return u, nil
+	}
+	u = u.clone()
+	sec := takeSecrets(u)
+	if sec.empty() {
+		return u, nil
+	}
+	plain, err := json.Marshal(sec)
+	if err != nil {
+		return nil, err
+	}
+	k, err := c.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := seal(k.aead, plain, userData(u))
+	if err != nil {
+		return nil, err
+	}
+	u.Sealed = &SealedSecrets{Key: k.wrapped, Data: data}
+	return u, nil
+}
+
+// open gives a copy of a user with its secrets decrypted, or the user itself if they are not
+// sealed.
+//
+// Errors: ErrDecrypt, any error from the provider
+func (c *cryptStore) open(ctx context.Context, u *User) (*User, error) {
+	if u == nil || u.Sealed == nil {
+		return u, nil
+	}
+	aead, err := c.unwrap(ctx, u.Sealed.Key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := open(aead, u.Sealed.Data, userData(u))
+	if err != nil {
+		return nil, err
+	}
+	var sec secrets
+	if err := json.Unmarshal(plain, &sec); err != nil {
+		return nil, ErrDecrypt
+	}
+	u = u.clone()
+	u.Sealed = nil
+	sec.restore(u)
+	return u, nil
+}
+
+func (c *cryptStore) InsertUser(ctx context.Context, u *User) error {
+	sealed, err := c.seal(ctx, u)
+	if err != nil {
+		return err
+	}
+	if err := c.Storage.InsertUser(ctx, sealed); err != nil {
+		return err
+	}
+	// The storage may assign the ID
+	u.ID = sealed.ID
+	return nil
+}
+
+func (c *cryptStore) UpdateUser(ctx context.Context, u *User) error {
+	sealed, err := c.seal(ctx, u)
+	if err != nil {
+		return err
+	}
+	return c.Storage.UpdateUser(ctx, sealed)
+}
+
+func (c *cryptStore) GetUser(ctx context.Context, id UserID) (*User, error) {
+	u, err := c.Storage.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(ctx, u)
+}
+
+func (c *cryptStore) GetUserByName(ctx context.Context, name string) (*User, error) {
+	u, err := c.Storage.GetUserByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(ctx, u)
+}
+
+func (c *cryptStore) ListUsers(ctx context.Context, q *ListQuery) ([]*User, error) {
+	list, err := c.Storage.ListUsers(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range list {
+		if list[i], err = c.open(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// openUser decrypts a user read from the storage given to NewServer, bypassing s.store, e.g.
+// through an optional interface.
+func (s *Server) openUser(ctx context.Context, u *User, err error) (*User, error) {
+	if err != nil {
+		return nil, err
+	}
+	if s.crypt == nil {
+		return u, nil
+	}
+	return s.crypt.open(ctx, u)
+}
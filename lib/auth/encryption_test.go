@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newKeyProvider makes a LocalKeyProvider with a master key made of b.
+func newKeyProvider(b byte) *LocalKeyProvider {
+	p, _ := NewLocalKeyProvider(bytes.Repeat([]byte{b}, 32))
+	return p
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	ctx := context.Background()
+	{
+		_, err := NewLocalKeyProvider(make([]byte, 16))
+		assert.Equal(t, ErrInvalidConfig, err, "should require a 256-bit key")
+	}
+	{
+		path := filepath.Join(t.TempDir(), "master.key")
+		os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0o600)
+		p, err := LoadKeyFile(path)
+		assert.Equal(t, nil, err, "should success")
+		key, wrapped, _ := p.GenerateDataKey(ctx)
+		assert.Equal(t, 32, len(key), "should make 256-bit data keys")
+		assert.NotContains(t, string(wrapped), string(key), "should wrap the data key")
+		unwrapped, err := newKeyProvider(1).DecryptDataKey(ctx, wrapped)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, key, unwrapped, "should unwrap with the same master key")
+		_, err = newKeyProvider(2).DecryptDataKey(ctx, wrapped)
+		assert.Equal(t, ErrDecrypt, err, "should not unwrap with another master key")
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	store := NewMemoryStorage()
+	cfg := &ServerConfig{TokenExpireSec: 60, KeyProvider: newKeyProvider(1)}
+	svr, _ := New(WithConfig(cfg), WithStorage(store), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	e, _ := svr.EnrollTOTP(uid)
+	secret, _ := totpEncoding.DecodeString(e.Secret)
+	svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod))
+	key, _ := svr.CreateAPIKey(uid, "ci", nil, time.Time{})
+	ctx := context.Background()
+	{
+		raw, _ := store.GetUser(ctx, uid)
+		assert.Equal(t, 0, len(raw.Secret), "should not store the password hash")
+		assert.Equal(t, 0, len(raw.TOTP.Secret), "should not store the TOTP secret")
+		assert.Equal(t, 0, len(raw.TOTP.RecoveryCodes), "should not store the recovery codes")
+		for _, k := range raw.APIKeys {
+			assert.Equal(t, 0, len(k.Hash), "should not store the hashes of API keys")
+		}
+		assert.NotEqual(t, (*SealedSecrets)(nil), raw.Sealed, "should store the secrets sealed")
+		u := svr.GetUser(uid)
+		assert.Equal(t, (*SealedSecrets)(nil), u.Sealed, "should decrypt the secrets")
+		assert.NotEqual(t, 0, len(u.Secret), "should decrypt the password hash")
+		assert.NotContains(t, string(raw.Sealed.Data), string(u.Secret), "should encrypt the password hash")
+
+		var snapshot bytes.Buffer
+		svr.Save(&snapshot, false)
+		assert.NotContains(t, snapshot.String(), e.Secret, "should encrypt snapshots")
+	}
+	{
+		_, err := svr.TokenUser(key)
+		assert.Equal(t, nil, err, "should verify API keys")
+		challenge, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrMFARequired, err, "should verify passwords")
+		_, err = svr.CompleteMFA(challenge, e.RecoveryCodes[0])
+		assert.Equal(t, nil, err, "should verify recovery codes")
+	}
+	{
+		other, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, KeyProvider: newKeyProvider(2)}), WithStorage(store), WithHasher(fastHasher))
+		_, err := other.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrDecrypt, err, "should not decrypt with another master key")
+	}
+	{
+		eid, _ := svr.CreateUser("elton", "123456")
+		anna, _ := store.GetUser(ctx, uid)
+		elton, _ := store.GetUser(ctx, eid)
+		elton = elton.clone()
+		elton.Sealed = anna.Sealed.clone()
+		store.UpdateUser(ctx, elton)
+		assert.Equal(t, (*User)(nil), svr.GetUser(eid), "should not decrypt the secrets of another user")
+	}
+}
+
+func TestEncryptionMigration(t *testing.T) {
+	store := NewMemoryStorage()
+	plain, _ := New(WithStorage(store), WithHasher(fastHasher))
+	uid, _ := plain.CreateUser("anna", "passw0rd")
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, KeyProvider: newKeyProvider(1)}), WithStorage(store), WithHasher(fastHasher))
+	_, err := svr.Authenticate("anna", "passw0rd")
+	assert.Equal(t, nil, err, "should read the users saved in the clear")
+	rid, _ := svr.CreateRole("clerk")
+	svr.AddRoleToUser(uid, rid)
+	raw, _ := store.GetUser(context.Background(), uid)
+	assert.NotEqual(t, (*SealedSecrets)(nil), raw.Sealed, "should seal the secrets when next updated")
+	_, err = svr.Authenticate("anna", "passw0rd")
+	assert.Equal(t, nil, err, "should success")
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AuthError is the type of the errors of the package, such as ErrUserNotExist. Besides its message,
+// it has a Code that does not change across versions, for clients to tell errors apart, and the
+// HTTP status that APIs answer it with, so that the REST API, the middleware and other layers such
+// as gRPC map errors the same way.
+//
+// The errors are compared as before, with == or errors.Is, e.g. errors.Is(err, ErrUserNotExist).
+// A copy made by WithDetail is not == to the error, but matches it with errors.Is.
+type AuthError struct {
+	// Code is machine-readable, in snake case, e.g. "user_not_exist"
+	Code string
+	// Status is the HTTP status of the error, e.g. http.StatusNotFound
+	Status int
+	// Message is the text of the error, for humans, e.g. "user does not exist"
+	Message string
+	// Detail, if set, tells more about this occurrence of the error, e.g. the requirements of the
+	// password policy that a password misses
+	Detail string
+
+	base *AuthError // the error that WithDetail copied, or nil
+}
+
+// NewError creates an error with a code, an HTTP status and a message, for other packages to
+// define errors like those of this package.
+//
+// Returns: the new error
+func NewError(code string, status int, message string) *AuthError {
+	return &AuthError{Code: code, Status: status, Message: message}
+}
+
+func (e *AuthError) Error() string {
+	if e.Detail != "" {
+		return e.Message + ": " + e.Detail
+	}
+	return e.Message
+}
+
+// Unwrap returns the error that WithDetail copied, for errors.Is.
+func (e *AuthError) Unwrap() error {
+	if e.base == nil {
+		return nil
+	}
+	return e.base
+}
+
+// WithDetail returns a copy of the error with a detail, which matches the error with errors.Is.
+//
+// Returns: the copy
+func (e *AuthError) WithDetail(detail string) *AuthError {
+	c := *e
+	c.Detail = detail
+	c.base = e.sentinel()
+	return &c
+}
+
+// sentinel returns the error that e is a copy of, or e.
+func (e *AuthError) sentinel() *AuthError {
+	if e.base != nil {
+		return e.base
+	}
+	return e
+}
+
+// ErrorCode tells the Code of an error, also when it wraps an AuthError.
+//
+// Returns: the code, "" for nil and "internal" for errors that are not AuthErrors, such as those
+// of the storage
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *AuthError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrInternal.(*AuthError).Code
+}
+
+// HTTPStatus tells the HTTP status of an error, also when it wraps an AuthError.
+//
+// Returns: the status, http.StatusOK for nil and http.StatusInternalServerError for errors that are
+// not AuthErrors, such as those of the storage
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var e *AuthError
+	if errors.As(err, &e) {
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// newError is NewError for the errors of the package, which are declared as error.
+func newError(code string, status int, message string) error {
+	return NewError(code, status, message)
+}
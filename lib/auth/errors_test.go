@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthError(t *testing.T) {
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		_, err := svr.TokenUser("nope")
+		assert.Equal(t, ErrInvalidToken, err, "should still return the sentinels")
+		assert.Equal(t, "invalid_token", ErrorCode(err), "should tell the code")
+		assert.Equal(t, http.StatusUnauthorized, HTTPStatus(err), "should tell the status")
+		assert.Equal(t, "invalid auth token", err.Error(), "should keep the message")
+	}
+	{
+		err := ErrWeakPassword.(*AuthError).WithDetail("at least 12 characters")
+		assert.Equal(t, "password does not match requirements: at least 12 characters", err.Error(), "should tell the detail")
+		assert.Equal(t, true, errors.Is(err, ErrWeakPassword), "should match the sentinel")
+		assert.Equal(t, false, errors.Is(err, ErrInvalidAuth), "should not match other errors")
+		assert.Equal(t, "weak_password", ErrorCode(err), "should keep the code")
+		assert.Equal(t, true, errors.Is(err.WithDetail("again"), ErrWeakPassword), "should match through copies")
+		assert.Equal(t, "", ErrWeakPassword.(*AuthError).Detail, "should not change the sentinel")
+		assert.Equal(t, "invalid_argument", ErrorClass(err), "should classify the copy like the sentinel")
+	}
+	{
+		err := fmt.Errorf("loading alice: %w", ErrUserNotExist)
+		assert.Equal(t, "user_not_exist", ErrorCode(err), "should find wrapped errors")
+		assert.Equal(t, http.StatusNotFound, HTTPStatus(err), "should find wrapped errors")
+	}
+	{
+		err := errors.New("disk full")
+		assert.Equal(t, "internal", ErrorCode(err), "should hide other errors")
+		assert.Equal(t, http.StatusInternalServerError, HTTPStatus(err), "should hide other errors")
+		assert.Equal(t, "", ErrorCode(nil), "should have no code for nil")
+		assert.Equal(t, http.StatusOK, HTTPStatus(nil), "should be OK for nil")
+	}
+	{
+		err := NewError("quota_exceeded", http.StatusTooManyRequests, "quota exceeded")
+		assert.Equal(t, http.StatusTooManyRequests, HTTPStatus(fmt.Errorf("%w", err)), "should support errors of other packages")
+	}
+}
@@ -0,0 +1,209 @@
+package etcdstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/storagetest"
+)
+
+// The tests run against an etcd server embedded in the test binary, or against a live cluster if
+// its endpoints are given, such as
+//
+//	ETCD_ENDPOINTS=localhost:2379
+//
+// Every test works under a prefix of its own, which is deleted afterwards.
+var testEndpoints []string
+
+func TestMain(m *testing.M) {
+	if endpoints := os.Getenv("ETCD_ENDPOINTS"); endpoints != "" {
+		testEndpoints = strings.Split(endpoints, ",")
+		os.Exit(m.Run())
+	}
+	dir, err := os.MkdirTemp("", "etcdstore")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	e, err := startEmbedded(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testEndpoints = []string{e.Clients[0].Addr().String()}
+	code := m.Run()
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startEmbedded starts a single-member etcd saving to dir, on free ports of the loopback
+// interface.
+func startEmbedded(dir string) (*embed.Etcd, error) {
+	local := []url.URL{{Scheme: "http", Host: "127.0.0.1:0"}}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	cfg.LCUrls, cfg.ACUrls, cfg.LPUrls, cfg.APUrls = local, local, local, local
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+		return e, nil
+	case <-time.After(time.Minute):
+		e.Close()
+		return nil, fmt.Errorf("embedded etcd not ready")
+	}
+}
+
+func testClient(t *testing.T) (*clientv3.Client, string) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: testEndpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("authtest/%s/%d/", t.Name(), time.Now().UnixNano())
+	t.Cleanup(func() {
+		_, _ = client.Delete(context.Background(), prefix, clientv3.WithPrefix())
+		client.Close()
+	})
+	return client, prefix
+}
+
+func testStore(t *testing.T, opts *Options) *Store {
+	client, prefix := testClient(t)
+	o := Options{Prefix: prefix}
+	if opts != nil {
+		o = *opts
+		o.Prefix = prefix
+	}
+	s, err := New(context.Background(), client, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+var testConfig = &auth.ServerConfig{TokenExpireSec: 60, DecisionCacheSec: 30, Hasher: &auth.BcryptHasher{Cost: 4}}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) auth.Storage {
+		return testStore(t, nil)
+	})
+}
+
+func TestConformanceCached(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) auth.Storage {
+		return testStore(t, &Options{CacheSize: 100})
+	})
+}
+
+func TestEtcdServer(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := testClient(t)
+	a, sa, err := NewEtcdServer(ctx, testConfig, client, &Options{Prefix: prefix})
+	assert.Equal(t, nil, err, "should success")
+	defer sa.Close()
+	b, sb, _ := NewEtcdServer(ctx, testConfig, client, &Options{Prefix: prefix, CacheSize: 100})
+	defer sb.Close()
+	uid, _ := a.CreateUser("elton", "123456")
+	rid, _ := a.CreateRole("scanner")
+	token, _ := a.Authenticate("elton", "123456")
+	{
+		ok, err := b.CheckRole(token, rid)
+		assert.Equal(t, nil, err, "should share the tokens")
+		assert.Equal(t, false, ok, "should not have the role")
+		a.AddRoleToUser(uid, rid)
+		assert.Eventually(t, func() bool {
+			ok, _ := b.CheckRole(token, rid)
+			return ok
+		}, 5*time.Second, 10*time.Millisecond, "should invalidate the decisions and the cache on the changes of other servers")
+		a.Invalidate(token)
+		assert.Eventually(t, func() bool {
+			_, err := b.CheckRole(token, rid)
+			return err == auth.ErrInvalidToken
+		}, 5*time.Second, 10*time.Millisecond, "should share the revocations of tokens")
+	}
+	{
+		_, err := client.Put(ctx, prefix+keyVersion, "2")
+		assert.Equal(t, nil, err, "should success")
+		_, err = New(ctx, client, &Options{Prefix: prefix})
+		assert.Equal(t, ErrSchemaTooNew, err, "should reject newer data")
+	}
+}
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	s := testStore(t, nil)
+	now := time.Now()
+	lease := func(v auth.TokenValue) (clientv3.LeaseID, int64) {
+		resp, _ := s.client.Get(ctx, s.prefix+keyTokens+string(v))
+		if len(resp.Kvs) == 0 {
+			return 0, 0
+		}
+		ttl, _ := s.client.TimeToLive(ctx, clientv3.LeaseID(resp.Kvs[0].Lease))
+		return clientv3.LeaseID(resp.Kvs[0].Lease), ttl.TTL
+	}
+	_ = s.InsertToken(ctx, &auth.Token{Value: "a", User: 1, Expires: now.Add(time.Hour)})
+	_ = s.InsertToken(ctx, &auth.Token{Value: "b", User: 1, Expires: now.Add(time.Hour + time.Second)})
+	_ = s.InsertToken(ctx, &auth.Token{Value: "c", User: 1, Expires: now.Add(-time.Hour)})
+	a, ttl := lease("a")
+	assert.Equal(t, true, ttl > int64((time.Hour+defaultLeaseGrace).Seconds()) && ttl <= int64((time.Hour+defaultLeaseGrace+leaseStep).Seconds()),
+		"should end the lease a grace period after the expiry")
+	b, _ := lease("b")
+	if time.Unix(now.Unix()+1, 0).Truncate(leaseStep) == time.Unix(now.Unix(), 0).Truncate(leaseStep) {
+		assert.Equal(t, a, b, "should share leases")
+	}
+	_, ttl = lease("c")
+	assert.Equal(t, true, ttl > 0 && ttl <= int64(2*leaseStep.Seconds()), "should keep expired tokens for a while")
+
+	_, _ = s.client.Revoke(ctx, a)
+	_, err := s.GetToken(ctx, "a")
+	assert.Equal(t, auth.ErrInvalidToken, err, "should remove the tokens at the end of their lease")
+	list, _ := s.UserTokens(ctx, 1)
+	assert.Equal(t, 1, len(list), "should remove the index entries at the end of the lease")
+	assert.Equal(t, nil, s.InsertToken(ctx, &auth.Token{Value: "d", User: 1, Expires: now.Add(time.Hour)}),
+		"should grant a new lease if the old one ended")
+}
+
+func TestDocCache(t *testing.T) {
+	c := newDocCache(2)
+	gen := c.generation()
+	c.put("a", []byte("1"), gen)
+	_, ok := c.get("a")
+	assert.Equal(t, false, ok, "should not cache without the watch")
+	c.setLive(true)
+	gen = c.generation()
+	c.drop("b")
+	c.put("a", []byte("1"), gen)
+	_, ok = c.get("a")
+	assert.Equal(t, false, ok, "should not cache values read before a change")
+	c.put("a", []byte("1"), c.generation())
+	v, ok := c.get("a")
+	assert.Equal(t, "1", string(v), "should cache values")
+	c.drop("a")
+	_, ok = c.get("a")
+	assert.Equal(t, false, ok, "should drop changed keys")
+	c.put("a", []byte("1"), c.generation())
+	c.put("b", []byte("2"), c.generation())
+	c.put("c", []byte("3"), c.generation())
+	_, ok = c.get("a")
+	assert.Equal(t, false, ok, "should empty the cache when full")
+	c.setLive(false)
+	_, ok = c.get("c")
+	assert.Equal(t, false, ok, "should empty the cache when the watch stops")
+}
@@ -0,0 +1,85 @@
+package etcdstore
+
+import "sync"
+
+// docCache keeps the values of keys read from etcd, see Options.CacheSize. A nil cache keeps
+// nothing.
+//
+// Entries are dropped by the watch as their keys change. gen counts the changes, so that a value
+// read before one is not cached after it, when the read and the event race. The cache is only used
+// while live, that is while the watch runs: changes are missed otherwise.
+type docCache struct {
+	size int
+
+	mu      sync.Mutex
+	gen     uint64
+	live    bool
+	entries map[string][]byte
+}
+
+func newDocCache(size int) *docCache {
+	return &docCache{size: size, entries: make(map[string][]byte)}
+}
+
+func (c *docCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	return v, ok
+}
+
+// generation tells the number of changes, to pass to put.
+func (c *docCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches a value read since generation gen. It is dropped if a key changed in between. A full
+// cache is emptied first.
+func (c *docCache) put(key string, v []byte, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || !c.live {
+		return
+	}
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string][]byte)
+	}
+	c.entries[key] = v
+}
+
+// drop forgets a key that changed.
+func (c *docCache) drop(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.entries, key)
+}
+
+// setLive empties the cache, and starts or stops caching. Values read before are not cached, as
+// the watch may not see the changes made since.
+func (c *docCache) setLive(live bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.live = live
+	if len(c.entries) > 0 {
+		c.entries = make(map[string][]byte)
+	}
+}
@@ -0,0 +1,1014 @@
+// Package etcdstore implements auth.Storage on top of etcd (go.etcd.io/etcd), for highly available
+// deployments, e.g. on Kubernetes, where several auth servers share their data through the etcd
+// cluster that replicates it.
+//
+// Each entity is saved as a JSON document under a key prefix, next to keys indexing the names, role
+// assignments, group memberships and tokens. Writes are atomic, and retried when they conflict with
+// another server, except that deleting a role or group then updates its users one at a time. Tokens are attached to etcd leases ending shortly after
+// they expire, so etcd removes them without a sweeper.
+//
+// The store watches its prefix. Every change, by any server, is passed to the functions given to
+// NotifyChanges; in particular, the servers using the store empty their decision caches (see
+// auth.ServerConfig.DecisionCacheSec). With Options.CacheSize, the documents read by key are also
+// cached, until the watch sees them change.
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Keys, after the prefix of the store
+const (
+	keyUsers      = "users/"       // ID -> userRecord
+	keyUserNames  = "user_names/"  // name -> ID
+	keyUserRoles  = "user_roles/"  // role ID/user ID -> nothing
+	keyUserGroups = "user_groups/" // group ID/user ID -> nothing
+	keyRoles      = "roles/"       // ID -> auth.Role
+	keyRoleNames  = "role_names/"
+	keyGroups     = "groups/" // ID -> auth.Group
+	keyGroupNames = "group_names/"
+	keyTokens     = "tokens/"       // value -> auth.Token
+	keyUserTokens = "user_tokens/"  // user ID/value -> nothing
+	keyExpiry     = "token_expiry/" // expiry (Unix nanoseconds)/value -> nothing
+	keySequences  = "sequences/"    // "users", "roles" or "groups" -> last ID
+	keyVersion    = "version"
+)
+
+// IDs are spelled in fixed-width hexadecimal, so that keys sort like IDs.
+const (
+	userIDFormat = "%016x"
+	roleIDFormat = "%08x"
+)
+
+// Options customizes a Store. The zero value is usable.
+type Options struct {
+	// Prefix is that of all the keys of the store, so that it can share a cluster. Defaults to
+	// "auth/".
+	Prefix string
+	// CacheSize, if positive, caches up to that many users, roles, groups and tokens read by key,
+	// saving a round trip to etcd for most reads of the server. Entries are dropped as soon as the
+	// watch sees them change, and all of them when the cache is full or the watch fails, e.g. when
+	// cut off from the etcd leader; the cache is not used until the watch is back.
+	CacheSize int
+	// LeaseGrace is how long tokens outlive their expiry in etcd, to allow for clock skew between
+	// the servers and etcd. Defaults to 1 minute.
+	LeaseGrace time.Duration
+}
+
+// Store is an auth.Storage backed by etcd.
+type Store struct {
+	client *clientv3.Client
+	prefix string
+	grace  time.Duration
+	cache  *docCache
+
+	leaseMu sync.Mutex
+	leases  map[int64]clientv3.LeaseID // by end, in Unix seconds
+
+	subMu sync.Mutex
+	subs  []func()
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var (
+	ErrSchemaTooNew = errors.New("data is newer than this version of the package")
+)
+
+// schemaVersion is saved under the prefix, to detect data written by a newer version.
+const schemaVersion = 1
+
+// defaultLeaseGrace is the LeaseGrace if not set.
+const defaultLeaseGrace = time.Minute
+
+// leaseStep is the granularity of the ends of leases. Tokens expiring within the same step share a
+// lease, rather than one lease per token.
+const leaseStep = time.Minute
+
+// New creates a Store on a connected client, and starts watching its prefix. The client is left
+// open by Close.
+//
+// Returns: pointer to the store
+// Errors: ErrSchemaTooNew, or any error from etcd
+func New(ctx context.Context, client *clientv3.Client, opts *Options) (*Store, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = "auth/"
+	}
+	if o.LeaseGrace <= 0 {
+		o.LeaseGrace = defaultLeaseGrace
+	}
+	s := &Store{client: client, prefix: o.Prefix, grace: o.LeaseGrace, leases: make(map[int64]clientv3.LeaseID)}
+	if o.CacheSize > 0 {
+		s.cache = newDocCache(o.CacheSize)
+	}
+
+	// The version is read and written in one transaction, so that an older version does not
+	// downgrade it meanwhile
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		if v := stm.Get(s.prefix + keyVersion); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n > schemaVersion {
+				return ErrSchemaTooNew
+			}
+		}
+		stm.Put(s.prefix+keyVersion, strconv.Itoa(schemaVersion))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, s.prefix+keyVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.watch(resp.Header.Revision)
+	return s, nil
+}
+
+// NewEtcdServer creates an auth.Server that persists its data in etcd, and empties its decision
+// cache on the changes of the other servers. Close the returned store when done, before the
+// client.
+//
+// Returns: pointer to the new server instance, and the store
+// Errors: auth.ErrInvalidConfig, plus those of New
+func NewEtcdServer(ctx context.Context, config *auth.ServerConfig, client *clientv3.Client, opts *Options) (*auth.Server, *Store, error) {
+	s, err := New(ctx, client, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	svr, err := auth.NewServer(config, s)
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	return svr, s, nil
+}
+
+// Close stops the watch, and revokes nothing: the leases of the tokens keep running. The store
+// cannot be used afterwards.
+//
+// Returns: none
+// Errors: none
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// NotifyChanges implements auth.ChangeNotifier. fn is called after every batch of changes seen by
+// the watch, and whenever the watch restarts, as changes may have been missed.
+func (s *Store) NotifyChanges(fn func()) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	// Copied on write, as notify iterates without the lock
+	s.subs = append(s.subs[:len(s.subs):len(s.subs)], fn)
+}
+
+func (s *Store) notify() {
+	s.subMu.Lock()
+	subs := s.subs
+	s.subMu.Unlock()
+	for _, fn := range subs {
+		fn()
+	}
+}
+
+// watch follows the changes under the prefix from after rev, restarting from the current revision
+// when the watch fails, until the store is closed.
+func (s *Store) watch(rev int64) {
+	defer s.wg.Done()
+	for {
+		s.cache.setLive(true)
+		// Without the leader, the member may be partitioned away from the changes
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(s.ctx))
+		for resp := range s.client.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+			if resp.Err() != nil {
+				break
+			}
+			for _, ev := range resp.Events {
+				s.cache.drop(string(ev.Kv.Key))
+			}
+			if len(resp.Events) > 0 {
+				s.notify()
+			}
+		}
+		cancel()
+		s.cache.setLive(false)
+		s.notify()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+			resp, err := s.client.Get(ctx, s.prefix+keyVersion)
+			cancel()
+			if err == nil {
+				rev = resp.Header.Revision
+				break
+			}
+		}
+	}
+}
+
+// DeleteExpiredTokens removes all tokens that expired before the given time. etcd removes them
+// anyway once their leases end, LeaseGrace after their expiry.
+//
+// Returns: number of removed tokens
+func (s *Store) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	var n int64
+	start := s.prefix + keyExpiry
+	end := start + fmt.Sprintf(userIDFormat, uint64(before.UnixNano()))
+	err := s.scan(ctx, start, end, false, func(key string, _ []byte) (bool, error) {
+		// After the expiry and a slash
+		v := key[len(end)+1:]
+		err := s.atomically(ctx, func(stm concurrency.STM) error {
+			return s.deleteToken(stm, v)
+		})
+		n++
+		return true, err
+	})
+	return n, err
+}
+
+// *-* Users *-*
+
+// userRecord is the JSON document of a user. Roles are saved by ID, and populated on reads.
+type userRecord struct {
+	*auth.User
+	Roles []auth.RoleID `json:",omitempty"`
+}
+
+func (s *Store) InsertUser(ctx context.Context, u *auth.User) error {
+	var id int64
+	err := s.atomically(ctx, func(stm concurrency.STM) (err error) {
+		if stm.Get(s.prefix+keyUserNames+u.Name) != "" {
+			return auth.ErrUserExists
+		}
+		if id, err = s.nextID(stm, strings.TrimSuffix(keyUsers, "/"), int64(u.ID)); err != nil {
+			return err
+		}
+		if stm.Get(s.userKey(auth.UserID(id))) != "" {
+			return auth.ErrUserExists
+		}
+		saved := *u
+		saved.ID = auth.UserID(id)
+		return s.putUser(stm, &saved, nil)
+	})
+	if err == nil {
+		u.ID = auth.UserID(id)
+	}
+	return err
+}
+
+func (s *Store) UpdateUser(ctx context.Context, u *auth.User) error {
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		old, err := s.getUser(stmGetter(stm), u.ID)
+		if err != nil {
+			return err
+		}
+		if id := stm.Get(s.prefix + keyUserNames + u.Name); id != "" && id != fmt.Sprintf(userIDFormat, uint64(u.ID)) {
+			return auth.ErrUserExists
+		}
+		return s.putUser(stm, u, old)
+	})
+	return err
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id auth.UserID) error {
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		u, err := s.getUser(stmGetter(stm), id)
+		if err != nil {
+			return err
+		}
+		s.unindexUser(stm, u)
+		stm.Del(s.prefix + keyUserNames + u.Name)
+		stm.Del(s.userKey(id))
+		return nil
+	})
+	return err
+}
+
+func (s *Store) GetUser(ctx context.Context, id auth.UserID) (*auth.User, error) {
+	return s.getUser(s.getter(ctx), id)
+}
+
+func (s *Store) GetUserByName(ctx context.Context, name string) (*auth.User, error) {
+	get := s.getter(ctx)
+	id, err := get(s.prefix + keyUserNames + name)
+	if err != nil {
+		return nil, err
+	} else if id == nil {
+		return nil, auth.ErrUserNotExist
+	}
+	n, err := strconv.ParseUint(string(id), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	return s.getUser(get, auth.UserID(n))
+}
+
+func (s *Store) UsersWithRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, s.prefix+keyUserRoles+fmt.Sprintf(roleIDFormat+"/", uint32(role)))
+}
+
+func (s *Store) ListUsers(ctx context.Context, q *auth.ListQuery) ([]*auth.User, error) {
+	var list []*auth.User
+	get := s.getter(ctx)
+	err := s.listPage(ctx, q, keyUsers, keyUserNames, userIDFormat, func(id uint64) (string, func(), error) {
+		u, err := s.getUser(get, auth.UserID(id))
+		if err != nil {
+			return "", nil, err
+		}
+		return u.Name, func() { list = append(list, u) }, nil
+	})
+	return list, err
+}
+
+// userIDs lists the users of an index of users by role or group, in key (and so ID) order.
+func (s *Store) userIDs(ctx context.Context, prefix string) ([]auth.UserID, error) {
+	list := []auth.UserID{}
+	err := s.scan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), false, func(key string, _ []byte) (bool, error) {
+		id, err := strconv.ParseUint(key[len(prefix):], 16, 64)
+		list = append(list, auth.UserID(id))
+		return true, err
+	})
+	return list, err
+}
+
+// getUser reads a user, with its Roles populated.
+func (s *Store) getUser(get getter, id auth.UserID) (*auth.User, error) {
+	data, err := get(s.userKey(id))
+	if err != nil {
+		return nil, err
+	} else if data == nil {
+		return nil, auth.ErrUserNotExist
+	}
+	var u auth.User
+	rec := userRecord{User: &u}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	u.Roles = make(map[auth.RoleID]*auth.Role, len(rec.Roles))
+	for _, role := range rec.Roles {
+		if r, err := s.getRole(get, role); err == nil {
+			u.Roles[role] = r
+		} else if err != auth.ErrRoleNotExist {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+// putUser saves a user, and updates the indexes from those of old (nil for a new user).
+func (s *Store) putUser(stm concurrency.STM, u, old *auth.User) error {
+	rec := userRecord{User: u, Roles: make([]auth.RoleID, 0, len(u.Roles))}
+	for role := range u.Roles {
+		// Reading the role also makes the write conflict with its deletion
+		if stm.Get(s.roleKey(keyRoles, role)) == "" {
+			continue
+		}
+		rec.Roles = append(rec.Roles, role)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		s.unindexUser(stm, old)
+		stm.Del(s.prefix + keyUserNames + old.Name)
+	}
+	id := fmt.Sprintf(userIDFormat, uint64(u.ID))
+	stm.Put(s.userKey(u.ID), string(data))
+	stm.Put(s.prefix+keyUserNames+u.Name, id)
+	for _, role := range rec.Roles {
+		stm.Put(s.roleKey(keyUserRoles, role)+"/"+id, "")
+	}
+	for _, group := range u.Groups {
+		stm.Put(s.groupKey(keyUserGroups, group)+"/"+id, "")
+	}
+	return nil
+}
+
+// unindexUser removes a user from the indexes of roles and groups.
+func (s *Store) unindexUser(stm concurrency.STM, u *auth.User) {
+	id := fmt.Sprintf(userIDFormat, uint64(u.ID))
+	for role := range u.Roles {
+		stm.Del(s.roleKey(keyUserRoles, role) + "/" + id)
+	}
+	for _, group := range u.Groups {
+		stm.Del(s.groupKey(keyUserGroups, group) + "/" + id)
+	}
+}
+
+// *-* Roles *-*
+
+func (s *Store) InsertRole(ctx context.Context, r *auth.Role) error {
+	id, err := s.insertNamed(ctx, keyRoles, keyRoleNames, int64(r.ID), r.Name, auth.ErrRoleExists, func(id int64) interface{} {
+		saved := *r
+		saved.ID = auth.RoleID(id)
+		return &saved
+	})
+	if err == nil {
+		r.ID = auth.RoleID(id)
+	}
+	return err
+}
+
+func (s *Store) UpdateRole(ctx context.Context, r *auth.Role) error {
+	return s.updateNamed(ctx, s.roleKey(keyRoles, r.ID), keyRoleNames, r.Name, r, auth.ErrRoleNotExist, auth.ErrRoleExists)
+}
+
+// DeleteRole removes a role, and then takes it away from its users, one at a time.
+func (s *Store) DeleteRole(ctx context.Context, id auth.RoleID) error {
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		r, err := s.getRole(stmGetter(stm), id)
+		if err != nil {
+			return err
+		}
+		stm.Del(s.roleKey(keyRoles, id))
+		stm.Del(s.prefix + keyRoleNames + r.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The role is gone, so no user can be given it anymore: the holders are taken one by one
+	users, err := s.UsersWithRole(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		err := s.atomically(ctx, func(stm concurrency.STM) error {
+			old, err := s.getUser(stmGetter(stm), user)
+			if err == auth.ErrUserNotExist {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			// getUser already leaves out the deleted role
+			if err := s.putUser(stm, old, old); err != nil {
+				return err
+			}
+			stm.Del(s.roleKey(keyUserRoles, id) + "/" + fmt.Sprintf(userIDFormat, uint64(user)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetRole(ctx context.Context, id auth.RoleID) (*auth.Role, error) {
+	return s.getRole(s.getter(ctx), id)
+}
+
+func (s *Store) GetRoleByName(ctx context.Context, name string) (*auth.Role, error) {
+	get := s.getter(ctx)
+	id, err := s.nameID(get, keyRoleNames, name, auth.ErrRoleNotExist)
+	if err != nil {
+		return nil, err
+	}
+	return s.getRole(get, auth.RoleID(id))
+}
+
+func (s *Store) ListRoles(ctx context.Context, q *auth.ListQuery) ([]*auth.Role, error) {
+	var list []*auth.Role
+	get := s.getter(ctx)
+	err := s.listPage(ctx, q, keyRoles, keyRoleNames, roleIDFormat, func(id uint64) (string, func(), error) {
+		r, err := s.getRole(get, auth.RoleID(id))
+		if err != nil {
+			return "", nil, err
+		}
+		return r.Name, func() { list = append(list, r) }, nil
+	})
+	return list, err
+}
+
+func (s *Store) getRole(get getter, id auth.RoleID) (*auth.Role, error) {
+	var r auth.Role
+	if err := getJSON(get, s.roleKey(keyRoles, id), &r, auth.ErrRoleNotExist); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// *-* Groups *-*
+
+func (s *Store) InsertGroup(ctx context.Context, g *auth.Group) error {
+	id, err := s.insertNamed(ctx, keyGroups, keyGroupNames, int64(g.ID), g.Name, auth.ErrGroupExists, func(id int64) interface{} {
+		saved := *g
+		saved.ID = auth.GroupID(id)
+		return &saved
+	})
+	if err == nil {
+		g.ID = auth.GroupID(id)
+	}
+	return err
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, g *auth.Group) error {
+	return s.updateNamed(ctx, s.groupKey(keyGroups, g.ID), keyGroupNames, g.Name, g, auth.ErrGroupNotExist, auth.ErrGroupExists)
+}
+
+// DeleteGroup removes a group, and then its members from it, one at a time.
+func (s *Store) DeleteGroup(ctx context.Context, id auth.GroupID) error {
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		g, err := s.getGroup(stmGetter(stm), id)
+		if err != nil {
+			return err
+		}
+		stm.Del(s.groupKey(keyGroups, id))
+		stm.Del(s.prefix + keyGroupNames + g.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	members, err := s.GroupMembers(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, user := range members {
+		err := s.atomically(ctx, func(stm concurrency.STM) error {
+			old, err := s.getUser(stmGetter(stm), user)
+			if err == auth.ErrUserNotExist {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			u := *old
+			u.Groups = nil
+			for _, group := range old.Groups {
+				if group != id {
+					u.Groups = append(u.Groups, group)
+				}
+			}
+			return s.putUser(stm, &u, old)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetGroup(ctx context.Context, id auth.GroupID) (*auth.Group, error) {
+	return s.getGroup(s.getter(ctx), id)
+}
+
+func (s *Store) GetGroupByName(ctx context.Context, name string) (*auth.Group, error) {
+	get := s.getter(ctx)
+	id, err := s.nameID(get, keyGroupNames, name, auth.ErrGroupNotExist)
+	if err != nil {
+		return nil, err
+	}
+	return s.getGroup(get, auth.GroupID(id))
+}
+
+func (s *Store) GroupMembers(ctx context.Context, group auth.GroupID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, s.groupKey(keyUserGroups, group)+"/")
+}
+
+func (s *Store) getGroup(get getter, id auth.GroupID) (*auth.Group, error) {
+	var g auth.Group
+	if err := getJSON(get, s.groupKey(keyGroups, id), &g, auth.ErrGroupNotExist); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Count implements auth.Counter.
+func (s *Store) Count(ctx context.Context) (auth.Counts, error) {
+	var c auth.Counts
+	for _, count := range []struct {
+		prefix string
+		n      *int64
+	}{{keyUsers, &c.Users}, {keyRoles, &c.Roles}, {keyTokens, &c.Tokens}} {
+		resp, err := s.client.Get(ctx, s.prefix+count.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return c, err
+		}
+		*count.n = resp.Count
+	}
+	return c, nil
+}
+
+// *-* Tokens *-*
+
+// InsertToken saves a token, and the keys indexing it, under a lease ending LeaseGrace after its
+// expiry, or at least a minute from now.
+func (s *Store) InsertToken(ctx context.Context, t *auth.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	v := string(t.Value)
+	put := func(lease clientv3.LeaseID) error {
+		err := s.atomically(ctx, func(stm concurrency.STM) error {
+			// A token saved again replaces the old one, and its index entries
+			if err := s.deleteToken(stm, v); err != nil {
+				return err
+			}
+			stm.Put(s.prefix+keyTokens+v, string(data), clientv3.WithLease(lease))
+			stm.Put(s.prefix+keyUserTokens+fmt.Sprintf(userIDFormat+"/", uint64(t.User))+v, "", clientv3.WithLease(lease))
+			stm.Put(s.expiryKey(t)+"/"+v, "", clientv3.WithLease(lease))
+			return nil
+		})
+		return err
+	}
+	end, lease, err := s.lease(ctx, t.Expires)
+	if err != nil {
+		return err
+	}
+	if err := put(lease); err != rpctypes.ErrLeaseNotFound {
+		return err
+	}
+	// Revoked, or ended early on a skewed clock
+	s.leaseMu.Lock()
+	if s.leases[end] == lease {
+		delete(s.leases, end)
+	}
+	s.leaseMu.Unlock()
+	if _, lease, err = s.lease(ctx, t.Expires); err != nil {
+		return err
+	}
+	return put(lease)
+}
+
+func (s *Store) GetToken(ctx context.Context, v auth.TokenValue) (*auth.Token, error) {
+	var t auth.Token
+	if err := getJSON(s.getter(ctx), s.prefix+keyTokens+string(v), &t, auth.ErrInvalidToken); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *Store) DeleteToken(ctx context.Context, v auth.TokenValue) error {
+	err := s.atomically(ctx, func(stm concurrency.STM) error {
+		return s.deleteToken(stm, string(v))
+	})
+	return err
+}
+
+func (s *Store) UserTokens(ctx context.Context, user auth.UserID) ([]*auth.Token, error) {
+	var list []*auth.Token
+	prefix := s.prefix + keyUserTokens + fmt.Sprintf(userIDFormat+"/", uint64(user))
+	err := s.scan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), false, func(key string, _ []byte) (bool, error) {
+		t, err := s.GetToken(ctx, auth.TokenValue(key[len(prefix):]))
+		if err == auth.ErrInvalidToken {
+			// Its lease just ended
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		list = append(list, t)
+		return true, nil
+	})
+	return list, err
+}
+
+// deleteToken removes a token and its index entries. It is a no-op if the token does not exist.
+func (s *Store) deleteToken(stm concurrency.STM, v string) error {
+	var t auth.Token
+	err := getJSON(stmGetter(stm), s.prefix+keyTokens+v, &t, auth.ErrInvalidToken)
+	if err == auth.ErrInvalidToken {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stm.Del(s.prefix + keyUserTokens + fmt.Sprintf(userIDFormat+"/", uint64(t.User)) + v)
+	stm.Del(s.expiryKey(&t) + "/" + v)
+	stm.Del(s.prefix + keyTokens + v)
+	return nil
+}
+
+func (s *Store) expiryKey(t *auth.Token) string {
+	return s.prefix + keyExpiry + fmt.Sprintf(userIDFormat, uint64(t.Expires.UnixNano()))
+}
+
+// lease gives a lease ending LeaseGrace after expires, rounded up to a leaseStep, and at least a
+// leaseStep from now. Leases are shared by the tokens ending in the same step.
+//
+// Returns: the end of the lease in Unix seconds, and the lease
+func (s *Store) lease(ctx context.Context, expires time.Time) (int64, clientv3.LeaseID, error) {
+	now := time.Now()
+	end := expires.Add(s.grace)
+	if min := now.Add(leaseStep); end.Before(min) {
+		end = min
+	}
+	end = end.Truncate(leaseStep).Add(leaseStep)
+
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	if id, ok := s.leases[end.Unix()]; ok {
+		return end.Unix(), id, nil
+	}
+	for e := range s.leases {
+		if e <= now.Unix() {
+			delete(s.leases, e)
+		}
+	}
+	resp, err := s.client.Grant(ctx, int64(math.Ceil(end.Sub(now).Seconds())))
+	if err != nil {
+		return 0, 0, err
+	}
+	s.leases[end.Unix()] = resp.ID
+	return end.Unix(), resp.ID, nil
+}
+
+// *-* Helpers *-*
+
+// getter reads the value of a key, nil if it does not exist.
+type getter func(key string) ([]byte, error)
+
+// getter reads from etcd, or the cache.
+func (s *Store) getter(ctx context.Context) getter {
+	return func(key string) ([]byte, error) {
+		if v, ok := s.cache.get(key); ok {
+			return v, nil
+		}
+		gen := s.cache.generation()
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			return nil, nil
+		}
+		s.cache.put(key, resp.Kvs[0].Value, gen)
+		return resp.Kvs[0].Value, nil
+	}
+}
+
+// stmGetter reads within a transaction. No value is empty, except those of index keys, which are
+// not read by key.
+func stmGetter(stm concurrency.STM) getter {
+	return func(key string) ([]byte, error) {
+		if v := stm.Get(key); v != "" {
+			return []byte(v), nil
+		}
+		return nil, nil
+	}
+}
+
+func getJSON(get getter, key string, v interface{}, errNotExist error) error {
+	data, err := get(key)
+	if err != nil {
+		return err
+	} else if data == nil {
+		return errNotExist
+	}
+	return json.Unmarshal(data, v)
+}
+
+// atomically runs fn in a transaction, from scratch again as long as it conflicts with another
+// one. fn must not have other side effects. The keys written are dropped from the cache once
+// committed, so that the store reads its own writes without waiting for the watch.
+func (s *Store) atomically(ctx context.Context, fn func(stm concurrency.STM) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var written []string
+	_, err := concurrency.NewSTM(s.client, func(stm concurrency.STM) error {
+		w := &writeSet{STM: stm}
+		err := fn(w)
+		written = w.keys
+		return err
+	}, concurrency.WithAbortContext(ctx))
+	if err == nil {
+		for _, key := range written {
+			s.cache.drop(key)
+		}
+	}
+	return err
+}
+
+// writeSet records the keys written by a transaction.
+type writeSet struct {
+	concurrency.STM
+	keys []string
+}
+
+func (w *writeSet) Put(key, val string, opts ...clientv3.OpOption) {
+	w.keys = append(w.keys, key)
+	w.STM.Put(key, val, opts...)
+}
+
+func (w *writeSet) Del(key string) {
+	w.keys = append(w.keys, key)
+	w.STM.Del(key)
+}
+
+// nextID returns id, or a new ID from the sequence of the entities if id is 0. The sequence is
+// moved past preset IDs, so that generated IDs do not collide with them, and never goes back, so
+// the IDs of deleted entities are not reused.
+func (s *Store) nextID(stm concurrency.STM, entities string, id int64) (int64, error) {
+	key := s.prefix + keySequences + entities
+	var seq int64
+	if v := stm.Get(key); v != "" {
+		var err error
+		if seq, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	if id == 0 {
+		id = seq + 1
+	}
+	if id > seq {
+		stm.Put(key, strconv.FormatInt(id, 10))
+	}
+	return id, nil
+}
+
+// insertNamed saves a new role or group under keys, given by saved with its ID, and indexes its
+// name under names.
+//
+// Returns: the ID
+func (s *Store) insertNamed(ctx context.Context, keys, names string, preset int64, name string, errExists error, saved func(id int64) interface{}) (int64, error) {
+	entities := strings.TrimSuffix(keys, "/")
+	keys, names = s.prefix+keys, s.prefix+names
+	var id int64
+	err := s.atomically(ctx, func(stm concurrency.STM) (err error) {
+		if stm.Get(names+name) != "" {
+			return errExists
+		}
+		if id, err = s.nextID(stm, entities, preset); err != nil {
+			return err
+		}
+		key := fmt.Sprintf(roleIDFormat, uint32(id))
+		if stm.Get(keys+key) != "" {
+			return errExists
+		}
+		data, err := json.Marshal(saved(id))
+		if err != nil {
+			return err
+		}
+		stm.Put(keys+key, string(data))
+		stm.Put(names+name, key)
+		return nil
+	})
+	return id, err
+}
+
+// updateNamed replaces a role or group saved in key, and moves the index of its name.
+func (s *Store) updateNamed(ctx context.Context, key, names, name string, v interface{}, errNotExist, errExists error) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	names = s.prefix + names
+	id := key[strings.LastIndexByte(key, '/')+1:]
+	err = s.atomically(ctx, func(stm concurrency.STM) error {
+		var old struct{ Name string }
+		if err := getJSON(stmGetter(stm), key, &old, errNotExist); err != nil {
+			return err
+		}
+		if other := stm.Get(names + name); other != "" && other != id {
+			return errExists
+		}
+		stm.Del(names + old.Name)
+		stm.Put(key, string(data))
+		stm.Put(names+name, id)
+		return nil
+	})
+	return err
+}
+
+// nameID looks up the ID of a role or group by name.
+func (s *Store) nameID(get getter, names, name string, errNotExist error) (uint64, error) {
+	id, err := get(s.prefix + names + name)
+	if err != nil {
+		return 0, err
+	} else if id == nil {
+		return 0, errNotExist
+	}
+	return strconv.ParseUint(string(id), 16, 32)
+}
+
+// scanBatch is how many keys scan reads at a time.
+const scanBatch = 256
+
+// scan calls fn with the keys in [start, end) and their values, in key order (or the reverse),
+// until it returns false. The keys are read in batches, at the revision of the first one.
+func (s *Store) scan(ctx context.Context, start, end string, desc bool, fn func(key string, value []byte) (bool, error)) error {
+	order := clientv3.SortAscend
+	if desc {
+		order = clientv3.SortDescend
+	}
+	var rev int64
+	for start < end {
+		resp, err := s.client.Get(ctx, start, clientv3.WithRange(end), clientv3.WithLimit(scanBatch),
+			clientv3.WithSort(clientv3.SortByKey, order), clientv3.WithRev(rev))
+		if err != nil {
+			return err
+		}
+		rev = resp.Header.Revision
+		for _, kv := range resp.Kvs {
+			if more, err := fn(string(kv.Key), kv.Value); err != nil || !more {
+				return err
+			}
+		}
+		if !resp.More {
+			return nil
+		}
+		last := string(resp.Kvs[len(resp.Kvs)-1].Key)
+		if desc {
+			end = last
+		} else {
+			start = last + "\x00"
+		}
+	}
+	return nil
+}
+
+// listPage calls load with the IDs of the entities, in the order of the query, until it accepts
+// q.Limit of them. load gives the name of the entity, and a function adding it to the page. The
+// entities are saved under byID, keyed by IDs spelled with idFormat, and byName maps names to IDs.
+func (s *Store) listPage(ctx context.Context, q *auth.ListQuery, byID, byName, idFormat string, load func(id uint64) (string, func(), error)) error {
+	byNames := q.SortBy == auth.SortByName
+	prefix := s.prefix + byID
+	start, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if byNames {
+		// Names with the prefix are contiguous
+		prefix = s.prefix + byName
+		start = prefix + q.Prefix
+		end = clientv3.GetPrefixRangeEnd(start)
+	}
+	if q.After != nil {
+		after := prefix + q.After.Name
+		if !byNames {
+			after = prefix + fmt.Sprintf(idFormat, uint64(q.After.ID))
+		}
+		if !q.Desc && after >= start {
+			start = after + "\x00"
+		} else if q.Desc && after < end {
+			end = after
+		}
+	}
+
+	n := 0
+	return s.scan(ctx, start, end, q.Desc, func(key string, value []byte) (bool, error) {
+		if n >= q.Limit {
+			return false, nil
+		}
+		id := key[len(prefix):]
+		if byNames {
+			id = string(value)
+		}
+		n64, err := strconv.ParseUint(id, 16, 64)
+		if err != nil {
+			return false, err
+		}
+		name, add, err := load(n64)
+		if err == auth.ErrUserNotExist || err == auth.ErrRoleNotExist {
+			// Deleted since the scan started
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if q.Match(auth.ListKey{ID: int64(n64), Name: name}) {
+			add()
+			n++
+		}
+		return n < q.Limit, nil
+	})
+}
+
+func (s *Store) userKey(id auth.UserID) string {
+	return s.prefix + keyUsers + fmt.Sprintf(userIDFormat, uint64(id))
+}
+
+// roleKey and groupKey give the key of an ID under a prefix of keys, e.g. keyRoles.
+func (s *Store) roleKey(keys string, id auth.RoleID) string {
+	return s.prefix + keys + fmt.Sprintf(roleIDFormat, uint32(id))
+}
+
+func (s *Store) groupKey(keys string, id auth.GroupID) string {
+	return s.prefix + keys + fmt.Sprintf(roleIDFormat, uint32(id))
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventType names a change or an attempt reported to subscribers, see Subscribe.
+type EventType string
+
+const (
+	EventUserCreated     EventType = "user.created" // by CreateUser, CreateServiceAccount or an Authenticator
+	EventUserDeleted     EventType = "user.deleted"
+	EventUserRestored    EventType = "user.restored"
+	EventUserSuspended   EventType = "user.suspended"
+	EventUserReactivated EventType = "user.reactivated"
+	EventUserRenamed     EventType = "user.renamed"
+	EventEmailVerified   EventType = "email.verified"
+	EventPasswordReset   EventType = "password.reset"    // by CompletePasswordReset
+	EventImpersonated    EventType = "user.impersonated" // by Impersonate
+	EventRoleCreated     EventType = "role.created"
+	EventRoleDeleted     EventType = "role.deleted"
+	EventRoleRenamed     EventType = "role.renamed"
+	EventRoleGranted     EventType = "role.granted" // directly to a user (or by DefaultRoles), not through a group
+	EventRoleRevoked     EventType = "role.revoked"
+	EventRoleExpired     EventType = "role.expired" // removed by ExpireRoles, see AddRoleToUserUntil
+	EventLoginSucceeded  EventType = "login.succeeded"
+	EventLoginFailed     EventType = "login.failed"  // User is 0 if the name has no user
+	EventTokenRevoked    EventType = "token.revoked" // by Invalidate, InvalidateToken or CompletePasswordReset
+	EventAPIKeyRevoked   EventType = "apikey.revoked"
+	EventLoginThrottled  EventType = "login.throttled" // by Authenticate, see ServerConfig.RateLimiter
+	EventAnomaly         EventType = "security.anomaly"
+	EventMFARecovered    EventType = "mfa.recovered"
+	EventUserErased      EventType = "user.erased" // by EraseUser, with the user ID only
+)
+
+// Event describes something that happened on a server. Fields that do not apply to the type are
+// left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	User UserID    `json:"user_id,omitempty"`
+	// Name is that of the user, or of the role for role.created, role.deleted and role.renamed. For
+	// failed logins, it is the name that was tried.
+	Name      string `json:"name,omitempty"`
+	OldName   string `json:"old_name,omitempty"` // before user.renamed and role.renamed
+	Role      RoleID `json:"role_id,omitempty"`
+	Actor     UserID `json:"actor_id,omitempty"` // acting as User, for impersonation tokens
+	TokenID   string `json:"token_id,omitempty"` // see TokenInfo and APIKeyInfo
+	IP        string `json:"ip,omitempty"`       // of the client, for logins
+	UserAgent string `json:"user_agent,omitempty"`
+	Realm     string `json:"realm,omitempty"` // of the server, see Realms
+	// Expires is that of temporary roles, for role.granted. See AddRoleToUserUntil.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Resource is that of roles on a resource, for role.granted and role.revoked. See
+	// AddRoleToUserOnResource.
+	Resource string `json:"resource,omitempty"`
+	// Default marks the role.granted events of ServerConfig.DefaultRoles, given to new users.
+	Default bool `json:"default,omitempty"`
+	// Anomaly is the pattern found, for security.anomaly. See DetectAnomalies.
+	Anomaly Anomaly `json:"anomaly,omitempty"`
+}
+
+// eventBus delivers events to the subscriptions. Its mutex is never held while calling a
+// subscriber, so it can be taken under any lock of the server.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+	// The detectors of DetectAnomalies, for the tokens they do not learn from events
+	detectors map[*detector]struct{}
+}
+
+// subscription queues the events of a subscriber, and calls it from its own goroutine.
+type subscription struct {
+	fn    func(Event)
+	types map[EventType]bool // nil for all types
+
+	mu      sync.Mutex
+	queue   []Event
+	closed  bool
+	wake    chan struct{} // buffered, signals new events
+	running bool          // while fn is called
+	idle    chan struct{} // if set, closed once the queue is empty and fn returned, see flush
+}
+
+// Subscribe calls fn with the events of the given types, or all events if no type is given.
+// Events are delivered in order, from a goroutine of the subscription, after the change is saved:
+// a slow subscriber holds back neither the server nor other subscribers, and fn may call the
+// server. Events of other servers sharing the storage are not seen.
+//
+// Returns: a function that ends the subscription. Events not delivered yet are dropped.
+func (s *Server) Subscribe(fn func(Event), types ...EventType) func() {
+	sub := &subscription{fn: fn, wake: make(chan struct{}, 1)}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	s.events.mu.Lock()
+	s.events.subs[sub] = struct{}{}
+	s.events.mu.Unlock()
+	go sub.run()
+
+	return func() {
+		s.events.mu.Lock()
+		_, ok := s.events.subs[sub]
+		delete(s.events.subs, sub)
+		s.events.mu.Unlock()
+		if ok {
+			sub.close()
+		}
+	}
+}
+
+// close ends all the subscriptions, once their queued events are delivered or ctx ends, for
+// Server.Close.
+//
+// Errors: ctx.Err(), if events were dropped
+func (b *eventBus) close(ctx context.Context) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[*subscription]struct{})
+	b.mu.Unlock()
+	var err error
+	for sub := range subs {
+		if err == nil {
+			err = wait(ctx, sub.flush)
+		}
+		sub.close()
+	}
+	return err
+}
+
+// emit queues an event for the subscribers. It does not block.
+func (s *Server) emit(e Event) {
+	e.Time = s.now()
+	e.Realm = s.realm
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	for sub := range s.events.subs {
+		if sub.types == nil || sub.types[e.Type] {
+			sub.push(e)
+		}
+	}
+}
+
+func (sub *subscription) push(e Event) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, e)
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+		// Already signaled, run picks it up with the rest of the queue
+	}
+}
+
+func (sub *subscription) run() {
+	for range sub.wake {
+		for {
+			sub.mu.Lock()
+			sub.running = false
+			if sub.closed || len(sub.queue) == 0 {
+				sub.queue = nil // Do not keep the drained array
+				if sub.idle != nil {
+					close(sub.idle)
+					sub.idle = nil
+				}
+				sub.mu.Unlock()
+				break
+			}
+			e := sub.queue[0]
+			sub.queue = sub.queue[1:]
+			sub.running = true
+			sub.mu.Unlock()
+			sub.fn(e)
+		}
+	}
+}
+
+// flush waits until the events queued so far are delivered.
+func (sub *subscription) flush() {
+	sub.mu.Lock()
+	if sub.closed || (len(sub.queue) == 0 && !sub.running) {
+		sub.mu.Unlock()
+		return
+	}
+	if sub.idle == nil {
+		sub.idle = make(chan struct{})
+	}
+	idle := sub.idle
+	sub.mu.Unlock()
+	<-idle
+}
+
+// close ends the subscription. Events not delivered yet are dropped.
+func (sub *subscription) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.queue = nil
+	if sub.idle != nil {
+		close(sub.idle)
+		sub.idle = nil
+	}
+	sub.mu.Unlock()
+	close(sub.wake)
+}
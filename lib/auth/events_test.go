@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collect subscribes to a server. next waits for n events, or gives those received in the meantime.
+func collect(svr *Server, types ...EventType) (func(n int) []Event, func()) {
+	ch := make(chan Event, 100)
+	cancel := svr.Subscribe(func(e Event) { ch <- e }, types...)
+	next := func(n int) []Event {
+		var list []Event
+		for len(list) < n {
+			select {
+			case e := <-ch:
+				list = append(list, e)
+			case <-time.After(200 * time.Millisecond):
+				return list
+			}
+		}
+		return list
+	}
+	return next, cancel
+}
+
+func TestEvents(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	next, cancel := collect(svr)
+	{
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		rid, _ := svr.CreateRole("reader")
+		svr.AddRoleToUser(uid, rid)
+		svr.AddRoleToUser(uid, rid)
+		svr.RemoveRoleFromUser(uid, rid)
+		events := next(4)
+		assert.Equal(t, 4, len(events), "should report changes only")
+		assert.Equal(t, Event{Type: EventUserCreated, User: uid, Name: "anna"}, Event{Type: events[0].Type, User: events[0].User, Name: events[0].Name},
+			"should describe the user")
+		assert.Equal(t, false, events[0].Time.IsZero(), "should give the time")
+		assert.Equal(t, []EventType{EventUserCreated, EventRoleCreated, EventRoleGranted, EventRoleRevoked},
+			[]EventType{events[0].Type, events[1].Type, events[2].Type, events[3].Type}, "should deliver in order")
+		assert.Equal(t, rid, events[2].Role, "should give the role")
+	}
+	{
+		svr.AuthenticateClient("anna", "wrong", ClientInfo{IP: "192.0.2.1"})
+		svr.Authenticate("belle", "wrong")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Invalidate(token)
+		svr.Invalidate(token)
+		events := next(4)
+		assert.Equal(t, EventLoginFailed, events[0].Type, "should report failed logins")
+		assert.Equal(t, "192.0.2.1", events[0].IP, "should give the client")
+		assert.Equal(t, Event{Type: EventLoginFailed, Name: "belle"}, Event{Type: events[1].Type, User: events[1].User, Name: events[1].Name},
+			"should report failed logins of unknown names")
+		assert.Equal(t, EventLoginSucceeded, events[2].Type, "should report successful logins")
+		assert.Equal(t, EventTokenRevoked, events[3].Type, "should report revoked tokens")
+		assert.Equal(t, 0, len(next(1)), "should not report tokens revoked twice")
+	}
+	{
+		only, cancelOnly := collect(svr, EventUserSuspended)
+		uid := svr.GetUserByName("anna").ID
+		svr.SuspendUser(uid)
+		svr.ReactivateUser(uid)
+		events := next(2)
+		assert.Equal(t, []EventType{EventUserSuspended, EventUserReactivated}, []EventType{events[0].Type, events[1].Type},
+			"should report suspension")
+		events = only(2)
+		assert.Equal(t, 1, len(events), "should filter by type")
+		cancelOnly()
+		cancelOnly()
+	}
+	{
+		cancel()
+		svr.CreateUser("belle", "passw0rd")
+		assert.Equal(t, 0, len(next(1)), "should stop after the subscription ends")
+	}
+	{
+		// Subscribers may call the server
+		done := make(chan bool, 1)
+		svr.Subscribe(func(e Event) { done <- svr.GetUser(e.User) != nil }, EventUserDeleted)
+		svr.DeleteUser(svr.GetUserByName("belle").ID)
+		select {
+		case found := <-done:
+			assert.Equal(t, false, found, "should report after the change is saved")
+		case <-time.After(time.Second):
+			t.Error("should report deleted users")
+		}
+	}
+}
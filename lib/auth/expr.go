@@ -0,0 +1,659 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are the built-in language of the policies of CheckAccess, a small subset of CEL:
+//
+//	"admin" in subject.roles || (subject.attributes.clearance >= 3 && request.region == subject.attributes.region)
+//
+// Values are null, bools, strings, numbers (integers and floats compare with each other) and lists.
+// The variables are:
+//
+//	subject.id, subject.name         the user of the token
+//	subject.roles, subject.role_ids  the names and IDs of its roles within the scope of the token
+//	subject.attributes.<key>         its attributes, see SetUserAttribute
+//	request.<key>                    the attributes of the request, see AccessInput
+//	env.time, env.hour, env.weekday  the time of the check, in Unix seconds, and its UTC hour and
+//	                                 weekday (0 for Sunday)
+//
+// Missing attributes are null. The operators are, by increasing precedence: ||, &&, the
+// comparisons (==, !=, <, <=, >, >= and "in", for membership in a list), and !. Comparisons of
+// null other than == and != are false. The functions are has(x), which is false if x is null,
+// size(x) of a string or list, and startsWith(s, prefix). An expression must give a bool.
+
+// PolicyError is an error in the source of a policy, found by compiling it or, for the types of the
+// values, by evaluating it. It matches ErrInvalidPolicy with errors.Is.
+type PolicyError struct {
+	Pos int // byte offset in the source
+	Msg string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("invalid policy at %d: %s", e.Pos, e.Msg)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrInvalidPolicy
+}
+
+// CompileExpression compiles a policy in the built-in language of expressions, as the default
+// PolicyCompiler of servers does.
+//
+// Returns: the compiled policy
+// Errors: *PolicyError
+func CompileExpression(src string) (Policy, error) {
+	p := &exprParser{src: src}
+	p.next()
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return &expression{root: n}, nil
+}
+
+type expressionCompiler struct{}
+
+func (expressionCompiler) Compile(src string) (Policy, error) {
+	return CompileExpression(src)
+}
+
+// expression is a compiled policy of the built-in language.
+type expression struct {
+	root exprNode
+}
+
+func (e *expression) Allow(sub *Subject, env *Environment) (bool, error) {
+	v, err := e.root.eval(&exprScope{sub: sub, env: env})
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := v.(bool)
+	if !isBool {
+		return false, &PolicyError{Pos: 0, Msg: "expression is not a bool"}
+	}
+	return ok, nil
+}
+
+// *-* Lexer *-*
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+	val  interface{} // of literals
+}
+
+type exprParser struct {
+	src string
+	off int
+	tok exprToken
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return &PolicyError{Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token into p.tok. Malformed tokens are operators, and reported as unexpected
+// by the parser.
+func (p *exprParser) next() {
+	for p.off < len(p.src) && unicode.IsSpace(rune(p.src[p.off])) {
+		p.off++
+	}
+	start := p.off
+	if p.off >= len(p.src) {
+		p.tok = exprToken{kind: tokEOF, pos: start}
+		return
+	}
+	c := p.src[p.off]
+	switch {
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.off < len(p.src) && (p.src[p.off] == '_' || unicode.IsLetter(rune(p.src[p.off])) || unicode.IsDigit(rune(p.src[p.off]))) {
+			p.off++
+		}
+		p.tok = exprToken{kind: tokIdent, text: p.src[start:p.off], pos: start}
+	case unicode.IsDigit(rune(c)):
+		for p.off < len(p.src) && (unicode.IsDigit(rune(p.src[p.off])) || p.src[p.off] == '.') {
+			p.off++
+		}
+		text := p.src[start:p.off]
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			p.tok = exprToken{kind: tokInt, text: text, pos: start, val: i}
+		} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+			p.tok = exprToken{kind: tokFloat, text: text, pos: start, val: f}
+		} else {
+			p.tok = exprToken{kind: tokOp, text: text, pos: start}
+		}
+	case c == '"' || c == '\'':
+		p.off++
+		for p.off < len(p.src) && p.src[p.off] != c {
+			if p.src[p.off] == '\\' {
+				p.off++
+			}
+			p.off++
+		}
+		if p.off >= len(p.src) {
+			p.tok = exprToken{kind: tokOp, text: p.src[start:], pos: start}
+			return
+		}
+		p.off++
+		body := p.src[start+1 : p.off-1]
+		if c == '\'' {
+			body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+		}
+		s, err := strconv.Unquote(`"` + body + `"`)
+		if err != nil {
+			p.tok = exprToken{kind: tokOp, text: p.src[start:p.off], pos: start}
+			return
+		}
+		p.tok = exprToken{kind: tokString, text: p.src[start:p.off], pos: start, val: s}
+	default:
+		for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."} {
+			if strings.HasPrefix(p.src[p.off:], op) {
+				p.off += len(op)
+				p.tok = exprToken{kind: tokOp, text: op, pos: start}
+				return
+			}
+		}
+		p.off++
+		p.tok = exprToken{kind: tokOp, text: p.src[start:p.off], pos: start}
+	}
+}
+
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		if p.tok.kind == tokEOF {
+			return p.errorf("expected %q, got the end", op)
+		}
+		return p.errorf("expected %q, got %q", op, p.tok.text)
+	}
+	p.next()
+	return nil
+}
+
+// *-* Parser *-*
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		pos := p.tok.pos
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &logicNode{and: false, x: x, y: y, pos: pos}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	x, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		pos := p.tok.pos
+		p.next()
+		y, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		x = &logicNode{and: true, x: x, y: y, pos: pos}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.tok.text
+	switch {
+	case p.tok.kind == tokOp && (op == "==" || op == "!=" || op == "<" || op == "<=" || op == ">" || op == ">="):
+	case p.tok.kind == tokIdent && op == "in":
+	default:
+		return x, nil
+	}
+	pos := p.tok.pos
+	p.next()
+	y, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &compareNode{op: op, x: x, y: y, pos: pos}, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!") {
+		pos := p.tok.pos
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x, pos: pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt, tokFloat, tokString:
+		p.next()
+		return literalNode{tok.val}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		if p.isOp("(") {
+			return p.parseCall(tok)
+		}
+		return p.parsePath(tok)
+	case tokOp:
+		switch tok.text {
+		case "(":
+			p.next()
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			p.next()
+			list := &listNode{}
+			for !p.isOp("]") {
+				x, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, x)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			return list, p.expect("]")
+		}
+	case tokEOF:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+// exprFuncs are the functions of expressions, by their number of arguments.
+var exprFuncs = map[string]int{"has": 1, "size": 1, "startsWith": 2}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	arity, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, &PolicyError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", name.text)}
+	}
+	p.next()
+	call := &callNode{fn: name.text, pos: name.pos}
+	for !p.isOp(")") {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, x)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(call.args) != arity {
+		return nil, &PolicyError{Pos: name.pos, Msg: fmt.Sprintf("%s takes %d arguments", name.text, arity)}
+	}
+	if _, isPath := call.args[0].(*pathNode); name.text == "has" && !isPath {
+		return nil, &PolicyError{Pos: name.pos, Msg: "has takes a variable"}
+	}
+	return call, nil
+}
+
+// parsePath parses a variable, and checks that it exists.
+func (p *exprParser) parsePath(root exprToken) (exprNode, error) {
+	path := &pathNode{parts: []string{root.text}, pos: root.pos}
+	for p.isOp(".") {
+		p.next()
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected a name after \".\"")
+		}
+		path.parts = append(path.parts, p.tok.text)
+		p.next()
+	}
+	valid := false
+	switch path.parts[0] {
+	case "subject":
+		if len(path.parts) == 2 {
+			switch path.parts[1] {
+			case "id", "name", "roles", "role_ids":
+				valid = true
+			}
+		}
+		valid = valid || (len(path.parts) == 3 && path.parts[1] == "attributes")
+	case "request":
+		valid = len(path.parts) == 2
+	case "env":
+		if len(path.parts) == 2 {
+			switch path.parts[1] {
+			case "time", "hour", "weekday":
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return nil, &PolicyError{Pos: root.pos, Msg: fmt.Sprintf("unknown variable %q", strings.Join(path.parts, "."))}
+	}
+	return path, nil
+}
+
+// *-* Evaluation *-*
+
+type exprScope struct {
+	sub *Subject
+	env *Environment
+}
+
+type exprNode interface {
+	eval(sc *exprScope) (interface{}, error)
+}
+
+type literalNode struct {
+	v interface{}
+}
+
+func (n literalNode) eval(*exprScope) (interface{}, error) {
+	return n.v, nil
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) eval(sc *exprScope) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(sc)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+type pathNode struct {
+	parts []string
+	pos   int
+}
+
+func (n *pathNode) eval(sc *exprScope) (interface{}, error) {
+	switch n.parts[0] {
+	case "subject":
+		switch n.parts[1] {
+		case "id":
+			return int64(sc.sub.User), nil
+		case "name":
+			return sc.sub.Name, nil
+		case "roles":
+			return exprValue(sc.sub.RoleNames), nil
+		case "role_ids":
+			ids := make([]interface{}, len(sc.sub.Roles))
+			for i, id := range sc.sub.Roles {
+				ids[i] = int64(id)
+			}
+			return ids, nil
+		}
+		return exprValue(sc.sub.Attributes[n.parts[2]]), nil
+	case "request":
+		return exprValue(sc.env.Attributes[n.parts[1]]), nil
+	}
+	t := sc.env.Time.UTC()
+	switch n.parts[1] {
+	case "time":
+		return t.Unix(), nil
+	case "hour":
+		return int64(t.Hour()), nil
+	}
+	return int64(t.Weekday()), nil
+}
+
+// exprValue converts an attribute to a value of expressions.
+func exprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	case int:
+		return int64(v)
+	}
+	return v
+}
+
+type logicNode struct {
+	and  bool
+	x, y exprNode
+	pos  int
+}
+
+func (n *logicNode) eval(sc *exprScope) (interface{}, error) {
+	for _, operand := range []exprNode{n.x, n.y} {
+		v, err := operand.eval(sc)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return nil, &PolicyError{Pos: n.pos, Msg: "operand of && or || is not a bool"}
+		}
+		// Short-circuit
+		if b != n.and {
+			return b, nil
+		}
+	}
+	return n.and, nil
+}
+
+type notNode struct {
+	x   exprNode
+	pos int
+}
+
+func (n *notNode) eval(sc *exprScope) (interface{}, error) {
+	v, err := n.x.eval(sc)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, &PolicyError{Pos: n.pos, Msg: "operand of ! is not a bool"}
+	}
+	return !b, nil
+}
+
+type compareNode struct {
+	op   string
+	x, y exprNode
+	pos  int
+}
+
+func (n *compareNode) eval(sc *exprScope) (interface{}, error) {
+	x, err := n.x.eval(sc)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(sc)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(x, y), nil
+	case "!=":
+		return !exprEqual(x, y), nil
+	case "in":
+		if y == nil {
+			return false, nil
+		}
+		list, ok := y.([]interface{})
+		if !ok {
+			return nil, &PolicyError{Pos: n.pos, Msg: "right operand of in is not a list"}
+		}
+		for _, item := range list {
+			if exprEqual(x, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if x == nil || y == nil {
+		return false, nil
+	}
+	var c int
+	if xs, ok := x.(string); ok {
+		ys, ok := y.(string)
+		if !ok {
+			return nil, &PolicyError{Pos: n.pos, Msg: "cannot compare a string with another type"}
+		}
+		c = strings.Compare(xs, ys)
+	} else {
+		xf, okX := exprNumber(x)
+		yf, okY := exprNumber(y)
+		if !okX || !okY {
+			return nil, &PolicyError{Pos: n.pos, Msg: "cannot order values other than numbers and strings"}
+		}
+		switch {
+		case xf < yf:
+			c = -1
+		case xf > yf:
+			c = 1
+		}
+	}
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func exprNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func exprEqual(x, y interface{}) bool {
+	if xi, ok := x.(int64); ok {
+		if yi, ok := y.(int64); ok {
+			return xi == yi
+		}
+	}
+	if xf, ok := exprNumber(x); ok {
+		yf, ok := exprNumber(y)
+		return ok && xf == yf
+	}
+	if xl, ok := x.([]interface{}); ok {
+		yl, ok := y.([]interface{})
+		if !ok || len(xl) != len(yl) {
+			return false
+		}
+		for i := range xl {
+			if !exprEqual(xl[i], yl[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if _, ok := y.([]interface{}); ok {
+		return false
+	}
+	return x == y
+}
+
+type callNode struct {
+	fn   string
+	args []exprNode
+	pos  int
+}
+
+func (n *callNode) eval(sc *exprScope) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(sc)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch n.fn {
+	case "has":
+		return args[0] != nil, nil
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return int64(len([]rune(v))), nil
+		case []interface{}:
+			return int64(len(v)), nil
+		case nil:
+			return int64(0), nil
+		}
+		return nil, &PolicyError{Pos: n.pos, Msg: "size takes a string or a list"}
+	}
+	s, okS := args[0].(string)
+	prefix, okP := args[1].(string)
+	if args[0] == nil {
+		return false, nil
+	}
+	if !okS || !okP {
+		return nil, &PolicyError{Pos: n.pos, Msg: "startsWith takes strings"}
+	}
+	return strings.HasPrefix(s, prefix), nil
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The fuzz targets run their seeds with go test. To fuzz, e.g.:
+//
+//	go test -run '^$' -fuzz FuzzTokenUser ./lib/auth
+
+// fuzzServer creates a server (in JWT mode with jwt) with a user holding a session token and an
+// API key, which are returned.
+func fuzzServer(jwt *JWTConfig) (*Server, []TokenValue) {
+	svr, err := New(WithConfig(&ServerConfig{JWT: jwt}), WithTokenTTL(time.Hour),
+		WithClock(NewManualClock(time.Unix(1700000000, 0))), WithHasher(fastHasher))
+	if err != nil {
+		panic(err)
+	}
+	uid, _ := svr.CreateUser("elton", "passw0rd")
+	token, _ := svr.Authenticate("elton", "passw0rd")
+	key, _ := svr.CreateAPIKey(uid, "ci", nil, time.Time{})
+	return svr, []TokenValue{token, key}
+}
+
+func FuzzTokenUser(f *testing.F) {
+	opaque, opaqueTokens := fuzzServer(nil)
+	jwt, jwtTokens := fuzzServer(&JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")})
+	for _, v := range append(append([]TokenValue(nil), opaqueTokens...), jwtTokens...) {
+		f.Add(string(v))
+		f.Add(string(v[:len(v)-1]))
+		f.Add(string(v) + "A")
+		f.Add(strings.Replace(string(v), ".", "\n.", 1))
+	}
+	f.Add("")
+	f.Add(APIKeyPrefix)
+	f.Add("..")
+	f.Fuzz(func(t *testing.T, token string) {
+		id, err := opaque.TokenUser(TokenValue(token))
+		if tokenIn(opaqueTokens, TokenValue(token)) {
+			assert.Equal(t, UserID(1), id, "should accept the tokens issued")
+		} else {
+			assert.Equal(t, ErrInvalidToken, err, "should only accept the tokens issued")
+		}
+		// JWTs signed by other processes (fuzzing workers) are valid too, but only as issued
+		id, err = jwt.TokenUser(TokenValue(token))
+		if tokenIn(jwtTokens, TokenValue(token)) {
+			assert.Equal(t, UserID(1), id, "should accept the tokens issued")
+		} else if err == nil {
+			assert.Equal(t, true, canonicalJWT(token), "should only accept JWTs as issued")
+		} else {
+			assert.Equal(t, ErrInvalidToken, err, "should only accept the tokens issued")
+		}
+	})
+}
+
+func FuzzJWTVerify(f *testing.F) {
+	cfg := &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), Issuer: "hsbc"}
+	verifier, _ := NewJWTVerifier(HS256, []byte("s3cr3t"), "hsbc")
+	verifier.clock = NewManualClock(time.Unix(1700000000, 0))
+	valid, _ := SignJWT(cfg, JWTClaims{Subject: "1", Issuer: "hsbc", ExpiresAt: 1700000060})
+	f.Add(string(valid))
+	// Claims tampered with, and the signature spelled otherwise: with other trailing bits, which
+	// decode the same, and with a line break
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	last := strings.IndexByte(alphabet, valid[len(valid)-1])
+	f.Add(strings.Replace(string(valid), ".", ".e30", 1))
+	f.Add(string(valid[:len(valid)-1]) + alphabet[last^1:last^1+1])
+	f.Add(string(valid[:len(valid)-1]) + "\n" + string(valid[len(valid)-1:]))
+	f.Add(`eyJhbGciOiJub25lIn0.eyJzdWIiOiIxIn0.`)
+	f.Fuzz(func(t *testing.T, token string) {
+		claims, err := verifier.Verify(TokenValue(token))
+		if token == string(valid) {
+			assert.Equal(t, "1", claims.Subject, "should accept the token issued")
+		} else {
+			assert.Equal(t, ErrInvalidToken, err, "should only accept the token issued")
+		}
+	})
+}
+
+func FuzzParseHash(f *testing.F) {
+	for _, h := range []PasswordHasher{&Argon2idHasher{Time: 1, Memory: 64}, &ScryptHasher{LogN: 4}} {
+		hash, _ := h.Hash("passw0rd")
+		f.Add(string(hash))
+	}
+	f.Add("$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5")
+	f.Add("$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5")
+	f.Add("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$")
+	f.Add("$scrypt$ln=4,r=8,p=1$c2FsdA$")
+	f.Fuzz(func(t *testing.T, hash string) {
+		if a, err := parseArgon2id([]byte(hash)); err == nil {
+			assert.Equal(t, true, a.t >= 1 && a.p >= 1, "should only take the parameters of argon2.IDKey")
+			assert.NotEqual(t, 0, len(a.key), "should not take empty keys")
+		}
+		if sh, err := parseScrypt([]byte(hash)); err == nil {
+			assert.NotEqual(t, 0, len(sh.key), "should not take empty keys")
+		}
+	})
+}
+
+// canonicalJWT tells if the parts of a JWT are spelled as the signer does.
+func canonicalJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	for _, part := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil || base64.RawURLEncoding.EncodeToString(b) != part {
+			return false
+		}
+	}
+	return len(parts) == 3
+}
+
+func tokenIn(tokens []TokenValue, v TokenValue) bool {
+	for _, t := range tokens {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+)
+
+type GroupID int32
+
+// Group is a set of users that share roles. The effective roles of a user are the direct ones plus
+// those of all the groups the user is a member of. Membership is saved on the user, see User.Groups.
+type Group struct {
+	ID    GroupID
+	Name  string
+	Roles []RoleID `json:",omitempty"` // sorted
+}
+
+var (
+	ErrGroupExists   = newError("group_exists", http.StatusConflict, "group already exists")
+	ErrGroupNotExist = newError("group_not_exist", http.StatusNotFound, "group does not exist")
+)
+
+// clone returns a copy of the group. It returns nil for a nil group.
+func (g *Group) clone() *Group {
+	if g == nil {
+		return nil
+	}
+	c := *g
+	c.Roles = append([]RoleID(nil), g.Roles...)
+	return &c
+}
+
+// hasRole tells if a role is granted to the group.
+func (g *Group) hasRole(role RoleID) bool {
+	i := sort.Search(len(g.Roles), func(i int) bool { return g.Roles[i] >= role })
+	return i < len(g.Roles) && g.Roles[i] == role
+}
+
+// removeRole takes a role out of a group, which must be a clone.
+func (g *Group) removeRole(role RoleID) {
+	roles := g.Roles[:0]
+	for _, r := range g.Roles {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == 0 {
+		roles = nil
+	}
+	g.Roles = roles
+}
+
+// inGroup tells if the user is a member of a group.
+func (u *User) inGroup(group GroupID) bool {
+	i := sort.Search(len(u.Groups), func(i int) bool { return u.Groups[i] >= group })
+	return i < len(u.Groups) && u.Groups[i] == group
+}
+
+// *-* Public API *-*
+
+// CreateGroup adds a new group without members or roles.
+//
+// Returns: the ID of the new group
+// Errors: ErrGroupExists
+func (s *Server) CreateGroup(name string) (_ GroupID, err error) {
+	s, sp := s.trace("auth.CreateGroup")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.store.GetGroupByName(ctx, name); err == nil {
+		return 0, ErrGroupExists
+	} else if err != ErrGroupNotExist {
+		return 0, err
+	}
+	g := Group{Name: name}
+	if err := s.store.InsertGroup(ctx, &g); err != nil {
+		return 0, err
+	}
+	return g.ID, nil
+}
+
+// DeleteGroup removes a group. Its members lose the roles they had through it.
+//
+// Returns: none
+// Errors: ErrGroupNotExist
+func (s *Server) DeleteGroup(group GroupID) (err error) {
+	s, sp := s.trace("auth.DeleteGroup")
+	defer func() { sp.end(err) }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store.DeleteGroup(s.ctx, group)
+}
+
+// AddUserToGroup makes a user a member of a group. It is a no-op if the user already is.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrGroupNotExist
+func (s *Server) AddUserToGroup(user UserID, group GroupID) (err error) {
+	s, sp := s.trace("auth.AddUserToGroup")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetGroup(ctx, group); err != nil {
+		return err
+	}
+	if userObj.inGroup(group) {
+		return nil
+	}
+	userObj = userObj.clone()
+	userObj.Groups = append(userObj.Groups, group)
+	sort.Slice(userObj.Groups, func(i, j int) bool { return userObj.Groups[i] < userObj.Groups[j] })
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// RemoveUserFromGroup ends the membership of a user in a group. It is a no-op if the user is not a
+// member.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) RemoveUserFromGroup(user UserID, group GroupID) (err error) {
+	s, sp := s.trace("auth.RemoveUserFromGroup")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !userObj.inGroup(group) {
+		return nil
+	}
+	userObj = userObj.clone()
+	groups := userObj.Groups[:0]
+	for _, g := range userObj.Groups {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	if len(groups) == 0 {
+		groups = nil
+	}
+	userObj.Groups = groups
+	s.bumpSession(userObj)
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// AddRoleToGroup grants a role to all members of a group. It is a no-op if the group already has it.
+//
+// Returns: none
+// Errors: ErrGroupNotExist, ErrRoleNotExist
+func (s *Server) AddRoleToGroup(group GroupID, role RoleID) (err error) {
+	s, sp := s.trace("auth.AddRoleToGroup")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groupObj, err := s.store.GetGroup(ctx, group)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetRole(ctx, role); err != nil {
+		return err
+	}
+	if groupObj.hasRole(role) {
+		return nil
+	}
+	groupObj = groupObj.clone()
+	groupObj.Roles = append(groupObj.Roles, role)
+	sort.Slice(groupObj.Roles, func(i, j int) bool { return groupObj.Roles[i] < groupObj.Roles[j] })
+	return s.store.UpdateGroup(ctx, groupObj)
+}
+
+// RemoveRoleFromGroup revokes a role from a group. Members holding the role directly keep it.
+// It is a no-op if the group does not have the role.
+//
+// Returns: none
+// Errors: ErrGroupNotExist
+func (s *Server) RemoveRoleFromGroup(group GroupID, role RoleID) (err error) {
+	s, sp := s.trace("auth.RemoveRoleFromGroup")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groupObj, err := s.store.GetGroup(ctx, group)
+	if err != nil {
+		return err
+	}
+	if !groupObj.hasRole(role) {
+		return nil
+	}
+	groupObj = groupObj.clone()
+	groupObj.removeRole(role)
+	if err := s.store.UpdateGroup(ctx, groupObj); err != nil {
+		return err
+	}
+	return s.bumpGroupSessions(group)
+}
+
+// ListGroupMembers lists the IDs of the members of a group, in ascending order.
+//
+// Returns: a list of UserIDs
+// Errors: ErrGroupNotExist
+func (s *Server) ListGroupMembers(group GroupID) (_ []UserID, err error) {
+	s, sp := s.trace("auth.ListGroupMembers")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.store.GetGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	return s.store.GroupMembers(ctx, group)
+}
+
+// effectiveRoles returns the IDs of the direct roles of a user, plus those granted to the groups
+// of the user. Groups that no longer exist are skipped.
+func (s *Server) effectiveRoles(u *User) (map[RoleID]struct{}, error) {
+	roles := make(map[RoleID]struct{}, len(u.Roles))
+	now := s.now()
+	for role := range u.Roles {
+		if u.unexpired(role, now) {
+			roles[role] = struct{}{}
+		}
+	}
+	for _, group := range u.Groups {
+		g, err := s.store.GetGroup(s.ctx, group)
+		if err == ErrGroupNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, role := range g.Roles {
+			roles[role] = struct{}{}
+		}
+	}
+	return roles, nil
+}
+
+// groupsGrant tells if a group of a user grants it a role, without gathering all its roles like
+// effectiveRoles. Groups that no longer exist are skipped.
+func (s *Server) groupsGrant(u *User, role RoleID) (bool, error) {
+	for _, group := range u.Groups {
+		g, err := s.store.GetGroup(s.ctx, group)
+		if err == ErrGroupNotExist {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if g.hasRole(role) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
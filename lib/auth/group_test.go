@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroups(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	uid2, _ := svr.CreateUser("fred", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.GrantPermissionToRole(rid2, "devices:plug")
+	gid, err := svr.CreateGroup("staff")
+	assert.Equal(t, nil, err, "should success")
+	{
+		_, err := svr.CreateGroup("staff")
+		assert.Equal(t, ErrGroupExists, err, "should not create another group with the same name")
+		assert.Equal(t, ErrGroupNotExist, svr.AddUserToGroup(uid, 101), "should give ErrGroupNotExist")
+		assert.Equal(t, ErrUserNotExist, svr.AddUserToGroup(101, gid), "should give ErrUserNotExist")
+		assert.Equal(t, ErrRoleNotExist, svr.AddRoleToGroup(gid, 101), "should give ErrRoleNotExist")
+		_, err = svr.ListGroupMembers(101)
+		assert.Equal(t, ErrGroupNotExist, err, "should give ErrGroupNotExist")
+	}
+
+	svr.AddRoleToUser(uid, rid)
+	assert.Equal(t, nil, svr.AddRoleToGroup(gid, rid2), "should success")
+	assert.Equal(t, nil, svr.AddRoleToGroup(gid, rid2), "should be a no-op")
+	assert.Equal(t, nil, svr.AddUserToGroup(uid, gid), "should success")
+	assert.Equal(t, nil, svr.AddUserToGroup(uid2, gid), "should success")
+	assert.Equal(t, nil, svr.AddUserToGroup(uid2, gid), "should be a no-op")
+	assert.Equal(t, &Group{ID: gid, Name: "staff", Roles: []RoleID{rid2}}, svr.GetGroupByName("staff"), "should grant the role to the group")
+	{
+		members, err := svr.ListGroupMembers(gid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []UserID{uid, uid2}, members, "should list the members")
+		users, _ := svr.ListUsersWithRole(rid2)
+		assert.Equal(t, []UserID{}, users, "should only list direct holders of the role")
+	}
+
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		ok, err := svr.CheckRole(token, rid2)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should have the role of the group")
+		roles, _ := svr.AllRoles(token)
+		assert.ElementsMatch(t, []RoleID{rid, rid2}, roles, "should include direct and group roles")
+		ok, _ = svr.CheckPermission(token, "devices:plug")
+		assert.Equal(t, true, ok, "should have the permissions of the group roles")
+	}
+	{
+		assert.Equal(t, nil, svr.RemoveUserFromGroup(uid, gid), "should success")
+		assert.Equal(t, nil, svr.RemoveUserFromGroup(uid, gid), "should be a no-op")
+		ok, _ := svr.CheckRole(token, rid2)
+		assert.Equal(t, false, ok, "should lose the role of the group")
+		members, _ := svr.ListGroupMembers(gid)
+		assert.Equal(t, []UserID{uid2}, members, "should update the members")
+	}
+	{
+		svr.AddUserToGroup(uid, gid)
+		svr.AddRoleToUser(uid, rid2)
+		assert.Equal(t, nil, svr.RemoveRoleFromGroup(gid, rid2), "should success")
+		ok, _ := svr.CheckRole(token, rid2)
+		assert.Equal(t, true, ok, "should keep a role that is also held directly")
+		svr.AddRoleToGroup(gid, rid)
+		assert.Equal(t, nil, svr.DeleteGroup(gid), "should success")
+		assert.Equal(t, ErrGroupNotExist, svr.DeleteGroup(gid), "should not be able to repeatedly delete a group")
+		roles, err := svr.AllRoles(token)
+		assert.Equal(t, nil, err, "should ignore deleted groups")
+		assert.ElementsMatch(t, []RoleID{rid, rid2}, roles, "should keep direct roles")
+		var nilGroup *Group
+		assert.Equal(t, nilGroup, svr.GetGroup(gid), "should return nil for a deleted group")
+	}
+}
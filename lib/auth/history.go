@@ -0,0 +1,96 @@
+package auth
+
+import "time"
+
+// defaultLoginHistorySize is the default of ServerConfig.LoginHistorySize.
+const defaultLoginHistorySize = 10
+
+// LoginRecord describes a login attempt with the right username, as seen by the server.
+type LoginRecord struct {
+	Time      time.Time
+	Success   bool   `json:",omitempty"`
+	IP        string `json:",omitempty"` // from the ClientInfo of the login, if any
+	UserAgent string `json:",omitempty"`
+}
+
+// LoginHistory is kept on each user that has tried to log in, see GetLoginHistory.
+type LoginHistory struct {
+	LastSuccess *LoginRecord `json:",omitempty"`
+	LastFailure *LoginRecord `json:",omitempty"`
+	// Recent holds the last logins, oldest first, up to ServerConfig.LoginHistorySize of them
+	Recent []LoginRecord `json:",omitempty"`
+}
+
+func (h *LoginHistory) clone() *LoginHistory {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	if h.LastSuccess != nil {
+		r := *h.LastSuccess
+		c.LastSuccess = &r
+	}
+	if h.LastFailure != nil {
+		r := *h.LastFailure
+		c.LastFailure = &r
+	}
+	c.Recent = append([]LoginRecord(nil), h.Recent...)
+	return &c
+}
+
+// GetLoginHistory lists the recent logins of a user, newest first, e.g. to show "last signed in"
+// or to investigate an account. Logins with a password and CompleteMFA are recorded, successful or
+// not; tokens from IssueToken are not. The history holds at most ServerConfig.LoginHistorySize
+// entries, and User.Logins also keeps the last success and failure.
+//
+// Returns: the logins
+// Errors: ErrUserNotExist
+func (s *Server) GetLoginHistory(user UserID) (_ []LoginRecord, err error) {
+	s, sp := s.trace("auth.GetLoginHistory")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	list := []LoginRecord{}
+	if userObj.Logins == nil {
+		return list, nil
+	}
+	for i := len(userObj.Logins.Recent) - 1; i >= 0; i-- {
+		list = append(list, userObj.Logins.Recent[i])
+	}
+	return list, nil
+}
+
+// recordLogin saves a login attempt in the history of a user, and reports it to subscribers.
+// Errors are ignored, as they must not fail the login. The caller must hold s.mu.
+func (s *Server) recordLogin(user UserID, client ClientInfo, success bool) {
+	ctx := s.ctx
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return
+	}
+	r := LoginRecord{Time: s.now(), Success: success, IP: client.IP, UserAgent: client.UserAgent}
+	userObj = userObj.clone()
+	if userObj.Logins == nil {
+		userObj.Logins = &LoginHistory{}
+	}
+	h := userObj.Logins
+	if success {
+		h.LastSuccess = &r
+	} else {
+		h.LastFailure = &r
+	}
+	h.Recent = append(h.Recent, r)
+	if n := len(h.Recent) - s.cfg.LoginHistorySize; n > 0 {
+		h.Recent = append([]LoginRecord(nil), h.Recent[n:]...)
+	}
+	_ = s.store.UpdateUser(ctx, userObj)
+
+	e := Event{Type: EventLoginFailed, User: user, Name: userObj.Name, IP: client.IP, UserAgent: client.UserAgent}
+	if success {
+		e.Type = EventLoginSucceeded
+	}
+	s.emit(e)
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginHistory(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher, LoginHistorySize: 3})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	{
+		list, err := svr.GetLoginHistory(uid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []LoginRecord{}, list, "should start empty")
+		_, err = svr.GetLoginHistory(101)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist for nonexistent users")
+	}
+	{
+		svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: "192.0.2.1"})
+		svr.AuthenticateClient("anna", "wrong", ClientInfo{IP: "198.51.100.7", UserAgent: "curl/8.0"})
+		svr.Authenticate("belle", "wrong")
+		list, _ := svr.GetLoginHistory(uid)
+		assert.Equal(t, 2, len(list), "should record logins of the user only")
+		assert.Equal(t, false, list[0].Success, "should list the newest login first")
+		assert.Equal(t, "curl/8.0", list[0].UserAgent, "should record the client")
+		assert.Equal(t, true, list[1].Success, "should record successful logins")
+		logins := svr.GetUser(uid).Logins
+		assert.Equal(t, "192.0.2.1", logins.LastSuccess.IP, "should keep the last success")
+		assert.Equal(t, "198.51.100.7", logins.LastFailure.IP, "should keep the last failure")
+	}
+	{
+		svr.SuspendUser(uid)
+		svr.Authenticate("anna", "passw0rd")
+		svr.ReactivateUser(uid)
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		list, _ := svr.GetLoginHistory(uid)
+		assert.Equal(t, 3, len(list), "should keep a bounded history")
+		assert.Equal(t, []bool{true, false, false}, []bool{list[0].Success, list[1].Success, list[2].Success},
+			"should count suspended users as failures, and drop the oldest")
+		assert.Equal(t, list[0].Time, svr.GetUser(uid).Logins.LastSuccess.Time, "should keep the last success")
+		svr.Invalidate(token)
+	}
+	{
+		e, _ := svr.EnrollTOTP(uid)
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		// Confirm with the previous step, so that the current code is still unused
+		svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod-1))
+		challenge, _ := svr.Authenticate("anna", "passw0rd")
+		list, _ := svr.GetLoginHistory(uid)
+		pending := list[0].Time
+		svr.CompleteMFA(challenge, currentCode(e))
+		list, _ = svr.GetLoginHistory(uid)
+		assert.Equal(t, pending, list[1].Time, "should not record a login pending MFA")
+		assert.Equal(t, true, list[0].Success, "should record the login after MFA")
+	}
+	{
+		_, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, LoginHistorySize: -1})
+		assert.Equal(t, ErrInvalidConfig, err, "should reject a negative size")
+	}
+}
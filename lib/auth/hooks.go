@@ -0,0 +1,73 @@
+package auth
+
+import "context"
+
+// Interceptor runs around operations of the server, see ServerConfig.Interceptors and
+// WithInterceptors, so that integrators can add validation, enrichment, rate limiting or auditing
+// without forking the package. It calls next to carry on with the operation (and the interceptors
+// after it), or returns an error instead to reject it:
+//
+//	func requireCorpNames(op *auth.Operation, next func() error) error {
+//		if op.Method == "CreateUser" && !strings.HasSuffix(op.Name, "@corp.example") {
+//			return auth.ErrInvalidUsername
+//		}
+//		return next()
+//	}
+//
+// The fields of op are the arguments of the operation when called, and its results after next
+// returns. The server takes the arguments from op when next is called and the results when the
+// interceptor returns, so it can change them, e.g. normalize a name or deny a check. Its error is
+// that of the operation; for Invalidate, which has none, it is dropped.
+//
+// Interceptors run synchronously, on the goroutine of the caller and while it waits, unlike the
+// subscribers of Subscribe. No lock of the server is held, so they may call it, e.g. to look a user
+// up, keeping in mind that the operations they call are intercepted too.
+type Interceptor func(op *Operation, next func() error) error
+
+// Operation is a call of a server operation, as seen by its interceptors. Fields that do not apply
+// to the method are left empty. Passwords are not given.
+//
+// These methods are intercepted: CreateUser, DeleteUser, CreateRole, AddRoleToUser,
+// RemoveRoleFromUser and GrantPermissionToRole; Authenticate, AuthenticateClient and
+// AuthenticateScoped; Invalidate, TokenUser, CheckRole, CheckPermission and AllRoles.
+type Operation struct {
+	// Method is the name of the method, e.g. "CreateUser", that of its span without "auth.".
+	Method string
+	// Context is that of the server (see WithContext), carrying the span of the method with a
+	// Tracer. The operation runs on the context set by the interceptors, e.g. to add values for a
+	// Storage.
+	Context context.Context
+
+	// Name is the user name of CreateUser and the Authenticate methods, or the role name of
+	// CreateRole.
+	Name       string
+	Role       RoleID
+	Permission string
+	// Token is that of the token operations, or the token issued by the Authenticate methods, once
+	// done (an MFA challenge with ErrMFARequired).
+	Token  TokenValue
+	Client ClientInfo // of AuthenticateClient and AuthenticateScoped
+
+	// User is the user operated on: the argument of DeleteUser, AddRoleToUser and
+	// RemoveRoleFromUser, or the result of CreateUser and TokenUser, once done.
+	User UserID
+	// Allowed is the result of CheckRole and CheckPermission, and Roles that of AllRoles, once
+	// done.
+	Allowed bool
+	Roles   []RoleID
+}
+
+// intercept runs an operation through the interceptors of the server. run carries it out on the
+// server bound to op.Context, reading its arguments from op and setting its results there.
+func (s *Server) intercept(op *Operation, run func(s *Server) error) error {
+	op.Context = s.ctx
+	chain := s.cfg.Interceptors
+	var call func(i int) error
+	call = func(i int) error {
+		if i == len(chain) {
+			return run(s.WithContext(op.Context))
+		}
+		return chain[i](op, func() error { return call(i + 1) })
+	}
+	return call(0)
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type hookKey struct{}
+
+func TestInterceptors(t *testing.T) {
+	var calls []string
+	var last Operation
+	audit := func(op *Operation, next func() error) error {
+		calls = append(calls, "audit:"+op.Method)
+		err := next()
+		last = *op
+		return err
+	}
+	normalize := func(op *Operation, next func() error) error {
+		calls = append(calls, "normalize:"+op.Method)
+		op.Name = strings.ToLower(op.Name)
+		return next()
+	}
+	var denied RoleID
+	policy := func(op *Operation, next func() error) error {
+		if op.Method == "CreateUser" && strings.HasPrefix(op.Name, "root") {
+			return ErrInvalidUsername
+		}
+		if op.Context.Value(hookKey{}) == "cancel" {
+			ctx, cancel := context.WithCancel(op.Context)
+			cancel()
+			op.Context = ctx
+		}
+		err := next()
+		if op.Method == "CheckRole" && op.Role == denied {
+			op.Allowed = false
+		}
+		return err
+	}
+	svr, _ := New(WithHasher(fastHasher), WithInterceptors(audit, normalize), WithInterceptors(policy))
+	{
+		uid, err := svr.CreateUser("Anna", "passw0rd")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []string{"audit:CreateUser", "normalize:CreateUser"}, calls, "should run the interceptors in order")
+		assert.Equal(t, uid, svr.GetUserByName("anna").ID, "should take the arguments changed by the interceptors")
+		last.Context = nil
+		assert.Equal(t, Operation{Method: "CreateUser", Name: "anna", User: uid}, last, "should tell the results")
+		_, err = svr.CreateUser("rootkit", "passw0rd")
+		assert.Equal(t, ErrInvalidUsername, err, "should reject operations")
+		assert.Equal(t, (*User)(nil), svr.GetUserByName("rootkit"), "should not run rejected operations")
+	}
+	{
+		ctx := context.WithValue(context.Background(), hookKey{}, "cancel")
+		_, err := svr.WithContext(ctx).CreateUser("bella", "passw0rd")
+		assert.Equal(t, context.Canceled, err, "should run on the context set by the interceptors")
+		assert.Equal(t, "cancel", last.Context.Value(hookKey{}), "should give the context of the server")
+	}
+	{
+		token, err := svr.AuthenticateClient("ANNA", "passw0rd", ClientInfo{IP: "10.0.0.1"})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "AuthenticateClient", last.Method, "should intercept the variants of Authenticate")
+		assert.Equal(t, ClientInfo{IP: "10.0.0.1"}, last.Client, "should tell the client")
+		assert.Equal(t, token, last.Token, "should tell the token issued")
+		uid, _ := svr.TokenUser(token)
+		assert.Equal(t, uid, last.User, "should tell the user of the token")
+
+		rid, _ := svr.CreateRole("clerk")
+		other, _ := svr.CreateRole("auditor")
+		svr.AddRoleToUser(uid, rid)
+		svr.AddRoleToUser(uid, other)
+		denied = other
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should keep the results")
+		ok, _ = svr.CheckRole(token, other)
+		assert.Equal(t, false, ok, "should take the results changed by the interceptors")
+		assert.Equal(t, true, last.Method == "CheckRole" && last.Role == other, "should tell the arguments")
+		roles, _ := svr.AllRoles(token)
+		assert.Equal(t, roles, last.Roles, "should tell the roles")
+
+		calls = nil
+		svr.Invalidate(token)
+		assert.Equal(t, "audit:Invalidate", calls[0], "should intercept Invalidate")
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate")
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// IDGenerator makes the IDs of new users, instead of the counter of the storage, see
+// ServerConfig.UserIDs. Counted IDs tell how many accounts there are, and collide when the users of
+// several instances are merged. Role and group IDs are always counted.
+type IDGenerator interface {
+	// NewID returns a positive ID, unique with high probability.
+	NewID() (int64, error)
+}
+
+// RandomIDs makes random 53-bit IDs, the counterpart of random UUIDs for the integer IDs of this
+// package. They stay exact in JSON numbers read by JavaScript. Collisions are unlikely (about one
+// in 2^25 after a million users), and retried.
+type RandomIDs struct{}
+
+func (RandomIDs) NewID() (int64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := int64(binary.BigEndian.Uint64(b[:]) & (1<<53 - 1)); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// snowflakeEpoch is the zero time of Snowflake IDs.
+var snowflakeEpoch = time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake makes time-ordered 63-bit IDs: 41 bits of milliseconds since 2022-09-01, 10 bits of
+// node, and a 12-bit sequence within the millisecond. Instances with different nodes never
+// collide. IDs beyond 2^53 are not exact in JavaScript numbers, so JavaScript clients of the REST
+// API should use RandomIDs instead.
+//
+// It is safe for concurrent use.
+type Snowflake struct {
+	node int64
+
+	mu   sync.Mutex
+	last int64 // milliseconds of the last ID
+	seq  int64
+}
+
+// NewSnowflake creates a Snowflake for a node from 0 to 1023.
+//
+// Returns: pointer to the new generator
+// Errors: ErrInvalidConfig
+func NewSnowflake(node int) (*Snowflake, error) {
+	if node < 0 || node >= 1<<10 {
+		return nil, ErrInvalidConfig
+	}
+	return &Snowflake{node: int64(node)}, nil
+}
+
+func (f *Snowflake) NewID() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ms := time.Since(snowflakeEpoch).Milliseconds()
+	switch {
+	case ms > f.last:
+		f.last, f.seq = ms, 0
+	case f.seq < 1<<12-1:
+		// Same millisecond, or the clock went back: keep counting from the last one
+		f.seq++
+	default:
+		// Sequence exhausted, borrow the next millisecond rather than waiting for it
+		f.last, f.seq = f.last+1, 0
+	}
+	return f.last<<22 | f.node<<12 | f.seq, nil
+}
+
+// insertUser saves a new user, with an ID from ServerConfig.UserIDs if set. The caller must hold
+// s.mu, and have checked that the name is free.
+//
+// Errors: ErrUserExists, ErrTooManyUsers, ErrInternal, or any error from the store
+func (s *Server) insertUser(ctx context.Context, u *User) error {
+	if err := s.checkUserLimit(ctx); err != nil {
+		return err
+	}
+	if s.cfg.UserIDs == nil {
+		return s.store.InsertUser(ctx, u)
+	}
+	for attempt := 1; ; attempt++ {
+		id, err := s.cfg.UserIDs.NewID()
+		if err != nil || id <= 0 {
+			return ErrInternal
+		}
+		u.ID = UserID(id)
+		err = s.store.InsertUser(ctx, u)
+		// The name is free, so ErrUserExists means that the ID is taken
+		if err != ErrUserExists || attempt == 3 {
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seqIDs gives the IDs in turn, for testing collisions.
+type seqIDs []int64
+
+func (g *seqIDs) NewID() (int64, error) {
+	id := (*g)[0]
+	*g = (*g)[1:]
+	return id, nil
+}
+
+func TestIDGenerators(t *testing.T) {
+	{
+		seen := make(map[int64]bool)
+		for i := 0; i < 1000; i++ {
+			id, _ := RandomIDs{}.NewID()
+			assert.Equal(t, true, id > 0 && id < 1<<53, "should be positive and exact in JavaScript")
+			seen[id] = true
+		}
+		assert.Equal(t, 1000, len(seen), "should not repeat")
+	}
+	{
+		_, err := NewSnowflake(1024)
+		assert.Equal(t, ErrInvalidConfig, err, "should check the node")
+		f, _ := NewSnowflake(5)
+		var last int64
+		for i := 0; i < 10000; i++ {
+			id, _ := f.NewID()
+			if id <= last {
+				t.Fatalf("should make increasing IDs, got %d after %d", id, last)
+			}
+			last = id
+		}
+		assert.Equal(t, int64(5), last>>12&(1<<10-1), "should carry the node")
+	}
+	{
+		gen := seqIDs{42, 42, 7}
+		svr, _ := New(WithHasher(fastHasher), WithUserIDs(&gen))
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		assert.Equal(t, UserID(42), uid, "should use the generator")
+		uid, _ = svr.CreateUser("belle", "passw0rd")
+		assert.Equal(t, UserID(7), uid, "should retry taken IDs")
+		_, err := svr.CreateUser("belle", "passw0rd")
+		assert.Equal(t, ErrUserExists, err, "should still reject taken names")
+	}
+	{
+		m := NewMemoryStorage()
+		m.StartIDs(1000, 0)
+		m.StartIDs(10, 50)
+		u := &User{Name: "anna"}
+		m.InsertUser(context.Background(), u)
+		r := &Role{Name: "admin"}
+		m.InsertRole(context.Background(), r)
+		assert.Equal(t, [2]int64{1000, 50}, [2]int64{int64(u.ID), int64(r.ID)}, "should start from the given IDs")
+	}
+}
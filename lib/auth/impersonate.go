@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+)
+
+var ErrImpersonationDenied = newError("impersonation_denied", http.StatusForbidden, "impersonation not permitted")
+
+// Actor identifies the user acting through an impersonation token, in the shape of the "act"
+// claim of OAuth 2.0 token exchange (RFC 8693). See Impersonate.
+type Actor struct {
+	Sub      string `json:"sub"` // the user ID, in decimal
+	Username string `json:"username,omitempty"`
+	UserID   UserID `json:"user_id"`
+}
+
+// Impersonate issues a session token that acts as another user, for support staff debugging what
+// that user sees: the token is checked with the roles and permissions of user, while the user of
+// the admin token is recorded as its actor, see TokenInfo, Introspect, and the Actor of the events
+// it causes. It requires the permission named by ServerConfig.ImpersonatePermission, which users
+// holding it cannot be impersonated with, so that it does not grant more than it already does.
+// Impersonation tokens cannot impersonate in turn, are left out of ServerConfig.MaxSessions, and
+// stop verifying as soon as their actor is deleted or suspended. For ServerConfig.StepUp, they are
+// authenticated like the admin token, with the AuthLevel of a password for API keys.
+//
+// Returns: the token string
+// Errors: ErrInvalidToken for the admin token, ErrImpersonationDenied, ErrUserNotExist,
+// ErrUserSuspended, ErrUnsupported without ImpersonatePermission or in JWT mode, ErrInternal
+func (s *Server) Impersonate(admin TokenValue, user UserID, client ClientInfo) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.Impersonate")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	perm := s.cfg.ImpersonatePermission
+	if perm == "" || s.jwt != nil {
+		return "", ErrUnsupported
+	}
+	ctx := s.ctx
+	ok, actor, err := s.checkPermission(admin, perm)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrImpersonationDenied
+	}
+	var a authn
+	if t, err := s.store.GetToken(ctx, admin); err == nil {
+		if t.Actor != 0 {
+			return "", ErrImpersonationDenied
+		}
+		a = t.authn()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if userObj.Status == UserSuspended {
+		return "", ErrUserSuspended
+	}
+	if ok, err := s.userPermission(userObj, nil, perm); err != nil {
+		return "", err
+	} else if ok || user == actor {
+		return "", ErrImpersonationDenied
+	}
+	token, err := s.newToken(userObj)
+	if err != nil {
+		return "", err
+	}
+	token.Client = client
+	token.Actor = actor
+	token.Level, token.AuthTime = a.level, a.at
+	if err := s.store.InsertToken(ctx, token); err != nil {
+		return "", err
+	}
+	s.emit(Event{Type: EventImpersonated, User: user, Name: userObj.Name, Actor: actor, TokenID: token.ID(),
+		IP: client.IP, UserAgent: client.UserAgent})
+	return token.Value, nil
+}
+
+// checkActor verifies that the actor of an impersonation token can still act.
+// The caller must hold s.mu (at least for reading).
+//
+// Errors: ErrInvalidToken
+func (s *Server) checkActor(t *Token) error {
+	if t.Actor == 0 {
+		return nil
+	}
+	actorObj, err := s.getUser(s.ctx, t.Actor)
+	if err == ErrUserNotExist {
+		return ErrInvalidToken
+	} else if err != nil {
+		return err
+	}
+	if actorObj.Status == UserSuspended {
+		return ErrInvalidToken
+	}
+	s.traceActor(t.Actor)
+	return nil
+}
+
+// actor describes the actor of an impersonation token, for Introspect.
+func (s *Server) actor(id UserID) *Actor {
+	a := &Actor{Sub: strconv.FormatInt(int64(id), 10), UserID: id}
+	if u, err := s.getUser(s.ctx, id); err == nil {
+		a.Username = u.Name
+	}
+	return a
+}
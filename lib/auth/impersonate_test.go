@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonate(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, MaxSessions: 1, ImpersonatePermission: "users:impersonate"}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	support, _ := svr.CreateUser("support", "passw0rd")
+	boss, _ := svr.CreateUser("boss", "passw0rd")
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	staff, _ := svr.CreateRole("support")
+	svr.GrantPermissionToRole(staff, "users:impersonate")
+	svr.AddRoleToUser(support, staff)
+	svr.AddRoleToUser(boss, staff)
+	clerk, _ := svr.CreateRole("clerk")
+	svr.GrantPermissionToRole(clerk, "orders:read")
+	svr.AddRoleToUser(anna, clerk)
+	admin, _ := svr.Authenticate("support", "passw0rd")
+	session, _ := svr.Authenticate("anna", "passw0rd")
+	next, cancel := collect(svr, EventImpersonated, EventTokenRevoked)
+	defer cancel()
+	var token TokenValue
+	{
+		var err error
+		token, err = svr.Impersonate(admin, anna, ClientInfo{IP: "10.0.0.1"})
+		assert.Equal(t, nil, err, "should success")
+		e := next(1)[0]
+		assert.Equal(t, [2]UserID{anna, support}, [2]UserID{e.User, e.Actor}, "should emit user.impersonated with both users")
+		assert.Equal(t, "10.0.0.1", e.IP, "should record the client")
+		ok, _ := svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should act as the user")
+		ok, _ = svr.CheckPermission(token, "users:impersonate")
+		assert.Equal(t, false, ok, "should not keep the rights of the actor")
+		_, err = svr.TokenUser(session)
+		assert.Equal(t, nil, err, "should not count against MaxSessions")
+	}
+	{
+		in, _ := svr.Introspect(token)
+		assert.Equal(t, anna, in.UserID, "should introspect as the user")
+		assert.Equal(t, &Actor{Sub: "1", Username: "support", UserID: support}, in.Act, "should tell the actor")
+		in, _ = svr.Introspect(session)
+		assert.Equal(t, (*Actor)(nil), in.Act, "should have no actor for other tokens")
+		tokens, _ := svr.ListTokens(anna)
+		assert.Equal(t, [2]UserID{0, support}, [2]UserID{tokens[0].Actor, tokens[1].Actor}, "should list the actor")
+	}
+	{
+		_, err := svr.Impersonate(session, support, ClientInfo{})
+		assert.Equal(t, ErrImpersonationDenied, err, "should require the permission")
+		_, err = svr.Impersonate(admin, boss, ClientInfo{})
+		assert.Equal(t, ErrImpersonationDenied, err, "should not impersonate users holding the permission")
+		_, err = svr.Impersonate(token, anna, ClientInfo{})
+		assert.Equal(t, ErrImpersonationDenied, err, "should not chain impersonations")
+		_, err = svr.Impersonate(admin, anna+9, ClientInfo{})
+		assert.Equal(t, ErrUserNotExist, err, "should check the user")
+		_, err = svr.Impersonate("invalid", anna, ClientInfo{})
+		assert.Equal(t, ErrInvalidToken, err, "should check the admin token")
+	}
+	{
+		svr.Invalidate(token)
+		e := next(1)[0]
+		assert.Equal(t, [2]UserID{anna, support}, [2]UserID{e.User, e.Actor}, "should tell the actor of revoked tokens")
+		token, _ = svr.Impersonate(admin, anna, ClientInfo{})
+		next(1)
+		svr.SuspendUser(support)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should stop with the actor")
+	}
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		_, err := svr.Impersonate(admin, anna, ClientInfo{})
+		assert.Equal(t, ErrUnsupported, err, "should be disabled by default")
+		_, err = NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, ImpersonatePermission: "users::impersonate"})
+		assert.Equal(t, ErrInvalidConfig, err, "should check the permission")
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Introspection describes a token in the shape of an OAuth 2.0 token introspection response
+// (RFC 7662), so that API gateways can validate tokens the standard way. Only Active is set for
+// invalid tokens. UserID, Roles and Realm are extensions.
+type Introspection struct {
+	Active bool `json:"active"`
+	// Scope lists the permissions the token is limited to, separated by spaces, if any. See
+	// TokenScope.
+	Scope     string `json:"scope,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"` // always "Bearer"
+	Exp       int64  `json:"exp,omitempty"`        // Unix seconds, none for API keys that do not expire
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"` // the user ID, in decimal
+	Iss       string `json:"iss,omitempty"` // the issuer of JWTs
+	Jti       string `json:"jti,omitempty"` // the ID of the token, as in TokenInfo or APIKeyInfo
+
+	UserID UserID   `json:"user_id,omitempty"`
+	Roles  []RoleID `json:"roles,omitempty"` // sorted, as AllRoles gives them
+	// Realm is that of the server, see Realms
+	Realm string `json:"realm,omitempty"`
+	// The ClientInfo of session tokens, see AuthenticateClient
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// Act is the user acting through an impersonation token, see Impersonate
+	Act *Actor `json:"act,omitempty"`
+	// AuthTime (Unix seconds, none for API keys) and AuthLevel tell when and how the user
+	// authenticated, see StepUp
+	AuthTime  int64     `json:"auth_time,omitempty"`
+	AuthLevel AuthLevel `json:"auth_level,omitempty"`
+}
+
+// Introspect describes a session token, API key or JWT. Tokens that do not verify, for whatever
+// reason, are reported as inactive rather than with an error, as RFC 7662 requires.
+//
+// Returns: the description of the token
+// Errors: any error from the store
+func (s *Server) Introspect(token TokenValue) (_ *Introspection, err error) {
+	s, sp := s.trace("auth.Introspect")
+	defer func() { sp.end(err) }()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, scope, a, err := s.verifyAuthn(token)
+	if err == ErrInvalidToken {
+		return &Introspection{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	in := &Introspection{
+		Active:    true,
+		Username:  userObj.Name,
+		TokenType: "Bearer",
+		Sub:       strconv.FormatInt(int64(userObj.ID), 10),
+		UserID:    userObj.ID,
+		AuthLevel: a.level,
+		Realm:     s.realm,
+	}
+	if !a.at.IsZero() {
+		in.AuthTime = a.at.Unix()
+	}
+	if scope != nil {
+		in.Scope = strings.Join(scope.Permissions, " ")
+	}
+
+	switch {
+	case strings.HasPrefix(string(token), APIKeyPrefix):
+		_, id, _ := parseAPIKey(token)
+		key := userObj.APIKeys[id]
+		in.Iat, in.Jti = key.Created.Unix(), id
+		if !key.Expires.IsZero() {
+			in.Exp = key.Expires.Unix()
+		}
+	case s.jwt != nil:
+		claims, err := s.jwt.verify(token)
+		if err != nil {
+			return &Introspection{}, nil
+		}
+		in.Iat, in.Exp, in.Jti, in.Iss = claims.IssuedAt, claims.ExpiresAt, claims.ID, claims.Issuer
+	default:
+		tokenObj, err := s.store.GetToken(s.ctx, token)
+		if err == ErrInvalidToken {
+			return &Introspection{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		in.Iat, in.Exp, in.Jti = tokenObj.Issued.Unix(), tokenObj.Expires.Unix(), tokenObj.ID()
+		in.IP, in.UserAgent, in.Device = tokenObj.Client.IP, tokenObj.Client.UserAgent, tokenObj.Client.Device
+		if tokenObj.Actor != 0 {
+			in.Act = s.actor(tokenObj.Actor)
+		}
+	}
+
+	if in.Roles, err = s.scopedRoles(userObj, scope); err != nil {
+		return nil, err
+	}
+	sort.Slice(in.Roles, func(i, j int) bool { return in.Roles[i] < in.Roles[j] })
+	return in, nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospect(t *testing.T) {
+	start := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	svr, _ := New(WithClock(clock), WithHasher(fastHasher), WithTokenTTL(time.Minute))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	reader, _ := svr.CreateRole("reader")
+	writer, _ := svr.CreateRole("writer")
+	svr.GrantPermissionToRole(reader, "orders:read")
+	svr.AddRoleToUser(uid, reader)
+	svr.AddRoleToUser(uid, writer)
+	{
+		in, err := svr.Introspect("invalid")
+		assert.Equal(t, nil, err, "should not fail on invalid tokens")
+		assert.Equal(t, &Introspection{}, in, "should report invalid tokens as inactive only")
+	}
+	{
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		tokens, _ := svr.ListTokens(uid)
+		in, _ := svr.Introspect(token)
+		assert.Equal(t, &Introspection{
+			Active:    true,
+			Username:  "anna",
+			TokenType: "Bearer",
+			Exp:       start.Add(time.Minute).Unix(),
+			Iat:       start.Unix(),
+			Sub:       strconv.FormatInt(int64(uid), 10),
+			Jti:       tokens[0].ID,
+			UserID:    uid,
+			Roles:     []RoleID{reader, writer},
+			AuthTime:  start.Unix(),
+		}, in, "should describe session tokens")
+
+		clock.Advance(2 * time.Minute)
+		in, _ = svr.Introspect(token)
+		assert.Equal(t, false, in.Active, "should report expired tokens as inactive")
+	}
+	{
+		token, _ := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{reader}})
+		in, _ := svr.Introspect(token)
+		assert.Equal(t, []RoleID{reader}, in.Roles, "should limit the roles to the scope")
+		token, _ = svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Permissions: []string{"orders:read", "orders:list"}})
+		in, _ = svr.Introspect(token)
+		assert.Equal(t, "orders:read orders:list", in.Scope, "should list the permissions of the scope")
+	}
+	{
+		client := ClientInfo{IP: "192.0.2.1", UserAgent: "phone/1.0", Device: "Anna's phone"}
+		token, _ := svr.AuthenticateClient("anna", "passw0rd", client)
+		in, _ := svr.Introspect(token)
+		assert.Equal(t, client, ClientInfo{IP: in.IP, UserAgent: in.UserAgent, Device: in.Device}, "should describe the client")
+	}
+	{
+		expires := clock.Now().Add(24 * time.Hour).Truncate(time.Second)
+		key, _ := svr.CreateAPIKey(uid, "ci", []string{"orders:read"}, expires)
+		keys, _ := svr.ListAPIKeys(uid)
+		in, _ := svr.Introspect(key)
+		assert.Equal(t, true, in.Active, "should describe API keys")
+		assert.Equal(t, expires.Unix(), in.Exp, "should tell the expiry of API keys")
+		assert.Equal(t, clock.Now().Unix(), in.Iat, "should tell the creation of API keys")
+		assert.Equal(t, keys[0].ID, in.Jti, "should identify API keys")
+		assert.Equal(t, "orders:read", in.Scope, "should list the scopes of API keys")
+	}
+	{
+		jwtSvr, _ := New(WithConfig(&ServerConfig{JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), Issuer: "hsbc"}}),
+			WithClock(clock), WithHasher(fastHasher), WithTokenTTL(time.Minute))
+		id, _ := jwtSvr.CreateUser("belle", "passw0rd")
+		token, _ := jwtSvr.Authenticate("belle", "passw0rd")
+		in, _ := jwtSvr.Introspect(token)
+		assert.Equal(t, true, in.Active, "should describe JWTs")
+		assert.Equal(t, "hsbc", in.Iss, "should tell the issuer of JWTs")
+		assert.Equal(t, clock.Now().Add(time.Minute).Unix(), in.Exp, "should tell the expiry of JWTs")
+		assert.Equal(t, id, in.UserID, "should identify the user")
+		assert.NotEqual(t, "", in.Jti, "should identify JWTs")
+	}
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWK is a public key in the format of RFC 7517, for verifiers of JWTs. Ed25519 keys are encoded as
+// in RFC 8037.
+type JWK struct {
+	Type      string       `json:"kty"`
+	Use       string       `json:"use"`
+	Algorithm JWTAlgorithm `json:"alg"`
+	KeyID     string       `json:"kid,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is a JWK set, as served at a "jwks_uri".
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK derives the public key to publish from a signing key. Shared secrets (HS256) cannot be
+// published.
+//
+// Returns: the public key
+// Errors: ErrInvalidConfig (for shared secrets, and keys not matching the algorithm)
+func NewJWK(cfg *JWTConfig) (*JWK, error) {
+	enc := jwtEncoding
+	key := JWK{Use: "sig", Algorithm: cfg.Algorithm, KeyID: cfg.KeyID}
+	switch k := cfg.Key.(type) {
+	case *rsa.PrivateKey:
+		if cfg.Algorithm != RS256 {
+			return nil, ErrInvalidConfig
+		}
+		key.Type = "RSA"
+		key.N = enc.EncodeToString(k.N.Bytes())
+		key.E = enc.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case ed25519.PrivateKey:
+		if cfg.Algorithm != EdDSA || len(k) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidConfig
+		}
+		key.Type = "OKP"
+		key.Curve = "Ed25519"
+		key.X = enc.EncodeToString(k.Public().(ed25519.PublicKey))
+	default:
+		return nil, ErrInvalidConfig
+	}
+	return &key, nil
+}
+
+// Verifier makes a JWTVerifier from the key, rejecting tokens of other issuers if issuer is not
+// empty.
+//
+// Returns: pointer to the new verifier
+// Errors: ErrInvalidConfig (for unsupported or malformed keys)
+func (k *JWK) Verifier(issuer string) (*JWTVerifier, error) {
+	var pub interface{}
+	switch {
+	case k.Type == "RSA" && k.Algorithm == RS256:
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, ErrInvalidConfig
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidConfig
+		}
+		pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case k.Type == "OKP" && k.Curve == "Ed25519" && k.Algorithm == EdDSA:
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, ErrInvalidConfig
+		}
+		pub = ed25519.PublicKey(x)
+	default:
+		return nil, ErrInvalidConfig
+	}
+	return NewJWTVerifier(k.Algorithm, pub, issuer)
+}
+
+// JWKSet gives the public keys of the JWTs of the server, for other services to verify them, e.g.
+// with lib/authclient: the signing key first, then those retired by a rotation that still verify
+// (see RotateJWTKey). Shared secrets are left out.
+//
+// Returns: the key set
+// Errors: ErrUnsupported (if not in JWT mode, or with shared secrets only)
+func (s *Server) JWKSet() (*JWKSet, error) {
+	if s.jwt == nil {
+		return nil, ErrUnsupported
+	}
+	set := &JWKSet{Keys: []JWK{}}
+	for _, signer := range s.jwt.published() {
+		if key, err := NewJWK(&signer.cfg); err == nil {
+			set.Keys = append(set.Keys, *key)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, ErrUnsupported
+	}
+	return set, nil
+}
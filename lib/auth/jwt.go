@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JWTAlgorithm string
+
+const (
+	HS256 JWTAlgorithm = "HS256"
+	RS256 JWTAlgorithm = "RS256"
+	EdDSA JWTAlgorithm = "EdDSA"
+)
+
+// JWTConfig makes the server issue signed JWTs instead of opaque tokens.
+// The type of Key depends on Algorithm:
+//   - HS256: []byte, the shared secret
+//   - RS256: *rsa.PrivateKey
+//   - EdDSA: ed25519.PrivateKey
+type JWTConfig struct {
+	Algorithm JWTAlgorithm
+	Key       interface{}
+	Issuer    string
+	// KeyID, if set, is put in the "kid" header, for verifiers picking the key from a JWK set.
+	KeyID string
+}
+
+// JWTClaims is the payload of the JWTs issued by the server.
+// The user ID is carried in "sub" as a decimal string, as required by RFC 7519.
+type JWTClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	Name      string   `json:"name,omitempty"`
+	Roles     []RoleID `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	// Scope is set for tokens limited to part of what the user is granted, see TokenScope.
+	// Roles are then only those in the scope.
+	Scope *TokenScope `json:"token_scope,omitempty"`
+	// SessionVersion is that of the user at issuance, see ServerConfig.SessionVersioning.
+	SessionVersion uint32 `json:"sv,omitempty"`
+	// AuthTime (as in OpenID Connect) and AuthLevel tell when and how the user authenticated, see
+	// StepUp.
+	AuthTime  int64     `json:"auth_time,omitempty"`
+	AuthLevel AuthLevel `json:"auth_level,omitempty"`
+	// Realm is that of the server, see Realms. Servers reject the JWTs of other realms.
+	Realm string `json:"realm,omitempty"`
+}
+
+// UserID parses the subject of the claims.
+func (c *JWTClaims) UserID() (UserID, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return UserID(id), nil
+}
+
+// Expires converts the "exp" claim to time.
+func (c *JWTClaims) Expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+type jwtHeader struct {
+	Algorithm JWTAlgorithm `json:"alg"`
+	Type      string       `json:"typ"`
+	KeyID     string       `json:"kid,omitempty"`
+}
+
+// jwtEncoding is strict, so that decoding rejects nonzero trailing bits; see decodeJWTSegment.
+var jwtEncoding = base64.RawURLEncoding.Strict()
+
+// JWTVerifier validates the JWTs issued by a server, without access to its storage.
+// It can be used by other services that share (or know the public part of) the signing key.
+type JWTVerifier struct {
+	alg    JWTAlgorithm
+	key    interface{}
+	issuer string
+	clock  Clock // that of the server, for those of a server
+}
+
+// NewJWTVerifier creates a JWTVerifier. The type of key depends on alg:
+//   - HS256: []byte, the shared secret
+//   - RS256: *rsa.PublicKey
+//   - EdDSA: ed25519.PublicKey
+//
+// If issuer is not empty, tokens from other issuers are rejected.
+//
+// Returns: pointer to the new verifier
+// Errors: ErrInvalidConfig
+func NewJWTVerifier(alg JWTAlgorithm, key interface{}, issuer string) (*JWTVerifier, error) {
+	switch k := key.(type) {
+	case []byte:
+		if alg != HS256 || len(k) == 0 {
+			return nil, ErrInvalidConfig
+		}
+	case *rsa.PublicKey:
+		if alg != RS256 {
+			return nil, ErrInvalidConfig
+		}
+	case ed25519.PublicKey:
+		if alg != EdDSA || len(k) != ed25519.PublicKeySize {
+			return nil, ErrInvalidConfig
+		}
+	default:
+		return nil, ErrInvalidConfig
+	}
+	return &JWTVerifier{alg: alg, key: key, issuer: issuer, clock: SystemClock}, nil
+}
+
+// WithClock makes a copy of the verifier that checks expiry by another clock than SystemClock,
+// such as that of a server.
+//
+// Returns: pointer to the new verifier
+func (v *JWTVerifier) WithClock(clock Clock) *JWTVerifier {
+	c := *v
+	c.clock = clock
+	return &c
+}
+
+// Verify checks the signature, issuer and expiry of a token.
+// The algorithm in the token header must match that of the verifier.
+//
+// Returns: the claims in the token
+// Errors: ErrInvalidToken
+func (v *JWTVerifier) Verify(token TokenValue) (*JWTClaims, error) {
+	var claims JWTClaims
+	if err := v.VerifyInto(token, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// VerifyInto works like Verify, for JWTs with other claims than JWTClaims, such as those made with
+// SignJWT. The payload is decoded into claims with encoding/json.
+//
+// Returns: none
+// Errors: ErrInvalidToken
+func (v *JWTVerifier) VerifyInto(token TokenValue, claims interface{}) error {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Algorithm != v.alg {
+		return ErrInvalidToken
+	}
+	sig, err := decodeJWTSegment(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.verifySignature(signed, sig) {
+		return ErrInvalidToken
+	}
+
+	// The registered claims are checked apart, as claims may not have them
+	var std struct {
+		Issuer    string `json:"iss"`
+		ExpiresAt int64  `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &std); err != nil {
+		return ErrInvalidToken
+	}
+	if v.issuer != "" && std.Issuer != v.issuer {
+		return ErrInvalidToken
+	}
+	if !v.clock.Now().Before(time.Unix(std.ExpiresAt, 0)) {
+		return ErrInvalidToken
+	}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (v *JWTVerifier) verifySignature(signed, sig []byte) bool {
+	switch k := v.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := decodeJWTSegment(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decodeJWTSegment decodes a part of a JWT, only in the encoding that the signer makes, so that a
+// token is spelled one way: the decoder also skips line breaks, which the length check rejects.
+func decodeJWTSegment(part string) ([]byte, error) {
+	b, err := jwtEncoding.DecodeString(part)
+	if err == nil && jwtEncoding.EncodedLen(len(b)) != len(part) {
+		return nil, ErrInvalidToken
+	}
+	return b, err
+}
+
+// *-* Issuing *-*
+
+// jwtSigner is built from JWTConfig when the server starts.
+type jwtSigner struct {
+	cfg      JWTConfig
+	verifier *JWTVerifier
+}
+
+// newJWTSigner validates the config and derives the matching verifier.
+func newJWTSigner(cfg *JWTConfig) (*jwtSigner, error) {
+	var pub interface{}
+	switch k := cfg.Key.(type) {
+	case []byte:
+		pub = k
+	case *rsa.PrivateKey:
+		pub = &k.PublicKey
+	case ed25519.PrivateKey:
+		if len(k) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidConfig
+		}
+		pub = k.Public()
+	default:
+		return nil, ErrInvalidConfig
+	}
+	v, err := NewJWTVerifier(cfg.Algorithm, pub, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtSigner{cfg: *cfg, verifier: v}, nil
+}
+
+// SignJWT signs arbitrary claims with the key of cfg, for JWTs other than those of the server, such
+// as OpenID Connect ID tokens. The claims are encoded with encoding/json.
+//
+// Returns: the JWT
+// Errors: ErrInvalidConfig, or any error from encoding the claims
+func SignJWT(cfg *JWTConfig, claims interface{}) (TokenValue, error) {
+	j, err := newJWTSigner(cfg)
+	if err != nil {
+		return "", err
+	}
+	return j.sign(claims)
+}
+
+// sign encodes and signs the claims.
+func (j *jwtSigner) sign(claims interface{}) (TokenValue, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: j.cfg.Algorithm, Type: "JWT", KeyID: j.cfg.KeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtEncoding.EncodeToString(header) + "." + jwtEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch k := j.cfg.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return TokenValue(signed + "." + jwtEncoding.EncodeToString(sig)), nil
+}
+
+// newJWT issues a JWT for a user, carrying its current roles within the scope.
+func (s *Server) newJWT(u *User, scope *TokenScope, level AuthLevel) (TokenValue, error) {
+	b := make([]byte, 12)
+	if err := s.random(b); err != nil {
+		return "", err
+	}
+	signer := s.signingKey()
+	now := s.now()
+	claims := JWTClaims{
+		Issuer:         signer.cfg.Issuer,
+		Subject:        strconv.FormatInt(int64(u.ID), 10),
+		Name:           u.Name,
+		Roles:          make([]RoleID, 0, len(u.Roles)),
+		IssuedAt:       now.Unix(),
+		ExpiresAt:      now.Add(time.Duration(s.live().TokenExpireSec) * time.Second).Unix(),
+		ID:             jwtEncoding.EncodeToString(b),
+		Scope:          scope,
+		SessionVersion: u.SessionVersion,
+		AuthTime:       now.Unix(),
+		AuthLevel:      level,
+		Realm:          s.realm,
+	}
+	roles, err := s.effectiveRoles(u)
+	if err != nil {
+		return "", err
+	}
+	if scope != nil {
+		scope.limit(roles)
+	}
+	for role := range roles {
+		claims.Roles = append(claims.Roles, role)
+	}
+	return signer.sign(&claims)
+}
+
+// verifyJWT checks a JWT issued by the server, and reads its user from the store so that deletion
+// and suspension apply at once. The returned user is rebuilt from the claims, so its roles are
+// those at the time of issuance.
+// The scope, if any, and how the user authenticated come from the claims too.
+func (s *Server) verifyJWT(t TokenValue) (*User, *TokenScope, authn, error) {
+	claims, err := s.jwt.verify(t)
+	if err != nil {
+		return nil, nil, authn{}, err
+	}
+	if claims.Realm != s.realm || s.isRevoked(claims.ID) {
+		return nil, nil, authn{}, ErrInvalidToken
+	}
+	id, err := claims.UserID()
+	if err != nil {
+		return nil, nil, authn{}, err
+	}
+	// One read per check, as deletion and suspension must apply to tokens that are already out
+	stored, err := s.store.GetUser(s.ctx, id)
+	if err == ErrUserNotExist {
+		return nil, nil, authn{}, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, authn{}, err
+	}
+	// An older session version without SessionVersioning is that of a deletion, see softDeleteUser
+	if stored.Status == UserSuspended || stored.Deleted != nil || !s.currentSession(stored, claims.SessionVersion) ||
+		claims.SessionVersion < stored.SessionVersion {
+		return nil, nil, authn{}, ErrInvalidToken
+	}
+	u := User{
+		ID:    id,
+		Name:  claims.Name,
+		Roles: make(map[RoleID]*Role, len(claims.Roles)),
+	}
+	// Deny rules apply at once, like suspension
+	u.Denied = stored.Denied
+	u.ResourceRoles = stored.ResourceRoles
+	u.Attributes = stored.Attributes
+	for _, role := range claims.Roles {
+		u.Roles[role] = &Role{ID: role}
+	}
+	at := claims.AuthTime
+	if at == 0 {
+		at = claims.IssuedAt
+	}
+	return &u, claims.Scope, authn{level: claims.AuthLevel, at: time.Unix(at, 0)}, nil
+}
+
+// revokeJWT records the ID of a JWT until it expires, and publishes it to the other servers if
+// configured. Malformed tokens are ignored.
+func (s *Server) revokeJWT(t TokenValue) {
+	claims, err := s.jwt.verify(t)
+	if err != nil {
+		return
+	}
+	r := Revocation{ID: claims.ID, Expires: claims.Expires()}
+	if s.recordRevocation(r) && s.cfg.Revocations != nil {
+		// Not under tokenMu, as it may take a network round trip. A failure leaves the token
+		// revoked on this server only.
+		_ = s.cfg.Revocations.Publish(s.ctx, r)
+	}
+	if id, err := claims.UserID(); err == nil {
+		s.emit(Event{Type: EventTokenRevoked, User: id, Name: claims.Name, TokenID: claims.ID})
+	}
+}
+
+func (s *Server) isRevoked(jti string) bool {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	_, ok := s.revoked[jti]
+	return ok
+}
+
+// pruneRevoked forgets the revocations of expired JWTs. The caller must hold s.tokenMu.
+func (s *Server) pruneRevoked() {
+	now := s.now()
+	for jti, exp := range s.revoked {
+		if now.After(exp) {
+			delete(s.revoked, jti)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTConfig(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	var nilServer *Server
+	{
+		svr, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: priv}})
+		assert.Equal(t, nilServer, svr, "should return nil if the key does not match the algorithm")
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if the key does not match the algorithm")
+	}
+	{
+		_, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte{}}})
+		assert.Equal(t, ErrInvalidConfig, err, "should give ErrInvalidConfig if the secret is empty")
+	}
+}
+
+func TestJWTMode(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	cases := []struct {
+		cfg JWTConfig
+		pub interface{}
+	}{
+		{JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), Issuer: "hsbc"}, []byte("s3cr3t")},
+		{JWTConfig{Algorithm: RS256, Key: rsaKey, Issuer: "hsbc"}, &rsaKey.PublicKey},
+		{JWTConfig{Algorithm: EdDSA, Key: edPriv, Issuer: "hsbc"}, edPub},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(string(c.cfg.Algorithm), func(t *testing.T) {
+			svr, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &c.cfg})
+			assert.Equal(t, nil, err, "should success")
+			uid, _ := svr.CreateUser("elton", "123456")
+			rid, _ := svr.CreateRole("scanner")
+			rid2, _ := svr.CreateRole("plugdev")
+			rid3, _ := svr.CreateRole("staff")
+			gid, _ := svr.CreateGroup("staff")
+			svr.AddRoleToUser(uid, rid)
+			svr.AddRoleToGroup(gid, rid3)
+			svr.AddUserToGroup(uid, gid)
+
+			token, err := svr.Authenticate("elton", "123456")
+			assert.Equal(t, nil, err, "should success")
+			assert.Equal(t, 3, len(strings.Split(string(token), ".")), "should be a JWT")
+			assert.Equal(t, 0, len(memTokens(svr)), "should not store the token")
+
+			verifier, _ := NewJWTVerifier(c.cfg.Algorithm, c.pub, "hsbc")
+			claims, err := verifier.Verify(token)
+			assert.Equal(t, nil, err, "should be verifiable by other services")
+			id, _ := claims.UserID()
+			assert.Equal(t, uid, id, "should carry the user ID")
+			assert.ElementsMatch(t, []RoleID{rid, rid3}, claims.Roles, "should carry the roles, including those of the groups")
+
+			ok, err := svr.CheckRole(token, rid)
+			assert.Equal(t, nil, err, "should success")
+			assert.Equal(t, true, ok, "should have the role scanner")
+			ok, _ = svr.CheckRole(token, rid2)
+			assert.Equal(t, false, ok, "should not have the role plugdev")
+
+			svr.Invalidate(token)
+			_, err = svr.AllRoles(token)
+			assert.Equal(t, ErrInvalidToken, err, "the token should be invalidated")
+		})
+	}
+}
+
+func TestJWTDeletedUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, Hasher: fastHasher, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "123456")
+	ok, _ := svr.CheckRole(token, rid)
+	assert.Equal(t, true, ok, "should have the role")
+	svr.DeleteUser(uid)
+	{
+		ok, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the tokens of deleted users")
+		assert.Equal(t, false, ok, "should not have the role")
+		_, err = svr.AllRoles(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not list the roles of deleted users")
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	svr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), Issuer: "hsbc"}})
+	svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	parts := strings.Split(string(token), ".")
+	{
+		v, _ := NewJWTVerifier(HS256, []byte("wrong"), "")
+		_, err := v.Verify(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject a wrong signature")
+	}
+	{
+		v, _ := NewJWTVerifier(HS256, []byte("s3cr3t"), "other")
+		_, err := v.Verify(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject other issuers")
+	}
+	{
+		none := jwtEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+		_, err := svr.CheckRole(TokenValue(none+"."+parts[1]+"."), 1)
+		assert.Equal(t, ErrInvalidToken, err, "should reject unsigned tokens")
+	}
+	{
+		expired := &JWTClaims{Subject: "1", IssuedAt: 1, ExpiresAt: 2, ID: "x"}
+		tok, _ := svr.jwt.current().sign(expired)
+		_, err := svr.AllRoles(tok)
+		assert.Equal(t, ErrInvalidToken, err, "should reject expired tokens")
+	}
+	{
+		_, err := svr.AllRoles("a.b")
+		assert.Equal(t, ErrInvalidToken, err, "should reject malformed tokens")
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	cfg := JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), KeyID: "k1"}
+	token, err := SignJWT(&cfg, map[string]interface{}{"sub": "1", "exp": 4102444800, "aud": "app"})
+	assert.Equal(t, nil, err, "should success")
+	var header jwtHeader
+	decodeJWTPart(strings.Split(string(token), ".")[0], &header)
+	assert.Equal(t, "k1", header.KeyID, "should set the key ID")
+	v, _ := NewJWTVerifier(HS256, []byte("s3cr3t"), "")
+	claims, err := v.Verify(token)
+	assert.Equal(t, nil, err, "should be verifiable")
+	assert.Equal(t, "1", claims.Subject, "should carry the claims")
+	var custom struct {
+		Audience string `json:"aud"`
+	}
+	assert.Equal(t, nil, v.VerifyInto(token, &custom), "should success")
+	assert.Equal(t, "app", custom.Audience, "should decode other claims")
+	other, _ := SignJWT(&cfg, map[string]interface{}{"exp": 1})
+	assert.Equal(t, ErrInvalidToken, v.VerifyInto(other, &custom), "should check the expiry")
+
+	_, err = SignJWT(&JWTConfig{Algorithm: RS256, Key: []byte("s3cr3t")}, nil)
+	assert.Equal(t, ErrInvalidConfig, err, "should reject a key not matching the algorithm")
+}
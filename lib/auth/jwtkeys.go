@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtKeys holds the signing keys of JWT mode: the active one signs, retired ones still verify until
+// the end of their grace period. See ServerConfig.JWTRotationSec and RotateJWTKey.
+type jwtKeys struct {
+	clock Clock
+
+	mu      sync.RWMutex
+	active  *jwtSigner
+	since   time.Time // when active started signing
+	retired []retiredKey
+}
+
+type retiredKey struct {
+	signer *jwtSigner
+	until  time.Time
+}
+
+const rsaKeyBits = 2048
+
+func newJWTKeys(cfg *JWTConfig, clock Clock) (*jwtKeys, error) {
+	k := &jwtKeys{clock: clock}
+	signer, err := k.signerOf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	k.active, k.since = signer, clock.Now()
+	return k, nil
+}
+
+// signerOf validates a key, and makes its signer, verifying with the clock of the server.
+func (k *jwtKeys) signerOf(cfg *JWTConfig) (*jwtSigner, error) {
+	signer, err := newJWTSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	signer.verifier.clock = k.clock
+	return signer, nil
+}
+
+// current gives the active key.
+func (k *jwtKeys) current() *jwtSigner {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// published gives the keys that still verify, the active one first.
+func (k *jwtKeys) published() []*jwtSigner {
+	now := k.clock.Now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := []*jwtSigner{k.active}
+	for _, r := range k.retired {
+		if now.Before(r.until) {
+			keys = append(keys, r.signer)
+		}
+	}
+	return keys
+}
+
+// verify checks a JWT with the key named by its "kid" header, if that key still verifies.
+//
+// Errors: ErrInvalidToken
+func (k *jwtKeys) verify(t TokenValue) (*JWTClaims, error) {
+	kid, ok := jwtKeyID(t)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	for _, signer := range k.published() {
+		if signer.cfg.KeyID == kid {
+			return signer.verifier.Verify(t)
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// rotate makes next the active key, and retires the current one until grace from now. A zero
+// grace drops it right away. Keys past their grace period are forgotten. If from is set, nothing
+// happens unless it is still the active key.
+//
+// Errors: ErrInvalidConfig
+func (k *jwtKeys) rotate(from *jwtSigner, next *JWTConfig, grace time.Duration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if from != nil && k.active != from {
+		return nil
+	}
+	if next.Issuer == "" {
+		next.Issuer = k.active.cfg.Issuer
+	}
+	if next.KeyID == "" || next.Issuer != k.active.cfg.Issuer {
+		return ErrInvalidConfig
+	}
+	now := k.clock.Now()
+	retired := make([]retiredKey, 0, len(k.retired)+1)
+	for _, r := range k.retired {
+		if now.Before(r.until) {
+			retired = append(retired, r)
+		}
+	}
+	if grace > 0 {
+		retired = append(retired, retiredKey{signer: k.active, until: now.Add(grace)})
+	}
+	for _, r := range append(retired, retiredKey{signer: k.active}) {
+		if r.signer.cfg.KeyID == next.KeyID {
+			return ErrInvalidConfig
+		}
+	}
+	signer, err := k.signerOf(next)
+	if err != nil {
+		return err
+	}
+	k.active, k.since, k.retired = signer, now, retired
+	return nil
+}
+
+// jwtKeyID reads the "kid" header of a JWT, without checking anything else. It is empty if the
+// header has none.
+func jwtKeyID(t TokenValue) (string, bool) {
+	i := strings.IndexByte(string(t), '.')
+	if i < 0 {
+		return "", false
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(string(t[:i]), &header); err != nil {
+		return "", false
+	}
+	return header.KeyID, true
+}
+
+// generateJWTKey makes a new key of the algorithm, with a random key ID, drawn from r.
+func generateJWTKey(alg JWTAlgorithm, issuer string, r io.Reader) (*JWTConfig, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, err
+	}
+	cfg := &JWTConfig{Algorithm: alg, Issuer: issuer, KeyID: base64.RawURLEncoding.EncodeToString(id)}
+	switch alg {
+	case HS256:
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(r, secret); err != nil {
+			return nil, err
+		}
+		cfg.Key = secret
+	case RS256:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Key = key
+	case EdDSA:
+		_, key, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Key = key
+	default:
+		return nil, ErrInvalidConfig
+	}
+	return cfg, nil
+}
+
+// *-* Server *-*
+
+// RotateJWTKey makes next the signing key of JWT mode, or a new key of the same algorithm if next
+// is nil, and keeps the current key verifying for grace, so that the tokens it signed live out
+// their lifetime. A zero grace drops it right away, e.g. when it leaked. Keys are picked by the
+// "kid" header, so next needs a KeyID not used by the keys that still verify, and the issuer of
+// the server, if its Issuer is set. JWKSet publishes all of them. On the server of a realm, the
+// key of next is derived for the realm as that of CreateRealm, see RealmJWTConfig.
+//
+// Keys live in memory: servers sharing the storage must be given the same keys, from a shared
+// source, as those rotated on one are unknown to the others.
+//
+// Returns: the ID of the new key
+// Errors: ErrUnsupported (if not in JWT mode), ErrInvalidConfig, ErrInternal
+func (s *Server) RotateJWTKey(next *JWTConfig, grace time.Duration) (_ string, err error) {
+	s, sp := s.trace("auth.RotateJWTKey")
+	defer func() { sp.end(err) }()
+	if s.jwt == nil {
+		return "", ErrUnsupported
+	}
+	if next == nil {
+		cur := s.jwt.current().cfg
+		if next, err = generateJWTKey(cur.Algorithm, cur.Issuer, s.cfg.Rand); err != nil {
+			return "", ErrInternal
+		}
+	} else if s.realm != "" {
+		if next, err = RealmJWTConfig(next, s.realm); err != nil {
+			return "", err
+		}
+	} else {
+		cfg := *next
+		next = &cfg
+	}
+	if err := s.jwt.rotate(nil, next, grace); err != nil {
+		return "", err
+	}
+	return next.KeyID, nil
+}
+
+// signingKey gives the key to sign new JWTs with, rotating it first if ServerConfig.JWTRotationSec
+// is due. A failed rotation keeps the current key, and is tried again with the next token.
+func (s *Server) signingKey() *jwtSigner {
+	k := s.jwt
+	interval := time.Duration(s.cfg.JWTRotationSec) * time.Second
+	if interval <= 0 {
+		return k.current()
+	}
+	k.mu.RLock()
+	signer, due := k.active, !s.now().Before(k.since.Add(interval))
+	k.mu.RUnlock()
+	if !due {
+		return signer
+	}
+	next, err := generateJWTKey(signer.cfg.Algorithm, signer.cfg.Issuer, s.cfg.Rand)
+	if err != nil {
+		return signer
+	}
+	// A no-op if rotated in the meantime
+	_ = k.rotate(signer, next, s.jwtGrace())
+	return k.current()
+}
+
+// jwtGrace is how long the keys rotated on schedule keep verifying.
+func (s *Server) jwtGrace() time.Duration {
+	if s.cfg.JWTGraceSec > 0 {
+		return time.Duration(s.cfg.JWTGraceSec) * time.Second
+	}
+	return time.Duration(s.live().TokenExpireSec) * time.Second
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateJWTKey(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	cfg := &ServerConfig{TokenExpireSec: 600, JWT: &JWTConfig{Algorithm: EdDSA, Key: priv, Issuer: "auth", KeyID: "k1"}}
+	svr, _ := New(WithConfig(cfg), WithClock(clock), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	old, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		_, next, _ := ed25519.GenerateKey(rand.Reader)
+		kid, err := svr.RotateJWTKey(&JWTConfig{Algorithm: EdDSA, Key: next, KeyID: "k2"}, 10*time.Minute)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "k2", kid, "should tell the key ID")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, "k2", keyIDOf(token), "should sign with the new key")
+		_, err = svr.TokenUser(old)
+		assert.Equal(t, nil, err, "should verify tokens of the old key during the grace period")
+		set, _ := svr.JWKSet()
+		assert.Equal(t, []string{"k2", "k1"}, keyIDs(set), "should publish both keys")
+		want, _ := NewJWK(cfg.JWT)
+		assert.Equal(t, *want, set.Keys[1], "should publish the old key")
+	}
+	{
+		_, err := svr.RotateJWTKey(&JWTConfig{Algorithm: EdDSA, Key: priv, KeyID: "k1"}, 0)
+		assert.Equal(t, ErrInvalidConfig, err, "should not reuse the ID of a key that still verifies")
+		_, err = svr.RotateJWTKey(&JWTConfig{Algorithm: EdDSA, Key: priv}, 0)
+		assert.Equal(t, ErrInvalidConfig, err, "should require an ID")
+		_, err = svr.RotateJWTKey(&JWTConfig{Algorithm: EdDSA, Key: priv, KeyID: "k3", Issuer: "other"}, 0)
+		assert.Equal(t, ErrInvalidConfig, err, "should keep the issuer")
+	}
+	{
+		clock.Advance(10 * time.Minute)
+		_, err := svr.TokenUser(old)
+		assert.Equal(t, ErrInvalidToken, err, "should drop the old key after the grace period")
+		kid, err := svr.RotateJWTKey(nil, 0)
+		assert.Equal(t, nil, err, "should generate a key")
+		set, _ := svr.JWKSet()
+		assert.Equal(t, []string{kid}, keyIDs(set), "should drop the previous key without grace")
+	}
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		_, err := svr.RotateJWTKey(nil, 0)
+		assert.Equal(t, ErrUnsupported, err, "should require JWT mode")
+	}
+}
+
+func TestJWTRotationSchedule(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	cfg := &ServerConfig{TokenExpireSec: 600, JWTRotationSec: 3600, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}}
+	svr, _ := New(WithConfig(cfg), WithClock(clock), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	first, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		clock.Advance(59 * time.Minute)
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, "", keyIDOf(token), "should keep the key until due")
+		clock.Advance(time.Minute)
+		token, _ = svr.Authenticate("anna", "passw0rd")
+		assert.NotEqual(t, "", keyIDOf(token), "should rotate when due")
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should verify with the new key")
+	}
+	{
+		clock.Advance(9 * time.Minute)
+		kept, _ := svr.Authenticate("anna", "passw0rd")
+		_, err := svr.TokenUser(first)
+		assert.Equal(t, ErrInvalidToken, err, "should expire the tokens of the old key as usual")
+		clock.Advance(2 * time.Minute)
+		_, err = svr.TokenUser(kept)
+		assert.Equal(t, nil, err, "should keep the new key")
+	}
+	{
+		_, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 600, JWTRotationSec: 3600})
+		assert.Equal(t, ErrInvalidConfig, err, "should require JWT mode")
+	}
+}
+
+func keyIDOf(token TokenValue) string {
+	kid, _ := jwtKeyID(token)
+	return kid
+}
+
+func keyIDs(set *JWKSet) []string {
+	ids := make([]string, len(set.Keys))
+	for i, k := range set.Keys {
+		ids[i] = k.KeyID
+	}
+	return ids
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// ServerConfig.MaxUsers and friends bound the memory of the server, and the size of its storage,
+// against callers creating entities without end. Users and roles are counted by the storage;
+// tokens as they are queued for pruning, which is where an attacker calling Authenticate or
+// RequestPasswordReset over and over would make the server grow.
+
+var (
+	ErrTooManyUsers  = newError("too_many_users", http.StatusInsufficientStorage, "too many users")
+	ErrTooManyRoles  = newError("too_many_roles", http.StatusInsufficientStorage, "too many roles")
+	ErrTooManyTokens = newError("too_many_tokens", http.StatusInsufficientStorage, "too many tokens")
+)
+
+// validLimits tells if the limits of a config are usable with a storage.
+func validLimits(config *ServerConfig, store Storage) bool {
+	if config.MaxUsers < 0 || config.MaxRoles < 0 || config.MaxTokens < 0 || config.MaxTokensPerUser < 0 {
+		return false
+	}
+	_, counted := store.(Counter)
+	return counted || (config.MaxUsers == 0 && config.MaxRoles == 0)
+}
+
+// checkUserLimit makes sure that there is room for a new user. The caller must hold s.mu.
+//
+// Errors: ErrTooManyUsers, or any error from the storage
+func (s *Server) checkUserLimit(ctx context.Context) error {
+	if s.cfg.MaxUsers <= 0 {
+		return nil
+	}
+	counts, err := s.baseStore().(Counter).Count(ctx)
+	if err != nil {
+		return err
+	}
+	if counts.Users >= s.cfg.MaxUsers {
+		return ErrTooManyUsers
+	}
+	return nil
+}
+
+// checkRoleLimit makes sure that there is room for n new roles. The caller must hold s.mu.
+//
+// Errors: ErrTooManyRoles, or any error from the storage
+func (s *Server) checkRoleLimit(ctx context.Context, n int) error {
+	if s.cfg.MaxRoles <= 0 || n == 0 {
+		return nil
+	}
+	counts, err := s.baseStore().(Counter).Count(ctx)
+	if err != nil {
+		return err
+	}
+	if counts.Roles+int64(n) > s.cfg.MaxRoles {
+		return ErrTooManyRoles
+	}
+	return nil
+}
+
+// checkTokenLimit makes sure that there is room for a new token of a user in the queue, and among
+// the live tokens of the user. The caller must hold s.tokenMu.
+//
+// Errors: ErrTooManyTokens, or any error from the storage
+func (s *Server) checkTokenLimit(user UserID) error {
+	if s.cfg.MaxTokens > 0 && s.queued >= s.cfg.MaxTokens {
+		return ErrTooManyTokens
+	}
+	if s.cfg.MaxTokensPerUser <= 0 {
+		return nil
+	}
+	tokens, err := s.store.UserTokens(s.ctx, user)
+	if err != nil {
+		return err
+	}
+	now, live := s.now(), 0
+	for _, t := range tokens {
+		if now.Before(t.Expires) {
+			live++
+		}
+	}
+	if live >= s.cfg.MaxTokensPerUser {
+		return ErrTooManyTokens
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+	{
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxUsers: 2, MaxRoles: 1}), WithHasher(fastHasher))
+		anna, _ := svr.CreateUser("anna", "passw0rd")
+		svr.CreateUser("elton", "123456")
+		_, err := svr.CreateUser("belle", "123456")
+		assert.Equal(t, ErrTooManyUsers, err, "should reject users beyond MaxUsers")
+		_, _, err = svr.CreateServiceAccount("ci")
+		assert.Equal(t, ErrTooManyUsers, err, "should count service accounts")
+		svr.DeleteUser(anna)
+		_, err = svr.CreateUser("belle", "123456")
+		assert.Equal(t, nil, err, "should make room on deletion")
+
+		svr.CreateRole("clerk")
+		_, err = svr.CreateRole("editor")
+		assert.Equal(t, ErrTooManyRoles, err, "should reject roles beyond MaxRoles")
+		_, err = svr.Apply(&Spec{Roles: []RoleSpec{{Name: "clerk"}, {Name: "editor"}}}, nil)
+		assert.Equal(t, ErrTooManyRoles, err, "should reject specs creating too many roles")
+		assert.Equal(t, (*Role)(nil), svr.GetRoleByName("editor"), "should make no change")
+	}
+	{
+		clock := NewManualClock(time.Unix(1700000000, 0))
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, PruneIntervalSec: 60, MaxTokens: 3}), WithClock(clock), WithHasher(fastHasher))
+		svr.CreateUser("anna", "passw0rd")
+		svr.CreateUser("elton", "123456")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Authenticate("anna", "passw0rd")
+		svr.Authenticate("elton", "123456")
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrTooManyTokens, err, "should reject tokens beyond MaxTokens")
+		svr.Invalidate(token)
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrTooManyTokens, err, "should count invalidated tokens until pruned")
+		clock.Advance(4 * time.Minute)
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should make room once pruned")
+		st, _ := svr.Stats()
+		assert.Equal(t, 1, st.ActiveTokens+st.PendingPrune, "should have pruned the others")
+	}
+	{
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxTokensPerUser: 2}), WithHasher(fastHasher))
+		svr.CreateUser("anna", "passw0rd")
+		svr.CreateUser("elton", "123456")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Authenticate("anna", "passw0rd")
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrTooManyTokens, err, "should bound the tokens of each user")
+		_, err = svr.RequestPasswordReset("anna")
+		assert.Equal(t, ErrTooManyTokens, err, "should count all kinds of tokens")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should not limit other users")
+		for i := 0; i < 3; i++ {
+			svr.Invalidate(token)
+			token, err = svr.Authenticate("anna", "passw0rd")
+		}
+		assert.Equal(t, nil, err, "should make room on logout")
+	}
+	{
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxTokensPerUser: 2}), WithHasher(fastHasher))
+		svr.CreateUser("anna", "passw0rd")
+		for i := 0; i < 3; i++ {
+			svr.RequestPasswordReset("anna")
+		}
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should not count the password resets replaced since")
+		_, err = svr.RequestPasswordReset("anna")
+		assert.Equal(t, nil, err, "should replace the password reset")
+	}
+	{
+		_, err := New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxUsers: 10}), WithStorage(listOnlyStorage{NewMemoryStorage()}))
+		assert.Equal(t, ErrInvalidConfig, err, "should require a Counter to count users")
+		_, err = New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxTokens: 10}), WithStorage(listOnlyStorage{NewMemoryStorage()}))
+		assert.Equal(t, nil, err, "should count tokens without a Counter")
+		_, err = New(WithConfig(&ServerConfig{TokenExpireSec: 60, MaxTokensPerUser: -1}))
+		assert.Equal(t, ErrInvalidConfig, err, "should reject negative limits")
+	}
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Listings are paginated with keyset cursors: a cursor holds the sort key of the last entity of a
+// page, and the next page starts right after it. Unlike offsets, this does not skip or repeat
+// entities when others are created or deleted between two pages.
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// SortField is the key that listings are sorted by.
+type SortField int
+
+const (
+	SortByID SortField = iota
+	SortByName
+)
+
+// ListOptions selects a page of a listing. The zero value lists the first DefaultListLimit
+// entities in ascending order of ID.
+type ListOptions struct {
+	Prefix string // only list the entities whose name starts with it
+	SortBy SortField
+	Desc   bool
+	Limit  int // 0 for DefaultListLimit, capped at MaxListLimit
+	// Cursor is the cursor returned with the previous page, or "" for the first page. The other
+	// options must not change between pages.
+	Cursor string
+}
+
+// ListQuery is the request for a page of a listing that a server passes a store.
+type ListQuery struct {
+	Prefix string
+	SortBy SortField
+	Desc   bool
+	// After, if not nil, is the sort key of the last entity of the previous page. Only the entities
+	// strictly after it (in the sort order) are listed.
+	After *ListKey
+	Limit int
+}
+
+// ListKey is the sort key of an entity. Names are unique, so both fields are unique keys.
+type ListKey struct {
+	ID   int64
+	Name string
+}
+
+// listCursor is the content of ListOptions.Cursor. The options are included to detect misuse.
+type listCursor struct {
+	SortBy SortField `json:"s"`
+	Desc   bool      `json:"d,omitempty"`
+	Prefix string    `json:"p,omitempty"`
+	ID     int64     `json:"i,omitempty"`
+	Name   string    `json:"n,omitempty"`
+}
+
+var (
+	ErrInvalidCursor = newError("invalid_cursor", http.StatusBadRequest, "invalid listing cursor")
+	ErrInvalidSort   = newError("invalid_sort", http.StatusBadRequest, "invalid sort field")
+)
+
+// query validates the options, and converts them to a ListQuery.
+// One more entity than the page size is requested, to tell if there is a next page.
+func (o *ListOptions) query() (*ListQuery, error) {
+	var opts ListOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.SortBy != SortByID && opts.SortBy != SortByName {
+		return nil, ErrInvalidSort
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	} else if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+	q := ListQuery{Prefix: opts.Prefix, SortBy: opts.SortBy, Desc: opts.Desc, Limit: opts.Limit + 1}
+	if opts.Cursor == "" {
+		return &q, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.SortBy != opts.SortBy || c.Desc != opts.Desc || c.Prefix != opts.Prefix {
+		return nil, ErrInvalidCursor
+	}
+	q.After = &ListKey{ID: c.ID, Name: c.Name}
+	return &q, nil
+}
+
+// cursor makes the cursor of the page that ends with the given entity.
+func (q *ListQuery) cursor(last ListKey) string {
+	c := listCursor{SortBy: q.SortBy, Desc: q.Desc, Prefix: q.Prefix}
+	if q.SortBy == SortByName {
+		c.Name = last.Name
+	} else {
+		c.ID = last.ID
+	}
+	b, _ := json.Marshal(&c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Match tells if an entity belongs to the page, apart from the limit.
+// It is meant for stores that filter entities by themselves.
+func (q *ListQuery) Match(k ListKey) bool {
+	if !strings.HasPrefix(k.Name, q.Prefix) {
+		return false
+	}
+	if q.After == nil {
+		return true
+	}
+	if q.SortBy == SortByName {
+		return (k.Name > q.After.Name) != q.Desc && k.Name != q.After.Name
+	}
+	return (k.ID > q.After.ID) != q.Desc && k.ID != q.After.ID
+}
+
+// Less tells if the entity with key a comes before b in the sort order.
+func (q *ListQuery) Less(a, b ListKey) bool {
+	if q.SortBy == SortByName {
+		return (a.Name < b.Name) != q.Desc
+	}
+	return (a.ID < b.ID) != q.Desc
+}
+
+// Page selects the keys of a page from the keys of all entities, in the sort order.
+func (q *ListQuery) Page(keys []ListKey) []ListKey {
+	list := keys[:0]
+	for _, k := range keys {
+		if q.Match(k) {
+			list = append(list, k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return q.Less(list[i], list[j]) })
+	if len(list) > q.Limit {
+		list = list[:q.Limit]
+	}
+	return list
+}
+
+// *-* Public API *-*
+
+// ListUsers lists a page of users, see ListOptions. Pass the returned cursor in ListOptions.Cursor
+// to get the next page. Soft-deleted users that have not been purged are included, with Deleted
+// set, so that they can be found for RestoreUser.
+//
+// Returns: the users, and the cursor of the next page ("" if this is the last page)
+// Errors: ErrInvalidCursor, ErrInvalidSort
+func (s *Server) ListUsers(opts *ListOptions) (_ []*User, _ string, err error) {
+	s, sp := s.trace("auth.ListUsers")
+	defer func() { sp.end(err) }()
+	q, err := opts.query()
+	if err != nil {
+		return nil, "", err
+	}
+	list, err := s.store.ListUsers(s.ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(list) == q.Limit {
+		list = list[:q.Limit-1]
+		last := list[len(list)-1]
+		next = q.cursor(ListKey{ID: int64(last.ID), Name: last.Name})
+	}
+	res := make([]*User, len(list))
+	for i, u := range list {
+		res[i] = u.clone()
+	}
+	return res, next, nil
+}
+
+// ListRoles lists a page of roles, like ListUsers.
+//
+// Returns: the roles, and the cursor of the next page ("" if this is the last page)
+// Errors: ErrInvalidCursor, ErrInvalidSort
+func (s *Server) ListRoles(opts *ListOptions) (_ []*Role, _ string, err error) {
+	s, sp := s.trace("auth.ListRoles")
+	defer func() { sp.end(err) }()
+	q, err := opts.query()
+	if err != nil {
+		return nil, "", err
+	}
+	list, err := s.store.ListRoles(s.ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(list) == q.Limit {
+		list = list[:q.Limit-1]
+		last := list[len(list)-1]
+		next = q.cursor(ListKey{ID: int64(last.ID), Name: last.Name})
+	}
+	res := make([]*Role, len(list))
+	for i, r := range list {
+		res[i] = r.clone()
+	}
+	return res, next, nil
+}
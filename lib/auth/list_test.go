@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func userNames(list []*User) []string {
+	names := make([]string, len(list))
+	for i, u := range list {
+		names[i] = u.Name
+	}
+	return names
+}
+
+func TestListUsers(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	for _, name := range []string{"fred", "anna", "elton", "ella", "belle"} {
+		svr.CreateUser(name, "123456")
+	}
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(2, rid)
+	{
+		list, next, err := svr.ListUsers(nil)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []string{"fred", "anna", "elton", "ella", "belle"}, userNames(list), "should sort by ID by default")
+		assert.Equal(t, "", next, "should not give a cursor on the last page")
+		assert.Equal(t, rid, list[1].Roles[rid].ID, "should populate the roles")
+	}
+	{
+		opts := ListOptions{SortBy: SortByName, Limit: 2}
+		list, next, _ := svr.ListUsers(&opts)
+		assert.Equal(t, []string{"anna", "belle"}, userNames(list), "should sort by name")
+		// Entities created between pages do not shift the next page
+		svr.CreateUser("aaron", "123456")
+		opts.Cursor = next
+		list, next, _ = svr.ListUsers(&opts)
+		assert.Equal(t, []string{"ella", "elton"}, userNames(list), "should continue after the cursor")
+		opts.Cursor = next
+		list, next, _ = svr.ListUsers(&opts)
+		assert.Equal(t, []string{"fred"}, userNames(list), "should give the last page")
+		assert.Equal(t, "", next, "should not give a cursor on the last page")
+	}
+	{
+		opts := ListOptions{Prefix: "el", Desc: true, Limit: 1}
+		list, next, _ := svr.ListUsers(&opts)
+		assert.Equal(t, []string{"ella"}, userNames(list), "should filter by prefix in descending order")
+		opts.Cursor = next
+		list, next, _ = svr.ListUsers(&opts)
+		assert.Equal(t, []string{"elton"}, userNames(list), "should continue after the cursor")
+		assert.Equal(t, "", next, "should not give a cursor on the last page")
+	}
+	{
+		_, next, _ := svr.ListUsers(&ListOptions{Limit: 1})
+		_, _, err := svr.ListUsers(&ListOptions{Limit: 1, Desc: true, Cursor: next})
+		assert.Equal(t, ErrInvalidCursor, err, "should reject a cursor made with other options")
+		_, _, err = svr.ListUsers(&ListOptions{Cursor: "invalid"})
+		assert.Equal(t, ErrInvalidCursor, err, "should reject a malformed cursor")
+		_, _, err = svr.ListUsers(&ListOptions{SortBy: 101})
+		assert.Equal(t, ErrInvalidSort, err, "should reject an unknown sort field")
+	}
+}
+
+func TestListRoles(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	for _, name := range []string{"scanner", "plugdev", "printer"} {
+		svr.CreateRole(name)
+	}
+	list, next, err := svr.ListRoles(&ListOptions{Prefix: "p", SortBy: SortByName, Desc: true})
+	assert.Equal(t, nil, err, "should success")
+	assert.Equal(t, "", next, "should not give a cursor on the last page")
+	assert.Equal(t, 2, len(list), "should filter by prefix")
+	assert.Equal(t, "printer", list[0].Name, "should sort by name in descending order")
+	assert.Equal(t, "plugdev", list[1].Name, "should sort by name in descending order")
+}
@@ -0,0 +1,808 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryStorage is the reference Storage implementation, which keeps everything in memory
+// (without persistence). It uses maps to provide quick access with both IDs and names as key.
+type MemoryStorage struct {
+	mu sync.RWMutex
+	// view is the *memView of the users, roles and groups by ID, read without mu
+	view atomic.Value
+
+	users  map[UserID]*User
+	uname  map[string]*User
+	uemail map[string]*User // see EmailFinder
+	roles  map[RoleID]*Role
+	rname  map[string]*Role
+	groups map[GroupID]*Group
+	gname  map[string]*Group
+
+	// Tokens, the most read and written of all, are sharded on their value, each shard with a lock
+	// of its own instead of mu
+	shards []tokenShard
+
+	// Reverse indexes of role assignments and group memberships
+	holders map[RoleID]map[UserID]struct{}
+	members map[GroupID]map[UserID]struct{}
+	// Reverse indexes of resource grants and group roles, see RoleFinder
+	grantees map[RoleID]map[UserID]struct{}
+	rgroups  map[RoleID]map[GroupID]struct{}
+
+	// Auto-increment numerical IDs
+	nextUser  UserID
+	nextRole  RoleID
+	nextGroup GroupID
+
+	// batch, when set, is an edit shared by many writes and published at once, see Load
+	batch *viewEdit
+}
+
+// memView is an immutable copy of the users, roles and groups of a MemoryStorage by ID, swapped
+// atomically on each write, so that GetUser, GetRole and GetGroup, which back every CheckRole,
+// never wait for mu. Users are split into buckets on their ID, so that a write copies only the
+// buckets it changes (and the few roles or groups).
+type memView struct {
+	users  [viewBuckets]map[UserID]*User
+	roles  map[RoleID]*Role
+	groups map[GroupID]*Group
+}
+
+const viewBuckets = 64
+
+func viewBucket(id UserID) int {
+	return int(uint64(id) * 0x9e3779b97f4a7c15 >> 58)
+}
+
+// viewEdit is a copy of the view being changed by a write, which copies each part on its first
+// change.
+type viewEdit struct {
+	memView
+	copied       [viewBuckets]bool
+	rolesCopied  bool
+	groupsCopied bool
+}
+
+// edit starts a change of the view. The caller must hold m.mu, until m.publish.
+func (m *MemoryStorage) edit() *viewEdit {
+	if m.batch != nil {
+		return m.batch
+	}
+	return &viewEdit{memView: *m.view.Load().(*memView)}
+}
+
+// publish makes an edit visible to readers. The caller must hold m.mu.
+func (m *MemoryStorage) publish(e *viewEdit) {
+	if e == m.batch {
+		return
+	}
+	v := e.memView
+	m.view.Store(&v)
+}
+
+func (e *viewEdit) userBucket(id UserID) map[UserID]*User {
+	i := viewBucket(id)
+	if !e.copied[i] {
+		users := make(map[UserID]*User, len(e.users[i])+1)
+		for id, u := range e.users[i] {
+			users[id] = u
+		}
+		e.users[i], e.copied[i] = users, true
+	}
+	return e.users[i]
+}
+
+func (e *viewEdit) putUser(u *User) {
+	e.userBucket(u.ID)[u.ID] = u
+}
+
+func (e *viewEdit) deleteUser(id UserID) {
+	delete(e.userBucket(id), id)
+}
+
+func (e *viewEdit) copyRoles() {
+	if e.rolesCopied {
+		return
+	}
+	roles := make(map[RoleID]*Role, len(e.roles)+1)
+	for id, r := range e.roles {
+		roles[id] = r
+	}
+	e.roles, e.rolesCopied = roles, true
+}
+
+func (e *viewEdit) putRole(r *Role) {
+	e.copyRoles()
+	e.roles[r.ID] = r
+}
+
+func (e *viewEdit) deleteRole(id RoleID) {
+	e.copyRoles()
+	delete(e.roles, id)
+}
+
+func (e *viewEdit) copyGroups() {
+	if e.groupsCopied {
+		return
+	}
+	groups := make(map[GroupID]*Group, len(e.groups)+1)
+	for id, g := range e.groups {
+		groups[id] = g
+	}
+	e.groups, e.groupsCopied = groups, true
+}
+
+func (e *viewEdit) putGroup(g *Group) {
+	e.copyGroups()
+	e.groups[g.ID] = g
+}
+
+func (e *viewEdit) deleteGroup(id GroupID) {
+	e.copyGroups()
+	delete(e.groups, id)
+}
+
+// tokenShard holds the tokens whose value hashes to it.
+type tokenShard struct {
+	mu     sync.RWMutex
+	tokens map[TokenValue]*Token
+	utoken map[UserID]map[TokenValue]*Token // the tokens of each user
+	_      [64]byte                         // keeps the locks of neighbors on other cache lines
+}
+
+// DefaultTokenShards is the number of token shards of NewMemoryStorage.
+const DefaultTokenShards = 16
+
+// NewMemoryStorage creates an empty MemoryStorage. IDs start from 1.
+func NewMemoryStorage() *MemoryStorage {
+	return NewShardedMemoryStorage(DefaultTokenShards)
+}
+
+// NewShardedMemoryStorage creates an empty MemoryStorage with its tokens split into n shards, each
+// with its own lock, so that token checks under heavy load do not wait on the writes of new tokens,
+// nor on those of users and roles. n is rounded up to a power of two; more shards than cores gain
+// little. With n below 1, it is DefaultTokenShards.
+func NewShardedMemoryStorage(n int) *MemoryStorage {
+	shards := 1
+	if n < 1 {
+		n = DefaultTokenShards
+	}
+	for shards < n {
+		shards <<= 1
+	}
+	m := &MemoryStorage{
+		users:     make(map[UserID]*User),
+		uname:     make(map[string]*User),
+		uemail:    make(map[string]*User),
+		roles:     make(map[RoleID]*Role),
+		rname:     make(map[string]*Role),
+		groups:    make(map[GroupID]*Group),
+		gname:     make(map[string]*Group),
+		shards:    make([]tokenShard, shards),
+		holders:   make(map[RoleID]map[UserID]struct{}),
+		members:   make(map[GroupID]map[UserID]struct{}),
+		grantees:  make(map[RoleID]map[UserID]struct{}),
+		rgroups:   make(map[RoleID]map[GroupID]struct{}),
+		nextUser:  1,
+		nextRole:  1,
+		nextGroup: 1,
+	}
+	for i := range m.shards {
+		m.shards[i].tokens = make(map[TokenValue]*Token)
+		m.shards[i].utoken = make(map[UserID]map[TokenValue]*Token)
+	}
+	m.view.Store(&memView{})
+	return m
+}
+
+// StartIDs makes the next users and roles counted from the given IDs, e.g. to keep them apart
+// from those of another system. IDs below the next ones, and zero, are ignored.
+func (m *MemoryStorage) StartIDs(user UserID, role RoleID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user > m.nextUser {
+		m.nextUser = user
+	}
+	if role > m.nextRole {
+		m.nextRole = role
+	}
+}
+
+// *-* Users *-*
+
+func (m *MemoryStorage) InsertUser(_ context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.uname[u.Name]; exists {
+		return ErrUserExists
+	}
+	if u.ID == 0 {
+		u.ID = m.nextUser
+	} else if _, exists := m.users[u.ID]; exists {
+		return ErrUserExists
+	}
+	if u.ID >= m.nextUser {
+		m.nextUser = u.ID + 1
+	}
+	m.linkRoles(u)
+	m.indexRoles(nil, u)
+	m.indexGroups(nil, u)
+	m.indexGrants(nil, u)
+	m.users[u.ID] = u
+	m.uname[u.Name] = u
+	m.indexEmail(nil, u)
+	e := m.edit()
+	e.putUser(u)
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) UpdateUser(_ context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[u.ID]
+	if !ok {
+		return ErrUserNotExist
+	}
+	if other, exists := m.uname[u.Name]; exists && other.ID != u.ID {
+		return ErrUserExists
+	}
+	m.linkRoles(u)
+	m.indexRoles(old, u)
+	m.indexGroups(old, u)
+	m.indexGrants(old, u)
+	delete(m.uname, old.Name)
+	m.users[u.ID] = u
+	m.uname[u.Name] = u
+	m.indexEmail(old, u)
+	e := m.edit()
+	e.putUser(u)
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) DeleteUser(_ context.Context, id UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return ErrUserNotExist
+	}
+	m.indexRoles(u, nil)
+	m.indexGroups(u, nil)
+	m.indexGrants(u, nil)
+	delete(m.users, id)
+	delete(m.uname, u.Name)
+	m.indexEmail(u, nil)
+	e := m.edit()
+	e.deleteUser(id)
+	m.publish(e)
+	return nil
+}
+
+// GetUser reads the view, without locking.
+func (m *MemoryStorage) GetUser(_ context.Context, id UserID) (*User, error) {
+	u, ok := m.view.Load().(*memView).users[viewBucket(id)][id]
+	if !ok {
+		return nil, ErrUserNotExist
+	}
+	return u, nil
+}
+
+func (m *MemoryStorage) GetUserByName(_ context.Context, name string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.uname[name]
+	if !ok {
+		return nil, ErrUserNotExist
+	}
+	return u, nil
+}
+
+// GetUserByEmail implements EmailFinder.
+func (m *MemoryStorage) GetUserByEmail(_ context.Context, email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.uemail[email]
+	if !ok {
+		return nil, ErrUserNotExist
+	}
+	return u, nil
+}
+
+// indexEmail replaces old with u in the index of emails. Either may be nil.
+func (m *MemoryStorage) indexEmail(old, u *User) {
+	if old != nil && old.Email != "" && m.uemail[old.Email] == old {
+		delete(m.uemail, old.Email)
+	}
+	if u != nil && u.Email != "" {
+		m.uemail[u.Email] = u
+	}
+}
+
+func (m *MemoryStorage) UsersWithRole(_ context.Context, role RoleID) ([]UserID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]UserID, 0, len(m.holders[role]))
+	for id := range m.holders[role] {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// ListUsers sorts all matching users. TODO: keep the users sorted if this gets hot.
+func (m *MemoryStorage) ListUsers(_ context.Context, q *ListQuery) ([]*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]ListKey, 0, len(m.users))
+	for _, u := range m.users {
+		keys = append(keys, ListKey{ID: int64(u.ID), Name: u.Name})
+	}
+	keys = q.Page(keys)
+	list := make([]*User, len(keys))
+	for i, k := range keys {
+		list[i] = m.users[UserID(k.ID)]
+	}
+	return list, nil
+}
+
+// indexRoles updates the reverse index of role assignments when a user changes from old to u.
+// Either can be nil, for insertion and deletion respectively. The caller must hold m.mu.
+func (m *MemoryStorage) indexRoles(old, u *User) {
+	if old != nil {
+		for role := range old.Roles {
+			if u == nil || u.Roles[role] == nil {
+				delete(m.holders[role], old.ID)
+				if len(m.holders[role]) == 0 {
+					delete(m.holders, role)
+				}
+			}
+		}
+	}
+	if u != nil {
+		for role := range u.Roles {
+			if m.holders[role] == nil {
+				m.holders[role] = make(map[UserID]struct{})
+			}
+			m.holders[role][u.ID] = struct{}{}
+		}
+	}
+}
+
+// indexGroups updates the reverse index of group memberships, like indexRoles.
+// The caller must hold m.mu.
+func (m *MemoryStorage) indexGroups(old, u *User) {
+	if old != nil && u != nil && old.ID == u.ID && sameGroups(old.Groups, u.Groups) {
+		// Most updates, such as recording logins, leave the groups alone
+		return
+	}
+	if old != nil {
+		for _, group := range old.Groups {
+			members := m.members[group]
+			delete(members, old.ID)
+			if len(members) == 0 {
+				delete(m.members, group)
+			}
+		}
+	}
+	if u != nil {
+		for _, group := range u.Groups {
+			members, ok := m.members[group]
+			if !ok {
+				members = make(map[UserID]struct{})
+				m.members[group] = members
+			}
+			members[u.ID] = struct{}{}
+		}
+	}
+}
+
+// sameGroups tells if two sorted lists of groups are equal.
+func sameGroups(a, b []GroupID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexGrants updates the reverse index of resource grants, like indexRoles.
+// The caller must hold m.mu.
+func (m *MemoryStorage) indexGrants(old, u *User) {
+	if old != nil {
+		for role := range old.ResourceRoles {
+			delete(m.grantees[role], old.ID)
+			if len(m.grantees[role]) == 0 {
+				delete(m.grantees, role)
+			}
+		}
+	}
+	if u != nil {
+		for role := range u.ResourceRoles {
+			if m.grantees[role] == nil {
+				m.grantees[role] = make(map[UserID]struct{})
+			}
+			m.grantees[role][u.ID] = struct{}{}
+		}
+	}
+}
+
+// UsersWithResourceRole implements RoleFinder.
+func (m *MemoryStorage) UsersWithResourceRole(_ context.Context, role RoleID) ([]UserID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]UserID, 0, len(m.grantees[role]))
+	for id := range m.grantees[role] {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// linkRoles points the role assignments of a user to the stored role objects, so that all users
+// holding a role share the same object. The caller must hold m.mu.
+func (m *MemoryStorage) linkRoles(u *User) {
+	for id := range u.Roles {
+		if r, ok := m.roles[id]; ok {
+			u.Roles[id] = r
+		}
+	}
+}
+
+// *-* Roles *-*
+
+func (m *MemoryStorage) InsertRole(_ context.Context, r *Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.rname[r.Name]; exists {
+		return ErrRoleExists
+	}
+	if r.ID == 0 {
+		r.ID = m.nextRole
+	} else if _, exists := m.roles[r.ID]; exists {
+		return ErrRoleExists
+	}
+	if r.ID >= m.nextRole {
+		m.nextRole = r.ID + 1
+	}
+	m.roles[r.ID] = r
+	m.rname[r.Name] = r
+	e := m.edit()
+	e.putRole(r)
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) UpdateRole(_ context.Context, r *Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.roles[r.ID]
+	if !ok {
+		return ErrRoleNotExist
+	}
+	if other, exists := m.rname[r.Name]; exists && other.ID != r.ID {
+		return ErrRoleExists
+	}
+	delete(m.rname, old.Name)
+	m.roles[r.ID] = r
+	m.rname[r.Name] = r
+	e := m.edit()
+	e.putRole(r)
+
+	// Stored objects are never modified, so replace the holders with copies pointing to the new role
+	for id := range m.holders[r.ID] {
+		u := *m.users[id]
+		u.Roles = make(map[RoleID]*Role, len(m.users[id].Roles))
+		for rid, role := range m.users[id].Roles {
+			u.Roles[rid] = role
+		}
+		u.Roles[r.ID] = r
+		m.users[id] = &u
+		m.uname[u.Name] = &u
+		m.indexEmail(nil, &u)
+		e.putUser(&u)
+	}
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) DeleteRole(_ context.Context, id RoleID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.roles[id]
+	if !ok {
+		return ErrRoleNotExist
+	}
+	delete(m.roles, id)
+	delete(m.rname, r.Name)
+	e := m.edit()
+	e.deleteRole(id)
+	m.publish(e)
+	return nil
+}
+
+// GetRole reads the view, without locking.
+func (m *MemoryStorage) GetRole(_ context.Context, id RoleID) (*Role, error) {
+	r, ok := m.view.Load().(*memView).roles[id]
+	if !ok {
+		return nil, ErrRoleNotExist
+	}
+	return r, nil
+}
+
+func (m *MemoryStorage) GetRoleByName(_ context.Context, name string) (*Role, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, ok := m.rname[name]
+	if !ok {
+		return nil, ErrRoleNotExist
+	}
+	return r, nil
+}
+
+// ListRoles sorts all matching roles, like ListUsers.
+func (m *MemoryStorage) ListRoles(_ context.Context, q *ListQuery) ([]*Role, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]ListKey, 0, len(m.roles))
+	for _, r := range m.roles {
+		keys = append(keys, ListKey{ID: int64(r.ID), Name: r.Name})
+	}
+	keys = q.Page(keys)
+	list := make([]*Role, len(keys))
+	for i, k := range keys {
+		list[i] = m.roles[RoleID(k.ID)]
+	}
+	return list, nil
+}
+
+// *-* Groups *-*
+
+func (m *MemoryStorage) InsertGroup(_ context.Context, g *Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.gname[g.Name]; exists {
+		return ErrGroupExists
+	}
+	if g.ID == 0 {
+		g.ID = m.nextGroup
+	} else if _, exists := m.groups[g.ID]; exists {
+		return ErrGroupExists
+	}
+	if g.ID >= m.nextGroup {
+		m.nextGroup = g.ID + 1
+	}
+	m.indexGroupRoles(nil, g)
+	m.groups[g.ID] = g
+	m.gname[g.Name] = g
+	e := m.edit()
+	e.putGroup(g)
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) UpdateGroup(_ context.Context, g *Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.groups[g.ID]
+	if !ok {
+		return ErrGroupNotExist
+	}
+	if other, exists := m.gname[g.Name]; exists && other.ID != g.ID {
+		return ErrGroupExists
+	}
+	delete(m.gname, old.Name)
+	m.indexGroupRoles(old, g)
+	m.groups[g.ID] = g
+	m.gname[g.Name] = g
+	e := m.edit()
+	e.putGroup(g)
+	m.publish(e)
+	return nil
+}
+
+func (m *MemoryStorage) DeleteGroup(_ context.Context, id GroupID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[id]
+	if !ok {
+		return ErrGroupNotExist
+	}
+	m.indexGroupRoles(g, nil)
+	delete(m.groups, id)
+	delete(m.gname, g.Name)
+	e := m.edit()
+	e.deleteGroup(id)
+	m.publish(e)
+	return nil
+}
+
+// GetGroup reads the view, without locking.
+func (m *MemoryStorage) GetGroup(_ context.Context, id GroupID) (*Group, error) {
+	g, ok := m.view.Load().(*memView).groups[id]
+	if !ok {
+		return nil, ErrGroupNotExist
+	}
+	return g, nil
+}
+
+func (m *MemoryStorage) GetGroupByName(_ context.Context, name string) (*Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g, ok := m.gname[name]
+	if !ok {
+		return nil, ErrGroupNotExist
+	}
+	return g, nil
+}
+
+func (m *MemoryStorage) GroupMembers(_ context.Context, group GroupID) ([]UserID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]UserID, 0, len(m.members[group]))
+	for id := range m.members[group] {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// GroupsWithRole implements RoleFinder.
+func (m *MemoryStorage) GroupsWithRole(_ context.Context, role RoleID) ([]GroupID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]GroupID, 0, len(m.rgroups[role]))
+	for id := range m.rgroups[role] {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list, nil
+}
+
+// indexGroupRoles updates the reverse index of the roles of groups when a group changes from old
+// to g, like indexRoles. The caller must hold m.mu.
+func (m *MemoryStorage) indexGroupRoles(old, g *Group) {
+	if old != nil {
+		for _, role := range old.Roles {
+			delete(m.rgroups[role], old.ID)
+			if len(m.rgroups[role]) == 0 {
+				delete(m.rgroups, role)
+			}
+		}
+	}
+	if g != nil {
+		for _, role := range g.Roles {
+			if m.rgroups[role] == nil {
+				m.rgroups[role] = make(map[GroupID]struct{})
+			}
+			m.rgroups[role][g.ID] = struct{}{}
+		}
+	}
+}
+
+// Count implements Counter.
+func (m *MemoryStorage) Count(_ context.Context) (Counts, error) {
+	m.mu.RLock()
+	counts := Counts{Users: int64(len(m.users)), Roles: int64(len(m.roles))}
+	m.mu.RUnlock()
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		counts.Tokens += int64(len(sh.tokens))
+		sh.mu.RUnlock()
+	}
+	return counts, nil
+}
+
+// *-* Tokens *-*
+
+// shard gives the shard of a token value, by its FNV-1a hash.
+func (m *MemoryStorage) shard(v TokenValue) *tokenShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(v); i++ {
+		h = (h ^ uint32(v[i])) * 16777619
+	}
+	return &m.shards[h&uint32(len(m.shards)-1)]
+}
+
+func (m *MemoryStorage) InsertToken(_ context.Context, t *Token) error {
+	sh := m.shard(t.Value)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.put(t)
+	return nil
+}
+
+func (m *MemoryStorage) GetToken(_ context.Context, v TokenValue) (*Token, error) {
+	sh := m.shard(v)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	t, ok := sh.tokens[v]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+func (m *MemoryStorage) DeleteToken(_ context.Context, v TokenValue) error {
+	sh := m.shard(v)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if t, ok := sh.tokens[v]; ok {
+		sh.index(t, nil)
+		delete(sh.tokens, v)
+	}
+	return nil
+}
+
+// UserTokens looks for the tokens of the user in every shard, one at a time.
+func (m *MemoryStorage) UserTokens(_ context.Context, user UserID) ([]*Token, error) {
+	var list []*Token
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for _, t := range sh.utoken[user] {
+			list = append(list, t)
+		}
+		sh.mu.RUnlock()
+	}
+	if list == nil {
+		list = []*Token{}
+	}
+	return list, nil
+}
+
+// put saves a token in the shard. The caller must hold sh.mu.
+func (sh *tokenShard) put(t *Token) {
+	sh.index(sh.tokens[t.Value], t)
+	sh.tokens[t.Value] = t
+}
+
+// index updates the index of tokens by user when a token changes from old to t, like
+// MemoryStorage.indexRoles. The caller must hold sh.mu.
+func (sh *tokenShard) index(old, t *Token) {
+	if old != nil {
+		delete(sh.utoken[old.User], old.Value)
+		if len(sh.utoken[old.User]) == 0 {
+			delete(sh.utoken, old.User)
+		}
+	}
+	if t != nil {
+		tokens, ok := sh.utoken[t.User]
+		if !ok {
+			tokens = make(map[TokenValue]*Token)
+			sh.utoken[t.User] = tokens
+		}
+		tokens[t.Value] = t
+	}
+}
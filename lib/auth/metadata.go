@@ -0,0 +1,96 @@
+package auth
+
+import "net/http"
+
+// MaxMetadataSize limits the metadata of a user, counted as the length of its keys and values.
+const MaxMetadataSize = 8 << 10
+
+var ErrInvalidMetadata = newError("invalid_metadata", http.StatusBadRequest, "invalid metadata")
+
+// SetUserMetadata updates the metadata of a user, i.e. free-form fields for applications, such as a
+// display name or an email address. Unlike attributes (see SetUserAttribute), metadata is not seen
+// by policies. The entries of metadata are set, or removed if their value is empty; other entries
+// are kept. Metadata is listed with the user, see GetUser and ListUsers, and exported with it in
+// JSON Lines.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrInvalidMetadata if a key is empty, or the metadata would be larger
+// than MaxMetadataSize
+func (s *Server) SetUserMetadata(user UserID, metadata map[string]string) (err error) {
+	s, sp := s.trace("auth.SetUserMetadata")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	for key := range metadata {
+		if key == "" {
+			return ErrInvalidMetadata
+		}
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	userObj = userObj.clone()
+	userObj.Metadata = mergeMetadata(userObj.Metadata, metadata)
+	if metadataSize(userObj.Metadata) > MaxMetadataSize {
+		return ErrInvalidMetadata
+	}
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// GetUserMetadata gives the metadata of a user, see SetUserMetadata.
+//
+// Returns: a copy of the metadata, nil if there is none
+// Errors: ErrUserNotExist
+func (s *Server) GetUserMetadata(user UserID) (_ map[string]string, err error) {
+	s, sp := s.trace("auth.GetUserMetadata")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return mergeMetadata(nil, userObj.Metadata), nil
+}
+
+// mergeMetadata returns a copy of metadata with the entries of changes, without the empty ones, or
+// nil if there is no entry left.
+func mergeMetadata(metadata, changes map[string]string) map[string]string {
+	res := make(map[string]string, len(metadata)+len(changes))
+	for key, value := range metadata {
+		res[key] = value
+	}
+	for key, value := range changes {
+		if value == "" {
+			delete(res, key)
+		} else {
+			res[key] = value
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+func metadataSize(metadata map[string]string) int {
+	n := 0
+	for key, value := range metadata {
+		n += len(key) + len(value)
+	}
+	return n
+}
+
+// validMetadata tells if metadata could be set by SetUserMetadata.
+func validMetadata(metadata map[string]string) bool {
+	for key, value := range metadata {
+		if key == "" || value == "" {
+			return false
+		}
+	}
+	return metadataSize(metadata) <= MaxMetadataSize
+}
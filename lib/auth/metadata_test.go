@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserMetadata(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("elton", "123456")
+	{
+		assert.Equal(t, ErrUserNotExist, svr.SetUserMetadata(uid+1, map[string]string{"email": "e@example.com"}), "should check the user")
+		assert.Equal(t, ErrInvalidMetadata, svr.SetUserMetadata(uid, map[string]string{"": "x"}), "should check the keys")
+		big := map[string]string{"bio": strings.Repeat("x", MaxMetadataSize)}
+		assert.Equal(t, ErrInvalidMetadata, svr.SetUserMetadata(uid, big), "should limit the size")
+		md, err := svr.GetUserMetadata(uid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, map[string]string(nil), md, "should have no metadata")
+	}
+	{
+		assert.Equal(t, nil, svr.SetUserMetadata(uid, map[string]string{"email": "e@example.com", "display_name": "Elton"}), "should success")
+		assert.Equal(t, nil, svr.SetUserMetadata(uid, map[string]string{"display_name": "", "team": "ops"}), "should success")
+		md, _ := svr.GetUserMetadata(uid)
+		assert.Equal(t, map[string]string{"email": "e@example.com", "team": "ops"}, md, "should merge the changes")
+		md["team"] = "dev"
+		assert.Equal(t, "ops", svr.GetUser(uid).Metadata["team"], "should return copies")
+		users, _, _ := svr.ListUsers(nil)
+		assert.Equal(t, "e@example.com", users[0].Metadata["email"], "should list the metadata")
+	}
+	{
+		var buf bytes.Buffer
+		svr.ExportUsers(&buf, FormatJSON)
+		other, _ := New(WithHasher(fastHasher))
+		res, err := other.ImportUsers(&buf, FormatJSON)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 1, res.Created, "should import the user")
+		assert.Equal(t, svr.GetUser(uid).Metadata, other.GetUserByName("elton").Metadata, "should export and import the metadata")
+
+		res, _ = other.ImportUsers(strings.NewReader(`{"name": "anna", "password": "passw0rd", "metadata": {"email": ""}}`), FormatJSON)
+		assert.Equal(t, []ImportFailure{{Line: 1, Name: "anna", Err: ErrInvalidMetadata}}, res.Failed, "should check imported metadata")
+	}
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// serverMetrics holds the counters of a server. It is allocated on its own, so that the 64-bit
+// fields are aligned for atomic operations on 32-bit platforms.
+type serverMetrics struct {
+	authentications uint64
+	failedLogins    uint64
+	mfaChallenges   uint64
+	prunes          uint64
+	prunedTokens    uint64
+	pruneNanos      uint64
+	lastPruneNanos  uint64
+	decisionHits    uint64
+	decisionMisses  uint64
+	storageHits     uint64
+	storageMisses   uint64
+}
+
+// Metrics is a snapshot of the counters and gauges of a server.
+// Counters start from 0 when the server is created.
+type Metrics struct {
+	Uptime time.Duration
+
+	// Entity counts, or -1 if the storage does not implement Counter
+	Users  int64
+	Roles  int64
+	Tokens int64 // including expired tokens that have not been pruned
+
+	Authentications uint64 // session tokens issued
+	FailedLogins    uint64 // wrong passwords and wrong MFA codes
+	MFAChallenges   uint64
+
+	Prunes            uint64
+	PrunedTokens      uint64
+	PruneDuration     time.Duration // in total
+	LastPruneDuration time.Duration
+
+	// Checks answered from the decision cache or not, see ServerConfig.DecisionCacheSec
+	DecisionCacheHits   uint64
+	DecisionCacheMisses uint64
+	// Lookups answered from the storage cache or not, see ServerConfig.StorageCacheSize
+	StorageCacheHits   uint64
+	StorageCacheMisses uint64
+}
+
+// Metrics takes a snapshot of the server metrics, e.g. for monitoring.
+// Authentication rates can be derived from the counters and the uptime.
+//
+// Returns: the snapshot
+// Errors: any error from counting the entities in the storage
+func (s *Server) Metrics() (_ *Metrics, err error) {
+	s, sp := s.trace("auth.Metrics")
+	defer func() { sp.end(err) }()
+	m := s.metrics
+	res := Metrics{
+		Uptime:              s.now().Sub(s.startedOn),
+		Users:               -1,
+		Roles:               -1,
+		Tokens:              -1,
+		Authentications:     atomic.LoadUint64(&m.authentications),
+		FailedLogins:        atomic.LoadUint64(&m.failedLogins),
+		MFAChallenges:       atomic.LoadUint64(&m.mfaChallenges),
+		Prunes:              atomic.LoadUint64(&m.prunes),
+		PrunedTokens:        atomic.LoadUint64(&m.prunedTokens),
+		PruneDuration:       time.Duration(atomic.LoadUint64(&m.pruneNanos)),
+		LastPruneDuration:   time.Duration(atomic.LoadUint64(&m.lastPruneNanos)),
+		DecisionCacheHits:   atomic.LoadUint64(&m.decisionHits),
+		DecisionCacheMisses: atomic.LoadUint64(&m.decisionMisses),
+		StorageCacheHits:    atomic.LoadUint64(&m.storageHits),
+		StorageCacheMisses:  atomic.LoadUint64(&m.storageMisses),
+	}
+	if c, ok := s.baseStore().(Counter); ok {
+		counts, err := c.Count(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.Users, res.Roles, res.Tokens = counts.Users, counts.Roles, counts.Tokens
+	}
+	return &res, nil
+}
+
+// Stats is a snapshot of what a server holds, e.g. for dashboards and capacity planning. See
+// Metrics for the activity counters.
+type Stats struct {
+	Uptime time.Duration
+
+	Users int64 // including soft-deleted users
+	Roles int64
+	// Tokens is the number of saved tokens, including expired ones not yet pruned, or -1 if the
+	// storage does not implement Counter.
+	Tokens int64
+
+	// The tokens issued by this server, as queued for pruning: those not expired, and those waiting
+	// for the next prune. Sliding tokens (see ServerConfig.TokenMaxLifetimeSec) are counted by their
+	// first expiry, and invalidated tokens until pruned. JWTs are not saved, so not counted.
+	ActiveTokens int
+	PendingPrune int
+}
+
+// Stats counts the users, roles and tokens of the server. Users and roles are counted with the
+// Counter of the storage, or by listing them otherwise, which takes a while on large storages.
+//
+// Returns: the snapshot
+// Errors: any error from the storage
+func (s *Server) Stats() (_ *Stats, err error) {
+	s, sp := s.trace("auth.Stats")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	res := Stats{Uptime: s.now().Sub(s.startedOn), Tokens: -1}
+	if c, ok := s.baseStore().(Counter); ok {
+		counts, err := c.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.Users, res.Roles, res.Tokens = counts.Users, counts.Roles, counts.Tokens
+	} else {
+		if res.Users, err = s.countUsers(ctx); err != nil {
+			return nil, err
+		}
+		if res.Roles, err = s.countRoles(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	now := s.now()
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	for _, t := range s.tokenQ {
+		if now.After(t.Expires) {
+			res.PendingPrune++
+		} else {
+			res.ActiveTokens++
+		}
+	}
+	return &res, nil
+}
+
+// GetUserCount counts the users, including soft-deleted ones, like Stats.
+//
+// Returns: the number of users
+// Errors: any error from the storage
+func (s *Server) GetUserCount() (_ int64, err error) {
+	s, sp := s.trace("auth.GetUserCount")
+	defer func() { sp.end(err) }()
+	if c, ok := s.baseStore().(Counter); ok {
+		counts, err := c.Count(s.ctx)
+		return counts.Users, err
+	}
+	return s.countUsers(s.ctx)
+}
+
+// GetRoleCount counts the roles, like Stats.
+//
+// Returns: the number of roles
+// Errors: any error from the storage
+func (s *Server) GetRoleCount() (_ int64, err error) {
+	s, sp := s.trace("auth.GetRoleCount")
+	defer func() { sp.end(err) }()
+	if c, ok := s.baseStore().(Counter); ok {
+		counts, err := c.Count(s.ctx)
+		return counts.Roles, err
+	}
+	return s.countRoles(s.ctx)
+}
+
+// countUsers lists the users page by page, for storages without a Counter.
+func (s *Server) countUsers(ctx context.Context) (int64, error) {
+	var n int64
+	q := &ListQuery{Limit: MaxListLimit}
+	for {
+		list, err := s.store.ListUsers(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		n += int64(len(list))
+		if len(list) < q.Limit {
+			return n, nil
+		}
+		last := list[len(list)-1]
+		q.After = &ListKey{ID: int64(last.ID), Name: last.Name}
+	}
+}
+
+// countRoles is countUsers for roles.
+func (s *Server) countRoles(ctx context.Context) (int64, error) {
+	var n int64
+	q := &ListQuery{Limit: MaxListLimit}
+	for {
+		list, err := s.store.ListRoles(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		n += int64(len(list))
+		if len(list) < q.Limit {
+			return n, nil
+		}
+		last := list[len(list)-1]
+		q.After = &ListKey{ID: int64(last.ID), Name: last.Name}
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format, so that they can be
+// scraped like those of promhttp. Unknown entity counts are left out.
+//
+// Returns: none
+// Errors: any error from w
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	type metric struct {
+		name, typ, help string
+		value           float64
+		skip            bool
+	}
+	list := []metric{
+		{"auth_uptime_seconds", "gauge", "Time since the auth server started.", m.Uptime.Seconds(), false},
+		{"auth_users", "gauge", "Number of users.", float64(m.Users), m.Users < 0},
+		{"auth_roles", "gauge", "Number of roles.", float64(m.Roles), m.Roles < 0},
+		{"auth_tokens", "gauge", "Number of saved tokens, including expired ones not yet pruned.", float64(m.Tokens), m.Tokens < 0},
+		{"auth_authentications_total", "counter", "Session tokens issued.", float64(m.Authentications), false},
+		{"auth_failed_logins_total", "counter", "Logins rejected for wrong passwords or MFA codes.", float64(m.FailedLogins), false},
+		{"auth_mfa_challenges_total", "counter", "MFA challenges issued.", float64(m.MFAChallenges), false},
+		{"auth_prunes_total", "counter", "Bulk removals of expired tokens.", float64(m.Prunes), false},
+		{"auth_pruned_tokens_total", "counter", "Tokens removed by pruning.", float64(m.PrunedTokens), false},
+		{"auth_prune_duration_seconds_total", "counter", "Time spent pruning tokens.", m.PruneDuration.Seconds(), false},
+		{"auth_last_prune_duration_seconds", "gauge", "Duration of the last prune.", m.LastPruneDuration.Seconds(), false},
+		{"auth_decision_cache_hits_total", "counter", "Checks answered from the decision cache.", float64(m.DecisionCacheHits), false},
+		{"auth_decision_cache_misses_total", "counter", "Checks not found in the decision cache.", float64(m.DecisionCacheMisses), false},
+		{"auth_storage_cache_hits_total", "counter", "Lookups answered from the storage cache.", float64(m.StorageCacheHits), false},
+		{"auth_storage_cache_misses_total", "counter", "Lookups not found in the storage cache.", float64(m.StorageCacheMisses), false},
+	}
+	for _, x := range list {
+		if x.skip {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", x.name, x.help, x.name, x.typ, x.name, x.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) countLogin(ok bool) {
+	if ok {
+		atomic.AddUint64(&s.metrics.authentications, 1)
+	} else {
+		atomic.AddUint64(&s.metrics.failedLogins, 1)
+	}
+}
+
+func (s *Server) countPrune(tokens int, d time.Duration) {
+	m := s.metrics
+	atomic.AddUint64(&m.prunes, 1)
+	atomic.AddUint64(&m.prunedTokens, uint64(tokens))
+	atomic.AddUint64(&m.pruneNanos, uint64(d))
+	atomic.StoreUint64(&m.lastPruneNanos, uint64(d))
+}
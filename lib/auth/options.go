@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// Option customizes a server created by New.
+type Option func(*options)
+
+type options struct {
+	cfg   ServerConfig
+	store Storage
+	err   error
+
+	// First IDs of a new MemoryStorage, see WithIDStart
+	nextUser UserID
+	nextRole RoleID
+	// Token shards of a new MemoryStorage, see WithTokenShards
+	shards int
+	// Fixture to seed the server with, see WithFixture
+	fixture string
+}
+
+// New creates a Server configured by functional options, which saves its data to a new
+// MemoryStorage unless WithStorage is given. Tokens expire after an hour unless WithTokenTTL is
+// given; other settings have the defaults of ServerConfig. It is equivalent to NewServer, but
+// options can be added without breaking callers.
+//
+//	svr, err := auth.New(auth.WithTokenTTL(15*time.Minute), auth.WithHasher(&auth.BcryptHasher{}))
+//
+// Returns: pointer to the new server instance
+// Errors: ErrInvalidConfig, see NewServer; those of Seed with WithFixture
+func New(opts ...Option) (*Server, error) {
+	o := options{cfg: ServerConfig{TokenExpireSec: 3600}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	if o.store == nil {
+		m := NewShardedMemoryStorage(o.shards)
+		m.StartIDs(o.nextUser, o.nextRole)
+		o.store = m
+	} else if o.nextUser > 0 || o.nextRole > 0 || o.shards > 0 {
+		// Other storages assign IDs their own way
+		return nil, ErrInvalidConfig
+	}
+	svr, err := NewServer(&o.cfg, o.store)
+	if err != nil || o.fixture == "" {
+		return svr, err
+	}
+	f, err := ReadFixtureFile(o.fixture)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := svr.Seed(f); err != nil {
+		return nil, err
+	}
+	return svr, nil
+}
+
+// WithConfig starts from a ServerConfig, for the settings without an option of their own. It
+// replaces the settings of the options before it, so it comes first.
+func WithConfig(config *ServerConfig) Option {
+	return func(o *options) {
+		if config == nil {
+			o.err = ErrInvalidConfig
+			return
+		}
+		o.cfg = *config
+	}
+}
+
+// WithStorage saves the data of the server to store, instead of a new MemoryStorage.
+func WithStorage(store Storage) Option {
+	return func(o *options) {
+		if store == nil {
+			o.err = ErrInvalidConfig
+			return
+		}
+		o.store = store
+	}
+}
+
+// WithTokenTTL sets how long tokens are valid, see ServerConfig.TokenExpireSec. It is rounded down
+// to whole seconds, and must be at least a minute.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.cfg.TokenExpireSec = durationSec(ttl, &o.err)
+	}
+}
+
+// WithPruneInterval sets the length of a server epoch, see ServerConfig.PruneIntervalSec.
+// It is rounded down to whole seconds.
+func WithPruneInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.PruneIntervalSec = durationSec(interval, &o.err)
+		if o.cfg.PruneIntervalSec == 0 {
+			o.err = ErrInvalidConfig
+		}
+	}
+}
+
+// WithHasher sets the hasher of new passwords, see ServerConfig.Hasher.
+func WithHasher(hasher PasswordHasher) Option {
+	return func(o *options) {
+		o.cfg.Hasher = hasher
+	}
+}
+
+// WithClock sets the clock of the server, see ServerConfig.Clock.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.cfg.Clock = clock
+	}
+}
+
+// WithRand sets the entropy source of the server, see ServerConfig.Rand.
+func WithRand(r io.Reader) Option {
+	return func(o *options) {
+		o.cfg.Rand = r
+	}
+}
+
+// WithInterceptors adds interceptors around the operations of the server, after those added
+// before, see ServerConfig.Interceptors.
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(o *options) {
+		n := len(o.cfg.Interceptors)
+		o.cfg.Interceptors = append(o.cfg.Interceptors[:n:n], interceptors...)
+	}
+}
+
+// WithChangeLog keeps the last changes for Watch, see ServerConfig.ChangeLogSize.
+func WithChangeLog(size int) Option {
+	return func(o *options) {
+		o.cfg.ChangeLogSize = size
+	}
+}
+
+// WithTracer traces the operations of the server, see ServerConfig.Tracer.
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) {
+		o.cfg.Tracer = tracer
+	}
+}
+
+// WithPolicyCompiler sets the compiler of the policies of CheckAccess, see
+// ServerConfig.PolicyCompiler.
+func WithPolicyCompiler(compiler PolicyCompiler) Option {
+	return func(o *options) {
+		o.cfg.PolicyCompiler = compiler
+	}
+}
+
+// WithDecisionCache caches the results of checks for ttl, rounded down to whole seconds, and up to
+// size of them, or the default number if 0. See ServerConfig.DecisionCacheSec.
+func WithDecisionCache(ttl time.Duration, size int) Option {
+	return func(o *options) {
+		o.cfg.DecisionCacheSec = durationSec(ttl, &o.err)
+		o.cfg.DecisionCacheSize = size
+	}
+}
+
+// WithStorageCache keeps up to size users, roles, groups and tokens read from the storage in
+// memory. See ServerConfig.StorageCacheSize.
+func WithStorageCache(size int) Option {
+	return func(o *options) {
+		o.cfg.StorageCacheSize = size
+	}
+}
+
+// WithUserIDs sets the generator of user IDs, see ServerConfig.UserIDs.
+func WithUserIDs(gen IDGenerator) Option {
+	return func(o *options) {
+		o.cfg.UserIDs = gen
+	}
+}
+
+// WithIDStart sets the first IDs given to users and roles, instead of 1, e.g. to keep them apart
+// from those of another system. It only applies to the MemoryStorage made by New, so it cannot be
+// used with WithStorage. See WithUserIDs for IDs that are not counted.
+func WithIDStart(user UserID, role RoleID) Option {
+	return func(o *options) {
+		if user < 1 || role < 1 {
+			o.err = ErrInvalidConfig
+			return
+		}
+		o.nextUser, o.nextRole = user, role
+	}
+}
+
+// WithTokenShards sets the number of token shards, see NewShardedMemoryStorage. Like WithIDStart,
+// it only applies to the MemoryStorage made by New.
+func WithTokenShards(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			o.err = ErrInvalidConfig
+			return
+		}
+		o.shards = n
+	}
+}
+
+// WithSnapshotPath saves a snapshot to path on Close, see ServerConfig.SnapshotPath.
+func WithSnapshotPath(path string) Option {
+	return func(o *options) {
+		o.cfg.SnapshotPath = path
+	}
+}
+
+// WithFixture seeds the server with the fixture in the YAML or JSON file at path, see Seed. New then
+// also returns the errors of reading and seeding.
+func WithFixture(path string) Option {
+	return func(o *options) {
+		o.fixture = path
+	}
+}
+
+// durationSec converts d to the seconds of ServerConfig, recording ErrInvalidConfig in err if they
+// do not fit.
+func durationSec(d time.Duration, err *error) int32 {
+	sec := d / time.Second
+	if sec < 0 || sec > math.MaxInt32 {
+		*err = ErrInvalidConfig
+		return 0
+	}
+	return int32(sec)
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	{
+		svr, err := New()
+		assert.Equal(t, nil, err, "should success without options")
+		assert.Equal(t, int32(3600), svr.cfg.TokenExpireSec, "should default to an hour")
+		assert.Equal(t, SystemClock, svr.cfg.Clock, "should default to the system clock")
+	}
+	{
+		for _, opt := range []Option{WithTokenTTL(time.Second), WithTokenTTL(-time.Minute), WithPruneInterval(time.Millisecond),
+			WithIDStart(0, 1), WithTokenShards(0), WithConfig(nil), WithStorage(nil)} {
+			_, err := New(opt)
+			assert.Equal(t, ErrInvalidConfig, err, "should check the options")
+		}
+		_, err := New(WithStorage(NewMemoryStorage()), WithIDStart(100, 100))
+		assert.Equal(t, ErrInvalidConfig, err, "should only set the IDs of its own storage")
+		_, err = New(WithStorage(NewMemoryStorage()), WithTokenShards(4))
+		assert.Equal(t, ErrInvalidConfig, err, "should only shard its own storage")
+		svr, _ := New(WithTokenShards(5))
+		assert.Equal(t, 8, len(memStore(svr).shards), "should round the shards up to a power of two")
+	}
+	{
+		at := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+		svr, _ := New(WithConfig(&ServerConfig{TOTPIssuer: "acme"}), WithTokenTTL(2*time.Minute), WithPruneInterval(time.Minute),
+			WithHasher(fastHasher), WithClock(NewManualClock(at)), WithIDStart(100, 200))
+		assert.Equal(t, "acme", svr.cfg.TOTPIssuer, "should start from the config")
+		assert.Equal(t, int32(60), svr.cfg.PruneIntervalSec, "should set the prune interval")
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		rid, _ := svr.CreateRole("admin")
+		assert.Equal(t, UserID(100), uid, "should start user IDs from the given one")
+		assert.Equal(t, RoleID(200), rid, "should start role IDs from the given one")
+		svr.Authenticate("anna", "passw0rd")
+		info, _ := svr.ListTokens(uid)
+		assert.Equal(t, at, info[0].Issued, "should use the clock")
+		assert.Equal(t, at.Add(2*time.Minute), info[0].Expires, "should set the token TTL")
+	}
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher turns passwords into self-describing hashes, which contain the algorithm, the cost
+// parameters and a random per-user salt. It can then verify passwords against such hashes.
+type PasswordHasher interface {
+	// Hash hashes a password with a new random salt.
+	Hash(password string) ([]byte, error)
+	// Verify checks a password against a hash made by the same kind of hasher, whatever its cost
+	// parameters were.
+	// Errors: ErrHashFormat if the hash was not made by this kind of hasher
+	Verify(password string, hash []byte) (bool, error)
+}
+
+// RehashChecker is implemented by hashers that can tell if a hash of their kind was made with other
+// cost parameters than they would use, e.g. before the parameters were raised. It is optional;
+// see ServerConfig.RehashOnLogin.
+type RehashChecker interface {
+	NeedsRehash(hash []byte) bool
+}
+
+var (
+	ErrHashFormat = newError("hash_format", http.StatusBadRequest, "unrecognized password hash format")
+)
+
+var b64 = base64.RawStdEncoding
+
+// newSalt creates n random bytes.
+func newSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// *-* Argon2id *-*
+
+// Argon2idHasher hashes passwords with Argon2id, in the PHC string format
+// "$argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<hash>".
+// Zero fields take the defaults recommended by OWASP: 19 MiB of memory, 2 passes and 1 thread,
+// with a 16-byte salt and a 32-byte key.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+func (h *Argon2idHasher) params() (t, m uint32, p uint8, saltLen, keyLen uint32) {
+	t, m, p, saltLen, keyLen = 2, 19*1024, 1, 16, 32
+	if h.Time > 0 {
+		t = h.Time
+	}
+	if h.Memory > 0 {
+		m = h.Memory
+	}
+	if h.Threads > 0 {
+		p = h.Threads
+	}
+	if h.SaltLen > 0 {
+		saltLen = h.SaltLen
+	}
+	if h.KeyLen > 0 {
+		keyLen = h.KeyLen
+	}
+	return
+}
+
+func (h *Argon2idHasher) Hash(password string) ([]byte, error) {
+	t, m, p, saltLen, keyLen := h.params()
+	salt, err := newSalt(int(saltLen))
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, t, m, p, keyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, m, t, p, b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+func (h *Argon2idHasher) Verify(password string, hash []byte) (bool, error) {
+	a, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), a.salt, a.t, a.m, a.p, uint32(len(a.key)))
+	return subtle.ConstantTimeCompare(a.key, other) == 1, nil
+}
+
+// argon2idHash is a hash of Argon2idHasher, parsed.
+type argon2idHash struct {
+	t, m      uint32
+	p         uint8
+	salt, key []byte
+}
+
+// parseArgon2id parses a hash of Argon2idHasher. It rejects the parameters that argon2.IDKey
+// panics on, and empty keys, which every password would match.
+//
+// Errors: ErrHashFormat
+func parseArgon2id(hash []byte) (*argon2idHash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrHashFormat
+	}
+	var (
+		a       argon2idHash
+		version int
+		err     error
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.m, &a.t, &a.p); err != nil || a.t < 1 || a.p < 1 {
+		return nil, ErrHashFormat
+	}
+	if a.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return nil, ErrHashFormat
+	}
+	if a.key, err = b64.DecodeString(parts[5]); err != nil || len(a.key) == 0 {
+		return nil, ErrHashFormat
+	}
+	return &a, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	t, m, p, _, keyLen := h.params()
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return true
+	}
+	key, err := b64.DecodeString(parts[5])
+	return err != nil || parts[2] != fmt.Sprintf("v=%d", argon2.Version) ||
+		parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", m, t, p) || uint32(len(key)) != keyLen
+}
+
+// *-* bcrypt *-*
+
+// BcryptHasher hashes passwords with bcrypt, in its usual "$2a$<cost>$..." format.
+// A zero Cost means bcrypt.DefaultCost. Note that bcrypt only uses the first 72 bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) ([]byte, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), cost)
+}
+
+func (h *BcryptHasher) Verify(password string, hash []byte) (bool, error) {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return false, ErrHashFormat
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	want := h.Cost
+	if want == 0 {
+		want = bcrypt.DefaultCost
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != want
+}
+
+// *-* scrypt *-*
+
+// ScryptHasher hashes passwords with scrypt, in the format "$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>".
+// Zero fields take the defaults recommended by OWASP: N=2^17, r=8 and p=1, with a 16-byte salt
+// and a 32-byte key.
+type ScryptHasher struct {
+	LogN    uint8
+	R, P    int
+	SaltLen int
+	KeyLen  int
+}
+
+func (h *ScryptHasher) params() (ln uint8, r, p, saltLen, keyLen int) {
+	ln, r, p, saltLen, keyLen = 17, 8, 1, 16, 32
+	if h.LogN > 0 {
+		ln = h.LogN
+	}
+	if h.R > 0 {
+		r = h.R
+	}
+	if h.P > 0 {
+		p = h.P
+	}
+	if h.SaltLen > 0 {
+		saltLen = h.SaltLen
+	}
+	if h.KeyLen > 0 {
+		keyLen = h.KeyLen
+	}
+	return
+}
+
+func (h *ScryptHasher) Hash(password string) ([]byte, error) {
+	ln, r, p, saltLen, keyLen := h.params()
+	salt, err := newSalt(saltLen)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<ln, r, p, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		ln, r, p, b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+func (h *ScryptHasher) Verify(password string, hash []byte) (bool, error) {
+	sh, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), sh.salt, 1<<sh.ln, sh.r, sh.p, len(sh.key))
+	if err != nil {
+		return false, ErrHashFormat
+	}
+	return subtle.ConstantTimeCompare(sh.key, other) == 1, nil
+}
+
+// scryptHash is a hash of ScryptHasher, parsed.
+type scryptHash struct {
+	ln        uint8
+	r, p      int
+	salt, key []byte
+}
+
+// parseScrypt parses a hash of ScryptHasher. It rejects empty keys, which every password would
+// match; scrypt.Key checks the other parameters.
+//
+// Errors: ErrHashFormat
+func parseScrypt(hash []byte) (*scryptHash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return nil, ErrHashFormat
+	}
+	var (
+		sh  scryptHash
+		err error
+	)
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &sh.ln, &sh.r, &sh.p); err != nil || sh.ln >= 32 {
+		return nil, ErrHashFormat
+	}
+	if sh.salt, err = b64.DecodeString(parts[3]); err != nil {
+		return nil, ErrHashFormat
+	}
+	if sh.key, err = b64.DecodeString(parts[4]); err != nil || len(sh.key) == 0 {
+		return nil, ErrHashFormat
+	}
+	return &sh, nil
+}
+
+func (h *ScryptHasher) NeedsRehash(hash []byte) bool {
+	ln, r, p, _, keyLen := h.params()
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return true
+	}
+	key, err := b64.DecodeString(parts[4])
+	return err != nil || parts[2] != fmt.Sprintf("ln=%d,r=%d,p=%d", ln, r, p) || len(key) != keyLen
+}
+
+// *-* Server side *-*
+
+// knownHashers are tried in order when verifying a hash not made by the configured hasher,
+// so that switching algorithms does not lock out existing users.
+var knownHashers = []PasswordHasher{&Argon2idHasher{}, &BcryptHasher{}, &ScryptHasher{}}
+
+// hashPassword hashes a new password with the configured hasher, and the current pepper if any.
+func (s *Server) hashPassword(password string) ([]byte, error) {
+	if len(s.cfg.Peppers) == 0 {
+		return s.hasher.Hash(password)
+	}
+	p := &s.cfg.Peppers[0]
+	hash, err := s.hasher.Hash(p.mix(password))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(pepperPrefix+p.ID), hash...), nil
+}
+
+// verifyPassword checks a password against a stored hash, whatever hasher made it.
+// Unsalted SHA-256 hashes, as created by early versions of this package, are only accepted with
+// ServerConfig.LegacySHA256. stale tells if hashPassword would make another kind of hash, i.e. if
+// the hash was made by another hasher, by this one with other parameters (see RehashChecker), or
+// with another pepper than the current one.
+func (s *Server) verifyPassword(password string, hash []byte) (ok, stale bool, err error) {
+	if id, inner, peppered := splitPepper(hash); peppered {
+		p := s.pepper(id)
+		if p == nil {
+			// Made with a pepper that was removed from the config
+			return false, false, ErrHashFormat
+		}
+		ok, stale, err = s.verifyHash(p.mix(password), inner)
+		return ok, stale || p != &s.cfg.Peppers[0], err
+	}
+	ok, stale, err = s.verifyHash(password, hash)
+	return ok, stale || len(s.cfg.Peppers) > 0, err
+}
+
+// verifyHash checks a password against a hash without a pepper, see verifyPassword.
+func (s *Server) verifyHash(password string, hash []byte) (ok, stale bool, err error) {
+	for i, h := range append([]PasswordHasher{s.hasher}, knownHashers...) {
+		ok, err := h.Verify(password, hash)
+		if err != ErrHashFormat {
+			if i == 0 {
+				c, isChecker := h.(RehashChecker)
+				stale = isChecker && c.NeedsRehash(hash)
+			}
+			return ok, i > 0 || stale, err
+		}
+	}
+	if s.cfg.LegacySHA256 && len(hash) == sha256.Size {
+		return subtle.ConstantTimeCompare(getPasswordHash(password), hash) == 1, true, nil
+	}
+	return false, false, ErrHashFormat
+}
+
+// dummyPassword is hashed once for dummyVerify.
+const dummyPassword = "dummy password for unknown users"
+
+// dummyVerify verifies a password against a hash made once by the server, for logins without a
+// hash to verify, such as those of unknown names or of service accounts, so that they take as long
+// as those with a wrong password, and the time of a login does not tell whether a user exists.
+func (s *Server) dummyVerify(password string) {
+	s.dummyOnce.Do(func() {
+		s.dummyHash, _ = s.hashPassword(dummyPassword)
+	})
+	if s.dummyHash != nil {
+		_, _, _ = s.verifyPassword(password, s.dummyHash)
+	}
+}
+
+// rehash replaces the stale hash of a user with one of the configured hasher, once the password
+// has been verified. It is best effort: the old hash still works if it fails.
+func (s *Server) rehash(ctx context.Context, userObj *User, password string) {
+	secret, err := s.hashPassword(password)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.getUser(ctx, userObj.ID)
+	// Unless the password was changed meanwhile
+	if err != nil || !bytes.Equal(cur.Secret, userObj.Secret) {
+		return
+	}
+	cur = cur.clone()
+	cur.Secret = secret
+	_ = s.store.UpdateUser(ctx, cur)
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"$argon2id$": &Argon2idHasher{Time: 1, Memory: 64},
+		"$2a$":       &BcryptHasher{Cost: 4},
+		"$scrypt$":   &ScryptHasher{LogN: 4},
+	}
+	for prefix, h := range hashers {
+		hash, err := h.Hash("passw0rd")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, strings.HasPrefix(string(hash), prefix), "should be in the standard format")
+		other, _ := h.Hash("passw0rd")
+		assert.NotEqual(t, hash, other, "should use a random salt")
+
+		ok, err := h.Verify("passw0rd", hash)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should accept the right password")
+		ok, _ = h.Verify("passw1rd", hash)
+		assert.Equal(t, false, ok, "should reject a wrong password")
+
+		for otherPrefix, otherHasher := range hashers {
+			if otherPrefix != prefix {
+				_, err := otherHasher.Verify("passw0rd", hash)
+				assert.Equal(t, ErrHashFormat, err, "should not accept hashes of other algorithms")
+			}
+		}
+	}
+}
+
+func TestChangeHasher(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 60, Hasher: &BcryptHasher{Cost: 4}}
+	svr, _ := NewInMemoryServer(cfg)
+	svr.CreateUser("anna", "passw0rd")
+
+	store := svr.store
+	cfg.Hasher = &ScryptHasher{LogN: 4}
+	svr, _ = NewServer(cfg, store)
+	_, err := svr.Authenticate("anna", "passw0rd")
+	assert.Equal(t, nil, err, "should still accept bcrypt hashes after switching to scrypt")
+}
+
+func TestLegacySHA256(t *testing.T) {
+	store := NewMemoryStorage()
+	store.InsertUser(context.Background(), &User{Name: "anna", Secret: getPasswordHash("passw0rd"), Roles: map[RoleID]*Role{}})
+	{
+		svr, _ := NewServer(&ServerConfig{TokenExpireSec: 60}, store)
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject unsalted hashes by default")
+	}
+	{
+		svr, _ := NewServer(&ServerConfig{TokenExpireSec: 60, LegacySHA256: true}, store)
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should accept unsalted hashes in compatibility mode")
+		_, err = svr.Authenticate("anna", "passw1rd")
+		assert.Equal(t, ErrInvalidAuth, err, "should still check the password")
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	store.InsertUser(ctx, &User{Name: "anna", Secret: getPasswordHash("passw0rd"), Roles: map[RoleID]*Role{}})
+	secret := func() string {
+		u, _ := store.GetUserByName(ctx, "anna")
+		return string(u.Secret)
+	}
+	{
+		svr, _ := NewServer(&ServerConfig{TokenExpireSec: 60, LegacySHA256: true, Hasher: &BcryptHasher{Cost: 4}}, store)
+		svr.Authenticate("anna", "passw1rd")
+		assert.Equal(t, false, strings.HasPrefix(secret(), "$2a$"), "should not rehash on failed logins")
+		svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, false, strings.HasPrefix(secret(), "$2a$"), "should not rehash by default")
+	}
+	{
+		cfg := &ServerConfig{TokenExpireSec: 60, LegacySHA256: true, RehashOnLogin: true, Hasher: &BcryptHasher{Cost: 4}}
+		svr, _ := NewServer(cfg, store)
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "$2a$04$", secret()[:7], "should rehash legacy hashes with the configured hasher")
+		before := secret()
+		svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, before, secret(), "should keep current hashes")
+
+		cfg.Hasher = &BcryptHasher{Cost: 5}
+		svr, _ = NewServer(cfg, store)
+		svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, "$2a$05$", secret()[:7], "should rehash with raised costs")
+
+		cfg.Hasher = &ScryptHasher{LogN: 4}
+		cfg.LegacySHA256 = false
+		svr, _ = NewServer(cfg, store)
+		svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, "$scrypt$ln=4,", secret()[:13], "should rehash after switching algorithms")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should accept the password with the new hash")
+	}
+	{
+		argon := &Argon2idHasher{Time: 1, Memory: 64}
+		hash, _ := argon.Hash("passw0rd")
+		assert.Equal(t, false, argon.NeedsRehash(hash), "should keep hashes with the same parameters")
+		assert.Equal(t, true, (&Argon2idHasher{Time: 2, Memory: 64}).NeedsRehash(hash), "should rehash with other parameters")
+		scryptHash, _ := (&ScryptHasher{LogN: 4}).Hash("passw0rd")
+		assert.Equal(t, true, (&ScryptHasher{LogN: 5}).NeedsRehash(scryptHash), "should rehash with other parameters")
+	}
+}
+
+func TestPeppers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	old := Pepper{ID: "1", Key: []byte("0123456789abcdef")}
+	cur := Pepper{ID: "2", Key: []byte("fedcba9876543210")}
+	cfg := &ServerConfig{TokenExpireSec: 60, Hasher: &BcryptHasher{Cost: 4}}
+	secret := func() string {
+		u, _ := store.GetUserByName(ctx, "anna")
+		return string(u.Secret)
+	}
+	{
+		svr, _ := NewServer(cfg, store)
+		svr.CreateUser("anna", "passw0rd")
+		cfg.Peppers = []Pepper{old}
+		svr, _ = NewServer(cfg, store)
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should still accept hashes without a pepper")
+		svr.SetPassword(svr.GetUserByName("anna").ID, "passw0rd")
+		assert.Equal(t, "$pepper$1$2a$04$", secret()[:16], "should name the pepper in new hashes")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should accept the password")
+		_, err = svr.Authenticate("anna", "passw1rd")
+		assert.Equal(t, ErrInvalidAuth, err, "should still check the password")
+	}
+	{
+		cfg.Peppers = []Pepper{cur, old}
+		cfg.RehashOnLogin = true
+		svr, _ := NewServer(cfg, store)
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should accept hashes of older peppers")
+		assert.Equal(t, "$pepper$2$", secret()[:10], "should rehash with the current pepper")
+
+		cfg.Peppers = []Pepper{{ID: "3", Key: cur.Key}}
+		svr, _ = NewServer(cfg, store)
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject hashes of removed peppers")
+	}
+	{
+		for _, peppers := range [][]Pepper{{{ID: "", Key: cur.Key}}, {{ID: "a$b", Key: cur.Key}}, {{ID: "1", Key: []byte("short")}}, {old, old}} {
+			_, err := NewServer(&ServerConfig{TokenExpireSec: 60, Peppers: peppers}, store)
+			assert.Equal(t, ErrInvalidConfig, err, "should reject unusable peppers")
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      16,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		BannedWords:    []string{"Password"},
+		RejectUsername: true,
+	}
+	assert.Equal(t, []string{
+		"at least 8 characters", "at most 16 characters", "an uppercase letter", "a digit", "a symbol",
+		"no common words or phrases", "not containing the username",
+	}, p.Describe(), "should describe all rules")
+	assert.Equal(t, nil, p.Check("anna", "Tr0ub4dor&3"), "should accept a strong password")
+	assert.Equal(t, ErrWeakPassword, p.Check("anna", "Tr0ub4dor3"), "should require a symbol")
+	assert.Equal(t, []string{"at least 8 characters", "an uppercase letter", "a digit", "a symbol"},
+		p.Violations("anna", "short"), "should list all violations")
+	assert.Equal(t, []string{"no common words or phrases"}, p.Violations("anna", "MyPASSWORD1!"), "should reject banned words")
+	assert.Equal(t, []string{"not containing the username"}, p.Violations("anna", "Anna_1998!"), "should reject the username")
+	assert.Equal(t, []string{"at most 16 characters"}, p.Violations("anna", "Correct-Horse-Battery-1"), "should reject long passwords")
+	assert.Equal(t, nil, p.Check("anna", "Ünïcødé—Pässw8"), "should count characters rather than bytes")
+	assert.Equal(t, []string{"at least 6 characters"}, (&PasswordPolicy{}).Describe(), "should default to 6 characters")
+}
+
+func TestCreateUserPolicy(t *testing.T) {
+	svr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, PasswordPolicy: &PasswordPolicy{RequireDigit: true, RejectUsername: true}})
+	_, err := svr.CreateUser("anna", "nodigits")
+	assert.Equal(t, ErrWeakPassword, err, "should enforce the policy")
+	_, err = svr.CreateUser("anna", "anna1234")
+	assert.Equal(t, ErrWeakPassword, err, "should pass the username to the policy")
+	_, err = svr.CreateUser("anna", "passw0rd")
+	assert.Equal(t, nil, err, "should success")
+	policy := svr.PasswordPolicy()
+	assert.Equal(t, []string{"at least 6 characters", "a digit", "not containing the username"}, policy.Describe(), "should expose the policy")
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+)
+
+// Pepper is a secret mixed into password hashes, see ServerConfig.Peppers. Unlike salts, it is kept
+// out of the storage, e.g. in a secret manager, so that a leaked database is not enough to guess
+// the passwords.
+type Pepper struct {
+	// ID names the pepper in the hashes made with it, e.g. "2024-01". It must not contain "$".
+	ID string
+	// Key should be at least 32 random bytes. It must be at least 16.
+	Key []byte
+}
+
+const pepperPrefix = "$pepper$"
+
+// mix derives the string that is hashed in place of a password. HMAC output is also short enough
+// for the 72-byte limit of bcrypt, whatever the length of the password.
+func (p *Pepper) mix(password string) string {
+	mac := hmac.New(sha256.New, p.Key)
+	mac.Write([]byte(password))
+	return b64.EncodeToString(mac.Sum(nil))
+}
+
+// validPeppers tells if the peppers of a config have distinct and usable IDs and keys.
+func validPeppers(peppers []Pepper) bool {
+	seen := make(map[string]bool, len(peppers))
+	for _, p := range peppers {
+		if p.ID == "" || strings.Contains(p.ID, "$") || len(p.Key) < 16 || seen[p.ID] {
+			return false
+		}
+		seen[p.ID] = true
+	}
+	return true
+}
+
+// splitPepper splits a hash in the form "$pepper$<ID>$<hash of the hasher without its leading $>".
+func splitPepper(hash []byte) (id string, inner []byte, ok bool) {
+	if !bytes.HasPrefix(hash, []byte(pepperPrefix)) {
+		return "", nil, false
+	}
+	rest := hash[len(pepperPrefix):]
+	i := bytes.IndexByte(rest, '$')
+	if i <= 0 {
+		return "", nil, false
+	}
+	return string(rest[:i]), rest[i:], true
+}
+
+// pepper finds a configured pepper by ID, or returns nil.
+func (s *Server) pepper(id string) *Pepper {
+	for i := range s.cfg.Peppers {
+		if s.cfg.Peppers[i].ID == id {
+			return &s.cfg.Peppers[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Permissions are strings made of segments separated by colons, such as "orders:read".
+// When granted to a role, a segment can be a wildcard:
+//   - "*" in the middle matches exactly one segment, e.g. "orders:*:own" matches "orders:read:own"
+//   - "*" at the end matches one or more segments, e.g. "orders:*" matches "orders:read" and
+//     "orders:read:own", but not "orders"
+//   - "*" alone matches every permission
+//
+// Wildcards in a checked permission have no special meaning.
+
+var (
+	ErrInvalidPermission = newError("invalid_permission", http.StatusBadRequest, "invalid permission string")
+)
+
+// validatePermission rejects empty permissions and empty segments.
+func validatePermission(perm string) error {
+	if perm == "" {
+		return ErrInvalidPermission
+	}
+	for _, seg := range strings.Split(perm, ":") {
+		if seg == "" {
+			return ErrInvalidPermission
+		}
+	}
+	return nil
+}
+
+// matchPermission tells if a granted permission (possibly with wildcards) covers a requested one.
+func matchPermission(granted, requested string) bool {
+	g := strings.Split(granted, ":")
+	r := strings.Split(requested, ":")
+	for i, seg := range g {
+		if i >= len(r) {
+			return false
+		}
+		if seg == "*" {
+			if i == len(g)-1 {
+				return true
+			}
+			continue
+		}
+		if seg != r[i] {
+			return false
+		}
+	}
+	return len(g) == len(r)
+}
+
+// MatchPermission tells if a granted permission, possibly with wildcards, covers a requested one,
+// as CheckPermission does, e.g. for fakes of the server (see Service).
+func MatchPermission(granted, requested string) bool {
+	return validatePermission(requested) == nil && matchPermission(granted, requested)
+}
+
+// matchAny tells if any of the granted permissions covers a requested one.
+func matchAny(granted []string, requested string) bool {
+	for _, g := range granted {
+		if matchPermission(g, requested) {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantPermissionToRole adds a permission to a role. It is a no-op if the role already has it.
+//
+// Returns: none
+// Errors: ErrRoleNotExist, ErrInvalidPermission
+func (s *Server) GrantPermissionToRole(role RoleID, perm string) (err error) {
+	s, sp := s.trace("auth.GrantPermissionToRole")
+	defer func() { sp.end(err) }()
+	if s.cfg.Interceptors == nil {
+		return s.grantPermission(role, perm)
+	}
+	op := &Operation{Method: "GrantPermissionToRole", Role: role, Permission: perm}
+	return s.intercept(op, func(s *Server) error {
+		return s.grantPermission(op.Role, op.Permission)
+	})
+}
+
+// grantPermission is GrantPermissionToRole without the interceptors.
+func (s *Server) grantPermission(role RoleID, perm string) (err error) {
+	if err := validatePermission(perm); err != nil {
+		return err
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	if roleObj.hasPermission(perm) {
+		return nil
+	}
+	roleObj = roleObj.clone()
+	roleObj.Permissions = append(roleObj.Permissions, perm)
+	sort.Strings(roleObj.Permissions)
+	return s.store.UpdateRole(ctx, roleObj)
+}
+
+// RevokePermissionFromRole removes a permission from a role. It is a no-op if the role does not
+// have it. Only the exact string is removed: revoking "orders:read" from a role granted "orders:*"
+// changes nothing.
+//
+// Returns: none
+// Errors: ErrRoleNotExist, ErrInvalidPermission
+func (s *Server) RevokePermissionFromRole(role RoleID, perm string) (err error) {
+	s, sp := s.trace("auth.RevokePermissionFromRole")
+	defer func() { sp.end(err) }()
+	if err := validatePermission(perm); err != nil {
+		return err
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return err
+	}
+	if !roleObj.hasPermission(perm) {
+		return nil
+	}
+	roleObj = roleObj.clone()
+	perms := roleObj.Permissions[:0]
+	for _, p := range roleObj.Permissions {
+		if p != perm {
+			perms = append(perms, p)
+		}
+	}
+	if len(perms) == 0 {
+		perms = nil
+	}
+	roleObj.Permissions = perms
+	return s.store.UpdateRole(ctx, roleObj)
+}
+
+// CheckPermission checks if any role of the user identified by the token (including the roles of
+// the groups of the user) grants the permission, and no deny rule of the user or its roles denies
+// it (see DenyPermissionToRole for the order of evaluation).
+// Roles are looked up at the time of the check, so permission changes apply to existing tokens.
+// For tokens with a scope, only the roles in the scope count, and the permission must match one
+// of the scope, if any: that of API keys with scopes too. Permissions listed in ServerConfig.StepUp
+// are only granted to tokens authenticated as it demands. Results may come from the decision
+// cache, see ServerConfig.DecisionCacheSec.
+//
+// Returns: true or false
+// Errors: ErrInvalidToken, ErrInvalidPermission, ErrStepUpRequired
+func (s *Server) CheckPermission(token TokenValue, perm string) (ok bool, err error) {
+	s, sp := s.trace("auth.CheckPermission")
+	defer func() { sp.check(ok, err) }()
+	if s.cfg.Interceptors == nil {
+		return s.cachedCheckPermission(token, perm)
+	}
+	op := &Operation{Method: "CheckPermission", Token: token, Permission: perm}
+	err = s.intercept(op, func(s *Server) (err error) {
+		op.Allowed, err = s.cachedCheckPermission(op.Token, op.Permission)
+		return err
+	})
+	return op.Allowed && err == nil, err
+}
+
+// cachedCheckPermission is CheckPermission without the interceptors.
+func (s *Server) cachedCheckPermission(token TokenValue, perm string) (bool, error) {
+	if err := validatePermission(perm); err != nil {
+		return false, err
+	}
+	return s.cachedCheck(decisionKey{token: token, perm: perm}, func() (bool, UserID, error) {
+		return s.checkPermission(token, perm)
+	})
+}
+
+// checkPermission is CheckPermission without the cache. It also tells the user of the token.
+func (s *Server) checkPermission(token TokenValue, perm string) (bool, UserID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userObj, scope, a, err := s.verifyAuthn(token)
+	if err != nil {
+		return false, 0, err
+	}
+	ok, err := s.userPermission(userObj, scope, perm)
+	if err != nil {
+		return false, 0, err
+	}
+	if ok {
+		// Only once granted, as logging in again would not help otherwise
+		if err := s.checkStepUp(a, perm); err != nil {
+			return false, 0, err
+		}
+	}
+	return ok, userObj.ID, nil
+}
+
+// userPermission checks if a user holds a permission, within the scope of its token, if any.
+func (s *Server) userPermission(userObj *User, scope *TokenScope, perm string) (bool, error) {
+	ctx := s.ctx
+	if scope != nil && !scope.allows(perm) {
+		return false, nil
+	}
+	if matchAny(userObj.Denied, perm) {
+		return false, nil
+	}
+	roles, err := s.effectiveRoles(userObj)
+	if err != nil {
+		return false, err
+	}
+	// Deny rules apply whatever the scope, so only the grants are limited to it
+	inScope := roles
+	if scope != nil {
+		inScope = make(map[RoleID]struct{}, len(roles))
+		for role := range roles {
+			inScope[role] = struct{}{}
+		}
+		scope.limit(inScope)
+	}
+	granted := false
+	for role := range roles {
+		roleObj, err := s.store.GetRole(ctx, role)
+		if err == ErrRoleNotExist {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if matchAny(roleObj.Denied, perm) {
+			return false, nil
+		}
+		if _, ok := inScope[role]; ok && !granted {
+			granted = matchAny(roleObj.Permissions, perm)
+		}
+	}
+	return granted, nil
+}
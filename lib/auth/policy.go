@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes the requirements for new passwords.
+// Lengths are counted in Unicode characters. Zero values disable a rule, except MinLength which
+// defaults to 6.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	// Character classes that must appear at least once
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool // punctuation or symbols, such as "!" or "$"
+
+	// BannedWords are rejected anywhere in the password, case-insensitively.
+	BannedWords []string
+	// RejectUsername rejects passwords containing the username, case-insensitively.
+	RejectUsername bool
+}
+
+// DefaultPasswordPolicy only asks for 6 characters, as early versions of this package did.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 6}
+
+func (p *PasswordPolicy) minLength() int {
+	if p.MinLength <= 0 {
+		return DefaultPasswordPolicy.MinLength
+	}
+	return p.MinLength
+}
+
+// Check tells if a password satisfies the policy.
+//
+// Returns: none
+// Errors: ErrWeakPassword
+func (p *PasswordPolicy) Check(username, password string) error {
+	if len(p.Violations(username, password)) > 0 {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+// Violations lists the requirements (in the wording of Describe) that a password does not satisfy.
+// It is empty if the password is acceptable.
+func (p *PasswordPolicy) Violations(username, password string) []string {
+	var (
+		list  []string
+		n     = utf8.RuneCountInString(password)
+		lower = strings.ToLower(password)
+	)
+	if n < p.minLength() {
+		list = append(list, p.describeMin())
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		list = append(list, p.describeMax())
+	}
+	for _, class := range p.classes() {
+		if strings.IndexFunc(password, class.is) < 0 {
+			list = append(list, class.desc)
+		}
+	}
+	for _, word := range p.BannedWords {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			list = append(list, describeBanned)
+			break
+		}
+	}
+	if p.RejectUsername && username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		list = append(list, describeUsername)
+	}
+	return list
+}
+
+// Describe lists the requirements of the policy in plain English, so that UIs can show them.
+// For example: "at least 8 characters", "an uppercase letter".
+func (p *PasswordPolicy) Describe() []string {
+	list := []string{p.describeMin()}
+	if p.MaxLength > 0 {
+		list = append(list, p.describeMax())
+	}
+	for _, class := range p.classes() {
+		list = append(list, class.desc)
+	}
+	if len(p.BannedWords) > 0 {
+		list = append(list, describeBanned)
+	}
+	if p.RejectUsername {
+		list = append(list, describeUsername)
+	}
+	return list
+}
+
+const (
+	describeBanned   = "no common words or phrases"
+	describeUsername = "not containing the username"
+)
+
+func (p *PasswordPolicy) describeMin() string {
+	return fmt.Sprintf("at least %d characters", p.minLength())
+}
+
+func (p *PasswordPolicy) describeMax() string {
+	return fmt.Sprintf("at most %d characters", p.MaxLength)
+}
+
+type charClass struct {
+	is   func(rune) bool
+	desc string
+}
+
+func (p *PasswordPolicy) classes() []charClass {
+	var list []charClass
+	if p.RequireUpper {
+		list = append(list, charClass{unicode.IsUpper, "an uppercase letter"})
+	}
+	if p.RequireLower {
+		list = append(list, charClass{unicode.IsLower, "a lowercase letter"})
+	}
+	if p.RequireDigit {
+		list = append(list, charClass{unicode.IsDigit, "a digit"})
+	}
+	if p.RequireSymbol {
+		list = append(list, charClass{func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) }, "a symbol"})
+	}
+	return list
+}
+
+// PasswordPolicy returns the requirements for new passwords on this server.
+func (s *Server) PasswordPolicy() PasswordPolicy {
+	return s.LiveConfig().PasswordPolicy
+}
+
+// checkPassword evaluates the password policy for a user, then the BreachChecker. It is the single
+// place that validates new passwords, wherever they come from.
+//
+// Errors: ErrWeakPassword, ErrBreachedPassword, or any error from the BreachChecker
+func (s *Server) checkPassword(ctx context.Context, username, password string) error {
+	if err := s.live().PasswordPolicy.Check(username, password); err != nil {
+		return err
+	}
+	return s.checkBreached(ctx, password)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeterministicRand(t *testing.T) {
+	{
+		a, b := make([]byte, 100), make([]byte, 100)
+		NewDeterministicRand(1).Read(a)
+		r := NewDeterministicRand(1)
+		r.Read(b[:7])
+		r.Read(b[7:50])
+		r.Read(b[50:])
+		assert.Equal(t, a, b, "should give the same bytes for a seed, however they are read")
+		NewDeterministicRand(2).Read(b)
+		assert.NotEqual(t, a, b, "should give other bytes for other seeds")
+	}
+
+	// issue runs the same steps on a new server
+	issue := func(opts ...Option) []string {
+		jwt := &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), KeyID: "k1"}
+		svr, _ := New(append([]Option{WithConfig(&ServerConfig{JWT: jwt}), WithTokenTTL(time.Hour), WithHasher(fastHasher),
+			WithClock(NewManualClock(time.Unix(1700000000, 0)))}, opts...)...)
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		key, _ := svr.CreateAPIKey(uid, "ci", nil, time.Time{})
+		enrollment, _ := svr.EnrollTOTP(uid)
+		kid, _ := svr.RotateJWTKey(nil, time.Hour)
+		return []string{string(token), string(key), enrollment.Secret, enrollment.RecoveryCodes[0], kid}
+	}
+	{
+		first := issue(WithRand(NewDeterministicRand(1)))
+		assert.Equal(t, first, issue(WithRand(NewDeterministicRand(1))), "should issue the same values for a seed")
+		second := issue(WithRand(NewDeterministicRand(2)))
+		for i := range first {
+			assert.NotEqual(t, first[i], second[i], "should issue other values for other seeds")
+		}
+		assert.NotEqual(t, first, issue(), "should default to crypto/rand")
+	}
+	{
+		svr, _ := New(WithHasher(fastHasher), WithRand(bytes.NewReader(bytes.Repeat([]byte{0xff}, defaultTokenBytes))))
+		svr.CreateUser("anna", "passw0rd")
+		token, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should take any reader")
+		assert.Equal(t, TokenValue(base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, defaultTokenBytes))), token, "should draw the token from the reader")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrInternal, err, "should fail when the reader does")
+		svr, _ = New(WithHasher(fastHasher), WithRand(iotest.ErrReader(io.ErrUnexpectedEOF)))
+		svr.CreateUser("anna", "passw0rd")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrInternal, err, "should fail when the reader does")
+	}
+}
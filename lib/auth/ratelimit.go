@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter throttles login attempts by key, see ServerConfig.RateLimiter. TokenBucket is the
+// built-in one; a limiter shared by the servers of a cluster can be backed by e.g. Redis.
+type RateLimiter interface {
+	// Allow takes an attempt from the allowance of key, and tells if there was one left.
+	Allow(ctx context.Context, key string) (bool, error)
+	// Reset gives key its full allowance back.
+	Reset(ctx context.Context, key string) error
+}
+
+var ErrRateLimited = newError("rate_limited", http.StatusTooManyRequests, "too many login attempts")
+
+const (
+	defaultBurst    = 5
+	defaultInterval = time.Minute
+	// minSweep is the number of buckets a TokenBucket holds before forgetting the full ones
+	minSweep = 1024
+)
+
+// TokenBucket is a RateLimiter in memory, for a single server: each key may make Burst attempts
+// at once, and is given one back every Interval, up to Burst again. Keys with their full allowance
+// are forgotten from time to time, so memory stays bounded by the keys recently throttled. The
+// zero value allows 5 attempts, and one more per minute.
+type TokenBucket struct {
+	Burst    int
+	Interval time.Duration
+	Clock    Clock // defaults to SystemClock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweepAt int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow implements RateLimiter. It never fails.
+func (b *TokenBucket) Allow(_ context.Context, key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.buckets == nil {
+		b.buckets, b.sweepAt = make(map[string]*bucket), minSweep
+	}
+	k, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= b.sweepAt {
+			b.sweep(now)
+		}
+		k = &bucket{tokens: float64(b.burst()), last: now}
+		b.buckets[key] = k
+	}
+	b.refill(k, now)
+	if k.tokens < 1 {
+		return false, nil
+	}
+	k.tokens--
+	return true, nil
+}
+
+// Reset implements RateLimiter. It never fails.
+func (b *TokenBucket) Reset(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.buckets, key)
+	return nil
+}
+
+// refill gives a bucket the attempts it earned since it was last used. The caller must hold b.mu.
+func (b *TokenBucket) refill(k *bucket, now time.Time) {
+	if elapsed := now.Sub(k.last); elapsed > 0 {
+		k.tokens += float64(elapsed) / float64(b.interval())
+		if max := float64(b.burst()); k.tokens > max {
+			k.tokens = max
+		}
+	}
+	k.last = now
+}
+
+// sweep forgets the buckets that are full again, and doubles the threshold of the next sweep if
+// most are not. The caller must hold b.mu.
+func (b *TokenBucket) sweep(now time.Time) {
+	for key, k := range b.buckets {
+		if b.refill(k, now); k.tokens >= float64(b.burst()) {
+			delete(b.buckets, key)
+		}
+	}
+	if b.sweepAt = 2 * len(b.buckets); b.sweepAt < minSweep {
+		b.sweepAt = minSweep
+	}
+}
+
+func (b *TokenBucket) burst() int {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return defaultBurst
+}
+
+func (b *TokenBucket) interval() time.Duration {
+	if b.Interval > 0 {
+		return b.Interval
+	}
+	return defaultInterval
+}
+
+func (b *TokenBucket) now() time.Time {
+	if b.Clock != nil {
+		return b.Clock.Now()
+	}
+	return time.Now()
+}
+
+// *-* Server *-*
+
+// The keys of the attempts of a user (by normalized name) and of a source IP. They cannot collide,
+// as the prefixes differ.
+func userLimitKey(name string) string { return "user:" + name }
+func ipLimitKey(ip string) string     { return "ip:" + ip }
+
+// checkRateLimit takes a login attempt from the allowances of its user name and source IP, with
+// the RateLimiter of the server, if any. The source is the IP of the client given to
+// AuthenticateClient, or else that of the context (see WithClientInfo); without either, only the
+// name is limited.
+//
+// Errors: ErrRateLimited, or any error from the limiter
+func (s *Server) checkRateLimit(username string, client ClientInfo) error {
+	l := s.live().RateLimiter
+	if l == nil {
+		return nil
+	}
+	keys := []string{userLimitKey(s.cfg.UsernamePolicy.Normalize(username))}
+	if client.IP == "" {
+		client, _ = s.requestClient()
+	}
+	if client.IP != "" {
+		keys = append(keys, ipLimitKey(client.IP))
+	}
+	for _, key := range keys {
+		ok, err := l.Allow(s.ctx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s.emit(Event{Type: EventLoginThrottled, Name: username, IP: client.IP, UserAgent: client.UserAgent})
+			return ErrRateLimited
+		}
+	}
+	return nil
+}
+
+// resetRateLimit gives a user name its full allowance back after a successful login. That of the
+// source IP is kept, so that an attacker cannot reset it by logging in to an account of their own.
+func (s *Server) resetRateLimit(username string) {
+	if l := s.live().RateLimiter; l != nil {
+		_ = l.Reset(s.ctx, userLimitKey(s.cfg.UsernamePolicy.Normalize(username)))
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	b := &TokenBucket{Burst: 2, Interval: time.Minute, Clock: clock}
+	{
+		ok1, _ := b.Allow(ctx, "anna")
+		ok2, _ := b.Allow(ctx, "anna")
+		ok3, _ := b.Allow(ctx, "anna")
+		assert.Equal(t, []bool{true, true, false}, []bool{ok1, ok2, ok3}, "should allow a burst")
+		ok, _ := b.Allow(ctx, "elton")
+		assert.Equal(t, true, ok, "should keep keys apart")
+	}
+	{
+		clock.Advance(30 * time.Second)
+		ok, _ := b.Allow(ctx, "anna")
+		assert.Equal(t, false, ok, "should refill gradually")
+		clock.Advance(30 * time.Second)
+		ok, _ = b.Allow(ctx, "anna")
+		assert.Equal(t, true, ok, "should give an attempt back every interval")
+		clock.Advance(time.Hour)
+		ok1, _ := b.Allow(ctx, "anna")
+		ok2, _ := b.Allow(ctx, "anna")
+		ok3, _ := b.Allow(ctx, "anna")
+		assert.Equal(t, []bool{true, true, false}, []bool{ok1, ok2, ok3}, "should refill up to the burst")
+	}
+	{
+		assert.Equal(t, nil, b.Reset(ctx, "anna"), "should success")
+		ok, _ := b.Allow(ctx, "anna")
+		assert.Equal(t, true, ok, "should restore the allowance")
+	}
+	{
+		b := &TokenBucket{Clock: clock}
+		for i := 0; i < 2*minSweep; i++ {
+			b.Allow(ctx, strconv.Itoa(i))
+		}
+		clock.Advance(time.Hour)
+		b.Allow(ctx, "new")
+		assert.Equal(t, true, len(b.buckets) < minSweep, "should forget the full buckets")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, RateLimiter: &TokenBucket{Burst: 3}}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	svr.CreateUser("anna", "passw0rd")
+	svr.CreateUser("elton", "123456")
+	next, cancel := collect(svr, EventLoginThrottled)
+	defer cancel()
+	{
+		svr.Authenticate("anna", "wrong")
+		svr.Authenticate("anna", "wrong")
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should allow attempts within the burst")
+		svr.Authenticate("anna", "wrong")
+		svr.Authenticate("anna", "wrong")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should restore the allowance of the name on success")
+	}
+	{
+		for i := 0; i < 3; i++ {
+			svr.Authenticate("elton", "wrong")
+		}
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrRateLimited, err, "should throttle the name")
+		e := next(1)[0]
+		assert.Equal(t, "elton", e.Name, "should emit login.throttled")
+		assert.Equal(t, "rate_limited", ErrorClass(err), "should be rate_limited")
+	}
+	{
+		client := ClientInfo{IP: "10.0.0.1"}
+		svr.AuthenticateClient("bob", "x", client)
+		svr.AuthenticateClient("carl", "x", client)
+		svr.AuthenticateClient("dora", "x", client)
+		_, err := svr.AuthenticateClient("anna", "passw0rd", client)
+		assert.Equal(t, ErrRateLimited, err, "should throttle the source")
+		_, err = svr.WithContext(WithClientInfo(context.Background(), client)).Authenticate("anna", "passw0rd")
+		assert.Equal(t, ErrRateLimited, err, "should take the source from the context")
+		e := next(2)[1]
+		assert.Equal(t, "10.0.0.1", e.IP, "should record the source")
+		_, err = svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: "10.0.0.2"})
+		assert.Equal(t, nil, err, "should keep sources apart")
+	}
+}
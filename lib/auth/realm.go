@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Realms hosts isolated servers, one per realm (or tenant), in a single process. Each realm has
+// its own users, roles, groups and tokens in a storage of its own, and its own ServerConfig, so
+// token lifetimes, password policies and JWT keys can differ between tenants. Tokens only verify
+// in the realm that issued them, so administrators of a realm have no rights in others: JWTs carry
+// their realm, and are signed with a key of its own, see RealmJWTConfig.
+//
+// Realms are not persisted: the application creates them at startup, e.g. from its own config,
+// and closes them on shutdown. All methods are safe for concurrent use.
+type Realms struct {
+	defaults ServerConfig
+	newStore func(realm string) (Storage, error)
+
+	mu     sync.RWMutex
+	realms map[string]*Server
+	closed bool
+}
+
+// realmNameRE is what realm names may be made of, so that they can be used in URLs, file names
+// and database names.
+var realmNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+	ErrRealmExists   = newError("realm_exists", http.StatusConflict, "realm already exists")
+	ErrRealmNotExist = newError("realm_not_exist", http.StatusNotFound, "realm does not exist")
+	ErrInvalidRealm  = newError("invalid_realm", http.StatusBadRequest, "invalid realm name")
+)
+
+// NewRealms creates a host of realms. defaults is the config of realms created without one, and
+// newStore gives the storage of a new realm, e.g. a MemoryStorage, a directory of a walstore, or
+// a database of a sqlstore. A nil newStore makes MemoryStorages.
+//
+// Returns: pointer to the new host
+// Errors: ErrInvalidConfig, if defaults would not make a server, or have an RS256 JWT key
+func NewRealms(defaults *ServerConfig, newStore func(realm string) (Storage, error)) (*Realms, error) {
+	if _, err := NewServer(defaults, NewMemoryStorage()); err != nil {
+		return nil, err
+	}
+	if defaults.JWT != nil {
+		if _, err := RealmJWTConfig(defaults.JWT, ""); err != nil {
+			return nil, err
+		}
+	}
+	if newStore == nil {
+		newStore = func(string) (Storage, error) { return NewMemoryStorage(), nil }
+	}
+	return &Realms{defaults: *defaults, newStore: newStore, realms: make(map[string]*Server)}, nil
+}
+
+// CreateRealm adds a realm with its own config, or the defaults if config is nil. Names are made
+// of lower-case letters, digits and inner dashes, at most 63 of them. The JWT key of the config,
+// if any, is not used as is, but that of the realm is derived from it, see RealmJWTConfig.
+//
+// Returns: the server of the realm
+// Errors: ErrInvalidRealm, ErrRealmExists, ErrInvalidConfig, ErrServerClosed, or any error from
+// newStore
+func (r *Realms) CreateRealm(name string, config *ServerConfig) (*Server, error) {
+	if !realmNameRE.MatchString(name) {
+		return nil, ErrInvalidRealm
+	}
+	if config == nil {
+		config = &r.defaults
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrServerClosed
+	}
+	if _, ok := r.realms[name]; ok {
+		return nil, ErrRealmExists
+	}
+	cfg := *config
+	if cfg.JWT != nil {
+		jwt, err := RealmJWTConfig(cfg.JWT, name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.JWT = jwt
+	}
+	store, err := r.newStore(name)
+	if err != nil {
+		return nil, err
+	}
+	svr, err := NewServer(&cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	svr.realm = name
+	r.realms[name] = svr
+	return svr, nil
+}
+
+// Realm looks up the server of a realm. It is nil if there is no such realm.
+//
+// Returns: the server of the realm, or nil
+func (r *Realms) Realm(name string) *Server {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.realms[name]
+}
+
+// DeleteRealm removes a realm, whose tokens stop verifying through Realm, and closes its server
+// (see Server.Close). The data is left in its storage, for the caller to remove.
+//
+// Returns: none
+// Errors: ErrRealmNotExist, or any error from Server.Close
+func (r *Realms) DeleteRealm(ctx context.Context, name string) error {
+	r.mu.Lock()
+	svr, ok := r.realms[name]
+	if !ok {
+		r.mu.Unlock()
+		return ErrRealmNotExist
+	}
+	delete(r.realms, name)
+	r.mu.Unlock()
+	return svr.Close(ctx)
+}
+
+// Close closes the servers of all the realms (see Server.Close), and rejects the realms created
+// later with ErrServerClosed. Their storages are left open, to be closed by their owner.
+//
+// Returns: none
+// Errors: ErrServerClosed if already closed, or the first error from Server.Close
+func (r *Realms) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrServerClosed
+	}
+	r.closed = true
+	servers := make([]*Server, 0, len(r.realms))
+	for _, svr := range r.realms {
+		servers = append(servers, svr)
+	}
+	r.mu.Unlock()
+
+	var err error
+	for _, svr := range servers {
+		if cerr := svr.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ListRealms lists the names of the realms, in alphabetical order.
+//
+// Returns: the names
+func (r *Realms) ListRealms() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.realms))
+	for name := range r.realms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RealmJWTConfig derives the JWT config of a realm from that given to Realms, for the services
+// verifying its JWTs: the key is replaced with one of the realm, so that no two realms accept each
+// other's tokens, even when they share a config, and the KeyID, if set, ends with "-" and the
+// realm, so that the keys of realms get IDs of their own too. RS256 keys cannot be derived, so
+// realms only support HS256 and EdDSA.
+//
+// Returns: the config of the realm
+// Errors: ErrInvalidConfig
+func RealmJWTConfig(cfg *JWTConfig, realm string) (*JWTConfig, error) {
+	derive := func(key []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("auth realm " + realm))
+		return mac.Sum(nil)
+	}
+	derived := *cfg
+	switch k := cfg.Key.(type) {
+	case []byte:
+		if cfg.Algorithm != HS256 || len(k) == 0 {
+			return nil, ErrInvalidConfig
+		}
+		derived.Key = derive(k)
+	case ed25519.PrivateKey:
+		if cfg.Algorithm != EdDSA || len(k) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidConfig
+		}
+		derived.Key = ed25519.NewKeyFromSeed(derive(k.Seed()))
+	default:
+		return nil, ErrInvalidConfig
+	}
+	if cfg.KeyID != "" {
+		derived.KeyID = cfg.KeyID + "-" + realm
+	}
+	return &derived, nil
+}
+
+// Realm tells the realm of the server, or "" if it was not created by Realms.
+//
+// Returns: the name of the realm
+func (s *Server) Realm() string {
+	return s.realm
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealms(t *testing.T) {
+	_, err := NewRealms(&ServerConfig{TokenExpireSec: 1}, nil)
+	assert.Equal(t, ErrInvalidConfig, err, "should check the defaults")
+	ctx := context.Background()
+	realms, _ := NewRealms(&ServerConfig{TokenExpireSec: 60, Hasher: fastHasher}, nil)
+	{
+		for _, name := range []string{"", "Acme", "-acme", "acme-", "acme/1", string(make([]byte, 64))} {
+			_, err := realms.CreateRealm(name, nil)
+			assert.Equal(t, ErrInvalidRealm, err, "should reject the name %q", name)
+		}
+		_, err := realms.CreateRealm("acme", &ServerConfig{TokenExpireSec: 1})
+		assert.Equal(t, ErrInvalidConfig, err, "should check the config")
+		assert.Equal(t, []string{}, realms.ListRealms(), "should not add invalid realms")
+	}
+	acme, _ := realms.CreateRealm("acme", nil)
+	globex, err := realms.CreateRealm("globex", &ServerConfig{TokenExpireSec: 120, Hasher: fastHasher,
+		PasswordPolicy: &PasswordPolicy{MinLength: 12}})
+	{
+		assert.Equal(t, nil, err, "should success")
+		_, err = realms.CreateRealm("acme", nil)
+		assert.Equal(t, ErrRealmExists, err, "should reject taken names")
+		assert.Equal(t, acme, realms.Realm("acme"), "should find the realm")
+		assert.Equal(t, "globex", globex.Realm(), "should know its realm")
+		assert.Equal(t, []string{"acme", "globex"}, realms.ListRealms(), "should list the realms")
+	}
+	{
+		uid, _ := acme.CreateUser("anna", "passw0rd")
+		rid, _ := acme.CreateRole("admin")
+		acme.AddRoleToUser(uid, rid)
+		_, err := globex.CreateUser("anna", "passw0rd")
+		assert.Equal(t, ErrWeakPassword, err, "should apply the policy of the realm")
+		guid, err := globex.CreateUser("anna", "long passw0rd")
+		assert.Equal(t, nil, err, "should allow the same name in another realm")
+		assert.Equal(t, uid, guid, "should number users in each realm")
+
+		token, _ := acme.Authenticate("anna", "passw0rd")
+		_, err = globex.AllRoles(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not accept tokens of other realms")
+		ok, _ := acme.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should accept tokens of the realm")
+		globex.Authenticate("anna", "long passw0rd")
+		info, _ := globex.ListTokens(guid)
+		assert.Equal(t, 1, len(info), "should keep the tokens of each realm")
+		assert.Equal(t, 120*time.Second, info[0].Expires.Sub(info[0].Issued), "should apply the token TTL of the realm")
+	}
+	{
+		next, cancel := collect(acme, EventUserCreated)
+		defer cancel()
+		acme.CreateUser("belle", "passw0rd")
+		events := next(1)
+		assert.Equal(t, "acme", events[0].Realm, "should tell the realm of events")
+	}
+	{
+		newStoreErr := errors.New("no storage")
+		r, _ := NewRealms(&ServerConfig{TokenExpireSec: 60}, func(name string) (Storage, error) { return nil, newStoreErr })
+		_, err := r.CreateRealm("acme", nil)
+		assert.Equal(t, newStoreErr, err, "should report storage errors")
+		assert.Equal(t, ErrRealmNotExist, realms.DeleteRealm(ctx, "initech"), "should report missing realms")
+		assert.Equal(t, nil, realms.DeleteRealm(ctx, "acme"), "should success")
+		assert.Equal(t, (*Server)(nil), realms.Realm("acme"), "should remove the realm")
+		_, err = acme.CreateUser("fred", "passw0rd")
+		assert.Equal(t, ErrServerClosed, err, "should close the server of the realm")
+		_, err = realms.CreateRealm("acme", nil)
+		assert.Equal(t, nil, err, "should allow the name again")
+	}
+	{
+		assert.Equal(t, nil, realms.Close(ctx), "should success")
+		_, err := globex.CreateUser("fred", "long passw0rd")
+		assert.Equal(t, ErrServerClosed, err, "should close the servers of all the realms")
+		_, err = realms.CreateRealm("initech", nil)
+		assert.Equal(t, ErrServerClosed, err, "should not create realms once closed")
+		assert.Equal(t, ErrServerClosed, realms.Close(ctx), "should report closing twice")
+	}
+}
+
+func TestRealmsJWT(t *testing.T) {
+	jwt := &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t"), Issuer: "hsbc"}
+	realms, _ := NewRealms(&ServerConfig{TokenExpireSec: 60, Hasher: fastHasher, JWT: jwt}, nil)
+	acme, _ := realms.CreateRealm("acme", nil)
+	globex, _ := realms.CreateRealm("globex", nil)
+	var rid RoleID
+	for _, svr := range []*Server{acme, globex} {
+		uid, _ := svr.CreateUser("root", "passw0rd")
+		rid, _ = svr.CreateRole("admin")
+		svr.AddRoleToUser(uid, rid)
+	}
+	token, _ := acme.Authenticate("root", "passw0rd")
+	{
+		ok, err := acme.CheckRole(token, rid)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should accept the JWTs of the realm")
+		_, err = globex.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should not accept the JWTs of other realms")
+		_, err = globex.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not accept the JWTs of other realms")
+		in, _ := acme.Introspect(token)
+		assert.Equal(t, "acme", in.Realm, "should tell the realm")
+	}
+	{
+		cfg, _ := RealmJWTConfig(jwt, "globex")
+		v, _ := NewJWTVerifier(HS256, cfg.Key, "hsbc")
+		gtoken, _ := globex.Authenticate("root", "passw0rd")
+		claims, err := v.Verify(gtoken)
+		assert.Equal(t, nil, err, "should derive the key of the realm")
+		assert.Equal(t, "globex", claims.Realm, "should carry the realm")
+		_, err = v.Verify(token)
+		assert.Equal(t, ErrInvalidToken, err, "should sign with a key of each realm")
+
+		// Signed with the key of globex, but outside of it
+		outside, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, Hasher: fastHasher, JWT: cfg})
+		outside.CreateUser("root", "passw0rd")
+		otoken, _ := outside.Authenticate("root", "passw0rd")
+		_, err = globex.TokenUser(otoken)
+		assert.Equal(t, ErrInvalidToken, err, "should check the realm of the claims")
+	}
+	{
+		next := &JWTConfig{Algorithm: HS256, Key: []byte("n3xt"), Issuer: "hsbc", KeyID: "k2"}
+		kid, err := globex.RotateJWTKey(next, time.Minute)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "k2-globex", kid, "should give the keys of realms IDs of their own")
+		cfg, _ := RealmJWTConfig(next, "globex")
+		v, _ := NewJWTVerifier(HS256, cfg.Key, "hsbc")
+		gtoken, _ := globex.Authenticate("root", "passw0rd")
+		_, err = v.Verify(gtoken)
+		assert.Equal(t, nil, err, "should derive the rotated keys of realms")
+		v, _ = NewJWTVerifier(HS256, next.Key, "hsbc")
+		_, err = v.Verify(gtoken)
+		assert.Equal(t, ErrInvalidToken, err, "should not sign with the key as given")
+	}
+	{
+		ekey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+		r, err := NewRealms(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: EdDSA, Key: ekey}}, nil)
+		assert.Equal(t, nil, err, "should support EdDSA")
+		a, _ := r.CreateRealm("acme", nil)
+		b, _ := r.CreateRealm("globex", nil)
+		ka, _ := a.JWKSet()
+		kb, _ := b.JWKSet()
+		assert.NotEqual(t, ka.Keys[0].X, kb.Keys[0].X, "should derive a key pair of each realm")
+
+		rkey, _ := rsa.GenerateKey(rand.Reader, 1024)
+		_, err = NewRealms(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: RS256, Key: rkey}}, nil)
+		assert.Equal(t, ErrInvalidConfig, err, "should reject RS256 keys")
+		_, err = realms.CreateRealm("initech", &ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: RS256, Key: rkey}})
+		assert.Equal(t, ErrInvalidConfig, err, "should reject RS256 keys")
+	}
+}
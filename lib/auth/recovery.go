@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+)
+
+// Recovery codes stand in for a TOTP code when the authenticator is lost: each is accepted once by
+// CompleteMFA. Only their SHA-256 hashes are saved, which is enough for 48 random bits.
+
+const (
+	recoveryCodes     = 10
+	recoveryCodeBytes = 6
+)
+
+var recoveryEncoding = totpEncoding
+
+// newRecoveryCodes generates a set of recovery codes, as shown to the user, e.g. "mfrgg-zdfmz",
+// and their hashes.
+func (s *serverCore) newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodes)
+	hashes := make([][]byte, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if err := s.random(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a code, ignoring case, dashes and spaces.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+// matchRecovery finds the recovery code of a TOTP matching a code. It returns -1 if there is none.
+// All codes are compared, in constant time.
+func (t *TOTP) matchRecovery(code string) int {
+	sum := hashRecoveryCode(code)
+	found := -1
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare(sum, h) == 1 {
+			found = i
+		}
+	}
+	return found
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user enrolled in MFA with a new set,
+// e.g. when the old one was used up or lost. The old codes stop working.
+//
+// Returns: the new codes, to show the user once
+// Errors: ErrUserNotExist, ErrMFANotEnrolled, ErrInternal
+func (s *Server) RegenerateRecoveryCodes(user UserID) (_ []string, err error) {
+	s, sp := s.trace("auth.RegenerateRecoveryCodes")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	codes, hashes, err := s.newRecoveryCodes()
+	if err != nil {
+		return nil, ErrInternal
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if userObj.TOTP == nil {
+		return nil, ErrMFANotEnrolled
+	}
+	userObj = userObj.clone()
+	userObj.TOTP.RecoveryCodes = hashes
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft counts the recovery codes of a user that have not been used, e.g. to prompt for
+// new ones when few are left.
+//
+// Returns: the number of codes
+// Errors: ErrUserNotExist, ErrMFANotEnrolled
+func (s *Server) RecoveryCodesLeft(user UserID) (_ int, err error) {
+	s, sp := s.trace("auth.RecoveryCodesLeft")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	if userObj.TOTP == nil {
+		return 0, ErrMFANotEnrolled
+	}
+	return len(userObj.TOTP.RecoveryCodes), nil
+}
+
+// useRecoveryCode checks a recovery code of a user whose enrollment is confirmed, and removes it
+// if accepted, with an mfa.recovered event. The caller must hold s.mu.
+func (s *Server) useRecoveryCode(userObj *User, code string) (bool, error) {
+	if userObj.TOTP == nil || !userObj.TOTP.Confirmed {
+		return false, nil
+	}
+	i := userObj.TOTP.matchRecovery(code)
+	if i < 0 {
+		return false, nil
+	}
+	userObj = userObj.clone()
+	codes := userObj.TOTP.RecoveryCodes
+	userObj.TOTP.RecoveryCodes = append(codes[:i:i], codes[i+1:]...)
+	if err := s.store.UpdateUser(s.ctx, userObj); err != nil {
+		return false, err
+	}
+	s.emit(Event{Type: EventMFARecovered, User: userObj.ID, Name: userObj.Name})
+	return true, nil
+}
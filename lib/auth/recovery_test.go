@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	_, err := svr.RegenerateRecoveryCodes(uid)
+	assert.Equal(t, ErrMFANotEnrolled, err, "should require MFA")
+	_, err = svr.RecoveryCodesLeft(uid)
+	assert.Equal(t, ErrMFANotEnrolled, err, "should require MFA")
+
+	e, _ := svr.EnrollTOTP(uid)
+	assert.Equal(t, recoveryCodes, len(e.RecoveryCodes), "should give recovery codes")
+	assert.Equal(t, 11, len(e.RecoveryCodes[0]), "should format the codes")
+	hashes := svr.GetUser(uid).TOTP.RecoveryCodes
+	assert.Equal(t, hashRecoveryCode(e.RecoveryCodes[0]), hashes[0], "should save the codes hashed")
+	secret, _ := totpEncoding.DecodeString(e.Secret)
+	svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod))
+
+	challenge, _ := svr.Authenticate("elton", "123456")
+	next, cancel := collect(svr, EventMFARecovered)
+	defer cancel()
+	code := strings.ToUpper(strings.Replace(e.RecoveryCodes[3], "-", " ", 1))
+	token, err := svr.CompleteMFA(challenge, code)
+	assert.Equal(t, nil, err, "should accept a recovery code, ignoring case and spaces")
+	_, err = svr.TokenUser(token)
+	assert.Equal(t, nil, err, "should give a working session")
+	assert.Equal(t, uid, next(1)[0].User, "should emit mfa.recovered")
+	n, _ := svr.RecoveryCodesLeft(uid)
+	assert.Equal(t, recoveryCodes-1, n, "should use up the code")
+
+	challenge, _ = svr.Authenticate("elton", "123456")
+	_, err = svr.CompleteMFA(challenge, e.RecoveryCodes[3])
+	assert.Equal(t, ErrInvalidCode, err, "should not accept a code twice")
+	_, err = svr.CompleteMFA(challenge, e.RecoveryCodes[4])
+	assert.Equal(t, nil, err, "should accept the other codes")
+
+	codes, err := svr.RegenerateRecoveryCodes(uid)
+	assert.Equal(t, nil, err, "should success")
+	n, _ = svr.RecoveryCodesLeft(uid)
+	assert.Equal(t, recoveryCodes, n, "should replace the codes")
+	challenge, _ = svr.Authenticate("elton", "123456")
+	_, err = svr.CompleteMFA(challenge, e.RecoveryCodes[5])
+	assert.Equal(t, ErrInvalidCode, err, "should reject the old codes")
+	_, err = svr.CompleteMFA(challenge, codes[0])
+	assert.Equal(t, nil, err, "should accept the new codes")
+}
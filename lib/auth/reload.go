@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"time"
+)
+
+// LiveConfig is the part of a ServerConfig that can be changed on a running server, see
+// UpdateConfig. The fields are those of ServerConfig, with the defaults applied.
+type LiveConfig struct {
+	TokenExpireSec   int32
+	PruneIntervalSec int32
+	PasswordPolicy   PasswordPolicy
+	RateLimiter      RateLimiter
+}
+
+// liveConfig is the LiveConfig in effect, replaced as a whole by UpdateConfig.
+type liveConfig struct {
+	LiveConfig
+	// Epochs (PruneIntervalSec long) are counted from epochBase at epochFrom, see currentEpoch
+	epochFrom time.Time
+	epochBase int32
+}
+
+// live returns the LiveConfig in effect. It must not be modified.
+func (s *Server) live() *liveConfig {
+	return s.liveCfg.Load().(*liveConfig)
+}
+
+// LiveConfig returns the settings of the server that UpdateConfig can change, as they are.
+//
+// Returns: a copy of the settings
+func (s *Server) LiveConfig() LiveConfig {
+	c := s.live().LiveConfig
+	c.PasswordPolicy.BannedWords = append([]string(nil), c.PasswordPolicy.BannedWords...)
+	return c
+}
+
+// UpdateConfig changes settings of a running server without losing its state, e.g. on SIGHUP after
+// reading a config file again:
+//
+//	c := svr.LiveConfig()
+//	c.PasswordPolicy.MinLength = 12
+//	err := svr.UpdateConfig(c)
+//
+// The settings follow the rules of NewServer; a PruneIntervalSec of 0 means the default. They apply
+// to the operations started after UpdateConfig returns: tokens already issued keep their expiry,
+// and existing passwords are not checked again. A new PruneIntervalSec starts a new epoch count, so
+// that the next background purge comes one interval after the change.
+//
+// Returns: none
+// Errors: ErrInvalidConfig, leaving the settings as they were
+func (s *Server) UpdateConfig(c LiveConfig) (err error) {
+	s, sp := s.trace("auth.UpdateConfig")
+	defer func() { sp.end(err) }()
+	if c.TokenExpireSec < 60 || c.PruneIntervalSec < 0 {
+		return ErrInvalidConfig
+	}
+	if s.cfg.TokenMaxLifetimeSec != 0 && s.cfg.TokenMaxLifetimeSec < c.TokenExpireSec {
+		return ErrInvalidConfig
+	}
+	if s.cfg.DecisionCacheSec >= c.TokenExpireSec {
+		return ErrInvalidConfig
+	}
+	if c.PruneIntervalSec == 0 {
+		c.PruneIntervalSec = 3600
+	}
+	c.PasswordPolicy.BannedWords = append([]string(nil), c.PasswordPolicy.BannedWords...)
+
+	// Serialized with other updates, so that none is lost
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.live()
+	next := &liveConfig{LiveConfig: c, epochFrom: old.epochFrom, epochBase: old.epochBase}
+	if c.PruneIntervalSec != old.PruneIntervalSec {
+		next.epochFrom, next.epochBase = s.now(), s.currentEpoch()
+	}
+	s.liveCfg.Store(next)
+	return nil
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 600, PruneIntervalSec: 60}), WithClock(clock), WithHasher(fastHasher))
+	svr.CreateUser("elton", "passw0rd")
+	old, _ := svr.Authenticate("elton", "passw0rd")
+	{
+		c := svr.LiveConfig()
+		assert.Equal(t, LiveConfig{TokenExpireSec: 600, PruneIntervalSec: 60, PasswordPolicy: DefaultPasswordPolicy}, c,
+			"should tell the settings in effect")
+		c.TokenExpireSec = 59
+		assert.Equal(t, ErrInvalidConfig, svr.UpdateConfig(c), "should check the settings")
+		assert.Equal(t, int32(600), svr.LiveConfig().TokenExpireSec, "should keep the settings on errors")
+	}
+	{
+		c := svr.LiveConfig()
+		c.TokenExpireSec = 60
+		c.PasswordPolicy = PasswordPolicy{MinLength: 12, BannedWords: []string{"secret"}}
+		c.RateLimiter = &TokenBucket{Burst: 1, Clock: clock}
+		assert.Equal(t, nil, svr.UpdateConfig(c), "should success")
+		c.PasswordPolicy.BannedWords[0] = "other"
+		_, err := svr.CreateUser("fred", "passw0rd")
+		assert.Equal(t, ErrWeakPassword, err, "should apply the new password policy")
+		_, err = svr.CreateUser("fred", "my-secret-password")
+		assert.Equal(t, ErrWeakPassword, err, "should copy the banned words")
+
+		token, _ := svr.Authenticate("elton", "passw0rd")
+		svr.Authenticate("elton", "wrong")
+		_, err = svr.Authenticate("elton", "passw0rd")
+		assert.Equal(t, ErrRateLimited, err, "should apply the new rate limiter")
+		clock.Advance(2 * time.Minute)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should issue tokens with the new TTL")
+		_, err = svr.TokenUser(old)
+		assert.Equal(t, nil, err, "should keep the expiry of tokens already issued")
+	}
+	{
+		ep := svr.currentEpoch()
+		c := svr.LiveConfig()
+		c.PruneIntervalSec = 3600
+		svr.UpdateConfig(c)
+		assert.Equal(t, ep, svr.currentEpoch(), "should not move the epoch on a new interval")
+		clock.Advance(time.Hour)
+		assert.Equal(t, ep+1, svr.currentEpoch(), "should count epochs of the new interval")
+	}
+}
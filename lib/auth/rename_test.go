@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateUserName(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, UsernamePolicy: &UsernamePolicy{Reserved: []string{"root"}, CaseInsensitive: true}}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(anna, rid)
+	next, cancel := collect(svr, EventUserRenamed)
+	defer cancel()
+	{
+		assert.Equal(t, nil, svr.UpdateUserName(anna, "Anna.K"), "should success")
+		e := next(1)[0]
+		assert.Equal(t, []string{"anna.k", "anna"}, []string{e.Name, e.OldName}, "should emit user.renamed")
+		u := svr.GetUserByName("anna.k")
+		assert.Equal(t, anna, u.ID, "should keep the ID")
+		_, ok := u.Roles[rid]
+		assert.Equal(t, true, ok, "should keep the roles")
+		assert.Equal(t, (*User)(nil), svr.GetUserByName("anna"), "should free the old name")
+		_, err := svr.Authenticate("anna.k", "passw0rd")
+		assert.Equal(t, nil, err, "should keep the password")
+	}
+	{
+		assert.Equal(t, ErrUserExists, svr.UpdateUserName(anna, "Elton"), "should keep names unique")
+		assert.Equal(t, ErrInvalidUsername, svr.UpdateUserName(anna, "root"), "should check the policy")
+		assert.Equal(t, ErrUserNotExist, svr.UpdateUserName(anna+9, "dora"), "should check the user")
+		assert.Equal(t, nil, svr.UpdateUserName(anna, "ANNA.K"), "should accept the current name")
+	}
+}
+
+func TestUpdateRoleName(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.CreateRole("reader")
+	svr.GrantPermissionToRole(rid, "orders:*")
+	svr.AddRoleToUser(uid, rid)
+	next, cancel := collect(svr, EventRoleRenamed)
+	defer cancel()
+	{
+		assert.Equal(t, nil, svr.UpdateRoleName(rid, "operator"), "should success")
+		e := next(1)[0]
+		assert.Equal(t, []string{"operator", "admin"}, []string{e.Name, e.OldName}, "should emit role.renamed")
+		assert.Equal(t, rid, svr.GetRoleByName("operator").ID, "should keep the ID")
+		assert.Equal(t, (*Role)(nil), svr.GetRoleByName("admin"), "should free the old name")
+		assert.Equal(t, "operator", svr.GetUser(uid).Roles[rid].Name, "should rename the role of its holders")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		ok, _ := svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should keep the permissions")
+	}
+	{
+		assert.Equal(t, ErrRoleExists, svr.UpdateRoleName(rid, "reader"), "should keep names unique")
+		assert.Equal(t, ErrRoleNotExist, svr.UpdateRoleName(rid+9, "writer"), "should check the role")
+		assert.Equal(t, nil, svr.UpdateRoleName(rid, "operator"), "should accept the current name")
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// defaultPasswordResetTTL is the PasswordResetSec if not set.
+const defaultPasswordResetTTL = 15 * time.Minute
+
+// RequestPasswordReset issues a single-use token to set a new password with CompletePasswordReset,
+// for the caller to send to the user, e.g. by email or SMS. The user is given by email address (see
+// SetUserEmail) or by name. The token expires after ServerConfig.PasswordResetSec; a new request
+// replaces the earlier tokens of the user.
+//
+// Callers should not tell whether the user exists: answer ErrUserNotExist as a success, so that the
+// endpoint cannot be used to find accounts.
+//
+// Returns: the token string
+// Errors: ErrUserNotExist, ErrUserSuspended, ErrUnsupported for service accounts and users of an
+// Authenticator, ErrTooManyTokens, ErrInternal
+func (s *Server) RequestPasswordReset(identifier string) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.RequestPasswordReset")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.resetUser(ctx, identifier)
+	if err != nil {
+		return "", err
+	}
+	s.traceUser(userObj.ID)
+	if userObj.Source != "" || userObj.Kind == UserService {
+		return "", ErrUnsupported
+	}
+	if userObj.Status == UserSuspended {
+		return "", ErrUserSuspended
+	}
+	tokens, err := s.store.UserTokens(ctx, userObj.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tokens {
+		if t.Kind == TokenPasswordReset {
+			if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+				return "", err
+			}
+		}
+	}
+	t, err := s.newOneTimeToken(userObj, TokenPasswordReset, s.passwordResetTTL())
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.InsertToken(ctx, t); err != nil {
+		return "", err
+	}
+	return t.Value, nil
+}
+
+// CompletePasswordReset sets the password of a user with a token of RequestPasswordReset, and emits a
+// password.reset event. The password must satisfy the password policy; if it does not, the token
+// can be used again. Every token of the user is then invalidated, signing out all its sessions
+// (JWTs are not saved, so those that have not expired stay valid). API keys are kept, see
+// RevokeAPIKey.
+//
+// Returns: none
+// Errors: ErrInvalidToken if the token is unknown, expired or already used, ErrUserSuspended,
+// ErrWeakPassword, ErrBreachedPassword, ErrInternal, or any error from the BreachChecker
+func (s *Server) CompletePasswordReset(token TokenValue, password string) (err error) {
+	s, sp := s.trace("auth.CompletePasswordReset")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	// The password is checked and hashed without the lock, like in SetPassword
+	s.mu.Lock()
+	_, userObj, err := s.useOneTimeToken(ctx, token, TokenPasswordReset)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.traceUser(userObj.ID)
+	if err := s.checkPassword(ctx, userObj.Name, password); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	secret, err := s.hashPassword(password)
+	if err != nil {
+		return ErrInternal
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check it again, as it may have been used while hashing
+	_, userObj, err = s.useOneTimeToken(ctx, token, TokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	if userObj.Status == UserSuspended {
+		return ErrUserSuspended
+	}
+	if userObj.Source != "" || userObj.Kind == UserService {
+		return ErrInvalidToken
+	}
+	if err := s.store.DeleteToken(ctx, token); err != nil {
+		return err
+	}
+	userObj = userObj.clone()
+	userObj.Secret = secret
+	s.bumpSession(userObj)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventPasswordReset, User: userObj.ID, Name: userObj.Name})
+	tokens, err := s.store.UserTokens(ctx, userObj.ID)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+			return err
+		}
+		if t.Kind == TokenSession {
+			s.emit(Event{Type: EventTokenRevoked, User: userObj.ID, TokenID: t.ID()})
+		}
+	}
+	return nil
+}
+
+// resetUser finds the user of RequestPasswordReset by email address, or else by name.
+func (s *Server) resetUser(ctx context.Context, identifier string) (*User, error) {
+	if email, ok := normalizeEmail(identifier); ok {
+		u, err := s.userByEmail(ctx, email)
+		if err == nil && u.Deleted == nil {
+			return u, nil
+		} else if err != nil && err != ErrUserNotExist {
+			return nil, err
+		}
+	}
+	return s.getUserByName(ctx, identifier)
+}
+
+// passwordResetTTL is ServerConfig.PasswordResetSec, or its default, within the lifetime of session
+// tokens, like emailVerificationTTL.
+func (s *Server) passwordResetTTL() time.Duration {
+	ttl := defaultPasswordResetTTL
+	if s.cfg.PasswordResetSec > 0 {
+		ttl = time.Duration(s.cfg.PasswordResetSec) * time.Second
+	}
+	if max := time.Duration(s.tokenLifetimeSec()) * time.Second; ttl > max {
+		ttl = max
+	}
+	return ttl
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordReset(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600}), WithClock(clock), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("elton", "123456")
+	svr.SetUserEmail(uid, "elton@example.com")
+	session, _ := svr.Authenticate("elton", "123456")
+	next, cancel := collect(svr, EventPasswordReset, EventTokenRevoked)
+	defer cancel()
+	{
+		_, err := svr.RequestPasswordReset("anna")
+		assert.Equal(t, ErrUserNotExist, err, "should check the user")
+		_, err = svr.RequestPasswordReset("anna@example.com")
+		assert.Equal(t, ErrUserNotExist, err, "should check the address")
+		sa, _, _ := svr.CreateServiceAccount("ci")
+		_, err = svr.RequestPasswordReset(svr.GetUser(sa).Name)
+		assert.Equal(t, ErrUnsupported, err, "should not reset service accounts")
+	}
+	{
+		token, err := svr.RequestPasswordReset("Elton@Example.com")
+		assert.Equal(t, nil, err, "should find the user by email")
+		_, err = svr.CheckRole(token, 1)
+		assert.Equal(t, ErrInvalidToken, err, "should not be a session token")
+		assert.Equal(t, ErrInvalidToken, svr.CompletePasswordReset("wrong", "abcdef"), "should check the token")
+		assert.Equal(t, ErrWeakPassword, svr.CompletePasswordReset(token, ""), "should enforce the policy")
+		assert.Equal(t, nil, svr.CompletePasswordReset(token, "abcdef"), "should keep the token on weak passwords")
+		events := next(2)
+		assert.Equal(t, EventPasswordReset, events[0].Type, "should emit password.reset")
+		assert.Equal(t, EventTokenRevoked, events[1].Type, "should revoke the sessions")
+		_, err = svr.CheckRole(session, 1)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate the sessions")
+		_, err = svr.Authenticate("elton", "abcdef")
+		assert.Equal(t, nil, err, "should set the password")
+		assert.Equal(t, ErrInvalidToken, svr.CompletePasswordReset(token, "ghijkl"), "should only be used once")
+	}
+	{
+		first, _ := svr.RequestPasswordReset("elton")
+		second, _ := svr.RequestPasswordReset("elton")
+		assert.Equal(t, ErrInvalidToken, svr.CompletePasswordReset(first, "ghijkl"), "should replace earlier tokens")
+		clock.Advance(15*time.Minute + time.Second)
+		assert.Equal(t, ErrInvalidToken, svr.CompletePasswordReset(second, "ghijkl"), "should expire")
+	}
+	{
+		token, _ := svr.RequestPasswordReset("elton")
+		svr.SuspendUser(uid)
+		assert.Equal(t, ErrInvalidToken, svr.CompletePasswordReset(token, "ghijkl"), "should drop the tokens of suspended users")
+		_, err := svr.RequestPasswordReset("elton")
+		assert.Equal(t, ErrUserSuspended, err, "should not reset suspended users")
+	}
+	{
+		_, err := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, PasswordResetSec: -1}))
+		assert.Equal(t, ErrInvalidConfig, err, "should check PasswordResetSec")
+	}
+}
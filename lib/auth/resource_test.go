@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceRoles(t *testing.T) {
+	svr, _ := New(WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	editor, _ := svr.CreateRole("editor")
+	viewer, _ := svr.CreateRole("viewer")
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	next, cancel := collect(svr, EventRoleGranted, EventRoleRevoked)
+	defer cancel()
+	{
+		assert.Equal(t, ErrInvalidResource, svr.AddRoleToUserOnResource(uid, editor, ""), "should validate the resource")
+		assert.Equal(t, ErrRoleNotExist, svr.AddRoleToUserOnResource(uid, editor+10, "project:42"), "should check the role")
+		assert.Equal(t, ErrUserNotExist, svr.AddRoleToUserOnResource(uid+10, editor, "project:42"), "should check the user")
+		assert.Equal(t, nil, svr.AddRoleToUserOnResource(uid, editor, "project:42"), "should success")
+		assert.Equal(t, nil, svr.AddRoleToUserOnResource(uid, editor, "project:42"), "should be a no-op the second time")
+		events := next(1)
+		assert.Equal(t, "project:42", events[0].Resource, "should report the resource")
+
+		ok, _ := svr.CheckRoleOnResource(token, editor, "project:42")
+		assert.Equal(t, true, ok, "should grant the role on the resource")
+		ok, _ = svr.CheckRoleOnResource(token, editor, "project:7")
+		assert.Equal(t, false, ok, "should not grant the role on other resources")
+		ok, _ = svr.CheckRole(token, editor)
+		assert.Equal(t, false, ok, "should not grant the role globally")
+		_, err := svr.CheckRoleOnResource(token, editor, "project:")
+		assert.Equal(t, ErrInvalidResource, err, "should validate the resource")
+	}
+	{
+		svr.AddRoleToUserOnResource(uid, viewer, "project:*")
+		ok, _ := svr.CheckRoleOnResource(token, viewer, "project:7")
+		assert.Equal(t, true, ok, "should match wildcards")
+		ok, _ = svr.CheckRoleOnResource(token, viewer, "team:7")
+		assert.Equal(t, false, ok, "should match wildcards by segment")
+		svr.AddRoleToUser(uid, editor)
+		ok, _ = svr.CheckRoleOnResource(token, editor, "team:7")
+		assert.Equal(t, true, ok, "should grant global roles on every resource")
+		scoped, _ := svr.AuthenticateScoped("anna", "passw0rd", ClientInfo{}, &TokenScope{Roles: []RoleID{editor}})
+		ok, _ = svr.CheckRoleOnResource(scoped, viewer, "project:7")
+		assert.Equal(t, false, ok, "should limit the roles to the scope")
+		next(2)
+	}
+	{
+		assert.Equal(t, nil, svr.RemoveRoleFromUserOnResource(uid, viewer, "project:*"), "should success")
+		assert.Equal(t, nil, svr.RemoveRoleFromUserOnResource(uid, viewer, "project:*"), "should be a no-op the second time")
+		assert.Equal(t, ErrRoleNotExist, svr.RemoveRoleFromUserOnResource(uid, viewer+10, "project:*"), "should check the role")
+		events := next(1)
+		assert.Equal(t, EventRoleRevoked, events[0].Type, "should report the removal")
+		ok, _ := svr.CheckRoleOnResource(token, viewer, "project:7")
+		assert.Equal(t, false, ok, "should not grant the role anymore")
+		assert.Equal(t, map[RoleID][]string{editor: {"project:42"}}, svr.GetUser(uid).ResourceRoles, "should keep the other grants")
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Revocation is the invalidation of a JWT, as shared between servers. Expires is that of the token,
+// after which the revocation can be forgotten.
+type Revocation struct {
+	ID      string    `json:"jti"`
+	Expires time.Time `json:"exp"`
+}
+
+// RevocationBroadcaster shares revocations between the servers of a cluster that issue JWTs with the
+// same key. As JWTs are verified without the storage, Invalidate on one server is otherwise not
+// seen by the others. See ServerConfig.Revocations.
+//
+// Revocations published before a server subscribes are not delivered to it, so servers starting
+// later accept tokens revoked earlier. Short token lifetimes keep that window small.
+type RevocationBroadcaster interface {
+	// Publish sends a revocation to the subscribed servers. It may return before they receive it.
+	Publish(ctx context.Context, r Revocation) error
+	// Subscribe calls fn with the revocations published by any server, including this one, until
+	// the broadcaster is closed. fn must not block for long.
+	Subscribe(fn func(Revocation)) error
+}
+
+// MemoryBroadcaster is a RevocationBroadcaster for servers in the same process, e.g. Realms
+// sharing a key. It is also the reference for implementations over a network.
+type MemoryBroadcaster struct {
+	mu   sync.Mutex
+	subs []func(Revocation)
+}
+
+// NewMemoryBroadcaster creates a MemoryBroadcaster without subscribers.
+func NewMemoryBroadcaster() *MemoryBroadcaster {
+	return &MemoryBroadcaster{}
+}
+
+// Publish calls every subscriber before returning.
+func (b *MemoryBroadcaster) Publish(_ context.Context, r Revocation) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+	for _, fn := range subs {
+		fn(r)
+	}
+	return nil
+}
+
+func (b *MemoryBroadcaster) Subscribe(fn func(Revocation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Copied on write, as Publish iterates without the lock
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], fn)
+	return nil
+}
+
+// *-* Server *-*
+
+// recordRevocation adds a revocation to the local cache, unless the token has already expired.
+// It reports whether the revocation is new.
+func (s *Server) recordRevocation(r Revocation) bool {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if ep := s.currentEpoch(); ep > s.revokedEpoch {
+		s.pruneRevoked()
+		s.revokedEpoch = ep
+	}
+	if _, ok := s.revoked[r.ID]; ok || !s.now().Before(r.Expires) {
+		return false
+	}
+	s.revoked[r.ID] = r.Expires
+	s.decisions.invalidate()
+	return true
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingBroadcaster struct{ MemoryBroadcaster }
+
+func (*failingBroadcaster) Subscribe(func(Revocation)) error {
+	return errors.New("unreachable")
+}
+
+func TestRevocations(t *testing.T) {
+	store := NewMemoryStorage()
+	bus := NewMemoryBroadcaster()
+	cfg := &ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}, Revocations: bus}
+	a, err := NewServer(cfg, store)
+	assert.Equal(t, nil, err, "should success")
+	b, _ := NewServer(cfg, store)
+	alone, _ := NewServer(&ServerConfig{TokenExpireSec: 60, JWT: cfg.JWT}, store)
+	a.CreateUser("elton", "123456")
+	{
+		token, _ := a.Authenticate("elton", "123456")
+		_, err := b.AllRoles(token)
+		assert.Equal(t, nil, err, "should accept the tokens of other servers")
+		a.Invalidate(token)
+		_, err = b.AllRoles(token)
+		assert.Equal(t, ErrInvalidToken, err, "should apply the revocations of other servers")
+		_, err = a.AllRoles(token)
+		assert.Equal(t, ErrInvalidToken, err, "should still apply its own revocations")
+		_, err = alone.AllRoles(token)
+		assert.Equal(t, nil, err, "should not reach servers without the broadcaster")
+	}
+	{
+		token, _ := b.Authenticate("elton", "123456")
+		claims, _ := b.jwt.verify(token)
+		bus.Publish(context.Background(), Revocation{ID: claims.ID, Expires: time.Now().Add(-time.Second)})
+		_, err := a.AllRoles(token)
+		assert.Equal(t, nil, err, "should ignore the revocations of expired tokens")
+		bus.Publish(context.Background(), Revocation{ID: claims.ID, Expires: claims.Expires()})
+		_, err = a.AllRoles(token)
+		assert.Equal(t, ErrInvalidToken, err, "should apply published revocations")
+	}
+	{
+		_, err := NewServer(&ServerConfig{TokenExpireSec: 60, Revocations: bus}, store)
+		assert.Equal(t, ErrInvalidConfig, err, "should only be supported in JWT mode")
+		_, err = NewServer(&ServerConfig{TokenExpireSec: 60, JWT: cfg.JWT, Revocations: &failingBroadcaster{}}, store)
+		assert.Equal(t, "unreachable", err.Error(), "should report the error of subscribing")
+	}
+}
@@ -1,18 +1,40 @@
-package auth
-
-import (
-	"errors"
-)
-
-type RoleID int32
-
-type Role struct {
-	ID   RoleID
-	Name string
-	//UserList map[UserID]struct{}
-}
-
-var (
-	ErrRoleExists   = errors.New("role already exists")
-	ErrRoleNotExist = errors.New("role does not exist")
-)
+package auth
+
+import (
+	"net/http"
+	"sort"
+)
+
+type RoleID int32
+
+type Role struct {
+	ID          RoleID
+	Name        string
+	Permissions []string `json:",omitempty"` // sorted, see CheckPermission
+	Denied      []string `json:",omitempty"` // sorted, see DenyPermissionToRole
+	Protected   bool     `json:",omitempty"` // see SetRoleProtected
+	//UserList map[UserID]struct{}
+}
+
+var (
+	ErrRoleExists    = newError("role_exists", http.StatusConflict, "role already exists")
+	ErrRoleNotExist  = newError("role_not_exist", http.StatusNotFound, "role does not exist")
+	ErrRoleProtected = newError("role_protected", http.StatusConflict, "role is protected")
+)
+
+// clone returns a copy of the role. It returns nil for a nil role.
+func (r *Role) clone() *Role {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Permissions = append([]string(nil), r.Permissions...)
+	c.Denied = append([]string(nil), r.Denied...)
+	return &c
+}
+
+// hasPermission tells if the exact permission string is granted to the role, without wildcard matching.
+func (r *Role) hasPermission(perm string) bool {
+	i := sort.SearchStrings(r.Permissions, perm)
+	return i < len(r.Permissions) && r.Permissions[i] == perm
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is the initial state of a server for integration tests and demos, for Seed. It is read
+// from YAML or JSON with ReadFixture:
+//
+//	roles:
+//	  - name: clerk
+//	    permissions: [orders:read, orders:write]
+//	users:
+//	  - name: alice
+//	    password: passw0rd
+//	    roles: [clerk]
+//	tokens:
+//	  - user: alice
+//	    value: dev-alice       # random if left out
+//	    expires: 2030-01-01T00:00:00Z
+type Fixture struct {
+	Roles  []RoleSpec     `json:"roles"`
+	Users  []FixtureUser  `json:"users"`
+	Tokens []FixtureToken `json:"tokens"`
+}
+
+// FixtureUser is a user of a Fixture, holding exactly the given roles, by name.
+type FixtureUser struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// FixtureToken is a session token of a Fixture. Value, if set, is the token, so that clients can be
+// configured with it beforehand. Expires defaults to the token lifetime from the time of Seed.
+type FixtureToken struct {
+	User    string     `json:"user"`
+	Value   TokenValue `json:"value"`
+	Expires time.Time  `json:"expires"`
+}
+
+// ReadFixture parses a Fixture in YAML or JSON (which is YAML too). Unknown fields are rejected, to
+// catch typos.
+//
+// Returns: the fixture
+// Errors: any error from reading or parsing
+func ReadFixture(r io.Reader) (*Fixture, error) {
+	var doc interface{}
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// Through JSON, so that the fields are only tagged once. Timestamps of YAML become strings.
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var f Fixture
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ReadFixtureFile is ReadFixture on a file.
+//
+// Returns: the fixture
+// Errors: any error from opening, reading or parsing the file
+func ReadFixtureFile(path string) (*Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFixture(file)
+}
+
+// Seed loads a fixture: it creates the users that do not exist yet, applies the roles and the roles
+// of the users like Apply (without Prune), and issues the tokens. It can run at every start of a
+// server with a persistent storage: existing users keep their passwords, and tokens already in the
+// storage are kept, unless expired. It is for test environments and demos, not production data,
+// as the passwords and tokens of the fixture are known to whoever reads it.
+//
+// Seeding is not atomic: an error midway leaves what was done so far, and seeding again completes
+// it.
+//
+// Returns: the tokens, in the order of the fixture
+// Errors: ErrInvalidSpec (e.g. a user twice, or a token starting with APIKeyPrefix),
+// ErrUnsupported for tokens in JWT mode, ErrInvalidExpiry, ErrTooManyTokens, any error of
+// CreateUsers for the new users, or of Apply
+func (s *Server) Seed(f *Fixture) (_ []TokenValue, err error) {
+	s, sp := s.trace("auth.Seed")
+	defer func() { sp.end(err) }()
+	if f == nil {
+		return nil, ErrInvalidSpec
+	}
+	now := s.now()
+	for _, t := range f.Tokens {
+		if t.User == "" || strings.HasPrefix(string(t.Value), APIKeyPrefix) {
+			return nil, ErrInvalidSpec
+		}
+		if !t.Expires.IsZero() && !t.Expires.After(now) {
+			return nil, ErrInvalidExpiry
+		}
+	}
+	if len(f.Tokens) > 0 && s.jwt != nil {
+		// JWTs are signed, their values cannot be chosen
+		return nil, ErrUnsupported
+	}
+
+	// Users, only hashing the passwords of the new ones
+	spec := Spec{Roles: f.Roles, Users: make([]UserSpec, len(f.Users))}
+	var missing []Credentials
+	for i, u := range f.Users {
+		spec.Users[i] = UserSpec{Name: u.Name, Roles: u.Roles}
+		if s.GetUserByName(u.Name) == nil {
+			missing = append(missing, Credentials{Name: u.Name, Password: u.Password})
+		}
+	}
+	_, errs, err := s.CreateUsers(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		// Taken meanwhile, or listed twice, which Apply rejects
+		if err != nil && err != ErrUserExists {
+			return nil, err
+		}
+	}
+	if _, err := s.Apply(&spec, nil); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]TokenValue, len(f.Tokens))
+	for i, t := range f.Tokens {
+		if tokens[i], err = s.seedToken(&t, now); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// seedToken issues a token of a fixture, unless it is in the storage already and not expired.
+//
+// Errors: ErrUserNotExist, ErrInvalidExpiry, ErrTooManyTokens, ErrInternal
+func (s *Server) seedToken(ft *FixtureToken, now time.Time) (TokenValue, error) {
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.getUserByName(ctx, ft.User)
+	if err != nil {
+		return "", err
+	}
+	if ft.Value != "" {
+		if old, err := s.store.GetToken(ctx, ft.Value); err == nil {
+			if old.Expires.After(now) {
+				return ft.Value, nil
+			}
+			// Not pruned yet
+			if err := s.store.DeleteToken(ctx, ft.Value); err != nil {
+				return "", err
+			}
+		}
+	} else if ft.Value, err = s.newTokenValue(); err != nil {
+		return "", ErrInternal
+	}
+	t := Token{
+		Value:    ft.Value,
+		User:     u.ID,
+		Issued:   now,
+		Expires:  ft.Expires,
+		AuthTime: now,
+		Version:  u.SessionVersion,
+	}
+	if t.Expires.IsZero() {
+		t.Expires = now.Add(time.Duration(s.live().TokenExpireSec) * time.Second)
+	}
+	if max := s.cfg.TokenMaxLifetimeSec; max != 0 && t.Expires.After(now.Add(time.Duration(max)*time.Second)) {
+		return "", ErrInvalidExpiry
+	}
+	if err := s.addToTokenQueue(&t); err != nil {
+		return "", err
+	}
+	if err := s.store.InsertToken(ctx, &t); err != nil {
+		return "", err
+	}
+	return t.Value, nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFixture = `
+roles:
+  - name: clerk
+    permissions: [orders:read, orders:write]
+users:
+  - name: alice
+    password: passw0rd
+    roles: [clerk]
+  - name: bob
+    password: passw0rd
+tokens:
+  - user: alice
+    value: dev-alice
+    expires: 2023-11-15T00:00:00Z
+  - user: bob
+`
+
+func TestSeed(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	{
+		_, err := ReadFixture(strings.NewReader("users:\n  - nmae: alice\n"))
+		assert.NotEqual(t, nil, err, "should reject unknown fields")
+		f, err := ReadFixture(strings.NewReader(`{"users": [{"name": "alice", "roles": ["clerk"]}]}`))
+		assert.Equal(t, nil, err, "should read JSON")
+		assert.Equal(t, &Fixture{Users: []FixtureUser{{Name: "alice", Roles: []string{"clerk"}}}}, f, "should read JSON")
+	}
+	path := filepath.Join(t.TempDir(), "fixture.yaml")
+	os.WriteFile(path, []byte(testFixture), 0o600)
+	store := NewMemoryStorage()
+	svr, err := New(WithStorage(store), WithClock(clock), WithHasher(fastHasher), WithFixture(path))
+	assert.Equal(t, nil, err, "should seed the server")
+	{
+		ok, err := svr.CheckPermission("dev-alice", "orders:write")
+		assert.Equal(t, true, ok && err == nil, "should issue the tokens of the fixture")
+		token, _ := svr.Authenticate("alice", "passw0rd")
+		ok, _ = svr.CheckRole(token, svr.GetRoleByName("clerk").ID)
+		assert.Equal(t, true, ok, "should create the users with their roles")
+		tokens, _ := svr.ListTokens(svr.GetUserByName("bob").ID)
+		assert.Equal(t, 1, len(tokens), "should issue random tokens")
+		assert.Equal(t, clock.Now().Add(time.Hour), tokens[0].Expires, "should expire random tokens as usual")
+		clock.Advance(24 * time.Hour)
+		_, err = svr.TokenUser("dev-alice")
+		assert.Equal(t, ErrInvalidToken, err, "should expire tokens as told")
+	}
+	{
+		svr.SetPassword(svr.GetUserByName("alice").ID, "changed")
+		f, _ := ReadFixtureFile(path)
+		f.Tokens = []FixtureToken{{User: "alice", Value: "dev-alice"}}
+		again, err := New(WithStorage(store), WithClock(clock), WithHasher(fastHasher))
+		assert.Equal(t, nil, err, "should success")
+		tokens, err := again.Seed(f)
+		assert.Equal(t, nil, err, "should seed existing servers again")
+		assert.Equal(t, []TokenValue{"dev-alice"}, tokens, "should tell the tokens")
+		_, err = again.Authenticate("alice", "changed")
+		assert.Equal(t, nil, err, "should keep existing users")
+		id, _ := again.TokenUser("dev-alice")
+		assert.Equal(t, again.GetUserByName("alice").ID, id, "should issue expired tokens again")
+		before, _ := again.ListTokens(id)
+		_, err = again.Seed(f)
+		assert.Equal(t, nil, err, "should keep existing tokens")
+		after, _ := again.ListTokens(id)
+		assert.Equal(t, before, after, "should keep existing tokens")
+	}
+	{
+		_, err := svr.Seed(&Fixture{Tokens: []FixtureToken{{User: "alice", Value: APIKeyPrefix + "x"}}})
+		assert.Equal(t, ErrInvalidSpec, err, "should not issue API keys")
+		_, err = svr.Seed(&Fixture{Tokens: []FixtureToken{{User: "alice", Expires: clock.Now()}}})
+		assert.Equal(t, ErrInvalidExpiry, err, "should check the expiry")
+		_, err = svr.Seed(&Fixture{Tokens: []FixtureToken{{User: "carol"}}})
+		assert.Equal(t, ErrUserNotExist, err, "should check the users of tokens")
+		_, err = svr.Seed(&Fixture{Users: []FixtureUser{{Name: "carol", Password: "x"}}})
+		assert.Equal(t, ErrWeakPassword, err, "should check the passwords of new users")
+		_, err = New(WithFixture(filepath.Join(t.TempDir(), "none.yaml")))
+		assert.Equal(t, true, os.IsNotExist(err), "should report missing fixtures")
+	}
+}
@@ -0,0 +1,27 @@
+package auth
+
+// Service is the part of a Server that services relying on it call at run time: logins, token
+// checks and the assignments their own tests set up. Services that depend on a Service rather than
+// *Server can be unit-tested against a fake, see lib/auth/authtest.
+type Service interface {
+	CreateUser(name, password string) (UserID, error)
+	DeleteUser(user UserID) error
+	CreateRole(name string) (RoleID, error)
+	AddRoleToUser(user UserID, role RoleID) error
+	RemoveRoleFromUser(user UserID, role RoleID) error
+	GrantPermissionToRole(role RoleID, perm string) error
+
+	Authenticate(username, password string) (TokenValue, error)
+	Invalidate(token TokenValue)
+	TokenUser(token TokenValue) (UserID, error)
+	CheckRole(token TokenValue, role RoleID) (bool, error)
+	CheckPermission(token TokenValue, perm string) (bool, error)
+	AllRoles(token TokenValue) ([]RoleID, error)
+
+	GetUser(id UserID) *User
+	GetUserByName(name string) *User
+	GetRole(id RoleID) *Role
+	GetRoleByName(name string) *Role
+}
+
+var _ Service = (*Server)(nil)
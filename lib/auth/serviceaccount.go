@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+// Service accounts are users for CI jobs and daemons. They hold roles and join groups like other
+// users, but have no password: they use API keys, or tokens from IssueToken. Their names share the
+// namespace of users.
+
+// UserKind tells what a user stands for.
+type UserKind int
+
+const (
+	UserHuman UserKind = iota
+	// UserService accounts cannot log in with a password, see CreateServiceAccount.
+	UserService
+)
+
+// ServiceKeyName names the API keys made by CreateServiceAccount and RotateCredentials.
+const ServiceKeyName = "credentials"
+
+var ErrNotServiceAccount = newError("not_service_account", http.StatusBadRequest, "not a service account")
+
+// CreateServiceAccount adds a service account, with an API key (named ServiceKeyName) that does
+// not expire. Authenticate always fails for it, and it cannot get a password with SetPassword.
+// The key is only returned here, keep it safe.
+//
+// Returns: the ID of the new account, and its key
+// Errors: ErrInvalidUsername, ErrUserExists, ErrTooManyUsers, ErrInternal
+func (s *Server) CreateServiceAccount(name string) (_ UserID, _ TokenValue, err error) {
+	s, sp := s.trace("auth.CreateServiceAccount")
+	defer func() { sp.end(err) }()
+	if err := s.checkUsername(name); err != nil {
+		return 0, "", err
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.lookupUserByName(ctx, name); err == nil {
+		return 0, "", ErrUserExists
+	} else if err != ErrUserNotExist {
+		return 0, "", err
+	}
+
+	newUser := User{
+		Name:  s.cfg.UsernamePolicy.Normalize(name),
+		Kind:  UserService,
+		Roles: make(map[RoleID]*Role),
+	}
+	if err := s.insertUser(ctx, &newUser); err != nil {
+		return 0, "", err
+	}
+	// The key encodes the ID, which is only known now
+	userObj := newUser.clone()
+	key, err := s.addAPIKey(userObj, ServiceKeyName, nil, time.Time{})
+	if err != nil {
+		return 0, "", err
+	}
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return 0, "", err
+	}
+	s.emit(Event{Type: EventUserCreated, User: newUser.ID, Name: newUser.Name})
+	return newUser.ID, key, nil
+}
+
+// RotateCredentials gives a service account a new API key (named ServiceKeyName) that does not
+// expire, and makes all its other keys expire after grace, so that clients can switch over.
+// A zero grace revokes them right away. Tokens of the account are kept.
+//
+// Returns: the new key
+// Errors: ErrUserNotExist, ErrNotServiceAccount, ErrInternal
+func (s *Server) RotateCredentials(account UserID, grace time.Duration) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.RotateCredentials")
+	defer func() { sp.end(err) }()
+	s.traceUser(account)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, account)
+	if err != nil {
+		return "", err
+	}
+	if userObj.Kind != UserService {
+		return "", ErrNotServiceAccount
+	}
+	userObj = userObj.clone()
+	deadline := s.now().Add(grace)
+	for id, k := range userObj.APIKeys {
+		if grace <= 0 {
+			delete(userObj.APIKeys, id)
+		} else if k.Expires.IsZero() || k.Expires.After(deadline) {
+			k.Expires = deadline
+		}
+	}
+	key, err := s.addAPIKey(userObj, ServiceKeyName, nil, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return "", err
+	}
+	return key, nil
+}
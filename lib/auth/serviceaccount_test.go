@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	rid, _ := svr.CreateRole("deployer")
+	{
+		id, key, err := svr.CreateServiceAccount("ci")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, UserService, svr.GetUser(id).Kind, "should make a service account")
+		svr.AddRoleToUser(id, rid)
+		ok, _ := svr.CheckRole(key, rid)
+		assert.Equal(t, true, ok, "should give a working key")
+		_, err = svr.Authenticate("ci", "")
+		assert.Equal(t, ErrInvalidAuth, err, "should not log in with a password")
+		err = svr.SetPassword(id, "passw0rd")
+		assert.Equal(t, ErrUnsupported, err, "should not get a password")
+		token, err := svr.IssueToken(id, ClientInfo{})
+		assert.Equal(t, nil, err, "should get tokens")
+		ok, _ = svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should get tokens")
+		_, _, err = svr.CreateServiceAccount("ci")
+		assert.Equal(t, ErrUserExists, err, "should share the names of users")
+	}
+	{
+		id := svr.GetUserByName("ci").ID
+		old, _ := svr.CreateAPIKey(id, "extra", nil, time.Time{})
+		key, err := svr.RotateCredentials(id, time.Hour)
+		assert.Equal(t, nil, err, "should success")
+		_, err = svr.TokenUser(old)
+		assert.Equal(t, nil, err, "should keep old keys during the grace period")
+		ok, _ := svr.CheckRole(key, rid)
+		assert.Equal(t, true, ok, "should give a working key")
+		list, _ := svr.ListAPIKeys(id)
+		assert.Equal(t, 3, len(list), "should add a key")
+		assert.Equal(t, false, list[0].Expires.IsZero(), "should make old keys expire")
+		assert.Equal(t, true, list[2].Expires.IsZero(), "should not make the new key expire")
+
+		key2, _ := svr.RotateCredentials(id, 0)
+		_, err = svr.TokenUser(key)
+		assert.Equal(t, ErrInvalidToken, err, "should revoke old keys without a grace period")
+		_, err = svr.TokenUser(key2)
+		assert.Equal(t, nil, err, "should give a working key")
+	}
+	{
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		_, err := svr.RotateCredentials(uid, 0)
+		assert.Equal(t, ErrNotServiceAccount, err, "should only rotate service accounts")
+		_, err = svr.RotateCredentials(101, 0)
+		assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist for nonexistent users")
+	}
+}
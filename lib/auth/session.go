@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ClientInfo describes the client a token was issued to, as reported by the application.
+// It is listed by ListTokens and Introspect, e.g. for UIs managing the signed-in devices. The server
+// only checks it when verifying tokens bound to their client, see ServerConfig.BindTokens.
+type ClientInfo struct {
+	IP        string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+	Device    string `json:",omitempty"` // a label for the device, such as "Anna's phone"
+	// Fingerprint identifies the client beyond its IP, e.g. a hash of its TLS certificate or of a
+	// key held by the device, as computed by the application.
+	Fingerprint string `json:",omitempty"`
+	// Bind binds the token to the IP and Fingerprint, like ServerConfig.BindTokens does for all.
+	Bind bool `json:",omitempty"`
+}
+
+// TokenInfo describes an active token (a session) without revealing its value.
+type TokenInfo struct {
+	ID      string
+	Issued  time.Time
+	Expires time.Time
+	Client  ClientInfo
+	Scope   *TokenScope // nil if the token is not limited
+	Actor   UserID      // who acts as the user, for impersonation tokens, see Impersonate
+}
+
+// SessionLimitAction tells what happens to a new session beyond ServerConfig.MaxSessions.
+type SessionLimitAction uint8
+
+const (
+	EvictOldest SessionLimitAction = iota // the oldest sessions of the user are invalidated
+	RejectNew                             // the login fails with ErrTooManySessions
+)
+
+var (
+	ErrUnsupported     = newError("unsupported", http.StatusNotImplemented, "not supported in this mode")
+	ErrTooManySessions = newError("too_many_sessions", http.StatusForbidden, "too many sessions")
+)
+
+// maxSlideStep is how much a token can lose of its idle timeout, at most, before its use extends it.
+// Saving each use would be a write per request.
+const maxSlideStep = time.Minute
+
+// ID returns an identifier of the token, which can be shown to users and sent to UIs instead of the
+// token itself. It is derived from the token value, and cannot be turned back into it.
+func (t *Token) ID() string {
+	return tokenID(t.Value)
+}
+
+// tokenID gives the ID of a token value, see Token.ID.
+func tokenID(v TokenValue) string {
+	sum := sha256.Sum256([]byte(v))
+	return base64.RawURLEncoding.EncodeToString(sum[:9])
+}
+
+// tokenLifetimeSec is how long session tokens can be valid, with sliding expiry or not.
+func (s *Server) tokenLifetimeSec() int32 {
+	if s.cfg.TokenMaxLifetimeSec > 0 {
+		return s.cfg.TokenMaxLifetimeSec
+	}
+	return s.live().TokenExpireSec
+}
+
+// slideToken extends a token used at now, up to its maximum lifetime (see
+// ServerConfig.TokenMaxLifetimeSec). The new expiry is saved in the background, like the last use of
+// API keys, as the callers of verifyToken only hold s.mu for reading.
+func (s *Server) slideToken(tokenObj *Token, now time.Time) {
+	idle := time.Duration(s.live().TokenExpireSec) * time.Second
+	expires := now.Add(idle)
+	if max := tokenObj.Issued.Add(time.Duration(s.cfg.TokenMaxLifetimeSec) * time.Second); expires.After(max) {
+		expires = max
+	}
+	step := idle / 10
+	if step > maxSlideStep {
+		step = maxSlideStep
+	}
+	if expires.Sub(tokenObj.Expires) < step {
+		return
+	}
+
+	key := string(tokenObj.Value)
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.touching[key] {
+		return
+	}
+	s.touching[key] = true
+
+	started := s.goBackground(func() {
+		defer func() {
+			s.tokenMu.Lock()
+			delete(s.touching, key)
+			s.tokenMu.Unlock()
+		}()
+		ctx := context.Background() // Not canceled with the request using the token
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// The token may have been invalidated in the meantime
+		stored, err := s.store.GetToken(ctx, tokenObj.Value)
+		if err != nil || !stored.Expires.Before(expires) || now.After(stored.Expires) {
+			return
+		}
+		extended := *stored
+		extended.Expires = expires
+		// Token checks wait for s.mu, so they never miss the token in between
+		if err := s.store.DeleteToken(ctx, stored.Value); err != nil {
+			return
+		}
+		_ = s.store.InsertToken(ctx, &extended)
+	})
+	if !started {
+		delete(s.touching, key)
+	}
+}
+
+func (t *Token) info() TokenInfo {
+	return TokenInfo{ID: t.ID(), Issued: t.Issued, Expires: t.Expires, Client: t.Client, Scope: t.Scope, Actor: t.Actor}
+}
+
+// AuthenticateClient works like Authenticate, and records the client on the new token, so that it
+// shows up in ListTokens and Introspect. In JWT mode, the client is not recorded.
+//
+// Returns: the token string
+// Errors: ErrInvalidAuth, ErrUserSuspended, ErrMFARequired, ErrTooManySessions, ErrRateLimited,
+// ErrTooManyTokens, ErrInternal
+func (s *Server) AuthenticateClient(username, password string, client ClientInfo) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.AuthenticateClient")
+	defer func() { sp.end(err) }()
+	return s.interceptAuthenticate("AuthenticateClient", username, password, client, nil)
+}
+
+// IssueToken issues a token for a user authenticated by other means than its password, such as
+// an identity provider layered on the server. Unlike Authenticate, it does not make MFA challenges:
+// the caller is responsible for how the user was authenticated.
+//
+// Returns: the token string
+// Errors: ErrUserNotExist, ErrUserSuspended, ErrTooManySessions, ErrTooManyTokens, ErrInternal
+func (s *Server) IssueToken(user UserID, client ClientInfo) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.IssueToken")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	// No lock is needed, see authenticate
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if userObj.Status == UserSuspended {
+		return "", ErrUserSuspended
+	}
+	return s.issueToken(userObj, client, nil, AuthPassword)
+}
+
+// AuthenticateScoped works like AuthenticateClient, and limits the new token to part of the roles
+// and permissions of the user, e.g. for a tool that only needs to read. The scope is kept through
+// MFA. A nil scope gives an unlimited token.
+//
+// Returns: the token string
+// Errors: ErrInvalidAuth, ErrUserSuspended, ErrMFARequired, ErrInvalidScope, ErrInvalidPermission,
+// ErrTooManySessions, ErrTooManyTokens, ErrInternal
+func (s *Server) AuthenticateScoped(username, password string, client ClientInfo, scope *TokenScope) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.AuthenticateScoped")
+	defer func() { sp.end(err) }()
+	return s.interceptAuthenticate("AuthenticateScoped", username, password, client, scope)
+}
+
+// IssueScopedToken works like IssueToken, and limits the new token like AuthenticateScoped.
+//
+// Returns: the token string
+// Errors: ErrUserNotExist, ErrUserSuspended, ErrInvalidScope, ErrInvalidPermission, ErrTooManySessions,
+// ErrTooManyTokens, ErrInternal
+func (s *Server) IssueScopedToken(user UserID, client ClientInfo, scope *TokenScope) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.IssueScopedToken")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	userObj, err := s.getUser(s.ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if userObj.Status == UserSuspended {
+		return "", ErrUserSuspended
+	}
+	if scope, err = s.checkScope(userObj, scope); err != nil {
+		return "", err
+	}
+	return s.issueToken(userObj, client, scope, AuthPassword)
+}
+
+// ListTokens lists the active tokens of a user, oldest first, so that applications can show the
+// signed-in devices. Tokens are not tracked in JWT mode.
+//
+// Returns: the tokens
+// Errors: ErrUserNotExist, ErrUnsupported
+func (s *Server) ListTokens(user UserID) (_ []TokenInfo, err error) {
+	s, sp := s.trace("auth.ListTokens")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	if s.jwt != nil {
+		return nil, ErrUnsupported
+	}
+	ctx := s.ctx
+	if _, err := s.getUser(ctx, user); err != nil {
+		return nil, err
+	}
+	tokens, err := s.store.UserTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	list := make([]TokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Kind == TokenSession && now.Before(t.Expires) {
+			list = append(list, t.info())
+		}
+	}
+	// By ID among the tokens issued at the same time, as the store lists them in any order
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Issued.Equal(list[j].Issued) {
+			return list[i].Issued.Before(list[j].Issued)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// InvalidateToken invalidates a token of a user by its ID (see TokenInfo), e.g. to sign out a lost
+// device. Tokens of other users are never touched, even if the ID matches.
+//
+// Returns: none
+// Errors: ErrInvalidToken, ErrUnsupported
+func (s *Server) InvalidateToken(user UserID, id string) (err error) {
+	s, sp := s.trace("auth.InvalidateToken")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	if s.jwt != nil {
+		return ErrUnsupported
+	}
+	ctx := s.ctx
+	tokens, err := s.store.UserTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.Kind == TokenSession && t.ID() == id {
+			if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+				return err
+			}
+			s.emit(Event{Type: EventTokenRevoked, User: user, Actor: t.Actor, TokenID: id})
+			return nil
+		}
+	}
+	return ErrInvalidToken
+}
+
+// limitSessions makes room for a new session token of a user, see ServerConfig.MaxSessions.
+// The caller must hold s.sessionMu.
+//
+// Errors: ErrTooManySessions
+func (s *Server) limitSessions(user UserID) error {
+	ctx := s.ctx
+	tokens, err := s.store.UserTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	active := make([]*Token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Kind == TokenSession && t.Actor == 0 && now.Before(t.Expires) {
+			active = append(active, t)
+		}
+	}
+	excess := len(active) - s.cfg.MaxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+	if s.cfg.OnMaxSessions == RejectNew {
+		return ErrTooManySessions
+	}
+	sort.SliceStable(active, func(i, j int) bool { return active[i].Issued.Before(active[j].Issued) })
+	for _, t := range active[:excess] {
+		if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRole checks if the scope keeps a role for CheckRole.
+func (sc *TokenScope) hasRole(role RoleID) bool {
+	for _, r := range sc.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// limit removes the roles outside the scope. Scopes of permissions only keep all of them.
+func (sc *TokenScope) limit(roles map[RoleID]struct{}) {
+	if len(sc.Roles) == 0 {
+		return
+	}
+	for role := range roles {
+		if !sc.hasRole(role) {
+			delete(roles, role)
+		}
+	}
+}
+
+// allows checks if the scope admits a permission.
+func (sc *TokenScope) allows(perm string) bool {
+	return len(sc.Permissions) == 0 || matchAny(sc.Permissions, perm)
+}
+
+// checkScope makes sure that a requested scope is part of what the user is granted, and returns it
+// without duplicates. A nil scope stays nil.
+//
+// Errors: ErrInvalidScope, ErrInvalidPermission
+func (s *Server) checkScope(userObj *User, scope *TokenScope) (*TokenScope, error) {
+	if scope == nil {
+		return nil, nil
+	}
+	if len(scope.Roles) == 0 && len(scope.Permissions) == 0 {
+		return nil, ErrInvalidScope
+	}
+	roles, err := s.effectiveRoles(userObj)
+	if err != nil {
+		return nil, err
+	}
+	checked := &TokenScope{}
+	for _, role := range scope.Roles {
+		if _, ok := roles[role]; !ok {
+			return nil, ErrInvalidScope
+		}
+		if !checked.hasRole(role) {
+			checked.Roles = append(checked.Roles, role)
+		}
+	}
+	seen := make(map[string]bool, len(scope.Permissions))
+	for _, perm := range scope.Permissions {
+		if err := validatePermission(perm); err != nil {
+			return nil, err
+		}
+		if !seen[perm] {
+			seen[perm] = true
+			checked.Permissions = append(checked.Permissions, perm)
+		}
+	}
+	return checked, nil
+}
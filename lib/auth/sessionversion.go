@@ -0,0 +1,41 @@
+package auth
+
+// bumpSession marks a downgrade of a user, so that its tokens issued before stop verifying, see
+// ServerConfig.SessionVersioning. u is a clone about to be saved.
+func (s *Server) bumpSession(u *User) {
+	if s.cfg.SessionVersioning {
+		u.SessionVersion++
+	}
+}
+
+// currentSession tells if a token issued at the session version v is still valid for its user.
+func (s *Server) currentSession(u *User, v uint32) bool {
+	return !s.cfg.SessionVersioning || u.SessionVersion == v
+}
+
+// bumpGroupSessions bumps the session version of the members of a group, for the roles it loses.
+// The caller must hold s.mu.
+func (s *Server) bumpGroupSessions(group GroupID) error {
+	if !s.cfg.SessionVersioning {
+		return nil
+	}
+	ctx := s.ctx
+	members, err := s.store.GroupMembers(ctx, group)
+	if err != nil {
+		return err
+	}
+	for _, id := range members {
+		userObj, err := s.getUser(ctx, id)
+		if err == ErrUserNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		userObj = userObj.clone()
+		s.bumpSession(userObj)
+		if err := s.store.UpdateUser(ctx, userObj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
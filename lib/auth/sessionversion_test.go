@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionVersioning(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, SessionVersioning: true}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	admin, _ := svr.CreateRole("admin")
+	reader, _ := svr.CreateRole("reader")
+	svr.AddRoleToUser(uid, admin)
+	svr.AddRoleToUser(uid, reader)
+	gid, _ := svr.CreateGroup("staff")
+	svr.AddRoleToGroup(gid, reader)
+	svr.AddUserToGroup(uid, gid)
+	login := func() TokenValue {
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		return token
+	}
+	{
+		token := login()
+		svr.AddRoleToUser(uid, admin)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should keep tokens on upgrades")
+		svr.RemoveRoleFromUser(uid, admin)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate tokens on role revocation")
+		_, err = svr.TokenUser(login())
+		assert.Equal(t, nil, err, "should accept new tokens")
+	}
+	{
+		token := login()
+		svr.RemoveRoleFromGroup(gid, reader)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate the tokens of group members")
+		token = login()
+		svr.RemoveUserFromGroup(uid, gid)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate tokens on group removal")
+	}
+	{
+		token := login()
+		svr.SetPassword(uid, "n3wpassw0rd")
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate tokens on password change")
+		token, _ = svr.Authenticate("anna", "n3wpassw0rd")
+		svr.SuspendUser(uid)
+		svr.ReactivateUser(uid)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not bring tokens back on reactivation")
+	}
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		rid, _ := svr.CreateRole("admin")
+		svr.AddRoleToUser(uid, rid)
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.RemoveRoleFromUser(uid, rid)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should keep tokens by default")
+	}
+}
+
+func TestSessionVersioningJWT(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, SessionVersioning: true, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should verify the JWT")
+		svr.RemoveRoleFromUser(uid, rid)
+		_, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should not keep the roles in the claims")
+	}
+}
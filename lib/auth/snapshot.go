@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// A snapshot is the full content of a MemoryStorage as a JSON document, so that it survives a
+// process restart. Role assignments are saved as role IDs. The format is versioned: a newer version
+// of this package can read the snapshots of an older one, but not the other way around.
+//
+// Version history:
+//   - 1: users, roles and tokens
+//   - 2: groups
+//   - 3: the status of users, an older reader would load suspended users as active
+//   - 4: the tombstones of soft-deleted users
+//   - 5: the scopes of tokens
+//   - 6: the sealed secrets of users
+
+// SnapshotVersion is the version of the snapshots written by this package.
+const SnapshotVersion = 6
+
+type snapshot struct {
+	Version   int
+	Created   time.Time
+	NextUser  UserID
+	NextRole  RoleID
+	NextGroup GroupID `json:",omitempty"`
+	Users     []snapshotUser
+	Roles     []*Role
+	Groups    []*Group `json:",omitempty"`
+	Tokens    []*Token `json:",omitempty"`
+}
+
+// snapshotUser replaces the role objects of a user with their IDs.
+type snapshotUser struct {
+	*User
+	Roles []RoleID
+}
+
+var (
+	ErrInvalidSnapshot = newError("invalid_snapshot", http.StatusBadRequest, "invalid snapshot")
+	ErrSnapshotTooNew  = newError("snapshot_too_new", http.StatusBadRequest, "snapshot is newer than this version of the package")
+)
+
+// Save writes a snapshot of all users and roles to w. Tokens are only included if withTokens is
+// true, as they are secrets that allow logging in as their users.
+//
+// Returns: none
+// Errors: any error from w
+func (m *MemoryStorage) Save(w io.Writer, withTokens bool) error {
+	return m.save(w, withTokens, time.Now())
+}
+
+// save writes a snapshot created at now.
+func (m *MemoryStorage) save(w io.Writer, withTokens bool, now time.Time) error {
+	m.mu.RLock()
+	snap := snapshot{
+		Version:   SnapshotVersion,
+		Created:   now,
+		NextUser:  m.nextUser,
+		NextRole:  m.nextRole,
+		NextGroup: m.nextGroup,
+		Users:     make([]snapshotUser, 0, len(m.users)),
+		Roles:     make([]*Role, 0, len(m.roles)),
+	}
+	// Stored objects are immutable, so they can be encoded after releasing the lock
+	for _, u := range m.users {
+		su := snapshotUser{User: u, Roles: make([]RoleID, 0, len(u.Roles))}
+		for role := range u.Roles {
+			su.Roles = append(su.Roles, role)
+		}
+		sort.Slice(su.Roles, func(i, j int) bool { return su.Roles[i] < su.Roles[j] })
+		snap.Users = append(snap.Users, su)
+	}
+	for _, r := range m.roles {
+		snap.Roles = append(snap.Roles, r)
+	}
+	for _, g := range m.groups {
+		snap.Groups = append(snap.Groups, g)
+	}
+	m.mu.RUnlock()
+	if withTokens {
+		for i := range m.shards {
+			sh := &m.shards[i]
+			sh.mu.RLock()
+			for _, t := range sh.tokens {
+				snap.Tokens = append(snap.Tokens, t)
+			}
+			sh.mu.RUnlock()
+		}
+	}
+
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].ID < snap.Users[j].ID })
+	sort.Slice(snap.Roles, func(i, j int) bool { return snap.Roles[i].ID < snap.Roles[j].ID })
+	sort.Slice(snap.Groups, func(i, j int) bool { return snap.Groups[i].ID < snap.Groups[j].ID })
+	sort.Slice(snap.Tokens, func(i, j int) bool { return snap.Tokens[i].Issued.Before(snap.Tokens[j].Issued) })
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&snap)
+}
+
+// Load replaces everything in the storage with a snapshot made by Save. Expired tokens are dropped.
+// The storage is left unchanged if the snapshot cannot be loaded.
+//
+// Returns: none
+// Errors: ErrInvalidSnapshot, ErrSnapshotTooNew, or any error from r
+func (m *MemoryStorage) Load(r io.Reader) error {
+	_, err := m.load(r, time.Now())
+	return err
+}
+
+// load restores a snapshot, dropping the tokens expired at now, and returns the restored tokens.
+func (m *MemoryStorage) load(r io.Reader, now time.Time) ([]*Token, error) {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		switch err.(type) {
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			return nil, ErrInvalidSnapshot
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidSnapshot
+		}
+		return nil, err
+	}
+	if snap.Version > SnapshotVersion {
+		return nil, ErrSnapshotTooNew
+	} else if snap.Version < 1 {
+		return nil, ErrInvalidSnapshot
+	}
+
+	// Build a new storage with the regular methods, which check for duplicates, and its view in a
+	// single edit
+	ctx := context.Background()
+	fresh := NewShardedMemoryStorage(len(m.shards))
+	fresh.batch = fresh.edit()
+	for _, role := range snap.Roles {
+		if role == nil || role.ID <= 0 || fresh.InsertRole(ctx, role) != nil {
+			return nil, ErrInvalidSnapshot
+		}
+	}
+	for _, g := range snap.Groups {
+		if g == nil || g.ID <= 0 || fresh.InsertGroup(ctx, g) != nil {
+			return nil, ErrInvalidSnapshot
+		}
+	}
+	for _, su := range snap.Users {
+		if su.User == nil || su.ID <= 0 {
+			return nil, ErrInvalidSnapshot
+		}
+		u := su.User
+		u.Roles = make(map[RoleID]*Role, len(su.Roles))
+		for _, role := range su.Roles {
+			if fresh.roles[role] == nil {
+				return nil, ErrInvalidSnapshot
+			}
+			u.Roles[role] = fresh.roles[role]
+		}
+		if !sort.SliceIsSorted(u.Groups, func(i, j int) bool { return u.Groups[i] < u.Groups[j] }) {
+			return nil, ErrInvalidSnapshot
+		}
+		for _, group := range u.Groups {
+			if fresh.groups[group] == nil {
+				return nil, ErrInvalidSnapshot
+			}
+		}
+		if fresh.InsertUser(ctx, u) != nil {
+			return nil, ErrInvalidSnapshot
+		}
+	}
+	var tokens []*Token
+	for _, t := range snap.Tokens {
+		if t != nil && now.Before(t.Expires) && fresh.users[t.User] != nil {
+			fresh.shard(t.Value).put(t)
+			tokens = append(tokens, t)
+		}
+	}
+	if snap.NextUser > fresh.nextUser {
+		fresh.nextUser = snap.NextUser
+	}
+	if snap.NextRole > fresh.nextRole {
+		fresh.nextRole = snap.NextRole
+	}
+	if snap.NextGroup > fresh.nextGroup {
+		fresh.nextGroup = snap.NextGroup
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users, m.uname, m.uemail, m.roles, m.rname = fresh.users, fresh.uname, fresh.uemail, fresh.roles, fresh.rname
+	m.groups, m.gname = fresh.groups, fresh.gname
+	m.holders, m.members = fresh.holders, fresh.members
+	m.grantees, m.rgroups = fresh.grantees, fresh.rgroups
+	m.nextUser, m.nextRole, m.nextGroup = fresh.nextUser, fresh.nextRole, fresh.nextGroup
+	m.view.Store(&fresh.batch.memView)
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		sh.tokens, sh.utoken = fresh.shards[i].tokens, fresh.shards[i].utoken
+		sh.mu.Unlock()
+	}
+	return tokens, nil
+}
+
+// Save writes a snapshot of the server data to w, created at the time of its clock. See
+// MemoryStorage.Save.
+// Only servers backed by a MemoryStorage support snapshots: other backends persist data by
+// themselves.
+//
+// Returns: none
+// Errors: ErrUnsupported, or any error from w
+func (s *Server) Save(w io.Writer, withTokens bool) (err error) {
+	s, sp := s.trace("auth.Save")
+	defer func() { sp.end(err) }()
+	m, ok := s.baseStore().(*MemoryStorage)
+	if !ok {
+		return ErrUnsupported
+	}
+	// Keep writers out, so that the snapshot is consistent
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return m.save(w, withTokens, s.now())
+}
+
+// Load replaces the server data with a snapshot made by Save. Tokens expired by the clock of the
+// server are dropped, and restored ones are pruned like new ones once they expire. Watches end, to
+// list the data again, see Watch.
+//
+// Returns: none
+// Errors: ErrUnsupported, ErrInvalidSnapshot, ErrSnapshotTooNew, or any error from r
+func (s *Server) Load(r io.Reader) (err error) {
+	s, sp := s.trace("auth.Load")
+	defer func() { sp.end(err) }()
+	m, ok := s.baseStore().(*MemoryStorage)
+	if !ok {
+		return ErrUnsupported
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := m.load(r, s.now())
+	if err != nil {
+		return err
+	}
+	s.decisions.invalidate()
+	if s.changes != nil {
+		s.changes.reset()
+	}
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	// The old queue refers to tokens that are gone
+	s.tokenQ = append(tokenHeap(nil), tokens...)
+	heap.Init(&s.tokenQ)
+	s.queued = len(tokens)
+	return nil
+}
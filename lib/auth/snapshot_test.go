@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+	uid, _ := svr.CreateUser("elton", "123456")
+	svr.CreateUser("fred", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.AddRoleToUser(uid, rid)
+	svr.GrantPermissionToRole(rid, "devices:scan")
+	svr.DeleteRole(rid2)
+	gid, _ := svr.CreateGroup("staff")
+	svr.AddUserToGroup(uid, gid)
+	token, _ := svr.Authenticate("elton", "123456")
+
+	var withTokens, withoutTokens bytes.Buffer
+	assert.Equal(t, nil, svr.Save(&withTokens, true), "should success")
+	assert.Equal(t, nil, svr.Save(&withoutTokens, false), "should success")
+	assert.NotContains(t, withoutTokens.String(), string(token), "should leave out tokens unless asked")
+	{
+		restored, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, Hasher: fastHasher})
+		assert.Equal(t, nil, restored.Load(&withTokens), "should success")
+		ok, err := restored.CheckPermission(token, "devices:scan")
+		assert.Equal(t, nil, err, "should restore tokens")
+		assert.Equal(t, true, ok, "should restore roles and permissions")
+		assert.Equal(t, 1, len(restored.tokenQ), "should queue restored tokens for pruning")
+		users, _ := restored.ListUsersWithRole(rid)
+		assert.Equal(t, []UserID{uid}, users, "should rebuild the role index")
+		_, err = restored.Authenticate("fred", "123456")
+		assert.Equal(t, nil, err, "should restore password hashes")
+		newRole, _ := restored.CreateRole("printer")
+		assert.Equal(t, rid2+1, newRole, "should not reuse the IDs of deleted roles")
+		members, _ := restored.ListGroupMembers(gid)
+		assert.Equal(t, []UserID{uid}, members, "should restore groups and rebuild the membership index")
+	}
+	{
+		restored, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+		assert.Equal(t, nil, restored.Load(&withoutTokens), "should success")
+		_, err := restored.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should not restore tokens")
+	}
+	{
+		clock := NewManualClock(time.Unix(1700000000, 0))
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60}), WithHasher(fastHasher), WithClock(clock))
+		svr.CreateUser("elton", "123456")
+		token, _ := svr.Authenticate("elton", "123456")
+		var buf bytes.Buffer
+		svr.Save(&buf, true)
+		data := buf.String()
+		assert.Contains(t, data, `"Created": "`+clock.Now().Format(time.RFC3339Nano)+`"`, "should use the clock of the server")
+		restored, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60}), WithHasher(fastHasher), WithClock(clock))
+		assert.Equal(t, nil, restored.Load(strings.NewReader(data)), "should success")
+		_, err := restored.TokenUser(token)
+		assert.Equal(t, nil, err, "should expire tokens by the clock of the server")
+		clock.Advance(time.Minute)
+		assert.Equal(t, nil, restored.Load(strings.NewReader(data)), "should success")
+		assert.Equal(t, 0, len(restored.tokenQ), "should drop the tokens expired by the clock of the server")
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStorage()
+	m.InsertUser(ctx, &User{Name: "anna"})
+	for _, c := range []struct {
+		data string
+		err  error
+	}{
+		{fmt.Sprintf(`{"Version": %d}`, SnapshotVersion+1), ErrSnapshotTooNew},
+		{`{}`, ErrInvalidSnapshot},
+		{`{"Version": 1`, ErrInvalidSnapshot},
+		{`{"Version": "1"}`, ErrInvalidSnapshot},
+		{`{"Version": 1, "Users": [{"ID": 1, "Name": "anna", "Roles": [1]}]}`, ErrInvalidSnapshot},
+		{`{"Version": 1, "Users": [{"ID": 1, "Name": "anna"}, {"ID": 2, "Name": "anna"}]}`, ErrInvalidSnapshot},
+		{`{"Version": 2, "Users": [{"ID": 1, "Name": "anna", "Groups": [1]}]}`, ErrInvalidSnapshot},
+	} {
+		assert.Equal(t, c.err, m.Load(strings.NewReader(c.data)), "should reject "+c.data)
+	}
+	_, err := m.GetUserByName(ctx, "anna")
+	assert.Equal(t, nil, err, "should keep the data if the snapshot is rejected")
+
+	expired := `{"Version": 1, "Users": [{"ID": 1, "Name": "belle"}],
+		"Tokens": [{"Value": "old", "User": 1, "Expires": "` + time.Now().Add(-time.Minute).Format(time.RFC3339) + `"}]}`
+	assert.Equal(t, nil, m.Load(strings.NewReader(expired)), "should success")
+	_, err = m.GetToken(ctx, "old")
+	assert.Equal(t, ErrInvalidToken, err, "should drop expired tokens")
+	_, err = m.GetUserByName(ctx, "anna")
+	assert.Equal(t, ErrUserNotExist, err, "should replace the data")
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// With ServerConfig.SoftDeleteSec, DeleteUser keeps a tombstone of the user for a while, so that
+// mistakes can be undone with RestoreUser. Tombstones are saved as regular users with Deleted set.
+// Their roles and groups are moved into the tombstone, so that role and group listings leave them
+// out without extra lookups, and their name stays taken until they are purged.
+
+// Tombstone is what remains of a soft-deleted user, besides the name and the password hash.
+type Tombstone struct {
+	On     time.Time
+	Roles  []RoleID  `json:",omitempty"`
+	Groups []GroupID `json:",omitempty"`
+}
+
+func (t *Tombstone) clone() *Tombstone {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Roles = append([]RoleID(nil), t.Roles...)
+	c.Groups = append([]GroupID(nil), t.Groups...)
+	return &c
+}
+
+// RestoreUser brings back a user deleted less than SoftDeleteSec ago, with the roles and groups
+// that still exist. Tokens and API keys are not restored, JWTs included: those issued before the
+// deletion stay invalid.
+//
+// Returns: none
+// Errors: ErrUserNotExist (if there is no such deleted user)
+func (s *Server) RestoreUser(user UserID) (err error) {
+	s, sp := s.trace("auth.RestoreUser")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.store.GetUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if userObj.Deleted == nil || s.purgeable(userObj, s.now()) {
+		return ErrUserNotExist
+	}
+	userObj = userObj.clone()
+	for _, role := range userObj.Deleted.Roles {
+		if r, err := s.store.GetRole(ctx, role); err == nil {
+			userObj.Roles[role] = r
+		} else if err != ErrRoleNotExist {
+			return err
+		}
+	}
+	for _, group := range userObj.Deleted.Groups {
+		if _, err := s.store.GetGroup(ctx, group); err == nil {
+			userObj.Groups = append(userObj.Groups, group)
+		} else if err != ErrGroupNotExist {
+			return err
+		}
+	}
+	userObj.Deleted = nil
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	s.emit(Event{Type: EventUserRestored, User: user, Name: userObj.Name})
+	return nil
+}
+
+// PurgeDeletedUsers permanently removes the users deleted more than SoftDeleteSec ago. It runs by
+// itself once per server epoch (see ServerConfig.PruneIntervalSec), in the background. It scans all
+// users, so call it directly only if tombstones must go at a precise time.
+//
+// Returns: the number of purged users
+// Errors: any error from the storage
+func (s *Server) PurgeDeletedUsers() (_ int, err error) {
+	s, sp := s.trace("auth.PurgeDeletedUsers")
+	defer func() { sp.end(err) }()
+	var (
+		n    int
+		opts = ListOptions{Limit: MaxListLimit}
+		now  = s.now()
+	)
+	for {
+		list, next, err := s.ListUsers(&opts)
+		if err != nil {
+			return n, err
+		}
+		for _, u := range list {
+			if !s.purgeable(u, now) {
+				continue
+			}
+			if err := s.purgeUser(u.ID, now); err == nil {
+				n++
+			} else if err != ErrUserNotExist {
+				return n, err
+			}
+		}
+		if next == "" {
+			return n, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// purgeUser deletes a user if it is still due for purging.
+func (s *Server) purgeUser(user UserID, now time.Time) error {
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check again, in case the user was restored in the meantime
+	userObj, err := s.store.GetUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !s.purgeable(userObj, now) {
+		return ErrUserNotExist
+	}
+	return s.hardDeleteUser(ctx, user)
+}
+
+func (s *Server) purgeable(u *User, now time.Time) bool {
+	return u.Deleted != nil && now.Sub(u.Deleted.On) >= time.Duration(s.cfg.SoftDeleteSec)*time.Second
+}
+
+// softDeleteUser turns a user into a tombstone, and removes its tokens. The caller must hold s.mu.
+func (s *Server) softDeleteUser(userObj *User) error {
+	ctx := s.ctx
+	userObj = userObj.clone()
+	userObj.Deleted = &Tombstone{On: s.now(), Groups: userObj.Groups}
+	for role := range userObj.Roles {
+		userObj.Deleted.Roles = append(userObj.Deleted.Roles, role)
+	}
+	sort.Slice(userObj.Deleted.Roles, func(i, j int) bool { return userObj.Deleted.Roles[i] < userObj.Deleted.Roles[j] })
+	userObj.Roles = make(map[RoleID]*Role)
+	userObj.Groups = nil
+	userObj.APIKeys = nil
+	// Even without SessionVersioning, so that the JWTs issued before, which are not saved, do not
+	// verify again once the user is restored, see verifyJWT
+	userObj.SessionVersion++
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	// Tokens are rejected for tombstones anyway, so a failure here is not fatal
+	tokens, err := s.store.UserTokens(ctx, userObj.ID)
+	if err != nil {
+		return nil
+	}
+	for _, t := range tokens {
+		_ = s.store.DeleteToken(ctx, t.Value)
+	}
+	return nil
+}
+
+// startPurge runs PurgeDeletedUsers in the background, unless it is already running.
+func (s *Server) startPurge() {
+	if s.cfg.SoftDeleteSec <= 0 || !atomic.CompareAndSwapInt32(&s.purging, 0, 1) {
+		return
+	}
+	started := s.goBackground(func() {
+		defer atomic.StoreInt32(&s.purging, 0)
+		// Not bound to the request that happened to start the purge
+		_, _ = s.WithContext(context.Background()).PurgeDeletedUsers()
+	})
+	if !started {
+		atomic.StoreInt32(&s.purging, 0)
+	}
+}
+
+// getUser is store.GetUser for users that are not soft-deleted.
+func (s *Server) getUser(ctx context.Context, id UserID) (*User, error) {
+	u, err := s.store.GetUser(ctx, id)
+	if err == nil && u.Deleted != nil {
+		return nil, ErrUserNotExist
+	}
+	return u, err
+}
+
+// getUserByName is lookupUserByName for users that are not soft-deleted.
+func (s *Server) getUserByName(ctx context.Context, name string) (*User, error) {
+	u, err := s.lookupUserByName(ctx, name)
+	if err == nil && u.Deleted != nil {
+		return nil, ErrUserNotExist
+	}
+	return u, err
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftDelete(t *testing.T) {
+	{
+		_, err := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, SoftDeleteSec: -1})
+		assert.Equal(t, ErrInvalidConfig, err, "should reject a negative SoftDeleteSec")
+	}
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, SoftDeleteSec: 3600})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	gid, _ := svr.CreateGroup("staff")
+	svr.AddRoleToUser(uid, rid)
+	svr.AddRoleToUser(uid, rid2)
+	svr.AddUserToGroup(uid, gid)
+	token, _ := svr.Authenticate("elton", "123456")
+
+	assert.Equal(t, ErrUserNotExist, svr.RestoreUser(uid), "should not restore a user that is not deleted")
+	assert.Equal(t, nil, svr.DeleteUser(uid), "should success")
+	{
+		var nilUser *User
+		assert.Equal(t, nilUser, svr.GetUser(uid), "should hide the deleted user")
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrInvalidAuth, err, "should reject deleted users")
+		_, err = svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate the tokens")
+		_, err = svr.CreateUser("elton", "123456")
+		assert.Equal(t, ErrUserExists, err, "should keep the name taken")
+		users, _ := svr.ListUsersWithRole(rid)
+		assert.Equal(t, []UserID{}, users, "should not list the deleted user as a role holder")
+		list, _, _ := svr.ListUsers(nil)
+		assert.NotEqual(t, (*Tombstone)(nil), list[0].Deleted, "should list the deleted user for restoring")
+		assert.Equal(t, ErrUserNotExist, svr.AddRoleToUser(uid, rid), "should treat the deleted user as missing")
+	}
+
+	svr.DeleteRole(rid2)
+	assert.Equal(t, nil, svr.RestoreUser(uid), "should success")
+	{
+		u := svr.GetUser(uid)
+		assert.Equal(t, 1, len(u.Roles), "should restore the roles that still exist")
+		assert.Equal(t, rid, u.Roles[rid].ID, "should restore the roles that still exist")
+		members, _ := svr.ListGroupMembers(gid)
+		assert.Equal(t, []UserID{uid}, members, "should restore the groups")
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should accept the restored user")
+	}
+	{
+		svr.DeleteUser(uid)
+		assert.Equal(t, nil, svr.DeleteUser(uid), "should delete a deleted user for good")
+		assert.Equal(t, ErrUserNotExist, svr.RestoreUser(uid), "should not restore a purged user")
+	}
+}
+
+func TestSoftDeleteJWT(t *testing.T) {
+	for _, versioning := range []bool{false, true} {
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 60, SoftDeleteSec: 3600, SessionVersioning: versioning,
+			JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}}), WithHasher(fastHasher))
+		uid, _ := svr.CreateUser("elton", "123456")
+		token, _ := svr.Authenticate("elton", "123456")
+		svr.DeleteUser(uid)
+		_, err := svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the JWTs of deleted users")
+		svr.RestoreUser(uid)
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should not restore the JWTs, with SessionVersioning %v", versioning)
+		token, _ = svr.Authenticate("elton", "123456")
+		id, err := svr.TokenUser(token)
+		assert.Equal(t, nil, err, "should accept new JWTs")
+		assert.Equal(t, uid, id, "should accept new JWTs")
+	}
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	ctx := context.Background()
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, SoftDeleteSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	uid2, _ := svr.CreateUser("fred", "123456")
+	svr.CreateUser("gina", "123456")
+	svr.DeleteUser(uid)
+	svr.DeleteUser(uid2)
+	// Backdate the first deletion beyond the restore window
+	u, _ := memStore(svr).GetUser(ctx, uid)
+	u = u.clone()
+	u.Deleted.On = time.Now().Add(-time.Minute)
+	memStore(svr).UpdateUser(ctx, u)
+
+	assert.Equal(t, ErrUserNotExist, svr.RestoreUser(uid), "should not restore after the restore window")
+	n, err := svr.PurgeDeletedUsers()
+	assert.Equal(t, nil, err, "should success")
+	assert.Equal(t, 1, n, "should purge the expired tombstone only")
+	_, err = memStore(svr).GetUser(ctx, uid)
+	assert.Equal(t, ErrUserNotExist, err, "should remove the user from the storage")
+	assert.Equal(t, nil, svr.RestoreUser(uid2), "should keep the other tombstone")
+}
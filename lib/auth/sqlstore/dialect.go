@@ -0,0 +1,213 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the differences between SQL databases that matter to Store.
+// Use one of the predefined dialects.
+type Dialect struct {
+	Name string
+
+	// numbered is true if bind parameters are written as $1, $2... instead of ?.
+	numbered bool
+	// returning is true if INSERT ... RETURNING is supported. Otherwise LastInsertId is used.
+	returning bool
+	// migrations are applied in order. The index plus one is the schema version.
+	migrations []string
+	// fixSequence, if set, is called after inserting a row with an explicit ID, so that
+	// auto-generated IDs do not collide with it.
+	fixSequence func(ctx context.Context, tx *sql.Tx, table string) error
+	// uniqueViolation tells if an error is caused by a unique constraint.
+	uniqueViolation func(err error) bool
+	// setup is run by New before the migrations, to configure the database.
+	setup []string
+}
+
+var Postgres = &Dialect{
+	Name:      "postgres",
+	numbered:  true,
+	returning: true,
+	migrations: []string{
+		`CREATE TABLE auth_users (
+			id BIGSERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_roles (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_user_roles (
+			user_id BIGINT NOT NULL REFERENCES auth_users (id) ON DELETE CASCADE,
+			role_id INTEGER NOT NULL REFERENCES auth_roles (id) ON DELETE CASCADE,
+			PRIMARY KEY (user_id, role_id)
+		);
+		CREATE INDEX auth_user_roles_role ON auth_user_roles (role_id);
+		CREATE TABLE auth_tokens (
+			value VARCHAR(255) PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			expires BIGINT NOT NULL,
+			data TEXT NOT NULL
+		);
+		CREATE INDEX auth_tokens_expires ON auth_tokens (expires);`,
+		`CREATE INDEX auth_tokens_user ON auth_tokens (user_id);`,
+		`CREATE TABLE auth_groups (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_user_groups (
+			user_id BIGINT NOT NULL REFERENCES auth_users (id) ON DELETE CASCADE,
+			group_id INTEGER NOT NULL REFERENCES auth_groups (id) ON DELETE CASCADE,
+			PRIMARY KEY (user_id, group_id)
+		);
+		CREATE INDEX auth_user_groups_group ON auth_user_groups (group_id);`,
+	},
+	fixSequence: func(ctx context.Context, tx *sql.Tx, table string) error {
+		_, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('"+table+"', 'id'), (SELECT MAX(id) FROM "+table+"))")
+		return err
+	},
+	uniqueViolation: func(err error) bool {
+		// SQLSTATE 23505, as reported by lib/pq and pgx
+		return strings.Contains(err.Error(), "23505") || strings.Contains(err.Error(), "duplicate key")
+	},
+}
+
+var MySQL = &Dialect{
+	Name: "mysql",
+	migrations: []string{
+		`CREATE TABLE auth_users (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data LONGTEXT NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		CREATE TABLE auth_roles (
+			id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data LONGTEXT NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		CREATE TABLE auth_user_roles (
+			user_id BIGINT NOT NULL,
+			role_id INT NOT NULL,
+			PRIMARY KEY (user_id, role_id),
+			INDEX auth_user_roles_role (role_id),
+			FOREIGN KEY (user_id) REFERENCES auth_users (id) ON DELETE CASCADE,
+			FOREIGN KEY (role_id) REFERENCES auth_roles (id) ON DELETE CASCADE
+		) ENGINE=InnoDB;
+		CREATE TABLE auth_tokens (
+			value VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			expires BIGINT NOT NULL,
+			data LONGTEXT NOT NULL,
+			INDEX auth_tokens_expires (expires)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`,
+		`CREATE INDEX auth_tokens_user ON auth_tokens (user_id);`,
+		`CREATE TABLE auth_groups (
+			id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			data LONGTEXT NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+		CREATE TABLE auth_user_groups (
+			user_id BIGINT NOT NULL,
+			group_id INT NOT NULL,
+			PRIMARY KEY (user_id, group_id),
+			INDEX auth_user_groups_group (group_id),
+			FOREIGN KEY (user_id) REFERENCES auth_users (id) ON DELETE CASCADE,
+			FOREIGN KEY (group_id) REFERENCES auth_groups (id) ON DELETE CASCADE
+		) ENGINE=InnoDB;`,
+	},
+	uniqueViolation: func(err error) bool {
+		// Error 1062, as reported by go-sql-driver/mysql
+		return strings.Contains(err.Error(), "1062") || strings.Contains(err.Error(), "Duplicate entry")
+	},
+}
+
+// SQLite is for modernc.org/sqlite (driver "sqlite") and github.com/mattn/go-sqlite3 (driver
+// "sqlite3"). New turns on WAL mode, so that reads do not wait for writes. Writes still take turns:
+// give the connections a busy timeout, e.g. with "_pragma=busy_timeout(5000)" in the DSN of
+// modernc.org/sqlite or "_busy_timeout=5000" with go-sqlite3, so that they wait rather than fail.
+var SQLite = &Dialect{
+	Name: "sqlite",
+	// AUTOINCREMENT keeps the IDs of deleted rows from being reused, as with the other databases
+	migrations: []string{
+		`CREATE TABLE auth_users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_roles (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_user_roles (
+			user_id INTEGER NOT NULL REFERENCES auth_users (id) ON DELETE CASCADE,
+			role_id INTEGER NOT NULL REFERENCES auth_roles (id) ON DELETE CASCADE,
+			PRIMARY KEY (user_id, role_id)
+		);
+		CREATE INDEX auth_user_roles_role ON auth_user_roles (role_id);
+		CREATE TABLE auth_tokens (
+			value TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires INTEGER NOT NULL,
+			data TEXT NOT NULL
+		);
+		CREATE INDEX auth_tokens_expires ON auth_tokens (expires);`,
+		`CREATE INDEX auth_tokens_user ON auth_tokens (user_id);`,
+		`CREATE TABLE auth_groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			data TEXT NOT NULL
+		);
+		CREATE TABLE auth_user_groups (
+			user_id INTEGER NOT NULL REFERENCES auth_users (id) ON DELETE CASCADE,
+			group_id INTEGER NOT NULL REFERENCES auth_groups (id) ON DELETE CASCADE,
+			PRIMARY KEY (user_id, group_id)
+		);
+		CREATE INDEX auth_user_groups_group ON auth_user_groups (group_id);`,
+	},
+	uniqueViolation: func(err error) bool {
+		// SQLITE_CONSTRAINT_UNIQUE, as reported by both drivers
+		return strings.Contains(err.Error(), "UNIQUE constraint failed")
+	},
+	// The journal mode is saved in the database file, unlike most pragmas
+	setup: []string{"PRAGMA journal_mode = WAL"},
+}
+
+// rebind rewrites the ? placeholders of a query for the dialect.
+func (d *Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// statements splits a migration into single statements, because not every driver accepts
+// multiple statements in one Exec call.
+func statements(migration string) []string {
+	var list []string
+	for _, stmt := range strings.Split(migration, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			list = append(list, stmt)
+		}
+	}
+	return list
+}
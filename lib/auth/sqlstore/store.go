@@ -0,0 +1,723 @@
+// Package sqlstore implements auth.Storage on top of a SQL database (PostgreSQL, MySQL or SQLite).
+//
+// The package does not import any database driver. Open the *sql.DB with the driver of your choice
+// (such as github.com/lib/pq, github.com/go-sql-driver/mysql or modernc.org/sqlite) and pass the
+// matching Dialect. SQLite suits single-binary deployments that need durability without a
+// database server.
+//
+// Each entity is saved as a JSON document, next to the columns that need to be indexed. That way,
+// new fields of auth.User and friends are persisted without a schema change.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Store is an auth.Storage backed by a SQL database.
+type Store struct {
+	db *sql.DB
+	d  *Dialect
+}
+
+var (
+	ErrInvalidDialect = errors.New("unknown SQL dialect")
+	ErrSchemaTooNew   = errors.New("database schema is newer than this version of the package")
+)
+
+// New creates a Store, and brings the database schema up to date with Migrate.
+//
+// Returns: pointer to the new store
+// Errors: ErrInvalidDialect, ErrSchemaTooNew, or any error from the database
+func New(ctx context.Context, db *sql.DB, d *Dialect) (*Store, error) {
+	if db == nil || d == nil {
+		return nil, ErrInvalidDialect
+	}
+	s := &Store{db: db, d: d}
+	for _, stmt := range d.setup {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Migrate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSQLServer creates an auth.Server that persists its data to the database.
+// It is the SQL counterpart of auth.NewInMemoryServer.
+//
+// Returns: pointer to the new server instance
+// Errors: auth.ErrInvalidConfig, plus those of New
+func NewSQLServer(ctx context.Context, config *auth.ServerConfig, db *sql.DB, d *Dialect) (*auth.Server, error) {
+	s, err := New(ctx, db, d)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewServer(config, s)
+}
+
+// Migrate applies all pending schema migrations, each in its own transaction.
+// The current schema version is recorded in the table auth_schema.
+//
+// Errors: ErrSchemaTooNew, or any error from the database
+func (s *Store) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS auth_schema (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	err := s.db.QueryRowContext(ctx, "SELECT version FROM auth_schema").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.ExecContext(ctx, "INSERT INTO auth_schema (version) VALUES (0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if version > len(s.d.migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for ; version < len(s.d.migrations); version++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range statements(s.d.migrations[version]) {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.d.rebind("UPDATE auth_schema SET version = ?"), version+1)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredTokens removes all tokens that expired before the given time.
+// The server only prunes the tokens it issued itself, so it is a good idea to call this
+// periodically when multiple servers share a database, or after a restart.
+//
+// Returns: number of removed tokens
+func (s *Store) DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.d.rebind("DELETE FROM auth_tokens WHERE expires < ?"), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// *-* Users *-*
+
+// userRecord is the JSON document of a user. Role assignments and group memberships are saved in
+// their own tables.
+type userRecord struct {
+	*auth.User
+	Roles  []auth.RoleID  `json:",omitempty"`
+	Groups []auth.GroupID `json:",omitempty"`
+}
+
+func (s *Store) InsertUser(ctx context.Context, u *auth.User) error {
+	data, err := json.Marshal(userRecord{User: u})
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_users WHERE name = ?", u.Name); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrUserExists
+		}
+		id, err := s.insert(ctx, tx, "auth_users", int64(u.ID), u.Name, data)
+		if err != nil {
+			return s.mapUnique(err, auth.ErrUserExists)
+		}
+		if err := s.saveUserRoles(ctx, tx, auth.UserID(id), u.Roles); err != nil {
+			return err
+		}
+		if err := s.saveUserGroups(ctx, tx, auth.UserID(id), u.Groups); err != nil {
+			return err
+		}
+		u.ID = auth.UserID(id)
+		return nil
+	})
+}
+
+func (s *Store) UpdateUser(ctx context.Context, u *auth.User) error {
+	data, err := json.Marshal(userRecord{User: u})
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_users WHERE id = ?", u.ID); err != nil {
+			return err
+		} else if !exists {
+			return auth.ErrUserNotExist
+		}
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_users WHERE name = ? AND id <> ?", u.Name, u.ID); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrUserExists
+		}
+		_, err := tx.ExecContext(ctx, s.d.rebind("UPDATE auth_users SET name = ?, data = ? WHERE id = ?"), u.Name, string(data), u.ID)
+		if err != nil {
+			return s.mapUnique(err, auth.ErrUserExists)
+		}
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_roles WHERE user_id = ?"), u.ID); err != nil {
+			return err
+		}
+		if err := s.saveUserRoles(ctx, tx, u.ID, u.Roles); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_groups WHERE user_id = ?"), u.ID); err != nil {
+			return err
+		}
+		return s.saveUserGroups(ctx, tx, u.ID, u.Groups)
+	})
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id auth.UserID) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// Not relying on ON DELETE CASCADE alone, in case foreign keys are not enforced.
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_roles WHERE user_id = ?"), id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_groups WHERE user_id = ?"), id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_users WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return auth.ErrUserNotExist
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetUser(ctx context.Context, id auth.UserID) (*auth.User, error) {
+	return s.getUser(ctx, "SELECT id, name, data FROM auth_users WHERE id = ?", id)
+}
+
+func (s *Store) GetUserByName(ctx context.Context, name string) (*auth.User, error) {
+	return s.getUser(ctx, "SELECT id, name, data FROM auth_users WHERE name = ?", name)
+}
+
+func (s *Store) UsersWithRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, "SELECT user_id FROM auth_user_roles WHERE role_id = ? ORDER BY user_id", role)
+}
+
+// userIDs runs a query selecting a column of user IDs.
+func (s *Store) userIDs(ctx context.Context, query string, arg interface{}) ([]auth.UserID, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(query), arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []auth.UserID{}
+	for rows.Next() {
+		var id auth.UserID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		list = append(list, id)
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) ListUsers(ctx context.Context, q *auth.ListQuery) ([]*auth.User, error) {
+	query, args := s.listQuery("auth_users", q)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*auth.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	// Not while iterating, as some drivers cannot run queries with an open result set
+	for _, u := range list {
+		if err := s.loadUser(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (s *Store) getUser(ctx context.Context, query string, arg interface{}) (*auth.User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, s.d.rebind(query), arg))
+	if err == sql.ErrNoRows {
+		return nil, auth.ErrUserNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.loadUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func scanUser(row scanner) (*auth.User, error) {
+	var (
+		u    auth.User
+		data string
+	)
+	if err := row.Scan(&u.ID, &u.Name, &data); err != nil {
+		return nil, err
+	}
+	id, name := u.ID, u.Name
+	if err := json.Unmarshal([]byte(data), &userRecord{User: &u}); err != nil {
+		return nil, err
+	}
+	// The columns are authoritative
+	u.ID, u.Name = id, name
+	return &u, nil
+}
+
+// loadUser populates the role assignments and group memberships of a user.
+func (s *Store) loadUser(ctx context.Context, u *auth.User) error {
+	u.Roles = make(map[auth.RoleID]*auth.Role)
+	rows, err := s.db.QueryContext(ctx, s.d.rebind(`SELECT r.id, r.name, r.data FROM auth_roles r
+		JOIN auth_user_roles ur ON ur.role_id = r.id WHERE ur.user_id = ?`), u.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return err
+		}
+		u.Roles[r.ID] = r
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	u.Groups = nil
+	grows, err := s.db.QueryContext(ctx, s.d.rebind("SELECT group_id FROM auth_user_groups WHERE user_id = ? ORDER BY group_id"), u.ID)
+	if err != nil {
+		return err
+	}
+	defer grows.Close()
+	for grows.Next() {
+		var g auth.GroupID
+		if err := grows.Scan(&g); err != nil {
+			return err
+		}
+		u.Groups = append(u.Groups, g)
+	}
+	return grows.Err()
+}
+
+func (s *Store) saveUserRoles(ctx context.Context, tx *sql.Tx, user auth.UserID, roles map[auth.RoleID]*auth.Role) error {
+	for role := range roles {
+		_, err := tx.ExecContext(ctx, s.d.rebind("INSERT INTO auth_user_roles (user_id, role_id) VALUES (?, ?)"), user, role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) saveUserGroups(ctx context.Context, tx *sql.Tx, user auth.UserID, groups []auth.GroupID) error {
+	for _, group := range groups {
+		_, err := tx.ExecContext(ctx, s.d.rebind("INSERT INTO auth_user_groups (user_id, group_id) VALUES (?, ?)"), user, group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *-* Roles *-*
+
+func (s *Store) InsertRole(ctx context.Context, r *auth.Role) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_roles WHERE name = ?", r.Name); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrRoleExists
+		}
+		id, err := s.insert(ctx, tx, "auth_roles", int64(r.ID), r.Name, data)
+		if err != nil {
+			return s.mapUnique(err, auth.ErrRoleExists)
+		}
+		r.ID = auth.RoleID(id)
+		return nil
+	})
+}
+
+func (s *Store) UpdateRole(ctx context.Context, r *auth.Role) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_roles WHERE id = ?", r.ID); err != nil {
+			return err
+		} else if !exists {
+			return auth.ErrRoleNotExist
+		}
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_roles WHERE name = ? AND id <> ?", r.Name, r.ID); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrRoleExists
+		}
+		_, err := tx.ExecContext(ctx, s.d.rebind("UPDATE auth_roles SET name = ?, data = ? WHERE id = ?"), r.Name, string(data), r.ID)
+		return s.mapUnique(err, auth.ErrRoleExists)
+	})
+}
+
+func (s *Store) DeleteRole(ctx context.Context, id auth.RoleID) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_roles WHERE role_id = ?"), id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_roles WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return auth.ErrRoleNotExist
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetRole(ctx context.Context, id auth.RoleID) (*auth.Role, error) {
+	return s.getRole(ctx, "SELECT id, name, data FROM auth_roles WHERE id = ?", id)
+}
+
+func (s *Store) GetRoleByName(ctx context.Context, name string) (*auth.Role, error) {
+	return s.getRole(ctx, "SELECT id, name, data FROM auth_roles WHERE name = ?", name)
+}
+
+func (s *Store) ListRoles(ctx context.Context, q *auth.ListQuery) ([]*auth.Role, error) {
+	query, args := s.listQuery("auth_roles", q)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*auth.Role
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) getRole(ctx context.Context, query string, arg interface{}) (*auth.Role, error) {
+	r, err := scanRole(s.db.QueryRowContext(ctx, s.d.rebind(query), arg))
+	if err == sql.ErrNoRows {
+		return nil, auth.ErrRoleNotExist
+	}
+	return r, err
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRole(row scanner) (*auth.Role, error) {
+	var (
+		r    auth.Role
+		data string
+	)
+	if err := row.Scan(&r.ID, &r.Name, &data); err != nil {
+		return nil, err
+	}
+	id, name := r.ID, r.Name
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil, err
+	}
+	// The columns are authoritative
+	r.ID, r.Name = id, name
+	return &r, nil
+}
+
+// *-* Groups *-*
+
+func (s *Store) InsertGroup(ctx context.Context, g *auth.Group) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_groups WHERE name = ?", g.Name); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrGroupExists
+		}
+		id, err := s.insert(ctx, tx, "auth_groups", int64(g.ID), g.Name, data)
+		if err != nil {
+			return s.mapUnique(err, auth.ErrGroupExists)
+		}
+		g.ID = auth.GroupID(id)
+		return nil
+	})
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, g *auth.Group) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_groups WHERE id = ?", g.ID); err != nil {
+			return err
+		} else if !exists {
+			return auth.ErrGroupNotExist
+		}
+		if exists, err := s.exists(ctx, tx, "SELECT 1 FROM auth_groups WHERE name = ? AND id <> ?", g.Name, g.ID); err != nil {
+			return err
+		} else if exists {
+			return auth.ErrGroupExists
+		}
+		_, err := tx.ExecContext(ctx, s.d.rebind("UPDATE auth_groups SET name = ?, data = ? WHERE id = ?"), g.Name, string(data), g.ID)
+		return s.mapUnique(err, auth.ErrGroupExists)
+	})
+}
+
+func (s *Store) DeleteGroup(ctx context.Context, id auth.GroupID) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_user_groups WHERE group_id = ?"), id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.d.rebind("DELETE FROM auth_groups WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return auth.ErrGroupNotExist
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetGroup(ctx context.Context, id auth.GroupID) (*auth.Group, error) {
+	return s.getGroup(ctx, "SELECT id, name, data FROM auth_groups WHERE id = ?", id)
+}
+
+func (s *Store) GetGroupByName(ctx context.Context, name string) (*auth.Group, error) {
+	return s.getGroup(ctx, "SELECT id, name, data FROM auth_groups WHERE name = ?", name)
+}
+
+func (s *Store) GroupMembers(ctx context.Context, group auth.GroupID) ([]auth.UserID, error) {
+	return s.userIDs(ctx, "SELECT user_id FROM auth_user_groups WHERE group_id = ? ORDER BY user_id", group)
+}
+
+func (s *Store) getGroup(ctx context.Context, query string, arg interface{}) (*auth.Group, error) {
+	var (
+		g    auth.Group
+		data string
+	)
+	err := s.db.QueryRowContext(ctx, s.d.rebind(query), arg).Scan(&g.ID, &g.Name, &data)
+	if err == sql.ErrNoRows {
+		return nil, auth.ErrGroupNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	id, name := g.ID, g.Name
+	if err := json.Unmarshal([]byte(data), &g); err != nil {
+		return nil, err
+	}
+	// The columns are authoritative
+	g.ID, g.Name = id, name
+	return &g, nil
+}
+
+// Count implements auth.Counter.
+func (s *Store) Count(ctx context.Context) (auth.Counts, error) {
+	var c auth.Counts
+	err := s.db.QueryRowContext(ctx, `SELECT
+		(SELECT COUNT(*) FROM auth_users),
+		(SELECT COUNT(*) FROM auth_roles),
+		(SELECT COUNT(*) FROM auth_tokens)`).Scan(&c.Users, &c.Roles, &c.Tokens)
+	return c, err
+}
+
+// *-* Tokens *-*
+
+func (s *Store) InsertToken(ctx context.Context, t *auth.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.d.rebind("INSERT INTO auth_tokens (value, user_id, expires, data) VALUES (?, ?, ?, ?)"),
+		string(t.Value), t.User, t.Expires.UnixNano(), string(data))
+	return err
+}
+
+func (s *Store) GetToken(ctx context.Context, v auth.TokenValue) (*auth.Token, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, s.d.rebind("SELECT data FROM auth_tokens WHERE value = ?"), string(v)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, auth.ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	var t auth.Token
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *Store) DeleteToken(ctx context.Context, v auth.TokenValue) error {
+	_, err := s.db.ExecContext(ctx, s.d.rebind("DELETE FROM auth_tokens WHERE value = ?"), string(v))
+	return err
+}
+
+func (s *Store) UserTokens(ctx context.Context, user auth.UserID) ([]*auth.Token, error) {
+	rows, err := s.db.QueryContext(ctx, s.d.rebind("SELECT data FROM auth_tokens WHERE user_id = ?"), user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*auth.Token
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var t auth.Token
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, err
+		}
+		list = append(list, &t)
+	}
+	return list, rows.Err()
+}
+
+// *-* Helpers *-*
+
+func (s *Store) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) exists(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	var one int
+	err := tx.QueryRowContext(ctx, s.d.rebind(query), args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// insert adds a row to auth_users, auth_roles or auth_groups, and returns its ID.
+// If id is 0, the database generates one.
+func (s *Store) insert(ctx context.Context, tx *sql.Tx, table string, id int64, name string, data []byte) (int64, error) {
+	if id != 0 {
+		_, err := tx.ExecContext(ctx, s.d.rebind("INSERT INTO "+table+" (id, name, data) VALUES (?, ?, ?)"), id, name, string(data))
+		if err != nil {
+			return 0, err
+		}
+		if s.d.fixSequence != nil {
+			err = s.d.fixSequence(ctx, tx, table)
+		}
+		return id, err
+	}
+
+	query := s.d.rebind("INSERT INTO " + table + " (name, data) VALUES (?, ?)")
+	if s.d.returning {
+		err := tx.QueryRowContext(ctx, query+" RETURNING id", name, string(data)).Scan(&id)
+		return id, err
+	}
+	res, err := tx.ExecContext(ctx, query, name, string(data))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// listQuery builds the SELECT statement of a page of auth_users or auth_roles.
+func (s *Store) listQuery(table string, q *auth.ListQuery) (string, []interface{}) {
+	var (
+		where []string
+		args  []interface{}
+		col   = "id"
+		op    = ">"
+		order = "ASC"
+	)
+	if q.Prefix != "" {
+		where = append(where, "name LIKE ? ESCAPE '!'")
+		args = append(args, likeEscaper.Replace(q.Prefix)+"%")
+	}
+	if q.SortBy == auth.SortByName {
+		col = "name"
+	}
+	if q.Desc {
+		op, order = "<", "DESC"
+	}
+	if q.After != nil {
+		where = append(where, col+" "+op+" ?")
+		if q.SortBy == auth.SortByName {
+			args = append(args, q.After.Name)
+		} else {
+			args = append(args, q.After.ID)
+		}
+	}
+	query := "SELECT id, name, data FROM " + table
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + col + " " + order + " LIMIT ?"
+	args = append(args, q.Limit)
+	return s.d.rebind(query), args
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, with ! as the escape character. Backslash
+// is avoided, as MySQL and PostgreSQL disagree on escaping it in string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// mapUnique translates unique constraint violations (caused by concurrent inserts from another
+// process) into the given error.
+func (s *Store) mapUnique(err, to error) error {
+	if err != nil && s.d.uniqueViolation(err) {
+		return to
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	for _, store := range []Storage{NewMemoryStorage(), listOnlyStorage{NewMemoryStorage()}} {
+		clock := NewManualClock(time.Unix(1700000000, 0))
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 1800}), WithStorage(store), WithClock(clock), WithHasher(fastHasher))
+		svr.CreateUser("elton", "123456")
+		svr.CreateUser("anna", "passw0rd")
+		svr.CreateRole("scanner")
+		svr.Authenticate("elton", "123456")
+		{
+			st, err := svr.Stats()
+			assert.Equal(t, nil, err, "should success")
+			assert.Equal(t, [2]int64{2, 1}, [2]int64{st.Users, st.Roles}, "should count the entities")
+			assert.Equal(t, 1, st.ActiveTokens, "should count the active tokens")
+			assert.Equal(t, 0, st.PendingPrune, "should have nothing to prune")
+			n, _ := svr.GetUserCount()
+			assert.Equal(t, int64(2), n, "should count the users")
+			n, _ = svr.GetRoleCount()
+			assert.Equal(t, int64(1), n, "should count the roles")
+		}
+		{
+			clock.Advance(31 * time.Minute)
+			st, _ := svr.Stats()
+			assert.Equal(t, 31*time.Minute, st.Uptime, "should tell the uptime")
+			assert.Equal(t, [2]int{0, 1}, [2]int{st.ActiveTokens, st.PendingPrune}, "should count expired tokens until pruned")
+		}
+	}
+	{
+		svr, _ := New(WithStorage(listOnlyStorage{NewMemoryStorage()}))
+		st, _ := svr.Stats()
+		assert.Equal(t, int64(-1), st.Tokens, "should not count tokens without a Counter")
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+// AuthLevel tells how strongly the user of a token authenticated, see StepUp.
+type AuthLevel uint8
+
+const (
+	AuthPassword AuthLevel = iota // one factor: a password, an Authenticator or IssueToken
+	AuthMFA                       // a password and a TOTP or recovery code, see CompleteMFA
+)
+
+// StepUp demands a stronger or more recent authentication for sensitive permissions, such as
+// changing an email address or paying: CheckPermission fails with ErrStepUpRequired, instead of
+// granting a permission matching Permission, to tokens that fall short of Level or MaxAgeSec. The
+// client should then have the user log in again, e.g. through MFA, and retry with the new token.
+type StepUp struct {
+	// Permission is matched against the checked permissions as if granted, so "billing:*" covers
+	// "billing:refund".
+	Permission string
+	// Level is the lowest AuthLevel accepted.
+	Level AuthLevel
+	// MaxAgeSec, if positive, is how long ago the user may have authenticated. Using or extending
+	// a token does not count as authenticating. API keys never authenticated recently.
+	MaxAgeSec int32
+}
+
+var ErrStepUpRequired = newError("step_up_required", http.StatusUnauthorized, "step-up authentication required")
+
+// authn tells how the user of a token authenticated.
+type authn struct {
+	level AuthLevel
+	at    time.Time // zero for API keys
+}
+
+// authn tells how the user of a session token authenticated. Tokens without an AuthTime were
+// authenticated when issued.
+func (t *Token) authn() authn {
+	at := t.AuthTime
+	if at.IsZero() {
+		at = t.Issued
+	}
+	return authn{level: t.Level, at: at}
+}
+
+// validStepUp checks the StepUp rules of a config.
+func validStepUp(rules []StepUp) bool {
+	for _, rule := range rules {
+		if validatePermission(rule.Permission) != nil || rule.Level > AuthMFA || rule.MaxAgeSec < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkStepUp verifies that a token authenticated as the StepUp rules matching a permission demand.
+//
+// Errors: ErrStepUpRequired
+func (s *Server) checkStepUp(a authn, perm string) error {
+	now := s.now()
+	for _, rule := range s.cfg.StepUp {
+		if !matchPermission(rule.Permission, perm) {
+			continue
+		}
+		if a.level < rule.Level {
+			return ErrStepUpRequired
+		}
+		if rule.MaxAgeSec > 0 && (a.at.IsZero() || now.Sub(a.at) > time.Duration(rule.MaxAgeSec)*time.Second) {
+			return ErrStepUpRequired
+		}
+	}
+	return nil
+}
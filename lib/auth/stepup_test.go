@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepUpLevel(t *testing.T) {
+	cfg := &ServerConfig{TokenExpireSec: 3600, StepUp: []StepUp{{Permission: "billing:*", Level: AuthMFA}}}
+	svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("accountant")
+	svr.GrantPermissionToRole(rid, "billing:refund")
+	svr.GrantPermissionToRole(rid, "orders:read")
+	svr.AddRoleToUser(uid, rid)
+	password, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		ok, err := svr.CheckPermission(password, "billing:refund")
+		assert.Equal(t, ErrStepUpRequired, err, "should demand MFA")
+		assert.Equal(t, false, ok, "should not grant the permission")
+		ok, err = svr.CheckPermission(password, "orders:read")
+		assert.Equal(t, true, ok, "should grant the other permissions")
+		_, err = svr.CheckPermission(password, "billing:delete")
+		assert.Equal(t, nil, err, "should not demand MFA for permissions not granted")
+		assert.Equal(t, "step_up_required", ErrorClass(ErrStepUpRequired), "should be step_up_required")
+	}
+	{
+		e, _ := svr.EnrollTOTP(uid)
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod))
+		challenge, _ := svr.Authenticate("anna", "passw0rd")
+		token, _ := svr.CompleteMFA(challenge, e.RecoveryCodes[0])
+		ok, err := svr.CheckPermission(token, "billing:refund")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should grant the permission after MFA")
+		in, _ := svr.Introspect(token)
+		assert.Equal(t, AuthMFA, in.AuthLevel, "should introspect the level")
+	}
+}
+
+func TestStepUpMaxAge(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	cfg := &ServerConfig{TokenExpireSec: 3600, TokenMaxLifetimeSec: 7200, ImpersonatePermission: "users:impersonate",
+		StepUp: []StepUp{{Permission: "users:delete", MaxAgeSec: 300}}}
+	svr, _ := New(WithConfig(cfg), WithClock(clock), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	elton, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	svr.GrantPermissionToRole(rid, "users:*")
+	svr.AddRoleToUser(uid, rid)
+	clerk, _ := svr.CreateRole("clerk")
+	svr.GrantPermissionToRole(clerk, "users:delete")
+	svr.AddRoleToUser(elton, clerk)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	key, _ := svr.CreateAPIKey(uid, "ci", nil, time.Time{})
+	{
+		ok, _ := svr.CheckPermission(token, "users:delete")
+		assert.Equal(t, true, ok, "should grant the permission to fresh logins")
+		_, err := svr.CheckPermission(key, "users:delete")
+		assert.Equal(t, ErrStepUpRequired, err, "should not take API keys as fresh")
+	}
+	{
+		clock.Advance(301 * time.Second)
+		_, err := svr.CheckPermission(token, "users:delete")
+		assert.Equal(t, ErrStepUpRequired, err, "should demand a new login")
+		ok, _ := svr.CheckPermission(token, "users:list")
+		assert.Equal(t, true, ok, "should keep the token working")
+		clock.Advance(3000 * time.Second)
+		_, err = svr.CheckPermission(token, "users:delete")
+		assert.Equal(t, ErrStepUpRequired, err, "should not refresh the login when the token is extended")
+		token, _ = svr.Authenticate("anna", "passw0rd")
+		ok, _ = svr.CheckPermission(token, "users:delete")
+		assert.Equal(t, true, ok, "should grant the permission after logging in again")
+	}
+	{
+		imp, _ := svr.Impersonate(token, elton, ClientInfo{})
+		ok, _ := svr.CheckPermission(imp, "users:delete")
+		assert.Equal(t, true, ok, "should authenticate impersonation like the admin token")
+		clock.Advance(301 * time.Second)
+		_, err := svr.CheckPermission(imp, "users:delete")
+		assert.Equal(t, ErrStepUpRequired, err, "should keep the auth time of the admin token")
+	}
+	{
+		for _, rule := range []StepUp{{Permission: "users::delete"}, {Permission: "users:delete", Level: AuthMFA + 1},
+			{Permission: "users:delete", MaxAgeSec: -1}} {
+			_, err := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, StepUp: []StepUp{rule}})
+			assert.Equal(t, ErrInvalidConfig, err, "should reject invalid rules")
+		}
+	}
+}
+
+func TestStepUpJWT(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	cfg := &ServerConfig{TokenExpireSec: 3600, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("secret")},
+		StepUp: []StepUp{{Permission: "users:delete", MaxAgeSec: 300}}}
+	svr, _ := New(WithConfig(cfg), WithClock(clock), WithHasher(fastHasher))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("admin")
+	svr.GrantPermissionToRole(rid, "users:delete")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	ok, _ := svr.CheckPermission(token, "users:delete")
+	assert.Equal(t, true, ok, "should grant the permission to fresh logins")
+	clock.Advance(301 * time.Second)
+	_, err := svr.CheckPermission(token, "users:delete")
+	assert.Equal(t, ErrStepUpRequired, err, "should read the auth time of the claims")
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+)
+
+// Storage is the persistence backend of a Server.
+// The server implements all the auth logic (hashing, token lifecycle, permission checks) on top of
+// it, so a backend only has to save and look up entities.
+//
+// Objects passed to and returned from a Storage are treated as immutable by the server: it never
+// modifies an object after handing it over, and it always clones an object before modifying it.
+// Implementations are free to return their internal copies.
+//
+// All methods must be safe for concurrent use. The server serializes calls that must be atomic
+// with each other (such as a lookup followed by an insert), so a backend does not need transactions
+// spanning multiple calls.
+type Storage interface {
+	UserStore
+	RoleStore
+	GroupStore
+	TokenStore
+}
+
+type UserStore interface {
+	// InsertUser saves a new user. If u.ID is 0, the store assigns a new ID and writes it back to u.
+	// Errors: ErrUserExists
+	InsertUser(ctx context.Context, u *User) error
+	// UpdateUser replaces a saved user, including its role assignments.
+	// Errors: ErrUserNotExist, ErrUserExists (if the new name is taken)
+	UpdateUser(ctx context.Context, u *User) error
+	// DeleteUser removes a user.
+	// Errors: ErrUserNotExist
+	DeleteUser(ctx context.Context, id UserID) error
+	// GetUser and GetUserByName look up a user, with its Roles populated.
+	// Errors: ErrUserNotExist
+	GetUser(ctx context.Context, id UserID) (*User, error)
+	GetUserByName(ctx context.Context, name string) (*User, error)
+	// UsersWithRole lists the IDs of the users holding a role, in ascending order.
+	// It should be backed by an index rather than a scan of all users.
+	UsersWithRole(ctx context.Context, role RoleID) ([]UserID, error)
+	// ListUsers lists the users of a page, with their Roles populated, in the sort order of the
+	// query and at most q.Limit of them. See ListQuery.Match for the filtering rules.
+	ListUsers(ctx context.Context, q *ListQuery) ([]*User, error)
+}
+
+type RoleStore interface {
+	// InsertRole saves a new role. If r.ID is 0, the store assigns a new ID and writes it back to r.
+	// Errors: ErrRoleExists
+	InsertRole(ctx context.Context, r *Role) error
+	// UpdateRole replaces a saved role.
+	// Errors: ErrRoleNotExist, ErrRoleExists (if the new name is taken)
+	UpdateRole(ctx context.Context, r *Role) error
+	// DeleteRole removes a role.
+	// Errors: ErrRoleNotExist
+	DeleteRole(ctx context.Context, id RoleID) error
+	// GetRole and GetRoleByName look up a role.
+	// Errors: ErrRoleNotExist
+	GetRole(ctx context.Context, id RoleID) (*Role, error)
+	GetRoleByName(ctx context.Context, name string) (*Role, error)
+	// ListRoles lists the roles of a page, like ListUsers.
+	ListRoles(ctx context.Context, q *ListQuery) ([]*Role, error)
+}
+
+type GroupStore interface {
+	// InsertGroup saves a new group. If g.ID is 0, the store assigns a new ID and writes it back to g.
+	// Errors: ErrGroupExists
+	InsertGroup(ctx context.Context, g *Group) error
+	// UpdateGroup replaces a saved group.
+	// Errors: ErrGroupNotExist, ErrGroupExists (if the new name is taken)
+	UpdateGroup(ctx context.Context, g *Group) error
+	// DeleteGroup removes a group. Users may keep the ID in User.Groups, which the server ignores.
+	// Errors: ErrGroupNotExist
+	DeleteGroup(ctx context.Context, id GroupID) error
+	// GetGroup and GetGroupByName look up a group.
+	// Errors: ErrGroupNotExist
+	GetGroup(ctx context.Context, id GroupID) (*Group, error)
+	GetGroupByName(ctx context.Context, name string) (*Group, error)
+	// GroupMembers lists the IDs of the users in a group (see User.Groups), in ascending order.
+	// It should be backed by an index rather than a scan of all users.
+	GroupMembers(ctx context.Context, group GroupID) ([]UserID, error)
+}
+
+type TokenStore interface {
+	// InsertToken saves a new token.
+	InsertToken(ctx context.Context, t *Token) error
+	// GetToken looks up a token. Expiry is checked by the server, not the store.
+	// Errors: ErrInvalidToken
+	GetToken(ctx context.Context, v TokenValue) (*Token, error)
+	// DeleteToken removes a token. It is a no-op if the token does not exist.
+	DeleteToken(ctx context.Context, v TokenValue) error
+	// UserTokens lists the tokens of a user, in any order. Expired tokens may be included.
+	// It should be backed by an index rather than a scan of all tokens: it is used to revoke the
+	// tokens of a user, e.g. when it is deleted or suspended, and to list its sessions.
+	UserTokens(ctx context.Context, user UserID) ([]*Token, error)
+}
+
+// Counter is optionally implemented by a Storage that can count its entities cheaply.
+// It is used by Server.Metrics.
+type Counter interface {
+	Count(ctx context.Context) (Counts, error)
+}
+
+// EmailFinder is optionally implemented by a Storage that indexes the users by email, see
+// Server.SetUserEmail. Emails are saved normalized, so they are looked up as they are. Without it,
+// the server lists the users to find an email.
+type EmailFinder interface {
+	// GetUserByEmail finds the user having an email, including soft-deleted ones.
+	// Errors: ErrUserNotExist
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+}
+
+// RoleFinder is optionally implemented by a Storage that indexes the groups having each role, and
+// the users holding it on resources (see User.ResourceRoles), for Server.DeleteRole to take the role
+// away from them. Without it, they keep the ID of a deleted role, which the server ignores.
+type RoleFinder interface {
+	// GroupsWithRole lists the IDs of the groups having a role, in ascending order.
+	GroupsWithRole(ctx context.Context, role RoleID) ([]GroupID, error)
+	// UsersWithResourceRole lists the IDs of the users holding a role on resources, including
+	// soft-deleted ones, in ascending order.
+	UsersWithResourceRole(ctx context.Context, role RoleID) ([]UserID, error)
+}
+
+// ChangeNotifier is optionally implemented by a Storage shared by several servers that can tell when
+// any of them changes it, such as the etcd store. The server then empties its decision cache (see
+// ServerConfig.DecisionCacheSec), which otherwise misses the changes made by the other servers.
+type ChangeNotifier interface {
+	// NotifyChanges calls fn after changes to the storage, by this server or another one, until the
+	// storage is closed. Calls may be coalesced, and fn must not block for long.
+	NotifyChanges(fn func())
+}
+
+// Counts are the numbers of entities in a Storage.
+type Counts struct {
+	Users  int64
+	Roles  int64
+	Tokens int64
+}
@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Kinds of entries of a storageCache
+const (
+	cacheUser byte = iota
+	cacheRole
+	cacheGroup
+	cacheToken
+)
+
+// cacheKey identifies an entry of a storageCache: an entity by ID, a token by value (in name), or
+// the ID of an entity by name (with a zero id, which no entity has).
+type cacheKey struct {
+	kind byte
+	id   int64
+	name string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+}
+
+// storageCache keeps the users, roles, groups and tokens last read from the storage, see
+// ServerConfig.StorageCacheSize. Names are mapped to IDs, which are checked against the entity found,
+// so that renames need not drop them.
+//
+// Like the decision cache, gen counts the changes, so that a value read before one is not cached
+// after it, when the read races with a write.
+type storageCache struct {
+	size int
+
+	mu      sync.Mutex
+	gen     uint64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+func newStorageCache(size int) *storageCache {
+	return &storageCache{size: size, lru: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+func (c *storageCache) get(k cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// generation tells the number of changes, to pass to put.
+func (c *storageCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches a value read since generation gen. It is dropped if something changed in between. A
+// full cache evicts its least recently used entry.
+func (c *storageCache) put(k cacheKey, v interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*cacheEntry).value = v
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{key: k, value: v})
+}
+
+// drop forgets an entry that changed.
+func (c *storageCache) drop(k cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.entries[k]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, k)
+	}
+}
+
+// dropKind forgets the entries of a kind, such as all the users, whose populated Roles change with
+// a role.
+func (c *storageCache) dropKind(kind byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for k, e := range c.entries {
+		if k.kind == kind {
+			c.lru.Remove(e)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// invalidate forgets everything, when another server changed the storage.
+func (c *storageCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if c.lru.Len() > 0 {
+		c.lru.Init()
+		c.entries = make(map[cacheKey]*list.Element)
+	}
+}
+
+// *-* Storage *-*
+
+// cachedStore answers the lookups of users, roles, groups and tokens by ID, name or value from its
+// cache. Writes go through to the storage, and then drop what they may have changed. Lists and the
+// indexes are not cached.
+type cachedStore struct {
+	Storage
+	cache   *storageCache
+	metrics *serverMetrics
+}
+
+// lookup reads an entry from the cache, or calls read and caches its result.
+func (c *cachedStore) lookup(k cacheKey, read func() (interface{}, error)) (interface{}, error) {
+	if v, ok := c.cache.get(k); ok {
+		atomic.AddUint64(&c.metrics.storageHits, 1)
+		return v, nil
+	}
+	atomic.AddUint64(&c.metrics.storageMisses, 1)
+	gen := c.cache.generation()
+	v, err := read()
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(k, v, gen)
+	return v, nil
+}
+
+// named is the ID and name of an entity found by name: the name is checked, as an entity may have
+// been renamed since its ID was cached.
+type named interface {
+	key() (int64, string)
+}
+
+func (u *User) key() (int64, string)  { return int64(u.ID), u.Name }
+func (r *Role) key() (int64, string)  { return int64(r.ID), r.Name }
+func (g *Group) key() (int64, string) { return int64(g.ID), g.Name }
+
+// lookupName finds an entity of a kind by name, through its cached ID if any. byID looks it up by
+// ID (through the cache), byName in the storage.
+func (c *cachedStore) lookupName(kind byte, name string, byID func(id int64) (named, error), byName func() (named, error)) (named, error) {
+	k := cacheKey{kind: kind, name: name}
+	if id, ok := c.cache.get(k); ok {
+		if v, err := byID(id.(int64)); err == nil {
+			if _, n := v.key(); n == name {
+				return v, nil
+			}
+		}
+		// Renamed or deleted since
+		c.cache.drop(k)
+	}
+	atomic.AddUint64(&c.metrics.storageMisses, 1)
+	gen := c.cache.generation()
+	v, err := byName()
+	if err != nil {
+		return nil, err
+	}
+	id, _ := v.key()
+	c.cache.put(cacheKey{kind: kind, id: id}, v, gen)
+	c.cache.put(k, id, gen)
+	return v, nil
+}
+
+func (c *cachedStore) UpdateUser(ctx context.Context, u *User) error {
+	defer c.cache.drop(cacheKey{kind: cacheUser, id: int64(u.ID)})
+	return c.Storage.UpdateUser(ctx, u)
+}
+
+func (c *cachedStore) DeleteUser(ctx context.Context, id UserID) error {
+	defer c.cache.drop(cacheKey{kind: cacheUser, id: int64(id)})
+	return c.Storage.DeleteUser(ctx, id)
+}
+
+func (c *cachedStore) GetUser(ctx context.Context, id UserID) (*User, error) {
+	v, err := c.lookup(cacheKey{kind: cacheUser, id: int64(id)}, func() (interface{}, error) {
+		return c.Storage.GetUser(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*User), nil
+}
+
+func (c *cachedStore) GetUserByName(ctx context.Context, name string) (*User, error) {
+	v, err := c.lookupName(cacheUser, name, func(id int64) (named, error) {
+		return c.GetUser(ctx, UserID(id))
+	}, func() (named, error) {
+		return c.Storage.GetUserByName(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*User), nil
+}
+
+// UpdateRole drops every cached user too, as they hold the roles they have.
+func (c *cachedStore) UpdateRole(ctx context.Context, r *Role) error {
+	defer c.cache.dropKind(cacheUser)
+	defer c.cache.drop(cacheKey{kind: cacheRole, id: int64(r.ID)})
+	return c.Storage.UpdateRole(ctx, r)
+}
+
+// DeleteRole drops every cached user and group too, as the storage may take the role away from them.
+func (c *cachedStore) DeleteRole(ctx context.Context, id RoleID) error {
+	defer c.cache.dropKind(cacheGroup)
+	defer c.cache.dropKind(cacheUser)
+	defer c.cache.drop(cacheKey{kind: cacheRole, id: int64(id)})
+	return c.Storage.DeleteRole(ctx, id)
+}
+
+func (c *cachedStore) GetRole(ctx context.Context, id RoleID) (*Role, error) {
+	v, err := c.lookup(cacheKey{kind: cacheRole, id: int64(id)}, func() (interface{}, error) {
+		return c.Storage.GetRole(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Role), nil
+}
+
+func (c *cachedStore) GetRoleByName(ctx context.Context, name string) (*Role, error) {
+	v, err := c.lookupName(cacheRole, name, func(id int64) (named, error) {
+		return c.GetRole(ctx, RoleID(id))
+	}, func() (named, error) {
+		return c.Storage.GetRoleByName(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Role), nil
+}
+
+func (c *cachedStore) UpdateGroup(ctx context.Context, g *Group) error {
+	defer c.cache.drop(cacheKey{kind: cacheGroup, id: int64(g.ID)})
+	return c.Storage.UpdateGroup(ctx, g)
+}
+
+// DeleteGroup drops every cached user too, as the storage may remove the members from the group.
+func (c *cachedStore) DeleteGroup(ctx context.Context, id GroupID) error {
+	defer c.cache.dropKind(cacheUser)
+	defer c.cache.drop(cacheKey{kind: cacheGroup, id: int64(id)})
+	return c.Storage.DeleteGroup(ctx, id)
+}
+
+func (c *cachedStore) GetGroup(ctx context.Context, id GroupID) (*Group, error) {
+	v, err := c.lookup(cacheKey{kind: cacheGroup, id: int64(id)}, func() (interface{}, error) {
+		return c.Storage.GetGroup(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Group), nil
+}
+
+func (c *cachedStore) GetGroupByName(ctx context.Context, name string) (*Group, error) {
+	v, err := c.lookupName(cacheGroup, name, func(id int64) (named, error) {
+		return c.GetGroup(ctx, GroupID(id))
+	}, func() (named, error) {
+		return c.Storage.GetGroupByName(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Group), nil
+}
+
+// InsertToken drops the token, in case it replaces a saved one.
+func (c *cachedStore) InsertToken(ctx context.Context, t *Token) error {
+	defer c.cache.drop(cacheKey{kind: cacheToken, name: string(t.Value)})
+	return c.Storage.InsertToken(ctx, t)
+}
+
+func (c *cachedStore) GetToken(ctx context.Context, v TokenValue) (*Token, error) {
+	t, err := c.lookup(cacheKey{kind: cacheToken, name: string(v)}, func() (interface{}, error) {
+		return c.Storage.GetToken(ctx, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.(*Token), nil
+}
+
+func (c *cachedStore) DeleteToken(ctx context.Context, v TokenValue) error {
+	defer c.cache.drop(cacheKey{kind: cacheToken, name: string(v)})
+	return c.Storage.DeleteToken(ctx, v)
+}
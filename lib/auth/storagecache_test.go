@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage is a persistent storage, as far as the server knows, that counts the lookups of
+// users and tokens.
+type countingStorage struct {
+	Storage
+	users, tokens int
+}
+
+func (c *countingStorage) GetUser(ctx context.Context, id UserID) (*User, error) {
+	c.users++
+	return c.Storage.GetUser(ctx, id)
+}
+
+func (c *countingStorage) GetToken(ctx context.Context, v TokenValue) (*Token, error) {
+	c.tokens++
+	return c.Storage.GetToken(ctx, v)
+}
+
+func TestStorageCache(t *testing.T) {
+	store := &countingStorage{Storage: NewMemoryStorage()}
+	svr, err := New(WithStorage(store), WithHasher(fastHasher), WithStorageCache(100))
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "123456")
+	{
+		svr.CheckRole(token, rid)
+		users, tokens := store.users, store.tokens
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should have the role")
+		assert.Equal(t, users, store.users, "should read the users from the cache")
+		assert.Equal(t, tokens, store.tokens, "should read the tokens from the cache")
+		m, _ := svr.Metrics()
+		assert.Equal(t, true, m.StorageCacheHits > 0, "should count the hits")
+	}
+	{
+		svr.GrantPermissionToRole(rid, "orders:read")
+		ok, _ := svr.CheckPermission(token, "orders:read")
+		assert.Equal(t, true, ok, "should drop the users on changes of their roles")
+		svr.RemoveRoleFromUser(uid, rid)
+		ok, _ = svr.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should drop changed users")
+		svr.Invalidate(token)
+		_, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should drop deleted tokens")
+	}
+	{
+		svr.GetUserByName("elton")
+		svr.UpdateUserName(uid, "fred")
+		assert.Equal(t, (*User)(nil), svr.GetUserByName("elton"), "should not find users by their old names")
+		other, _ := svr.CreateUser("elton", "123456")
+		assert.Equal(t, other, svr.GetUserByName("elton").ID, "should find the new owners of names")
+		assert.Equal(t, uid, svr.GetUserByName("fred").ID, "should find users by their new names")
+	}
+	{
+		_, err := New(WithHasher(fastHasher), WithStorageCache(100))
+		assert.Equal(t, ErrInvalidConfig, err, "should reject a MemoryStorage")
+		_, err = New(WithStorage(store), WithStorageCache(-1))
+		assert.Equal(t, ErrInvalidConfig, err, "should reject negative sizes")
+	}
+}
+
+func TestStorageCacheNotifier(t *testing.T) {
+	store := &notifyingStorage{MemoryStorage: NewMemoryStorage()}
+	cfg := &ServerConfig{TokenExpireSec: 60, StorageCacheSize: 100, Hasher: fastHasher}
+	a, _ := NewServer(cfg, store)
+	b, _ := NewServer(cfg, store)
+	uid, _ := a.CreateUser("elton", "123456")
+	rid, _ := a.CreateRole("admin")
+	token, _ := a.Authenticate("elton", "123456")
+	{
+		ok, _ := b.CheckRole(token, rid)
+		assert.Equal(t, false, ok, "should not have the role")
+		a.AddRoleToUser(uid, rid)
+		ok, _ = b.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should drop the cache on the changes of other servers")
+	}
+}
+
+func TestStorageCacheEviction(t *testing.T) {
+	c := newStorageCache(2)
+	key := func(id int64) cacheKey { return cacheKey{kind: cacheUser, id: id} }
+	gen := c.generation()
+	c.put(key(1), "a", gen)
+	c.put(key(2), "b", gen)
+	c.get(key(1))
+	c.put(key(3), "c", gen)
+	_, ok := c.get(key(2))
+	assert.Equal(t, false, ok, "should evict the least recently used entry")
+	v, _ := c.get(key(1))
+	assert.Equal(t, "a", v, "should keep recently used entries")
+	c.drop(key(4))
+	c.put(key(2), "b", gen)
+	_, ok = c.get(key(2))
+	assert.Equal(t, false, ok, "should not cache values read before a change")
+	c.invalidate()
+	_, ok = c.get(key(3))
+	assert.Equal(t, false, ok, "should empty on invalidation")
+}
@@ -0,0 +1,14 @@
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// TestMemory runs the suite against the reference implementation, which defines the semantics.
+func TestMemory(t *testing.T) {
+	Run(t, func(t *testing.T) auth.Storage {
+		return auth.NewMemoryStorage()
+	})
+}
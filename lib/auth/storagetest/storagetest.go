@@ -0,0 +1,487 @@
+// Package storagetest is a conformance suite for implementations of auth.Storage. A backend runs it
+// from its own tests, to prove that it keeps the semantics that the server relies on:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) auth.Storage {
+//			s, err := mystore.Open(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { s.Close() })
+//			return s
+//		})
+//	}
+//
+// What the interface leaves open is not checked. In particular, users may or may not keep referring
+// to a deleted role or group (MemoryStorage does, the SQL store does not); it is only checked that
+// doing so is harmless, as the IDs of deleted entities are never reused.
+//
+// The optional interfaces auth.Counter and ExpiredTokenDeleter are checked if implemented.
+package storagetest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// NewStore gives an empty store for a test. It is called once for every test, and should release
+// the store with t.Cleanup.
+type NewStore func(t *testing.T) auth.Storage
+
+// ExpiredTokenDeleter is optionally implemented by a Storage that can remove expired tokens in bulk,
+// like the SQL and Bolt stores.
+type ExpiredTokenDeleter interface {
+	// DeleteExpiredTokens removes all tokens that expired before the given time.
+	// It gives the number of tokens removed.
+	DeleteExpiredTokens(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Run runs the whole suite against the stores given by newStore, each test as a subtest of t.
+//
+// Returns: none
+// Errors: none (failures are reported to t)
+func Run(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s auth.Storage)
+	}{
+		{"Users", testUsers},
+		{"Roles", testRoles},
+		{"Groups", testGroups},
+		{"Assignments", testAssignments},
+		{"Cascade", testCascade},
+		{"Listing", testListing},
+		{"Tokens", testTokens},
+		{"Count", testCount},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+// must stops a test at a failed setup step, after which the checks would only report noise.
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// *-* Named entities *-*
+
+// named abstracts over users, roles and groups, which share the rules of IDs and unique names.
+type named struct {
+	insert    func(id int64, name string) (int64, error)
+	rename    func(id int64, name string) error
+	remove    func(id int64) error
+	get       func(id int64) (string, error)
+	getByName func(name string) (int64, error)
+
+	errExists, errNotExist error
+}
+
+func testNamed(t *testing.T, n *named) {
+	{
+		anna, err := n.insert(0, "anna")
+		assert.Equal(t, nil, err, "should success")
+		assert.NotEqual(t, int64(0), anna, "should assign an ID")
+		_, err = n.insert(0, "anna")
+		assert.Equal(t, n.errExists, err, "should reject taken names")
+		_, err = n.insert(anna, "belle")
+		assert.Equal(t, n.errExists, err, "should reject taken IDs")
+		preset, err := n.insert(anna+10, "belle")
+		assert.Equal(t, nil, err, "should accept a preset ID")
+		assert.Equal(t, anna+10, preset, "should keep a preset ID")
+		cara, err := n.insert(0, "cara")
+		must(t, err)
+		assert.Equal(t, true, cara > preset, "should assign IDs after a preset one")
+
+		name, err := n.get(preset)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "belle", name, "should find by ID")
+		id, err := n.getByName("anna")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, anna, id, "should find by name")
+		_, err = n.get(cara + 100)
+		assert.Equal(t, n.errNotExist, err, "should not find unknown IDs")
+		_, err = n.getByName("dora")
+		assert.Equal(t, n.errNotExist, err, "should not find unknown names")
+	}
+	{
+		cara, _ := n.getByName("cara")
+		assert.Equal(t, n.errExists, n.rename(cara, "anna"), "should reject renaming to a taken name")
+		assert.Equal(t, nil, n.rename(cara, "cara"), "should accept keeping the name")
+		assert.Equal(t, nil, n.rename(cara, "cora"), "should rename")
+		_, err := n.getByName("cara")
+		assert.Equal(t, n.errNotExist, err, "should forget the old name")
+		id, _ := n.getByName("cora")
+		assert.Equal(t, cara, id, "should find by the new name")
+		assert.Equal(t, n.errNotExist, n.rename(cara+100, "dora"), "should reject unknown IDs")
+
+		assert.Equal(t, nil, n.remove(cara), "should success")
+		assert.Equal(t, n.errNotExist, n.remove(cara), "should reject unknown IDs")
+		_, err = n.get(cara)
+		assert.Equal(t, n.errNotExist, err, "should not find deleted entities by ID")
+		_, err = n.getByName("cora")
+		assert.Equal(t, n.errNotExist, err, "should not find deleted entities by name")
+		dora, err := n.insert(0, "cora")
+		assert.Equal(t, nil, err, "should free the names of deleted entities")
+		assert.Equal(t, true, dora > cara, "should not reuse the IDs of deleted entities")
+	}
+}
+
+func testUsers(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	testNamed(t, &named{
+		insert: func(id int64, name string) (int64, error) {
+			u := &auth.User{ID: auth.UserID(id), Name: name}
+			err := s.InsertUser(ctx, u)
+			return int64(u.ID), err
+		},
+		rename: func(id int64, name string) error {
+			u := &auth.User{ID: auth.UserID(id), Name: name}
+			if old, err := s.GetUser(ctx, u.ID); err == nil {
+				*u = *old
+				u.Name = name
+			}
+			return s.UpdateUser(ctx, u)
+		},
+		remove: func(id int64) error {
+			return s.DeleteUser(ctx, auth.UserID(id))
+		},
+		get: func(id int64) (string, error) {
+			u, err := s.GetUser(ctx, auth.UserID(id))
+			if err != nil {
+				return "", err
+			}
+			return u.Name, nil
+		},
+		getByName: func(name string) (int64, error) {
+			u, err := s.GetUserByName(ctx, name)
+			if err != nil {
+				return 0, err
+			}
+			return int64(u.ID), nil
+		},
+		errExists:   auth.ErrUserExists,
+		errNotExist: auth.ErrUserNotExist,
+	})
+}
+
+func testRoles(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	testNamed(t, &named{
+		insert: func(id int64, name string) (int64, error) {
+			r := &auth.Role{ID: auth.RoleID(id), Name: name}
+			err := s.InsertRole(ctx, r)
+			return int64(r.ID), err
+		},
+		rename: func(id int64, name string) error {
+			return s.UpdateRole(ctx, &auth.Role{ID: auth.RoleID(id), Name: name})
+		},
+		remove: func(id int64) error {
+			return s.DeleteRole(ctx, auth.RoleID(id))
+		},
+		get: func(id int64) (string, error) {
+			r, err := s.GetRole(ctx, auth.RoleID(id))
+			if err != nil {
+				return "", err
+			}
+			return r.Name, nil
+		},
+		getByName: func(name string) (int64, error) {
+			r, err := s.GetRoleByName(ctx, name)
+			if err != nil {
+				return 0, err
+			}
+			return int64(r.ID), nil
+		},
+		errExists:   auth.ErrRoleExists,
+		errNotExist: auth.ErrRoleNotExist,
+	})
+}
+
+func testGroups(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	testNamed(t, &named{
+		insert: func(id int64, name string) (int64, error) {
+			g := &auth.Group{ID: auth.GroupID(id), Name: name}
+			err := s.InsertGroup(ctx, g)
+			return int64(g.ID), err
+		},
+		rename: func(id int64, name string) error {
+			return s.UpdateGroup(ctx, &auth.Group{ID: auth.GroupID(id), Name: name})
+		},
+		remove: func(id int64) error {
+			return s.DeleteGroup(ctx, auth.GroupID(id))
+		},
+		get: func(id int64) (string, error) {
+			g, err := s.GetGroup(ctx, auth.GroupID(id))
+			if err != nil {
+				return "", err
+			}
+			return g.Name, nil
+		},
+		getByName: func(name string) (int64, error) {
+			g, err := s.GetGroupByName(ctx, name)
+			if err != nil {
+				return 0, err
+			}
+			return int64(g.ID), nil
+		},
+		errExists:   auth.ErrGroupExists,
+		errNotExist: auth.ErrGroupNotExist,
+	})
+}
+
+// *-* Roles and groups of users *-*
+
+func testAssignments(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	clerk := &auth.Role{Name: "clerk"}
+	must(t, s.InsertRole(ctx, clerk))
+	auditor := &auth.Role{Name: "auditor"}
+	must(t, s.InsertRole(ctx, auditor))
+	staff := &auth.Group{Name: "staff"}
+	must(t, s.InsertGroup(ctx, staff))
+	anna := &auth.User{Name: "anna", Roles: map[auth.RoleID]*auth.Role{clerk.ID: clerk}, Groups: []auth.GroupID{staff.ID}}
+	must(t, s.InsertUser(ctx, anna))
+	belle := &auth.User{Name: "belle", Roles: map[auth.RoleID]*auth.Role{clerk.ID: clerk, auditor.ID: auditor}}
+	must(t, s.InsertUser(ctx, belle))
+	{
+		u, err := s.GetUser(ctx, anna.ID)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 1, len(u.Roles), "should keep the roles")
+		assert.Equal(t, "clerk", u.Roles[clerk.ID].Name, "should populate the roles")
+		assert.Equal(t, []auth.GroupID{staff.ID}, u.Groups, "should keep the groups")
+		users, err := s.UsersWithRole(ctx, clerk.ID)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []auth.UserID{anna.ID, belle.ID}, users, "should list the holders in ascending order")
+		members, err := s.GroupMembers(ctx, staff.ID)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []auth.UserID{anna.ID}, members, "should list the members")
+	}
+	{
+		must(t, s.UpdateRole(ctx, &auth.Role{ID: clerk.ID, Name: "teller", Permissions: []string{"cash:*"}, Denied: []string{"cash:void"}}))
+		r, _ := s.GetRole(ctx, clerk.ID)
+		assert.Equal(t, []string{"cash:void"}, r.Denied, "should keep the deny rules of roles")
+		u, _ := s.GetUserByName(ctx, "anna")
+		assert.Equal(t, "teller", u.Roles[clerk.ID].Name, "should populate the current roles")
+		assert.Equal(t, []string{"cash:*"}, u.Roles[clerk.ID].Permissions, "should populate the current roles")
+		list, _ := s.ListUsers(ctx, &auth.ListQuery{Limit: 10})
+		assert.Equal(t, 2, len(list), "should list the users")
+		assert.Equal(t, "teller", list[1].Roles[clerk.ID].Name, "should populate the roles of listed users")
+	}
+	{
+		u, _ := s.GetUser(ctx, belle.ID)
+		changed := *u
+		changed.Roles = map[auth.RoleID]*auth.Role{auditor.ID: u.Roles[auditor.ID]}
+		changed.Groups = []auth.GroupID{staff.ID}
+		expires := time.Unix(1700000000, 0)
+		changed.RoleExpiry = map[auth.RoleID]time.Time{auditor.ID: expires}
+		changed.Denied = []string{"ledger:close"}
+		changed.ResourceRoles = map[auth.RoleID][]string{clerk.ID: {"branch:7"}}
+		changed.Attributes = auth.Attributes{"region": "eu", "clearance": int64(3), "teams": []string{"ops"}}
+		changed.Metadata = map[string]string{"email": "belle@example.com"}
+		changed.Email, changed.EmailVerified = "belle@example.com", true
+		must(t, s.UpdateUser(ctx, &changed))
+		u, _ = s.GetUser(ctx, belle.ID)
+		assert.Equal(t, true, u.RoleExpiry[auditor.ID].Equal(expires), "should keep the expiry of roles")
+		assert.Equal(t, []string{"ledger:close"}, u.Denied, "should keep the deny rules of users")
+		assert.Equal(t, map[auth.RoleID][]string{clerk.ID: {"branch:7"}}, u.ResourceRoles, "should keep the roles on resources")
+		assert.Equal(t, changed.Attributes, u.Attributes, "should keep the attributes and their types")
+		assert.Equal(t, changed.Metadata, u.Metadata, "should keep the metadata")
+		assert.Equal(t, true, u.Email == changed.Email && u.EmailVerified, "should keep the email")
+		if f, ok := s.(auth.EmailFinder); ok {
+			found, err := f.GetUserByEmail(ctx, "belle@example.com")
+			assert.Equal(t, true, err == nil && found.ID == belle.ID, "should find users by email")
+		}
+		users, _ := s.UsersWithRole(ctx, clerk.ID)
+		assert.Equal(t, []auth.UserID{anna.ID}, users, "should take away the roles dropped by an update")
+		members, _ := s.GroupMembers(ctx, staff.ID)
+		assert.Equal(t, []auth.UserID{anna.ID, belle.ID}, members, "should add the groups of an update")
+
+		must(t, s.DeleteUser(ctx, belle.ID))
+		users, _ = s.UsersWithRole(ctx, auditor.ID)
+		assert.Equal(t, 0, len(users), "should forget the roles of deleted users")
+		members, _ = s.GroupMembers(ctx, staff.ID)
+		assert.Equal(t, []auth.UserID{anna.ID}, members, "should forget the groups of deleted users")
+	}
+}
+
+func testCascade(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	clerk := &auth.Role{Name: "clerk"}
+	must(t, s.InsertRole(ctx, clerk))
+	staff := &auth.Group{Name: "staff"}
+	must(t, s.InsertGroup(ctx, staff))
+	anna := &auth.User{Name: "anna", Roles: map[auth.RoleID]*auth.Role{clerk.ID: clerk}, Groups: []auth.GroupID{staff.ID}}
+	must(t, s.InsertUser(ctx, anna))
+	{
+		assert.Equal(t, nil, s.DeleteRole(ctx, clerk.ID), "should delete roles in use")
+		_, err := s.GetUser(ctx, anna.ID)
+		assert.Equal(t, nil, err, "should keep the holders of deleted roles")
+		again := &auth.Role{Name: "clerk"}
+		assert.Equal(t, nil, s.InsertRole(ctx, again), "should free the names of deleted roles")
+		assert.Equal(t, true, again.ID > clerk.ID, "should not reuse the IDs of deleted roles")
+		u, _ := s.GetUser(ctx, anna.ID)
+		_, has := u.Roles[again.ID]
+		assert.Equal(t, false, has, "should not grant a new role to the holders of a deleted one")
+		users, _ := s.UsersWithRole(ctx, again.ID)
+		assert.Equal(t, 0, len(users), "should not grant a new role to the holders of a deleted one")
+	}
+	{
+		assert.Equal(t, nil, s.DeleteGroup(ctx, staff.ID), "should delete groups in use")
+		_, err := s.GetUser(ctx, anna.ID)
+		assert.Equal(t, nil, err, "should keep the members of deleted groups")
+		again := &auth.Group{Name: "staff"}
+		assert.Equal(t, nil, s.InsertGroup(ctx, again), "should free the names of deleted groups")
+		assert.Equal(t, true, again.ID > staff.ID, "should not reuse the IDs of deleted groups")
+		members, _ := s.GroupMembers(ctx, again.ID)
+		assert.Equal(t, 0, len(members), "should not add the members of a deleted group to a new one")
+	}
+}
+
+// *-* Listing *-*
+
+func userNames(list []*auth.User) []string {
+	names := make([]string, len(list))
+	for i, u := range list {
+		names[i] = u.Name
+	}
+	return names
+}
+
+func testListing(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	for _, name := range []string{"belle", "anne", "anna"} {
+		must(t, s.InsertUser(ctx, &auth.User{Name: name}))
+	}
+	anna, _ := s.GetUserByName(ctx, "anna")
+	{
+		list, err := s.ListUsers(ctx, &auth.ListQuery{Limit: 10})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []string{"belle", "anne", "anna"}, userNames(list), "should sort by ID")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{SortBy: auth.SortByName, Limit: 10})
+		assert.Equal(t, []string{"anna", "anne", "belle"}, userNames(list), "should sort by name")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{SortBy: auth.SortByName, Desc: true, Limit: 10})
+		assert.Equal(t, []string{"belle", "anne", "anna"}, userNames(list), "should sort in descending order")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Prefix: "an", Limit: 10})
+		assert.Equal(t, []string{"anne", "anna"}, userNames(list), "should filter by prefix")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Limit: 2})
+		assert.Equal(t, []string{"belle", "anne"}, userNames(list), "should apply the limit")
+	}
+	{
+		list, _ := s.ListUsers(ctx, &auth.ListQuery{SortBy: auth.SortByName, After: &auth.ListKey{Name: "anna"}, Limit: 1})
+		assert.Equal(t, []string{"anne"}, userNames(list), "should continue after the key")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Desc: true, After: &auth.ListKey{ID: int64(anna.ID)}, Limit: 10})
+		assert.Equal(t, []string{"anne", "belle"}, userNames(list), "should continue after the key in descending order")
+		list, _ = s.ListUsers(ctx, &auth.ListQuery{Prefix: "an", SortBy: auth.SortByName, After: &auth.ListKey{Name: "anne"}, Limit: 10})
+		assert.Equal(t, 0, len(list), "should end after the last key")
+	}
+	{
+		for _, name := range []string{"clerk", "auditor", "cleaner"} {
+			must(t, s.InsertRole(ctx, &auth.Role{Name: name}))
+		}
+		list, err := s.ListRoles(ctx, &auth.ListQuery{Prefix: "cl", SortBy: auth.SortByName, Limit: 10})
+		assert.Equal(t, nil, err, "should success")
+		names := make([]string, len(list))
+		for i, r := range list {
+			names[i] = r.Name
+		}
+		assert.Equal(t, []string{"cleaner", "clerk"}, names, "should list roles like users")
+	}
+}
+
+// *-* Tokens *-*
+
+func tokenValues(list []*auth.Token) []auth.TokenValue {
+	values := make([]auth.TokenValue, len(list))
+	for i, t := range list {
+		values[i] = t.Value
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+func testTokens(t *testing.T, s auth.Storage) {
+	ctx := context.Background()
+	anna := &auth.User{Name: "anna"}
+	must(t, s.InsertUser(ctx, anna))
+	belle := &auth.User{Name: "belle"}
+	must(t, s.InsertUser(ctx, belle))
+	// Whole seconds, as some stores keep no finer times
+	now := time.Now().UTC().Truncate(time.Second)
+	must(t, s.InsertToken(ctx, &auth.Token{
+		Value: "live", User: anna.ID, Issued: now, Expires: now.Add(time.Hour),
+		Client: auth.ClientInfo{IP: "10.0.0.1"}, Scope: &auth.TokenScope{Permissions: []string{"orders:read"}},
+	}))
+	must(t, s.InsertToken(ctx, &auth.Token{Value: "dead", User: anna.ID, Issued: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)}))
+	must(t, s.InsertToken(ctx, &auth.Token{Value: "other", User: belle.ID, Issued: now, Expires: now.Add(time.Hour)}))
+	{
+		tok, err := s.GetToken(ctx, "live")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, anna.ID, tok.User, "should keep the user")
+		assert.Equal(t, true, tok.Issued.Equal(now), "should keep the issue time")
+		assert.Equal(t, true, tok.Expires.Equal(now.Add(time.Hour)), "should keep the expiry time")
+		assert.Equal(t, "10.0.0.1", tok.Client.IP, "should keep the client")
+		assert.Equal(t, &auth.TokenScope{Permissions: []string{"orders:read"}}, tok.Scope, "should keep the scope")
+		_, err = s.GetToken(ctx, "dead")
+		assert.Equal(t, nil, err, "should leave expiry to the server")
+		_, err = s.GetToken(ctx, "unknown")
+		assert.Equal(t, auth.ErrInvalidToken, err, "should give ErrInvalidToken if the token is unknown")
+
+		list, err := s.UserTokens(ctx, anna.ID)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []auth.TokenValue{"dead", "live"}, tokenValues(list), "should list the tokens of the user only")
+	}
+	{
+		assert.Equal(t, nil, s.DeleteToken(ctx, "unknown"), "should be a no-op for unknown tokens")
+		assert.Equal(t, nil, s.DeleteToken(ctx, "live"), "should success")
+		_, err := s.GetToken(ctx, "live")
+		assert.Equal(t, auth.ErrInvalidToken, err, "should not find deleted tokens")
+		list, _ := s.UserTokens(ctx, anna.ID)
+		assert.Equal(t, []auth.TokenValue{"dead"}, tokenValues(list), "should not list deleted tokens")
+	}
+	if d, ok := s.(ExpiredTokenDeleter); ok {
+		n, err := d.DeleteExpiredTokens(ctx, now)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, int64(1), n, "should remove the expired tokens only")
+		_, err = s.GetToken(ctx, "dead")
+		assert.Equal(t, auth.ErrInvalidToken, err, "should remove the expired tokens")
+		list, _ := s.UserTokens(ctx, anna.ID)
+		assert.Equal(t, 0, len(list), "should not list removed tokens")
+		_, err = s.GetToken(ctx, "other")
+		assert.Equal(t, nil, err, "should keep valid tokens")
+	}
+}
+
+func testCount(t *testing.T, s auth.Storage) {
+	c, ok := s.(auth.Counter)
+	if !ok {
+		t.Skip("auth.Counter not implemented")
+	}
+	ctx := context.Background()
+	counts, err := c.Count(ctx)
+	assert.Equal(t, nil, err, "should success")
+	assert.Equal(t, auth.Counts{}, counts, "should count nothing in an empty store")
+
+	anna := &auth.User{Name: "anna"}
+	must(t, s.InsertUser(ctx, anna))
+	must(t, s.InsertUser(ctx, &auth.User{Name: "belle"}))
+	must(t, s.InsertRole(ctx, &auth.Role{Name: "clerk"}))
+	must(t, s.InsertToken(ctx, &auth.Token{Value: "live", User: anna.ID, Expires: time.Now().Add(time.Hour)}))
+	must(t, s.InsertToken(ctx, &auth.Token{Value: "gone", User: anna.ID, Expires: time.Now().Add(time.Hour)}))
+	must(t, s.DeleteToken(ctx, "gone"))
+	counts, _ = c.Count(ctx)
+	assert.Equal(t, auth.Counts{Users: 2, Roles: 1, Tokens: 1}, counts, "should count the entities")
+}
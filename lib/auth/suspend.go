@@ -0,0 +1,75 @@
+package auth
+
+import "net/http"
+
+// UserStatus tells if a user may log in.
+type UserStatus int
+
+const (
+	UserActive UserStatus = iota
+	// UserSuspended users keep their data, roles and groups, but cannot log in or use their tokens.
+	UserSuspended
+)
+
+var ErrUserSuspended = newError("user_suspended", http.StatusForbidden, "user is suspended")
+
+// SuspendUser disables a user without deleting it: Authenticate fails with ErrUserSuspended, and
+// the tokens of the user stop verifying. Saved tokens are removed, so they stay invalid after
+// ReactivateUser (JWTs are not saved, so those that have not expired become valid again).
+// It is a no-op if the user is already suspended.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) SuspendUser(user UserID) (err error) {
+	s, sp := s.trace("auth.SuspendUser")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	return s.setUserStatus(user, UserSuspended)
+}
+
+// ReactivateUser lifts the suspension of a user. It is a no-op if the user is not suspended.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) ReactivateUser(user UserID) (err error) {
+	s, sp := s.trace("auth.ReactivateUser")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	return s.setUserStatus(user, UserActive)
+}
+
+func (s *Server) setUserStatus(user UserID, status UserStatus) error {
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if userObj.Status == status {
+		return nil
+	}
+	userObj = userObj.clone()
+	userObj.Status = status
+	if status == UserSuspended {
+		s.bumpSession(userObj)
+	}
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	if status != UserSuspended {
+		s.emit(Event{Type: EventUserReactivated, User: user, Name: userObj.Name})
+		return nil
+	}
+	s.emit(Event{Type: EventUserSuspended, User: user, Name: userObj.Name})
+	// Tokens are rejected while the user is suspended anyway, so a failure here is not fatal
+	tokens, err := s.store.UserTokens(ctx, user)
+	if err != nil {
+		return nil
+	}
+	for _, t := range tokens {
+		_ = s.store.DeleteToken(ctx, t.Value)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuspendUser(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("elton", "123456")
+
+	assert.Equal(t, ErrUserNotExist, svr.SuspendUser(101), "should give ErrUserNotExist")
+	assert.Equal(t, nil, svr.SuspendUser(uid), "should success")
+	assert.Equal(t, nil, svr.SuspendUser(uid), "should be a no-op")
+	assert.Equal(t, UserSuspended, svr.GetUser(uid).Status, "should save the status")
+	{
+		_, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrUserSuspended, err, "should reject suspended users")
+		_, err = svr.Authenticate("elton", "654321")
+		assert.Equal(t, ErrInvalidAuth, err, "should not reveal the status without the password")
+		_, err = svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the tokens of suspended users")
+	}
+	assert.Equal(t, nil, svr.ReactivateUser(uid), "should success")
+	{
+		_, err := svr.CheckRole(token, rid)
+		assert.Equal(t, ErrInvalidToken, err, "should not revive old tokens")
+		token, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should accept reactivated users")
+		ok, _ := svr.CheckRole(token, rid)
+		assert.Equal(t, true, ok, "should keep the roles")
+	}
+}
+
+func TestSuspendUserJWT(t *testing.T) {
+	svr, _ := NewInMemoryServer(&ServerConfig{TokenExpireSec: 60, JWT: &JWTConfig{Algorithm: HS256, Key: []byte("s3cr3t")}})
+	uid, _ := svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	svr.SuspendUser(uid)
+	_, err := svr.AllRoles(token)
+	assert.Equal(t, ErrInvalidToken, err, "should reject the JWTs of suspended users")
+	svr.ReactivateUser(uid)
+	_, err = svr.AllRoles(token)
+	assert.Equal(t, nil, err, "should accept the JWTs again, as they are not stored")
+}
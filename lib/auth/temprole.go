@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidExpiry = newError("invalid_expiry", http.StatusBadRequest, "expiry is not in the future")
+
+// AddRoleToUserUntil gives a role to a user until expires, e.g. to an on-call administrator.
+// CheckRole, CheckPermission and AllRoles ignore the assignment once it has expired, and the server
+// removes it in the background afterwards, with a role.expired event (see ExpireRoles). It replaces
+// any previous assignment of the role to the user; AddRoleToUser makes it permanent again. JWTs
+// issued before the expiry carry the role until they expire themselves.
+//
+// Returns: none
+// Errors: ErrUserNotExist, ErrRoleNotExist, ErrInvalidExpiry
+func (s *Server) AddRoleToUserUntil(user UserID, role RoleID, expires time.Time) (err error) {
+	s, sp := s.trace("auth.AddRoleToUserUntil")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	if !expires.After(s.now()) {
+		return ErrInvalidExpiry
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	roleObj, err := s.store.GetRole(ctx, role)
+	if err != nil {
+		return err
+	}
+
+	userObj = userObj.clone()
+	userObj.Roles[roleObj.ID] = roleObj
+	if userObj.RoleExpiry == nil {
+		userObj.RoleExpiry = make(map[RoleID]time.Time)
+	}
+	userObj.RoleExpiry[roleObj.ID] = expires
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.tempRoles, 1)
+	s.emit(Event{Type: EventRoleGranted, User: user, Name: userObj.Name, Role: role, Expires: &expires})
+	return nil
+}
+
+// ExpireRoles removes the expired assignments of AddRoleToUserUntil, with a role.expired event for
+// each. It runs by itself once per server epoch (see ServerConfig.PruneIntervalSec), in the
+// background, while there are temporary assignments. It scans all users, so call it directly only
+// if the assignments must go at a precise time; they are ignored by the checks anyway.
+//
+// Returns: the number of removed assignments
+// Errors: any error from the storage
+func (s *Server) ExpireRoles() (_ int, err error) {
+	s, sp := s.trace("auth.ExpireRoles")
+	defer func() { sp.end(err) }()
+	var (
+		n       int
+		pending bool
+		opts    = ListOptions{Limit: MaxListLimit}
+		now     = s.now()
+	)
+	// Cleared first, so that assignments made during the scan set it again
+	atomic.StoreInt32(&s.tempRoles, 0)
+	defer func() {
+		if pending || err != nil {
+			atomic.StoreInt32(&s.tempRoles, 1)
+		}
+	}()
+	for {
+		list, next, err := s.ListUsers(&opts)
+		if err != nil {
+			return n, err
+		}
+		for _, u := range list {
+			if len(u.RoleExpiry) == 0 {
+				continue
+			}
+			removed, left, err := s.expireUserRoles(u.ID, now)
+			if err != nil && err != ErrUserNotExist {
+				return n, err
+			}
+			n += removed
+			pending = pending || left
+		}
+		if next == "" {
+			return n, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// expireUserRoles removes the assignments of a user that expired before now. Those of tombstones
+// are kept, so that RestoreUser gives back the assignments that are still valid.
+// It reports whether temporary assignments are left.
+func (s *Server) expireUserRoles(user UserID, now time.Time) (removed int, left bool, err error) {
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Read again, as assignments may have changed since the listing
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return 0, false, err
+	}
+	var expired []RoleID
+	for role, exp := range userObj.RoleExpiry {
+		if !now.Before(exp) {
+			expired = append(expired, role)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, len(userObj.RoleExpiry) > 0, nil
+	}
+
+	userObj = userObj.clone()
+	for _, role := range expired {
+		delete(userObj.Roles, role)
+		delete(userObj.RoleExpiry, role)
+	}
+	if len(userObj.RoleExpiry) == 0 {
+		userObj.RoleExpiry = nil
+	}
+	s.bumpSession(userObj)
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return 0, true, err
+	}
+	for _, role := range expired {
+		s.emit(Event{Type: EventRoleExpired, User: user, Name: userObj.Name, Role: role})
+	}
+	return len(expired), len(userObj.RoleExpiry) > 0, nil
+}
+
+// startRoleExpiry runs ExpireRoles in the background, if there may be temporary assignments and it
+// is not already running.
+func (s *Server) startRoleExpiry() {
+	if atomic.LoadInt32(&s.tempRoles) == 0 || !atomic.CompareAndSwapInt32(&s.expiringRoles, 0, 1) {
+		return
+	}
+	started := s.goBackground(func() {
+		defer atomic.StoreInt32(&s.expiringRoles, 0)
+		// Not bound to the request that happened to start it
+		_, _ = s.WithContext(context.Background()).ExpireRoles()
+	})
+	if !started {
+		atomic.StoreInt32(&s.expiringRoles, 0)
+	}
+}
+
+// hasRole tells if a user holds a role directly, and the assignment has not expired.
+func (u *User) hasRole(role RoleID, now time.Time) bool {
+	if _, ok := u.Roles[role]; !ok {
+		return false
+	}
+	return u.unexpired(role, now)
+}
+
+// unexpired tells if a role in u.Roles is held at that time, i.e. is not a temporary role past its
+// expiry. It saves hasRole looking the role up again while iterating over u.Roles.
+func (u *User) unexpired(role RoleID, now time.Time) bool {
+	exp, temporary := u.RoleExpiry[role]
+	return !temporary || now.Before(exp)
+}
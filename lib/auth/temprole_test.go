@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemporaryRoles(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithClock(clock), WithHasher(fastHasher), WithTokenTTL(24*time.Hour))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	oncall, _ := svr.CreateRole("oncall")
+	perm := "pager:ack"
+	svr.GrantPermissionToRole(oncall, perm)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	next, cancel := collect(svr, EventRoleGranted, EventRoleExpired)
+	defer cancel()
+	{
+		assert.Equal(t, ErrInvalidExpiry, svr.AddRoleToUserUntil(uid, oncall, clock.Now()), "should reject past expiries")
+		assert.Equal(t, ErrRoleNotExist, svr.AddRoleToUserUntil(uid, oncall+1, clock.Now().Add(time.Hour)), "should check the role")
+		expires := clock.Now().Add(time.Hour)
+		assert.Equal(t, nil, svr.AddRoleToUserUntil(uid, oncall, expires), "should success")
+		events := next(1)
+		assert.Equal(t, expires, *events[0].Expires, "should report the expiry")
+
+		ok, _ := svr.CheckRole(token, oncall)
+		assert.Equal(t, true, ok, "should grant the role until it expires")
+		ok, _ = svr.CheckPermission(token, perm)
+		assert.Equal(t, true, ok, "should grant the permissions of the role")
+	}
+	{
+		clock.Advance(time.Hour)
+		ok, _ := svr.CheckRole(token, oncall)
+		assert.Equal(t, false, ok, "should ignore expired roles")
+		ok, _ = svr.CheckPermission(token, perm)
+		assert.Equal(t, false, ok, "should ignore the permissions of expired roles")
+		roles, _ := svr.AllRoles(token)
+		assert.Equal(t, []RoleID{}, roles, "should leave out expired roles")
+
+		n, err := svr.ExpireRoles()
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 1, n, "should remove the expired assignment")
+		assert.Equal(t, 0, len(svr.GetUser(uid).Roles), "should remove the role")
+		events := next(1)
+		assert.Equal(t, []EventType{EventRoleExpired}, []EventType{events[0].Type}, "should report the expiry")
+		assert.Equal(t, oncall, events[0].Role, "should give the role")
+		n, _ = svr.ExpireRoles()
+		assert.Equal(t, 0, n, "should not remove anything twice")
+	}
+	{
+		svr.AddRoleToUserUntil(uid, oncall, clock.Now().Add(time.Minute))
+		assert.Equal(t, nil, svr.AddRoleToUser(uid, oncall), "should success")
+		clock.Advance(time.Hour)
+		ok, _ := svr.CheckRole(token, oncall)
+		assert.Equal(t, true, ok, "should make the role permanent with AddRoleToUser")
+		assert.Equal(t, 0, len(svr.GetUser(uid).RoleExpiry), "should forget the expiry")
+		next(2)
+	}
+	{
+		svr.AddRoleToUserUntil(uid, oncall, clock.Now().Add(time.Minute))
+		next(1)
+		clock.Advance(2 * time.Hour)
+		// A login in a new epoch starts the cleanup
+		svr.Authenticate("anna", "passw0rd")
+		events := next(1)
+		assert.Equal(t, 1, len(events), "should remove expired roles in the background")
+		assert.Equal(t, EventRoleExpired, events[0].Type, "should report the expiry")
+
+		svr.AddRoleToUserUntil(uid, oncall, clock.Now().Add(time.Minute))
+		svr.RemoveRoleFromUser(uid, oncall)
+		assert.Equal(t, 0, len(svr.GetUser(uid).RoleExpiry), "should forget the expiry of removed roles")
+	}
+}
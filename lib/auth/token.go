@@ -1,23 +1,157 @@
-package auth
-
-import (
-	"errors"
-	"time"
-)
-
-type TokenValue string
-
-type Token struct {
-	Value   TokenValue
-	User    UserID
-	Expires time.Time
-}
-
-type TokenQueue struct {
-	ServerEpoch int32
-	Tokens      []*Token
-}
-
-var (
-	ErrInvalidToken = errors.New("invalid auth token")
-)
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TokenValue string
+
+// TokenEncoding tells how the random bytes of opaque tokens are written, see
+// ServerConfig.TokenEncoding.
+type TokenEncoding uint8
+
+const (
+	TokenBase64URL TokenEncoding = iota // URL-safe base64 without padding, the default
+	TokenHex                            // lower-case hexadecimal
+)
+
+const (
+	defaultTokenBytes = 32
+	minTokenBytes     = 16
+)
+
+// TokenKind tells what a token grants. Only session tokens identify a user to CheckRole and friends.
+type TokenKind uint8
+
+const (
+	TokenSession           TokenKind = iota
+	TokenMFAChallenge                // issued after the password when MFA is on, see CompleteMFA
+	TokenEmailVerification           // see RequestEmailVerification
+	TokenPasswordReset               // see RequestPasswordReset
+)
+
+type Token struct {
+	Value    TokenValue
+	Kind     TokenKind `json:",omitempty"`
+	User     UserID
+	Issued   time.Time
+	Expires  time.Time
+	AuthTime time.Time // when the user authenticated, Issued if zero; kept when the token is extended
+	Client   ClientInfo
+	Scope    *TokenScope `json:",omitempty"` // see AuthenticateScoped
+	Attempts int         `json:",omitempty"` // failed MFA codes for a challenge
+	Email    string      `json:",omitempty"` // to verify, for email verification tokens
+	Actor    UserID      `json:",omitempty"` // who acts as User, for impersonation tokens
+	Version  uint32      `json:",omitempty"` // the SessionVersion of User at issuance
+	Level    AuthLevel   `json:",omitempty"` // how the user authenticated, see StepUp
+}
+
+// TokenScope limits a token to part of what its user is granted, see AuthenticateScoped.
+// The token holds only the listed roles, as long as the user keeps them. Permissions, if any, limit
+// CheckPermission further. A scope of permissions only, like that of an API key, holds no role for
+// CheckRole, but checks its permissions against all the roles of the user.
+type TokenScope struct {
+	Roles       []RoleID `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// tokenHeap is a min-heap of tokens on their expiry, for pruning them as they expire, see
+// container/heap.
+type tokenHeap []*Token
+
+func (h tokenHeap) Len() int           { return len(h) }
+func (h tokenHeap) Less(i, j int) bool { return h[i].Expires.Before(h[j].Expires) }
+func (h tokenHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *tokenHeap) Push(x interface{}) { *h = append(*h, x.(*Token)) }
+
+// Pop also gives back the memory of the heap once it is down to a quarter of its capacity, which
+// it grew to when the most tokens were live.
+func (h *tokenHeap) Pop() interface{} {
+	old := *h
+	n := len(old) - 1
+	t := old[n]
+	old[n] = nil
+	*h = old[:n]
+	if c := cap(old); c > 64 && n < c/4 {
+		*h = append(make(tokenHeap, 0, c/2), old[:n]...)
+	}
+	return t
+}
+
+// peek gives the token that expires first, or nil.
+func (h tokenHeap) peek() *Token {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
+
+var (
+	ErrInvalidToken = newError("invalid_token", http.StatusUnauthorized, "invalid auth token")
+	ErrInvalidScope = newError("invalid_scope", http.StatusForbidden, "scope not granted to the user")
+)
+
+// validTokenFormat checks the TokenBytes, TokenEncoding and TokenPrefix of a config. Prefixes are
+// made of letters, digits, "_" and "-", so that tokens need no escaping, and must not be taken for
+// API keys.
+func validTokenFormat(config *ServerConfig) bool {
+	if config.TokenBytes != 0 && config.TokenBytes < minTokenBytes || config.TokenEncoding > TokenHex {
+		return false
+	}
+	if strings.HasPrefix(config.TokenPrefix, APIKeyPrefix) {
+		return false
+	}
+	for _, r := range config.TokenPrefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenBuffers holds the buffers of newTokenValue, for the random bytes followed by their encoding.
+var tokenBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// newTokenValue draws the value of a new opaque token, as set by the TokenBytes, TokenEncoding and
+// TokenPrefix of the config. The bytes are drawn and encoded in a pooled buffer, cleared after use,
+// so that the value is the only allocation. Values are never those of API keys.
+func (s *Server) newTokenValue() (TokenValue, error) {
+	n, m := s.cfg.TokenBytes, base64.RawURLEncoding.EncodedLen(s.cfg.TokenBytes)
+	if s.cfg.TokenEncoding == TokenHex {
+		m = hex.EncodedLen(n)
+	}
+	bp := tokenBuffers.Get().(*[]byte)
+	if cap(*bp) < n+m {
+		*bp = make([]byte, n+m)
+	}
+	buf := (*bp)[:n+m]
+	defer func() {
+		for i := range buf {
+			buf[i] = 0
+		}
+		tokenBuffers.Put(bp)
+	}()
+	b, v := buf[:n], buf[n:]
+	for {
+		if err := s.random(b); err != nil {
+			return "", err
+		}
+		switch s.cfg.TokenEncoding {
+		case TokenHex:
+			hex.Encode(v, b)
+		default:
+			base64.RawURLEncoding.Encode(v, b)
+		}
+		// Without a prefix, about one value in 2^18 would be taken for an API key
+		if s.cfg.TokenPrefix != "" || !bytes.HasPrefix(v, []byte(APIKeyPrefix)) {
+			return TokenValue(s.cfg.TokenPrefix + string(v)), nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFormat(t *testing.T) {
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		svr.CreateUser("anna", "passw0rd")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, false, strings.ContainsAny(string(token), "+/="), "should be URL-safe by default")
+	}
+	{
+		cfg := &ServerConfig{TokenExpireSec: 3600, TokenBytes: 16, TokenEncoding: TokenHex, TokenPrefix: "hsb_"}
+		svr, _ := New(WithConfig(cfg), WithHasher(fastHasher))
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, true, strings.HasPrefix(string(token), "hsb_"), "should start with the prefix")
+		b, err := hex.DecodeString(strings.TrimPrefix(string(token), "hsb_"))
+		assert.Equal(t, nil, err, "should be hexadecimal")
+		assert.Equal(t, 16, len(b), "should have the configured length")
+		id, _ := svr.TokenUser(token)
+		assert.Equal(t, uid, id, "should verify")
+		reset, _ := svr.RequestPasswordReset("anna")
+		assert.Equal(t, true, strings.HasPrefix(string(reset), "hsb_"), "should apply to one-time tokens")
+	}
+	for _, cfg := range []*ServerConfig{
+		{TokenExpireSec: 3600, TokenBytes: 8},
+		{TokenExpireSec: 3600, TokenEncoding: TokenHex + 1},
+		{TokenExpireSec: 3600, TokenPrefix: "hsb/"},
+		{TokenExpireSec: 3600, TokenPrefix: APIKeyPrefix},
+	} {
+		_, err := NewInMemoryServer(cfg)
+		assert.Equal(t, ErrInvalidConfig, err, "should check the token format")
+	}
+}
+
+func TestUserTokenIndex(t *testing.T) {
+	ctx := context.Background()
+	svr, _ := New(WithHasher(fastHasher))
+	store := memStore(svr)
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	elton, _ := svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	svr.Authenticate("anna", "passw0rd")
+	svr.Authenticate("elton", "123456")
+	{
+		tokens, _ := store.UserTokens(ctx, anna)
+		assert.Equal(t, 2, len(tokens), "should list the tokens of the user")
+		tok, _ := store.GetToken(ctx, token)
+		extended := *tok
+		store.InsertToken(ctx, &extended)
+		tokens, _ = store.UserTokens(ctx, anna)
+		assert.Equal(t, 2, len(tokens), "should list a replaced token once")
+	}
+	{
+		svr.Invalidate(token)
+		tokens, _ := store.UserTokens(ctx, anna)
+		assert.Equal(t, 1, len(tokens), "should not list deleted tokens")
+		tokens, _ = store.UserTokens(ctx, elton)
+		assert.Equal(t, 1, len(tokens), "should keep the tokens of other users")
+	}
+	{
+		var buf bytes.Buffer
+		svr.Save(&buf, true)
+		restored := NewMemoryStorage()
+		assert.Equal(t, nil, restored.Load(&buf), "should success")
+		tokens, _ := restored.UserTokens(ctx, anna)
+		assert.Equal(t, 1, len(tokens), "should index the restored tokens")
+	}
+}
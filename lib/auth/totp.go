@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Time-based one-time passwords (RFC 6238), as generated by authenticator apps: HMAC-SHA1, 6 digits,
+// 30-second steps. Codes of the previous and the next step are accepted for clock skew, and each
+// code is accepted only once.
+
+const (
+	totpPeriod      = 30
+	totpSkew        = 1
+	totpSecretLen   = 20
+	mfaChallengeTTL = 5 * time.Minute
+	// maxMFAAttempts is the number of wrong codes after which a challenge is invalidated.
+	maxMFAAttempts = 5
+)
+
+// TOTP is the MFA state of a user.
+type TOTP struct {
+	Secret    []byte
+	Confirmed bool  // MFA is only enforced after the first code has been verified
+	LastStep  int64 // the time step of the last accepted code, to reject replays
+	// RecoveryCodes are the hashes of the recovery codes left, see RegenerateRecoveryCodes.
+	RecoveryCodes [][]byte `json:",omitempty"`
+}
+
+// TOTPEnrollment is what a user needs to set up an authenticator app.
+type TOTPEnrollment struct {
+	Secret string // base32, for manual entry
+	URI    string // otpauth:// URI, usually shown as a QR code
+	// RecoveryCodes are single-use codes for when the authenticator app is lost, to keep offline.
+	RecoveryCodes []string
+}
+
+var (
+	ErrMFARequired    = newError("mfa_required", http.StatusUnauthorized, "multi-factor authentication required")
+	ErrMFAEnrolled    = newError("mfa_enrolled", http.StatusConflict, "multi-factor authentication already enrolled")
+	ErrMFANotEnrolled = newError("mfa_not_enrolled", http.StatusConflict, "multi-factor authentication not enrolled")
+	ErrInvalidCode    = newError("invalid_code", http.StatusUnauthorized, "invalid one-time code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of a time step (RFC 4226 dynamic truncation).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// match finds the time step of a code that has not been used yet. It returns 0 if there is none.
+func (t *TOTP) match(code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(t.Secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+func (t *TOTP) clone() *TOTP {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Secret = append([]byte(nil), t.Secret...)
+	if t.RecoveryCodes != nil {
+		c.RecoveryCodes = make([][]byte, len(t.RecoveryCodes))
+		for i, h := range t.RecoveryCodes {
+			c.RecoveryCodes[i] = append([]byte(nil), h...)
+		}
+	}
+	return &c
+}
+
+// EnrollTOTP generates a new TOTP secret for a user, and a set of recovery codes, which CompleteMFA
+// accepts once each in place of a code from the authenticator. MFA is enforced once the user proves
+// to have set up the authenticator, by passing a code to VerifyTOTP. Until then, enrolling again
+// replaces the secret and the codes. A confirmed enrollment must be removed with DisableTOTP first.
+//
+// Returns: the secret, the provisioning URI and the recovery codes
+// Errors: ErrUserNotExist, ErrMFAEnrolled, ErrInternal
+func (s *Server) EnrollTOTP(user UserID) (_ *TOTPEnrollment, err error) {
+	s, sp := s.trace("auth.EnrollTOTP")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	secret := make([]byte, totpSecretLen)
+	if err := s.random(secret); err != nil {
+		return nil, ErrInternal
+	}
+	codes, hashes, err := s.newRecoveryCodes()
+	if err != nil {
+		return nil, ErrInternal
+	}
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if userObj.TOTP != nil && userObj.TOTP.Confirmed {
+		return nil, ErrMFAEnrolled
+	}
+	userObj = userObj.clone()
+	userObj.TOTP = &TOTP{Secret: secret, RecoveryCodes: hashes}
+	if err := s.store.UpdateUser(ctx, userObj); err != nil {
+		return nil, err
+	}
+
+	issuer := s.cfg.TOTPIssuer
+	if issuer == "" {
+		issuer = "auth"
+	}
+	enc := totpEncoding.EncodeToString(secret)
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&algorithm=SHA1&digits=6&period=%d",
+		url.PathEscape(issuer), url.PathEscape(userObj.Name), enc, url.QueryEscape(issuer), totpPeriod)
+	return &TOTPEnrollment{Secret: enc, URI: uri, RecoveryCodes: codes}, nil
+}
+
+// VerifyTOTP checks a one-time code of a user. The first valid code confirms the enrollment.
+//
+// Returns: true or false
+// Errors: ErrUserNotExist, ErrMFANotEnrolled
+func (s *Server) VerifyTOTP(user UserID, code string) (ok bool, err error) {
+	s, sp := s.trace("auth.VerifyTOTP")
+	defer func() { sp.check(ok, err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return s.verifyTOTP(userObj, code)
+}
+
+// DisableTOTP removes the TOTP enrollment of a user. It is a no-op if there is none.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) DisableTOTP(user UserID) (err error) {
+	s, sp := s.trace("auth.DisableTOTP")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.getUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if userObj.TOTP == nil {
+		return nil
+	}
+	userObj = userObj.clone()
+	userObj.TOTP = nil
+	return s.store.UpdateUser(ctx, userObj)
+}
+
+// CompleteMFA exchanges the challenge returned by Authenticate (along with ErrMFARequired) and a
+// one-time code for a session token. The code may also be one of the recovery codes of the user
+// (see EnrollTOTP), which is then used up. After a few wrong codes, the challenge is invalidated
+// and the user has to log in again. Every code also takes an attempt from the allowance of the
+// user, whatever the challenge, so that logging in again does not give more guesses: that of
+// ServerConfig.RateLimiter if set (shared with the passwords), or else 5 codes, and one more per
+// minute. Without an attempt left, the challenge is invalidated with ErrRateLimited. A valid code
+// restores the allowance.
+//
+// Returns: the token string
+// Errors: ErrInvalidToken, ErrInvalidCode, ErrUserSuspended, ErrRateLimited, ErrTooManySessions, ErrTooManyTokens,
+// ErrInternal, or any error from the rate limiter
+func (s *Server) CompleteMFA(challenge TokenValue, code string) (_ TokenValue, err error) {
+	s, sp := s.trace("auth.CompleteMFA")
+	defer func() { sp.end(err) }()
+	ctx := s.ctx
+	// The rate limiter may be remote, so it is called without s.mu, and the challenge is read again
+	// under the lock
+	tokenObj, userObj, err := s.mfaChallenge(ctx, challenge)
+	if err != nil {
+		return "", err
+	}
+	limiter, key := s.mfaLimiter(), userLimitKey(s.cfg.UsernamePolicy.Normalize(userObj.Name))
+	if ok, err := limiter.Allow(ctx, key); err != nil {
+		return "", err
+	} else if !ok {
+		_ = s.store.DeleteToken(ctx, challenge)
+		s.emit(Event{Type: EventLoginThrottled, User: userObj.ID, Name: userObj.Name, IP: tokenObj.Client.IP,
+			UserAgent: tokenObj.Client.UserAgent})
+		return "", ErrRateLimited
+	}
+	token, accepted, err := s.completeMFA(ctx, challenge, code)
+	if accepted {
+		_ = limiter.Reset(ctx, key)
+	}
+	return token, err
+}
+
+// mfaChallenge reads a challenge and its user, and deletes the challenge if it can no longer be
+// completed.
+//
+// Returns: the challenge and its user
+// Errors: ErrInvalidToken, ErrUserSuspended, ErrInternal
+func (s *Server) mfaChallenge(ctx context.Context, challenge TokenValue) (*Token, *User, error) {
+	tokenObj, err := s.store.GetToken(ctx, challenge)
+	if err == ErrInvalidToken || (err == nil && tokenObj.Kind != TokenMFAChallenge) {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if s.now().After(tokenObj.Expires) {
+		_ = s.store.DeleteToken(ctx, challenge)
+		return nil, nil, ErrInvalidToken
+	}
+	userObj, err := s.getUser(ctx, tokenObj.User)
+	if err == ErrUserNotExist {
+		_ = s.store.DeleteToken(ctx, challenge)
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if userObj.Status == UserSuspended {
+		_ = s.store.DeleteToken(ctx, challenge)
+		return nil, nil, ErrUserSuspended
+	}
+	return tokenObj, userObj, nil
+}
+
+// completeMFA checks the code of a challenge allowed by the rate limiter, under s.mu.
+//
+// Returns: the token string, and whether the code was accepted
+// Errors: those of CompleteMFA, except ErrRateLimited
+func (s *Server) completeMFA(ctx context.Context, challenge TokenValue, code string) (TokenValue, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenObj, userObj, err := s.mfaChallenge(ctx, challenge)
+	if err != nil {
+		return "", false, err
+	}
+	ok, err := s.verifyTOTP(userObj, code)
+	if err == ErrMFANotEnrolled {
+		// MFA was disabled in the meantime
+		ok = true
+	} else if err != nil {
+		return "", false, err
+	}
+	if !ok {
+		if ok, err = s.useRecoveryCode(userObj, code); err != nil {
+			return "", false, err
+		}
+	}
+	if !ok {
+		s.countLogin(false)
+		s.recordLogin(userObj.ID, tokenObj.Client, false)
+		if err := s.store.DeleteToken(ctx, challenge); err != nil {
+			return "", false, err
+		}
+		retry := *tokenObj
+		if retry.Attempts++; retry.Attempts < maxMFAAttempts {
+			if err := s.store.InsertToken(ctx, &retry); err != nil {
+				return "", false, err
+			}
+		}
+		return "", false, ErrInvalidCode
+	}
+	if err := s.store.DeleteToken(ctx, challenge); err != nil {
+		return "", true, err
+	}
+	// The scope was checked at login, and roles the user no longer holds are ignored by the checks
+	token, err := s.issueToken(userObj, tokenObj.Client, tokenObj.Scope, AuthMFA)
+	if err == nil {
+		s.recordLogin(userObj.ID, tokenObj.Client, true)
+	}
+	return token, true, err
+}
+
+// mfaLimiter gives the RateLimiter of the MFA codes: that of the server, or else mfaBucket.
+func (s *Server) mfaLimiter() RateLimiter {
+	if l := s.live().RateLimiter; l != nil {
+		return l
+	}
+	return s.mfaBucket
+}
+
+// verifyTOTP checks a code, and saves the step of an accepted code. The caller must hold s.mu.
+func (s *Server) verifyTOTP(userObj *User, code string) (bool, error) {
+	if userObj.TOTP == nil {
+		return false, ErrMFANotEnrolled
+	}
+	step := userObj.TOTP.match(code, s.now())
+	if step == 0 {
+		return false, nil
+	}
+	userObj = userObj.clone()
+	userObj.TOTP.Confirmed = true
+	userObj.TOTP.LastStep = step
+	if err := s.store.UpdateUser(s.ctx, userObj); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// newChallenge creates the token that stands for a passed password, until CompleteMFA.
+func (s *Server) newChallenge(u *User, client ClientInfo) (*Token, error) {
+	v, err := s.newTokenValue()
+	if err != nil {
+		return nil, ErrInternal
+	}
+	// Not outliving session tokens keeps the challenge safe from pruning
+	ttl := mfaChallengeTTL
+	if max := time.Duration(s.live().TokenExpireSec) * time.Second; ttl > max {
+		ttl = max
+	}
+	now := s.now()
+	t := Token{
+		Value:   v,
+		Kind:    TokenMFAChallenge,
+		User:    u.ID,
+		Issued:  now,
+		Expires: now.Add(ttl),
+		Client:  client,
+	}
+	if err := s.addToTokenQueue(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	for _, c := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		assert.Equal(t, c.code, totpCode(secret, c.unix/totpPeriod), "should match RFC 6238")
+	}
+
+	now := time.Unix(1111111109, 0)
+	totp := &TOTP{Secret: secret}
+	assert.Equal(t, int64(1111111109/totpPeriod), totp.match("081804", now), "should accept the current code")
+	assert.NotEqual(t, int64(0), totp.match("081804", now.Add(totpPeriod*time.Second)), "should tolerate clock skew")
+	assert.Equal(t, int64(0), totp.match("081804", now.Add(3*totpPeriod*time.Second)), "should reject old codes")
+	totp.LastStep = 1111111109 / totpPeriod
+	assert.Equal(t, int64(0), totp.match("081804", now), "should reject replayed codes")
+}
+
+// currentCode computes the code an authenticator app would show for an enrollment.
+func currentCode(e *TOTPEnrollment) string {
+	secret, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	return totpCode(secret, time.Now().Unix()/totpPeriod)
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60, TOTPIssuer: "Acme Corp"})
+	uid, _ := svr.CreateUser("elton", "123456")
+
+	e, err := svr.EnrollTOTP(uid)
+	assert.Equal(t, nil, err, "should success")
+	uri, _ := url.Parse(e.URI)
+	assert.Equal(t, "otpauth", uri.Scheme, "should give a provisioning URI")
+	assert.Equal(t, "/Acme Corp:elton", uri.Path, "should label the account")
+	assert.Equal(t, e.Secret, uri.Query().Get("secret"), "should include the secret")
+	assert.Equal(t, "Acme Corp", uri.Query().Get("issuer"), "should include the issuer")
+
+	token, err := svr.Authenticate("elton", "123456")
+	assert.Equal(t, nil, err, "MFA should not be enforced before confirmation")
+	svr.Invalidate(token)
+
+	ok, err := svr.VerifyTOTP(uid, "000000")
+	assert.Equal(t, nil, err, "should success")
+	assert.Equal(t, false, ok, "should reject wrong codes")
+	ok, _ = svr.VerifyTOTP(uid, currentCode(e))
+	assert.Equal(t, true, ok, "should accept the current code")
+	assert.Equal(t, true, svr.GetUser(uid).TOTP.Confirmed, "should confirm the enrollment")
+	ok, _ = svr.VerifyTOTP(uid, currentCode(e))
+	assert.Equal(t, false, ok, "should not accept a code twice")
+
+	_, err = svr.EnrollTOTP(uid)
+	assert.Equal(t, ErrMFAEnrolled, err, "should not silently replace a confirmed enrollment")
+	assert.Equal(t, nil, svr.DisableTOTP(uid), "should success")
+	_, err = svr.VerifyTOTP(uid, "000000")
+	assert.Equal(t, ErrMFANotEnrolled, err, "should give ErrMFANotEnrolled")
+	_, err = svr.EnrollTOTP(101)
+	assert.Equal(t, ErrUserNotExist, err, "should give ErrUserNotExist")
+}
+
+func TestCompleteMFA(t *testing.T) {
+	svr, _ := NewInMemoryServer(&InMemoryServerConfig{TokenExpireSec: 60})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	e, _ := svr.EnrollTOTP(uid)
+	secret, _ := totpEncoding.DecodeString(e.Secret)
+	// Confirm with the previous step, so that the current code is still unused
+	svr.VerifyTOTP(uid, totpCode(secret, time.Now().Unix()/totpPeriod-1))
+
+	challenge, err := svr.AuthenticateClient("elton", "123456", ClientInfo{UserAgent: "phone"})
+	assert.Equal(t, ErrMFARequired, err, "should require MFA")
+	assert.NotEqual(t, TokenValue(""), challenge, "should give a challenge")
+	_, err = svr.CheckRole(challenge, rid)
+	assert.Equal(t, ErrInvalidToken, err, "the challenge should not work as a session")
+	list, _ := svr.ListTokens(uid)
+	assert.Equal(t, 0, len(list), "the challenge should not be listed as a session")
+
+	_, err = svr.CompleteMFA(challenge, "000000")
+	assert.Equal(t, ErrInvalidCode, err, "should reject wrong codes")
+	token, err := svr.CompleteMFA(challenge, currentCode(e))
+	assert.Equal(t, nil, err, "should success")
+	ok, _ := svr.CheckRole(token, rid)
+	assert.Equal(t, true, ok, "should give a working session")
+	list, _ = svr.ListTokens(uid)
+	assert.Equal(t, "phone", list[0].Client.UserAgent, "should keep the client of the challenge")
+	_, err = svr.CompleteMFA(challenge, currentCode(e))
+	assert.Equal(t, ErrInvalidToken, err, "should not reuse a challenge")
+	_, err = svr.CompleteMFA(token, currentCode(e))
+	assert.Equal(t, ErrInvalidToken, err, "should not accept sessions as challenges")
+
+	challenge, _ = svr.Authenticate("elton", "123456")
+	for i := 0; i < maxMFAAttempts; i++ {
+		_, err = svr.CompleteMFA(challenge, "000000")
+		assert.Equal(t, ErrInvalidCode, err, "should reject wrong codes")
+	}
+	_, err = svr.CompleteMFA(challenge, currentCode(e))
+	assert.Equal(t, ErrInvalidToken, err, "should invalidate the challenge after too many attempts")
+}
+
+func TestMFARateLimit(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600}), WithHasher(fastHasher), WithClock(clock))
+	uid, _ := svr.CreateUser("elton", "123456")
+	e, _ := svr.EnrollTOTP(uid)
+	secret, _ := totpEncoding.DecodeString(e.Secret)
+	step := clock.Now().Unix() / totpPeriod
+	svr.VerifyTOTP(uid, totpCode(secret, step-1))
+	{
+		challenge, _ := svr.Authenticate("elton", "123456")
+		for i := 0; i < maxMFAAttempts-1; i++ {
+			svr.CompleteMFA(challenge, "000000")
+		}
+		challenge, _ = svr.Authenticate("elton", "123456")
+		_, err := svr.CompleteMFA(challenge, "000000")
+		assert.Equal(t, ErrInvalidCode, err, "should reject wrong codes")
+		_, err = svr.CompleteMFA(challenge, totpCode(secret, step))
+		assert.Equal(t, ErrRateLimited, err, "should count the wrong codes of the user across challenges")
+		_, err = svr.CompleteMFA(challenge, totpCode(secret, step))
+		assert.Equal(t, ErrInvalidToken, err, "should invalidate the challenge")
+		challenge, _ = svr.Authenticate("elton", "123456")
+		_, err = svr.CompleteMFA(challenge, totpCode(secret, step))
+		assert.Equal(t, ErrRateLimited, err, "should not give more codes on a new login")
+	}
+	{
+		clock.Advance(2 * time.Minute)
+		step = clock.Now().Unix() / totpPeriod
+		challenge, _ := svr.Authenticate("elton", "123456")
+		_, err := svr.CompleteMFA(challenge, totpCode(secret, step))
+		assert.Equal(t, nil, err, "should give attempts back over time")
+		for i := 0; i < maxMFAAttempts-1; i++ {
+			challenge, _ = svr.Authenticate("elton", "123456")
+			_, err = svr.CompleteMFA(challenge, "000000")
+		}
+		assert.Equal(t, ErrInvalidCode, err, "should restore the allowance on success")
+	}
+	{
+		cfg := &ServerConfig{TokenExpireSec: 3600, RateLimiter: &TokenBucket{Burst: 3, Clock: clock}}
+		svr, _ := New(WithConfig(cfg), WithHasher(fastHasher), WithClock(clock))
+		uid, _ := svr.CreateUser("elton", "123456")
+		e, _ := svr.EnrollTOTP(uid)
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		svr.VerifyTOTP(uid, totpCode(secret, step-1))
+		challenge, _ := svr.Authenticate("elton", "123456")
+		svr.CompleteMFA(challenge, "000000")
+		_, err := svr.CompleteMFA(challenge, "000000")
+		assert.Equal(t, ErrInvalidCode, err, "should reject wrong codes")
+		_, err = svr.Authenticate("elton", "123456")
+		assert.Equal(t, ErrRateLimited, err, "should share the allowance of the passwords")
+	}
+	{
+		limiter := &lockCheckLimiter{TokenBucket: TokenBucket{Burst: 10, Clock: clock}}
+		svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, RateLimiter: limiter}), WithHasher(fastHasher),
+			WithClock(clock))
+		limiter.svr = svr
+		uid, _ := svr.CreateUser("elton", "123456")
+		e, _ := svr.EnrollTOTP(uid)
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		svr.VerifyTOTP(uid, totpCode(secret, step-1))
+		challenge, _ := svr.Authenticate("elton", "123456")
+		svr.CompleteMFA(challenge, "000000")
+		_, err := svr.CompleteMFA(challenge, totpCode(secret, step))
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 0, limiter.locked, "should not call the rate limiter under the lock of the server")
+	}
+}
+
+// lockCheckLimiter counts the calls made while the server is locked.
+type lockCheckLimiter struct {
+	TokenBucket
+	svr    *Server
+	locked int
+}
+
+func (l *lockCheckLimiter) check() {
+	if l.svr.mu.TryLock() {
+		l.svr.mu.Unlock()
+	} else {
+		l.locked++
+	}
+}
+
+func (l *lockCheckLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	l.check()
+	return l.TokenBucket.Allow(ctx, key)
+}
+
+func (l *lockCheckLimiter) Reset(ctx context.Context, key string) error {
+	l.check()
+	return l.TokenBucket.Reset(ctx, key)
+}
@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// Tracer starts the spans of the server, see ServerConfig.Tracer. lib/authotel implements it with
+// OpenTelemetry; other tracing libraries only need a small adapter.
+//
+// Every public method that can fail gets a span named "auth.<Method>", and every storage call one
+// named "auth.store.<Method>", as a child of the span of the method when there is one. Token pruning
+// gets a root span named "auth.prune".
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and returns a context carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span. value is a string, bool or int64.
+	SetAttribute(key string, value interface{})
+	// End ends the span. err is the error of the operation, or nil.
+	End(err error)
+}
+
+// Attributes set on the spans. Users are identified by a hash of their ID, so that traces can be
+// correlated without exposing the IDs to the tracing backend.
+const (
+	AttrUserHash    = "auth.user_hash"
+	AttrActorHash   = "auth.actor_hash"  // of the actor of an impersonation token, see Impersonate
+	AttrOutcome     = "auth.outcome"     // OutcomeSuccess, OutcomeDenied or OutcomeError
+	AttrErrorClass  = "auth.error_class" // see ErrorClass, unset on success
+	AttrPrunedCount = "auth.pruned_tokens"
+)
+
+// Outcomes of the operations. An operation is denied if it fails on the credentials or rights of
+// the caller, or if a check (e.g. CheckRole) is false.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+// ErrorClass sorts the errors of the package into a few classes, e.g. for span attributes or
+// metrics labels: "not_found", "conflict", "unauthenticated", "mfa_required", "step_up_required",
+// "forbidden", "rate_limited", "invalid_argument", "unsupported", "unavailable", "canceled" and
+// "internal" for everything else.
+//
+// Returns: the class, "" for nil
+func ErrorClass(err error) string {
+	if e, ok := err.(*AuthError); ok {
+		err = e.sentinel()
+	}
+	switch err {
+	case nil:
+		return ""
+	case ErrUserNotExist, ErrRoleNotExist, ErrGroupNotExist, ErrAPIKeyNotExist, ErrRealmNotExist, ErrPolicyNotExist,
+		ErrRevisionUnavailable:
+		return "not_found"
+	case ErrUserExists, ErrRoleExists, ErrGroupExists, ErrRealmExists, ErrMFAEnrolled, ErrRoleProtected, ErrEmailExists:
+		return "conflict"
+	case ErrInvalidAuth, ErrInvalidToken, ErrInvalidCode:
+		return "unauthenticated"
+	case ErrMFARequired:
+		return "mfa_required"
+	case ErrStepUpRequired:
+		return "step_up_required"
+	case ErrUserSuspended, ErrInvalidScope, ErrTooManySessions, ErrEmailNotVerified, ErrImpersonationDenied:
+		return "forbidden"
+	case ErrRateLimited:
+		return "rate_limited"
+	case ErrTooManyUsers, ErrTooManyRoles, ErrTooManyTokens:
+		return "resource_exhausted"
+	case ErrWeakPassword, ErrBreachedPassword, ErrInvalidPermission, ErrInvalidCursor, ErrInvalidSort, ErrInvalidSpec, ErrBadImport,
+		ErrBadRecord, ErrInvalidSnapshot, ErrSnapshotTooNew, ErrInvalidConfig, ErrInvalidRealm, ErrHashFormat,
+		ErrNotServiceAccount, ErrMFANotEnrolled, ErrInvalidExpiry, ErrInvalidResource,
+		ErrInvalidAttribute, ErrInvalidPolicy, ErrInvalidMetadata, ErrInvalidEmail, ErrInvalidUsername:
+		return "invalid_argument"
+	case ErrUnsupported:
+		return "unsupported"
+	case ErrServerClosed:
+		return "unavailable"
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "canceled"
+	}
+	if errors.Is(err, ErrInvalidPolicy) {
+		return "invalid_argument"
+	}
+	return "internal"
+}
+
+// outcome tells the outcome of an operation that returned err.
+func outcome(err error) string {
+	switch ErrorClass(err) {
+	case "":
+		return OutcomeSuccess
+	case "unauthenticated", "mfa_required", "step_up_required", "forbidden", "rate_limited":
+		return OutcomeDenied
+	}
+	return OutcomeError
+}
+
+// userHash gives the value of AttrUserHash for a user.
+func userHash(id UserID) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(int64(id), 10)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// span wraps a Span with the attributes of the package. A nil span does nothing, so that the server
+// works the same without a Tracer.
+type span struct {
+	sp     Span
+	denied bool
+}
+
+type spanKey struct{}
+
+// startSpan starts a span with the Tracer of the server, if any.
+func (c *serverCore) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if c.cfg.Tracer == nil {
+		return ctx, nil
+	}
+	ctx, sp := c.cfg.Tracer.Start(ctx, name)
+	t := &span{sp: sp}
+	return context.WithValue(ctx, spanKey{}, t), t
+}
+
+// trace starts the span of a public method, and returns the server bound to its context, so that
+// the storage calls of the method are its children.
+//
+//	s, sp := s.trace("auth.Method")
+//	defer func() { sp.end(err) }()
+func (s *Server) trace(name string) (*Server, *span) {
+	if s.cfg.Tracer == nil {
+		return s, nil
+	}
+	ctx, sp := s.startSpan(s.ctx, name)
+	return &Server{serverCore: s.serverCore, ctx: ctx}, sp
+}
+
+// traceUser sets the user of the current span, if any.
+func (s *Server) traceUser(id UserID) {
+	if s.cfg.Tracer == nil {
+		return
+	}
+	if sp, _ := s.ctx.Value(spanKey{}).(*span); sp != nil {
+		sp.sp.SetAttribute(AttrUserHash, userHash(id))
+	}
+}
+
+// traceActor sets the actor of the current span, for impersonation tokens.
+func (s *Server) traceActor(id UserID) {
+	if s.cfg.Tracer == nil {
+		return
+	}
+	if sp, _ := s.ctx.Value(spanKey{}).(*span); sp != nil {
+		sp.sp.SetAttribute(AttrActorHash, userHash(id))
+	}
+}
+
+func (sp *span) set(key string, value interface{}) {
+	if sp != nil {
+		sp.sp.SetAttribute(key, value)
+	}
+}
+
+// check ends the span of a check, which is denied if ok is false.
+func (sp *span) check(ok bool, err error) {
+	if sp != nil && err == nil && !ok {
+		sp.denied = true
+	}
+	sp.end(err)
+}
+
+func (sp *span) end(err error) {
+	if sp == nil {
+		return
+	}
+	if o := outcome(err); sp.denied && o == OutcomeSuccess {
+		sp.sp.SetAttribute(AttrOutcome, OutcomeDenied)
+	} else {
+		sp.sp.SetAttribute(AttrOutcome, o)
+	}
+	if err != nil {
+		sp.sp.SetAttribute(AttrErrorClass, ErrorClass(err))
+	}
+	sp.sp.End(err)
+}
+
+// *-* Storage *-*
+
+// tracedStore gives the storage calls of a server their spans.
+type tracedStore struct {
+	Storage
+	svr *serverCore
+}
+
+// baseStore returns the storage given to NewServer, for the features that depend on its type.
+func (s *Server) baseStore() Storage {
+	store := s.store.(*closableStore).Storage
+	if c, ok := store.(*changeStore); ok {
+		store = c.Storage
+	}
+	if d, ok := store.(*decisionStore); ok {
+		store = d.Storage
+	}
+	if t, ok := store.(*tracedStore); ok {
+		store = t.Storage
+	}
+	if c, ok := store.(*cachedStore); ok {
+		store = c.Storage
+	}
+	if c, ok := store.(*cryptStore); ok {
+		return c.Storage
+	}
+	return store
+}
+
+func (t *tracedStore) start(ctx context.Context, method string) (context.Context, *span) {
+	return t.svr.startSpan(ctx, "auth.store."+method)
+}
+
+func (t *tracedStore) InsertUser(ctx context.Context, u *User) (err error) {
+	ctx, sp := t.start(ctx, "InsertUser")
+	defer func() { sp.end(err) }()
+	return t.Storage.InsertUser(ctx, u)
+}
+
+func (t *tracedStore) UpdateUser(ctx context.Context, u *User) (err error) {
+	ctx, sp := t.start(ctx, "UpdateUser")
+	defer func() { sp.end(err) }()
+	return t.Storage.UpdateUser(ctx, u)
+}
+
+func (t *tracedStore) DeleteUser(ctx context.Context, id UserID) (err error) {
+	ctx, sp := t.start(ctx, "DeleteUser")
+	defer func() { sp.end(err) }()
+	return t.Storage.DeleteUser(ctx, id)
+}
+
+func (t *tracedStore) GetUser(ctx context.Context, id UserID) (_ *User, err error) {
+	ctx, sp := t.start(ctx, "GetUser")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetUser(ctx, id)
+}
+
+func (t *tracedStore) GetUserByName(ctx context.Context, name string) (_ *User, err error) {
+	ctx, sp := t.start(ctx, "GetUserByName")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetUserByName(ctx, name)
+}
+
+func (t *tracedStore) UsersWithRole(ctx context.Context, role RoleID) (_ []UserID, err error) {
+	ctx, sp := t.start(ctx, "UsersWithRole")
+	defer func() { sp.end(err) }()
+	return t.Storage.UsersWithRole(ctx, role)
+}
+
+func (t *tracedStore) ListUsers(ctx context.Context, q *ListQuery) (_ []*User, err error) {
+	ctx, sp := t.start(ctx, "ListUsers")
+	defer func() { sp.end(err) }()
+	return t.Storage.ListUsers(ctx, q)
+}
+
+func (t *tracedStore) InsertRole(ctx context.Context, r *Role) (err error) {
+	ctx, sp := t.start(ctx, "InsertRole")
+	defer func() { sp.end(err) }()
+	return t.Storage.InsertRole(ctx, r)
+}
+
+func (t *tracedStore) UpdateRole(ctx context.Context, r *Role) (err error) {
+	ctx, sp := t.start(ctx, "UpdateRole")
+	defer func() { sp.end(err) }()
+	return t.Storage.UpdateRole(ctx, r)
+}
+
+func (t *tracedStore) DeleteRole(ctx context.Context, id RoleID) (err error) {
+	ctx, sp := t.start(ctx, "DeleteRole")
+	defer func() { sp.end(err) }()
+	return t.Storage.DeleteRole(ctx, id)
+}
+
+func (t *tracedStore) GetRole(ctx context.Context, id RoleID) (_ *Role, err error) {
+	ctx, sp := t.start(ctx, "GetRole")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetRole(ctx, id)
+}
+
+func (t *tracedStore) GetRoleByName(ctx context.Context, name string) (_ *Role, err error) {
+	ctx, sp := t.start(ctx, "GetRoleByName")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetRoleByName(ctx, name)
+}
+
+func (t *tracedStore) ListRoles(ctx context.Context, q *ListQuery) (_ []*Role, err error) {
+	ctx, sp := t.start(ctx, "ListRoles")
+	defer func() { sp.end(err) }()
+	return t.Storage.ListRoles(ctx, q)
+}
+
+func (t *tracedStore) InsertGroup(ctx context.Context, g *Group) (err error) {
+	ctx, sp := t.start(ctx, "InsertGroup")
+	defer func() { sp.end(err) }()
+	return t.Storage.InsertGroup(ctx, g)
+}
+
+func (t *tracedStore) UpdateGroup(ctx context.Context, g *Group) (err error) {
+	ctx, sp := t.start(ctx, "UpdateGroup")
+	defer func() { sp.end(err) }()
+	return t.Storage.UpdateGroup(ctx, g)
+}
+
+func (t *tracedStore) DeleteGroup(ctx context.Context, id GroupID) (err error) {
+	ctx, sp := t.start(ctx, "DeleteGroup")
+	defer func() { sp.end(err) }()
+	return t.Storage.DeleteGroup(ctx, id)
+}
+
+func (t *tracedStore) GetGroup(ctx context.Context, id GroupID) (_ *Group, err error) {
+	ctx, sp := t.start(ctx, "GetGroup")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetGroup(ctx, id)
+}
+
+func (t *tracedStore) GetGroupByName(ctx context.Context, name string) (_ *Group, err error) {
+	ctx, sp := t.start(ctx, "GetGroupByName")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetGroupByName(ctx, name)
+}
+
+func (t *tracedStore) GroupMembers(ctx context.Context, group GroupID) (_ []UserID, err error) {
+	ctx, sp := t.start(ctx, "GroupMembers")
+	defer func() { sp.end(err) }()
+	return t.Storage.GroupMembers(ctx, group)
+}
+
+func (t *tracedStore) InsertToken(ctx context.Context, tok *Token) (err error) {
+	ctx, sp := t.start(ctx, "InsertToken")
+	defer func() { sp.end(err) }()
+	return t.Storage.InsertToken(ctx, tok)
+}
+
+func (t *tracedStore) GetToken(ctx context.Context, v TokenValue) (_ *Token, err error) {
+	ctx, sp := t.start(ctx, "GetToken")
+	defer func() { sp.end(err) }()
+	return t.Storage.GetToken(ctx, v)
+}
+
+func (t *tracedStore) DeleteToken(ctx context.Context, v TokenValue) (err error) {
+	ctx, sp := t.start(ctx, "DeleteToken")
+	defer func() { sp.end(err) }()
+	return t.Storage.DeleteToken(ctx, v)
+}
+
+func (t *tracedStore) UserTokens(ctx context.Context, user UserID) (_ []*Token, err error) {
+	ctx, sp := t.start(ctx, "UserTokens")
+	defer func() { sp.end(err) }()
+	return t.Storage.UserTokens(ctx, user)
+}
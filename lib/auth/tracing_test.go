@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSpan struct {
+	name   string
+	parent *fakeSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (sp *fakeSpan) SetAttribute(key string, value interface{}) { sp.attrs[key] = value }
+func (sp *fakeSpan) End(err error)                              { sp.err, sp.ended = err, true }
+
+type fakeSpanKey struct{}
+
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, _ := ctx.Value(fakeSpanKey{}).(*fakeSpan)
+	sp := &fakeSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, sp)
+	return context.WithValue(ctx, fakeSpanKey{}, sp), sp
+}
+
+// take returns the spans started so far, and forgets them.
+func (t *fakeTracer) take() []*fakeSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := t.spans
+	t.spans = nil
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &fakeTracer{}
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithTracer(tracer), WithClock(clock), WithTokenTTL(time.Minute), WithPruneInterval(time.Minute))
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	tracer.take()
+	{
+		token, err := svr.Authenticate("elton", "123456")
+		assert.Equal(t, nil, err, "should success")
+		spans := tracer.take()
+		root := spans[0]
+		assert.Equal(t, "auth.Authenticate", root.name, "should trace the method")
+		assert.Equal(t, true, root.ended, "should end the span")
+		assert.Equal(t, OutcomeSuccess, root.attrs[AttrOutcome], "should set the outcome")
+		assert.Equal(t, userHash(uid), root.attrs[AttrUserHash], "should set the hashed user")
+		assert.Equal(t, 16, len(userHash(uid)), "should hash to 16 hex digits")
+		assert.Equal(t, "auth.store.GetUserByName", spans[1].name, "should trace storage calls")
+		assert.Equal(t, root, spans[1].parent, "should nest storage calls in the method")
+
+		ok, err := svr.CheckRole(token, rid)
+		assert.Equal(t, false, ok || err != nil, "should success")
+		spans = tracer.take()
+		assert.Equal(t, OutcomeDenied, spans[0].attrs[AttrOutcome], "should deny false checks")
+		assert.Equal(t, userHash(uid), spans[0].attrs[AttrUserHash], "should set the user of the token")
+	}
+	{
+		_, err := svr.Authenticate("elton", "wrong")
+		spans := tracer.take()
+		assert.Equal(t, ErrInvalidAuth, spans[0].err, "should end with the error")
+		assert.Equal(t, OutcomeDenied, spans[0].attrs[AttrOutcome], "should deny wrong passwords")
+		assert.Equal(t, "unauthenticated", spans[0].attrs[AttrErrorClass], "should set the error class")
+		assert.Equal(t, ErrInvalidAuth, err, "should not change the error")
+
+		svr.DeleteRole(rid + 1)
+		spans = tracer.take()
+		assert.Equal(t, OutcomeError, spans[0].attrs[AttrOutcome], "should fail on other errors")
+		assert.Equal(t, "not_found", spans[0].attrs[AttrErrorClass], "should set the error class")
+	}
+	{
+		svr.Authenticate("elton", "123456")
+		clock.Advance(5 * time.Minute)
+		svr.Authenticate("elton", "123456")
+		var prune *fakeSpan
+		for _, sp := range tracer.take() {
+			if sp.name == "auth.prune" {
+				prune = sp
+			}
+		}
+		assert.Equal(t, true, prune != nil && prune.parent == nil, "should trace pruning in a root span")
+		assert.Equal(t, int64(2), prune.attrs[AttrPrunedCount], "should count the pruned tokens")
+	}
+	{
+		assert.Equal(t, "canceled", ErrorClass(context.Canceled), "should classify context errors")
+		assert.Equal(t, "internal", ErrorClass(ErrInternal), "should classify other errors as internal")
+		assert.Equal(t, "", ErrorClass(nil), "should not classify nil")
+		var buf bytes.Buffer
+		assert.Equal(t, nil, svr.Save(&buf, false), "should still save the MemoryStorage behind the tracing")
+	}
+}
@@ -1,27 +1,98 @@
-package auth
-
-import (
-	"crypto/sha256"
-	"errors"
-)
-
-type UserID int64
-
-type User struct {
-	ID     UserID
-	Name   string
-	Secret []byte // password hash, default SHA-256
-	Roles  map[RoleID]*Role
-}
-
-var (
-	ErrWeakPassword = errors.New("password does not match requirements")
-	ErrUserExists   = errors.New("user already exists")
-	ErrUserNotExist = errors.New("user does not exist")
-	ErrInvalidAuth  = errors.New("authentication failed")
-)
-
-func getPasswordHash(pass string) []byte {
-	arr := sha256.Sum256([]byte(pass))
-	return arr[:]
-}
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"time"
+)
+
+type UserID int64
+
+type User struct {
+	ID      UserID
+	Name    string
+	Secret  []byte // password hash, in the format of the PasswordHasher that made it
+	Source  string `json:",omitempty"` // Authenticator verifying the password instead, see Identity
+	Roles   map[RoleID]*Role
+	Groups  []GroupID          `json:",omitempty"` // sorted
+	TOTP    *TOTP              `json:",omitempty"`
+	Status  UserStatus         `json:",omitempty"`
+	Kind    UserKind           `json:",omitempty"`
+	Deleted *Tombstone         `json:",omitempty"` // soft-deleted, see RestoreUser
+	APIKeys map[string]*APIKey `json:",omitempty"` // by ID, see CreateAPIKey
+	Logins  *LoginHistory      `json:",omitempty"` // see GetLoginHistory
+	// RoleExpiry has the expiry of the temporary assignments in Roles, see AddRoleToUserUntil.
+	RoleExpiry map[RoleID]time.Time `json:",omitempty"`
+	// Denied are the deny rules of the user, sorted, see DenyPermissionToUser.
+	Denied []string `json:",omitempty"`
+	// ResourceRoles are the roles of the user on resources, with the sorted resources of each, see
+	// AddRoleToUserOnResource. They are apart from Roles, which are global.
+	ResourceRoles map[RoleID][]string `json:",omitempty"`
+	// Attributes are for attribute-based access control, see SetUserAttribute.
+	Attributes Attributes `json:",omitempty"`
+	// Email is unique among users, see SetUserEmail. EmailVerified tells if it passed VerifyEmail.
+	Email         string `json:",omitempty"`
+	EmailVerified bool   `json:",omitempty"`
+	// Metadata are free-form fields for applications, see SetUserMetadata.
+	Metadata map[string]string `json:",omitempty"`
+	// SessionVersion is bumped by the downgrades of the user, see ServerConfig.SessionVersioning.
+	SessionVersion uint32 `json:",omitempty"`
+	// Sealed holds the secrets of the user encrypted at rest, in the storage only, see
+	// ServerConfig.KeyProvider.
+	Sealed *SealedSecrets `json:",omitempty"`
+}
+
+var (
+	ErrWeakPassword = newError("weak_password", http.StatusBadRequest, "password does not match requirements")
+	ErrUserExists   = newError("user_exists", http.StatusConflict, "user already exists")
+	ErrUserNotExist = newError("user_not_exist", http.StatusNotFound, "user does not exist")
+	ErrInvalidAuth  = newError("invalid_auth", http.StatusUnauthorized, "authentication failed")
+)
+
+// getPasswordHash is the unsalted SHA-256 hash used by early versions of this package.
+// It is only kept for ServerConfig.LegacySHA256.
+func getPasswordHash(pass string) []byte {
+	arr := sha256.Sum256([]byte(pass))
+	return arr[:]
+}
+
+// clone returns a copy of the user that shares no mutable state with the original.
+// The referenced roles are copied as well. It returns nil for a nil user.
+func (u *User) clone() *User {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.Secret = append([]byte(nil), u.Secret...)
+	c.Groups = append([]GroupID(nil), u.Groups...)
+	c.Denied = append([]string(nil), u.Denied...)
+	c.Attributes = u.Attributes.clone()
+	c.Metadata = mergeMetadata(nil, u.Metadata)
+	c.TOTP = u.TOTP.clone()
+	c.Deleted = u.Deleted.clone()
+	c.Logins = u.Logins.clone()
+	c.Sealed = u.Sealed.clone()
+	c.Roles = make(map[RoleID]*Role, len(u.Roles))
+	for id, role := range u.Roles {
+		c.Roles[id] = role.clone()
+	}
+	if u.RoleExpiry != nil {
+		c.RoleExpiry = make(map[RoleID]time.Time, len(u.RoleExpiry))
+		for id, exp := range u.RoleExpiry {
+			c.RoleExpiry[id] = exp
+		}
+	}
+	if u.ResourceRoles != nil {
+		c.ResourceRoles = make(map[RoleID][]string, len(u.ResourceRoles))
+		for id, resources := range u.ResourceRoles {
+			c.ResourceRoles[id] = append([]string(nil), resources...)
+		}
+	}
+	if u.APIKeys != nil {
+		c.APIKeys = make(map[string]*APIKey, len(u.APIKeys))
+		for id, k := range u.APIKeys {
+			c.APIKeys[id] = k.clone()
+		}
+	}
+	return &c
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"sort"
+	"time"
+)
+
+// UserData is everything stored about a user, in a machine-readable form for the access requests
+// of data subjects (GDPR Article 15), see ExportUserData. Secrets (the password hash, TOTP secret,
+// recovery codes and API key hashes) are left out, as they would let anyone holding the export log
+// in as the user.
+type UserData struct {
+	Exported      time.Time         `json:"exported"`
+	ID            UserID            `json:"id"`
+	Name          string            `json:"name"`
+	Email         string            `json:"email,omitempty"`
+	EmailVerified bool              `json:"email_verified,omitempty"`
+	Suspended     bool              `json:"suspended,omitempty"`
+	Service       bool              `json:"service,omitempty"`
+	Source        string            `json:"source,omitempty"`  // the Authenticator of external users
+	Deleted       *time.Time        `json:"deleted,omitempty"` // when it was soft-deleted
+	MFA           bool              `json:"mfa,omitempty"`     // enrolled in TOTP
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Attributes    Attributes        `json:"attributes,omitempty"`
+	Denied        []string          `json:"denied,omitempty"`
+	// Roles are held globally, or on the listed resources, by ID
+	Roles    []UserDataRole    `json:"roles,omitempty"`
+	Groups   []UserDataGroup   `json:"groups,omitempty"`
+	Sessions []UserDataSession `json:"sessions,omitempty"` // oldest first, none in JWT mode
+	APIKeys  []UserDataAPIKey  `json:"api_keys,omitempty"` // oldest first
+	Logins   []UserDataLogin   `json:"logins,omitempty"`   // newest first, see GetLoginHistory
+}
+
+// UserDataRole is a role of a user in UserData.
+type UserDataRole struct {
+	ID        RoleID     `json:"id"`
+	Name      string     `json:"name"`
+	Resources []string   `json:"resources,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"` // of temporary roles
+}
+
+// UserDataGroup is a group of a user in UserData.
+type UserDataGroup struct {
+	ID   GroupID `json:"id"`
+	Name string  `json:"name"`
+}
+
+// UserDataSession is a session token of a user in UserData, see TokenInfo.
+type UserDataSession struct {
+	ID        string    `json:"id"`
+	Issued    time.Time `json:"issued"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Actor     UserID    `json:"actor_id,omitempty"` // for impersonation tokens
+}
+
+// UserDataAPIKey is an API key of a user in UserData, see APIKeyInfo.
+type UserDataAPIKey struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// UserDataLogin is a login of a user in UserData, see LoginRecord.
+type UserDataLogin struct {
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// ExportUserData gathers everything stored about a user, soft-deleted ones included: its profile,
+// roles and groups, sessions, API keys and login history. It is encoded with encoding/json.
+//
+// Returns: the data of the user
+// Errors: ErrUserNotExist
+func (s *Server) ExportUserData(user UserID) (_ *UserData, err error) {
+	s, sp := s.trace("auth.ExportUserData")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, err := s.store.GetUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	d := &UserData{
+		Exported:      s.now(),
+		ID:            u.ID,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Suspended:     u.Status == UserSuspended,
+		Service:       u.Kind == UserService,
+		Source:        u.Source,
+		MFA:           u.TOTP != nil && u.TOTP.Confirmed,
+		Metadata:      mergeMetadata(nil, u.Metadata),
+		Attributes:    u.Attributes.clone(),
+		Denied:        append([]string(nil), u.Denied...),
+	}
+
+	roles := make([]RoleID, 0, len(u.Roles))
+	for id := range u.Roles {
+		roles = append(roles, id)
+	}
+	groups := u.Groups
+	if u.Deleted != nil {
+		on := u.Deleted.On
+		d.Deleted = &on
+		roles, groups = append(roles, u.Deleted.Roles...), u.Deleted.Groups
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	for _, id := range roles {
+		r, err := s.store.GetRole(ctx, id)
+		if err == ErrRoleNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entry := UserDataRole{ID: id, Name: r.Name}
+		if t, ok := u.RoleExpiry[id]; ok {
+			entry.Expires = &t
+		}
+		d.Roles = append(d.Roles, entry)
+	}
+	resourceRoles := make([]RoleID, 0, len(u.ResourceRoles))
+	for id := range u.ResourceRoles {
+		resourceRoles = append(resourceRoles, id)
+	}
+	sort.Slice(resourceRoles, func(i, j int) bool { return resourceRoles[i] < resourceRoles[j] })
+	for _, id := range resourceRoles {
+		r, err := s.store.GetRole(ctx, id)
+		if err == ErrRoleNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		d.Roles = append(d.Roles, UserDataRole{ID: id, Name: r.Name, Resources: append([]string(nil), u.ResourceRoles[id]...)})
+	}
+	for _, id := range groups {
+		g, err := s.store.GetGroup(ctx, id)
+		if err == ErrGroupNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		d.Groups = append(d.Groups, UserDataGroup{ID: id, Name: g.Name})
+	}
+
+	if s.jwt == nil {
+		tokens, err := s.store.UserTokens(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tokens {
+			if t.Kind == TokenSession && d.Exported.Before(t.Expires) {
+				d.Sessions = append(d.Sessions, UserDataSession{ID: t.ID(), Issued: t.Issued, Expires: t.Expires,
+					IP: t.Client.IP, UserAgent: t.Client.UserAgent, Device: t.Client.Device, Actor: t.Actor})
+			}
+		}
+		sort.SliceStable(d.Sessions, func(i, j int) bool { return d.Sessions[i].Issued.Before(d.Sessions[j].Issued) })
+	}
+	for id, k := range u.APIKeys {
+		key := UserDataAPIKey{ID: id, Name: k.Name, Scopes: append([]string(nil), k.Scopes...), Created: k.Created}
+		if !k.Expires.IsZero() {
+			t := k.Expires
+			key.Expires = &t
+		}
+		if !k.LastUsed.IsZero() {
+			t := k.LastUsed
+			key.LastUsed = &t
+		}
+		d.APIKeys = append(d.APIKeys, key)
+	}
+	sort.Slice(d.APIKeys, func(i, j int) bool {
+		if !d.APIKeys[i].Created.Equal(d.APIKeys[j].Created) {
+			return d.APIKeys[i].Created.Before(d.APIKeys[j].Created)
+		}
+		return d.APIKeys[i].ID < d.APIKeys[j].ID
+	})
+	d.Logins = exportLogins(u.Logins)
+	return d, nil
+}
+
+// exportLogins lists the recent logins of a history, and its last success and failure if they are
+// older, newest first.
+func exportLogins(h *LoginHistory) []UserDataLogin {
+	if h == nil {
+		return nil
+	}
+	records := append([]LoginRecord(nil), h.Recent...)
+	for _, last := range []*LoginRecord{h.LastSuccess, h.LastFailure} {
+		if last != nil && (len(h.Recent) == 0 || last.Time.Before(h.Recent[0].Time)) {
+			records = append(records, *last)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.After(records[j].Time) })
+	list := make([]UserDataLogin, len(records))
+	for i, r := range records {
+		list[i] = UserDataLogin{Time: r.Time, Success: r.Success, IP: r.IP, UserAgent: r.UserAgent}
+	}
+	return list
+}
+
+// EraseUser removes a user and everything stored about it, for the erasure requests of data
+// subjects (GDPR Article 17): its profile, roles and groups, tokens (even with LazyCleanup), API
+// keys and login history. Unlike DeleteUser, it is never kept for SoftDeleteSec, and it erases
+// soft-deleted users as well. Anomaly detectors forget the user.
+//
+// Events already delivered are out of reach of the server: EraseUser emits a user.erased event,
+// carrying only the user ID, in place of user.deleted, for subscribers keeping an audit trail to
+// anonymize the entries of the user, e.g. by dropping its name, email and IPs while keeping the ID.
+//
+// Returns: none
+// Errors: ErrUserNotExist
+func (s *Server) EraseUser(user UserID) (err error) {
+	s, sp := s.trace("auth.EraseUser")
+	defer func() { sp.end(err) }()
+	s.traceUser(user)
+	ctx := s.ctx
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userObj, err := s.store.GetUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	tokens, err := s.store.UserTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := s.store.DeleteToken(ctx, t.Value); err != nil {
+			return err
+		}
+	}
+	if err := s.store.DeleteUser(ctx, user); err != nil {
+		return err
+	}
+
+	s.events.mu.Lock()
+	detectors := make([]*detector, 0, len(s.events.detectors))
+	for d := range s.events.detectors {
+		detectors = append(detectors, d)
+	}
+	s.events.mu.Unlock()
+	for _, d := range detectors {
+		d.forget(user, userObj.Name)
+	}
+	s.emit(Event{Type: EventUserErased, User: user})
+	return nil
+}
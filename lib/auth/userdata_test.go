@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportUserData(t *testing.T) {
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, SoftDeleteSec: 3600}), WithClock(clock), WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	clerk, _ := svr.CreateRole("clerk")
+	editor, _ := svr.CreateRole("editor")
+	staff, _ := svr.CreateGroup("staff")
+	svr.AddRoleToUserUntil(anna, clerk, clock.Now().Add(time.Hour))
+	svr.AddRoleToUserOnResource(anna, editor, "docs:1")
+	svr.AddUserToGroup(anna, staff)
+	svr.SetUserEmail(anna, "anna@example.com")
+	svr.SetUserMetadata(anna, map[string]string{"team": "payments"})
+	svr.CreateAPIKey(anna, "ci", nil, time.Time{})
+	svr.AuthenticateClient("anna", "wrong", ClientInfo{IP: "203.0.113.9"})
+	clock.Advance(time.Minute)
+	svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: "198.51.100.1", UserAgent: "curl"})
+	{
+		d, err := svr.ExportUserData(anna)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "anna", d.Name, "should give the name")
+		assert.Equal(t, "anna@example.com", d.Email, "should give the email")
+		assert.Equal(t, map[string]string{"team": "payments"}, d.Metadata, "should give the metadata")
+		expires := clock.Now().Add(-time.Minute).Add(time.Hour)
+		assert.Equal(t, []UserDataRole{{ID: clerk, Name: "clerk", Expires: &expires}, {ID: editor, Name: "editor", Resources: []string{"docs:1"}}},
+			d.Roles, "should give the roles, global or on resources")
+		assert.Equal(t, []UserDataGroup{{ID: staff, Name: "staff"}}, d.Groups, "should give the groups")
+		assert.Equal(t, 1, len(d.Sessions), "should give the sessions")
+		assert.Equal(t, "198.51.100.1", d.Sessions[0].IP, "should give the clients of the sessions")
+		assert.Equal(t, "ci", d.APIKeys[0].Name, "should give the API keys")
+		assert.Equal(t, []UserDataLogin{
+			{Time: clock.Now(), Success: true, IP: "198.51.100.1", UserAgent: "curl"},
+			{Time: clock.Now().Add(-time.Minute), IP: "203.0.113.9"},
+		}, d.Logins, "should give the logins, newest first")
+		b, _ := json.Marshal(d)
+		assert.NotContains(t, string(b), "argon2", "should leave out the password hash")
+	}
+	{
+		svr.DeleteUser(anna)
+		d, err := svr.ExportUserData(anna)
+		assert.Equal(t, nil, err, "should export soft-deleted users")
+		assert.Equal(t, clock.Now(), *d.Deleted, "should tell when the user was deleted")
+		assert.Equal(t, 1, len(d.Groups), "should give the groups kept in the tombstone")
+	}
+	{
+		_, err := svr.ExportUserData(404)
+		assert.Equal(t, ErrUserNotExist, err, "should reject unknown users")
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	store := NewMemoryStorage()
+	svr, _ := New(WithConfig(&ServerConfig{TokenExpireSec: 3600, SoftDeleteSec: 3600, LazyCleanup: true}), WithStorage(store), WithHasher(fastHasher))
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	elton, _ := svr.CreateUser("elton", "123456")
+	token, _ := svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: "198.51.100.1"})
+	svr.AuthenticateClient("elton", "123456", ClientInfo{IP: "198.51.100.2"})
+	stop := svr.DetectAnomalies(&AnomalyConfig{Locate: func(string) (float64, float64, bool) { return 51.5, 0, true }})
+	defer stop()
+	svr.AuthenticateClient("anna", "passw0rd", ClientInfo{IP: "198.51.100.1"})
+	for i := 0; i < 100 && len(detectorPlaces(svr)) == 0; i++ {
+		time.Sleep(2 * time.Millisecond)
+	}
+	next, cancel := collect(svr, EventUserErased, EventUserDeleted)
+	defer cancel()
+	{
+		assert.Equal(t, nil, svr.EraseUser(anna), "should success")
+		_, err := store.GetUser(context.Background(), anna)
+		assert.Equal(t, ErrUserNotExist, err, "should not keep a tombstone")
+		tokens, _ := store.UserTokens(context.Background(), anna)
+		assert.Equal(t, 0, len(tokens), "should delete the tokens despite lazy cleanup")
+		_, err = svr.TokenUser(token)
+		assert.Equal(t, ErrInvalidToken, err, "should reject the tokens")
+		assert.Equal(t, Event{Type: EventUserErased, User: anna}, withoutTime(next(1)[0]), "should emit user.erased with the ID only")
+		assert.Equal(t, []UserID(nil), detectorPlaces(svr), "should make the detectors forget the user")
+		assert.Equal(t, "elton", svr.GetUser(elton).Name, "should keep other users")
+	}
+	{
+		svr.DeleteUser(elton)
+		assert.Equal(t, nil, svr.EraseUser(elton), "should erase soft-deleted users")
+		_, err := store.GetUser(context.Background(), elton)
+		assert.Equal(t, ErrUserNotExist, err, "should remove the tombstone")
+		assert.Equal(t, ErrUserNotExist, svr.EraseUser(elton), "should reject unknown users")
+	}
+}
+
+// detectorPlaces lists the users whose last place the detectors of a server know.
+func detectorPlaces(svr *Server) []UserID {
+	var users []UserID
+	svr.events.mu.Lock()
+	defer svr.events.mu.Unlock()
+	for d := range svr.events.detectors {
+		d.mu.Lock()
+		for id := range d.places {
+			users = append(users, id)
+		}
+		d.mu.Unlock()
+	}
+	return users
+}
+
+func withoutTime(e Event) Event {
+	e.Time = time.Time{}
+	return e
+}
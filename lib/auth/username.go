@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// UsernamePolicy describes the requirements for the names of new users, see
+// ServerConfig.UsernamePolicy. Lengths are counted in Unicode characters. Zero values disable a
+// rule, except MinLength which defaults to 1. Names never contain spaces or control characters.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+
+	// AllowedChars, if set, limits names to letters, digits and the characters it contains, such
+	// as "._-@".
+	AllowedChars string
+	// Reserved names are rejected case-insensitively, e.g. "admin" or "root".
+	Reserved []string
+
+	// CaseInsensitive makes names compare regardless of case and Unicode normalization form: they
+	// are saved, and looked up, as given by Normalize. Names saved before keep their form, and are
+	// still found when given exactly.
+	CaseInsensitive bool
+}
+
+var ErrInvalidUsername = newError("invalid_username", http.StatusBadRequest, "invalid username")
+
+// Check tells if a name, as given by Normalize, satisfies the policy.
+//
+// Returns: none
+// Errors: ErrInvalidUsername
+func (p *UsernamePolicy) Check(name string) error {
+	n := utf8.RuneCountInString(name)
+	min := p.MinLength
+	if min <= 0 {
+		min = 1
+	}
+	if n < min || (p.MaxLength > 0 && n > p.MaxLength) || !utf8.ValidString(name) {
+		return ErrInvalidUsername
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return ErrInvalidUsername
+		}
+		if p.AllowedChars != "" && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(p.AllowedChars, r) {
+			return ErrInvalidUsername
+		}
+	}
+	folded := foldUsername(name)
+	for _, reserved := range p.Reserved {
+		if folded == foldUsername(reserved) {
+			return ErrInvalidUsername
+		}
+	}
+	return nil
+}
+
+// Normalize gives the form in which a name is saved and looked up: with CaseInsensitive, that is
+// its NFKC normalization in lower case, so that "Anna" and "ＡＮＮＡ" are "anna". Otherwise, it is
+// the name unchanged.
+func (p *UsernamePolicy) Normalize(name string) string {
+	if p == nil || !p.CaseInsensitive {
+		return name
+	}
+	return foldUsername(name)
+}
+
+func foldUsername(name string) string {
+	return strings.ToLower(norm.NFKC.String(name))
+}
+
+// *-* Server *-*
+
+// checkUsername checks the name of a new local user, once normalized, against the UsernamePolicy,
+// if any. The user is saved with the normalized name, and looked up with the given one.
+//
+// Errors: ErrInvalidUsername
+func (s *Server) checkUsername(name string) error {
+	p := s.cfg.UsernamePolicy
+	if p == nil {
+		return nil
+	}
+	return p.Check(p.Normalize(name))
+}
+
+// lookupUserByName is store.GetUserByName with the name normalized by the UsernamePolicy, falling
+// back on the name as given, for users saved before the policy.
+func (s *Server) lookupUserByName(ctx context.Context, name string) (*User, error) {
+	key := s.cfg.UsernamePolicy.Normalize(name)
+	u, err := s.store.GetUserByName(ctx, key)
+	if err == ErrUserNotExist && key != name {
+		u, err = s.store.GetUserByName(ctx, name)
+	}
+	return u, err
+}
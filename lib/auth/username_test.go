@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsernamePolicy(t *testing.T) {
+	p := &UsernamePolicy{MinLength: 3, MaxLength: 8, AllowedChars: "._-", Reserved: []string{"admin", "root"}}
+	{
+		assert.Equal(t, nil, p.Check("anna.k"), "should accept letters, digits and allowed symbols")
+		assert.Equal(t, nil, p.Check("élodie"), "should accept any letter")
+		assert.Equal(t, ErrInvalidUsername, p.Check("an"), "should check the minimum length")
+		assert.Equal(t, ErrInvalidUsername, p.Check("annabella"), "should check the maximum length")
+		assert.Equal(t, ErrInvalidUsername, p.Check("anna+k"), "should check the characters")
+		assert.Equal(t, ErrInvalidUsername, p.Check("Admin"), "should reserve names regardless of case")
+		assert.Equal(t, ErrInvalidUsername, (&UsernamePolicy{}).Check("anna k"), "should reject spaces")
+		assert.Equal(t, ErrInvalidUsername, (&UsernamePolicy{}).Check(""), "should reject empty names")
+	}
+	{
+		assert.Equal(t, "Anna", p.Normalize("Anna"), "should keep the case by default")
+		p.CaseInsensitive = true
+		assert.Equal(t, "anna", p.Normalize("ＡＮＮＡ"), "should fold the case and the width")
+		assert.Equal(t, "élodie", p.Normalize("Élodie"), "should compose accents")
+	}
+}
+
+func TestUsernameLookup(t *testing.T) {
+	store := NewMemoryStorage()
+	{
+		svr, _ := New(WithStorage(store), WithHasher(fastHasher))
+		svr.CreateUser("Elton", "123456")
+	}
+	cfg := &ServerConfig{TokenExpireSec: 3600, UsernamePolicy: &UsernamePolicy{Reserved: []string{"root"}, CaseInsensitive: true}}
+	svr, _ := New(WithConfig(cfg), WithStorage(store), WithHasher(fastHasher))
+	{
+		uid, err := svr.CreateUser("Anna", "passw0rd")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "anna", svr.GetUser(uid).Name, "should save the normalized name")
+		_, err = svr.CreateUser("ANNA", "passw0rd")
+		assert.Equal(t, ErrUserExists, err, "should not create the same name in another case")
+		_, err = svr.Authenticate("aNNa", "passw0rd")
+		assert.Equal(t, nil, err, "should log in regardless of case")
+		_, err = svr.CreateUser("Root", "passw0rd")
+		assert.Equal(t, ErrInvalidUsername, err, "should check the policy")
+		_, _, err = svr.CreateServiceAccount("root")
+		assert.Equal(t, ErrInvalidUsername, err, "should check service accounts")
+	}
+	{
+		_, err := svr.Authenticate("Elton", "123456")
+		assert.Equal(t, nil, err, "should find names saved before the policy")
+		_, err = svr.CreateUser("Elton", "123456")
+		assert.Equal(t, ErrUserExists, err, "should not shadow names saved before the policy")
+	}
+	{
+		res, err := svr.ImportUsers(strings.NewReader(`{"name": "Dora", "password": "passw0rd"}`+"\n"+`{"name": "root", "password": "passw0rd"}`), FormatJSON)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []ImportFailure{{Line: 2, Name: "root", Err: ErrInvalidUsername}}, res.Failed, "should check imported names")
+		assert.NotEqual(t, (*User)(nil), svr.GetUserByName("DORA"), "should normalize imported names")
+	}
+}
@@ -0,0 +1,164 @@
+package walstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth/storagetest"
+)
+
+var testConfig = &auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	svr, s, err := NewWALServer(testConfig, dir, &Options{CompactEvery: -1})
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("elton", "123456")
+	svr.CreateUser("fred", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	rid2, _ := svr.CreateRole("plugdev")
+	svr.AddRoleToUser(uid, rid)
+	svr.AddRoleToUser(uid, rid2)
+	svr.GrantPermissionToRole(rid, "devices:scan")
+	svr.DeleteRole(rid2)
+	gid, _ := svr.CreateGroup("staff")
+	rid3, _ := svr.CreateRole("printer")
+	svr.AddRoleToGroup(gid, rid3)
+	svr.AddUserToGroup(uid, gid)
+	token, _ := svr.Authenticate("elton", "123456")
+	revoked, _ := svr.Authenticate("fred", "123456")
+	svr.Invalidate(revoked)
+	// Simulate a crash: the log is not compacted
+	s.log.Close()
+
+	svr, s, err = NewWALServer(testConfig, dir, nil)
+	assert.Equal(t, nil, err, "should success")
+	defer s.Close()
+	ok, err := svr.CheckPermission(token, "devices:scan")
+	assert.Equal(t, nil, err, "should restore tokens")
+	assert.Equal(t, true, ok, "should restore roles, assignments and permissions")
+	_, err = svr.TokenUser(revoked)
+	assert.Equal(t, auth.ErrInvalidToken, err, "should replay invalidations")
+	assert.Equal(t, (*auth.Role)(nil), svr.GetRole(rid2), "should replay deletions")
+	ok, _ = svr.CheckRole(token, rid3)
+	assert.Equal(t, true, ok, "should restore groups and memberships")
+	_, err = svr.Authenticate("fred", "123456")
+	assert.Equal(t, nil, err, "should restore passwords")
+	newUser, _ := svr.CreateUser("gina", "123456")
+	assert.Equal(t, auth.UserID(3), newUser, "should continue the IDs")
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFile)
+	svr, s, _ := NewWALServer(testConfig, dir, &Options{CompactEvery: 3})
+	svr.CreateUser("elton", "123456")
+	svr.CreateUser("fred", "123456")
+	info, _ := os.Stat(logPath)
+	assert.NotEqual(t, int64(0), info.Size(), "should log the writes")
+	svr.CreateRole("scanner")
+	info, _ = os.Stat(logPath)
+	assert.Equal(t, int64(0), info.Size(), "should compact after 3 records")
+	svr.CreateRole("plugdev")
+	assert.Equal(t, nil, s.Close(), "should success")
+	assert.Equal(t, ErrClosed, s.InsertRole(ctx, &auth.Role{Name: "printer"}), "should not accept writes after Close")
+	assert.Equal(t, nil, s.Close(), "should be idempotent")
+
+	// A crash between writing the snapshot and emptying the log leaves records that are in both
+	s, _ = Open(dir, &Options{CompactEvery: -1})
+	s.InsertRole(ctx, &auth.Role{Name: "printer"})
+	log, _ := os.ReadFile(logPath)
+	assert.Equal(t, nil, s.Compact(), "should success")
+	s.log.Close()
+	os.WriteFile(logPath, log, 0o600)
+
+	s, err := Open(dir, nil)
+	assert.Equal(t, nil, err, "should skip the records in the snapshot")
+	r, _ := s.GetRoleByName(ctx, "printer")
+	assert.Equal(t, auth.RoleID(3), r.ID, "should keep the data")
+	s.Close()
+}
+
+func TestSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	svr, s, _ := NewWALServer(testConfig, dir, &Options{CompactEvery: -1})
+	svr.CreateUser("elton", "123456")
+	var snap bytes.Buffer
+	assert.Equal(t, nil, s.Save(&snap, false), "should success")
+	svr.CreateUser("fred", "123456")
+
+	assert.Equal(t, auth.ErrInvalidSnapshot, s.Load(strings.NewReader("{")), "should check the snapshot")
+	assert.Equal(t, nil, s.Load(bytes.NewReader(snap.Bytes())), "should success")
+	assert.Equal(t, (*auth.User)(nil), svr.GetUserByName("fred"), "should replace the data")
+	info, _ := os.Stat(filepath.Join(dir, logFile))
+	assert.Equal(t, int64(0), info.Size(), "should compact")
+	s.Close()
+
+	s, _ = Open(dir, nil)
+	_, err := s.GetUserByName(ctx, "elton")
+	assert.Equal(t, nil, err, "should persist the loaded data")
+	_, err = s.GetUserByName(ctx, "fred")
+	assert.Equal(t, auth.ErrUserNotExist, err, "should persist the loaded data")
+	s.Close()
+}
+
+func TestTornLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFile)
+	s, _ := Open(dir, nil)
+	s.InsertRole(ctx, &auth.Role{Name: "scanner"})
+	s.log.Close()
+	f, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"Seq": 2, "Op": "insert_ro`)
+	f.Close()
+
+	s, err := Open(dir, nil)
+	assert.Equal(t, nil, err, "should ignore an incomplete last record")
+	_, err = s.GetRoleByName(ctx, "scanner")
+	assert.Equal(t, nil, err, "should keep the complete records")
+	assert.Equal(t, nil, s.InsertRole(ctx, &auth.Role{Name: "plugdev"}), "should success")
+	s.log.Close()
+	s, _ = Open(dir, nil)
+	_, err = s.GetRoleByName(ctx, "plugdev")
+	assert.Equal(t, nil, err, "should append after the complete records")
+	s.Close()
+
+	os.WriteFile(logPath, []byte("garbage\n{}\n"), 0o600)
+	_, err = Open(dir, nil)
+	assert.Equal(t, ErrCorruptLog, err, "should reject a corrupt log")
+}
+
+func TestSkipTokens(t *testing.T) {
+	dir := t.TempDir()
+	svr, s, _ := NewWALServer(testConfig, dir, &Options{SkipTokens: true})
+	svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	s.Close()
+
+	svr, s, _ = NewWALServer(testConfig, dir, &Options{SkipTokens: true})
+	defer s.Close()
+	_, err := svr.TokenUser(token)
+	assert.Equal(t, auth.ErrInvalidToken, err, "should not persist tokens")
+	assert.Equal(t, "elton", svr.GetUserByName("elton").Name, "should persist users")
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) auth.Storage {
+		s, err := Open(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -0,0 +1,537 @@
+// Package walstore implements auth.Storage in memory, made durable by a write-ahead log.
+//
+// Every write is appended to a log file (and synced) before it is acknowledged. On startup, the
+// store loads the last snapshot and replays the log on top of it. Compaction writes a new snapshot
+// and empties the log, so that the log does not grow forever.
+//
+// The files are kept in a directory:
+//
+//	snapshot.json  the snapshot header (a JSON line), followed by an auth.MemoryStorage snapshot
+//	wal.log        one JSON record per line, numbered
+//
+// Only one process may open a directory at a time.
+package walstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.log"
+)
+
+// Options customizes a Store. The zero value is usable.
+type Options struct {
+	// CompactEvery triggers a compaction after this many records have been logged.
+	// 0 means 10000. Use a negative number to only compact when Compact is called.
+	CompactEvery int
+	// SkipTokens keeps tokens in memory only, so users have to log in again after a restart.
+	// Otherwise tokens, which are credentials, are written to disk.
+	SkipTokens bool
+	// NoSync skips fsync after each record. Writes are faster, but the last records may be lost
+	// if the machine (not just the process) crashes.
+	NoSync bool
+}
+
+// Store is an auth.Storage backed by an auth.MemoryStorage and a write-ahead log.
+type Store struct {
+	dir  string
+	opts Options
+	mem  *auth.MemoryStorage
+
+	// mu serializes writes, so that records are logged in the order they are applied.
+	mu      sync.Mutex
+	log     *os.File
+	seq     uint64 // of the last record
+	pending int    // records since the last compaction
+	// err is set when the log cannot be written. The store stops accepting writes, because
+	// the memory would be ahead of the disk.
+	err error
+}
+
+// record is a line of the log. Op tells which of the other fields are set.
+type record struct {
+	Seq     uint64
+	Op      string
+	User    *auth.User      `json:",omitempty"`
+	Role    *auth.Role      `json:",omitempty"`
+	Group   *auth.Group     `json:",omitempty"`
+	Token   *auth.Token     `json:",omitempty"`
+	UserID  auth.UserID     `json:",omitempty"`
+	RoleID  auth.RoleID     `json:",omitempty"`
+	GroupID auth.GroupID    `json:",omitempty"`
+	Value   auth.TokenValue `json:",omitempty"`
+}
+
+const (
+	opInsertUser  = "insert_user"
+	opUpdateUser  = "update_user"
+	opDeleteUser  = "delete_user"
+	opInsertRole  = "insert_role"
+	opUpdateRole  = "update_role"
+	opDeleteRole  = "delete_role"
+	opInsertGroup = "insert_group"
+	opUpdateGroup = "update_group"
+	opDeleteGroup = "delete_group"
+	opInsertToken = "insert_token"
+	opDeleteToken = "delete_token"
+)
+
+// snapshotHeader is the first line of the snapshot file.
+type snapshotHeader struct {
+	// Seq is the last record included in the snapshot. Older records are skipped on replay, in
+	// case the process crashed between writing a snapshot and emptying the log.
+	Seq uint64
+}
+
+var (
+	ErrCorruptLog = errors.New("write-ahead log is corrupt")
+	ErrClosed     = errors.New("store is closed")
+)
+
+// Open opens the store in dir, creating the directory if needed, and replays the log.
+// An incomplete last record, as left by a crash while writing it, is discarded.
+//
+// Returns: pointer to the store
+// Errors: ErrCorruptLog, auth.ErrInvalidSnapshot, auth.ErrSnapshotTooNew, or any error from the file system
+func Open(dir string, opts *Options) (*Store, error) {
+	s := &Store{dir: dir, mem: auth.NewMemoryStorage()}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.CompactEvery == 0 {
+		s.opts.CompactEvery = 10000
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewWALServer creates an auth.Server that persists its data in dir. Close the returned store
+// when done.
+//
+// Returns: pointer to the new server instance, and the store
+// Errors: auth.ErrInvalidConfig, plus those of Open
+func NewWALServer(config *auth.ServerConfig, dir string, opts *Options) (*auth.Server, *Store, error) {
+	s, err := Open(dir, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	svr, err := auth.NewServer(config, s)
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	return svr, s, nil
+}
+
+func (s *Store) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return auth.ErrInvalidSnapshot
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return auth.ErrInvalidSnapshot
+	}
+	if err := s.mem.Load(r); err != nil {
+		return err
+	}
+	s.seq = header.Seq
+	return nil
+}
+
+// replay applies the records of the log newer than the snapshot, and opens the log for appending.
+func (s *Store) replay() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	var (
+		r     = bufio.NewReader(f)
+		valid int64 // length of the complete records
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline is a record that was not completely written
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, err := r.Peek(1); err == io.EOF {
+				// The last record can be garbled by a crash
+				break
+			}
+			f.Close()
+			return ErrCorruptLog
+		}
+		if rec.Seq > s.seq {
+			if err := s.apply(&rec); err != nil {
+				f.Close()
+				return ErrCorruptLog
+			}
+			s.seq = rec.Seq
+			s.pending++
+		}
+		valid += int64(len(line))
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.log = f
+	return nil
+}
+
+// apply performs a record on the memory storage.
+func (s *Store) apply(rec *record) error {
+	ctx := context.Background()
+	switch {
+	case (rec.Op == opInsertUser || rec.Op == opUpdateUser) && rec.User == nil,
+		(rec.Op == opInsertRole || rec.Op == opUpdateRole) && rec.Role == nil,
+		(rec.Op == opInsertGroup || rec.Op == opUpdateGroup) && rec.Group == nil,
+		rec.Op == opInsertToken && rec.Token == nil:
+		return ErrCorruptLog
+	}
+	switch rec.Op {
+	case opInsertUser:
+		return s.mem.InsertUser(ctx, rec.User)
+	case opUpdateUser:
+		return s.mem.UpdateUser(ctx, rec.User)
+	case opDeleteUser:
+		return s.mem.DeleteUser(ctx, rec.UserID)
+	case opInsertRole:
+		return s.mem.InsertRole(ctx, rec.Role)
+	case opUpdateRole:
+		return s.mem.UpdateRole(ctx, rec.Role)
+	case opDeleteRole:
+		return s.mem.DeleteRole(ctx, rec.RoleID)
+	case opInsertGroup:
+		return s.mem.InsertGroup(ctx, rec.Group)
+	case opUpdateGroup:
+		return s.mem.UpdateGroup(ctx, rec.Group)
+	case opDeleteGroup:
+		return s.mem.DeleteGroup(ctx, rec.GroupID)
+	case opInsertToken:
+		if time.Now().After(rec.Token.Expires) {
+			// Nobody would remove it from memory
+			return nil
+		}
+		return s.mem.InsertToken(ctx, rec.Token)
+	case opDeleteToken:
+		return s.mem.DeleteToken(ctx, rec.Value)
+	}
+	return ErrCorruptLog
+}
+
+// write applies a change to the memory storage with fn, then logs rec. The caller must not hold
+// s.mu.
+func (s *Store) write(rec *record, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	rec.Seq = s.seq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		s.err = err
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.log.Write(line); err != nil {
+		s.err = err
+		return err
+	}
+	if !s.opts.NoSync {
+		if err := s.log.Sync(); err != nil {
+			s.err = err
+			return err
+		}
+	}
+	s.seq = rec.Seq
+	s.pending++
+	if s.opts.CompactEvery > 0 && s.pending >= s.opts.CompactEvery {
+		// The record is durable, so a failed compaction is not an error of this write
+		_ = s.compact()
+	}
+	return nil
+}
+
+// Compact writes a new snapshot and empties the log.
+//
+// Returns: none
+// Errors: ErrClosed, or any error from the file system
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.compact()
+}
+
+// compact is Compact without locking. The caller must hold s.mu.
+func (s *Store) compact() error {
+	var buf bytes.Buffer
+	header, _ := json.Marshal(snapshotHeader{Seq: s.seq})
+	buf.Write(header)
+	buf.WriteByte('\n')
+	if err := s.mem.Save(&buf, !s.opts.SkipTokens); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, snapshotFile)
+	tmp, err := os.CreateTemp(s.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+
+	// Records up to s.seq are now in the snapshot
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.pending = 0
+	return nil
+}
+
+// Save writes a snapshot of the store, like auth.MemoryStorage.Save, e.g. for a backup.
+//
+// Returns: none
+// Errors: any error from w
+func (s *Store) Save(w io.Writer, withTokens bool) error {
+	return s.mem.Save(w, withTokens)
+}
+
+// Load replaces everything in the store with a snapshot made by Save (or auth.MemoryStorage.Save),
+// and compacts it, so that the log starts from the loaded state. Servers using the store see the
+// change at once.
+//
+// Returns: none
+// Errors: ErrClosed, auth.ErrInvalidSnapshot, auth.ErrSnapshotTooNew, or any error from r or the
+// file system
+func (s *Store) Load(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.mem.Load(r); err != nil {
+		return err
+	}
+	if err := s.compact(); err != nil {
+		// The memory is ahead of the disk
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// syncDir makes a rename in the directory durable. It is best effort, as not all platforms support it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+// Close compacts the store and closes the log. The store cannot be used afterwards.
+//
+// Returns: none
+// Errors: any error from the file system
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == ErrClosed {
+		return nil
+	}
+	var err error
+	if s.err == nil {
+		err = s.compact()
+	}
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	s.err = ErrClosed
+	return err
+}
+
+// *-* Users *-*
+
+func (s *Store) InsertUser(ctx context.Context, u *auth.User) error {
+	return s.write(&record{Op: opInsertUser, User: u}, func() error { return s.mem.InsertUser(ctx, u) })
+}
+
+func (s *Store) UpdateUser(ctx context.Context, u *auth.User) error {
+	return s.write(&record{Op: opUpdateUser, User: u}, func() error { return s.mem.UpdateUser(ctx, u) })
+}
+
+func (s *Store) DeleteUser(ctx context.Context, id auth.UserID) error {
+	return s.write(&record{Op: opDeleteUser, UserID: id}, func() error { return s.mem.DeleteUser(ctx, id) })
+}
+
+func (s *Store) GetUser(ctx context.Context, id auth.UserID) (*auth.User, error) {
+	return s.mem.GetUser(ctx, id)
+}
+
+func (s *Store) GetUserByName(ctx context.Context, name string) (*auth.User, error) {
+	return s.mem.GetUserByName(ctx, name)
+}
+
+func (s *Store) UsersWithRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.mem.UsersWithRole(ctx, role)
+}
+
+// UsersWithResourceRole implements auth.RoleFinder.
+func (s *Store) UsersWithResourceRole(ctx context.Context, role auth.RoleID) ([]auth.UserID, error) {
+	return s.mem.UsersWithResourceRole(ctx, role)
+}
+
+func (s *Store) ListUsers(ctx context.Context, q *auth.ListQuery) ([]*auth.User, error) {
+	return s.mem.ListUsers(ctx, q)
+}
+
+// *-* Roles *-*
+
+func (s *Store) InsertRole(ctx context.Context, r *auth.Role) error {
+	return s.write(&record{Op: opInsertRole, Role: r}, func() error { return s.mem.InsertRole(ctx, r) })
+}
+
+func (s *Store) UpdateRole(ctx context.Context, r *auth.Role) error {
+	return s.write(&record{Op: opUpdateRole, Role: r}, func() error { return s.mem.UpdateRole(ctx, r) })
+}
+
+func (s *Store) DeleteRole(ctx context.Context, id auth.RoleID) error {
+	return s.write(&record{Op: opDeleteRole, RoleID: id}, func() error { return s.mem.DeleteRole(ctx, id) })
+}
+
+func (s *Store) GetRole(ctx context.Context, id auth.RoleID) (*auth.Role, error) {
+	return s.mem.GetRole(ctx, id)
+}
+
+func (s *Store) GetRoleByName(ctx context.Context, name string) (*auth.Role, error) {
+	return s.mem.GetRoleByName(ctx, name)
+}
+
+func (s *Store) ListRoles(ctx context.Context, q *auth.ListQuery) ([]*auth.Role, error) {
+	return s.mem.ListRoles(ctx, q)
+}
+
+// *-* Groups *-*
+
+func (s *Store) InsertGroup(ctx context.Context, g *auth.Group) error {
+	return s.write(&record{Op: opInsertGroup, Group: g}, func() error { return s.mem.InsertGroup(ctx, g) })
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, g *auth.Group) error {
+	return s.write(&record{Op: opUpdateGroup, Group: g}, func() error { return s.mem.UpdateGroup(ctx, g) })
+}
+
+func (s *Store) DeleteGroup(ctx context.Context, id auth.GroupID) error {
+	return s.write(&record{Op: opDeleteGroup, GroupID: id}, func() error { return s.mem.DeleteGroup(ctx, id) })
+}
+
+func (s *Store) GetGroup(ctx context.Context, id auth.GroupID) (*auth.Group, error) {
+	return s.mem.GetGroup(ctx, id)
+}
+
+func (s *Store) GetGroupByName(ctx context.Context, name string) (*auth.Group, error) {
+	return s.mem.GetGroupByName(ctx, name)
+}
+
+func (s *Store) GroupMembers(ctx context.Context, group auth.GroupID) ([]auth.UserID, error) {
+	return s.mem.GroupMembers(ctx, group)
+}
+
+// GroupsWithRole implements auth.RoleFinder.
+func (s *Store) GroupsWithRole(ctx context.Context, role auth.RoleID) ([]auth.GroupID, error) {
+	return s.mem.GroupsWithRole(ctx, role)
+}
+
+// Count implements auth.Counter.
+func (s *Store) Count(ctx context.Context) (auth.Counts, error) {
+	return s.mem.Count(ctx)
+}
+
+// *-* Tokens *-*
+
+func (s *Store) InsertToken(ctx context.Context, t *auth.Token) error {
+	if s.opts.SkipTokens {
+		return s.mem.InsertToken(ctx, t)
+	}
+	return s.write(&record{Op: opInsertToken, Token: t}, func() error { return s.mem.InsertToken(ctx, t) })
+}
+
+func (s *Store) GetToken(ctx context.Context, v auth.TokenValue) (*auth.Token, error) {
+	return s.mem.GetToken(ctx, v)
+}
+
+func (s *Store) DeleteToken(ctx context.Context, v auth.TokenValue) error {
+	if s.opts.SkipTokens {
+		return s.mem.DeleteToken(ctx, v)
+	}
+	return s.write(&record{Op: opDeleteToken, Value: v}, func() error { return s.mem.DeleteToken(ctx, v) })
+}
+
+func (s *Store) UserTokens(ctx context.Context, user auth.UserID) ([]*auth.Token, error) {
+	return s.mem.UserTokens(ctx, user)
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChangeType names the kind of a ChangeRecord.
+type ChangeType string
+
+const (
+	ChangeUserPut    ChangeType = "user.put" // created or updated, with ChangeRecord.User
+	ChangeUserDelete ChangeType = "user.delete"
+	// ChangeRoleAssign and ChangeRoleUnassign follow the ChangeUserPut of a change to the direct
+	// roles of a user, for indexes of assignments.
+	ChangeRoleAssign   ChangeType = "role.assign"
+	ChangeRoleUnassign ChangeType = "role.unassign"
+	ChangeRolePut      ChangeType = "role.put" // with ChangeRecord.Role
+	ChangeRoleDelete   ChangeType = "role.delete"
+	ChangeGroupPut     ChangeType = "group.put" // with ChangeRecord.Group
+	ChangeGroupDelete  ChangeType = "group.delete"
+)
+
+// ChangeRecord is a change to the users, roles or groups of a server, as saved to its storage, see
+// Watch.
+type ChangeRecord struct {
+	// Revision orders the changes of a server. It grows by one with each change, from the time the
+	// server started, in nanoseconds, so that revisions of earlier runs are older than the log.
+	Revision int64      `json:"revision"`
+	Type     ChangeType `json:"type"`
+	Time     time.Time  `json:"time"`
+	// User is the user after a user.put, without its secrets: the fields Secret, TOTP, APIKeys,
+	// Logins and Sealed are empty, and so is SessionVersion.
+	User  *User  `json:"user,omitempty"`
+	Role  *Role  `json:"role,omitempty"`  // after a role.put
+	Group *Group `json:"group,omitempty"` // after a group.put
+	// UserID, RoleID and GroupID are the IDs of the objects changed, also set along User, Role and
+	// Group.
+	UserID  UserID  `json:"user_id,omitempty"`
+	RoleID  RoleID  `json:"role_id,omitempty"`
+	GroupID GroupID `json:"group_id,omitempty"`
+}
+
+var (
+	ErrRevisionUnavailable = newError("revision_unavailable", http.StatusGone, "revision no longer available")
+)
+
+// Watch streams the changes made after a revision to the users (but their logins, API keys and
+// other secrets), roles, groups and role assignments, in order, so that caches and search indexes
+// can follow them without polling the list APIs. Tokens are not covered. since is the revision of
+// a ChangeRecord, or from Revision, or 0 to start with the next change.
+//
+// To sync a replica, read Revision, then list the objects, then watch from that revision: the
+// changes made while listing come again, and replace the objects listed. If the channel is closed
+// before ctx ends, the watcher fell too far behind or the server was closed: watching again from
+// the last revision received resumes, unless that fails with ErrRevisionUnavailable, and the
+// replica must be listed again.
+//
+// Changes are kept in memory, the last ServerConfig.ChangeLogSize of them, and only those of this
+// server are seen, not those of others sharing the storage.
+//
+// Returns: a channel of the changes, closed once ctx ends
+// Errors: ErrUnsupported without ServerConfig.ChangeLogSize, ErrRevisionUnavailable if since is no
+// longer in the log, or from another run of the server, ErrServerClosed
+func (s *Server) Watch(ctx context.Context, since int64) (_ <-chan ChangeRecord, err error) {
+	s, sp := s.trace("auth.Watch")
+	defer func() { sp.end(err) }()
+	if s.changes == nil {
+		return nil, ErrUnsupported
+	}
+	return s.changes.watch(ctx, since)
+}
+
+// Revision tells the revision of the last change to the server, as a starting point for Watch.
+//
+// Returns: the revision, or 0 without ServerConfig.ChangeLogSize
+func (s *Server) Revision() int64 {
+	if s.changes == nil {
+		return 0
+	}
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	return s.changes.last
+}
+
+// changeLog keeps the last changes of a server in a ring, for Watch.
+type changeLog struct {
+	clock Clock
+
+	mu      sync.Mutex
+	ring    []ChangeRecord // the change of revision r at (r-base-1) % cap(ring)
+	base    int64          // revision at the start, before any change
+	last    int64          // revision of the last change
+	updated chan struct{}  // closed on the next change, to wake the watchers
+	closed  bool
+}
+
+func newChangeLog(size int, clock Clock, start time.Time) *changeLog {
+	rev := start.UnixNano()
+	return &changeLog{clock: clock, ring: make([]ChangeRecord, 0, size), base: rev, last: rev, updated: make(chan struct{})}
+}
+
+// add appends changes, dropping the oldest ones beyond the size of the log.
+func (l *changeLog) add(changes ...ChangeRecord) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	for _, c := range changes {
+		l.last++
+		c.Revision, c.Time = l.last, now
+		if len(l.ring) < cap(l.ring) {
+			l.ring = append(l.ring, c)
+		} else {
+			l.ring[l.index(c.Revision)] = c
+		}
+	}
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// after copies the changes following a revision.
+//
+// Returns: the changes, and a channel closed on the next change if there is none
+// Errors: ErrRevisionUnavailable, ErrServerClosed
+func (l *changeLog) after(rev int64) ([]ChangeRecord, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, ErrServerClosed
+	}
+	first := l.last - int64(len(l.ring)) // the revision before the oldest change kept
+	if rev < first || rev > l.last {
+		return nil, nil, ErrRevisionUnavailable
+	}
+	if rev == l.last {
+		return nil, l.updated, nil
+	}
+	changes := make([]ChangeRecord, 0, l.last-rev)
+	for r := rev + 1; r <= l.last; r++ {
+		changes = append(changes, l.ring[l.index(r)])
+	}
+	return changes, nil, nil
+}
+
+func (l *changeLog) index(rev int64) int {
+	return int((rev - l.base - 1) % int64(cap(l.ring)))
+}
+
+func (l *changeLog) watch(ctx context.Context, since int64) (<-chan ChangeRecord, error) {
+	if since == 0 {
+		l.mu.Lock()
+		since = l.last
+		l.mu.Unlock()
+	}
+	// Checked now, so that the caller learns it has to list again
+	if _, _, err := l.after(since); err != nil {
+		return nil, err
+	}
+	ch := make(chan ChangeRecord)
+	go func() {
+		defer close(ch)
+		rev := since
+		for {
+			changes, updated, err := l.after(rev)
+			if err != nil {
+				return
+			}
+			for _, c := range changes {
+				select {
+				case ch <- c:
+					rev = c.Revision
+				case <-ctx.Done():
+					return
+				}
+			}
+			if updated != nil {
+				select {
+				case <-updated:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// reset drops the changes, for Server.Load, which replaces all the data: every watch ends, and
+// watching again from before fails with ErrRevisionUnavailable.
+func (l *changeLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	l.base, l.ring = l.last, l.ring[:0]
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// close ends the watches, for Server.Close.
+func (l *changeLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.updated)
+	}
+}
+
+// *-* Storage *-*
+
+// changeStore records the writes to the storage of a server in its change log.
+type changeStore struct {
+	Storage
+	log *changeLog
+}
+
+// publicUser gives the user as reported by changes, without its secrets and bookkeeping.
+func publicUser(u *User) *User {
+	c := u.clone()
+	c.Secret, c.TOTP, c.APIKeys, c.Logins, c.Sealed, c.SessionVersion = nil, nil, nil, nil, nil, 0
+	return c
+}
+
+// sameUser tells if two users are reported the same, which is the case when only their secrets
+// or bookkeeping changed, e.g. by a login.
+func sameUser(a, b *User) bool {
+	a, b = publicUser(a), publicUser(b)
+	if len(a.Roles) != len(b.Roles) {
+		return false
+	}
+	for id := range a.Roles {
+		if _, ok := b.Roles[id]; !ok {
+			return false
+		}
+	}
+	// The roles are those at the time the users were read
+	a.Roles, b.Roles = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// userChanges gives the changes from a user (nil if new) to another.
+func userChanges(old, u *User) []ChangeRecord {
+	if old != nil && sameUser(old, u) {
+		return nil
+	}
+	var oldRoles map[RoleID]*Role
+	if old != nil {
+		oldRoles = old.Roles
+	}
+	changes := []ChangeRecord{{Type: ChangeUserPut, User: publicUser(u), UserID: u.ID}}
+	for id := range u.Roles {
+		if _, ok := oldRoles[id]; !ok {
+			changes = append(changes, ChangeRecord{Type: ChangeRoleAssign, UserID: u.ID, RoleID: id})
+		}
+	}
+	for id := range oldRoles {
+		if _, ok := u.Roles[id]; !ok {
+			changes = append(changes, ChangeRecord{Type: ChangeRoleUnassign, UserID: u.ID, RoleID: id})
+		}
+	}
+	// In a stable order, not that of the maps
+	assignments := changes[1:]
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Type != assignments[j].Type {
+			return assignments[i].Type == ChangeRoleAssign
+		}
+		return assignments[i].RoleID < assignments[j].RoleID
+	})
+	return changes
+}
+
+func (c *changeStore) InsertUser(ctx context.Context, u *User) error {
+	if err := c.Storage.InsertUser(ctx, u); err != nil {
+		return err
+	}
+	c.log.add(userChanges(nil, u)...)
+	return nil
+}
+
+func (c *changeStore) UpdateUser(ctx context.Context, u *User) error {
+	old, _ := c.Storage.GetUser(ctx, u.ID)
+	if err := c.Storage.UpdateUser(ctx, u); err != nil {
+		return err
+	}
+	if changes := userChanges(old, u); len(changes) > 0 {
+		c.log.add(changes...)
+	}
+	return nil
+}
+
+func (c *changeStore) DeleteUser(ctx context.Context, id UserID) error {
+	if err := c.Storage.DeleteUser(ctx, id); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeUserDelete, UserID: id})
+	return nil
+}
+
+func (c *changeStore) InsertRole(ctx context.Context, r *Role) error {
+	if err := c.Storage.InsertRole(ctx, r); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeRolePut, Role: r.clone(), RoleID: r.ID})
+	return nil
+}
+
+func (c *changeStore) UpdateRole(ctx context.Context, r *Role) error {
+	if err := c.Storage.UpdateRole(ctx, r); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeRolePut, Role: r.clone(), RoleID: r.ID})
+	return nil
+}
+
+func (c *changeStore) DeleteRole(ctx context.Context, id RoleID) error {
+	if err := c.Storage.DeleteRole(ctx, id); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeRoleDelete, RoleID: id})
+	return nil
+}
+
+func (c *changeStore) InsertGroup(ctx context.Context, g *Group) error {
+	if err := c.Storage.InsertGroup(ctx, g); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeGroupPut, Group: g.clone(), GroupID: g.ID})
+	return nil
+}
+
+func (c *changeStore) UpdateGroup(ctx context.Context, g *Group) error {
+	if err := c.Storage.UpdateGroup(ctx, g); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeGroupPut, Group: g.clone(), GroupID: g.ID})
+	return nil
+}
+
+func (c *changeStore) DeleteGroup(ctx context.Context, id GroupID) error {
+	if err := c.Storage.DeleteGroup(ctx, id); err != nil {
+		return err
+	}
+	c.log.add(ChangeRecord{Type: ChangeGroupDelete, GroupID: id})
+	return nil
+}
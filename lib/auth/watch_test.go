@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextChange receives a change, or tells that the channel is closed (or nothing came for a second).
+func nextChange(ch <-chan ChangeRecord) (ChangeRecord, bool) {
+	select {
+	case c, ok := <-ch:
+		return c, ok
+	case <-time.After(time.Second):
+		return ChangeRecord{}, false
+	}
+}
+
+// changeTypes receives n changes, and gives their types.
+func changeTypes(ch <-chan ChangeRecord, n int) []ChangeType {
+	var types []ChangeType
+	for i := 0; i < n; i++ {
+		c, _ := nextChange(ch)
+		types = append(types, c.Type)
+	}
+	return types
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	{
+		svr, _ := New(WithHasher(fastHasher))
+		_, err := svr.Watch(ctx, 0)
+		assert.Equal(t, ErrUnsupported, err, "should require a change log")
+		assert.Equal(t, int64(0), svr.Revision(), "should be 0 without a change log")
+	}
+
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	svr, _ := New(WithHasher(fastHasher), WithClock(clock), WithChangeLog(8))
+	start := svr.Revision()
+	assert.Equal(t, clock.Now().UnixNano(), start, "should start from the time of the server")
+	ch, err := svr.Watch(ctx, 0)
+	assert.Equal(t, nil, err, "should success")
+	{
+		uid, _ := svr.CreateUser("anna", "passw0rd")
+		c, _ := nextChange(ch)
+		assert.Equal(t, ChangeRecord{Revision: start + 1, Type: ChangeUserPut, Time: clock.Now(), UserID: uid,
+			User: &User{ID: uid, Name: "anna", Roles: map[RoleID]*Role{}}}, c, "should report new users without their secrets")
+		rid, _ := svr.CreateRole("clerk")
+		c, _ = nextChange(ch)
+		assert.Equal(t, &Role{ID: rid, Name: "clerk"}, c.Role, "should report new roles")
+		svr.AddRoleToUser(uid, rid)
+		c, _ = nextChange(ch)
+		assert.Equal(t, true, c.Type == ChangeUserPut && c.User.Roles[rid] != nil, "should report the user with its roles")
+		c, _ = nextChange(ch)
+		assert.Equal(t, ChangeRecord{Revision: start + 4, Type: ChangeRoleAssign, Time: clock.Now(), UserID: uid, RoleID: rid}, c,
+			"should report assignments")
+
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		svr.Invalidate(token)
+		svr.RemoveRoleFromUser(uid, rid)
+		assert.Equal(t, []ChangeType{ChangeUserPut, ChangeRoleUnassign}, changeTypes(ch, 2), "should not report logins and tokens")
+		svr.DeleteUser(uid)
+		c, _ = nextChange(ch)
+		assert.Equal(t, ChangeRecord{Revision: start + 7, Type: ChangeUserDelete, Time: clock.Now(), UserID: uid}, c,
+			"should report deletions")
+		assert.Equal(t, start+7, svr.Revision(), "should tell the last revision")
+	}
+	{
+		again, _ := svr.Watch(ctx, start+4)
+		assert.Equal(t, []ChangeType{ChangeUserPut, ChangeRoleUnassign, ChangeUserDelete}, changeTypes(again, 3),
+			"should resume after a revision")
+		for i := 0; i < 20; i++ {
+			svr.CreateRole(fmt.Sprintf("role%d", i))
+		}
+		_, err := svr.Watch(ctx, start)
+		assert.Equal(t, ErrRevisionUnavailable, err, "should only keep the last changes")
+		_, err = svr.Watch(ctx, svr.Revision()+1)
+		assert.Equal(t, ErrRevisionUnavailable, err, "should reject revisions of other runs")
+	}
+	{
+		// ch was not read while the roles were created: it fell behind, and only gets those it had
+		// taken from the log
+		rev, n := start+7, 0
+		for c, ok := nextChange(ch); ok; c, ok = nextChange(ch) {
+			assert.Equal(t, rev+1, c.Revision, "should keep the order")
+			rev, n = c.Revision, n+1
+		}
+		assert.Equal(t, true, n <= 8, "should end the watches that fall behind")
+
+		watchCtx, stop := context.WithCancel(ctx)
+		w, _ := svr.Watch(watchCtx, 0)
+		stop()
+		_, ok := nextChange(w)
+		assert.Equal(t, false, ok, "should end with the context")
+
+		w, _ = svr.Watch(ctx, 0)
+		var snap bytes.Buffer
+		svr.Save(&snap, false)
+		rev = svr.Revision()
+		svr.Load(&snap)
+		_, ok = nextChange(w)
+		assert.Equal(t, false, ok, "should end the watches on load")
+		_, err := svr.Watch(ctx, rev)
+		assert.Equal(t, ErrRevisionUnavailable, err, "should list again after a load")
+
+		w, _ = svr.Watch(ctx, 0)
+		svr.Close(ctx)
+		_, ok = nextChange(w)
+		assert.Equal(t, false, ok, "should end the watches on close")
+	}
+}
@@ -0,0 +1,41 @@
+package authcel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func TestCompiler(t *testing.T) {
+	svr, err := auth.New(auth.WithPolicyCompiler(New()))
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("support")
+	svr.AddRoleToUser(uid, rid)
+	svr.SetUserAttribute(uid, "refund_limit", 500)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		err := svr.SetPolicy("refund", `"support" in subject.roles && request.amount <= subject.attributes.refund_limit && env.hour < 24`)
+		assert.Equal(t, nil, err, "should compile CEL")
+		ok, err := svr.CheckAccess(token, &auth.AccessInput{Policy: "refund", Attributes: auth.Attributes{"amount": int64(120)}})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, ok, "should allow by the policy")
+		ok, _ = svr.CheckAccess(token, &auth.AccessInput{Policy: "refund", Attributes: auth.Attributes{"amount": int64(900)}})
+		assert.Equal(t, false, ok, "should deny by the policy")
+		_, err = svr.CheckAccess(token, &auth.AccessInput{Policy: "refund"})
+		assert.Equal(t, true, errors.Is(err, auth.ErrInvalidPolicy), "should fail on missing keys")
+
+		svr.SetPolicy("region", `has(request.region) && request.region == "eu"`)
+		ok, err = svr.CheckAccess(token, &auth.AccessInput{Policy: "region"})
+		assert.Equal(t, nil, err, "should test missing keys with has")
+		assert.Equal(t, false, ok, "should deny without the key")
+	}
+	{
+		assert.Equal(t, true, errors.Is(svr.SetPolicy("bad", `subject.name ==`), auth.ErrInvalidPolicy), "should reject syntax errors")
+		assert.Equal(t, true, errors.Is(svr.SetPolicy("bad", `user.name == "anna"`), auth.ErrInvalidPolicy), "should reject unknown variables")
+		assert.Equal(t, true, errors.Is(svr.SetPolicy("bad", `env.hour + 1`), auth.ErrInvalidPolicy), "should reject non-bool policies")
+	}
+}
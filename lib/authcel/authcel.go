@@ -0,0 +1,96 @@
+// Package authcel compiles the policies of auth servers from CEL, the Common Expression Language,
+// as an auth.PolicyCompiler.
+//
+//	svr, err := auth.New(auth.WithPolicyCompiler(authcel.New()), ...)
+//	err = svr.SetPolicy("refund", `"support" in subject.roles && request.amount <= subject.attributes.refund_limit`)
+//
+// Policies see the variables of the built-in expressions of the auth package (see
+// auth.CompileExpression): subject (with id, name, roles, role_ids and attributes), request and env
+// (with time, hour and weekday), as maps. As CEL has it, reading a missing key is an error, so
+// optional attributes are tested with has() first, e.g. has(request.region) && request.region == "eu".
+package authcel
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Compiler compiles CEL policies.
+type Compiler struct {
+	env *cel.Env
+}
+
+// New creates a Compiler.
+func New() *Compiler {
+	env, err := cel.NewEnv(
+		cel.Variable("subject", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("env", cel.MapType(cel.StringType, cel.IntType)),
+	)
+	if err != nil {
+		// The declarations are fixed
+		panic(err)
+	}
+	return &Compiler{env: env}
+}
+
+// Compile compiles and type-checks a policy, which must give a bool.
+//
+// Returns: the compiled policy
+// Errors: ErrInvalidPolicy (wrapped) with the issues found
+func (c *Compiler) Compile(src string) (auth.Policy, error) {
+	ast, iss := c.env.Compile(src)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("%w: %v", auth.ErrInvalidPolicy, iss.Err())
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("%w: policy gives %v, not bool", auth.ErrInvalidPolicy, t)
+	}
+	prg, err := c.env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", auth.ErrInvalidPolicy, err)
+	}
+	return &policy{prg: prg}, nil
+}
+
+type policy struct {
+	prg cel.Program
+}
+
+func (p *policy) Allow(sub *auth.Subject, env *auth.Environment) (bool, error) {
+	roleIDs := make([]int64, len(sub.Roles))
+	for i, id := range sub.Roles {
+		roleIDs[i] = int64(id)
+	}
+	attrs := sub.Attributes
+	if attrs == nil {
+		attrs = auth.Attributes{}
+	}
+	req := env.Attributes
+	if req == nil {
+		req = auth.Attributes{}
+	}
+	t := env.Time.UTC()
+	out, _, err := p.prg.Eval(map[string]interface{}{
+		"subject": map[string]interface{}{
+			"id":         int64(sub.User),
+			"name":       sub.Name,
+			"roles":      sub.RoleNames,
+			"role_ids":   roleIDs,
+			"attributes": map[string]interface{}(attrs),
+		},
+		"request": map[string]interface{}(req),
+		"env":     map[string]int64{"time": t.Unix(), "hour": int64(t.Hour()), "weekday": int64(t.Weekday())},
+	})
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", auth.ErrInvalidPolicy, err)
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return false, fmt.Errorf("%w: policy gave %v, not bool", auth.ErrInvalidPolicy, out.Type())
+	}
+	return ok, nil
+}
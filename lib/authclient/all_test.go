@@ -0,0 +1,147 @@
+package authclient
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// keyServer serves a JWK set that can be changed, and counts the fetches.
+type keyServer struct {
+	mu      sync.Mutex
+	set     auth.JWKSet
+	fetches int
+}
+
+func (k *keyServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fetches++
+	_ = json.NewEncoder(w).Encode(&k.set)
+}
+
+func (k *keyServer) publish(cfgs ...*auth.JWTConfig) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.set.Keys = nil
+	for _, cfg := range cfgs {
+		key, _ := auth.NewJWK(cfg)
+		k.set.Keys = append(k.set.Keys, *key)
+	}
+}
+
+func newJWTServer(kid string, bus auth.RevocationBroadcaster) (*auth.Server, *auth.JWTConfig) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	cfg := &auth.JWTConfig{Algorithm: auth.EdDSA, Key: priv, Issuer: "hsbc", KeyID: kid}
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, JWT: cfg, Hasher: &auth.BcryptHasher{Cost: 4}, Revocations: bus})
+	return svr, cfg
+}
+
+func TestVerify(t *testing.T) {
+	bus := auth.NewMemoryBroadcaster()
+	svr, cfg := newJWTServer("k1", bus)
+	keys := &keyServer{}
+	keys.publish(cfg)
+	ts := httptest.NewServer(keys)
+	defer ts.Close()
+
+	c, err := New(&Config{JWKSURL: ts.URL, Issuer: "hsbc", Revocations: bus})
+	assert.Equal(t, nil, err, "should success")
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	{
+		token, _ := svr.Authenticate("elton", "123456")
+		claims, err := c.Verify(token)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "elton", claims.Name, "should give the claims")
+		assert.Equal(t, true, HasRole(claims, rid), "should carry the roles")
+		_, err = c.Verify("invalid")
+		assert.Equal(t, auth.ErrInvalidToken, err, "should reject malformed tokens")
+
+		svr.Invalidate(token)
+		_, err = c.Verify(token)
+		assert.Equal(t, auth.ErrInvalidToken, err, "should reject revoked tokens")
+	}
+	{
+		// Rotated to a new key
+		other, cfg2 := newJWTServer("k2", nil)
+		other.CreateUser("elton", "123456")
+		token, _ := other.Authenticate("elton", "123456")
+		keys.publish(cfg, cfg2)
+		_, err := c.Verify(token)
+		assert.Equal(t, nil, err, "should fetch the keys again for an unknown key")
+		assert.Equal(t, 2, keys.fetches, "should fetch the keys again for an unknown key")
+
+		unknown, _ := newJWTServer("k3", nil)
+		unknown.CreateUser("elton", "123456")
+		token, _ = unknown.Authenticate("elton", "123456")
+		_, err = c.Verify(token)
+		assert.Equal(t, auth.ErrInvalidToken, err, "should reject tokens of unknown keys")
+		_, err = c.Verify(token)
+		assert.Equal(t, auth.ErrInvalidToken, err, "should reject tokens of unknown keys")
+		assert.Equal(t, 2, keys.fetches, "should limit the fetches for unknown keys")
+	}
+	{
+		hs := &auth.JWTConfig{Algorithm: auth.HS256, Key: []byte("s3cr3t")}
+		hsSvr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, JWT: hs, Hasher: &auth.BcryptHasher{Cost: 4}})
+		hsSvr.CreateUser("elton", "123456")
+		token, _ := hsSvr.Authenticate("elton", "123456")
+		v, _ := auth.NewJWTVerifier(auth.HS256, []byte("s3cr3t"), "")
+		c, err := New(&Config{Verifier: v})
+		assert.Equal(t, nil, err, "should success")
+		_, err = c.Verify(token)
+		assert.Equal(t, nil, err, "should verify with the given verifier")
+	}
+	{
+		_, err := New(&Config{})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should need a key")
+		keys.publish()
+		_, err = New(&Config{JWKSURL: ts.URL})
+		assert.Equal(t, ErrNoKeys, err, "should need a usable key")
+		missing := httptest.NewServer(http.NotFoundHandler())
+		defer missing.Close()
+		_, err = New(&Config{JWKSURL: missing.URL})
+		assert.NotEqual(t, nil, err, "should report failed fetches")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	svr, cfg := newJWTServer("", nil)
+	key, _ := auth.NewJWK(cfg)
+	v, _ := key.Verifier("hsbc")
+	c, _ := New(&Config{Verifier: v})
+	uid, _ := svr.CreateUser("elton", "123456")
+	svr.CreateUser("fred", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	elton, _ := svr.Authenticate("elton", "123456")
+	fred, _ := svr.Authenticate("fred", "123456")
+
+	h := c.RequireRole(rid)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ClaimsFrom(r.Context()).Name))
+	}))
+	serve := func(token auth.TokenValue) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := serve(elton)
+	assert.Equal(t, http.StatusOK, rec.Code, "should let through users with the role")
+	assert.Equal(t, "elton", rec.Body.String(), "should pass the claims on")
+	assert.Equal(t, http.StatusForbidden, serve(fred).Code, "should reject users without the role")
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code, "should require a token")
+	assert.Equal(t, http.StatusUnauthorized, serve("invalid").Code, "should reject invalid tokens")
+}
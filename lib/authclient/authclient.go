@@ -0,0 +1,321 @@
+// Package authclient verifies the JWTs of an auth server (see auth.ServerConfig.JWT) inside the
+// services that accept them, without a round trip to the server per request.
+//
+//	c, err := authclient.New(&authclient.Config{
+//		JWKSURL:     "https://auth.example.com/auth/jwks",
+//		Issuer:      "https://auth.example.com",
+//		Revocations: redisrevoke.New(redisClient, ""),
+//	})
+//	http.Handle("/orders", c.RequireRole(clerkRoleID)(ordersHandler))
+//
+// The public keys are fetched from the JWK set of the server (lib/httpapi serves it at /auth/jwks)
+// when the Client is created, then again every Config.RefreshInterval, or when a token names a key
+// the Client does not know, e.g. after a key rotation. With Config.Revocations, the tokens revoked
+// on the servers are rejected too, from a local cache.
+//
+// Unlike the server, the Client cannot tell that a user was suspended or deleted after the token
+// was issued, nor check permissions, which are not in the token. Roles are those at the time of
+// issuance, by ID.
+package authclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+// Config configures a Client. Either JWKSURL or Verifier must be set.
+type Config struct {
+	// JWKSURL is where the JWK set of the server is fetched.
+	JWKSURL string
+	// Verifier, if set, is used instead of JWKSURL, e.g. for a shared secret, which is not published.
+	Verifier *auth.JWTVerifier
+	// Issuer, if set, rejects tokens of other issuers. It is the Issuer of auth.JWTConfig.
+	Issuer string
+	// RefreshInterval is how often the JWK set is fetched again. Defaults to an hour.
+	RefreshInterval time.Duration
+	// Revocations, if set, delivers the tokens revoked on the servers, see
+	// auth.ServerConfig.Revocations.
+	Revocations auth.RevocationBroadcaster
+	// HTTPClient fetches the JWK set. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// ErrorHandler answers the requests that are not let through. err is middleware.ErrNoToken,
+	// auth.ErrInvalidToken or middleware.ErrForbidden. Defaults to middleware.WriteError.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// missInterval limits the fetches of the JWK set made for unknown keys, as anyone can send tokens
+// naming any key.
+const missInterval = time.Minute
+
+var ErrNoKeys = errors.New("no usable key in the JWK set")
+
+// Client verifies tokens with the keys of the server.
+type Client struct {
+	cfg Config
+
+	// keys maps the key IDs to their verifiers, "" for a key without an ID. fetchMu serializes the
+	// fetches of the JWK set, and is never held while waiting for mu.
+	mu      sync.RWMutex
+	keys    map[string]*auth.JWTVerifier
+	fetched time.Time // of the last successful fetch
+	missed  time.Time // of the last fetch for an unknown key
+	fetchMu sync.Mutex
+
+	// revoked maps the IDs of revoked tokens to their expiry, and is pruned at most once per
+	// missInterval.
+	revMu   sync.Mutex
+	revoked map[string]time.Time
+	pruned  time.Time
+}
+
+// New creates a Client, and fetches the JWK set unless Config.Verifier is set.
+//
+// Returns: pointer to the new client
+// Errors: auth.ErrInvalidConfig, ErrNoKeys, or any error from fetching the JWK set or subscribing to
+// Config.Revocations
+func New(cfg *Config) (*Client, error) {
+	if cfg == nil || (cfg.JWKSURL == "") == (cfg.Verifier == nil) || cfg.RefreshInterval < 0 {
+		return nil, auth.ErrInvalidConfig
+	}
+	c := &Client{cfg: *cfg, revoked: make(map[string]time.Time)}
+	if c.cfg.RefreshInterval == 0 {
+		c.cfg.RefreshInterval = time.Hour
+	}
+	if c.cfg.HTTPClient == nil {
+		c.cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if c.cfg.ErrorHandler == nil {
+		c.cfg.ErrorHandler = middleware.WriteError
+	}
+
+	if c.cfg.Verifier != nil {
+		c.keys = map[string]*auth.JWTVerifier{"": c.cfg.Verifier}
+	} else if err := c.fetch(context.Background()); err != nil {
+		return nil, err
+	}
+	if c.cfg.Revocations != nil {
+		if err := c.cfg.Revocations.Subscribe(c.revoke); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// *-* Keys *-*
+
+// fetch gets the JWK set, and replaces the keys with those that can be used.
+//
+// Errors: ErrNoKeys, or any error from the request
+func (c *Client) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", c.cfg.JWKSURL, res.Status)
+	}
+	var set auth.JWKSet
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*auth.JWTVerifier, len(set.Keys))
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of other types may be added to the set later
+		if v, err := k.Verifier(c.cfg.Issuer); err == nil {
+			keys[k.KeyID] = v
+		}
+	}
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// verifier picks the key of a token, fetching the JWK set again if it is due, or if the key is
+// unknown. Failed fetches keep the previous keys.
+func (c *Client) verifier(ctx context.Context, kid string) *auth.JWTVerifier {
+	if c.cfg.Verifier != nil {
+		return c.cfg.Verifier
+	}
+	c.mu.RLock()
+	v, stale := c.keys[kid], time.Since(c.fetched) > c.cfg.RefreshInterval
+	missed := c.missed
+	c.mu.RUnlock()
+	if v != nil && !stale {
+		return v
+	}
+	if v == nil && !stale && time.Since(missed) < missInterval {
+		return nil
+	}
+
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	c.mu.Lock()
+	// Another request may have fetched the keys in the meantime
+	if v, ok := c.keys[kid]; ok && time.Since(c.fetched) <= c.cfg.RefreshInterval {
+		c.mu.Unlock()
+		return v
+	}
+	if v == nil {
+		c.missed = time.Now()
+	}
+	c.mu.Unlock()
+
+	_ = c.fetch(ctx)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keys[kid]
+}
+
+// keyID reads the "kid" header of a JWT, without checking anything else.
+func keyID(token auth.TokenValue) (string, error) {
+	i := strings.IndexByte(string(token), '.')
+	if i < 0 {
+		return "", auth.ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(string(token[:i]))
+	if err != nil {
+		return "", auth.ErrInvalidToken
+	}
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return "", auth.ErrInvalidToken
+	}
+	return header.KeyID, nil
+}
+
+// *-* Verification *-*
+
+// Verify checks the signature, issuer and expiry of a token, and that it was not revoked.
+//
+// Returns: the claims in the token
+// Errors: auth.ErrInvalidToken
+func (c *Client) Verify(token auth.TokenValue) (*auth.JWTClaims, error) {
+	return c.verify(context.Background(), token)
+}
+
+func (c *Client) verify(ctx context.Context, token auth.TokenValue) (*auth.JWTClaims, error) {
+	kid, err := keyID(token)
+	if err != nil {
+		return nil, err
+	}
+	v := c.verifier(ctx, kid)
+	if v == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.isRevoked(claims.ID) {
+		return nil, auth.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// revoke records a revocation delivered by Config.Revocations.
+func (c *Client) revoke(r auth.Revocation) {
+	c.revMu.Lock()
+	defer c.revMu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) >= missInterval {
+		for jti, exp := range c.revoked {
+			if now.After(exp) {
+				delete(c.revoked, jti)
+			}
+		}
+		c.pruned = now
+	}
+	if now.Before(r.Expires) {
+		c.revoked[r.ID] = r.Expires
+	}
+}
+
+func (c *Client) isRevoked(jti string) bool {
+	c.revMu.Lock()
+	defer c.revMu.Unlock()
+	_, ok := c.revoked[jti]
+	return ok
+}
+
+// HasRole tells if the claims carry a role. Roles held through groups are included in the claims.
+func HasRole(claims *auth.JWTClaims, role auth.RoleID) bool {
+	for _, r := range claims.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// *-* Middleware *-*
+
+type claimsKey struct{}
+
+// ClaimsFrom returns the claims of the token accepted by the middleware, or nil.
+func ClaimsFrom(ctx context.Context) *auth.JWTClaims {
+	c, _ := ctx.Value(claimsKey{}).(*auth.JWTClaims)
+	return c
+}
+
+// Require lets through the requests carrying a valid bearer token whose claims meet req, which can
+// be nil. See ClaimsFrom.
+func (c *Client) Require(req func(claims *auth.JWTClaims) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := middleware.BearerToken(r)
+			if err != nil {
+				c.cfg.ErrorHandler(w, r, err)
+				return
+			}
+			claims, err := c.verify(r.Context(), token)
+			if err != nil {
+				c.cfg.ErrorHandler(w, r, err)
+				return
+			}
+			if req != nil && !req(claims) {
+				c.cfg.ErrorHandler(w, r, middleware.ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// RequireToken lets through the requests carrying a valid token.
+func (c *Client) RequireToken(next http.Handler) http.Handler {
+	return c.Require(nil)(next)
+}
+
+// RequireRole lets through the requests whose token carries the role.
+func (c *Client) RequireRole(role auth.RoleID) func(http.Handler) http.Handler {
+	return c.Require(func(claims *auth.JWTClaims) bool {
+		return HasRole(claims, role)
+	})
+}
@@ -0,0 +1,59 @@
+package authotel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func attrs(sp sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range sp.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	svr, err := auth.New(WithTracerProvider(tp))
+	assert.Equal(t, nil, err, "should success")
+	svr.CreateUser("elton", "123456")
+	{
+		ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+		_, err := svr.WithContext(ctx).Authenticate("elton", "123456")
+		parent.End()
+		assert.Equal(t, nil, err, "should success")
+
+		var login sdktrace.ReadOnlySpan
+		for _, sp := range rec.Ended() {
+			if sp.Name() == "auth.Authenticate" {
+				login = sp
+			}
+		}
+		assert.Equal(t, parent.SpanContext().SpanID(), login.Parent().SpanID(), "should join the trace of the context")
+		assert.Equal(t, InstrumentationName, login.InstrumentationLibrary().Name, "should name the instrumentation")
+		a := attrs(login)
+		assert.Equal(t, auth.OutcomeSuccess, a[auth.AttrOutcome].AsString(), "should set the outcome")
+		assert.Equal(t, 16, len(a[auth.AttrUserHash].AsString()), "should set the hashed user")
+		assert.Equal(t, codes.Unset, login.Status().Code, "should not set a status on success")
+	}
+	{
+		svr.Authenticate("elton", "wrong")
+		spans := rec.Ended()
+		login := spans[len(spans)-1]
+		assert.Equal(t, "auth.Authenticate", login.Name(), "should end the method last")
+		assert.Equal(t, codes.Error, login.Status().Code, "should set the error status")
+		assert.Equal(t, "unauthenticated", login.Status().Description, "should describe the status by the error class")
+		assert.Equal(t, "exception", login.Events()[0].Name, "should record the error")
+		assert.Equal(t, auth.OutcomeDenied, attrs(login)[auth.AttrOutcome].AsString(), "should set the outcome")
+	}
+}
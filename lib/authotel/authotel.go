@@ -0,0 +1,65 @@
+// Package authotel traces auth servers with OpenTelemetry, as an auth.Tracer.
+//
+//	svr, err := auth.New(authotel.WithTracerProvider(otel.GetTracerProvider()), ...)
+//
+// Spans are named after the methods of auth.Server ("auth.Authenticate") and of the storage
+// ("auth.store.GetToken"), and carry the attributes of the auth package: the hashed user, the
+// outcome and the error class. Failed operations also get the Error status and the error as an
+// event. Token pruning runs in root spans named "auth.prune", with the number of pruned tokens.
+package authotel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// InstrumentationName is the name of the tracer taken from the TracerProvider.
+const InstrumentationName = "github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+
+// Tracer starts OpenTelemetry spans for an auth server.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// New creates a Tracer with a tracer of tp.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer(InstrumentationName)}
+}
+
+// WithTracerProvider traces a server created by auth.New with tp.
+func WithTracerProvider(tp trace.TracerProvider) auth.Option {
+	return auth.WithTracer(New(tp))
+}
+
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, auth.Span) {
+	ctx, sp := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal))
+	return ctx, span{sp}
+}
+
+type span struct {
+	sp trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.sp.SetAttributes(attribute.String(key, v))
+	case bool:
+		s.sp.SetAttributes(attribute.Bool(key, v))
+	case int64:
+		s.sp.SetAttributes(attribute.Int64(key, v))
+	}
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.sp.RecordError(err)
+		s.sp.SetStatus(codes.Error, auth.ErrorClass(err))
+	}
+	s.sp.End()
+}
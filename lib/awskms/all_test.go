@@ -0,0 +1,76 @@
+package awskms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func TestSign(t *testing.T) {
+	// The post-vanilla case of the Signature Version 4 test suite
+	p := &KeyProvider{cfg: Config{Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}}
+	req, _ := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	p.sign(req, nil, "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, "+
+		"Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b", req.Header.Get("Authorization"), "should match the test suite")
+}
+
+func TestKeyProvider(t *testing.T) {
+	// A fake KMS, wrapping keys by reversing them
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in struct {
+			KeyId          string
+			KeySpec        string
+			CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		if in.KeyId != "alias/auth" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "NotFoundException", "message": "no such key"})
+			return
+		}
+		reverse := func(b []byte) []byte {
+			r := make([]byte, len(b))
+			for i := range b {
+				r[len(b)-1-i] = b[i]
+			}
+			return r
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			key := []byte(strings.Repeat("k", 31) + "!")
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": key, "CiphertextBlob": reverse(key)})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": reverse(in.CiphertextBlob)})
+		}
+	}))
+	defer srv.Close()
+
+	_, err := New(&Config{Region: "eu-west-2", AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	assert.Equal(t, auth.ErrInvalidConfig, err, "should require a key")
+	p, _ := New(&Config{Region: "eu-west-2", KeyID: "alias/auth", AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: srv.URL})
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, KeyProvider: p, Hasher: &auth.BcryptHasher{Cost: 4}})
+	svr.CreateUser("anna", "passw0rd")
+	_, err = svr.Authenticate("anna", "passw0rd")
+	assert.Equal(t, nil, err, "should encrypt and decrypt with KMS")
+	key, wrapped, _ := p.GenerateDataKey(context.Background())
+	unwrapped, err := p.DecryptDataKey(context.Background(), wrapped)
+	assert.Equal(t, nil, err, "should success")
+	assert.Equal(t, key, unwrapped, "should decrypt data keys")
+
+	p, _ = New(&Config{Region: "eu-west-2", KeyID: "alias/other", AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: srv.URL})
+	_, _, err = p.GenerateDataKey(context.Background())
+	assert.Contains(t, err.Error(), "NotFoundException", "should report the errors of KMS")
+}
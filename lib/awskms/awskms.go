@@ -0,0 +1,186 @@
+// Package awskms wraps the data keys of auth.ServerConfig.KeyProvider with AWS KMS, so that the
+// master key encrypting secrets at rest never leaves KMS.
+//
+//	kms, err := awskms.New(&awskms.Config{Region: "eu-west-2", KeyID: "alias/auth"})
+//	svr, err := auth.NewServer(&auth.ServerConfig{KeyProvider: kms, ...}, store)
+//
+// It calls the GenerateDataKey and Decrypt actions of the KMS API, signed with Signature Version 4,
+// and needs the kms:GenerateDataKey and kms:Decrypt permissions on the key.
+package awskms
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Config configures a KeyProvider. Credentials default to the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, and Region to AWS_REGION.
+type Config struct {
+	Region string
+	// KeyID names the KMS key, by ID, ARN or alias (e.g. "alias/auth").
+	KeyID           string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // for temporary credentials
+	// Endpoint is the URL of the KMS API. Defaults to that of the region.
+	Endpoint string
+	// HTTPClient makes the requests. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// KeyProvider is an auth.KeyProvider backed by a KMS key.
+type KeyProvider struct {
+	cfg Config
+	now func() time.Time
+}
+
+var _ auth.KeyProvider = (*KeyProvider)(nil)
+
+// New creates a KeyProvider.
+//
+// Returns: pointer to the new provider
+// Errors: auth.ErrInvalidConfig without a region, a key or credentials
+func New(cfg *Config) (*KeyProvider, error) {
+	p := &KeyProvider{cfg: *cfg, now: time.Now}
+	if p.cfg.Region == "" {
+		p.cfg.Region = os.Getenv("AWS_REGION")
+	}
+	if p.cfg.AccessKeyID == "" && p.cfg.SecretAccessKey == "" {
+		p.cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		p.cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		p.cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if p.cfg.Region == "" || p.cfg.KeyID == "" || p.cfg.AccessKeyID == "" || p.cfg.SecretAccessKey == "" {
+		return nil, auth.ErrInvalidConfig
+	}
+	if p.cfg.Endpoint == "" {
+		p.cfg.Endpoint = "https://kms." + p.cfg.Region + ".amazonaws.com/"
+	}
+	if p.cfg.HTTPClient == nil {
+		p.cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return p, nil
+}
+
+// GenerateDataKey asks KMS for a new AES-256 data key.
+//
+// Returns: the key in the clear, and encrypted by the KMS key
+// Errors: any error from the request, or of the response
+func (p *KeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	var out struct {
+		Plaintext      []byte
+		CiphertextBlob []byte
+	}
+	in := map[string]string{"KeyId": p.cfg.KeyID, "KeySpec": "AES_256"}
+	if err := p.call(ctx, "GenerateDataKey", in, &out); err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// DecryptDataKey asks KMS to decrypt a data key. The KMS key must be the one it was made with.
+//
+// Returns: the key in the clear
+// Errors: any error from the request, or of the response
+func (p *KeyProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	in := map[string]interface{}{"KeyId": p.cfg.KeyID, "CiphertextBlob": wrapped}
+	if err := p.call(ctx, "Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// call posts an action of the KMS API. Binary fields are base64 in JSON, as []byte.
+func (p *KeyProvider) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if p.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.cfg.SessionToken)
+	}
+	p.sign(req, body, "kms", p.now())
+	res, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("kms %s: %s: %s %s", action, res.Status, e.Type, e.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// sign adds the Signature Version 4 of a request to its headers, covering the host and all the
+// headers set.
+func (p *KeyProvider) sign(req *http.Request, body []byte, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, path, req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, hashHex(body))
+
+	scope := amzDate[:8] + "/" + p.cfg.Region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonical.String()))
+	key := []byte("AWS4" + p.cfg.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], p.cfg.Region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		p.cfg.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
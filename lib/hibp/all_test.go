@@ -0,0 +1,44 @@
+package hibp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreached(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get("Add-Padding"), "should ask for padding")
+		fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n")
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	c := New(&Config{URL: srv.URL + "/range/"})
+	{
+		breached, err := c.Breached(ctx, "password")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, true, breached, "should find breached passwords")
+		assert.Equal(t, "/range/5BAA6", paths[0], "should only send the prefix of the hash")
+		breached, _ = c.Breached(ctx, "correct horse battery staple")
+		assert.Equal(t, false, breached, "should not find other passwords")
+	}
+	{
+		breached, _ := New(&Config{URL: srv.URL + "/range/", MinCount: 5000000}).Breached(ctx, "password")
+		assert.Equal(t, false, breached, "should allow passwords seen less than MinCount times")
+	}
+	{
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer down.Close()
+		_, err := New(&Config{URL: down.URL + "/range/"}).Breached(ctx, "password")
+		assert.NotEqual(t, nil, err, "should report failed requests")
+	}
+}
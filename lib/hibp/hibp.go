@@ -0,0 +1,103 @@
+// Package hibp checks passwords against the Pwned Passwords database of Have I Been Pwned, as an
+// auth.BreachChecker.
+//
+//	svr, err := auth.NewServer(&auth.ServerConfig{BreachChecker: hibp.New(nil), ...}, store)
+//
+// Passwords never leave the server: only the first 5 hex digits of their SHA-1 hash are sent (the
+// k-anonymity model of the range API), and the matching suffixes are compared locally. Responses are
+// padded, so that their size does not reveal the prefix either.
+package hibp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the range API of Pwned Passwords, to which the hash prefix is appended.
+const DefaultURL = "https://api.pwnedpasswords.com/range/"
+
+// Config configures a Checker. The zero value uses the public API.
+type Config struct {
+	// URL is that of the range API, e.g. of a mirror. Defaults to DefaultURL.
+	URL string
+	// MinCount is how many times a password must appear in breaches to be rejected. Defaults to 1.
+	MinCount int
+	// HTTPClient makes the requests. Defaults to a client with a 5 second timeout.
+	HTTPClient *http.Client
+	// UserAgent identifies the service to the API, as it requires. Defaults to "hsbc-assess-4".
+	UserAgent string
+}
+
+// Checker is an auth.BreachChecker backed by Pwned Passwords.
+type Checker struct {
+	cfg Config
+}
+
+// New creates a Checker. A nil cfg takes the defaults.
+func New(cfg *Config) *Checker {
+	c := &Checker{}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	if c.cfg.URL == "" {
+		c.cfg.URL = DefaultURL
+	}
+	if c.cfg.MinCount <= 0 {
+		c.cfg.MinCount = 1
+	}
+	if c.cfg.HTTPClient == nil {
+		c.cfg.HTTPClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	if c.cfg.UserAgent == "" {
+		c.cfg.UserAgent = "hsbc-assess-4"
+	}
+	return c
+}
+
+// Breached looks up the hash of the password by its prefix.
+//
+// Returns: true if the password appears at least MinCount times
+// Errors: any error from the request, or of the response
+func (c *Checker) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", c.cfg.UserAgent)
+	req.Header.Set("Add-Padding", "true")
+	res, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GET %s: %s", req.URL, res.Status)
+	}
+
+	// Lines are "<suffix>:<count>". Padding entries have a count of 0.
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(line[i+1:])
+		if err != nil {
+			return false, fmt.Errorf("malformed line %q", line)
+		}
+		return count >= c.cfg.MinCount, nil
+	}
+	return false, sc.Err()
+}
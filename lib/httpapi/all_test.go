@@ -0,0 +1,870 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func newTestServer() *auth.Server {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	return svr
+}
+
+// openAdmin serves the admin endpoints without a token, as most tests call them directly.
+var openAdmin = &Options{OpenAdmin: true}
+
+// do sends a request to the handler, and decodes the JSON response (if any) into a map.
+func do(h http.Handler, method, path, token, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var res map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res
+}
+
+func TestUsersAndRoles(t *testing.T) {
+	h := NewHandler(newTestServer(), openAdmin)
+	{
+		code, res := do(h, "POST", "/users", "", `{"name": "anna", "password": "passw0rd"}`)
+		assert.Equal(t, http.StatusCreated, code, "should create the user")
+		assert.Equal(t, 1.0, res["id"], "should return the ID")
+		code, res = do(h, "POST", "/users", "", `{"name": "anna", "password": "passw0rd"}`)
+		assert.Equal(t, http.StatusConflict, code, "should map ErrUserExists")
+		assert.Equal(t, auth.ErrUserExists.Error(), res["error"], "should report the error")
+		code, _ = do(h, "POST", "/users", "", `{"name": "belle", "password": ""}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrWeakPassword")
+		code, _ = do(h, "POST", "/users", "", `{"name": "belle", "passwd": "passw0rd"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should reject unknown fields")
+	}
+	{
+		code, res := do(h, "POST", "/roles", "", `{"name": "scanner"}`)
+		assert.Equal(t, http.StatusCreated, code, "should create the role")
+		assert.Equal(t, 1.0, res["id"], "should return the ID")
+		code, _ = do(h, "POST", "/roles/1/permissions", "", `{"permission": "devices:*"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should grant the permission")
+		code, res = do(h, "GET", "/roles/1", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, []interface{}{"devices:*"}, res["permissions"], "should list the permissions")
+		code, _ = do(h, "POST", "/roles/1/denies", "", `{"permission": "devices:wipe"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should add the deny rule")
+		_, res = do(h, "GET", "/roles/1", "", "")
+		assert.Equal(t, []interface{}{"devices:wipe"}, res["denied"], "should list the deny rules")
+		code, _ = do(h, "DELETE", "/roles/1/denies/devices:wipe", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should remove the deny rule")
+		code, _ = do(h, "POST", "/users/1/denies", "", `{"permission": "devices:"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidPermission")
+	}
+	{
+		code, _ := do(h, "POST", "/users/1/roles", "", `{"role_id": 1}`)
+		assert.Equal(t, http.StatusNoContent, code, "should assign the role")
+		code, _ = do(h, "POST", "/users/1/roles", "", `{"role_id": 101}`)
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrRoleNotExist")
+		code, res := do(h, "GET", "/users/1", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, map[string]interface{}{"id": 1.0, "name": "anna", "roles": []interface{}{1.0}}, res, "should not expose the password hash")
+		_, res = do(h, "GET", "/roles/1/users", "", "")
+		assert.Equal(t, []interface{}{1.0}, res["users"], "should list the holders")
+		code, _ = do(h, "DELETE", "/users/1/roles/1", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should remove the role")
+		code, _ = do(h, "POST", "/users/1/roles", "", `{"role_id": 1, "expires": "2000-01-01T00:00:00Z"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidExpiry")
+		code, _ = do(h, "POST", "/users/1/roles", "", `{"role_id": 1, "expires": "2100-01-01T00:00:00Z"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should assign the role temporarily")
+		do(h, "DELETE", "/users/1/roles/1", "", "")
+	}
+	{
+		code, _ := do(h, "POST", "/users/1/attributes", "", `{"region": "eu", "clearance": 3}`)
+		assert.Equal(t, http.StatusNoContent, code, "should set the attributes")
+		code, _ = do(h, "POST", "/users/1/attributes", "", `{"manager": {"id": 2}}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidAttribute")
+		code, _ = do(h, "DELETE", "/users/1/attributes/region", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should remove the attribute")
+		_, res := do(h, "GET", "/users/1", "", "")
+		assert.Equal(t, map[string]interface{}{"clearance": 3.0}, res["attributes"], "should list the attributes")
+	}
+	{
+		code, _ := do(h, "POST", "/users/1/metadata", "", `{"email": "e@example.com", "team": "ops"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should set the metadata")
+		code, _ = do(h, "POST", "/users/1/metadata", "", `{"": "x"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidMetadata")
+		do(h, "POST", "/users/1/metadata", "", `{"team": ""}`)
+		code, res := do(h, "GET", "/users/1/metadata", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, map[string]interface{}{"email": "e@example.com"}, res, "should remove empty values")
+		_, res = do(h, "GET", "/users", "", "")
+		assert.Equal(t, map[string]interface{}{"email": "e@example.com"}, res["users"].([]interface{})[0].(map[string]interface{})["metadata"], "should list the metadata")
+	}
+	{
+		code, _ := do(h, "POST", "/users/1/email", "", `{"email": "anna"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidEmail")
+		code, _ = do(h, "POST", "/users/1/email", "", `{"email": "anna@example.com"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should set the email")
+		code, res := do(h, "POST", "/users/1/email/verification", "", "")
+		assert.Equal(t, http.StatusCreated, code, "should issue a verification token")
+		code, res = do(h, "POST", "/auth/verify-email", "", fmt.Sprintf(`{"token": %q}`, res["token"]))
+		assert.Equal(t, http.StatusOK, code, "should verify the email")
+		assert.Equal(t, 1.0, res["user_id"], "should tell the user")
+		_, res = do(h, "GET", "/users/1", "", "")
+		assert.Equal(t, true, res["email_verified"], "should show the verification")
+	}
+	{
+		code, res := do(h, "POST", "/users/password-reset", "", `{"identifier": "anna"}`)
+		assert.Equal(t, http.StatusCreated, code, "should issue a reset token")
+		token := res["token"]
+		code, _ = do(h, "POST", "/auth/reset-password", "", fmt.Sprintf(`{"token": %q, "password": ""}`, token))
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrWeakPassword")
+		code, _ = do(h, "POST", "/auth/reset-password", "", fmt.Sprintf(`{"token": %q, "password": "n3wpassw0rd"}`, token))
+		assert.Equal(t, http.StatusNoContent, code, "should reset the password")
+		code, _ = do(h, "POST", "/auth/login", "", `{"username": "anna", "password": "n3wpassw0rd"}`)
+		assert.Equal(t, http.StatusOK, code, "should log in with the new password")
+		code, _ = do(h, "POST", "/users/password-reset", "", `{"identifier": "nobody"}`)
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrUserNotExist")
+		code, _ = do(h, "POST", "/users/1/name", "", `{"name": "anna.k"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should rename the user")
+		_, res = do(h, "GET", "/users/1", "", "")
+		assert.Equal(t, "anna.k", res["name"], "should show the new name")
+	}
+	{
+		code, _ := do(h, "DELETE", "/users/1", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should delete the user")
+		code, _ = do(h, "GET", "/users/1", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrUserNotExist")
+		code, _ = do(h, "POST", "/roles/1/name", "", `{"name": "reader"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should rename the role")
+		_, res := do(h, "GET", "/roles/1", "", "")
+		assert.Equal(t, "reader", res["name"], "should show the new name")
+		code, _ = do(h, "POST", "/roles/1/protect", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should protect the role")
+		_, res = do(h, "GET", "/roles/1", "", "")
+		assert.Equal(t, true, res["protected"], "should show the protection")
+		code, _ = do(h, "DELETE", "/roles/1", "", "")
+		assert.Equal(t, http.StatusConflict, code, "should map ErrRoleProtected")
+		do(h, "POST", "/roles/1/unprotect", "", "")
+		code, res = do(h, "DELETE", "/roles/1?dry_run=true", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, []interface{}{}, res["users"], "should report the holders")
+		code, _ = do(h, "DELETE", "/roles/1", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should delete the role")
+		code, _ = do(h, "PUT", "/roles/1", "", "")
+		assert.Equal(t, http.StatusMethodNotAllowed, code, "should reject unknown methods")
+		code, _ = do(h, "GET", "/widgets", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should reject unknown paths")
+	}
+}
+
+func TestListings(t *testing.T) {
+	svr := newTestServer()
+	for _, name := range []string{"belle", "anna", "cara"} {
+		svr.CreateUser(name, "123456")
+	}
+	svr.CreateRole("scanner")
+	h := NewHandler(svr, openAdmin)
+	{
+		code, res := do(h, "GET", "/users?sort=name&limit=2", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		users := res["users"].([]interface{})
+		assert.Equal(t, 2, len(users), "should apply the limit")
+		assert.Equal(t, "anna", users[0].(map[string]interface{})["name"], "should sort by name")
+		next, _ := res["next"].(string)
+		assert.NotEqual(t, "", next, "should give a cursor")
+		_, res = do(h, "GET", "/users?sort=name&limit=2&cursor="+next, "", "")
+		users = res["users"].([]interface{})
+		assert.Equal(t, "cara", users[0].(map[string]interface{})["name"], "should continue after the cursor")
+		assert.Equal(t, nil, res["next"], "should not give a cursor on the last page")
+	}
+	{
+		_, res := do(h, "GET", "/users?prefix=z", "", "")
+		assert.Equal(t, []interface{}{}, res["users"], "should give an empty list")
+		_, res = do(h, "GET", "/roles?order=desc", "", "")
+		assert.Equal(t, 1, len(res["roles"].([]interface{})), "should list the roles")
+		code, _ := do(h, "GET", "/users?sort=age", "", "")
+		assert.Equal(t, http.StatusBadRequest, code, "should reject unknown sort fields")
+		code, _ = do(h, "GET", "/users?cursor=invalid", "", "")
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidCursor")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	h := NewHandler(svr, openAdmin)
+	{
+		code, res := do(h, "POST", "/groups", "", `{"name": "staff"}`)
+		assert.Equal(t, http.StatusCreated, code, "should create the group")
+		assert.Equal(t, 1.0, res["id"], "should return the ID")
+		code, _ = do(h, "POST", "/groups", "", `{"name": "staff"}`)
+		assert.Equal(t, http.StatusConflict, code, "should map ErrGroupExists")
+		code, _ = do(h, "POST", "/groups/1/roles", "", fmt.Sprintf(`{"role_id": %d}`, rid))
+		assert.Equal(t, http.StatusNoContent, code, "should grant the role")
+		code, _ = do(h, "POST", "/groups/1/users", "", fmt.Sprintf(`{"user_id": %d}`, uid))
+		assert.Equal(t, http.StatusNoContent, code, "should add the member")
+		code, _ = do(h, "POST", "/groups/2/users", "", fmt.Sprintf(`{"user_id": %d}`, uid))
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrGroupNotExist")
+	}
+	{
+		_, res := do(h, "GET", "/groups/1", "", "")
+		assert.Equal(t, map[string]interface{}{"id": 1.0, "name": "staff", "roles": []interface{}{float64(rid)}}, res, "should describe the group")
+		_, res = do(h, "GET", "/groups/1/users", "", "")
+		assert.Equal(t, []interface{}{float64(uid)}, res["users"], "should list the members")
+		_, res = do(h, "GET", fmt.Sprintf("/users/%d", uid), "", "")
+		assert.Equal(t, []interface{}{1.0}, res["groups"], "should list the groups of the user")
+		token, _ := svr.Authenticate("elton", "123456")
+		_, res = do(h, "POST", "/auth/check", string(token), fmt.Sprintf(`{"role_id": %d}`, rid))
+		assert.Equal(t, true, res["allowed"], "should grant the role of the group")
+	}
+	{
+		code, _ := do(h, "DELETE", fmt.Sprintf("/groups/1/users/%d", uid), "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should remove the member")
+		code, _ = do(h, "DELETE", fmt.Sprintf("/groups/1/roles/%d", rid), "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should revoke the role")
+		code, _ = do(h, "DELETE", "/groups/1", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should delete the group")
+		code, _ = do(h, "GET", "/groups/1", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrGroupNotExist")
+	}
+}
+
+func TestResourceRoles(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("editor")
+	token, _ := svr.Authenticate("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+	{
+		code, _ := do(h, "POST", fmt.Sprintf("/users/%d/roles", uid), "", fmt.Sprintf(`{"role_id": %d, "resource": "project:42"}`, rid))
+		assert.Equal(t, http.StatusNoContent, code, "should assign the role on the resource")
+		code, _ = do(h, "POST", fmt.Sprintf("/users/%d/roles", uid), "", fmt.Sprintf(`{"role_id": %d, "resource": "project:"}`, rid))
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidResource")
+		_, res := do(h, "POST", "/auth/check", string(token), fmt.Sprintf(`{"role_id": %d, "resource": "project:42"}`, rid))
+		assert.Equal(t, true, res["allowed"], "should grant the role on the resource")
+		_, res = do(h, "POST", "/auth/check", string(token), fmt.Sprintf(`{"role_id": %d, "resource": "project:7"}`, rid))
+		assert.Equal(t, false, res["allowed"], "should not grant the role on other resources")
+		_, res = do(h, "POST", "/auth/check", string(token), fmt.Sprintf(`{"role_id": %d}`, rid))
+		assert.Equal(t, false, res["allowed"], "should not grant the role globally")
+	}
+	{
+		code, _ := do(h, "DELETE", fmt.Sprintf("/users/%d/roles/%d?resource=project:42", uid, rid), "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should take the role away")
+		_, res := do(h, "POST", "/auth/check", string(token), fmt.Sprintf(`{"role_id": %d, "resource": "project:42"}`, rid))
+		assert.Equal(t, false, res["allowed"], "should not grant the role anymore")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	svr := newTestServer()
+	svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+	{
+		code, _ := do(h, "PUT", "/policies/refund", "", `{"source": "request.amount <= 100"}`)
+		assert.Equal(t, http.StatusNoContent, code, "should set the policy")
+		code, res := do(h, "PUT", "/policies/bad", "", `{"source": "request.amount <="}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidPolicy")
+		assert.Equal(t, `invalid policy at 17: unexpected end`, res["error"], "should report where the policy is wrong")
+		_, res = do(h, "GET", "/policies", "", "")
+		assert.Equal(t, []interface{}{"refund"}, res["policies"], "should list the policies")
+		_, res = do(h, "GET", "/policies/refund", "", "")
+		assert.Equal(t, "request.amount <= 100", res["source"], "should return the source")
+	}
+	{
+		_, res := do(h, "POST", "/auth/access", string(token), `{"policy": "refund", "attributes": {"amount": 40}}`)
+		assert.Equal(t, true, res["allowed"], "should allow by the policy")
+		_, res = do(h, "POST", "/auth/access", string(token), `{"policy": "refund", "attributes": {"amount": 400}}`)
+		assert.Equal(t, false, res["allowed"], "should deny by the policy")
+		code, _ := do(h, "POST", "/auth/access", string(token), `{"policy": "delete"}`)
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrPolicyNotExist")
+		code, _ = do(h, "DELETE", "/policies/refund", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should remove the policy")
+		code, _ = do(h, "GET", "/policies/refund", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should map ErrPolicyNotExist")
+	}
+}
+
+func TestAuthEndpoints(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("scanner")
+	svr.AddRoleToUser(uid, rid)
+	svr.GrantPermissionToRole(rid, "devices:scan")
+	h := NewHandler(svr, openAdmin)
+
+	var token string
+	{
+		code, _ := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "654321"}`)
+		assert.Equal(t, http.StatusUnauthorized, code, "should map ErrInvalidAuth")
+		code, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+		assert.Equal(t, http.StatusOK, code, "should success")
+		token = res["token"].(string)
+	}
+	{
+		_, res := do(h, "POST", "/auth/introspect", "", `{"token": "`+token+`"}`)
+		assert.Equal(t, true, res["active"], "should describe the token")
+		assert.Equal(t, 1.0, res["user_id"], "should describe the token")
+		assert.Equal(t, []interface{}{1.0}, res["roles"], "should describe the token")
+		assert.Equal(t, "elton", res["username"], "should describe the token")
+		assert.Equal(t, "1", res["sub"], "should describe the token")
+		assert.Equal(t, "Bearer", res["token_type"], "should describe the token")
+		assert.Equal(t, 60.0, res["exp"].(float64)-res["iat"].(float64), "should tell the lifetime")
+
+		req := httptest.NewRequest("POST", "/auth/introspect", strings.NewReader("token="+url.QueryEscape(token)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var form map[string]interface{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &form)
+		assert.Equal(t, res, form, "should accept form-encoded requests")
+		_, res = do(h, "POST", "/auth/introspect", "", `{"token": "invalid"}`)
+		assert.Equal(t, map[string]interface{}{"active": false}, res, "should report invalid tokens as inactive")
+	}
+	{
+		code, _ := do(h, "POST", "/auth/check", "", `{"role_id": 1}`)
+		assert.Equal(t, http.StatusUnauthorized, code, "should require a bearer token")
+		_, res := do(h, "POST", "/auth/check", token, `{"role_id": 1}`)
+		assert.Equal(t, true, res["allowed"], "should have the role")
+		_, res = do(h, "POST", "/auth/check", token, `{"permission": "devices:wipe"}`)
+		assert.Equal(t, false, res["allowed"], "should not have the permission")
+	}
+	{
+		code, _ := do(h, "POST", "/auth/logout", token, "")
+		assert.Equal(t, http.StatusNoContent, code, "should success")
+		code, _ = do(h, "POST", "/auth/check", token, `{"role_id": 1}`)
+		assert.Equal(t, http.StatusUnauthorized, code, "the token should be invalidated")
+	}
+	{
+		_, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456", "permissions": ["devices:list"]}`)
+		scoped := res["token"].(string)
+		_, res = do(h, "POST", "/auth/check", scoped, `{"permission": "devices:scan"}`)
+		assert.Equal(t, false, res["allowed"], "should limit the token to the scope")
+		_, res = do(h, "GET", "/users/1/tokens", "", "")
+		assert.Equal(t, map[string]interface{}{"permissions": []interface{}{"devices:list"}}, res["tokens"].([]interface{})[0].(map[string]interface{})["scope"], "should list the scope")
+		code, _ := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456", "roles": [2]}`)
+		assert.Equal(t, http.StatusForbidden, code, "should map ErrInvalidScope")
+	}
+	{
+		code, _ := do(h, "GET", "/auth/jwks", "", "")
+		assert.Equal(t, http.StatusNotImplemented, code, "should need JWT mode")
+		_, priv, _ := ed25519.GenerateKey(rand.Reader)
+		jwtSvr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, JWT: &auth.JWTConfig{Algorithm: auth.EdDSA, Key: priv, KeyID: "k1"}})
+		code, res := do(NewHandler(jwtSvr, openAdmin), "GET", "/auth/jwks", "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		keys := res["keys"].([]interface{})
+		assert.Equal(t, 1, len(keys), "should publish the key")
+		assert.Equal(t, "k1", keys[0].(map[string]interface{})["kid"], "should give the key ID")
+	}
+}
+
+func TestSuspendEndpoints(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	token, _ := svr.Authenticate("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+
+	code, _ := do(h, "POST", fmt.Sprintf("/users/%d/suspend", uid), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should suspend the user")
+	_, res := do(h, "GET", fmt.Sprintf("/users/%d", uid), "", "")
+	assert.Equal(t, true, res["suspended"], "should report the status")
+	code, res = do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusForbidden, code, "should map ErrUserSuspended")
+	assert.Equal(t, auth.ErrUserSuspended.Error(), res["error"], "should report the error")
+	_, res = do(h, "POST", "/auth/introspect", "", `{"token": "`+string(token)+`"}`)
+	assert.Equal(t, false, res["active"], "should report the tokens as inactive")
+
+	code, _ = do(h, "POST", fmt.Sprintf("/users/%d/reactivate", uid), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should reactivate the user")
+	code, _ = do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusOK, code, "should accept the user again")
+	code, _ = do(h, "POST", "/users/101/suspend", "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should map ErrUserNotExist")
+}
+
+func TestRestoreEndpoint(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, SoftDeleteSec: 3600, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+
+	code, _ := do(h, "DELETE", fmt.Sprintf("/users/%d", uid), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should delete the user")
+	code, _ = do(h, "GET", fmt.Sprintf("/users/%d", uid), "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should hide the deleted user")
+	_, res := do(h, "GET", "/users", "", "")
+	user := res["users"].([]interface{})[0].(map[string]interface{})
+	assert.NotEqual(t, nil, user["deleted"], "should list the deleted user with the time of deletion")
+	code, _ = do(h, "POST", fmt.Sprintf("/users/%d/restore", uid), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should restore the user")
+	code, _ = do(h, "POST", fmt.Sprintf("/users/%d/restore", uid), "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should not restore a user that is not deleted")
+}
+
+func TestUserDataEndpoints(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	svr.AuthenticateClient("elton", "123456", auth.ClientInfo{IP: "203.0.113.7"})
+	h := NewHandler(svr, openAdmin)
+
+	code, res := do(h, "GET", fmt.Sprintf("/users/%d/data", uid), "", "")
+	assert.Equal(t, http.StatusOK, code, "should export the data of the user")
+	assert.Equal(t, "elton", res["name"], "should give the profile")
+	assert.Equal(t, 1, len(res["sessions"].([]interface{})), "should give the sessions")
+	login := res["logins"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "203.0.113.7", login["ip"], "should give the logins")
+	code, _ = do(h, "POST", fmt.Sprintf("/users/%d/erase", uid), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should erase the user")
+	code, _ = do(h, "GET", fmt.Sprintf("/users/%d/data", uid), "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should have nothing left")
+}
+
+func TestAdminPermission(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("root", "123456")
+	svr.CreateUser("guest", "123456")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(uid, rid)
+	svr.GrantPermissionToRole(rid, "auth:admin")
+	h := NewHandler(svr, &Options{AdminPermission: "auth:admin"})
+	root, _ := svr.Authenticate("root", "123456")
+	guest, _ := svr.Authenticate("guest", "123456")
+
+	code, _ := do(h, "GET", "/users/1", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+	code, _ = do(h, "GET", "/users/1", string(guest), "")
+	assert.Equal(t, http.StatusForbidden, code, "should require the admin permission")
+	code, _ = do(h, "GET", "/users/1", string(root), "")
+	assert.Equal(t, http.StatusOK, code, "should allow admins")
+	code, _ = do(h, "POST", "/auth/login", "", `{"username": "guest", "password": "123456"}`)
+	assert.Equal(t, http.StatusOK, code, "should not protect authentication")
+	code, _ = do(h, "POST", "/auth/introspect", "", `{"token": "`+string(guest)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "should require a token to introspect")
+	code, _ = do(h, "POST", "/auth/introspect", string(guest), `{"token": "`+string(guest)+`"}`)
+	assert.Equal(t, http.StatusForbidden, code, "should require the admin permission to introspect")
+	code, res := do(h, "POST", "/auth/introspect", string(root), `{"token": "`+string(guest)+`"}`)
+	assert.Equal(t, true, res["active"], "should allow admins to introspect")
+	{
+		gid, _ := svr.CreateRole("gateway")
+		svr.GrantPermissionToRole(gid, "auth:introspect")
+		svr.AddRoleToUser(2, gid)
+		h := NewHandler(svr, &Options{AdminPermission: "auth:admin", IntrospectPermission: "auth:introspect"})
+		_, res = do(h, "POST", "/auth/introspect", string(guest), `{"token": "`+string(root)+`"}`)
+		assert.Equal(t, true, res["active"], "should allow the introspect permission")
+		code, _ = do(h, "POST", "/auth/introspect", string(root), `{"token": "`+string(guest)+`"}`)
+		assert.Equal(t, http.StatusForbidden, code, "should require it instead of the admin permission")
+		code, _ = do(h, "GET", "/users/1", string(guest), "")
+		assert.Equal(t, http.StatusForbidden, code, "should not grant the admin endpoints")
+	}
+	code, _ = do(NewHandler(svr, nil), "GET", "/users/1", "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should not serve the admin endpoints without a permission")
+	code, _ = do(NewHandler(svr, nil), "POST", "/auth/introspect", "", `{"token": "`+string(guest)+`"}`)
+	assert.Equal(t, http.StatusNotFound, code, "should not serve introspection without a permission")
+	code, _ = do(NewHandler(svr, nil), "POST", "/auth/login", "", `{"username": "guest", "password": "123456"}`)
+	assert.Equal(t, http.StatusOK, code, "should serve the others")
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"username": "elton", "password": "123456", "device": "CI runner"}`))
+	req.RemoteAddr = "192.0.2.1:50000"
+	req.Header.Set("User-Agent", "tester/1.0")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "should success")
+	var login map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &login)
+
+	code, res := do(h, "GET", "/users/1/tokens", "", "")
+	assert.Equal(t, http.StatusOK, code, "should success")
+	tokens := res["tokens"].([]interface{})
+	assert.Equal(t, 1, len(tokens), "should list the session")
+	info := tokens[0].(map[string]interface{})
+	assert.Equal(t, "192.0.2.1", info["ip"], "should record the client IP")
+	assert.Equal(t, "tester/1.0", info["user_agent"], "should record the user agent")
+	assert.Equal(t, "CI runner", info["device"], "should record the device")
+
+	code, _ = do(h, "DELETE", "/users/1/tokens/unknown", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code, "should map ErrInvalidToken")
+	code, _ = do(h, "DELETE", "/users/1/tokens/"+info["id"].(string), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should invalidate the token")
+	_, err := svr.TokenUser(auth.TokenValue(login["token"]))
+	assert.Equal(t, auth.ErrInvalidToken, err, "the token should be invalidated")
+	list, _ := svr.ListTokens(uid)
+	assert.Equal(t, 0, len(list), "should have no sessions left")
+
+	do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "654321"}`)
+	_, res = do(h, "GET", "/users/1/logins", "", "")
+	logins := res["logins"].([]interface{})
+	assert.Equal(t, 2, len(logins), "should list the logins")
+	assert.Equal(t, false, logins[0].(map[string]interface{})["success"], "should list the newest login first")
+	assert.Equal(t, "192.0.2.1", logins[1].(map[string]interface{})["ip"], "should record the client IP")
+}
+
+func TestTokenBinding(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, BindTokens: true, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("elton", "123456")
+	rid, _ := svr.CreateRole("admin")
+	svr.AddRoleToUser(uid, rid)
+	h := NewHandler(svr, openAdmin)
+	// httptest requests come from 192.0.2.1
+	_, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	token := res["token"].(string)
+	_, res = do(h, "POST", "/auth/check", token, fmt.Sprintf(`{"role_id": %d}`, rid))
+	assert.Equal(t, true, res["allowed"], "should verify for the same client")
+	req := httptest.NewRequest("POST", "/auth/check", strings.NewReader(fmt.Sprintf(`{"role_id": %d}`, rid)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.RemoteAddr = "198.51.100.7:50000"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "should reject the token from another IP")
+}
+
+func TestRateLimit(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, RateLimiter: &auth.TokenBucket{Burst: 1}, Hasher: &auth.BcryptHasher{Cost: 4}})
+	svr.CreateUser("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+	code, _ := do(h, "POST", "/auth/login", "", `{"username": "anna", "password": "123456"}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "should check the password within the allowance")
+	code, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusTooManyRequests, code, "should throttle the source IP")
+	assert.Equal(t, auth.ErrRateLimited.Error(), res["error"], "should tell why")
+}
+
+func TestLimits(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, MaxTokensPerUser: 1, Hasher: &auth.BcryptHasher{Cost: 4}})
+	svr.CreateUser("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+	code, _ := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusOK, code, "should log in within the limit")
+	code, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusInsufficientStorage, code, "should map ErrTooManyTokens")
+	assert.Equal(t, auth.ErrTooManyTokens.Error(), res["error"], "should tell why")
+}
+
+func TestClosed(t *testing.T) {
+	svr := newTestServer()
+	svr.CreateUser("elton", "123456")
+	svr.Close(context.Background())
+	h := NewHandler(svr, openAdmin)
+	code, res := do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should map ErrServerClosed")
+	assert.Equal(t, auth.ErrServerClosed.Error(), res["error"], "should tell why")
+	assert.Equal(t, "server_closed", res["code"], "should tell the code")
+}
+
+func TestStepUp(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, StepUp: []auth.StepUp{{Permission: "billing:refund", Level: auth.AuthMFA}},
+		Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("accountant")
+	svr.GrantPermissionToRole(rid, "billing:refund")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	h := NewHandler(svr, openAdmin)
+	code, res := do(h, "POST", "/auth/check", string(token), `{"permission": "billing:refund"}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "should map ErrStepUpRequired")
+	assert.Equal(t, auth.ErrStepUpRequired.Error(), res["error"], "should tell why")
+	_, res = do(h, "POST", "/auth/introspect", "", fmt.Sprintf(`{"token": %q}`, token))
+	assert.NotEqual(t, nil, res["auth_time"], "should introspect the auth time")
+}
+
+func TestImpersonation(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, ImpersonatePermission: "users:impersonate", Hasher: &auth.BcryptHasher{Cost: 4}})
+	support, _ := svr.CreateUser("support", "passw0rd")
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("support")
+	svr.GrantPermissionToRole(rid, "users:impersonate")
+	svr.AddRoleToUser(support, rid)
+	admin, _ := svr.Authenticate("support", "passw0rd")
+	user, _ := svr.Authenticate("anna", "passw0rd")
+	h := NewHandler(svr, openAdmin)
+
+	code, res := do(h, "POST", "/auth/impersonate", string(admin), fmt.Sprintf(`{"user_id": %d}`, anna))
+	assert.Equal(t, http.StatusOK, code, "should success")
+	_, res = do(h, "POST", "/auth/introspect", "", fmt.Sprintf(`{"token": %q}`, res["token"]))
+	assert.Equal(t, "anna", res["username"], "should act as the user")
+	assert.Equal(t, "support", res["act"].(map[string]interface{})["username"], "should tell the actor")
+	_, res = do(h, "GET", fmt.Sprintf("/users/%d/tokens", anna), "", "")
+	assert.Equal(t, float64(support), res["tokens"].([]interface{})[1].(map[string]interface{})["actor_id"], "should list the actor")
+	code, _ = do(h, "POST", "/auth/impersonate", string(user), fmt.Sprintf(`{"user_id": %d}`, support))
+	assert.Equal(t, http.StatusForbidden, code, "should map ErrImpersonationDenied")
+}
+
+func TestServiceAccountEndpoints(t *testing.T) {
+	svr := newTestServer()
+	h := NewHandler(svr, openAdmin)
+	code, res := do(h, "POST", "/users", "", `{"name": "ci", "service": true}`)
+	assert.Equal(t, http.StatusCreated, code, "should create the service account")
+	assert.Equal(t, 1.0, res["id"], "should return the ID")
+	_, err := svr.TokenUser(auth.TokenValue(res["key"].(string)))
+	assert.Equal(t, nil, err, "should return a working key")
+	_, res = do(h, "GET", "/users/1", "", "")
+	assert.Equal(t, true, res["service"], "should tell service accounts")
+	code, _ = do(h, "POST", "/users", "", `{"name": "cd", "password": "passw0rd", "service": true}`)
+	assert.Equal(t, http.StatusBadRequest, code, "should not give passwords to service accounts")
+
+	code, res = do(h, "POST", "/users/1/rotate", "", `{"grace_sec": 0}`)
+	assert.Equal(t, http.StatusOK, code, "should rotate the key")
+	_, err = svr.TokenUser(auth.TokenValue(res["key"].(string)))
+	assert.Equal(t, nil, err, "should return a working key")
+	svr.CreateUser("anna", "passw0rd")
+	code, _ = do(h, "POST", "/users/2/rotate", "", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code, "should map ErrNotServiceAccount")
+}
+
+func TestAPIKeyEndpoints(t *testing.T) {
+	svr := newTestServer()
+	h := NewHandler(svr, openAdmin)
+	svr.CreateUser("ci", "passw0rd")
+	rid, _ := svr.CreateRole("deployer")
+	svr.GrantPermissionToRole(rid, "deploy:*")
+	svr.AddRoleToUser(1, rid)
+	code, res := do(h, "POST", "/users/1/apikeys", "", `{"name": "pipeline", "scopes": ["deploy:*"]}`)
+	assert.Equal(t, http.StatusCreated, code, "should create the key")
+	key := auth.TokenValue(res["key"].(string))
+	ok, _ := svr.CheckPermission(key, "deploy:prod")
+	assert.Equal(t, true, ok, "should return a working key")
+
+	code, res = do(h, "GET", "/users/1/apikeys", "", "")
+	assert.Equal(t, http.StatusOK, code, "should success")
+	keys := res["api_keys"].([]interface{})
+	assert.Equal(t, 1, len(keys), "should list the key")
+	info := keys[0].(map[string]interface{})
+	assert.Equal(t, "pipeline", info["name"], "should list the name")
+	assert.Equal(t, nil, info["expires"], "should omit the expiry of keys that do not expire")
+
+	code, _ = do(h, "DELETE", "/users/1/apikeys/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, code, "should map ErrAPIKeyNotExist")
+	code, _ = do(h, "DELETE", "/users/1/apikeys/"+info["id"].(string), "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should revoke the key")
+	_, err := svr.TokenUser(key)
+	assert.Equal(t, auth.ErrInvalidToken, err, "the key should be revoked")
+}
+
+// totp computes the current code for a base32 secret, like an authenticator app.
+func totp(secret string) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[off:])&0x7fffffff)%1000000)
+}
+
+func TestMFAEndpoints(t *testing.T) {
+	svr := newTestServer()
+	svr.CreateUser("elton", "123456")
+	h := NewHandler(svr, openAdmin)
+
+	code, res := do(h, "POST", "/users/1/totp", "", "")
+	assert.Equal(t, http.StatusCreated, code, "should enroll the user")
+	secret := res["secret"].(string)
+	code, _ = do(h, "POST", "/users/1/totp", "", "")
+	assert.Equal(t, http.StatusCreated, code, "should replace an unconfirmed enrollment")
+	_, res = do(h, "POST", "/users/1/totp", "", "")
+	secret = res["secret"].(string)
+	assert.Equal(t, 10, len(res["recovery_codes"].([]interface{})), "should give recovery codes")
+	_, res = do(h, "POST", "/users/1/totp/verify", "", `{"code": "`+totp(secret)+`"}`)
+	assert.Equal(t, true, res["valid"], "should confirm the enrollment")
+	code, _ = do(h, "POST", "/users/1/totp", "", "")
+	assert.Equal(t, http.StatusConflict, code, "should map ErrMFAEnrolled")
+
+	_, res = do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	assert.Equal(t, true, res["mfa_required"], "should require MFA")
+	challenge := res["challenge"].(string)
+	code, _ = do(h, "POST", "/auth/mfa", "", `{"challenge": "`+challenge+`", "code": "abcdef"}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "should map ErrInvalidCode")
+	_, res = do(h, "POST", "/users/1/totp/recovery", "", "")
+	recovery := res["recovery_codes"].([]interface{})[0].(string)
+	code, _ = do(h, "POST", "/auth/mfa", "", `{"challenge": "`+challenge+`", "code": "`+recovery+`"}`)
+	assert.Equal(t, http.StatusOK, code, "should accept a recovery code")
+	_, res = do(h, "GET", "/users/1/totp/recovery", "", "")
+	assert.Equal(t, float64(9), res["remaining"], "should count the codes left")
+	_, res = do(h, "POST", "/auth/login", "", `{"username": "elton", "password": "123456"}`)
+	challenge = res["challenge"].(string)
+
+	code, _ = do(h, "DELETE", "/users/1/totp", "", "")
+	assert.Equal(t, http.StatusNoContent, code, "should disable MFA")
+	code, res = do(h, "POST", "/auth/mfa", "", `{"challenge": "`+challenge+`", "code": "abcdef"}`)
+	assert.Equal(t, http.StatusOK, code, "should let pending challenges through once MFA is off")
+	_, res = do(h, "POST", "/auth/introspect", "", `{"token": "`+res["token"].(string)+`"}`)
+	assert.Equal(t, true, res["active"], "should give a working token")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	svr := newTestServer()
+	svr.CreateUser("elton", "123456")
+	svr.Authenticate("elton", "654321")
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(svr).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "should success")
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"), "should use the Prometheus text format")
+	assert.Contains(t, rec.Body.String(), "# TYPE auth_failed_logins_total counter\nauth_failed_logins_total 1\n", "should count failed logins")
+	assert.Contains(t, rec.Body.String(), "\nauth_users 1\n", "should count users")
+}
+
+func TestRealms(t *testing.T) {
+	realms, _ := auth.NewRealms(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}, nil)
+	h := RealmsHandler(realms, &Options{AdminPermission: "admin"})
+	var tokens []string
+	for _, name := range []string{"acme", "globex"} {
+		svr, _ := realms.CreateRealm(name, nil)
+		uid, _ := svr.CreateUser("root", "passw0rd")
+		rid, _ := svr.CreateRole("admin")
+		svr.GrantPermissionToRole(rid, "admin")
+		svr.AddRoleToUser(uid, rid)
+		_, res := do(h, "POST", "/realms/"+name+"/auth/login", "", `{"username": "root", "password": "passw0rd"}`)
+		token, _ := res["token"].(string)
+		tokens = append(tokens, token)
+	}
+	{
+		code, res := do(h, "GET", "/realms", "", "")
+		assert.Equal(t, http.StatusOK, code, "should list the realms")
+		assert.Equal(t, []interface{}{"acme", "globex"}, res["realms"], "should give the names")
+		code, _ = do(h, "GET", "/realms/initech/users", tokens[0], "")
+		assert.Equal(t, http.StatusNotFound, code, "should report missing realms")
+		code, _ = do(h, "GET", "/users", tokens[0], "")
+		assert.Equal(t, http.StatusNotFound, code, "should only serve realms")
+	}
+	{
+		code, _ := do(h, "POST", "/realms/acme/users", tokens[0], `{"name": "anna", "password": "passw0rd"}`)
+		assert.Equal(t, http.StatusCreated, code, "should serve the API of the realm")
+		code, _ = do(h, "GET", "/realms/globex/users/1", tokens[0], "")
+		assert.Equal(t, http.StatusUnauthorized, code, "should not accept admins of other realms")
+		code, res := do(h, "GET", "/realms/globex/users?prefix=an", tokens[1], "")
+		assert.Equal(t, http.StatusOK, code, "should accept admins of the realm")
+		assert.Equal(t, 0, len(res["users"].([]interface{})), "should keep the users of each realm")
+		_, res = do(h, "POST", "/realms/acme/auth/introspect", tokens[0], `{"token": "`+tokens[0]+`"}`)
+		assert.Equal(t, "acme", res["realm"], "should tell the realm of tokens")
+	}
+	{
+		realms, _ := auth.NewRealms(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4},
+			JWT: &auth.JWTConfig{Algorithm: auth.HS256, Key: []byte("s3cr3t")}}, nil)
+		h := RealmsHandler(realms, &Options{AdminPermission: "admin"})
+		for _, name := range []string{"acme", "globex"} {
+			svr, _ := realms.CreateRealm(name, nil)
+			uid, _ := svr.CreateUser("root", "passw0rd")
+			rid, _ := svr.CreateRole("admin")
+			svr.GrantPermissionToRole(rid, "admin")
+			svr.AddRoleToUser(uid, rid)
+		}
+		_, res := do(h, "POST", "/realms/acme/auth/login", "", `{"username": "root", "password": "passw0rd"}`)
+		token, _ := res["token"].(string)
+		code, _ := do(h, "GET", "/realms/acme/users/1", token, "")
+		assert.Equal(t, http.StatusOK, code, "should accept the JWTs of admins of the realm")
+		code, _ = do(h, "GET", "/realms/globex/users/1", token, "")
+		assert.Equal(t, http.StatusUnauthorized, code, "should not accept the JWTs of admins of other realms")
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	h := NewHandler(newTestServer(), openAdmin)
+	{
+		code, res := do(h, "POST", "/users/import?format=csv", "", "name,password\nanna,passw0rd\nbelle,x\n")
+		assert.Equal(t, http.StatusOK, code, "should import")
+		assert.Equal(t, 1.0, res["created"], "should count the users created")
+		assert.Equal(t, []interface{}{map[string]interface{}{"line": 3.0, "name": "belle", "error": auth.ErrWeakPassword.Error()}},
+			res["failed"], "should report the failed records")
+		code, _ = do(h, "POST", "/users/import?format=csv", "", "name,email\n")
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrBadImport")
+		code, _ = do(h, "POST", "/users/import?format=xml", "", "")
+		assert.Equal(t, http.StatusBadRequest, code, "should check the format")
+	}
+	{
+		req := httptest.NewRequest("GET", "/users/export", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "should export")
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"), "should export JSON Lines")
+		var u auth.UserRecord
+		_ = json.Unmarshal(rec.Body.Bytes(), &u)
+		assert.Equal(t, "anna", u.Name, "should export the users")
+		assert.NotEqual(t, "", u.PasswordHash, "should export the hashes")
+	}
+}
+
+func TestApply(t *testing.T) {
+	svr := newTestServer()
+	svr.CreateUser("anna", "passw0rd")
+	svr.CreateRole("legacy")
+	h := NewHandler(svr, openAdmin)
+	spec := `{"roles": [{"name": "reader", "permissions": ["orders:read"]}], "users": [{"name": "anna", "roles": ["reader"]}]}`
+	{
+		code, res := do(h, "POST", "/apply?prune=true&dry_run=true", "", spec)
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, 4, len(res["changes"].([]interface{})), "should list the changes")
+		assert.Equal(t, (*auth.Role)(nil), svr.GetRoleByName("reader"), "should not make changes in a dry run")
+		code, _ = do(h, "POST", "/apply?prune=maybe", "", spec)
+		assert.Equal(t, http.StatusBadRequest, code, "should check the options")
+		code, _ = do(h, "POST", "/apply", "", `{"roles": [{"name": "a"}, {"name": "a"}]}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrInvalidSpec")
+	}
+	{
+		do(h, "POST", "/apply?prune=true", "", spec)
+		assert.NotEqual(t, (*auth.Role)(nil), svr.GetRoleByName("reader"), "should apply the spec")
+		assert.Equal(t, (*auth.Role)(nil), svr.GetRoleByName("legacy"), "should prune")
+		_, res := do(h, "POST", "/apply", "", spec)
+		assert.Equal(t, []interface{}{}, res["changes"], "should report no changes")
+	}
+}
+
+// FuzzHandler sends malformed requests, which should be rejected as such: the storage is in memory,
+// so a 500 is a bug, as is a panic.
+func FuzzHandler(f *testing.F) {
+	svr := newTestServer()
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	h := NewHandler(svr, openAdmin)
+	for _, seed := range []struct{ method, path, body string }{
+		{"POST", "/auth/login", `{"username": "anna", "password": "passw0rd", "roles": [1]}`},
+		{"POST", "/auth/check", `{"permission": "orders:read"}`},
+		{"POST", "/auth/introspect", `{"token": "x"}`},
+		{"POST", "/users", `{"name": "fred", "password": "passw0rd"}`},
+		{"PUT", "/users/1/roles/1", ``},
+		{"GET", "/users?limit=1&cursor=x&sort=-name", ``},
+		{"POST", "/users/import", `{"name": "bob", "hash": "$2a$04$x"}`},
+		{"POST", "/roles", `{"name": "writer"}`},
+		{"POST", "/apply?dry_run=true", `{"roles": [{"name": "clerk", "permissions": ["orders:*"]}]}`},
+		{"PUT", "/policies/p", `{"source": "subject.name == \"anna\""}`},
+		{"POST", "/auth/login", `{"username": 1}`},
+		{"GET", "/users/18446744073709551616", ``},
+	} {
+		f.Add(seed.method, seed.path, string(token), seed.body)
+	}
+	f.Fuzz(func(t *testing.T, method, path, token, body string) {
+		req, err := http.NewRequest(method, "http://auth.example.com/", strings.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.URL.Path = path
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.NotEqual(t, http.StatusInternalServerError, rec.Code, "should reject malformed requests: %s", rec.Body)
+	})
+}
@@ -0,0 +1,1327 @@
+// Package httpapi exposes an auth.Server as a JSON REST API.
+//
+// Endpoints (IDs are decimal numbers, bodies are JSON):
+//
+//	GET    /users?prefix&sort&order&limit&cursor -> {"users": [{"id", "name", "email", "email_verified", "roles", "groups", "suspended", "deleted", "metadata"}], "next"}
+//	POST   /users                        {"name", "password"} -> 201 {"id"}
+//	POST   /users                        {"name", "service": true} -> 201 {"id", "key"}
+//	POST   /users/import?format          JSON Lines or CSV of auth.UserRecord -> {"created", "failed": [{"line", "name", "error"}]}
+//	GET    /users/export?format          -> JSON Lines or CSV of auth.UserRecord
+//	POST   /users/password-reset         {"identifier"} -> 201 {"token"}, to send to the user
+//	GET    /users/{id}                   -> {"id", "name", "email", "email_verified", "roles", "groups", "suspended", "service", "denied", "attributes", "metadata"}
+//	DELETE /users/{id}                   -> 204
+//	POST   /users/{id}/name              {"name"} -> 204
+//	POST   /users/{id}/roles             {"role_id", "expires"?} or {"role_id", "resource"} -> 204
+//	DELETE /users/{id}/roles/{role}?resource -> 204
+//	POST   /users/{id}/attributes        auth.Attributes -> 204
+//	DELETE /users/{id}/attributes/{key}  -> 204
+//	GET    /users/{id}/metadata          -> {key: value}
+//	POST   /users/{id}/email             {"email"} -> 204
+//	POST   /users/{id}/email/verification -> 201 {"token"}, to send to the address
+//	POST   /users/{id}/metadata          {key: value}, empty values removing keys -> 204
+//	POST   /users/{id}/denies            {"permission"} -> 204
+//	DELETE /users/{id}/denies/{p}        -> 204
+//	GET    /users/{id}/tokens            -> {"tokens": [{"id", "issued", "expires", "ip", "user_agent", "device", "scope", "actor_id"}]}
+//	DELETE /users/{id}/tokens/{token_id} -> 204
+//	GET    /users/{id}/logins            -> {"logins": [{"time", "success", "ip", "user_agent"}]}
+//	GET    /users/{id}/apikeys           -> {"api_keys": [{"id", "name", "scopes", "created", "expires", "last_used"}]}
+//	POST   /users/{id}/apikeys           {"name", "scopes", "expires"} -> 201 {"key"}
+//	DELETE /users/{id}/apikeys/{key_id}  -> 204
+//	POST   /users/{id}/rotate            {"grace_sec"} -> {"key"}
+//	POST   /users/{id}/totp              -> 201 {"secret", "uri", "recovery_codes"}
+//	POST   /users/{id}/totp/verify       {"code"} -> {"valid"}
+//	GET    /users/{id}/totp/recovery     -> {"remaining"}
+//	POST   /users/{id}/totp/recovery     -> {"recovery_codes"}
+//	DELETE /users/{id}/totp              -> 204
+//	POST   /users/{id}/suspend           -> 204
+//	POST   /users/{id}/reactivate        -> 204
+//	POST   /users/{id}/restore           -> 204
+//	GET    /users/{id}/data              -> auth.UserData, for data subject access requests
+//	POST   /users/{id}/erase             -> 204, see auth.Server.EraseUser
+//	GET    /roles?prefix&sort&order&limit&cursor -> {"roles": [{"id", "name", "permissions", "denied", "protected"}], "next"}
+//	POST   /roles                        {"name"} -> 201 {"id"}
+//	GET    /roles/{id}                   -> {"id", "name", "permissions", "denied", "protected"}
+//	DELETE /roles/{id}                   -> 204
+//	POST   /roles/{id}/name              {"name"} -> 204
+//	DELETE /roles/{id}?dry_run=true      -> {"users"}, without deleting
+//	POST   /roles/{id}/protect           -> 204
+//	POST   /roles/{id}/unprotect         -> 204
+//	GET    /roles/{id}/users             -> {"users"}
+//	POST   /roles/{id}/permissions       {"permission"} -> 204
+//	DELETE /roles/{id}/permissions/{p}   -> 204
+//	POST   /roles/{id}/denies            {"permission"} -> 204
+//	DELETE /roles/{id}/denies/{p}        -> 204
+//	POST   /groups                       {"name"} -> 201 {"id"}
+//	GET    /groups/{id}                  -> {"id", "name", "roles"}
+//	DELETE /groups/{id}                  -> 204
+//	GET    /groups/{id}/users            -> {"users"}
+//	POST   /groups/{id}/users            {"user_id"} -> 204
+//	DELETE /groups/{id}/users/{user}     -> 204
+//	POST   /groups/{id}/roles            {"role_id"} -> 204
+//	DELETE /groups/{id}/roles/{role}     -> 204
+//	POST   /apply?prune&dry_run          auth.Spec -> {"changes": [{"op", "role", "permission", "user"}]}
+//	GET    /policies                     -> {"policies"}
+//	GET    /policies/{name}              -> {"name", "source"}
+//	PUT    /policies/{name}              {"source"} -> 204
+//	DELETE /policies/{name}              -> 204
+//	POST   /auth/login                   {"username", "password", "roles", "permissions", "device"} -> {"token"} or {"mfa_required", "challenge"}
+//	POST   /auth/mfa                     {"challenge", "code"} -> {"token"}
+//	POST   /auth/verify-email            {"token"} -> {"user_id"}
+//	POST   /auth/reset-password          {"token", "password"} -> 204
+//	POST   /auth/introspect              {"token"} or token=..., with bearer token -> auth.Introspection
+//	POST   /auth/check                   {"role_id", "resource"?} or {"permission"}, with bearer token -> {"allowed"}
+//	POST   /auth/access                  {"policy", "attributes"}, with bearer token -> {"allowed"}
+//	POST   /auth/impersonate             {"user_id"}, with bearer token -> {"token"}, see auth.Server.Impersonate
+//	POST   /auth/logout                  with bearer token -> 204
+//	GET    /auth/jwks                    -> auth.JWKSet, in JWT mode with a public key
+//
+// The format of imports and exports is "json" (default) or "csv", see auth.UserFormat. An import
+// that fails midway can be sent again: the users created by the first attempt are reported as
+// taken.
+//
+// Listings are sorted by "id" (default) or "name", in "asc" (default) or "desc" order. The "next"
+// cursor is omitted on the last page, see auth.ListOptions.
+//
+// Errors are reported as {"error": "<message>", "code": "<code>"} with a matching status code,
+// see auth.ErrorCode.
+//
+// RealmsHandler serves the same endpoints for each realm of an auth.Realms, under /realms/{name}.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Options customizes the Handler.
+type Options struct {
+	// AdminPermission is required (through CheckPermission) for the /users, /roles, /groups,
+	// /apply and /policies endpoints. Without it they are not served, unless OpenAdmin is set.
+	AdminPermission string
+	// OpenAdmin serves the admin endpoints to everyone when AdminPermission is empty, for handlers
+	// that are protected by other means.
+	OpenAdmin bool
+	// IntrospectPermission is required instead of AdminPermission for /auth/introspect, whose
+	// callers must authenticate (RFC 7662, section 2.1), e.g. to let gateways introspect tokens.
+	IntrospectPermission string
+	// MaxBodyBytes limits the size of request bodies. Defaults to 64 KiB.
+	MaxBodyBytes int64
+	// MaxImportBytes limits the size of the bodies of /users/import and /apply instead. Defaults to
+	// 64 MiB.
+	MaxImportBytes int64
+}
+
+// Handler serves the REST API of an auth server.
+type Handler struct {
+	svr  *auth.Server
+	opts Options
+}
+
+var (
+	ErrNotFound   error = auth.NewError("not_found", http.StatusNotFound, "not found")
+	ErrBadRequest error = auth.NewError("bad_request", http.StatusBadRequest, "malformed request")
+	ErrNoToken    error = auth.NewError("no_token", http.StatusUnauthorized, "missing bearer token")
+	ErrForbidden  error = auth.NewError("forbidden", http.StatusForbidden, "permission denied")
+	errBadMethod  error = auth.NewError("method_not_allowed", http.StatusMethodNotAllowed, "method not allowed")
+)
+
+// NewHandler creates a Handler. opts can be nil.
+func NewHandler(svr *auth.Server, opts *Options) *Handler {
+	h := &Handler{svr: svr}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.MaxBodyBytes <= 0 {
+		h.opts.MaxBodyBytes = 64 << 10
+	}
+	if h.opts.MaxImportBytes <= 0 {
+		h.opts.MaxImportBytes = 64 << 20
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	limit := h.opts.MaxBodyBytes
+	if (len(path) == 2 && path[0] == "users" && path[1] == "import") || path[0] == "apply" {
+		limit = h.opts.MaxImportBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	// Handlers are called on a copy, so that storage calls are canceled with the request, and tokens
+	// bound to their client are verified against it
+	h = &Handler{svr: h.svr.WithContext(auth.WithClientInfo(r.Context(), clientInfo(r))), opts: h.opts}
+
+	var err error
+	switch path[0] {
+	case "auth":
+		err = h.serveAuth(w, r, path[1:])
+	case "users", "roles", "groups", "apply", "policies":
+		if err = h.checkAdmin(r); err != nil {
+			break
+		}
+		switch path[0] {
+		case "users":
+			err = h.serveUsers(w, r, path[1:])
+		case "roles":
+			err = h.serveRoles(w, r, path[1:])
+		case "apply":
+			err = h.serveApply(w, r, path[1:])
+		case "policies":
+			err = h.servePolicies(w, r, path[1:])
+		default:
+			err = h.serveGroups(w, r, path[1:])
+		}
+	default:
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// *-* Authentication *-*
+
+// loginRequest may limit the token to some roles and permissions, see auth.TokenScope.
+type loginRequest struct {
+	Username    string        `json:"username"`
+	Password    string        `json:"password"`
+	Roles       []auth.RoleID `json:"roles"`
+	Permissions []string      `json:"permissions"`
+	Device      string        `json:"device"` // a label for the device, see auth.ClientInfo
+}
+
+type tokenRequest struct {
+	Token auth.TokenValue `json:"token"`
+}
+
+type mfaResponse struct {
+	MFARequired bool            `json:"mfa_required"`
+	Challenge   auth.TokenValue `json:"challenge"`
+}
+
+type resetRequest struct {
+	Identifier string `json:"identifier"`
+}
+
+type completeResetRequest struct {
+	Token    auth.TokenValue `json:"token"`
+	Password string          `json:"password"`
+}
+
+type mfaRequest struct {
+	Challenge auth.TokenValue `json:"challenge"`
+	Code      string          `json:"code"`
+}
+
+type accessRequest struct {
+	Policy     string          `json:"policy"`
+	Attributes auth.Attributes `json:"attributes"`
+}
+
+type checkRequest struct {
+	RoleID     auth.RoleID `json:"role_id"`
+	Permission string      `json:"permission"`
+	Resource   string      `json:"resource"`
+}
+
+func (h *Handler) serveAuth(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) != 1 {
+		return ErrNotFound
+	}
+	if path[0] == "jwks" {
+		if r.Method != http.MethodGet {
+			return errBadMethod
+		}
+		set, err := h.svr.JWKSet()
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, set)
+		return nil
+	}
+	if r.Method != http.MethodPost {
+		return errBadMethod
+	}
+
+	switch path[0] {
+	case "login":
+		var req loginRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		var scope *auth.TokenScope
+		if len(req.Roles) > 0 || len(req.Permissions) > 0 {
+			scope = &auth.TokenScope{Roles: req.Roles, Permissions: req.Permissions}
+		}
+		client := clientInfo(r)
+		client.Device = req.Device
+		token, err := h.svr.AuthenticateScoped(req.Username, req.Password, client, scope)
+		if err == auth.ErrMFARequired {
+			writeJSON(w, http.StatusOK, mfaResponse{MFARequired: true, Challenge: token})
+			return nil
+		} else if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, tokenRequest{Token: token})
+	case "mfa":
+		var req mfaRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		token, err := h.svr.CompleteMFA(req.Challenge, req.Code)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, tokenRequest{Token: token})
+	case "verify-email":
+		var req tokenRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		id, err := h.svr.VerifyEmail(req.Token)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]auth.UserID{"user_id": id})
+	case "reset-password":
+		var req completeResetRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.CompletePasswordReset(req.Token, req.Password); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "introspect":
+		// Form-encoded, as in RFC 7662, or JSON
+		var req tokenRequest
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			if err := r.ParseForm(); err != nil {
+				return ErrBadRequest
+			}
+			req.Token = auth.TokenValue(r.PostForm.Get("token"))
+		} else if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		perm := h.opts.IntrospectPermission
+		if perm == "" {
+			perm = h.opts.AdminPermission
+		}
+		if err := h.checkPermission(r, perm); err != nil {
+			return err
+		}
+		in, err := h.svr.Introspect(req.Token)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, in)
+	case "check":
+		token, err := bearerToken(r)
+		if err != nil {
+			return err
+		}
+		var req checkRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		var allowed bool
+		if req.Permission != "" {
+			allowed, err = h.svr.CheckPermission(token, req.Permission)
+		} else if req.Resource != "" {
+			allowed, err = h.svr.CheckRoleOnResource(token, req.RoleID, req.Resource)
+		} else {
+			allowed, err = h.svr.CheckRole(token, req.RoleID)
+		}
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"allowed": allowed})
+	case "access":
+		token, err := bearerToken(r)
+		if err != nil {
+			return err
+		}
+		var req accessRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if req.Attributes == nil {
+			req.Attributes = auth.Attributes{}
+		}
+		allowed, err := h.svr.CheckAccess(token, &auth.AccessInput{Policy: req.Policy, Attributes: req.Attributes})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"allowed": allowed})
+	case "impersonate":
+		token, err := bearerToken(r)
+		if err != nil {
+			return err
+		}
+		var req userIDRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		token, err = h.svr.Impersonate(token, req.UserID, clientInfo(r))
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, tokenRequest{Token: token})
+	case "logout":
+		token, err := bearerToken(r)
+		if err != nil {
+			return err
+		}
+		h.svr.Invalidate(token)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkAdmin enforces Options.AdminPermission.
+func (h *Handler) checkAdmin(r *http.Request) error {
+	return h.checkPermission(r, h.opts.AdminPermission)
+}
+
+// checkPermission requires the bearer token of a request to grant perm. Without perm, the endpoint
+// is not found, unless Options.OpenAdmin is set.
+func (h *Handler) checkPermission(r *http.Request, perm string) error {
+	if perm == "" {
+		if h.opts.OpenAdmin {
+			return nil
+		}
+		return ErrNotFound
+	}
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	ok, err := h.svr.CheckPermission(token, perm)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// *-* Users *-*
+
+type createUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Service  bool   `json:"service"` // a service account, which has no password
+}
+
+type serviceAccountResponse struct {
+	ID  auth.UserID     `json:"id"`
+	Key auth.TokenValue `json:"key"`
+}
+
+// nameRequest renames a user or a role.
+type nameRequest struct {
+	Name string `json:"name"`
+}
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+type rotateRequest struct {
+	GraceSec int64 `json:"grace_sec"`
+}
+
+type idResponse struct {
+	ID int64 `json:"id"`
+}
+
+type userResponse struct {
+	ID            auth.UserID       `json:"id"`
+	Name          string            `json:"name"`
+	Email         string            `json:"email,omitempty"`
+	EmailVerified bool              `json:"email_verified,omitempty"`
+	Roles         []auth.RoleID     `json:"roles"`
+	Groups        []auth.GroupID    `json:"groups,omitempty"`
+	Suspended     bool              `json:"suspended,omitempty"`
+	Service       bool              `json:"service,omitempty"`
+	Deleted       *time.Time        `json:"deleted,omitempty"`
+	Denied        []string          `json:"denied,omitempty"`
+	Attributes    auth.Attributes   `json:"attributes,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+type userListResponse struct {
+	Users []userResponse `json:"users"`
+	Next  string         `json:"next,omitempty"`
+}
+
+type roleIDRequest struct {
+	RoleID auth.RoleID `json:"role_id"`
+}
+
+// userRoleRequest gives a role to a user, until Expires if set (see auth.Server.AddRoleToUserUntil).
+type userRoleRequest struct {
+	RoleID  auth.RoleID `json:"role_id"`
+	Expires *time.Time  `json:"expires,omitempty"`
+	// Resource, if set, limits the role to a resource, see auth.Server.AddRoleToUserOnResource.
+	Resource string `json:"resource,omitempty"`
+}
+
+type totpResponse struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+type createAPIKeyRequest struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Expires time.Time `json:"expires"`
+}
+
+type apiKeyResponse struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+type tokenInfoResponse struct {
+	ID        string           `json:"id"`
+	Issued    time.Time        `json:"issued"`
+	Expires   time.Time        `json:"expires"`
+	IP        string           `json:"ip,omitempty"`
+	UserAgent string           `json:"user_agent,omitempty"`
+	Device    string           `json:"device,omitempty"`
+	Scope     *auth.TokenScope `json:"scope,omitempty"`
+	Actor     auth.UserID      `json:"actor_id,omitempty"`
+}
+
+type loginResponse struct {
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func (h *Handler) serveUsers(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		if r.Method == http.MethodGet {
+			opts, err := listOptions(r)
+			if err != nil {
+				return err
+			}
+			users, next, err := h.svr.ListUsers(opts)
+			if err != nil {
+				return err
+			}
+			res := userListResponse{Users: make([]userResponse, len(users)), Next: next}
+			for i, u := range users {
+				res.Users[i] = newUserResponse(u)
+			}
+			writeJSON(w, http.StatusOK, res)
+			return nil
+		}
+		if r.Method != http.MethodPost {
+			return errBadMethod
+		}
+		var req createUserRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if req.Service {
+			if req.Password != "" {
+				return ErrBadRequest
+			}
+			id, key, err := h.svr.CreateServiceAccount(req.Name)
+			if err != nil {
+				return err
+			}
+			writeJSON(w, http.StatusCreated, serviceAccountResponse{ID: id, Key: key})
+			return nil
+		}
+		id, err := h.svr.CreateUser(req.Name, req.Password)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, idResponse{ID: int64(id)})
+		return nil
+	}
+
+	if len(path) == 1 && (path[0] == "import" || path[0] == "export") {
+		return h.serveBulk(w, r, path[0])
+	}
+	if len(path) == 1 && path[0] == "password-reset" {
+		if r.Method != http.MethodPost {
+			return errBadMethod
+		}
+		var req resetRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		token, err := h.svr.RequestPasswordReset(req.Identifier)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, tokenRequest{Token: token})
+		return nil
+	}
+
+	n, err := strconv.ParseInt(path[0], 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	id := auth.UserID(n)
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		u := h.svr.GetUser(id)
+		if u == nil {
+			return auth.ErrUserNotExist
+		}
+		writeJSON(w, http.StatusOK, newUserResponse(u))
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if err := h.svr.DeleteUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "roles" && r.Method == http.MethodPost:
+		var req userRoleRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		switch {
+		case req.Resource != "" && req.Expires != nil:
+			return ErrBadRequest
+		case req.Resource != "":
+			err = h.svr.AddRoleToUserOnResource(id, req.RoleID, req.Resource)
+		case req.Expires != nil:
+			err = h.svr.AddRoleToUserUntil(id, req.RoleID, *req.Expires)
+		default:
+			err = h.svr.AddRoleToUser(id, req.RoleID)
+		}
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "roles" && r.Method == http.MethodDelete:
+		role, err := strconv.ParseInt(path[2], 10, 32)
+		if err != nil {
+			return ErrNotFound
+		}
+		if resource := r.URL.Query().Get("resource"); resource != "" {
+			err = h.svr.RemoveRoleFromUserOnResource(id, auth.RoleID(role), resource)
+		} else {
+			err = h.svr.RemoveRoleFromUser(id, auth.RoleID(role))
+		}
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "attributes" && r.Method == http.MethodPost:
+		var req auth.Attributes
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		for key, value := range req {
+			if err := h.svr.SetUserAttribute(id, key, value); err != nil {
+				return err
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "attributes" && r.Method == http.MethodDelete:
+		if err := h.svr.RemoveUserAttribute(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "metadata" && r.Method == http.MethodGet:
+		md, err := h.svr.GetUserMetadata(id)
+		if err != nil {
+			return err
+		}
+		if md == nil {
+			md = map[string]string{}
+		}
+		writeJSON(w, http.StatusOK, md)
+	case len(path) == 2 && path[1] == "metadata" && r.Method == http.MethodPost:
+		var req map[string]string
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.SetUserMetadata(id, req); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "name" && r.Method == http.MethodPost:
+		var req nameRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.UpdateUserName(id, req.Name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "email" && r.Method == http.MethodPost:
+		var req emailRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.SetUserEmail(id, req.Email); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "email" && path[2] == "verification" && r.Method == http.MethodPost:
+		token, err := h.svr.RequestEmailVerification(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, tokenRequest{Token: token})
+	case len(path) == 2 && path[1] == "denies" && r.Method == http.MethodPost:
+		var req permissionRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.DenyPermissionToUser(id, req.Permission); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "denies" && r.Method == http.MethodDelete:
+		if err := h.svr.RemoveDenyFromUser(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "tokens" && r.Method == http.MethodGet:
+		tokens, err := h.svr.ListTokens(id)
+		if err != nil {
+			return err
+		}
+		res := make([]tokenInfoResponse, len(tokens))
+		for i, t := range tokens {
+			res[i] = tokenInfoResponse{ID: t.ID, Issued: t.Issued, Expires: t.Expires, IP: t.Client.IP, UserAgent: t.Client.UserAgent,
+				Device: t.Client.Device, Scope: t.Scope, Actor: t.Actor}
+		}
+		writeJSON(w, http.StatusOK, map[string][]tokenInfoResponse{"tokens": res})
+	case len(path) == 3 && path[1] == "tokens" && r.Method == http.MethodDelete:
+		if err := h.svr.InvalidateToken(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "logins" && r.Method == http.MethodGet:
+		logins, err := h.svr.GetLoginHistory(id)
+		if err != nil {
+			return err
+		}
+		res := make([]loginResponse, len(logins))
+		for i, l := range logins {
+			res[i] = loginResponse{Time: l.Time, Success: l.Success, IP: l.IP, UserAgent: l.UserAgent}
+		}
+		writeJSON(w, http.StatusOK, map[string][]loginResponse{"logins": res})
+	case len(path) == 2 && path[1] == "apikeys" && r.Method == http.MethodGet:
+		keys, err := h.svr.ListAPIKeys(id)
+		if err != nil {
+			return err
+		}
+		res := make([]apiKeyResponse, len(keys))
+		for i, k := range keys {
+			res[i] = newAPIKeyResponse(&k)
+		}
+		writeJSON(w, http.StatusOK, map[string][]apiKeyResponse{"api_keys": res})
+	case len(path) == 2 && path[1] == "apikeys" && r.Method == http.MethodPost:
+		var req createAPIKeyRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		key, err := h.svr.CreateAPIKey(id, req.Name, req.Scopes, req.Expires)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, map[string]auth.TokenValue{"key": key})
+	case len(path) == 3 && path[1] == "apikeys" && r.Method == http.MethodDelete:
+		if err := h.svr.RevokeAPIKey(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "rotate" && r.Method == http.MethodPost:
+		var req rotateRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		key, err := h.svr.RotateCredentials(id, time.Duration(req.GraceSec)*time.Second)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]auth.TokenValue{"key": key})
+	case len(path) == 2 && path[1] == "totp" && r.Method == http.MethodPost:
+		e, err := h.svr.EnrollTOTP(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, totpResponse{Secret: e.Secret, URI: e.URI, RecoveryCodes: e.RecoveryCodes})
+	case len(path) == 2 && path[1] == "totp" && r.Method == http.MethodDelete:
+		if err := h.svr.DisableTOTP(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "totp" && path[2] == "verify" && r.Method == http.MethodPost:
+		var req codeRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		ok, err := h.svr.VerifyTOTP(id, req.Code)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"valid": ok})
+	case len(path) == 3 && path[1] == "totp" && path[2] == "recovery" && r.Method == http.MethodGet:
+		n, err := h.svr.RecoveryCodesLeft(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"remaining": n})
+	case len(path) == 3 && path[1] == "totp" && path[2] == "recovery" && r.Method == http.MethodPost:
+		codes, err := h.svr.RegenerateRecoveryCodes(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+	case len(path) == 2 && path[1] == "suspend" && r.Method == http.MethodPost:
+		if err := h.svr.SuspendUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "reactivate" && r.Method == http.MethodPost:
+		if err := h.svr.ReactivateUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "restore" && r.Method == http.MethodPost:
+		if err := h.svr.RestoreUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "data" && r.Method == http.MethodGet:
+		data, err := h.svr.ExportUserData(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, data)
+	case len(path) == 2 && path[1] == "erase" && r.Method == http.MethodPost:
+		if err := h.svr.EraseUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) <= 3:
+		return errBadMethod
+	default:
+		return ErrNotFound
+	}
+	return nil
+}
+
+func newUserResponse(u *auth.User) userResponse {
+	res := userResponse{ID: u.ID, Name: u.Name, Roles: []auth.RoleID{}, Groups: u.Groups, Suspended: u.Status == auth.UserSuspended, Service: u.Kind == auth.UserService, Denied: u.Denied, Attributes: u.Attributes, Metadata: u.Metadata,
+		Email: u.Email, EmailVerified: u.EmailVerified}
+	if u.Deleted != nil {
+		res.Deleted = &u.Deleted.On
+	}
+	for role := range u.Roles {
+		res.Roles = append(res.Roles, role)
+	}
+	sort.Slice(res.Roles, func(i, j int) bool { return res.Roles[i] < res.Roles[j] })
+	return res
+}
+
+func newAPIKeyResponse(k *auth.APIKeyInfo) apiKeyResponse {
+	res := apiKeyResponse{ID: k.ID, Name: k.Name, Scopes: k.Scopes, Created: k.Created}
+	if !k.Expires.IsZero() {
+		res.Expires = &k.Expires
+	}
+	if !k.LastUsed.IsZero() {
+		res.LastUsed = &k.LastUsed
+	}
+	return res
+}
+
+type importFailure struct {
+	Line  int    `json:"line"`
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error"`
+}
+
+type importResponse struct {
+	Created int             `json:"created"`
+	Failed  []importFailure `json:"failed"`
+}
+
+func (h *Handler) serveBulk(w http.ResponseWriter, r *http.Request, op string) error {
+	format, contentType := auth.FormatJSON, "application/x-ndjson"
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "csv":
+		format, contentType = auth.FormatCSV, "text/csv"
+	default:
+		return ErrBadRequest
+	}
+
+	if op == "export" {
+		if r.Method != http.MethodGet {
+			return errBadMethod
+		}
+		w.Header().Set("Content-Type", contentType)
+		// Once the export has started, errors can only cut it short
+		_ = h.svr.ExportUsers(w, format)
+		return nil
+	}
+	if r.Method != http.MethodPost {
+		return errBadMethod
+	}
+	res, err := h.svr.ImportUsers(r.Body, format)
+	if err != nil {
+		return err
+	}
+	resp := importResponse{Created: res.Created, Failed: make([]importFailure, len(res.Failed))}
+	for i, f := range res.Failed {
+		resp.Failed[i] = importFailure{Line: f.Line, Name: f.Name, Error: f.Err.Error()}
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+type applyResponse struct {
+	Changes []auth.Change `json:"changes"`
+}
+
+// *-* Policies *-*
+
+type policyRequest struct {
+	Source string `json:"source"`
+}
+
+type policyResponse struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+func (h *Handler) servePolicies(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		if r.Method != http.MethodGet {
+			return errBadMethod
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"policies": h.svr.Policies()})
+		return nil
+	}
+	if len(path) > 1 {
+		return ErrNotFound
+	}
+	name := path[0]
+	switch r.Method {
+	case http.MethodGet:
+		src, ok := h.svr.PolicySource(name)
+		if !ok {
+			return auth.ErrPolicyNotExist
+		}
+		writeJSON(w, http.StatusOK, policyResponse{Name: name, Source: src})
+	case http.MethodPut:
+		var req policyRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.SetPolicy(name, req.Source); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.svr.RemovePolicy(name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return errBadMethod
+	}
+	return nil
+}
+
+func (h *Handler) serveApply(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) != 0 {
+		return ErrNotFound
+	}
+	if r.Method != http.MethodPost {
+		return errBadMethod
+	}
+	var spec auth.Spec
+	if err := readJSON(r, &spec); err != nil {
+		return err
+	}
+	var opts auth.ApplyOptions
+	for name, v := range map[string]*bool{"prune": &opts.Prune, "dry_run": &opts.DryRun} {
+		if s := r.URL.Query().Get(name); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return ErrBadRequest
+			}
+			*v = b
+		}
+	}
+	changes, err := h.svr.Apply(&spec, &opts)
+	if err != nil {
+		return err
+	}
+	if changes == nil {
+		changes = []auth.Change{}
+	}
+	writeJSON(w, http.StatusOK, applyResponse{Changes: changes})
+	return nil
+}
+
+// *-* Roles *-*
+
+type createRoleRequest struct {
+	Name string `json:"name"`
+}
+
+type roleResponse struct {
+	ID          auth.RoleID `json:"id"`
+	Name        string      `json:"name"`
+	Permissions []string    `json:"permissions"`
+	Denied      []string    `json:"denied,omitempty"`
+	Protected   bool        `json:"protected,omitempty"`
+}
+
+type roleListResponse struct {
+	Roles []roleResponse `json:"roles"`
+	Next  string         `json:"next,omitempty"`
+}
+
+type permissionRequest struct {
+	Permission string `json:"permission"`
+}
+
+func (h *Handler) serveRoles(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		if r.Method == http.MethodGet {
+			opts, err := listOptions(r)
+			if err != nil {
+				return err
+			}
+			roles, next, err := h.svr.ListRoles(opts)
+			if err != nil {
+				return err
+			}
+			res := roleListResponse{Roles: make([]roleResponse, len(roles)), Next: next}
+			for i, role := range roles {
+				res.Roles[i] = newRoleResponse(role)
+			}
+			writeJSON(w, http.StatusOK, res)
+			return nil
+		}
+		if r.Method != http.MethodPost {
+			return errBadMethod
+		}
+		var req createRoleRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		id, err := h.svr.CreateRole(req.Name)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, idResponse{ID: int64(id)})
+		return nil
+	}
+
+	n, err := strconv.ParseInt(path[0], 10, 32)
+	if err != nil {
+		return ErrNotFound
+	}
+	id := auth.RoleID(n)
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		role := h.svr.GetRole(id)
+		if role == nil {
+			return auth.ErrRoleNotExist
+		}
+		writeJSON(w, http.StatusOK, newRoleResponse(role))
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if s := r.URL.Query().Get("dry_run"); s != "" {
+			dryRun, err := strconv.ParseBool(s)
+			if err != nil {
+				return ErrBadRequest
+			}
+			if dryRun {
+				users, err := h.svr.DeleteRoleDryRun(id)
+				if err != nil {
+					return err
+				}
+				writeJSON(w, http.StatusOK, map[string][]auth.UserID{"users": users})
+				return nil
+			}
+		}
+		if err := h.svr.DeleteRole(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "users" && r.Method == http.MethodGet:
+		users, err := h.svr.ListUsersWithRole(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string][]auth.UserID{"users": users})
+	case len(path) == 2 && path[1] == "name" && r.Method == http.MethodPost:
+		var req nameRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.UpdateRoleName(id, req.Name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && (path[1] == "protect" || path[1] == "unprotect") && r.Method == http.MethodPost:
+		if err := h.svr.SetRoleProtected(id, path[1] == "protect"); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "permissions" && r.Method == http.MethodPost:
+		var req permissionRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.GrantPermissionToRole(id, req.Permission); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "permissions" && r.Method == http.MethodDelete:
+		if err := h.svr.RevokePermissionFromRole(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "denies" && r.Method == http.MethodPost:
+		var req permissionRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.DenyPermissionToRole(id, req.Permission); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "denies" && r.Method == http.MethodDelete:
+		if err := h.svr.RemoveDenyFromRole(id, path[2]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) <= 3:
+		return errBadMethod
+	default:
+		return ErrNotFound
+	}
+	return nil
+}
+
+func newRoleResponse(role *auth.Role) roleResponse {
+	res := roleResponse{ID: role.ID, Name: role.Name, Permissions: role.Permissions, Denied: role.Denied,
+		Protected: role.Protected}
+	if res.Permissions == nil {
+		res.Permissions = []string{}
+	}
+	return res
+}
+
+// *-* Groups *-*
+
+type createGroupRequest struct {
+	Name string `json:"name"`
+}
+
+type groupResponse struct {
+	ID    auth.GroupID  `json:"id"`
+	Name  string        `json:"name"`
+	Roles []auth.RoleID `json:"roles"`
+}
+
+type userIDRequest struct {
+	UserID auth.UserID `json:"user_id"`
+}
+
+func (h *Handler) serveGroups(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		if r.Method != http.MethodPost {
+			return errBadMethod
+		}
+		var req createGroupRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		id, err := h.svr.CreateGroup(req.Name)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, idResponse{ID: int64(id)})
+		return nil
+	}
+
+	n, err := strconv.ParseInt(path[0], 10, 32)
+	if err != nil {
+		return ErrNotFound
+	}
+	id := auth.GroupID(n)
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		g := h.svr.GetGroup(id)
+		if g == nil {
+			return auth.ErrGroupNotExist
+		}
+		res := groupResponse{ID: g.ID, Name: g.Name, Roles: g.Roles}
+		if res.Roles == nil {
+			res.Roles = []auth.RoleID{}
+		}
+		writeJSON(w, http.StatusOK, res)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if err := h.svr.DeleteGroup(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "users" && r.Method == http.MethodGet:
+		users, err := h.svr.ListGroupMembers(id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, map[string][]auth.UserID{"users": users})
+	case len(path) == 2 && path[1] == "users" && r.Method == http.MethodPost:
+		var req userIDRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.AddUserToGroup(req.UserID, id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "users" && r.Method == http.MethodDelete:
+		user, err := strconv.ParseInt(path[2], 10, 64)
+		if err != nil {
+			return ErrNotFound
+		}
+		if err := h.svr.RemoveUserFromGroup(auth.UserID(user), id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "roles" && r.Method == http.MethodPost:
+		var req roleIDRequest
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if err := h.svr.AddRoleToGroup(id, req.RoleID); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "roles" && r.Method == http.MethodDelete:
+		role, err := strconv.ParseInt(path[2], 10, 32)
+		if err != nil {
+			return ErrNotFound
+		}
+		if err := h.svr.RemoveRoleFromGroup(id, auth.RoleID(role)); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) <= 3:
+		return errBadMethod
+	default:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// *-* Helpers *-*
+
+// listOptions parses the query parameters of a listing.
+func listOptions(r *http.Request) (*auth.ListOptions, error) {
+	q := r.URL.Query()
+	opts := auth.ListOptions{Prefix: q.Get("prefix"), Cursor: q.Get("cursor")}
+	switch q.Get("sort") {
+	case "", "id":
+	case "name":
+		opts.SortBy = auth.SortByName
+	default:
+		return nil, ErrBadRequest
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return nil, ErrBadRequest
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, ErrBadRequest
+		}
+		opts.Limit = n
+	}
+	return &opts, nil
+}
+
+// clientInfo describes the client of a request. Proxy headers such as X-Forwarded-For are not
+// trusted, so behind a proxy the IP is that of the proxy.
+func clientInfo(r *http.Request) auth.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auth.ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// bearerToken extracts the token from the Authorization header.
+func bearerToken(r *http.Request) (auth.TokenValue, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ErrNoToken
+	}
+	return auth.TokenValue(strings.TrimSpace(header[len(prefix):])), nil
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := auth.HTTPStatus(err)
+	body := map[string]string{"error": err.Error(), "code": auth.ErrorCode(err)}
+	if status == http.StatusInternalServerError {
+		// Do not leak the details of storage errors
+		body["error"] = auth.ErrInternal.Error()
+	}
+	if errors.Is(err, auth.ErrStepUpRequired) {
+		// RFC 9470, for the client to have the user log in again
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_user_authentication"`)
+	} else if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, status, body)
+}
@@ -0,0 +1,21 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// MetricsHandler serves the metrics of an auth server in the Prometheus text format, typically at
+// /metrics. It is separate from Handler, because metrics are for operators rather than clients.
+func MetricsHandler(svr *auth.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, err := svr.WithContext(r.Context()).Metrics()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,47 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// RealmsHandler serves the API of each realm under /realms/{name}/, e.g. /realms/acme/auth/login.
+// Every realm is reached through its own Handler, so tokens, and with them AdminPermission, only
+// count in the realm that issued them. GET /realms lists the names of the realms, and is open to
+// everyone, so it may be left unrouted if they are not public. opts can be nil.
+func RealmsHandler(realms *auth.Realms, opts *Options) http.Handler {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 3)
+		if path[0] != "realms" {
+			writeError(w, ErrNotFound)
+			return
+		}
+		if len(path) == 1 {
+			if r.Method != http.MethodGet {
+				writeError(w, errBadMethod)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string][]string{"realms": realms.ListRealms()})
+			return
+		}
+		svr := realms.Realm(path[1])
+		if svr == nil {
+			writeError(w, ErrNotFound)
+			return
+		}
+		rest := "/"
+		if len(path) == 3 {
+			rest += path[2]
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		NewHandler(svr, &o).ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,124 @@
+package ldapauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// fakeConn is a directory holding entries with a password and groups each.
+type fakeConn struct {
+	entries   map[string]*fakeEntry // by DN
+	binds     []string
+	filters   []string
+	closed    bool
+	searchErr error
+}
+
+type fakeEntry struct {
+	uid      string
+	password string
+	groups   []string
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	c.binds = append(c.binds, username)
+	if e, ok := c.entries[username]; ok && e.password == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+}
+
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.filters = append(c.filters, req.Filter)
+	if c.searchErr != nil {
+		return nil, c.searchErr
+	}
+	res := &ldap.SearchResult{}
+	for dn, e := range c.entries {
+		if req.Filter == "(uid="+e.uid+")" {
+			res.Entries = append(res.Entries, ldap.NewEntry(dn, map[string][]string{"memberOf": e.groups}))
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() { c.closed = true }
+
+func newTestAuthenticator(t *testing.T, c *fakeConn) *Authenticator {
+	a, err := New(&Config{
+		URL:          "ldap://localhost",
+		BindDN:       "cn=auth,dc=example,dc=com",
+		BindPassword: "s3rvice",
+		BaseDN:       "dc=example,dc=com",
+		GroupRoles:   map[string]string{"CN=Scanners,DC=example,DC=com": "scanner"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dial = func(context.Context) (conn, error) { return c, nil }
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	c := &fakeConn{entries: map[string]*fakeEntry{
+		"cn=auth,dc=example,dc=com":  {password: "s3rvice"},
+		"uid=anna,dc=example,dc=com": {uid: "anna", password: "c0rp", groups: []string{"cn=scanners,dc=example,dc=com", "cn=other,dc=example,dc=com"}},
+		"uid=lee1,dc=example,dc=com": {uid: "lee", password: "c0rp"},
+		"uid=lee2,dc=example,dc=com": {uid: "lee", password: "c0rp"},
+	}}
+	a := newTestAuthenticator(t, c)
+	{
+		id, err := a.Authenticate(ctx, "anna", "c0rp")
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, []string{"scanner"}, id.Roles, "should map the groups regardless of case")
+		assert.Equal(t, []string{"cn=auth,dc=example,dc=com", "uid=anna,dc=example,dc=com"}, c.binds, "should search as the service, then bind as the user")
+		assert.Equal(t, true, c.closed, "should close the connection")
+	}
+	{
+		_, err := a.Authenticate(ctx, "anna", "wrong")
+		assert.Equal(t, auth.ErrInvalidAuth, err, "should reject wrong passwords")
+		n := len(c.binds)
+		_, err = a.Authenticate(ctx, "anna", "")
+		assert.Equal(t, auth.ErrInvalidAuth, err, "should reject empty passwords")
+		assert.Equal(t, n, len(c.binds), "should not try unauthenticated binds")
+		_, err = a.Authenticate(ctx, "gina", "c0rp")
+		assert.Equal(t, auth.ErrUserNotExist, err, "should give ErrUserNotExist for unknown names")
+		_, err = a.Authenticate(ctx, "lee", "c0rp")
+		assert.Equal(t, auth.ErrInvalidAuth, err, "should reject ambiguous names")
+	}
+	{
+		a.Authenticate(ctx, "a*)(uid=*", "c0rp")
+		assert.Equal(t, `(uid=a\2a\29\28uid=\2a)`, c.filters[len(c.filters)-1], "should escape the name")
+		c.searchErr = ldap.NewError(ldap.ErrorNetwork, nil)
+		_, err := a.Authenticate(ctx, "anna", "c0rp")
+		assert.Equal(t, c.searchErr, err, "should report directory failures")
+	}
+	{
+		_, err := New(&Config{URL: "http://localhost", BaseDN: "dc=example,dc=com"})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should check the scheme")
+		_, err = New(&Config{URL: "ldap://localhost"})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should require the base DN")
+		_, err = New(&Config{URL: "ldap://localhost", BaseDN: "dc=example,dc=com", UserFilter: "(uid=x)"})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should check the filter")
+	}
+}
+
+func TestServerIntegration(t *testing.T) {
+	c := &fakeConn{entries: map[string]*fakeEntry{
+		"cn=auth,dc=example,dc=com":  {password: "s3rvice"},
+		"uid=anna,dc=example,dc=com": {uid: "anna", password: "c0rp", groups: []string{"cn=scanners,dc=example,dc=com"}},
+	}}
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Authenticators: []auth.Authenticator{newTestAuthenticator(t, c)}})
+	rid, _ := svr.CreateRole("scanner")
+	token, err := svr.Authenticate("anna", "c0rp")
+	assert.Equal(t, nil, err, "should log in with the directory password")
+	ok, _ := svr.CheckRole(token, rid)
+	assert.Equal(t, true, ok, "should give the mapped role")
+	assert.Equal(t, "ldap", svr.GetUserByName("anna").Source, "should create the user")
+}
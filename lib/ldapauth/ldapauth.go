@@ -0,0 +1,199 @@
+// Package ldapauth verifies passwords against an LDAP directory, such as Active Directory, as an
+// auth.Authenticator.
+//
+//	dir, err := ldapauth.New(&ldapauth.Config{
+//		URL:          "ldaps://dc.corp.example.com",
+//		BindDN:       "cn=auth,ou=services,dc=corp,dc=example,dc=com",
+//		BindPassword: "...",
+//		BaseDN:       "ou=people,dc=corp,dc=example,dc=com",
+//		UserFilter:   "(sAMAccountName=%s)",
+//		GroupRoles:   map[string]string{"cn=scanners,ou=groups,dc=corp,dc=example,dc=com": "scanner"},
+//	})
+//	svr, err := auth.NewServer(&auth.ServerConfig{Authenticators: []auth.Authenticator{dir}, ...}, store)
+//
+// Users are found with a search (as BindDN, or anonymously), then their password is checked by
+// binding as them. A connection is made for each login.
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Config configures an Authenticator.
+type Config struct {
+	// Name identifies the directory in auth.User.Source. Defaults to "ldap".
+	Name string
+	// URL of the directory, with the ldap:// or ldaps:// scheme.
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before sending any password.
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS. Defaults to the settings of crypto/tls.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the credentials used to search for users. If BindDN is empty,
+	// the search is anonymous.
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched, in the whole subtree.
+	BaseDN string
+	// UserFilter finds the entry of a user, with %s replaced by the (escaped) username. Defaults to
+	// "(uid=%s)". Use "(sAMAccountName=%s)" for Active Directory.
+	UserFilter string
+	// GroupAttribute lists the DNs of the groups of a user on its entry. Defaults to "memberOf".
+	GroupAttribute string
+	// GroupRoles maps the DNs of directory groups to the names of roles, which are given to users
+	// when they are created. DNs are compared regardless of case.
+	GroupRoles map[string]string
+	// Timeout limits each login, unless the context of the server ends it first. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// conn is the part of *ldap.Conn used by the Authenticator.
+type conn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// Authenticator is an auth.Authenticator backed by an LDAP directory.
+type Authenticator struct {
+	cfg    Config
+	groups map[string]string // GroupRoles, with lower-case DNs
+	dial   func(ctx context.Context) (conn, error)
+}
+
+// New creates an Authenticator. It does not connect to the directory.
+//
+// Returns: pointer to the new authenticator
+// Errors: auth.ErrInvalidConfig
+func New(cfg *Config) (*Authenticator, error) {
+	a := &Authenticator{cfg: *cfg, groups: make(map[string]string, len(cfg.GroupRoles))}
+	u, err := url.Parse(a.cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || a.cfg.BaseDN == "" {
+		return nil, auth.ErrInvalidConfig
+	}
+	if a.cfg.Name == "" {
+		a.cfg.Name = "ldap"
+	}
+	if a.cfg.UserFilter == "" {
+		a.cfg.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(a.cfg.UserFilter, "%s") != 1 {
+		return nil, auth.ErrInvalidConfig
+	}
+	if a.cfg.GroupAttribute == "" {
+		a.cfg.GroupAttribute = "memberOf"
+	}
+	if a.cfg.Timeout <= 0 {
+		a.cfg.Timeout = 10 * time.Second
+	}
+	for dn, role := range a.cfg.GroupRoles {
+		a.groups[strings.ToLower(dn)] = role
+	}
+	a.dial = a.dialURL
+	return a, nil
+}
+
+func (a *Authenticator) dialURL(ctx context.Context) (conn, error) {
+	timeout := a.cfg.Timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	c, err := ldap.DialURL(a.cfg.URL, ldap.DialWithTLSDialer(a.cfg.TLSConfig, &net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(timeout)
+	if a.cfg.StartTLS {
+		if err := c.StartTLS(a.cfg.TLSConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Name implements auth.Authenticator.
+func (a *Authenticator) Name() string {
+	return a.cfg.Name
+}
+
+// Authenticate implements auth.Authenticator. Names matching no entry give auth.ErrUserNotExist,
+// and names matching several give auth.ErrInvalidAuth.
+//
+// Returns: the roles mapped from the groups of the user
+// Errors: auth.ErrUserNotExist, auth.ErrInvalidAuth, ctx.Err(), or any error from the directory
+func (a *Authenticator) Authenticate(ctx context.Context, username, password string) (*auth.Identity, error) {
+	// An empty password would make an unauthenticated bind, which succeeds (RFC 4513, section 5.1.2)
+	if password == "" {
+		return nil, auth.ErrInvalidAuth
+	}
+	c, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if ctx.Done() != nil {
+		// Closing the connection makes pending requests fail. It can be closed twice.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-stop:
+			}
+		}()
+	}
+
+	if a.cfg.BindDN != "" {
+		if err := c.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return nil, ctxError(ctx, err)
+		}
+	}
+	res, err := c.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.cfg.GroupAttribute}, nil,
+	))
+	// Several entries are ambiguous. The size limit stops the search at two.
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(res.Entries) > 1) {
+		return nil, auth.ErrInvalidAuth
+	} else if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, auth.ErrUserNotExist
+	}
+	entry := res.Entries[0]
+	if err := c.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, auth.ErrInvalidAuth
+	} else if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+
+	var id auth.Identity
+	for _, dn := range entry.GetAttributeValues(a.cfg.GroupAttribute) {
+		if role, ok := a.groups[strings.ToLower(dn)]; ok {
+			id.Roles = append(id.Roles, role)
+		}
+	}
+	return &id, nil
+}
+
+// ctxError reports the cancellation of ctx rather than the failure it caused.
+func ctxError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// do sends a request with the token (if any) to h, and returns the status code and the body.
+func do(h http.Handler, token string) (int, string) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+// echoUser answers with the name of the injected user.
+var echoUser = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(UserFrom(r.Context()).Name))
+})
+
+func TestMiddleware(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	svr.CreateUser("belle", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.GrantPermissionToRole(rid, "orders:*")
+	svr.AddRoleToUser(uid, rid)
+	anna, _ := svr.Authenticate("anna", "passw0rd")
+	belle, _ := svr.Authenticate("belle", "passw0rd")
+	mw := New(svr, nil)
+	{
+		h := mw.RequireToken(echoUser)
+		code, body := do(h, string(anna))
+		assert.Equal(t, http.StatusOK, code, "should let valid tokens through")
+		assert.Equal(t, "anna", body, "should inject the user")
+		code, body = do(h, "")
+		assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+		var res map[string]string
+		json.Unmarshal([]byte(body), &res)
+		assert.Equal(t, ErrNoToken.Error(), res["error"], "should report the error")
+		code, _ = do(h, "invalid")
+		assert.Equal(t, http.StatusUnauthorized, code, "should reject invalid tokens")
+	}
+	{
+		h := mw.RequireRole("clerk")(echoUser)
+		code, _ := do(h, string(anna))
+		assert.Equal(t, http.StatusOK, code, "should let role holders through")
+		code, _ = do(h, string(belle))
+		assert.Equal(t, http.StatusForbidden, code, "should reject other users")
+		code, _ = do(mw.RequireRole("auditor")(echoUser), string(anna))
+		assert.Equal(t, http.StatusForbidden, code, "should treat a missing role as not held")
+		code, _ = do(h, "invalid")
+		assert.Equal(t, http.StatusUnauthorized, code, "should reject invalid tokens")
+	}
+	{
+		h := mw.RequirePermission("orders:write")(echoUser)
+		code, _ := do(h, string(anna))
+		assert.Equal(t, http.StatusOK, code, "should let permission holders through")
+		code, _ = do(h, string(belle))
+		assert.Equal(t, http.StatusForbidden, code, "should reject other users")
+	}
+	{
+		var got error
+		mw := New(svr, &Options{ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			w.WriteHeader(http.StatusTeapot)
+		}})
+		code, _ := do(mw.RequireRole("clerk")(echoUser), string(belle))
+		assert.Equal(t, http.StatusTeapot, code, "should use the custom error handler")
+		assert.Equal(t, ErrForbidden, got, "should pass the error")
+	}
+	{
+		var token auth.TokenValue
+		h := mw.RequireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = TokenFrom(r.Context())
+		}))
+		do(h, string(anna))
+		assert.Equal(t, anna, token, "should inject the token")
+		assert.Equal(t, (*auth.User)(nil), UserFrom(httptest.NewRequest("GET", "/", nil).Context()), "should give nil outside the middleware")
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, StepUp: []auth.StepUp{{Permission: "orders:delete", Level: auth.AuthMFA}},
+		Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.GrantPermissionToRole(rid, "orders:*")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	mw := New(svr, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	rec := httptest.NewRecorder()
+	mw.RequirePermission("orders:delete")(echoUser).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "should ask for a new login")
+	assert.Equal(t, `Bearer error="insufficient_user_authentication"`, rec.Header().Get("WWW-Authenticate"), "should tell the error of RFC 9470")
+	code, _ := do(mw.RequirePermission("orders:read")(echoUser), string(token))
+	assert.Equal(t, http.StatusOK, code, "should let the other permissions through")
+}
+
+func TestTokenBinding(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	svr.CreateUser("anna", "passw0rd")
+	// httptest requests come from 192.0.2.1
+	token, _ := svr.AuthenticateClient("anna", "passw0rd", auth.ClientInfo{IP: "192.0.2.1", Fingerprint: "sha256:abcd", Bind: true})
+	{
+		code, _ := do(New(svr, nil).RequireToken(echoUser), string(token))
+		assert.Equal(t, http.StatusUnauthorized, code, "should compare the fingerprint")
+	}
+	{
+		mw := New(svr, &Options{Client: func(r *http.Request) auth.ClientInfo {
+			return auth.ClientInfo{IP: "192.0.2.1", Fingerprint: r.Header.Get("X-Client-Cert")}
+		}})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		req.Header.Set("X-Client-Cert", "sha256:abcd")
+		rec := httptest.NewRecorder()
+		mw.RequireToken(echoUser).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "should use the custom client")
+		code, _ := do(mw.RequireToken(echoUser), string(token))
+		assert.Equal(t, http.StatusUnauthorized, code, "should reject other clients")
+	}
+}
+
+func TestChi(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.AddRoleToUser(uid, rid)
+	token, _ := svr.Authenticate("anna", "passw0rd")
+	mw := New(svr, nil)
+
+	router := chi.NewRouter()
+	router.Use(mw.RequireToken)
+	router.With(mw.RequireRole("clerk")).Get("/", echoUser)
+	router.With(mw.RequireRole("auditor")).Get("/audit", echoUser)
+	code, body := do(router, string(token))
+	assert.Equal(t, http.StatusOK, code, "should work as chi middleware")
+	assert.Equal(t, "anna", body, "should inject the user")
+	code, _ = do(router, "")
+	assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+	req := httptest.NewRequest("GET", "/audit", nil)
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "should check the role")
+}
+
+func TestForwardAuth(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	svr.CreateUser("belle", "passw0rd")
+	clerk, _ := svr.CreateRole("clerk")
+	auditor, _ := svr.CreateRole("auditor")
+	svr.AddRoleToUser(uid, clerk)
+	svr.AddRoleToUser(uid, auditor)
+	anna, _ := svr.Authenticate("anna", "passw0rd")
+	belle, _ := svr.Authenticate("belle", "passw0rd")
+	mw := New(svr, &Options{Cookie: "session"})
+	h := mw.ForwardAuth(HasRole("clerk"))
+	{
+		req := httptest.NewRequest("GET", "/forward", nil)
+		req.Header.Set("Authorization", "Bearer "+string(anna))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "should let role holders through")
+		assert.Equal(t, "anna", rec.Header().Get(HeaderUser), "should identify the user")
+		assert.Equal(t, strconv.FormatInt(int64(uid), 10), rec.Header().Get(HeaderUserID), "should identify the user")
+		assert.Equal(t, "auditor,clerk", rec.Header().Get(HeaderRoles), "should list the roles")
+		assert.Equal(t, 0, rec.Body.Len(), "should have no body")
+	}
+	{
+		req := httptest.NewRequest("GET", "/forward", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: string(anna)})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "should take the token from the cookie")
+		assert.Equal(t, "anna", rec.Header().Get(HeaderUser), "should identify the user")
+	}
+	{
+		code, _ := do(h, string(belle))
+		assert.Equal(t, http.StatusForbidden, code, "should reject other users")
+		code, _ = do(h, "")
+		assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+		code, _ = do(mw.ForwardAuth(nil), string(belle))
+		assert.Equal(t, http.StatusOK, code, "should only require a valid token without a requirement")
+	}
+}
@@ -0,0 +1,45 @@
+// Package echoauth adapts package middleware to Echo.
+//
+//	mw := middleware.New(svr, nil)
+//	e.POST("/orders", createOrder, echoauth.RequirePermission(mw, "orders:write"))
+//
+// Rejected requests are answered by the error handler of the Middleware rather than by the
+// HTTPErrorHandler of Echo, so that they look the same as with net/http. Otherwise, the user is in
+// the context of the request: middleware.UserFrom(c.Request().Context()).
+package echoauth
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+// RequireToken lets through the requests carrying a valid token.
+func RequireToken(m *middleware.Middleware) echo.MiddlewareFunc {
+	return Require(m, nil)
+}
+
+// RequireRole lets through the requests of users having the named role.
+func RequireRole(m *middleware.Middleware, name string) echo.MiddlewareFunc {
+	return Require(m, middleware.HasRole(name))
+}
+
+// RequirePermission lets through the requests of users granted the permission.
+func RequirePermission(m *middleware.Middleware, perm string) echo.MiddlewareFunc {
+	return Require(m, middleware.HasPermission(perm))
+}
+
+// Require lets through the requests carrying a valid token and meeting req, which can be nil.
+func Require(m *middleware.Middleware, req middleware.Requirement) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, err := m.Authorize(c.Request(), req)
+			if err != nil {
+				m.Error(c.Response(), c.Request(), err)
+				return nil
+			}
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
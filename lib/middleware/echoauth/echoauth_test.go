@@ -0,0 +1,55 @@
+package echoauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+func TestEcho(t *testing.T) {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	svr.CreateUser("belle", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.GrantPermissionToRole(rid, "orders:*")
+	svr.AddRoleToUser(uid, rid)
+	anna, _ := svr.Authenticate("anna", "passw0rd")
+	belle, _ := svr.Authenticate("belle", "passw0rd")
+
+	router := echo.New()
+	mw := middleware.New(svr, nil)
+	echoUser := func(c echo.Context) error {
+		return c.String(http.StatusOK, middleware.UserFrom(c.Request().Context()).Name)
+	}
+	router.GET("/me", echoUser, RequireToken(mw))
+	router.GET("/clerks", echoUser, RequireRole(mw, "clerk"))
+	router.POST("/orders", echoUser, RequirePermission(mw, "orders:write"))
+
+	do := func(method, path string, token auth.TokenValue) (int, string) {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+string(token))
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	code, body := do("GET", "/me", anna)
+	assert.Equal(t, http.StatusOK, code, "should let valid tokens through")
+	assert.Equal(t, "anna", body, "should inject the user")
+	code, _ = do("GET", "/me", "")
+	assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+	code, _ = do("GET", "/clerks", belle)
+	assert.Equal(t, http.StatusForbidden, code, "should check the role")
+	code, body = do("POST", "/orders", belle)
+	assert.Equal(t, http.StatusForbidden, code, "should check the permission")
+	assert.Equal(t, `{"code":"forbidden","error":"permission denied"}`+"\n", body, "should not run the handler")
+	code, _ = do("POST", "/orders", anna)
+	assert.Equal(t, http.StatusOK, code, "should let permission holders through")
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Headers set by ForwardAuth on the requests it lets through, for the proxy to pass upstream.
+const (
+	HeaderUser   = "X-Auth-User"
+	HeaderUserID = "X-Auth-User-Id"
+	HeaderRoles  = "X-Auth-Roles" // comma-separated names, sorted
+)
+
+// ForwardAuth is an endpoint for the subrequests of a reverse proxy, such as nginx auth_request or
+// Traefik ForwardAuth, which protects any upstream application without changing it. The proxy
+// sends the headers of the original request, with its bearer token or cookie (see Options.Cookie),
+// and only forwards the request on a 200 answer. That answer has an empty body, and identifies the
+// user in HeaderUser, HeaderUserID and HeaderRoles. Other requests get 401 or 403, through
+// Options.ErrorHandler. req can be nil, to only require a valid token.
+//
+// With nginx, the headers are copied to the upstream request with auth_request_set, e.g.
+//
+//	location = /_auth {
+//		internal;
+//		proxy_pass http://auth/forward;
+//		proxy_pass_request_body off;
+//		proxy_set_header Content-Length "";
+//	}
+//	location / {
+//		auth_request /_auth;
+//		auth_request_set $auth_user $upstream_http_x_auth_user;
+//		proxy_set_header X-Auth-User $auth_user;
+//		proxy_pass http://app;
+//	}
+//
+// and with Traefik, they are listed in authResponseHeaders. The proxy must remove these headers
+// from client requests, so that clients cannot set them.
+func (m *Middleware) ForwardAuth(req Requirement) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := m.Authorize(r, req)
+		if err != nil {
+			m.Error(w, r, err)
+			return
+		}
+		user, token := UserFrom(ctx), TokenFrom(ctx)
+		svr := m.server(r)
+		ids, err := svr.AllRoles(token)
+		if err != nil {
+			m.Error(w, r, err)
+			return
+		}
+		names := make([]string, 0, len(ids))
+		for _, id := range ids {
+			// Deleted roles are left out
+			if role := svr.GetRole(id); role != nil {
+				names = append(names, role.Name)
+			}
+		}
+		sort.Strings(names)
+
+		h := w.Header()
+		h.Set(HeaderUser, user.Name)
+		h.Set(HeaderUserID, strconv.FormatInt(int64(user.ID), 10))
+		h.Set(HeaderRoles, strings.Join(names, ","))
+		w.WriteHeader(http.StatusOK)
+	})
+}
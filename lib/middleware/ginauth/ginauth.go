@@ -0,0 +1,43 @@
+// Package ginauth adapts package middleware to Gin.
+//
+//	mw := middleware.New(svr, nil)
+//	router.POST("/orders", ginauth.RequirePermission(mw, "orders:write"), createOrder)
+//
+// Rejected requests are answered by the error handler of the Middleware, and the chain is aborted.
+// Otherwise, the user is in the context of the request: middleware.UserFrom(c.Request.Context()).
+package ginauth
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+// RequireToken lets through the requests carrying a valid token.
+func RequireToken(m *middleware.Middleware) gin.HandlerFunc {
+	return Require(m, nil)
+}
+
+// RequireRole lets through the requests of users having the named role.
+func RequireRole(m *middleware.Middleware, name string) gin.HandlerFunc {
+	return Require(m, middleware.HasRole(name))
+}
+
+// RequirePermission lets through the requests of users granted the permission.
+func RequirePermission(m *middleware.Middleware, perm string) gin.HandlerFunc {
+	return Require(m, middleware.HasPermission(perm))
+}
+
+// Require lets through the requests carrying a valid token and meeting req, which can be nil.
+func Require(m *middleware.Middleware, req middleware.Requirement) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := m.Authorize(c.Request, req)
+		if err != nil {
+			m.Error(c.Writer, c.Request, err)
+			c.Abort()
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
@@ -0,0 +1,247 @@
+// Package middleware enforces authentication and authorization in front of net/http handlers,
+// for services that rely on an auth.Server without exposing it.
+//
+//	mw := middleware.New(svr, nil)
+//	http.Handle("/orders", mw.RequirePermission("orders:write")(ordersHandler))
+//
+// The bearer token is taken from the Authorization header, or a cookie (see Options.Cookie).
+// Requests without a valid token are answered with 401, and those whose user lacks the role or
+// permission with 403, both as {"error": "<message>", "code": "<code>"}. Otherwise, the user
+// behind the token is available to the next handler through UserFrom.
+//
+// Require and its shorthands return func(http.Handler) http.Handler, so they also plug into chi
+// (router.Use, router.With) and other routers built on net/http. Subpackages ginauth and echoauth
+// adapt them to Gin and Echo. ForwardAuth protects other applications behind a reverse proxy.
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+var (
+	ErrNoToken   error = auth.NewError("no_token", http.StatusUnauthorized, "missing bearer token")
+	ErrForbidden error = auth.NewError("forbidden", http.StatusForbidden, "permission denied")
+)
+
+// Options customizes the Middleware.
+type Options struct {
+	// ErrorHandler, if set, answers the requests that are not let through, instead of the default
+	// JSON error. err is ErrNoToken, auth.ErrInvalidToken, ErrForbidden, or an error from the storage.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// Cookie, if set, names a cookie carrying the token, for browser sessions. It is only read from
+	// requests without an Authorization header.
+	Cookie string
+	// Client, if set, describes the client of a request, for verifying the tokens bound to it (see
+	// auth.ServerConfig.BindTokens), e.g. from a trusted proxy header or the TLS certificate. By
+	// default, it is the IP of the peer.
+	Client func(r *http.Request) auth.ClientInfo
+}
+
+// Middleware creates handlers that check requests against an auth server.
+type Middleware struct {
+	svr  *auth.Server
+	opts Options
+}
+
+// A Requirement decides if the user behind a (valid) token may proceed.
+type Requirement func(svr *auth.Server, token auth.TokenValue) (bool, error)
+
+// New creates a Middleware. opts can be nil.
+func New(svr *auth.Server, opts *Options) *Middleware {
+	m := &Middleware{svr: svr}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.opts.ErrorHandler == nil {
+		m.opts.ErrorHandler = WriteError
+	}
+	if m.opts.Client == nil {
+		m.opts.Client = peerClient
+	}
+	return m
+}
+
+// HasRole requires the named role, held directly or through a group. The name is resolved on each
+// request, so the role may be created after the middleware. If it does not exist, nobody has it.
+func HasRole(name string) Requirement {
+	return func(svr *auth.Server, token auth.TokenValue) (bool, error) {
+		role := svr.GetRoleByName(name)
+		if role == nil {
+			return false, nil
+		}
+		ok, err := svr.CheckRole(token, role.ID)
+		if err == auth.ErrRoleNotExist {
+			// Deleted in the meantime
+			return false, nil
+		}
+		return ok, err
+	}
+}
+
+// HasPermission requires a permission, see auth.Server.CheckPermission.
+func HasPermission(perm string) Requirement {
+	return func(svr *auth.Server, token auth.TokenValue) (bool, error) {
+		return svr.CheckPermission(token, perm)
+	}
+}
+
+// RequireToken lets through the requests carrying a valid token.
+func (m *Middleware) RequireToken(next http.Handler) http.Handler {
+	return m.Require(nil)(next)
+}
+
+// RequireRole lets through the requests of users having the named role.
+func (m *Middleware) RequireRole(name string) func(http.Handler) http.Handler {
+	return m.Require(HasRole(name))
+}
+
+// RequirePermission lets through the requests of users granted the permission.
+func (m *Middleware) RequirePermission(perm string) func(http.Handler) http.Handler {
+	return m.Require(HasPermission(perm))
+}
+
+// Require lets through the requests carrying a valid token and meeting req, which can be nil.
+func (m *Middleware) Require(req Requirement) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, err := m.Authorize(r, req)
+			if err != nil {
+				m.Error(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Authorize checks a request like Require, for adapting the middleware to other routers. It does
+// not write the response, see Error.
+//
+// Returns: the context of the request, carrying the user and the token (see UserFrom and TokenFrom)
+// Errors: ErrNoToken, auth.ErrInvalidToken, auth.ErrStepUpRequired, ErrForbidden, or any error from
+// the storage
+func (m *Middleware) Authorize(r *http.Request, req Requirement) (context.Context, error) {
+	token, err := m.token(r)
+	if err != nil {
+		return nil, err
+	}
+	svr := m.server(r)
+	if req != nil {
+		ok, err := req(svr, token)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrForbidden
+		}
+	}
+	id, err := svr.TokenUser(token)
+	if err != nil {
+		return nil, err
+	}
+	user := svr.GetUser(id)
+	if user == nil {
+		// Deleted since the token was checked
+		return nil, auth.ErrInvalidToken
+	}
+	ctx := context.WithValue(r.Context(), userKey{}, user)
+	return context.WithValue(ctx, tokenKey{}, token), nil
+}
+
+// Error answers a request rejected by Authorize with Options.ErrorHandler.
+func (m *Middleware) Error(w http.ResponseWriter, r *http.Request, err error) {
+	m.opts.ErrorHandler(w, r, err)
+}
+
+type userKey struct{}
+
+type tokenKey struct{}
+
+// UserFrom returns the user injected by the middleware, or nil. It is a copy, which the handler
+// can read and modify freely.
+func UserFrom(ctx context.Context) *auth.User {
+	u, _ := ctx.Value(userKey{}).(*auth.User)
+	return u
+}
+
+// TokenFrom returns the token the middleware accepted, or "". It can be passed to the server, for
+// example to Invalidate on logout.
+func TokenFrom(ctx context.Context) auth.TokenValue {
+	t, _ := ctx.Value(tokenKey{}).(auth.TokenValue)
+	return t
+}
+
+// BearerToken extracts the token from the Authorization header.
+//
+// Returns: the token
+// Errors: ErrNoToken
+func BearerToken(r *http.Request) (auth.TokenValue, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ErrNoToken
+	}
+	return auth.TokenValue(strings.TrimSpace(header[len(prefix):])), nil
+}
+
+// token extracts the token from the Authorization header or, failing that, Options.Cookie.
+//
+// Errors: ErrNoToken
+func (m *Middleware) token(r *http.Request) (auth.TokenValue, error) {
+	if m.opts.Cookie != "" && r.Header.Get("Authorization") == "" {
+		if c, err := r.Cookie(m.opts.Cookie); err == nil && c.Value != "" {
+			return auth.TokenValue(c.Value), nil
+		}
+	}
+	return BearerToken(r)
+}
+
+// server gives a copy of the server for a request: storage calls are canceled with it, and tokens
+// bound to their client are verified against Options.Client.
+func (m *Middleware) server(r *http.Request) *auth.Server {
+	return m.svr.WithContext(auth.WithClientInfo(r.Context(), m.opts.Client(r)))
+}
+
+// peerClient is the default Options.Client. Proxy headers such as X-Forwarded-For are not trusted.
+func peerClient(r *http.Request) auth.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auth.ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// stepUpChallenge asks the client to have the user log in again (RFC 9470).
+const stepUpChallenge = `Bearer error="insufficient_user_authentication"`
+
+// StatusOf maps the errors of Authorize to HTTP status codes, see auth.HTTPStatus.
+func StatusOf(err error) int {
+	return auth.HTTPStatus(err)
+}
+
+// WriteError is the default Options.ErrorHandler. It answers with the status code of err and
+// {"error": "<message>", "code": "<code>"}, see auth.ErrorCode. auth.ErrStepUpRequired is also
+// told in WWW-Authenticate, as the insufficient_user_authentication error of RFC 9470.
+func WriteError(w http.ResponseWriter, _ *http.Request, err error) {
+	status := StatusOf(err)
+	body := map[string]string{"error": err.Error(), "code": auth.ErrorCode(err)}
+	if status == http.StatusInternalServerError {
+		// Do not leak the details of storage errors
+		body["error"] = auth.ErrInternal.Error()
+	}
+	if errors.Is(err, auth.ErrStepUpRequired) {
+		w.Header().Set("WWW-Authenticate", stepUpChallenge)
+	} else if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
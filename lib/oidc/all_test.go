@@ -0,0 +1,269 @@
+package oidc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+const (
+	issuer   = "https://id.example.com"
+	callback = "https://app.example.com/callback"
+	verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+type fixture struct {
+	svr     *auth.Server
+	clock   *auth.ManualClock
+	p       *Provider
+	pub     ed25519.PublicKey
+	session auth.TokenValue
+}
+
+func newFixture(t *testing.T, cfg Config) *fixture {
+	clock := auth.NewManualClock(time.Now())
+	svr, _ := auth.New(auth.WithConfig(&auth.ServerConfig{TokenExpireSec: 60}), auth.WithHasher(&auth.BcryptHasher{Cost: 4}),
+		auth.WithClock(clock))
+	uid, _ := svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("clerk")
+	svr.AddRoleToUser(uid, rid)
+	session, _ := svr.Authenticate("anna", "passw0rd")
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	cfg.Issuer = issuer
+	cfg.Key = auth.JWTConfig{Algorithm: auth.EdDSA, Key: priv, KeyID: "k1"}
+	cfg.Clients = []Client{
+		{ID: "spa", RedirectURIs: []string{callback}},
+		{ID: "backend", Secret: "s3cr3t", RedirectURIs: []string{callback}},
+		{ID: "worker", Secret: "w0rker", Scopes: []string{"orders:read", "orders:write"}},
+	}
+	p, err := NewProvider(svr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{svr: svr, clock: clock, p: p, pub: pub, session: session}
+}
+
+// authorize sends an authorization request with the session cookie (if any), and returns the
+// redirect location.
+func (f *fixture) authorize(session auth.TokenValue, params url.Values) (int, *url.URL) {
+	req := httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: string(session)})
+	}
+	rec := httptest.NewRecorder()
+	f.p.ServeHTTP(rec, req)
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	return rec.Code, loc
+}
+
+// token redeems a code, optionally with basic client authentication.
+func (f *fixture) token(form url.Values, user, pass string) (int, map[string]interface{}) {
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	rec := httptest.NewRecorder()
+	f.p.ServeHTTP(rec, req)
+	var res map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res
+}
+
+func authParams(client string) url.Values {
+	sum := sha256.Sum256([]byte(verifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client},
+		"redirect_uri":          {callback},
+		"scope":                 {"openid profile roles"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func codeForm(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {callback},
+		"client_id":     {"spa"},
+		"code_verifier": {verifier},
+	}
+}
+
+func TestCodeFlow(t *testing.T) {
+	f := newFixture(t, Config{})
+	code, loc := f.authorize(f.session, authParams("spa"))
+	assert.Equal(t, http.StatusFound, code, "should redirect to the client")
+	assert.Equal(t, callback, loc.Scheme+"://"+loc.Host+loc.Path, "should redirect to the callback")
+	assert.Equal(t, "xyz", loc.Query().Get("state"), "should pass the state back")
+	authCode := loc.Query().Get("code")
+
+	{
+		form := codeForm(authCode)
+		form.Set("code_verifier", "wrong")
+		status, res := f.token(form, "", "")
+		assert.Equal(t, http.StatusBadRequest, status, "should check the code verifier")
+		assert.Equal(t, "invalid_grant", res["error"], "should report invalid_grant")
+		status, _ = f.token(codeForm(authCode), "", "")
+		assert.Equal(t, http.StatusBadRequest, status, "should drop the code after a failed attempt")
+	}
+
+	_, loc = f.authorize(f.session, authParams("spa"))
+	status, res := f.token(codeForm(loc.Query().Get("code")), "", "")
+	assert.Equal(t, http.StatusOK, status, "should issue tokens")
+	assert.Equal(t, "Bearer", res["token_type"], "should issue a bearer token")
+	{
+		idToken := auth.TokenValue(res["id_token"].(string))
+		parts := strings.Split(string(idToken), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		assert.Equal(t, true, ed25519.Verify(f.pub, []byte(parts[0]+"."+parts[1]), sig), "should sign the ID token with the published key")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(payload, &claims)
+		assert.Equal(t, "spa", claims["aud"], "should set the audience")
+		assert.Equal(t, "n-0S6", claims["nonce"], "should pass the nonce")
+		assert.Equal(t, issuer, claims["iss"], "should set the issuer")
+		assert.Equal(t, "1", claims["sub"], "should identify the user")
+		assert.Equal(t, "anna", claims["preferred_username"], "should carry the name for the profile scope")
+		assert.Equal(t, []interface{}{"clerk"}, claims["roles"], "should map the roles to names")
+	}
+	{
+		access := res["access_token"].(string)
+		id, err := f.svr.TokenUser(auth.TokenValue(access))
+		assert.Equal(t, nil, err, "should issue a token of the server")
+		assert.Equal(t, auth.UserID(1), id, "should issue the token to the user")
+
+		req := httptest.NewRequest("GET", "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+access)
+		rec := httptest.NewRecorder()
+		f.p.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "should serve the user info")
+		assert.Equal(t, `{"sub":"1","preferred_username":"anna","roles":["clerk"]}`+"\n", rec.Body.String(), "should give the claims")
+
+		req = httptest.NewRequest("GET", "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer invalid")
+		rec = httptest.NewRecorder()
+		f.p.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "should reject invalid tokens")
+	}
+	{
+		status, _ := f.token(codeForm(loc.Query().Get("code")), "", "")
+		assert.Equal(t, http.StatusBadRequest, status, "should not accept a code twice")
+	}
+	{
+		_, loc = f.authorize(f.session, authParams("spa"))
+		f.clock.Advance(codeExpiry + time.Second)
+		status, _ := f.token(codeForm(loc.Query().Get("code")), "", "")
+		assert.Equal(t, http.StatusBadRequest, status, "should expire codes by the clock of the server")
+	}
+}
+
+func TestConfidentialClient(t *testing.T) {
+	f := newFixture(t, Config{})
+	params := authParams("backend")
+	params.Del("code_challenge")
+	params.Del("code_challenge_method")
+	params.Set("scope", "openid")
+	_, loc := f.authorize(f.session, params)
+	form := codeForm(loc.Query().Get("code"))
+	form.Del("client_id")
+	form.Del("code_verifier")
+
+	status, res := f.token(form, "backend", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status, "should authenticate the client")
+	assert.Equal(t, "invalid_client", res["error"], "should report invalid_client")
+	status, res = f.token(form, "backend", "s3cr3t")
+	assert.Equal(t, http.StatusOK, status, "should not require PKCE from confidential clients")
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(res["id_token"].(string), ".")[1])
+	var claims map[string]interface{}
+	json.Unmarshal(payload, &claims)
+	assert.Equal(t, nil, claims["roles"], "should leave out the claims of scopes not requested")
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	f := newFixture(t, Config{})
+	{
+		params := authParams("spa")
+		params.Set("redirect_uri", "https://evil.example.com/")
+		code, _ := f.authorize(f.session, params)
+		assert.Equal(t, http.StatusBadRequest, code, "should not redirect to unregistered URIs")
+	}
+	{
+		params := authParams("spa")
+		params.Del("code_challenge")
+		_, loc := f.authorize(f.session, params)
+		assert.Equal(t, "invalid_request", loc.Query().Get("error"), "should require PKCE from public clients")
+		params = authParams("spa")
+		params.Set("code_challenge_method", "plain")
+		_, loc = f.authorize(f.session, params)
+		assert.Equal(t, "invalid_request", loc.Query().Get("error"), "should only accept S256")
+		params = authParams("spa")
+		params.Set("scope", "profile")
+		_, loc = f.authorize(f.session, params)
+		assert.Equal(t, "invalid_scope", loc.Query().Get("error"), "should require the openid scope")
+	}
+	{
+		_, loc := f.authorize("", authParams("spa"))
+		assert.Equal(t, "login_required", loc.Query().Get("error"), "should report users who are not signed in")
+		assert.Equal(t, "xyz", loc.Query().Get("state"), "should pass the state back")
+	}
+	{
+		f := newFixture(t, Config{LoginURL: "https://id.example.com/login"})
+		_, loc := f.authorize("invalid", authParams("spa"))
+		assert.Equal(t, "/login", loc.Path, "should send users to the login page")
+		back, _ := url.Parse(loc.Query().Get("return_to"))
+		assert.Equal(t, issuer+"/authorize", back.Scheme+"://"+back.Host+back.Path, "should come back to the authorization endpoint")
+		assert.Equal(t, "xyz", back.Query().Get("state"), "should come back with the same request")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	f := newFixture(t, Config{})
+	{
+		rec := httptest.NewRecorder()
+		f.p.ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+		var doc map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &doc)
+		assert.Equal(t, issuer, doc["issuer"], "should give the issuer")
+		assert.Equal(t, issuer+"/token", doc["token_endpoint"], "should give the endpoints")
+		assert.Equal(t, []interface{}{"EdDSA"}, doc["id_token_signing_alg_values_supported"], "should give the algorithm")
+	}
+	{
+		rec := httptest.NewRecorder()
+		f.p.ServeHTTP(rec, httptest.NewRequest("GET", "/jwks", nil))
+		var set auth.JWKSet
+		json.Unmarshal(rec.Body.Bytes(), &set)
+		assert.Equal(t, 1, len(set.Keys), "should publish the key")
+		assert.Equal(t, "k1", set.Keys[0].KeyID, "should give the key ID")
+		x, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+		assert.Equal(t, []byte(f.pub), x, "should publish the public key")
+	}
+	{
+		rec := httptest.NewRecorder()
+		f.p.ServeHTTP(rec, httptest.NewRequest("POST", "/jwks", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, "should check the method")
+	}
+	{
+		_, err := NewProvider(f.svr, &Config{Issuer: issuer, Key: auth.JWTConfig{Algorithm: auth.HS256, Key: []byte("s3cr3t")}})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should reject shared secrets")
+		_, err = NewProvider(f.svr, &Config{Issuer: issuer, Key: f.p.cfg.Key, Clients: []Client{{ID: "worker", Scopes: []string{"orders:read"}}}})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should reject public clients with scopes")
+	}
+}
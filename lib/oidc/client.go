@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+// Services authenticate with the client credentials grant (RFC 6749, section 4.4) without a user
+// account. Their access tokens are JWTs signed with the key of the ID tokens, rather than tokens of
+// the server, as there is no user to issue them to. Resource servers check them with
+// VerifyAccessToken or RequireScope, or by themselves with the published key.
+
+// ClientClaims is the payload of the access tokens issued to clients, in the format of RFC 9068.
+type ClientClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// HasScope checks if the token was granted a scope.
+func (c *ClientClaims) HasScope(scope string) bool {
+	return hasScope(strings.Fields(c.Scope), scope)
+}
+
+// grantClient implements the client_credentials grant. The client is already authenticated.
+func (p *Provider) grantClient(w http.ResponseWriter, r *http.Request, client *Client) {
+	if len(client.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, "unauthorized_client", "")
+		return
+	}
+	// All the scopes of the client by default, see RFC 6749, section 3.3
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, s := range scopes {
+		if !hasScope(client.Scopes, s) {
+			writeError(w, http.StatusBadRequest, "invalid_scope", s)
+			return
+		}
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	now := p.svr.Now()
+	claims := ClientClaims{
+		Issuer:    p.cfg.Issuer,
+		Subject:   client.ID,
+		ClientID:  client.ID,
+		Scope:     strings.Join(scopes, " "),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Duration(p.cfg.ClientTokenExpireSec) * time.Second).Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(b),
+	}
+	token, err := auth.SignJWT(&p.cfg.Key, claims)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   p.cfg.ClientTokenExpireSec,
+		Scope:       claims.Scope,
+	})
+}
+
+// VerifyAccessToken checks an access token issued with the client credentials grant. Tokens of
+// clients that are no longer configured are rejected.
+//
+// Returns: the claims in the token
+// Errors: auth.ErrInvalidToken
+func (p *Provider) VerifyAccessToken(token auth.TokenValue) (*ClientClaims, error) {
+	var claims ClientClaims
+	if err := p.verifier.VerifyInto(token, &claims); err != nil {
+		return nil, err
+	}
+	// ID tokens are signed with the same key, but have no client_id
+	if claims.ClientID == "" || claims.ClientID != claims.Subject || p.clients[claims.ClientID] == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+type clientKey struct{}
+
+// RequireScope lets through the requests carrying an access token of a client that was granted
+// the scope, or any scope if it is empty. Rejected requests are answered with
+// middleware.WriteError.
+func (p *Provider) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := middleware.BearerToken(r)
+			if err != nil {
+				middleware.WriteError(w, r, err)
+				return
+			}
+			claims, err := p.VerifyAccessToken(token)
+			if err != nil {
+				middleware.WriteError(w, r, err)
+				return
+			}
+			if scope != "" && !claims.HasScope(scope) {
+				middleware.WriteError(w, r, middleware.ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, claims)))
+		})
+	}
+}
+
+// ClientFrom returns the claims injected by RequireScope, or nil.
+func ClientFrom(ctx context.Context) *ClientClaims {
+	c, _ := ctx.Value(clientKey{}).(*ClientClaims)
+	return c
+}
+
+// newVerifier makes the verifier of the tokens signed with a key.
+func newVerifier(cfg *auth.JWTConfig) (*auth.JWTVerifier, error) {
+	switch k := cfg.Key.(type) {
+	case *rsa.PrivateKey:
+		return auth.NewJWTVerifier(cfg.Algorithm, &k.PublicKey, cfg.Issuer)
+	case ed25519.PrivateKey:
+		return auth.NewJWTVerifier(cfg.Algorithm, k.Public(), cfg.Issuer)
+	}
+	return nil, auth.ErrInvalidConfig
+}
@@ -0,0 +1,70 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func TestClientCredentials(t *testing.T) {
+	f := newFixture(t, Config{})
+	grant := url.Values{"grant_type": {"client_credentials"}}
+	{
+		status, res := f.token(grant, "worker", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, status, "should authenticate the client")
+		assert.Equal(t, "invalid_client", res["error"], "should report invalid_client")
+		status, res = f.token(grant, "backend", "s3cr3t")
+		assert.Equal(t, http.StatusBadRequest, status, "should reject clients without scopes")
+		assert.Equal(t, "unauthorized_client", res["error"], "should report unauthorized_client")
+		status, res = f.token(url.Values{"grant_type": {"client_credentials"}, "scope": {"orders:delete"}}, "worker", "w0rker")
+		assert.Equal(t, http.StatusBadRequest, status, "should reject scopes the client does not have")
+		assert.Equal(t, "invalid_scope", res["error"], "should report invalid_scope")
+	}
+	{
+		status, res := f.token(grant, "worker", "w0rker")
+		assert.Equal(t, http.StatusOK, status, "should issue a token")
+		assert.Equal(t, "orders:read orders:write", res["scope"], "should grant all the scopes by default")
+		assert.Equal(t, 600.0, res["expires_in"], "should give the lifetime")
+		assert.Equal(t, nil, res["id_token"], "should not issue an ID token")
+		claims, err := f.p.VerifyAccessToken(auth.TokenValue(res["access_token"].(string)))
+		assert.Equal(t, nil, err, "should verify the token")
+		assert.Equal(t, "worker", claims.ClientID, "should identify the client")
+		assert.Equal(t, true, claims.HasScope("orders:write"), "should carry the scopes")
+		assert.Equal(t, f.clock.Now().Unix()+600, claims.ExpiresAt, "should expire by the clock of the server")
+	}
+
+	status, res := f.token(url.Values{"grant_type": {"client_credentials"}, "scope": {"orders:read"}, "client_id": {"worker"}, "client_secret": {"w0rker"}}, "", "")
+	assert.Equal(t, http.StatusOK, status, "should accept credentials in the form")
+	assert.Equal(t, "orders:read", res["scope"], "should grant the requested scopes")
+	token := res["access_token"].(string)
+
+	var client string
+	h := func(scope string) http.Handler {
+		return f.p.RequireScope(scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client = ClientFrom(r.Context()).ClientID
+		}))
+	}
+	do := func(h http.Handler, token string) int {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, do(h("orders:read"), token), "should let the client through")
+	assert.Equal(t, "worker", client, "should inject the claims")
+	assert.Equal(t, http.StatusForbidden, do(h("orders:write"), token), "should check the scope")
+	assert.Equal(t, http.StatusUnauthorized, do(h(""), "invalid"), "should reject invalid tokens")
+
+	_, loc := f.authorize(f.session, authParams("spa"))
+	_, res = f.token(codeForm(loc.Query().Get("code")), "", "")
+	assert.Equal(t, http.StatusUnauthorized, do(h(""), res["id_token"].(string)), "should not take ID tokens for access tokens")
+	f.clock.Advance(601 * time.Second)
+	assert.Equal(t, http.StatusUnauthorized, do(h("orders:read"), token), "should expire tokens by the clock of the server")
+}
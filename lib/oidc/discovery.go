@@ -0,0 +1,20 @@
+package oidc
+
+import "github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+
+// discovery is the provider metadata, see OpenID Connect Discovery 1.0, section 3.
+type discovery struct {
+	Issuer                string              `json:"issuer"`
+	AuthorizationEndpoint string              `json:"authorization_endpoint"`
+	TokenEndpoint         string              `json:"token_endpoint"`
+	UserinfoEndpoint      string              `json:"userinfo_endpoint"`
+	JWKSURI               string              `json:"jwks_uri"`
+	ResponseTypes         []string            `json:"response_types_supported"`
+	GrantTypes            []string            `json:"grant_types_supported"`
+	SubjectTypes          []string            `json:"subject_types_supported"`
+	SigningAlgs           []auth.JWTAlgorithm `json:"id_token_signing_alg_values_supported"`
+	Scopes                []string            `json:"scopes_supported"`
+	TokenAuthMethods      []string            `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethods  []string            `json:"code_challenge_methods_supported"`
+	Claims                []string            `json:"claims_supported"`
+}
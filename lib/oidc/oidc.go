@@ -0,0 +1,520 @@
+// Package oidc turns an auth.Server into an OpenID Connect provider, so that applications
+// supporting OIDC can sign their users in with it.
+//
+// Users sign in with the authorization code flow, with PKCE (S256) required for public clients.
+// Backend services authenticate as themselves with the client credentials grant, see
+// VerifyAccessToken. The provider serves, relative to Config.Issuer:
+//
+//	GET  /.well-known/openid-configuration -> discovery document
+//	GET  /jwks                             -> public key of the ID tokens
+//	GET  /authorize                        -> redirect to the client with a code
+//	POST /token                            -> {"access_token", "token_type", "id_token", "expires_in", "scope"}
+//	GET  /userinfo                         with bearer token -> {"sub", "preferred_username", "roles"}
+//
+// The provider does not render a login page. The authorization endpoint reads the token of the
+// signed-in user from the request (a cookie by default), and sends users without one to
+// Config.LoginURL. Clients are trusted first-party applications: there is no consent screen.
+//
+// The access token is a regular token of the server, so it also works with CheckRole and package
+// middleware. Roles are mapped to the "roles" claim by name.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+// Client is an application registered with the provider.
+type Client struct {
+	ID string
+	// Secret authenticates confidential clients at the token endpoint. Public clients, such as
+	// single-page and mobile apps, have none and must use PKCE.
+	Secret string
+	// RedirectURIs are the only URIs codes are sent to. They are compared exactly.
+	RedirectURIs []string
+	// Scopes are those the client may be granted with its own credentials (the client_credentials
+	// grant). Only confidential clients can have them.
+	Scopes []string
+}
+
+func (c *Client) allows(redirect string) bool {
+	for _, uri := range c.RedirectURIs {
+		if uri == redirect {
+			return true
+		}
+	}
+	return false
+}
+
+// Config configures a Provider.
+type Config struct {
+	// Issuer is the URL the provider is served at, without a trailing slash. It is the "iss" claim
+	// of ID tokens, and the base of the endpoints in the discovery document.
+	Issuer string
+	// Key signs the ID tokens. Only RS256 and EdDSA can be used, as the public key is published.
+	// Key.Issuer is ignored.
+	Key auth.JWTConfig
+	// Clients are the applications allowed to use the provider.
+	Clients []Client
+	// LoginURL is where the authorization endpoint sends users who are not signed in, with the URL
+	// to come back to in the "return_to" parameter. If empty, clients get "login_required".
+	LoginURL string
+	// SessionToken extracts the token of the signed-in user from an authorization request. Defaults
+	// to the value of the "auth_token" cookie.
+	SessionToken func(r *http.Request) (auth.TokenValue, error)
+	// IDTokenExpireSec is the lifetime of ID tokens. Defaults to 300.
+	IDTokenExpireSec int32
+	// ClientTokenExpireSec is the lifetime of the access tokens of the client credentials grant.
+	// They cannot be revoked, so it should be short. Defaults to 600.
+	ClientTokenExpireSec int32
+}
+
+// codeExpiry is the lifetime of authorization codes. RFC 6749 recommends at most 10 minutes, but
+// clients redeem them right away.
+const codeExpiry = time.Minute
+
+// authCode is what an authorization code stands for.
+type authCode struct {
+	client    string
+	redirect  string
+	user      auth.UserID
+	scopes    []string
+	nonce     string
+	challenge string
+	expires   time.Time
+}
+
+// Provider serves the OIDC endpoints on top of an auth server.
+type Provider struct {
+	svr       *auth.Server
+	cfg       Config
+	clients   map[string]*Client
+	verifier  *auth.JWTVerifier
+	discovery []byte
+	jwks      []byte
+
+	// codes maps the authorization codes that have not been redeemed. Expired codes are removed
+	// when new ones are made, at most once per codeExpiry.
+	mu     sync.Mutex
+	codes  map[string]*authCode
+	pruned time.Time
+}
+
+// NewProvider creates a Provider. Clients with neither redirect URIs nor scopes are rejected, as are
+// public clients with scopes, and a key that cannot be published. Codes and tokens expire by the
+// clock of svr, see auth.ServerConfig.Clock.
+//
+// Returns: pointer to the new provider
+// Errors: auth.ErrInvalidConfig
+func NewProvider(svr *auth.Server, cfg *Config) (*Provider, error) {
+	p := &Provider{svr: svr, cfg: *cfg, clients: make(map[string]*Client), codes: make(map[string]*authCode)}
+	if _, err := url.Parse(p.cfg.Issuer); err != nil || p.cfg.Issuer == "" || strings.HasSuffix(p.cfg.Issuer, "/") {
+		return nil, auth.ErrInvalidConfig
+	}
+	p.cfg.Key.Issuer = p.cfg.Issuer
+	key, err := auth.NewJWK(&p.cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	if p.verifier, err = newVerifier(&p.cfg.Key); err != nil {
+		return nil, err
+	}
+	p.verifier = p.verifier.WithClock(svr)
+	for i := range p.cfg.Clients {
+		c := &p.cfg.Clients[i]
+		if c.ID == "" || (len(c.RedirectURIs) == 0 && len(c.Scopes) == 0) || (len(c.Scopes) > 0 && c.Secret == "") || p.clients[c.ID] != nil {
+			return nil, auth.ErrInvalidConfig
+		}
+		p.clients[c.ID] = c
+	}
+	if p.cfg.SessionToken == nil {
+		p.cfg.SessionToken = cookieToken
+	}
+	if p.cfg.IDTokenExpireSec <= 0 {
+		p.cfg.IDTokenExpireSec = 300
+	}
+	if p.cfg.ClientTokenExpireSec <= 0 {
+		p.cfg.ClientTokenExpireSec = 600
+	}
+
+	if p.jwks, err = json.Marshal(auth.JWKSet{Keys: []auth.JWK{*key}}); err != nil {
+		return nil, err
+	}
+	p.discovery, err = json.Marshal(discovery{
+		Issuer:                p.cfg.Issuer,
+		AuthorizationEndpoint: p.cfg.Issuer + "/authorize",
+		TokenEndpoint:         p.cfg.Issuer + "/token",
+		UserinfoEndpoint:      p.cfg.Issuer + "/userinfo",
+		JWKSURI:               p.cfg.Issuer + "/jwks",
+		ResponseTypes:         []string{"code"},
+		GrantTypes:            []string{"authorization_code", "client_credentials"},
+		SubjectTypes:          []string{"public"},
+		SigningAlgs:           []auth.JWTAlgorithm{p.cfg.Key.Algorithm},
+		Scopes:                []string{"openid", "profile", "roles"},
+		TokenAuthMethods:      []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethods:  []string{"S256"},
+		Claims:                []string{"iss", "sub", "aud", "exp", "iat", "nonce", "preferred_username", "roles"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// cookieToken is the default Config.SessionToken.
+func cookieToken(r *http.Request) (auth.TokenValue, error) {
+	c, err := r.Cookie("auth_token")
+	if err != nil {
+		return "", middleware.ErrNoToken
+	}
+	return auth.TokenValue(c.Value), nil
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Storage calls are canceled with the request, and tokens bound to their client are verified
+	// against it
+	svr := p.svr.WithContext(auth.WithClientInfo(r.Context(), clientInfo(r)))
+	get, post := r.Method == http.MethodGet, r.Method == http.MethodPost
+	switch path := r.URL.Path; {
+	case path == "/.well-known/openid-configuration" && get:
+		writeRaw(w, p.discovery)
+	case path == "/jwks" && get:
+		writeRaw(w, p.jwks)
+	case path == "/authorize" && get:
+		p.serveAuthorize(w, r, svr)
+	case path == "/token" && post:
+		p.serveToken(w, r, svr)
+	case path == "/userinfo" && (get || post):
+		p.serveUserinfo(w, r, svr)
+	case path == "/.well-known/openid-configuration", path == "/jwks", path == "/authorize", path == "/token":
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "")
+	}
+}
+
+// *-* Authorization *-*
+
+func (p *Provider) serveAuthorize(w http.ResponseWriter, r *http.Request, svr *auth.Server) {
+	q := r.URL.Query()
+	client := p.clients[q.Get("client_id")]
+	redirect := q.Get("redirect_uri")
+	if client == nil || !client.allows(redirect) {
+		// Errors are only sent to verified redirect URIs, so that the provider is not an open redirector
+		writeError(w, http.StatusBadRequest, "invalid_request", "unknown client or redirect URI")
+		return
+	}
+	fail := func(code, desc string) {
+		http.Redirect(w, r, withQuery(redirect, "error", code, "error_description", desc, "state", q.Get("state")), http.StatusFound)
+	}
+
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	scopes := strings.Fields(q.Get("scope"))
+	if !hasScope(scopes, "openid") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge == "" && client.Secret == "" {
+		fail("invalid_request", "PKCE is required for public clients")
+		return
+	}
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "only the S256 code challenge method is supported")
+		return
+	}
+
+	var user auth.UserID
+	token, err := p.cfg.SessionToken(r)
+	if err == nil {
+		user, err = svr.TokenUser(token)
+	}
+	if err != nil && err != auth.ErrInvalidToken && err != middleware.ErrNoToken {
+		fail("server_error", "")
+		return
+	}
+	if err != nil {
+		if p.cfg.LoginURL == "" || q.Get("prompt") == "none" {
+			fail("login_required", "")
+			return
+		}
+		http.Redirect(w, r, withQuery(p.cfg.LoginURL, "return_to", p.cfg.Issuer+"/authorize?"+q.Encode()), http.StatusFound)
+		return
+	}
+
+	code, err := p.newCode(&authCode{
+		client:    client.ID,
+		redirect:  redirect,
+		user:      user,
+		scopes:    scopes,
+		nonce:     q.Get("nonce"),
+		challenge: challenge,
+		expires:   p.svr.Now().Add(codeExpiry),
+	})
+	if err != nil {
+		fail("server_error", "")
+		return
+	}
+	http.Redirect(w, r, withQuery(redirect, "code", code, "state", q.Get("state")), http.StatusFound)
+}
+
+// newCode saves an authorization code.
+func (p *Provider) newCode(c *authCode) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := p.svr.Now(); now.Sub(p.pruned) >= codeExpiry {
+		for k, v := range p.codes {
+			if now.After(v.expires) {
+				delete(p.codes, k)
+			}
+		}
+		p.pruned = now
+	}
+	p.codes[code] = c
+	return code, nil
+}
+
+// takeCode redeems an authorization code. Codes can only be used once.
+func (p *Provider) takeCode(code string) *authCode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.codes[code]
+	delete(p.codes, code)
+	if c == nil || p.svr.Now().After(c.expires) {
+		return nil
+	}
+	return c
+}
+
+// *-* Tokens *-*
+
+type tokenResponse struct {
+	AccessToken auth.TokenValue `json:"access_token"`
+	TokenType   string          `json:"token_type"`
+	IDToken     auth.TokenValue `json:"id_token,omitempty"`
+	ExpiresIn   int32           `json:"expires_in,omitempty"`
+	Scope       string          `json:"scope"`
+}
+
+// UserInfo is the payload of the userinfo endpoint. The ID tokens carry the same claims, for the
+// scopes requested: "preferred_username" for "profile", and "roles" for "roles".
+type UserInfo struct {
+	Subject           string   `json:"sub"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Roles             []string `json:"roles,omitempty"`
+}
+
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce,omitempty"`
+	UserInfo
+}
+
+func (p *Provider) serveToken(w http.ResponseWriter, r *http.Request, svr *auth.Server) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client := p.clients[id]
+	if client == nil || (client.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		p.redeemCode(w, r, svr, client)
+	case "client_credentials":
+		p.grantClient(w, r, client)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// redeemCode implements the authorization_code grant.
+func (p *Provider) redeemCode(w http.ResponseWriter, r *http.Request, svr *auth.Server, client *Client) {
+	code := p.takeCode(r.PostForm.Get("code"))
+	if code == nil || code.client != client.ID || code.redirect != r.PostForm.Get("redirect_uri") {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	if code.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.challenge)) != 1 {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "code verifier mismatch")
+			return
+		}
+	}
+
+	access, err := svr.IssueToken(code.user, clientInfo(r))
+	if err == auth.ErrUserNotExist || err == auth.ErrUserSuspended {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	info, err := p.userInfo(svr, access)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if !hasScope(code.scopes, "profile") {
+		info.PreferredUsername = ""
+	}
+	if !hasScope(code.scopes, "roles") {
+		info.Roles = nil
+	}
+	now := p.svr.Now()
+	idToken, err := auth.SignJWT(&p.cfg.Key, idTokenClaims{
+		Issuer:    p.cfg.Issuer,
+		Audience:  client.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Duration(p.cfg.IDTokenExpireSec) * time.Second).Unix(),
+		Nonce:     code.nonce,
+		UserInfo:  *info,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		IDToken:     idToken,
+		Scope:       strings.Join(code.scopes, " "),
+	})
+}
+
+func (p *Provider) serveUserinfo(w http.ResponseWriter, r *http.Request, svr *auth.Server) {
+	token, err := middleware.BearerToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+	info, err := p.userInfo(svr, token)
+	if err == auth.ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// userInfo gathers the claims about the user behind a token. Roles that were deleted in the
+// meantime are left out.
+func (p *Provider) userInfo(svr *auth.Server, token auth.TokenValue) (*UserInfo, error) {
+	id, err := svr.TokenUser(token)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := svr.AllRoles(token)
+	if err != nil {
+		return nil, err
+	}
+	user := svr.GetUser(id)
+	if user == nil {
+		return nil, auth.ErrInvalidToken
+	}
+	info := UserInfo{Subject: strconv.FormatInt(int64(id), 10), PreferredUsername: user.Name}
+	for _, id := range roles {
+		if role := svr.GetRole(id); role != nil {
+			info.Roles = append(info.Roles, role.Name)
+		}
+	}
+	sort.Strings(info.Roles)
+	return &info, nil
+}
+
+// *-* Helpers *-*
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// withQuery adds parameters (pairs of names and values) to a URL, skipping empty values.
+func withQuery(base string, params ...string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	q := u.Query()
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i+1] != "" {
+			q.Set(params[i], params[i+1])
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// clientInfo describes the client of a request, like in package httpapi.
+func clientInfo(r *http.Request) auth.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auth.ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
+func writeRaw(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError reports an error in the format of RFC 6749, section 5.2.
+func writeError(w http.ResponseWriter, status int, code, desc string) {
+	res := map[string]string{"error": code}
+	if desc != "" {
+		res["error_description"] = desc
+	}
+	writeJSON(w, status, res)
+}
@@ -0,0 +1,68 @@
+package redisrevoke
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// waitFor polls cond, as deliveries are asynchronous.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestBroadcaster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	jwt := &auth.JWTConfig{Algorithm: auth.HS256, Key: []byte("s3cr3t")}
+	store := auth.NewMemoryStorage()
+	busA, busB := New(client, ""), New(client, "")
+	a, err := auth.NewServer(&auth.ServerConfig{TokenExpireSec: 60, JWT: jwt, Revocations: busA}, store)
+	assert.Equal(t, nil, err, "should success")
+	b, _ := auth.NewServer(&auth.ServerConfig{TokenExpireSec: 60, JWT: jwt, Revocations: busB}, store)
+	a.CreateUser("elton", "123456")
+	{
+		token, _ := a.Authenticate("elton", "123456")
+		_, err := b.AllRoles(token)
+		assert.Equal(t, nil, err, "should accept the tokens of other servers")
+		a.Invalidate(token)
+		assert.Equal(t, true, waitFor(func() bool {
+			_, err := b.AllRoles(token)
+			return err == auth.ErrInvalidToken
+		}), "should apply the revocations of other servers")
+	}
+	{
+		got := make(chan auth.Revocation, 10)
+		other := New(client, "other")
+		other.Subscribe(func(r auth.Revocation) { got <- r })
+		client.Publish(context.Background(), "other", "garbage")
+		other.Publish(context.Background(), auth.Revocation{ID: "x", Expires: time.Unix(1700000000, 0)})
+		var r auth.Revocation
+		select {
+		case r = <-got:
+		case <-time.After(time.Second):
+		}
+		assert.Equal(t, "x", r.ID, "should skip malformed messages, and decode the revocation")
+		assert.Equal(t, true, r.Expires.Equal(time.Unix(1700000000, 0)), "should decode the revocation")
+		assert.Equal(t, nil, other.Close(), "should success")
+		assert.Equal(t, 0, len(got), "should deliver each revocation once")
+		assert.Equal(t, nil, other.Close(), "should be idempotent")
+		assert.Equal(t, ErrClosed, other.Publish(context.Background(), r), "should not publish after closing")
+	}
+	assert.Equal(t, nil, busA.Close(), "should success")
+	assert.Equal(t, nil, busB.Close(), "should success")
+}
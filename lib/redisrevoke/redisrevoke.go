@@ -0,0 +1,127 @@
+// Package redisrevoke shares the revocations of JWTs between auth servers over Redis pub/sub, as an
+// auth.RevocationBroadcaster.
+//
+//	client := redis.NewClient(&redis.Options{Addr: "redis:6379"})
+//	bus := redisrevoke.New(client, "")
+//	defer bus.Close()
+//	svr, err := auth.NewServer(&auth.ServerConfig{JWT: jwtConfig, Revocations: bus, ...}, store)
+//
+// Pub/sub keeps no history: a server that is disconnected, or not started yet, misses the
+// revocations published meanwhile. The client reconnects by itself.
+package redisrevoke
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// DefaultChannel is the channel used when none is given to New.
+const DefaultChannel = "auth:revocations"
+
+var ErrClosed = errors.New("broadcaster closed")
+
+// Broadcaster publishes revocations to a Redis channel, and delivers those of the channel to its
+// subscribers.
+type Broadcaster struct {
+	client  redis.UniversalClient
+	channel string
+
+	mu     sync.Mutex
+	subs   []*redis.PubSub
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New creates a Broadcaster on a channel, or DefaultChannel if it is empty. The client is not
+// closed by the Broadcaster.
+//
+// Returns: pointer to the new broadcaster
+func New(client redis.UniversalClient, channel string) *Broadcaster {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	return &Broadcaster{client: client, channel: channel}
+}
+
+// Publish implements auth.RevocationBroadcaster.
+//
+// Returns: none
+// Errors: ErrClosed, or any error from Redis
+func (b *Broadcaster) Publish(ctx context.Context, r auth.Revocation) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	msg, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+// Subscribe implements auth.RevocationBroadcaster. It returns once the subscription is active, so
+// that revocations published afterwards are delivered. Malformed messages are ignored.
+//
+// Returns: none
+// Errors: ErrClosed, or any error from Redis
+func (b *Broadcaster) Subscribe(fn func(auth.Revocation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	ps := b.client.Subscribe(context.Background(), b.channel)
+	// The first reply confirms the subscription
+	if _, err := ps.Receive(context.Background()); err != nil {
+		ps.Close()
+		return err
+	}
+	b.subs = append(b.subs, ps)
+
+	ch := ps.Channel()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for msg := range ch {
+			var r auth.Revocation
+			if json.Unmarshal([]byte(msg.Payload), &r) == nil && r.ID != "" {
+				fn(r)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close ends the subscriptions, and waits for their deliveries to finish. It is a no-op if the
+// broadcaster is already closed.
+//
+// Returns: none
+// Errors: any error from Redis
+func (b *Broadcaster) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+
+	var err error
+	for _, ps := range subs {
+		if cerr := ps.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.wg.Wait()
+	return err
+}
@@ -0,0 +1,186 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+func newTestServer() *auth.Server {
+	svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+	return svr
+}
+
+// do sends a request to the handler, and decodes the JSON response (if any) into a map.
+func do(h http.Handler, method, path, token, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/scim+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var res map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res
+}
+
+// names lists an attribute of the resources of a ListResponse.
+func names(res map[string]interface{}, attr string) []interface{} {
+	list := []interface{}{}
+	for _, r := range res["Resources"].([]interface{}) {
+		list = append(list, r.(map[string]interface{})[attr])
+	}
+	return list
+}
+
+func TestUsers(t *testing.T) {
+	svr := newTestServer()
+	h := NewHandler(svr, &Options{BaseURL: "https://auth.example.com/scim/v2/"})
+	{
+		code, res := do(h, "POST", "/Users", "", `{
+			"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+			"userName": "anna", "name": {"givenName": "Anna"}, "password": "passw0rd", "active": true}`)
+		assert.Equal(t, http.StatusCreated, code, "should create the user")
+		assert.Equal(t, "1", res["id"], "should return the ID")
+		assert.Equal(t, nil, res["password"], "should not return the password")
+		assert.Equal(t, "https://auth.example.com/scim/v2/Users/1", res["meta"].(map[string]interface{})["location"], "should give the location")
+		_, err := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should set the password")
+		code, res = do(h, "POST", "/Users", "", `{"userName": "anna"}`)
+		assert.Equal(t, http.StatusConflict, code, "should map ErrUserExists")
+		assert.Equal(t, "uniqueness", res["scimType"], "should give the SCIM error type")
+		assert.Equal(t, "409", res["status"], "should give the status as a string")
+	}
+	{
+		code, res := do(h, "POST", "/Users", "", `{"userName": "belle", "active": false}`)
+		assert.Equal(t, http.StatusCreated, code, "should create users without a password")
+		assert.Equal(t, false, res["active"], "should suspend inactive users")
+		code, _ = do(h, "POST", "/Users", "", `{"userName": "cora", "password": "123"}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should map ErrWeakPassword")
+	}
+	{
+		code, res := do(h, "GET", `/Users?filter=userName%20eq%20"belle"`, "", "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, 1.0, res["totalResults"], "should filter by name")
+		assert.Equal(t, []interface{}{"belle"}, names(res, "userName"), "should filter by name")
+		_, res = do(h, "GET", `/Users?filter=userName+eq+"gina"`, "", "")
+		assert.Equal(t, []interface{}{}, res["Resources"], "should give an empty list")
+		code, res = do(h, "GET", `/Users?filter=emails+co+"x"`, "", "")
+		assert.Equal(t, http.StatusBadRequest, code, "should reject other filters")
+		assert.Equal(t, "invalidFilter", res["scimType"], "should reject other filters")
+		svr.CreateUser("cora", "passw0rd")
+		_, res = do(h, "GET", "/Users?startIndex=2&count=1", "", "")
+		assert.Equal(t, 3.0, res["totalResults"], "should count all users")
+		assert.Equal(t, []interface{}{"belle"}, names(res, "userName"), "should page from a 1-based index")
+	}
+	{
+		code, res := do(h, "PATCH", "/Users/1", "", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [{"op": "Replace", "path": "active", "value": "False"}]}`)
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, false, res["active"], "should deactivate the user")
+		assert.Equal(t, auth.UserSuspended, svr.GetUser(1).Status, "should suspend the user")
+		do(h, "PATCH", "/Users/1", "", `{"Operations": [{"op": "replace", "value": {"active": true, "password": "n3wpassw0rd"}}]}`)
+		_, err := svr.Authenticate("anna", "n3wpassw0rd")
+		assert.Equal(t, nil, err, "should reactivate the user and change the password")
+		code, res = do(h, "PATCH", "/Users/1", "", `{"Operations": [{"op": "replace", "path": "userName", "value": "anne"}]}`)
+		assert.Equal(t, "mutability", res["scimType"], "should not rename users")
+		code, _ = do(h, "PATCH", "/Users/1", "", `{"Operations": [{"op": "move", "path": "active", "value": true}]}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should reject unknown operations")
+	}
+	{
+		code, res := do(h, "PUT", "/Users/2", "", `{"userName": "belle", "active": true, "password": "passw0rd"}`)
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, true, res["active"], "should replace the user")
+		_, err := svr.Authenticate("belle", "passw0rd")
+		assert.Equal(t, nil, err, "should set the password")
+		code, _ = do(h, "DELETE", "/Users/2", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should delete the user")
+		code, res = do(h, "GET", "/Users/2", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should not find deleted users")
+		assert.Equal(t, []interface{}{"urn:ietf:params:scim:api:messages:2.0:Error"}, res["schemas"], "should give a SCIM error")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	svr := newTestServer()
+	h := NewHandler(svr, nil)
+	anna, _ := svr.CreateUser("anna", "passw0rd")
+	belle, _ := svr.CreateUser("belle", "passw0rd")
+	{
+		code, _ := do(h, "POST", "/Groups", "", `{"displayName": "scanner", "members": [{"value": "1"}, {"value": "101"}]}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should check the members")
+		assert.Equal(t, (*auth.Role)(nil), svr.GetRoleByName("scanner"), "should not create the role")
+		code, res := do(h, "POST", "/Groups", "", `{"displayName": "scanner", "members": [{"value": "1"}]}`)
+		assert.Equal(t, http.StatusCreated, code, "should create the role")
+		assert.Equal(t, []interface{}{map[string]interface{}{"value": "1", "display": "anna"}}, res["members"], "should add the members")
+		_, res = do(h, "GET", "/Users/1", "", "")
+		assert.Equal(t, []interface{}{map[string]interface{}{"value": "1", "display": "scanner"}}, res["groups"], "should list the groups of users")
+	}
+	rid := svr.GetRoleByName("scanner").ID
+	{
+		do(h, "PATCH", "/Groups/1", "", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "2"}]}]}`)
+		users, _ := svr.ListUsersWithRole(rid)
+		assert.Equal(t, []auth.UserID{anna, belle}, users, "should add members")
+		do(h, "PATCH", "/Groups/1", "", `{"Operations": [{"op": "remove", "path": "members[value eq \"1\"]"}]}`)
+		users, _ = svr.ListUsersWithRole(rid)
+		assert.Equal(t, []auth.UserID{belle}, users, "should remove the selected member")
+		do(h, "PATCH", "/Groups/1", "", `{"Operations": [{"op": "replace", "path": "members", "value": [{"value": "1"}]}]}`)
+		users, _ = svr.ListUsersWithRole(rid)
+		assert.Equal(t, []auth.UserID{anna}, users, "should replace the members")
+		code, res := do(h, "PATCH", "/Groups/1", "", `{"Operations": [{"op": "replace", "value": {"displayName": "printer"}}]}`)
+		assert.Equal(t, http.StatusBadRequest, code, "should not rename roles")
+		assert.Equal(t, "mutability", res["scimType"], "should not rename roles")
+	}
+	{
+		ci, _, _ := svr.CreateServiceAccount("ci")
+		svr.AddRoleToUser(ci, rid)
+		code, res := do(h, "PUT", "/Groups/1", "", `{"displayName": "scanner", "members": [{"value": "2"}]}`)
+		assert.Equal(t, http.StatusOK, code, "should success")
+		assert.Equal(t, 1, len(res["members"].([]interface{})), "should not show service accounts")
+		users, _ := svr.ListUsersWithRole(rid)
+		assert.Equal(t, []auth.UserID{belle, ci}, users, "should replace the members, but not service accounts")
+		code, _ = do(h, "GET", "/Users/3", "", "")
+		assert.Equal(t, http.StatusNotFound, code, "should not show service accounts")
+		svr.CreateRole("printer")
+		_, res = do(h, "GET", `/Groups?filter=displayName+eq+"printer"`, "", "")
+		assert.Equal(t, []interface{}{"printer"}, names(res, "displayName"), "should filter by name")
+		_, res = do(h, "GET", "/Groups", "", "")
+		assert.Equal(t, []interface{}{"scanner", "printer"}, names(res, "displayName"), "should list all roles")
+		code, _ = do(h, "DELETE", "/Groups/1", "", "")
+		assert.Equal(t, http.StatusNoContent, code, "should delete the role")
+		assert.Equal(t, (*auth.Role)(nil), svr.GetRole(rid), "should delete the role")
+	}
+}
+
+func TestPermission(t *testing.T) {
+	svr := newTestServer()
+	h := NewHandler(svr, &Options{Permission: "scim"})
+	svr.CreateUser("okta", "passw0rd")
+	svr.CreateUser("anna", "passw0rd")
+	rid, _ := svr.CreateRole("provisioner")
+	svr.GrantPermissionToRole(rid, "scim")
+	svr.AddRoleToUser(1, rid)
+	okta, _ := svr.Authenticate("okta", "passw0rd")
+	anna, _ := svr.Authenticate("anna", "passw0rd")
+	{
+		code, _ := do(h, "GET", "/Users", "", "")
+		assert.Equal(t, http.StatusUnauthorized, code, "should require a token")
+		code, _ = do(h, "GET", "/Users", string(anna), "")
+		assert.Equal(t, http.StatusForbidden, code, "should require the permission")
+		code, _ = do(h, "GET", "/Users", string(okta), "")
+		assert.Equal(t, http.StatusOK, code, "should success")
+	}
+	{
+		code, res := do(h, "GET", "/ServiceProviderConfig", "", "")
+		assert.Equal(t, http.StatusOK, code, "should describe the handler without a token")
+		assert.Equal(t, map[string]interface{}{"supported": true}, res["patch"], "should support PATCH")
+	}
+}
@@ -0,0 +1,313 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+type groupResource struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []ref    `json:"members"`
+	Meta        *meta    `json:"meta,omitempty"`
+}
+
+// memberPathRE matches the path removing a single member, as sent by most clients.
+var memberPathRE = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+func (h *Handler) serveGroups(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return h.listGroups(w, r)
+		case http.MethodPost:
+			return h.createGroup(w, r)
+		}
+		return errBadMethod
+	}
+	n, ok := parseID(path[0])
+	if !ok {
+		return errNotFound
+	}
+	role := h.svr.GetRole(auth.RoleID(n))
+	if role == nil {
+		return errNotFound
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req groupResource
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if req.DisplayName != "" && req.DisplayName != role.Name {
+			return badRequest("mutability", "displayName cannot be changed")
+		}
+		users, err := h.members(req.Members)
+		if err != nil {
+			return err
+		}
+		if err := h.setMembers(role.ID, users); err != nil {
+			return err
+		}
+	case http.MethodPatch:
+		ops, err := readPatch(r)
+		if err != nil {
+			return err
+		}
+		for i := range ops {
+			if err := h.patchGroup(role, &ops[i]); err != nil {
+				return err
+			}
+		}
+	case http.MethodDelete:
+		if err := h.svr.DeleteRole(role.ID); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return errBadMethod
+	}
+	res, err := h.newGroupResource(role)
+	if err != nil {
+		return err
+	}
+	writeResource(w, http.StatusOK, res)
+	return nil
+}
+
+func (h *Handler) listGroups(w http.ResponseWriter, r *http.Request) error {
+	start, count, err := h.page(r)
+	if err != nil {
+		return err
+	}
+	name, filtered, err := parseFilter(r, groupSchema, "displayName")
+	if err != nil {
+		return err
+	}
+	res := listResponse{Schemas: []string{listSchema}, StartIndex: start, Resources: []interface{}{}}
+	add := func(role *auth.Role) error {
+		res.TotalResults++
+		if res.TotalResults < start || len(res.Resources) >= count {
+			return nil
+		}
+		g, err := h.newGroupResource(role)
+		if err != nil {
+			return err
+		}
+		res.Resources = append(res.Resources, g)
+		return nil
+	}
+	if filtered {
+		if role := h.svr.GetRoleByName(name); role != nil {
+			if err := add(role); err != nil {
+				return err
+			}
+		}
+	} else {
+		opts := auth.ListOptions{Limit: auth.MaxListLimit}
+		for {
+			roles, next, err := h.svr.ListRoles(&opts)
+			if err != nil {
+				return err
+			}
+			for _, role := range roles {
+				if err := add(role); err != nil {
+					return err
+				}
+			}
+			if next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+	}
+	res.ItemsPerPage = len(res.Resources)
+	writeResource(w, http.StatusOK, res)
+	return nil
+}
+
+func (h *Handler) createGroup(w http.ResponseWriter, r *http.Request) error {
+	var req groupResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.DisplayName == "" {
+		return badRequest("invalidValue", "displayName is required")
+	}
+	// Check the members first, so that the role is not created if they are wrong
+	users, err := h.members(req.Members)
+	if err != nil {
+		return err
+	}
+	id, err := h.svr.CreateRole(req.DisplayName)
+	if err != nil {
+		return err
+	}
+	if err := h.setMembers(id, users); err != nil {
+		return err
+	}
+	role := h.svr.GetRole(id)
+	if role == nil {
+		return errNotFound
+	}
+	res, err := h.newGroupResource(role)
+	if err != nil {
+		return err
+	}
+	if loc := h.location("Groups", int64(id)); loc != "" {
+		w.Header().Set("Location", loc)
+	}
+	writeResource(w, http.StatusCreated, res)
+	return nil
+}
+
+// patchGroup applies a patch operation to the members of a role.
+func (h *Handler) patchGroup(role *auth.Role, op *patchOp) error {
+	if m := memberPathRE.FindStringSubmatch(op.Path); m != nil {
+		if op.Op != "remove" {
+			return badRequest("invalidPath", "members can only be selected for removal")
+		}
+		id, ok := parseID(m[1])
+		if !ok {
+			return nil
+		}
+		return h.removeMember(role.ID, auth.UserID(id))
+	}
+	if op.Op == "remove" {
+		if attrName(op.Path, groupSchema) != "members" {
+			return badRequest("mutability", "only members can be removed")
+		}
+		if len(op.Value) == 0 || string(op.Value) == "null" {
+			return h.setMembers(role.ID, nil)
+		}
+		var refs []ref
+		if err := json.Unmarshal(op.Value, &refs); err != nil {
+			return badRequest("invalidValue", "members must be a list")
+		}
+		for _, m := range refs {
+			if id, ok := parseID(m.Value); ok {
+				if err := h.removeMember(role.ID, auth.UserID(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	values, err := patchValues(op, groupSchema)
+	if err != nil {
+		return err
+	}
+	for attr, v := range values {
+		switch attr {
+		case "members":
+			var refs []ref
+			if err := json.Unmarshal(v, &refs); err != nil {
+				return badRequest("invalidValue", "members must be a list")
+			}
+			users, err := h.members(refs)
+			if err != nil {
+				return err
+			}
+			if op.Op == "replace" {
+				err = h.setMembers(role.ID, users)
+			} else {
+				for _, u := range users {
+					if err = h.svr.AddRoleToUser(u, role.ID); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		case "displayname":
+			var name string
+			if err := json.Unmarshal(v, &name); err != nil || name != role.Name {
+				return badRequest("mutability", "displayName cannot be changed")
+			}
+		}
+	}
+	return nil
+}
+
+// members checks that the members of a group are existing users.
+func (h *Handler) members(refs []ref) ([]auth.UserID, error) {
+	users := make([]auth.UserID, len(refs))
+	for i, m := range refs {
+		id, ok := parseID(m.Value)
+		if u := h.svr.GetUser(auth.UserID(id)); !ok || u == nil || u.Kind == auth.UserService {
+			return nil, badRequest("invalidValue", "no user "+strconv.Quote(m.Value))
+		}
+		users[i] = auth.UserID(id)
+	}
+	return users, nil
+}
+
+// setMembers makes a role held directly by exactly the given users, besides service accounts.
+func (h *Handler) setMembers(role auth.RoleID, users []auth.UserID) error {
+	have, err := h.svr.ListUsersWithRole(role)
+	if err != nil {
+		return err
+	}
+	keep := make(map[auth.UserID]bool, len(users))
+	for _, u := range users {
+		if err := h.svr.AddRoleToUser(u, role); err != nil {
+			return err
+		}
+		keep[u] = true
+	}
+	for _, u := range have {
+		if keep[u] {
+			continue
+		}
+		if obj := h.svr.GetUser(u); obj != nil && obj.Kind == auth.UserService {
+			continue
+		}
+		if err := h.removeMember(role, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeMember takes a role away from a user. Users that do not exist no longer hold it.
+func (h *Handler) removeMember(role auth.RoleID, user auth.UserID) error {
+	if err := h.svr.RemoveRoleFromUser(user, role); err != nil && err != auth.ErrUserNotExist {
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) newGroupResource(role *auth.Role) (*groupResource, error) {
+	users, err := h.svr.ListUsersWithRole(role.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := &groupResource{
+		Schemas:     []string{groupSchema},
+		ID:          strconv.FormatInt(int64(role.ID), 10),
+		DisplayName: role.Name,
+		Members:     []ref{},
+		Meta:        &meta{ResourceType: "Group", Location: h.location("Groups", int64(role.ID))},
+	}
+	for _, id := range users {
+		// Soft-deleted users keep their roles until they are purged
+		if u := h.svr.GetUser(id); u != nil && u.Kind != auth.UserService {
+			res.Members = append(res.Members, ref{
+				Value:   strconv.FormatInt(int64(id), 10),
+				Display: u.Name,
+				Ref:     h.location("Users", int64(id)),
+			})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,419 @@
+// Package scim lets identity governance tools, such as Okta or Microsoft Entra ID, provision the
+// users and role memberships of an auth.Server with SCIM 2.0 (RFC 7643 and RFC 7644).
+//
+//	h := scim.NewHandler(svr, &scim.Options{Permission: "scim", BaseURL: "https://auth.example.com/scim/v2"})
+//	http.Handle("/scim/v2/", http.StripPrefix("/scim/v2", h))
+//
+// Endpoints (bodies are SCIM resources or messages):
+//
+//	GET    /Users?filter&startIndex&count  -> ListResponse of Users
+//	POST   /Users                          User -> 201 User
+//	GET    /Users/{id}                     -> User
+//	PUT    /Users/{id}                     User -> User
+//	PATCH  /Users/{id}                     PatchOp -> User
+//	DELETE /Users/{id}                     -> 204
+//	GET    /Groups?filter&startIndex&count -> ListResponse of Groups
+//	POST   /Groups                         Group -> 201 Group
+//	GET    /Groups/{id}                    -> Group
+//	PUT    /Groups/{id}                    Group -> Group
+//	PATCH  /Groups/{id}                    PatchOp -> Group
+//	DELETE /Groups/{id}                    -> 204
+//	GET    /ServiceProviderConfig          -> ServiceProviderConfig
+//
+// SCIM Users are the users of the server, with the attributes id, userName, password (write-only),
+// active and groups (read-only). Tools deprovision users by setting active to false, which suspends
+// them, or with DELETE. Users created without a password get a random one, so they cannot log in
+// with a password until one is set. SCIM Groups are roles, with the attributes id, displayName and
+// members, the users holding the role directly. Other attributes, such as name or emails, are
+// accepted and ignored, as the server does not store them. userName and displayName cannot change.
+// Service accounts are left out, as they are not managed by the tools: replacing the members of a
+// group keeps those holding the role.
+//
+// Filters only support the eq operator on userName (for Users) or displayName (for Groups), which is
+// how provisioning tools look for existing resources. Listings without a filter go through all the
+// users or roles.
+//
+// Errors are reported as SCIM Error messages (RFC 7644, section 3.12).
+package scim
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+	"github.com/cooltech-bs/hsbc-assess-4/lib/middleware"
+)
+
+const (
+	userSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	groupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	configSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	listSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	errorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// Options customizes the Handler.
+type Options struct {
+	// Permission, if set, is required (through CheckPermission) of the bearer token of every request.
+	// Otherwise the endpoints are open to everyone, and the handler must be protected by other means.
+	Permission string
+	// BaseURL is the URL the handler is mounted at, such as "https://auth.example.com/scim/v2". If
+	// set, resources carry their location.
+	BaseURL string
+	// MaxResults caps the number of resources in a page of a listing. Defaults to 100.
+	MaxResults int
+	// MaxBodyBytes limits the size of request bodies. Defaults to 1 MiB, as replacing a group lists
+	// all its members.
+	MaxBodyBytes int64
+}
+
+// Handler serves the SCIM endpoints of an auth server.
+type Handler struct {
+	svr  *auth.Server
+	opts Options
+}
+
+// scimError is an error with its SCIM status and type.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+var (
+	errNotFound  = &scimError{status: http.StatusNotFound, detail: "resource not found"}
+	errBadMethod = &scimError{status: http.StatusMethodNotAllowed, detail: "method not allowed"}
+	errBadSyntax = &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request"}
+)
+
+// badRequest makes an error for a request that cannot be applied.
+func badRequest(scimType, detail string) error {
+	return &scimError{status: http.StatusBadRequest, scimType: scimType, detail: detail}
+}
+
+// NewHandler creates a Handler. opts can be nil.
+func NewHandler(svr *auth.Server, opts *Options) *Handler {
+	h := &Handler{svr: svr}
+	if opts != nil {
+		h.opts = *opts
+	}
+	h.opts.BaseURL = strings.TrimRight(h.opts.BaseURL, "/")
+	if h.opts.MaxResults <= 0 {
+		h.opts.MaxResults = 100
+	}
+	if h.opts.MaxBodyBytes <= 0 {
+		h.opts.MaxBodyBytes = 1 << 20
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes)
+	// Handlers are called on a copy, so that storage calls are canceled with the request
+	h = &Handler{svr: h.svr.WithContext(r.Context()), opts: h.opts}
+
+	var err error
+	switch {
+	case len(path) > 2:
+		err = errNotFound
+	case path[0] == "ServiceProviderConfig" && len(path) == 1:
+		// It describes the handler, so it is open like the discovery documents of OpenID Connect
+		err = h.serveConfig(w, r)
+	case path[0] == "Users" || path[0] == "Groups":
+		if err = h.checkPermission(r); err != nil {
+			break
+		}
+		if path[0] == "Users" {
+			err = h.serveUsers(w, r, path[1:])
+		} else {
+			err = h.serveGroups(w, r, path[1:])
+		}
+	default:
+		err = errNotFound
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// checkPermission enforces Options.Permission.
+func (h *Handler) checkPermission(r *http.Request) error {
+	if h.opts.Permission == "" {
+		return nil
+	}
+	token, err := middleware.BearerToken(r)
+	if err != nil {
+		return err
+	}
+	ok, err := h.svr.CheckPermission(token, h.opts.Permission)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return middleware.ErrForbidden
+	}
+	return nil
+}
+
+// *-* Resources *-*
+
+// ref points to another resource, as in the groups of a user and the members of a group.
+type ref struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+type listResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type patchRequest struct {
+	Operations []patchOp `json:"Operations"`
+}
+
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// location makes the URL of a resource, or "" without Options.BaseURL.
+func (h *Handler) location(endpoint string, id int64) string {
+	if h.opts.BaseURL == "" {
+		return ""
+	}
+	return h.opts.BaseURL + "/" + endpoint + "/" + strconv.FormatInt(id, 10)
+}
+
+// *-* Service provider configuration *-*
+
+type supported struct {
+	Supported bool `json:"supported"`
+}
+
+type bulkConfig struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type filterConfig struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type authScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type serviceProviderConfig struct {
+	Schemas               []string     `json:"schemas"`
+	Patch                 supported    `json:"patch"`
+	Bulk                  bulkConfig   `json:"bulk"`
+	Filter                filterConfig `json:"filter"`
+	ChangePassword        supported    `json:"changePassword"`
+	Sort                  supported    `json:"sort"`
+	ETag                  supported    `json:"etag"`
+	AuthenticationSchemes []authScheme `json:"authenticationSchemes"`
+}
+
+func (h *Handler) serveConfig(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errBadMethod
+	}
+	writeResource(w, http.StatusOK, serviceProviderConfig{
+		Schemas:        []string{configSchema},
+		Patch:          supported{true},
+		Filter:         filterConfig{Supported: true, MaxResults: h.opts.MaxResults},
+		ChangePassword: supported{true},
+		AuthenticationSchemes: []authScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer token",
+			Description: "A token of the auth server, in the Authorization header",
+		}},
+	})
+	return nil
+}
+
+// *-* Helpers *-*
+
+// page parses the pagination parameters of a listing (RFC 7644, section 3.4.2.4). startIndex is
+// 1-based.
+func (h *Handler) page(r *http.Request) (start, count int, err error) {
+	q := r.URL.Query()
+	start, count = 1, h.opts.MaxResults
+	if s := q.Get("startIndex"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil {
+			return 0, 0, badRequest("invalidValue", "invalid startIndex")
+		}
+		if start < 1 {
+			start = 1
+		}
+	}
+	if s := q.Get("count"); s != "" {
+		if count, err = strconv.Atoi(s); err != nil {
+			return 0, 0, badRequest("invalidValue", "invalid count")
+		}
+		if count < 0 {
+			count = 0
+		} else if count > h.opts.MaxResults {
+			count = h.opts.MaxResults
+		}
+	}
+	return start, count, nil
+}
+
+var filterRE = regexp.MustCompile(`(?i)^\s*(\S+)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// parseFilter parses the filter parameter of a listing, which can only compare attr for equality.
+//
+// Returns: the value to compare with, and whether there is a filter
+func parseFilter(r *http.Request, schema, attr string) (string, bool, error) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		return "", false, nil
+	}
+	m := filterRE.FindStringSubmatch(filter)
+	if m == nil || attrName(m[1], schema) != strings.ToLower(attr) {
+		return "", false, badRequest("invalidFilter", "only "+attr+` eq "..." is supported`)
+	}
+	var value string
+	if err := json.Unmarshal([]byte(m[2]), &value); err != nil {
+		return "", false, badRequest("invalidFilter", "invalid string")
+	}
+	return value, true, nil
+}
+
+// attrName normalizes the name of an attribute, which may be prefixed with its schema, since names
+// are case-insensitive (RFC 7643, section 2.1).
+func attrName(name, schema string) string {
+	name = strings.ToLower(name)
+	return strings.TrimPrefix(name, strings.ToLower(schema)+":")
+}
+
+// patchValues lists the attributes set by a patch operation, with their JSON values. Without a
+// path, the value holds the attributes.
+func patchValues(op *patchOp, schema string) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	if op.Path != "" {
+		values[attrName(op.Path, schema)] = op.Value
+		return values, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(op.Value, &raw); err != nil {
+		return nil, badRequest("invalidValue", "the value of an operation without a path must be an object")
+	}
+	for k, v := range raw {
+		values[attrName(k, schema)] = v
+	}
+	return values, nil
+}
+
+// readPatch reads a PatchOp message, with the operation names in lower case.
+func readPatch(r *http.Request) ([]patchOp, error) {
+	var req patchRequest
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		op.Op = strings.ToLower(op.Op)
+		if op.Op != "add" && op.Op != "replace" && op.Op != "remove" {
+			return nil, badRequest("invalidSyntax", "unknown operation "+strconv.Quote(op.Op))
+		}
+	}
+	return req.Operations, nil
+}
+
+// parseID parses the decimal ID of a resource.
+func parseID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// randomPassword makes a password nobody knows, for users created without one. The suffix has a
+// character of each class of auth.PasswordPolicy.
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", auth.ErrInternal
+	}
+	return base64.RawURLEncoding.EncodeToString(b) + "aA0!", nil
+}
+
+// readJSON decodes a request body. Unknown attributes are allowed, as clients send those of the
+// full schemas.
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadSyntax
+	}
+	return nil
+}
+
+func writeResource(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// errorOf maps errors from the auth and middleware packages to SCIM errors.
+func errorOf(err error) *scimError {
+	if e, ok := err.(*scimError); ok {
+		return e
+	}
+	e := &scimError{status: auth.HTTPStatus(err), detail: err.Error()}
+	switch {
+	case errors.Is(err, auth.ErrWeakPassword), errors.Is(err, auth.ErrBreachedPassword):
+		e.scimType = "invalidValue"
+	case errors.Is(err, auth.ErrUserExists), errors.Is(err, auth.ErrRoleExists):
+		e.scimType = "uniqueness"
+	}
+	if e.status == http.StatusInternalServerError {
+		// Do not leak the details of storage errors
+		e.detail = auth.ErrInternal.Error()
+	}
+	return e
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e := errorOf(err)
+	if e.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeResource(w, e.status, errorResponse{
+		Schemas:  []string{errorSchema},
+		Status:   strconv.Itoa(e.status),
+		ScimType: e.scimType,
+		Detail:   e.detail,
+	})
+}
@@ -0,0 +1,257 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+type userResource struct {
+	Schemas  []string `json:"schemas"`
+	ID       string   `json:"id,omitempty"`
+	UserName string   `json:"userName"`
+	Password string   `json:"password,omitempty"`
+	Active   *bool    `json:"active,omitempty"`
+	Groups   []ref    `json:"groups,omitempty"`
+	Meta     *meta    `json:"meta,omitempty"`
+}
+
+// userChange is what a request changes in a user.
+type userChange struct {
+	active   *bool
+	password string
+}
+
+func (h *Handler) serveUsers(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return h.listUsers(w, r)
+		case http.MethodPost:
+			return h.createUser(w, r)
+		}
+		return errBadMethod
+	}
+	n, ok := parseID(path[0])
+	if !ok {
+		return errNotFound
+	}
+	id := auth.UserID(n)
+	u := h.svr.GetUser(id)
+	if u == nil || u.Kind == auth.UserService {
+		return errNotFound
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeResource(w, http.StatusOK, h.newUserResource(u))
+		return nil
+	case http.MethodPut:
+		var req userResource
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		if req.UserName != "" && req.UserName != u.Name {
+			return badRequest("mutability", "userName cannot be changed")
+		}
+		// Unlike other attributes, active is kept when omitted, as clearing it has no meaning
+		if err := h.changeUser(id, &userChange{active: req.Active, password: req.Password}); err != nil {
+			return err
+		}
+	case http.MethodPatch:
+		ops, err := readPatch(r)
+		if err != nil {
+			return err
+		}
+		var c userChange
+		for i := range ops {
+			if err := patchUser(&c, u, &ops[i]); err != nil {
+				return err
+			}
+		}
+		if err := h.changeUser(id, &c); err != nil {
+			return err
+		}
+	case http.MethodDelete:
+		if err := h.svr.DeleteUser(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return errBadMethod
+	}
+	return h.writeUser(w, http.StatusOK, id)
+}
+
+func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request) error {
+	start, count, err := h.page(r)
+	if err != nil {
+		return err
+	}
+	name, filtered, err := parseFilter(r, userSchema, "userName")
+	if err != nil {
+		return err
+	}
+	res := listResponse{Schemas: []string{listSchema}, StartIndex: start, Resources: []interface{}{}}
+	add := func(u *auth.User) {
+		res.TotalResults++
+		if res.TotalResults >= start && len(res.Resources) < count {
+			res.Resources = append(res.Resources, h.newUserResource(u))
+		}
+	}
+	if filtered {
+		if u := h.svr.GetUserByName(name); u != nil && u.Kind != auth.UserService {
+			add(u)
+		}
+	} else {
+		opts := auth.ListOptions{Limit: auth.MaxListLimit}
+		for {
+			users, next, err := h.svr.ListUsers(&opts)
+			if err != nil {
+				return err
+			}
+			for _, u := range users {
+				if u.Deleted == nil && u.Kind != auth.UserService {
+					add(u)
+				}
+			}
+			if next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+	}
+	res.ItemsPerPage = len(res.Resources)
+	writeResource(w, http.StatusOK, res)
+	return nil
+}
+
+func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) error {
+	var req userResource
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.UserName == "" {
+		return badRequest("invalidValue", "userName is required")
+	}
+	password := req.Password
+	if password == "" {
+		var err error
+		if password, err = randomPassword(); err != nil {
+			return err
+		}
+	}
+	id, err := h.svr.CreateUser(req.UserName, password)
+	if err != nil {
+		return err
+	}
+	if err := h.changeUser(id, &userChange{active: req.Active}); err != nil {
+		return err
+	}
+	if loc := h.location("Users", int64(id)); loc != "" {
+		w.Header().Set("Location", loc)
+	}
+	return h.writeUser(w, http.StatusCreated, id)
+}
+
+// patchUser applies a patch operation to c. Attributes that are not stored are ignored.
+func patchUser(c *userChange, u *auth.User, op *patchOp) error {
+	if op.Op == "remove" {
+		return nil
+	}
+	values, err := patchValues(op, userSchema)
+	if err != nil {
+		return err
+	}
+	for attr, v := range values {
+		switch attr {
+		case "active":
+			active, err := parseBool(v)
+			if err != nil {
+				return err
+			}
+			c.active = &active
+		case "password":
+			if err := json.Unmarshal(v, &c.password); err != nil {
+				return badRequest("invalidValue", "password must be a string")
+			}
+		case "username":
+			var name string
+			if err := json.Unmarshal(v, &name); err != nil || name != u.Name {
+				return badRequest("mutability", "userName cannot be changed")
+			}
+		}
+	}
+	return nil
+}
+
+// changeUser applies a change to a user. The password is set first, as it may be rejected.
+func (h *Handler) changeUser(id auth.UserID, c *userChange) error {
+	if c.password != "" {
+		if err := h.svr.SetPassword(id, c.password); err != nil {
+			return err
+		}
+	}
+	if c.active == nil {
+		return nil
+	}
+	if *c.active {
+		return h.svr.ReactivateUser(id)
+	}
+	return h.svr.SuspendUser(id)
+}
+
+func (h *Handler) writeUser(w http.ResponseWriter, status int, id auth.UserID) error {
+	u := h.svr.GetUser(id)
+	if u == nil || u.Kind == auth.UserService {
+		return errNotFound
+	}
+	writeResource(w, status, h.newUserResource(u))
+	return nil
+}
+
+func (h *Handler) newUserResource(u *auth.User) *userResource {
+	active := u.Status == auth.UserActive
+	res := &userResource{
+		Schemas:  []string{userSchema},
+		ID:       strconv.FormatInt(int64(u.ID), 10),
+		UserName: u.Name,
+		Active:   &active,
+		Meta:     &meta{ResourceType: "User", Location: h.location("Users", int64(u.ID))},
+	}
+	ids := make([]auth.RoleID, 0, len(u.Roles))
+	for id := range u.Roles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		// Deleted roles are only removed from users lazily
+		if role := h.svr.GetRole(id); role != nil {
+			res.Groups = append(res.Groups, ref{
+				Value:   strconv.FormatInt(int64(id), 10),
+				Display: role.Name,
+				Ref:     h.location("Groups", int64(id)),
+			})
+		}
+	}
+	return res
+}
+
+// parseBool parses a boolean, which some clients send as a string such as "False".
+func parseBool(v json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	}
+	return false, badRequest("invalidValue", "active must be a boolean")
+}
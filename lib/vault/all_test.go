@@ -0,0 +1,176 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// fakeVault serves the transit endpoints of a key named "auth", wrapping keys in base64.
+func fakeVault() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var in map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/auth":
+			key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": key, "ciphertext": "vault:v1:" + key}})
+		case "/v1/transit/decrypt/auth":
+			key := strings.TrimPrefix(in["ciphertext"].(string), "vault:v1:")
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": key}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+		}
+	}))
+}
+
+func TestTransit(t *testing.T) {
+	srv := fakeVault()
+	defer srv.Close()
+	client := New(&Config{Addr: srv.URL, Token: "s.token"})
+	{
+		key, wrapped, err := client.Transit("", "auth").GenerateDataKey(context.Background())
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 32, len(key), "should decode the key")
+		assert.Equal(t, true, strings.HasPrefix(string(wrapped), "vault:v1:"), "should keep the ciphertext of Vault")
+		unwrapped, err := client.Transit("", "auth").DecryptDataKey(context.Background(), wrapped)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, key, unwrapped, "should decrypt data keys")
+		svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, KeyProvider: client.Transit("transit", "auth"), Hasher: &auth.BcryptHasher{Cost: 4}})
+		svr.CreateUser("anna", "passw0rd")
+		_, err = svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, nil, err, "should encrypt and decrypt with Vault")
+	}
+	{
+		_, _, err := New(&Config{Addr: srv.URL, Token: "wrong"}).Transit("", "auth").GenerateDataKey(context.Background())
+		assert.Contains(t, err.Error(), "permission denied", "should report the errors of Vault")
+	}
+}
+
+// fakeSecrets serves the KV secrets and database credentials of SecretPaths, and the renewals of
+// their leases. Renewals of the database lease are extended by the durations in renewals, in turn.
+type fakeSecrets struct {
+	mu        sync.Mutex
+	tokenTTL  int
+	issued    int
+	renewals  []int
+	leases    []string
+	increment string
+}
+
+func (f *fakeSecrets) serve() *httptest.Server {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("j", 32)))
+	kv := map[string]map[string]interface{}{
+		"/v1/secret/data/auth/jwt":       {"algorithm": "HS256", "key": key, "issuer": "auth.example.com"},
+		"/v1/secret/data/auth/peppers":   {"current": "2024-02", "2024-01": key, "2024-02": key, "version": 2},
+		"/v1/secret/data/auth/no-pepper": {"2024-01": key},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var in map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&in)
+		enc := json.NewEncoder(w)
+		switch {
+		case kv[r.URL.Path] != nil:
+			enc.Encode(map[string]interface{}{"data": map[string]interface{}{"data": kv[r.URL.Path]}})
+		case r.URL.Path == "/v1/database/creds/auth":
+			f.issued++
+			enc.Encode(map[string]interface{}{"lease_id": "database/creds/auth/" + strconv.Itoa(f.issued),
+				"lease_duration": 60, "renewable": true,
+				"data": map[string]string{"username": "v-auth-" + strconv.Itoa(f.issued), "password": "pw"}})
+		case r.URL.Path == "/v1/sys/leases/renew" && r.Method == http.MethodPut:
+			f.leases = append(f.leases, in["lease_id"].(string))
+			ttl := f.renewals[0]
+			f.renewals = f.renewals[1:]
+			enc.Encode(map[string]interface{}{"lease_id": in["lease_id"], "lease_duration": ttl, "renewable": true})
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			enc.Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": f.tokenTTL, "renewable": f.tokenTTL > 0}})
+		case r.URL.Path == "/v1/auth/token/renew-self":
+			f.increment = in["increment"].(string)
+			enc.Encode(map[string]interface{}{"auth": map[string]interface{}{"lease_duration": f.tokenTTL, "renewable": true}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(map[string][]string{"errors": {}})
+		}
+	}))
+}
+
+// tickClient gives a client whose renewals wait for ticks, telling how long they would wait.
+func tickClient(addr string) (c *Client, waits chan time.Duration, tick chan time.Time) {
+	c = New(&Config{Addr: addr, Token: "s.token"})
+	waits, tick = make(chan time.Duration, 1), make(chan time.Time)
+	c.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return tick
+	}
+	return c, waits, tick
+}
+
+func TestLoadSecrets(t *testing.T) {
+	f := &fakeSecrets{renewals: []int{60, 10}}
+	srv := f.serve()
+	defer srv.Close()
+	client, waits, tick := tickClient(srv.URL)
+	{
+		updated := make(chan *Credentials, 1)
+		secrets, err := client.LoadSecrets(context.Background(), &SecretPaths{JWT: "auth/jwt", Peppers: "auth/peppers",
+			Database: "database/creds/auth", OnDatabase: func(c *Credentials) { updated <- c }})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, "auth.example.com", secrets.JWT.Issuer, "should read the JWT config")
+		assert.Equal(t, 32, len(secrets.JWT.Key.([]byte)), "should decode the HMAC key")
+		assert.Equal(t, []string{"2024-02", "2024-01"}, []string{secrets.Peppers[0].ID, secrets.Peppers[1].ID}, "should put the current pepper first")
+		assert.Equal(t, &Credentials{Username: "v-auth-1", Password: "pw"}, secrets.Database(), "should read the database credentials")
+
+		cfg := &auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}}
+		secrets.Configure(cfg)
+		svr, err := auth.NewInMemoryServer(cfg)
+		assert.Equal(t, nil, err, "should configure the server")
+		svr.CreateUser("anna", "passw0rd")
+		token, _ := svr.Authenticate("anna", "passw0rd")
+		assert.Equal(t, 2, strings.Count(string(token), "."), "should issue JWTs")
+
+		assert.Equal(t, 30*time.Second, <-waits, "should renew at half the lease")
+		tick <- time.Now()
+		assert.Equal(t, 30*time.Second, <-waits, "should renew again")
+		tick <- time.Now()
+		assert.Equal(t, "v-auth-2", (<-updated).Username, "should read new credentials past the maximum TTL")
+		assert.Equal(t, 30*time.Second, <-waits, "should renew the new lease")
+		assert.Equal(t, "v-auth-2", secrets.Database().Username, "should give the new credentials")
+		secrets.Close()
+		assert.Equal(t, []string{"database/creds/auth/1", "database/creds/auth/1"}, f.leases, "should renew the lease")
+	}
+	{
+		f.tokenTTL = 3600
+		secrets, err := client.LoadSecrets(context.Background(), &SecretPaths{})
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, 30*time.Minute, <-waits, "should renew the token")
+		tick <- time.Now()
+		assert.Equal(t, 30*time.Minute, <-waits, "should renew the token again")
+		secrets.Close()
+		assert.Equal(t, "3600s", f.increment, "should renew the token for its TTL")
+	}
+	{
+		_, err := client.LoadSecrets(context.Background(), &SecretPaths{Peppers: "auth/no-pepper"})
+		assert.Contains(t, err.Error(), "no current pepper", "should require the current pepper")
+		_, err = client.LoadSecrets(context.Background(), &SecretPaths{JWT: "auth/missing"})
+		assert.Contains(t, err.Error(), "404", "should report missing secrets")
+	}
+}
@@ -0,0 +1,315 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// *-* Server secrets *-*
+
+// SecretPaths tells where the secrets of the server are in Vault, for LoadSecrets. Those with an
+// empty path are not read.
+type SecretPaths struct {
+	// KVMount is the mount of the KV version 2 engine holding JWT and Peppers. Defaults to "secret".
+	KVMount string
+	// JWT is the KV path of the signing key, with the fields "algorithm" (HS256, RS256 or EdDSA),
+	// "key" (in base64 for HS256, else a PEM private key), and optionally "issuer" and "kid".
+	JWT string
+	// Peppers is the KV path of the peppers, with a field per pepper named by its ID and holding its
+	// key in base64, and a "current" field naming the one for new hashes.
+	Peppers string
+	// Database is the path of leased database credentials with the fields "username" and "password",
+	// such as "database/creds/auth" of the database secrets engine.
+	Database string
+	// OnDatabase, if set, is called with new database credentials, read again when the lease of the
+	// previous ones reached its maximum TTL or failed to renew, so that new connections use them.
+	OnDatabase func(*Credentials)
+	// OnError, if set, is called with the errors of the renewals, which are retried sooner.
+	OnError func(error)
+}
+
+// Credentials are the database credentials of Secrets.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Secrets are the secrets of the server loaded by LoadSecrets.
+type Secrets struct {
+	JWT     *auth.JWTConfig
+	Peppers []auth.Pepper
+
+	mu       sync.Mutex
+	database *Credentials
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+var errNotRenewable = errors.New("vault: lease is not renewable")
+
+// lease is that of a secret or of a token, renewed by keep.
+type lease struct {
+	id        string
+	ttl       time.Duration
+	renewable bool
+}
+
+// LoadSecrets reads the secrets of the server, then keeps renewing the lease of the database
+// credentials, and that of the token of the client if it is renewable, until Close. Leases are
+// renewed when half of their duration is over.
+//
+// Returns: the secrets
+// Errors: any error from the requests, or a secret missing fields
+func (c *Client) LoadSecrets(ctx context.Context, paths *SecretPaths) (*Secrets, error) {
+	s := &Secrets{}
+	var err error
+	if paths.JWT != "" {
+		if s.JWT, err = c.readJWT(ctx, paths.KVMount, paths.JWT); err != nil {
+			return nil, err
+		}
+	}
+	if paths.Peppers != "" {
+		if s.Peppers, err = c.readPeppers(ctx, paths.KVMount, paths.Peppers); err != nil {
+			return nil, err
+		}
+	}
+	var db lease
+	if paths.Database != "" {
+		if s.database, db, err = c.readCredentials(ctx, paths.Database); err != nil {
+			return nil, err
+		}
+	}
+	var self struct {
+		TTL       int64 `json:"ttl"`
+		Renewable bool  `json:"renewable"`
+	}
+	if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &self); err != nil {
+		return nil, err
+	}
+	token := lease{ttl: time.Duration(self.TTL) * time.Second, renewable: self.Renewable}
+
+	onError := paths.OnError
+	if onError == nil {
+		onError = func(error) {}
+	}
+	renewCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		c.keep(renewCtx, token, c.renewToken, nil, onError)
+	}()
+	go func() {
+		defer s.wg.Done()
+		c.keep(renewCtx, db, c.renewLease, func(ctx context.Context) (lease, error) {
+			creds, l, err := c.readCredentials(ctx, paths.Database)
+			if err != nil {
+				return lease{}, err
+			}
+			s.mu.Lock()
+			s.database = creds
+			s.mu.Unlock()
+			if paths.OnDatabase != nil {
+				paths.OnDatabase(creds)
+			}
+			return l, nil
+		}, onError)
+	}()
+	return s, nil
+}
+
+// Configure sets the JWT signing key and the peppers of a config, those that were loaded.
+func (s *Secrets) Configure(cfg *auth.ServerConfig) {
+	if s.JWT != nil {
+		cfg.JWT = s.JWT
+	}
+	if s.Peppers != nil {
+		cfg.Peppers = s.Peppers
+	}
+}
+
+// Database gives the current database credentials, or nil if they were not loaded.
+func (s *Secrets) Database() *Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.database
+}
+
+// Close stops the renewals. The leases are left to expire.
+func (s *Secrets) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// ReadKV reads the latest version of a secret of the KV version 2 engine, e.g. written by
+// "vault kv put -mount=secret auth/jwt key=...". The mount defaults to "secret".
+//
+// Returns: the string fields of the secret
+// Errors: any error from the request, or of the response
+func (c *Client) ReadKV(ctx context.Context, mount, path string) (map[string]string, error) {
+	if mount == "" {
+		mount = "secret"
+	}
+	var out struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, strings.Trim(mount, "/")+"/data/"+strings.Trim(path, "/"), nil, &out); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(out.Data))
+	for name, v := range out.Data {
+		if s, ok := v.(string); ok {
+			fields[name] = s
+		}
+	}
+	return fields, nil
+}
+
+func (c *Client) readJWT(ctx context.Context, mount, path string) (*auth.JWTConfig, error) {
+	fields, err := c.ReadKV(ctx, mount, path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &auth.JWTConfig{Algorithm: auth.JWTAlgorithm(fields["algorithm"]), Issuer: fields["issuer"], KeyID: fields["kid"]}
+	if cfg.Algorithm == auth.HS256 {
+		cfg.Key, err = base64.StdEncoding.DecodeString(fields["key"])
+	} else {
+		cfg.Key, err = parsePrivateKey(fields["key"])
+	}
+	if err != nil || fields["key"] == "" {
+		return nil, fmt.Errorf("vault: invalid JWT key in %s", path)
+	}
+	return cfg, nil
+}
+
+// parsePrivateKey parses a PEM private key, in PKCS #8, or PKCS #1 for RSA.
+func parsePrivateKey(s string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func (c *Client) readPeppers(ctx context.Context, mount, path string) ([]auth.Pepper, error) {
+	fields, err := c.ReadKV(ctx, mount, path)
+	if err != nil {
+		return nil, err
+	}
+	current := fields["current"]
+	if _, ok := fields[current]; !ok || current == "current" {
+		return nil, fmt.Errorf("vault: no current pepper in %s", path)
+	}
+	ids := make([]string, 0, len(fields)-1)
+	for id := range fields {
+		if id != "current" {
+			ids = append(ids, id)
+		}
+	}
+	// The current one first, then the others for older hashes
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == current) != (ids[j] == current) {
+			return ids[i] == current
+		}
+		return ids[i] > ids[j]
+	})
+	peppers := make([]auth.Pepper, len(ids))
+	for i, id := range ids {
+		if peppers[i].Key, err = base64.StdEncoding.DecodeString(fields[id]); err != nil {
+			return nil, fmt.Errorf("vault: invalid pepper %s in %s", id, path)
+		}
+		peppers[i].ID = id
+	}
+	return peppers, nil
+}
+
+func (c *Client) readCredentials(ctx context.Context, path string) (*Credentials, lease, error) {
+	res, err := c.send(ctx, http.MethodGet, strings.Trim(path, "/"), nil)
+	if err != nil {
+		return nil, lease{}, err
+	}
+	var creds Credentials
+	if err := json.Unmarshal(res.Data, &creds); err != nil || creds.Username == "" {
+		return nil, lease{}, fmt.Errorf("vault: no database credentials in %s", path)
+	}
+	return &creds, lease{id: res.LeaseID, ttl: time.Duration(res.LeaseDuration) * time.Second, renewable: res.Renewable}, nil
+}
+
+// renewLease renews the lease of a secret for another increment.
+func (c *Client) renewLease(ctx context.Context, l lease, increment time.Duration) (lease, error) {
+	res, err := c.send(ctx, http.MethodPut, "sys/leases/renew",
+		map[string]interface{}{"lease_id": l.id, "increment": int64(increment / time.Second)})
+	if err != nil {
+		return lease{}, err
+	}
+	return lease{id: res.LeaseID, ttl: time.Duration(res.LeaseDuration) * time.Second, renewable: res.Renewable}, nil
+}
+
+// renewToken renews the token of the client for another increment.
+func (c *Client) renewToken(ctx context.Context, _ lease, increment time.Duration) (lease, error) {
+	res, err := c.send(ctx, http.MethodPost, "auth/token/renew-self",
+		map[string]string{"increment": fmt.Sprintf("%ds", int64(increment/time.Second))})
+	if err != nil {
+		return lease{}, err
+	}
+	if res.Auth == nil {
+		return lease{}, errNotRenewable
+	}
+	return lease{ttl: time.Duration(res.Auth.LeaseDuration) * time.Second, renewable: res.Auth.Renewable}, nil
+}
+
+// keep renews a lease when half of its duration is over, until ctx is done. With refresh set, a
+// lease that fails to renew, or is not extended as long as before, as past its maximum TTL, is
+// replaced by a new secret. After an error, it tries again when half of the time left is over,
+// until there is less than a second.
+func (c *Client) keep(ctx context.Context, l lease,
+	renew func(context.Context, lease, time.Duration) (lease, error),
+	refresh func(context.Context) (lease, error), onError func(error)) {
+	if !l.renewable && refresh == nil {
+		return
+	}
+	full := l.ttl
+	for l.ttl > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.after(l.ttl / 2):
+		}
+		var next lease
+		err := errNotRenewable
+		if l.renewable {
+			next, err = renew(ctx, l, full)
+		}
+		if refresh != nil && (err != nil || next.ttl < full) {
+			if next, err = refresh(ctx); err == nil {
+				full = next.ttl
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			onError(err)
+			if l.ttl /= 2; l.ttl < time.Second {
+				return
+			}
+			continue
+		}
+		l = next
+	}
+}
@@ -0,0 +1,192 @@
+// Package vault integrates the auth server with HashiCorp Vault. LoadSecrets reads the JWT signing
+// key, the peppers and the database credentials of the server at startup, and keeps their leases
+// renewed, so that they are neither in the environment nor in config files. Transit wraps the data
+// keys of auth.ServerConfig.KeyProvider with the transit secrets engine, so that the master key
+// encrypting secrets at rest never leaves Vault.
+//
+//	client := vault.New(&vault.Config{Addr: "https://vault.example.com:8200", Token: token})
+//	secrets, err := client.LoadSecrets(ctx, &vault.SecretPaths{JWT: "auth/jwt", Peppers: "auth/peppers"})
+//	defer secrets.Close()
+//	cfg := &auth.ServerConfig{TokenExpireSec: 3600, KeyProvider: client.Transit("transit", "auth")}
+//	secrets.Configure(cfg)
+//	svr, err := auth.NewServer(cfg, store)
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+// Config configures a Client. Fields default to the VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE
+// environment variables, as for the Vault CLI.
+type Config struct {
+	// Addr is the URL of the Vault server. Defaults to https://127.0.0.1:8200 without VAULT_ADDR.
+	Addr  string
+	Token string
+	// Namespace is that of Vault Enterprise, if any.
+	Namespace string
+	// HTTPClient makes the requests. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// Client calls the HTTP API of Vault.
+type Client struct {
+	cfg Config
+	// after waits between lease renewals, as time.After
+	after func(time.Duration) <-chan time.Time
+}
+
+// New creates a Client. A nil cfg takes the defaults.
+func New(cfg *Config) *Client {
+	c := &Client{after: time.After}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	if c.cfg.Addr == "" {
+		c.cfg.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if c.cfg.Addr == "" {
+		c.cfg.Addr = "https://127.0.0.1:8200"
+	}
+	c.cfg.Addr = strings.TrimRight(c.cfg.Addr, "/")
+	if c.cfg.Token == "" {
+		c.cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if c.cfg.Namespace == "" {
+		c.cfg.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if c.cfg.HTTPClient == nil {
+		c.cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return c
+}
+
+// response is the body of the responses of Vault. Secrets with a lease, as of the database engine,
+// tell it next to their data, and renewed tokens in auth.
+type response struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int64           `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		LeaseDuration int64 `json:"lease_duration"`
+		Renewable     bool  `json:"renewable"`
+	} `json:"auth"`
+}
+
+// do calls the API at a path below /v1/, and decodes the "data" of the response into out, if set.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	res, err := c.send(ctx, method, path, in)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(res.Data, out)
+}
+
+// send calls the API at a path below /v1/.
+//
+// Returns: the response, empty if it has no body
+// Errors: any error from the request, or those of Vault
+func (c *Client) send(ctx context.Context, method, path string, in interface{}) (*response, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.Addr+"/v1/"+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.cfg.Token)
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return nil, fmt.Errorf("vault %s %s: %s: %s", method, path, res.Status, strings.Join(e.Errors, "; "))
+	}
+	out := &response{}
+	if res.StatusCode == http.StatusNoContent {
+		return out, nil
+	}
+	return out, json.NewDecoder(res.Body).Decode(out)
+}
+
+// *-* Transit *-*
+
+// TransitKeyProvider is an auth.KeyProvider backed by a key of the transit secrets engine.
+type TransitKeyProvider struct {
+	c     *Client
+	mount string
+	key   string
+}
+
+var _ auth.KeyProvider = (*TransitKeyProvider)(nil)
+
+// Transit gives the KeyProvider of a transit key, e.g. made with "vault write -f transit/keys/auth".
+// The mount defaults to "transit". The token needs the update capability on the datakey/plaintext
+// and decrypt endpoints of the key.
+func (c *Client) Transit(mount, key string) *TransitKeyProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &TransitKeyProvider{c: c, mount: strings.Trim(mount, "/"), key: key}
+}
+
+// GenerateDataKey asks Vault for a new 256-bit data key.
+//
+// Returns: the key in the clear, and its ciphertext ("vault:v1:...")
+// Errors: any error from the request, or of the response
+func (p *TransitKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	var out struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	path := p.mount + "/datakey/plaintext/" + url.PathEscape(p.key)
+	if err := p.c.do(ctx, http.MethodPost, path, map[string]int{"bits": 256}, &out); err != nil {
+		return nil, nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, []byte(out.Ciphertext), nil
+}
+
+// DecryptDataKey asks Vault to decrypt a data key. Keys rotated in Vault keep decrypting as long as
+// their version is not below min_decryption_version.
+//
+// Returns: the key in the clear
+// Errors: any error from the request, or of the response
+func (p *TransitKeyProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	path := p.mount + "/decrypt/" + url.PathEscape(p.key)
+	if err := p.c.do(ctx, http.MethodPost, path, map[string]string{"ciphertext": string(wrapped)}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+var secret = []byte("s3cr3t")
+
+// receiver answers with the given status codes in turn, then 204, and keeps the verified events.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	events   []auth.Event
+	attempts int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.attempts++
+	if len(rc.statuses) > 0 {
+		w.WriteHeader(rc.statuses[0])
+		rc.statuses = rc.statuses[1:]
+		return
+	}
+	body, err := Verify(r, secret, time.Minute)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var e auth.Event
+	_ = json.Unmarshal(body, &e)
+	if r.Header.Get(HeaderEvent) == string(e.Type) {
+		rc.events = append(rc.events, e)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestDeliver(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusBadGateway, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	{
+		_, err := New("ftp://example.com/", nil)
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should only accept HTTP URLs")
+		_, err = New(srv.URL, &Options{MaxAttempts: -1})
+		assert.Equal(t, auth.ErrInvalidConfig, err, "should check the options")
+	}
+	{
+		hook, _ := New(srv.URL, &Options{Secret: secret, Backoff: time.Millisecond})
+		hook.Deliver(auth.Event{Type: auth.EventUserCreated, User: 1, Name: "anna"})
+		assert.Equal(t, 3, rc.attempts, "should retry server errors")
+		assert.Equal(t, []auth.Event{{Type: auth.EventUserCreated, User: 1, Name: "anna"}}, rc.events, "should deliver a signed event")
+	}
+	{
+		var dropped error
+		rc.statuses = []int{http.StatusBadRequest}
+		rc.attempts = 0
+		hook, _ := New(srv.URL, &Options{Secret: secret, Backoff: time.Millisecond, OnError: func(e auth.Event, err error) { dropped = err }})
+		hook.Deliver(auth.Event{Type: auth.EventRoleCreated})
+		assert.Equal(t, 1, rc.attempts, "should not retry client errors")
+		assert.Equal(t, true, errors.Is(dropped, ErrStatus), "should report dropped events")
+
+		rc.attempts = 0
+		hook, _ = New(srv.URL, &Options{Secret: []byte("wrong"), MaxAttempts: 2, Backoff: time.Millisecond})
+		hook.Deliver(auth.Event{Type: auth.EventRoleCreated})
+		assert.Equal(t, 1, rc.attempts, "should be rejected with the wrong secret")
+	}
+	{
+		svr, _ := auth.NewInMemoryServer(&auth.ServerConfig{TokenExpireSec: 60, Hasher: &auth.BcryptHasher{Cost: 4}})
+		rc.events = nil
+		hook, _ := New(srv.URL, &Options{Secret: secret})
+		cancel := svr.Subscribe(hook.Deliver, auth.EventLoginFailed)
+		defer cancel()
+		svr.Authenticate("belle", "passw0rd")
+		assert.Eventually(t, func() bool {
+			rc.mu.Lock()
+			defer rc.mu.Unlock()
+			return len(rc.events) == 1 && rc.events[0].Name == "belle"
+		}, time.Second, time.Millisecond, "should deliver the events of a server")
+	}
+}
+
+func unix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func TestVerify(t *testing.T) {
+	body := `{"type":"user.created"}`
+	newRequest := func(ts time.Time, sig string) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set(HeaderTimestamp, unix(ts))
+		r.Header.Set(HeaderSignature, sig)
+		return r
+	}
+	now := time.Now()
+	{
+		got, err := Verify(newRequest(now, Sign(secret, unix(now), []byte(body))), secret, time.Minute)
+		assert.Equal(t, nil, err, "should success")
+		assert.Equal(t, body, string(got), "should return the body")
+	}
+	{
+		_, err := Verify(newRequest(now, Sign(secret, unix(now), []byte(body+" "))), secret, time.Minute)
+		assert.Equal(t, ErrBadSignature, err, "should check the body")
+		old := now.Add(-2 * time.Minute)
+		_, err = Verify(newRequest(old, Sign(secret, unix(old), []byte(body))), secret, time.Minute)
+		assert.Equal(t, ErrBadSignature, err, "should reject old requests")
+	}
+}
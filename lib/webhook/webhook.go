@@ -0,0 +1,190 @@
+// Package webhook posts the events of an auth.Server to HTTP endpoints, so that other systems can
+// follow changes without polling.
+//
+//	hook, err := webhook.New("https://hr.example.com/hooks/auth", &webhook.Options{Secret: secret})
+//	cancel := svr.Subscribe(hook.Deliver, auth.EventUserCreated, auth.EventUserDeleted)
+//
+// Each event is sent as JSON (see auth.Event) in a POST request, with the headers:
+//
+//	X-Webhook-Event:     the event type, e.g. "user.created"
+//	X-Webhook-Timestamp: the time of sending, in Unix seconds
+//	X-Webhook-Signature: "sha256=" and the hex HMAC-SHA256 of the timestamp, ".", and the body
+//
+// Receivers check the signature with Verify. Failed deliveries are retried with exponential
+// backoff, which holds back the following events of the subscription, so that they arrive in
+// order.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cooltech-bs/hsbc-assess-4/lib/auth"
+)
+
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Options configures a Webhook.
+type Options struct {
+	// Secret is the key of the signatures, shared with the receiver. Requests are not signed if it
+	// is empty.
+	Secret []byte
+	// Client sends the requests. Defaults to a client with a 10-second timeout.
+	Client *http.Client
+	// MaxAttempts is how many times an event is sent before it is dropped. Defaults to 5.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each of the next. Defaults to 1 second.
+	Backoff time.Duration
+	// OnError, if set, is called when an event is dropped, with the error of the last attempt.
+	OnError func(e auth.Event, err error)
+}
+
+// Webhook sends events to a URL.
+type Webhook struct {
+	url  string
+	opts Options
+}
+
+var (
+	ErrBadSignature = errors.New("bad webhook signature")
+	// ErrStatus is wrapped by the errors of deliveries that got an unexpected status code.
+	ErrStatus = errors.New("unexpected status code")
+)
+
+// New creates a Webhook sending to an http:// or https:// URL.
+//
+// Returns: pointer to the new webhook
+// Errors: auth.ErrInvalidConfig
+func New(target string, opts *Options) (*Webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, auth.ErrInvalidConfig
+	}
+	w := &Webhook{url: target}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.MaxAttempts < 0 || w.opts.Backoff < 0 {
+		return nil, auth.ErrInvalidConfig
+	}
+	if w.opts.Client == nil {
+		w.opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if w.opts.MaxAttempts == 0 {
+		w.opts.MaxAttempts = 5
+	}
+	if w.opts.Backoff == 0 {
+		w.opts.Backoff = time.Second
+	}
+	return w, nil
+}
+
+// Deliver sends an event, retrying until it is accepted or MaxAttempts is reached. It is meant to
+// be passed to auth.Server.Subscribe, and blocks until it is done.
+//
+// Returns: none
+func (w *Webhook) Deliver(e auth.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.fail(e, err)
+		return
+	}
+	delay := w.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.opts.MaxAttempts {
+			w.fail(e, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// send makes one attempt, and tells if a failure may pass on retry.
+func (w *Webhook) send(e auth.Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(e.Type))
+	req.Header.Set(HeaderTimestamp, ts)
+	if len(w.opts.Secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(w.opts.Secret, ts, body))
+	}
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// Drain the body, so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Other client errors would fail the same way again
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%w %d", ErrStatus, resp.StatusCode)
+}
+
+func (w *Webhook) fail(e auth.Event, err error) {
+	if w.opts.OnError != nil {
+		w.opts.OnError(e, err)
+	}
+}
+
+// Sign computes the X-Webhook-Signature of a request.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a webhook request, for receivers. Requests signed more than maxAge
+// ago (or in the future by as much) are rejected, so that a captured request cannot be replayed
+// later. The body is read and returned.
+//
+// Returns: the body of the request
+// Errors: ErrBadSignature, or any error reading the body
+func Verify(r *http.Request, secret []byte, maxAge time.Duration) ([]byte, error) {
+	ts := r.Header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > maxAge || age < -maxAge {
+		return nil, ErrBadSignature
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	sig := r.Header.Get(HeaderSignature)
+	if !strings.HasPrefix(sig, "sha256=") || !hmac.Equal([]byte(sig), []byte(Sign(secret, ts, body))) {
+		return nil, ErrBadSignature
+	}
+	return body, nil
+}